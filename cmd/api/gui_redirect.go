@@ -23,7 +23,6 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/sapcc/go-bits/httpext"
 
 	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
@@ -31,6 +30,7 @@ import (
 
 // guiRedirecter is an api.API that implements the GUI redirect.
 type guiRedirecter struct {
+	cfg    keppel.Configuration
 	db     *keppel.DB
 	urlStr string
 }
@@ -77,8 +77,8 @@ func (g *guiRedirecter) tryRedirectToGUI(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	for _, policy := range policies {
-		ip := httpext.GetRequesterIPFor(r)
-		if policy.Matches(ip, repo.FullName(), auth.AnonymousUserIdentity.UserName()) {
+		ip := keppel.GetRequesterIP(r, g.cfg.TrustedProxyNetworks)
+		if policy.Matches(ip, repo.FullName(), auth.AnonymousUserIdentity.UserName(), nil) {
 			//do the redirect
 			s := g.urlStr
 			s = strings.Replace(s, "%AUTH_TENANT_ID%", account.AuthTenantID, -1)
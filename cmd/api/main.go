@@ -27,7 +27,6 @@ import (
 	"time"
 
 	"github.com/dlmiddlecote/sqlstats"
-	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
@@ -41,10 +40,12 @@ import (
 
 	auth "github.com/sapcc/keppel/internal/api/auth"
 	"github.com/sapcc/keppel/internal/api/clairproxy"
+	healthapi "github.com/sapcc/keppel/internal/api/health"
 	keppelv1 "github.com/sapcc/keppel/internal/api/keppel"
 	peerv1 "github.com/sapcc/keppel/internal/api/peer"
 	registryv2 "github.com/sapcc/keppel/internal/api/registry"
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 // AddCommandTo mounts this command into the command hierarchy.
@@ -67,11 +68,12 @@ func run(cmd *cobra.Command, args []string) {
 
 	db := must.Return(keppel.InitDB(cfg.DatabaseURL))
 	must.Succeed(setupDBIfRequested(db))
-	rc := must.Return(initRedis())
+	rc := must.Return(keppel.InitRedis())
 	ad := must.Return(keppel.NewAuthDriver(osext.MustGetenv("KEPPEL_DRIVER_AUTH"), rc))
 	fd := must.Return(keppel.NewFederationDriver(osext.MustGetenv("KEPPEL_DRIVER_FEDERATION"), ad, cfg))
-	sd := must.Return(keppel.NewStorageDriver(osext.MustGetenv("KEPPEL_DRIVER_STORAGE"), ad, cfg))
-	icd := must.Return(keppel.NewInboundCacheDriver(osext.MustGetenv("KEPPEL_DRIVER_INBOUND_CACHE"), cfg))
+	sdName := osext.MustGetenv("KEPPEL_DRIVER_STORAGE")
+	sd := keppel.WithStorageMetrics(must.Return(keppel.NewStorageDriver(sdName, ad, cfg)), sdName)
+	icd := must.Return(keppel.NewInboundCacheDriver(osext.MustGetenv("KEPPEL_DRIVER_INBOUND_CACHE"), cfg, rc))
 
 	prometheus.MustRegister(sqlstats.NewStatsCollector("keppel", db.DbMap.Db))
 
@@ -81,50 +83,83 @@ func run(cmd *cobra.Command, args []string) {
 		rle = &keppel.RateLimitEngine{Driver: rld, Client: rc}
 	}
 
-	//start background goroutines
+	//in read-only mode, all writes are refused (e.g. during DB migrations or incident response)
+	if cfg.ReadOnly {
+		logg.Info("KEPPEL_READONLY is set: rejecting all write requests and not running peering")
+	}
+
+	//start background goroutines (peering writes into the DB, so it is skipped in read-only mode)
 	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
-	runPeering(ctx, cfg, db)
-
-	//wire up HTTP handlers
-	corsMiddleware := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Content-Type", "User-Agent", "Authorization", "X-Auth-Token", "X-Keppel-Sublease-Token"},
-	})
-	handler := httpapi.Compose(
-		keppelv1.NewAPI(cfg, ad, fd, sd, icd, db, auditor),
+	if !cfg.ReadOnly {
+		runPeering(ctx, cfg, db)
+	}
+	//NOTE: In read-only mode, the registry API does not record any pulls, so these flushers do not have anything to write.
+	pc := keppel.NewPullCounter(db)
+	flushers := []*keppel.PeriodicFlusher{
+		keppel.StartPeriodicFlusher(10*time.Second, "manifest pull counts", pc.Flush),
+	}
+	lpd := keppel.NewLastPulledDebouncer(db)
+	if cfg.LastPulledDebounceInterval > 0 {
+		flushers = append(flushers, keppel.StartPeriodicFlusher(cfg.LastPulledDebounceInterval, "last_pulled_at timestamps", lpd.Flush))
+	}
+
+	//wire up HTTP handlers (the upstream fetch limit is shared by all APIs that can trigger replication)
+	ufl := processor.NewUpstreamFetchLimiter(cfg.MaxConcurrentUpstreamFetches)
+	corsMiddleware := cors.New(must.Return(keppel.ParseCORSOptions()))
+	apis := []httpapi.API{
+		keppelv1.NewAPI(cfg, ad, fd, sd, icd, db, auditor, ufl),
 		auth.NewAPI(cfg, ad, fd, db),
-		registryv2.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle),
+		registryv2.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle, pc, lpd, ufl),
 		peerv1.NewAPI(cfg, ad, db),
 		clairproxy.NewAPI(cfg, ad),
 		&headerReflector{logg.ShowDebug}, //the header reflection endpoint is only enabled where debugging is enabled (i.e. usually in dev/QA only)
-		&guiRedirecter{db, os.Getenv("KEPPEL_GUI_URI")},
+		&guiRedirecter{cfg, db, os.Getenv("KEPPEL_GUI_URI")},
 		httpapi.HealthCheckAPI{SkipRequestLog: true},
+		healthapi.NewAPI(db, sd),
 		httpapi.WithGlobalMiddleware(corsMiddleware.Handler),
-	)
+		httpapi.WithGlobalMiddleware(keppel.RequestIDMiddleware),
+	}
+	if cfg.ReadOnly {
+		apis = append(apis, httpapi.WithGlobalMiddleware(keppel.ReadOnlyMiddleware))
+	}
+	switch logFormat := osext.GetenvOrDefault("KEPPEL_LOG_FORMAT", "text"); logFormat {
+	case "text":
+		//use the default request log of httpapi.Compose()
+	case "json":
+		//this middleware is added last to wrap all others, so that it sees the final response
+		apis = append(apis,
+			httpapi.WithoutLogging(),
+			httpapi.WithGlobalMiddleware(keppel.JSONRequestLogMiddleware(os.Stderr, cfg.TrustedProxyNetworks)),
+		)
+	default:
+		logg.Fatal("malformed KEPPEL_LOG_FORMAT: expected \"text\" or \"json\", but got %q", logFormat)
+	}
+	handler := httpapi.Compose(apis...)
 	http.Handle("/", handler)
 	http.Handle("/metrics", promhttp.Handler())
 
 	//start HTTP server
 	apiListenAddress := osext.GetenvOrDefault("KEPPEL_API_LISTEN_ADDRESS", ":8080")
-	err := httpext.ListenAndServeContext(ctx, apiListenAddress, nil)
-	if err != nil {
-		logg.Fatal("error returned from httpext.ListenAndServeContext(): %s", err.Error())
+	if cfg.PeeringMode == keppel.PeeringModeMTLS {
+		err := listenAndServeWithClientCerts(ctx, apiListenAddress, *cfg.PeeringCertificate)
+		if err != nil {
+			logg.Fatal("error returned from listenAndServeWithClientCerts(): %s", err.Error())
+		}
+	} else {
+		err := httpext.ListenAndServeContext(ctx, apiListenAddress, nil)
+		if err != nil {
+			logg.Fatal("error returned from httpext.ListenAndServeContext(): %s", err.Error())
+		}
 	}
-}
 
-// Note that, since Redis is optional, this may return (nil, nil).
-func initRedis() (*redis.Client, error) {
-	if !osext.GetenvBool("KEPPEL_REDIS_ENABLE") {
-		return nil, nil
-	}
-	opts, err := keppel.GetRedisOptions("KEPPEL")
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse Redis URL: %s", err.Error())
+	//the HTTP server has finished all requests, so no more pulls can be
+	//recorded and the buffered pull statistics can be written one last time
+	for _, flusher := range flushers {
+		flusher.Stop()
 	}
-	return redis.NewClient(opts), nil
 }
 
+// Note that, since Redis is optional, this may return (nil, nil).
 func setupDBIfRequested(db *keppel.DB) error {
 	//This method performs specialized first-time setup for conformance test
 	//scenarios where we always start with a fresh empty database.
@@ -20,11 +20,14 @@ package apicmd
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/sqlext"
@@ -35,10 +38,24 @@ import (
 
 func runPeering(ctx context.Context, cfg keppel.Configuration, db *keppel.DB) {
 	isPeerHostName := make(map[string]bool)
-	for _, hostName := range strings.Split(os.Getenv("KEPPEL_PEERS"), ",") {
-		hostName = strings.TrimSpace(hostName)
-		if hostName != "" {
-			isPeerHostName[hostName] = true
+	certFingerprintForPeer := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("KEPPEL_PEERS"), ",") {
+		//in mTLS mode, each entry looks like "hostname=fingerprint"
+		hostName, fingerprint, hasFingerprint := strings.Cut(strings.TrimSpace(entry), "=")
+		if hostName == "" {
+			continue
+		}
+		isPeerHostName[hostName] = true
+
+		if cfg.PeeringMode == keppel.PeeringModeMTLS {
+			if !hasFingerprint {
+				logg.Fatal("malformed KEPPEL_PEERS: expected entries of the form \"hostname=fingerprint\" in mTLS peering mode, but got %q", entry)
+			}
+			var err error
+			certFingerprintForPeer[hostName], err = keppel.ParseCertificateFingerprint(fingerprint)
+			if err != nil {
+				logg.Fatal("malformed KEPPEL_PEERS: cannot parse entry for %s: %s", hostName, err.Error())
+			}
 		}
 	}
 
@@ -53,6 +70,10 @@ func runPeering(ctx context.Context, cfg keppel.Configuration, db *keppel.DB) {
 			`INSERT INTO peers (hostname) VALUES ($1) ON CONFLICT DO NOTHING`,
 			peerHostName,
 		))
+		_ = must.Return(db.Exec(
+			`UPDATE peers SET their_cert_fingerprint = $1 WHERE hostname = $2`,
+			certFingerprintForPeer[peerHostName], peerHostName,
+		))
 	}
 
 	//remove old entries from `peers` table
@@ -64,6 +85,13 @@ func runPeering(ctx context.Context, cfg keppel.Configuration, db *keppel.DB) {
 		}
 	}
 
+	//in mTLS mode, there are no passwords to rotate
+	if cfg.PeeringMode == keppel.PeeringModeMTLS {
+		return
+	}
+
+	prometheus.MustRegister(peeringCollector{db})
+
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
 		defer ticker.Stop()
@@ -86,7 +114,8 @@ func runPeering(ctx context.Context, cfg keppel.Configuration, db *keppel.DB) {
 // will not work as expected.
 var getNextPeerQuery = sqlext.SimplifyWhitespace(`
 	SELECT * FROM peers
-	 WHERE last_peered_at < $1 OR last_peered_at IS NULL
+	 WHERE (last_peered_at < $1 OR last_peered_at IS NULL)
+	   AND (next_peering_at < $2 OR next_peering_at IS NULL)
 	 ORDER BY COALESCE(last_peered_at, TO_TIMESTAMP(-1)) ASC LIMIT 1
 	   FOR UPDATE SKIP LOCKED
 `)
@@ -100,7 +129,8 @@ func tryIssueNewPasswordForPeer(cfg keppel.Configuration, db *keppel.DB) error {
 
 	//select next peer that needs a new password, if any
 	var peer keppel.Peer
-	err = tx.SelectOne(&peer, getNextPeerQuery, time.Now().Add(-10*time.Minute))
+	now := time.Now()
+	err = tx.SelectOne(&peer, getNextPeerQuery, now.Add(-10*time.Minute), now)
 	if err == sql.ErrNoRows {
 		//nothing to do
 		//nolint:errcheck
@@ -114,3 +144,91 @@ func tryIssueNewPasswordForPeer(cfg keppel.Configuration, db *keppel.DB) error {
 	//issue password (this will also commit the transaction)
 	return tasks.IssueNewPasswordForPeer(cfg, db, tx, peer)
 }
+
+var peeringAgeDesc = prometheus.NewDesc(
+	"keppel_peer_seconds_since_last_peering",
+	"Number of seconds since the last successful peering with the given peer.",
+	[]string{"hostname"}, nil,
+)
+
+var peeringBackoffDesc = prometheus.NewDesc(
+	"keppel_peer_in_backoff",
+	"Whether peering with the given peer is currently delayed because of previous failures (0 or 1).",
+	[]string{"hostname"}, nil,
+)
+
+// peeringCollector is a prometheus.Collector that reports the age of the
+// last successful peering with each peer, and whether further attempts are
+// currently being delayed. The values are computed at scrape time, so that
+// the age keeps increasing when peering stops working.
+type peeringCollector struct {
+	db *keppel.DB
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c peeringCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peeringAgeDesc
+	ch <- peeringBackoffDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c peeringCollector) Collect(ch chan<- prometheus.Metric) {
+	var peers []keppel.Peer
+	_, err := c.db.Select(&peers, `SELECT * FROM peers`)
+	if err != nil {
+		logg.Error("cannot collect peering metrics: " + err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, peer := range peers {
+		if peer.LastPeeredAt != nil {
+			ch <- prometheus.MustNewConstMetric(
+				peeringAgeDesc, prometheus.GaugeValue,
+				now.Sub(*peer.LastPeeredAt).Seconds(), peer.HostName,
+			)
+		}
+		inBackoff := 0.0
+		if peer.NextPeeringAt != nil && peer.NextPeeringAt.After(now) {
+			inBackoff = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			peeringBackoffDesc, prometheus.GaugeValue,
+			inBackoff, peer.HostName,
+		)
+	}
+}
+
+// In mTLS peering mode, keppel-api needs to terminate TLS by itself in order
+// to see the client certificates presented by peers. Client certificates are
+// requested, but neither required nor verified against a CA: Requests without
+// a client certificate are handled as usual, and client certificates are only
+// accepted if their fingerprint belongs to one of our peers (see
+// auth.IncomingRequest.Authorize).
+func listenAndServeWithClientCerts(ctx context.Context, addr string, cert tls.Certificate) error {
+	server := &http.Server{
+		Addr: addr,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	shutdownErrChan := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		logg.Info("Shutting down HTTP server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		shutdownErrChan <- server.Shutdown(shutdownCtx)
+	}()
+
+	logg.Info("Listening on %s (with TLS)...", addr)
+	err := server.ListenAndServeTLS("", "")
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownErrChan
+}
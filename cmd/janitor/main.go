@@ -22,6 +22,8 @@ import (
 	"context"
 	"database/sql"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/dlmiddlecote/sqlstats"
@@ -47,12 +49,17 @@ func AddCommandTo(parent *cobra.Command) {
 		Args:  cobra.NoArgs,
 		Run:   run,
 	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "gc-dry-run <account-name>...",
+		Short: "Show what the GC policies of the given accounts would delete.",
+		Long:  "Evaluate the GC policies of the given accounts without deleting anything. The projected outcome is written into the GC status of each manifest, where it can be inspected through the Keppel API.",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runGCDryRun,
+	})
 	parent.AddCommand(cmd)
 }
 
-func run(cmd *cobra.Command, args []string) {
-	keppel.SetTaskName("janitor")
-
+func setupJanitor() (*tasks.Janitor, keppel.Configuration, *keppel.DB) {
 	cfg := keppel.ParseConfiguration()
 	auditor := keppel.InitAuditTrail()
 
@@ -60,25 +67,79 @@ func run(cmd *cobra.Command, args []string) {
 	ad := must.Return(keppel.NewAuthDriver(osext.MustGetenv("KEPPEL_DRIVER_AUTH"), nil))
 	fd := must.Return(keppel.NewFederationDriver(osext.MustGetenv("KEPPEL_DRIVER_FEDERATION"), ad, cfg))
 	sd := must.Return(keppel.NewStorageDriver(osext.MustGetenv("KEPPEL_DRIVER_STORAGE"), ad, cfg))
-	icd := must.Return(keppel.NewInboundCacheDriver(osext.MustGetenv("KEPPEL_DRIVER_INBOUND_CACHE"), cfg))
+	rc := must.Return(keppel.InitRedis())
+	icd := must.Return(keppel.NewInboundCacheDriver(osext.MustGetenv("KEPPEL_DRIVER_INBOUND_CACHE"), cfg, rc))
+
+	janitor := tasks.NewJanitor(cfg, fd, sd, icd, db, auditor)
+	if thresholdStr := os.Getenv("KEPPEL_JANITOR_ABANDONED_UPLOAD_THRESHOLD"); thresholdStr != "" {
+		threshold, err := time.ParseDuration(thresholdStr)
+		if err != nil || threshold <= 0 {
+			logg.Fatal("malformed KEPPEL_JANITOR_ABANDONED_UPLOAD_THRESHOLD: expected a positive duration like \"24h\"")
+		}
+		janitor.SetAbandonedUploadThreshold(threshold)
+	}
+
+	intervals := tasks.DefaultTaskIntervals()
+	if graceStr := os.Getenv("KEPPEL_JANITOR_BLOB_GRACE_PERIOD"); graceStr != "" {
+		grace, err := time.ParseDuration(graceStr)
+		if err != nil || grace <= 0 {
+			logg.Fatal("malformed KEPPEL_JANITOR_BLOB_GRACE_PERIOD: expected a positive duration like \"30m\"")
+		}
+		//unless configured explicitly below, the sweep intervals follow the grace period
+		intervals.BlobGracePeriod = grace
+		intervals.BlobMountSweep = 2 * grace
+		intervals.BlobSweep = 2 * grace
+	}
+	for envVar, target := range map[string]*time.Duration{
+		"KEPPEL_JANITOR_INTERVAL_FEDERATION_ANNOUNCEMENT": &intervals.FederationAnnouncement,
+		"KEPPEL_JANITOR_INTERVAL_BLOB_MOUNT_SWEEP":        &intervals.BlobMountSweep,
+		"KEPPEL_JANITOR_INTERVAL_BLOB_SWEEP":              &intervals.BlobSweep,
+		"KEPPEL_JANITOR_INTERVAL_IMAGE_GC":                &intervals.GarbageCollection,
+		"KEPPEL_JANITOR_INTERVAL_MANIFEST_SIZE_CHECK":     &intervals.ManifestSizeCheck,
+		"KEPPEL_JANITOR_INTERVAL_MANIFEST_SYNC":           &intervals.ManifestSync,
+		"KEPPEL_JANITOR_INTERVAL_STORAGE_SWEEP":           &intervals.StorageSweep,
+	} {
+		if intervalStr := os.Getenv(envVar); intervalStr != "" {
+			interval, err := time.ParseDuration(intervalStr)
+			if err != nil || interval <= 0 {
+				logg.Fatal("malformed %s: expected a positive duration like \"1h\"", envVar)
+			}
+			*target = interval
+		}
+	}
+	err := intervals.Validate()
+	if err != nil {
+		logg.Fatal("invalid janitor configuration: %s", err.Error())
+	}
+	janitor.SetTaskIntervals(intervals)
+
+	workerCount, err := strconv.Atoi(osext.GetenvOrDefault("KEPPEL_JANITOR_WORKERS", "1"))
+	if err != nil || workerCount < 1 {
+		logg.Fatal("malformed KEPPEL_JANITOR_WORKERS: expected a positive integer")
+	}
+	janitor.SetWorkerCount(workerCount)
+
+	return janitor, cfg, db
+}
+
+func run(cmd *cobra.Command, args []string) {
+	keppel.SetTaskName("janitor")
+	janitor, cfg, db := setupJanitor()
 
 	prometheus.MustRegister(sqlstats.NewStatsCollector("keppel", db.DbMap.Db))
+	accountMetricsTTL, err := time.ParseDuration(osext.GetenvOrDefault("KEPPEL_JANITOR_ACCOUNT_METRICS_CACHE_TTL", "5m"))
+	if err != nil || accountMetricsTTL < 0 {
+		logg.Fatal("malformed KEPPEL_JANITOR_ACCOUNT_METRICS_CACHE_TTL: expected a non-negative duration like \"5m\"")
+	}
+	prometheus.MustRegister(tasks.NewAccountMetricsCollector(db, accountMetricsTTL))
 
 	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
 
-	//start task loops
-	janitor := tasks.NewJanitor(cfg, fd, sd, icd, db, auditor)
-	go jobLoop(janitor.AnnounceNextAccountToFederation)
-	go jobLoop(janitor.DeleteNextAbandonedUpload)
-	go jobLoop(janitor.GarbageCollectManifestsInNextRepo)
-	go jobLoop(janitor.SweepBlobMountsInNextRepo)
-	go jobLoop(janitor.SweepBlobsInNextAccount)
-	go jobLoop(janitor.SweepStorageInNextAccount)
-	go jobLoop(janitor.SyncManifestsInNextRepo)
-	go jobLoop(janitor.ValidateNextBlob)
-	go jobLoop(janitor.ValidateNextManifest)
-	if cfg.ClairClient != nil {
-		go jobLoop(janitor.CheckVulnerabilitiesForNextManifest)
+	//start task loops (all janitor tasks write into the DB, so none of them run in read-only mode)
+	if cfg.ReadOnly {
+		logg.Info("KEPPEL_READONLY is set: not running any janitor tasks")
+	} else {
+		startJobLoops(janitor, cfg)
 	}
 
 	//start HTTP server for Prometheus metrics and health check
@@ -86,12 +147,35 @@ func run(cmd *cobra.Command, args []string) {
 	http.Handle("/", handler)
 	http.Handle("/metrics", promhttp.Handler())
 	listenAddress := osext.GetenvOrDefault("KEPPEL_JANITOR_LISTEN_ADDRESS", ":8080")
-	err := httpext.ListenAndServeContext(ctx, listenAddress, nil)
+	err = httpext.ListenAndServeContext(ctx, listenAddress, nil)
 	if err != nil {
 		logg.Fatal("error returned from httpext.ListenAndServeContext(): %s", err.Error())
 	}
 }
 
+func startJobLoops(janitor *tasks.Janitor, cfg keppel.Configuration) {
+	//these tasks lock the repo or account that they work on, so they can run in
+	//multiple workers concurrently
+	for idx := 0; idx < janitor.WorkerCount(); idx++ {
+		go jobLoop(janitor.AnnounceNextAccountToFederation)
+		go jobLoop(janitor.CheckManifestSizesInNextRepo)
+		go jobLoop(janitor.GarbageCollectManifestsInNextRepo)
+		go jobLoop(janitor.SweepBlobMountsInNextRepo)
+		go jobLoop(janitor.SweepBlobsInNextAccount)
+		go jobLoop(janitor.SweepStorageInNextAccount)
+		go jobLoop(janitor.SyncManifestsInNextRepo)
+	}
+
+	go jobLoop(janitor.DeleteNextAbandonedUpload)
+	go jobLoop(janitor.PurgeExpiredDeletedManifests)
+	go jobLoop(janitor.PurgeOldManifestPullStats)
+	go jobLoop(janitor.ValidateNextBlob)
+	go jobLoop(janitor.ValidateNextManifest)
+	if cfg.ClairClient != nil {
+		go jobLoop(janitor.CheckVulnerabilitiesForNextManifest)
+	}
+}
+
 // Execute a task repeatedly, but slow down when sql.ErrNoRows is returned by it.
 // (Tasks use this error value to indicate that nothing needs scraping, so we
 // can back off a bit to avoid useless database load.)
@@ -111,3 +195,31 @@ func jobLoop(task func() error) {
 		}
 	}
 }
+
+func runGCDryRun(cmd *cobra.Command, args []string) {
+	keppel.SetTaskName("janitor-gc-dry-run")
+	janitor, _, db := setupJanitor()
+
+	for _, accountName := range args {
+		account, err := keppel.FindAccount(db, accountName)
+		if err != nil {
+			logg.Fatal("cannot find account %q: %s", accountName, err.Error())
+		}
+		if account == nil {
+			logg.Fatal("no such account: %q", accountName)
+		}
+
+		var repos []keppel.Repository
+		_, err = db.Select(&repos, `SELECT * FROM repos WHERE account_name = $1 ORDER BY name`, account.Name)
+		if err != nil {
+			logg.Fatal("cannot list repos in account %q: %s", account.Name, err.Error())
+		}
+		for _, repo := range repos {
+			err := janitor.DryRunGarbageCollectManifestsInRepo(repo)
+			if err != nil {
+				logg.Fatal(err.Error())
+			}
+			logg.Info("GC dry run completed for repo %s", repo.FullName())
+		}
+	}
+}
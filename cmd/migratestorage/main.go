@@ -0,0 +1,128 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package migratestoragecmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/must"
+	"github.com/sapcc/go-bits/osext"
+	"github.com/sapcc/go-bits/sqlext"
+	"github.com/spf13/cobra"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// targetEnvPrefix is the prefix for environment variables that configure the
+// target storage driver differently from the source storage driver.
+const targetEnvPrefix = "KEPPEL_MIGRATION_TARGET_"
+
+var longDesc = strings.TrimSpace(`
+Copies all blobs and manifests from one storage driver to another, e.g. when moving
+to a different storage backend. Configuration is read from environment variables
+as described in README.md, with the storage driver named in KEPPEL_DRIVER_STORAGE
+being replaced by the given source and target drivers. Both drivers read their
+configuration from the usual environment variables, but for the target driver,
+each variable KEPPEL_MIGRATION_TARGET_FOO overrides the variable FOO.
+
+Blob contents are verified against the digests recorded in the database, and
+manifest contents are verified against their digests. Objects that already exist
+in the target storage are skipped, so an interrupted migration can be resumed by
+running this command again. The migration only reads from the database and the
+source storage, so it is safe to run while keppel-api is in read-only mode.
+`)
+
+// AddCommandTo mounts this command into the command hierarchy.
+func AddCommandTo(parent *cobra.Command) {
+	cmd := &cobra.Command{
+		Use:     "migrate-storage <source-driver> <target-driver>",
+		Example: "  keppel server migrate-storage swift gcs",
+		Short:   "Copies all blobs and manifests from one storage driver to another.",
+		Long:    longDesc,
+		Args:    cobra.ExactArgs(2),
+		Run:     run,
+	}
+	parent.AddCommand(cmd)
+}
+
+// NOTE: Blobs in other accounts may refer to this account's storage contents
+// through cross-account deduplication, so they need to be considered as well.
+var findBlobByStorageIDQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM blobs
+	 WHERE ((account_name = $1 AND storage_account_name = '') OR storage_account_name = $1) AND storage_id = $2
+	 ORDER BY id LIMIT 1
+`)
+
+func run(cmd *cobra.Command, args []string) {
+	keppel.SetTaskName("migrate-storage")
+
+	cfg := keppel.ParseConfiguration()
+	db := must.Return(keppel.InitDB(cfg.DatabaseURL))
+	ad := must.Return(keppel.NewAuthDriver(osext.MustGetenv("KEPPEL_DRIVER_AUTH"), nil))
+	source := must.Return(keppel.NewStorageDriver(args[0], ad, cfg))
+	applyTargetEnvOverrides()
+	target := must.Return(keppel.NewStorageDriver(args[1], ad, cfg))
+
+	var accounts []keppel.Account
+	_, err := db.Select(&accounts, `SELECT * FROM accounts ORDER BY name`)
+	if err != nil {
+		logg.Fatal("cannot list accounts: %s", err.Error())
+	}
+
+	m := storageMigration{
+		Source: source,
+		Target: target,
+		FindBlob: func(account keppel.Account, storageID string) (*keppel.Blob, error) {
+			var blob keppel.Blob
+			err := db.SelectOne(&blob, findBlobByStorageIDQuery, account.Name, storageID)
+			return &blob, err
+		},
+	}
+	failed := false
+	for _, account := range accounts {
+		logg.Info("migrating account %s", account.Name)
+		err := m.MigrateAccount(account)
+		if err != nil {
+			logg.Error(err.Error())
+			failed = true
+		}
+	}
+
+	s := m.Stats
+	logg.Info("migration finished: copied %d blobs and %d manifests, skipped %d blobs and %d manifests, failed on %d blobs and %d manifests",
+		s.CopiedBlobs, s.CopiedManifests, s.SkippedBlobs, s.SkippedManifests, s.FailedBlobs, s.FailedManifests)
+	if failed || s.FailedBlobs > 0 || s.FailedManifests > 0 {
+		os.Exit(1)
+	}
+}
+
+// applyTargetEnvOverrides sets each variable FOO to the value of
+// KEPPEL_MIGRATION_TARGET_FOO (if set). This is called after the source
+// driver has been initialized, so that the target driver can use a different
+// configuration, e.g. a different container in the same Swift account.
+func applyTargetEnvOverrides() {
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, targetEnvPrefix) {
+			must.Succeed(os.Setenv(strings.TrimPrefix(key, targetEnvPrefix), value))
+		}
+	}
+}
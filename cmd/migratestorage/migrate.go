@@ -0,0 +1,214 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package migratestoragecmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// defaultChunkSize is the size of the chunks in which blobs are written into
+// the target storage. Blobs are never held in memory as a whole; this only
+// limits the size of individual objects in storages that store each chunk
+// separately.
+const defaultChunkSize uint64 = 256 << 20 //256 MiB
+
+// storageMigration copies all blobs and manifests of accounts from one
+// storage driver to another.
+type storageMigration struct {
+	Source keppel.StorageDriver
+	Target keppel.StorageDriver
+	//FindBlob returns the DB record for the blob with the given storage ID, or
+	//sql.ErrNoRows if there is none. The blob digest from the DB is used to
+	//verify the blob contents while copying.
+	FindBlob  func(account keppel.Account, storageID string) (*keppel.Blob, error)
+	ChunkSize uint64
+	Stats     migrationStats
+}
+
+type migrationStats struct {
+	CopiedBlobs      int
+	CopiedManifests  int
+	SkippedBlobs     int
+	SkippedManifests int
+	FailedBlobs      int
+	FailedManifests  int
+}
+
+// MigrateAccount copies all blobs and manifests of the given account from
+// the source to the target storage. Objects that already exist in the target
+// storage are skipped, so an interrupted migration can be resumed by running
+// it again. Errors on individual objects are logged and counted in m.Stats,
+// but do not abort the migration of the remaining objects.
+func (m *storageMigration) MigrateAccount(account keppel.Account) error {
+	srcBlobs, srcManifests, err := m.Source.ListStorageContents(account)
+	if err != nil {
+		return fmt.Errorf("cannot list contents of source storage for account %s: %w", account.Name, err)
+	}
+	tgtBlobs, tgtManifests, err := m.Target.ListStorageContents(account)
+	if err != nil {
+		return fmt.Errorf("cannot list contents of target storage for account %s: %w", account.Name, err)
+	}
+
+	//key = storage ID, value = same semantics as keppel.StoredBlobInfo.ChunkCount
+	tgtBlobChunkCounts := make(map[string]uint32, len(tgtBlobs))
+	for _, blob := range tgtBlobs {
+		tgtBlobChunkCounts[blob.StorageID] = blob.ChunkCount
+	}
+	tgtManifestExists := make(map[keppel.StoredManifestInfo]bool, len(tgtManifests))
+	for _, manifest := range tgtManifests {
+		tgtManifestExists[manifest] = true
+	}
+
+	for _, blob := range srcBlobs {
+		m.migrateBlob(account, blob, tgtBlobChunkCounts)
+	}
+	for _, manifest := range srcManifests {
+		if tgtManifestExists[manifest] {
+			logg.Debug("skipping manifest %s/%s@%s: already exists in target storage", account.Name, manifest.RepoName, manifest.Digest)
+			m.Stats.SkippedManifests++
+			continue
+		}
+		err := m.copyManifest(account, manifest)
+		if err != nil {
+			logg.Error("cannot copy manifest %s/%s@%s: %s", account.Name, manifest.RepoName, manifest.Digest, err.Error())
+			m.Stats.FailedManifests++
+		} else {
+			logg.Info("copied manifest %s/%s@%s", account.Name, manifest.RepoName, manifest.Digest)
+			m.Stats.CopiedManifests++
+		}
+	}
+	return nil
+}
+
+func (m *storageMigration) migrateBlob(account keppel.Account, blob keppel.StoredBlobInfo, tgtBlobChunkCounts map[string]uint32) {
+	//uploads that are still in progress cannot be copied meaningfully (if the
+	//API is read-only, they will be cleaned up as abandoned uploads later)
+	if blob.ChunkCount > 0 {
+		logg.Info("skipping blob %s/%s: upload is still in progress", account.Name, blob.StorageID)
+		m.Stats.SkippedBlobs++
+		return
+	}
+	tgtChunkCount, exists := tgtBlobChunkCounts[blob.StorageID]
+	if exists && tgtChunkCount == 0 {
+		logg.Debug("skipping blob %s/%s: already exists in target storage", account.Name, blob.StorageID)
+		m.Stats.SkippedBlobs++
+		return
+	}
+
+	dbBlob, err := m.FindBlob(account, blob.StorageID)
+	if err == sql.ErrNoRows {
+		//without a DB record, we cannot verify the contents; the blob will be
+		//removed by the storage sweep anyway
+		logg.Info("skipping blob %s/%s: not referenced in the database", account.Name, blob.StorageID)
+		m.Stats.SkippedBlobs++
+		return
+	}
+	if err == nil {
+		//a previous run may have been interrupted while copying this blob
+		if exists {
+			err = m.Target.AbortBlobUpload(account, blob.StorageID, tgtChunkCount)
+		}
+		if err == nil {
+			err = m.copyBlob(account, *dbBlob)
+		}
+	}
+	if err != nil {
+		logg.Error("cannot copy blob %s/%s: %s", account.Name, blob.StorageID, err.Error())
+		m.Stats.FailedBlobs++
+	} else {
+		logg.Info("copied blob %s/%s (%s, %d bytes)", account.Name, blob.StorageID, dbBlob.Digest, dbBlob.SizeBytes)
+		m.Stats.CopiedBlobs++
+	}
+}
+
+func (m *storageMigration) copyBlob(account keppel.Account, blob keppel.Blob) (returnErr error) {
+	expectedDigest, err := digest.Parse(blob.Digest)
+	if err != nil {
+		return fmt.Errorf("cannot parse digest %q from database: %w", blob.Digest, err)
+	}
+	reader, sizeBytes, err := m.Source.ReadBlob(account, blob.StorageID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if sizeBytes != blob.SizeBytes {
+		return fmt.Errorf("expected %d bytes, but source storage has %d bytes", blob.SizeBytes, sizeBytes)
+	}
+
+	verifier := expectedDigest.Verifier()
+	contents := io.TeeReader(reader, verifier)
+	chunkSize := m.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	var chunkNumber uint32
+	defer func() {
+		if returnErr != nil && chunkNumber > 0 {
+			abortErr := m.Target.AbortBlobUpload(account, blob.StorageID, chunkNumber)
+			if abortErr != nil {
+				logg.Error("additional error encountered when aborting upload of blob %s/%s into target storage: %s",
+					account.Name, blob.StorageID, abortErr.Error())
+			}
+		}
+	}()
+
+	//NOTE: The loop runs at least once, so that empty blobs also get one (empty) chunk.
+	remaining := sizeBytes
+	for chunkNumber == 0 || remaining > 0 {
+		chunkLength := chunkSize
+		if remaining < chunkLength {
+			chunkLength = remaining
+		}
+		chunkNumber++
+		err := m.Target.AppendToBlob(account, blob.StorageID, chunkNumber, &chunkLength, io.LimitReader(contents, int64(chunkLength)))
+		if err != nil {
+			return err
+		}
+		remaining -= chunkLength
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("contents in source storage do not match digest %s", expectedDigest)
+	}
+	return m.Target.FinalizeBlob(account, blob.StorageID, chunkNumber)
+}
+
+func (m *storageMigration) copyManifest(account keppel.Account, manifest keppel.StoredManifestInfo) error {
+	expectedDigest, err := digest.Parse(manifest.Digest)
+	if err != nil {
+		return err
+	}
+	contents, err := m.Source.ReadManifest(account, manifest.RepoName, manifest.Digest)
+	if err != nil {
+		return err
+	}
+	actualDigest := expectedDigest.Algorithm().FromBytes(contents)
+	if actualDigest != expectedDigest {
+		return fmt.Errorf("contents in source storage have digest %s", actualDigest)
+	}
+	return m.Target.WriteManifest(account, manifest.RepoName, manifest.Digest, contents)
+}
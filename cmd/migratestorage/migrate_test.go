@@ -0,0 +1,167 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package migratestoragecmd
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	_ "github.com/sapcc/keppel/internal/drivers/trivial"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestMigrateStorage(t *testing.T) {
+	account := keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+	source := mustNewInMemoryStorage(t)
+	target := mustNewInMemoryStorage(t)
+
+	//fill the source storage with some blobs and manifests (one of each is
+	//corrupted, and there are also some blobs that cannot be copied)
+	dbBlobs := make(map[string]*keppel.Blob)
+	putBlob := func(storageID string, contents []byte, expected test.Bytes) {
+		t.Helper()
+		mustDo(t, source.AppendToBlob(account, storageID, 1, nil, bytes.NewReader(contents)))
+		mustDo(t, source.FinalizeBlob(account, storageID, 1))
+		dbBlobs[storageID] = &keppel.Blob{
+			AccountName: account.Name,
+			Digest:      expected.Digest.String(),
+			SizeBytes:   uint64(len(expected.Contents)),
+			StorageID:   storageID,
+		}
+	}
+	blob1 := test.NewBytes([]byte("the first blob, which is larger than one chunk"))
+	blob2 := test.NewBytes([]byte("the second blob"))
+	emptyBlob := test.NewBytes(nil)
+	corruptedBlob := test.NewBytes([]byte("the blob that is corrupted"))
+	putBlob("blob1", blob1.Contents, blob1)
+	putBlob("blob2", blob2.Contents, blob2)
+	putBlob("empty", emptyBlob.Contents, emptyBlob)
+	putBlob("corrupted", []byte("the blob that is Corrupted"), corruptedBlob)
+	//blob without DB record
+	mustDo(t, source.AppendToBlob(account, "orphaned", 1, nil, strings.NewReader("orphaned blob")))
+	mustDo(t, source.FinalizeBlob(account, "orphaned", 1))
+	//blob upload that is still in progress
+	mustDo(t, source.AppendToBlob(account, "uploading", 1, nil, strings.NewReader("upload in progress")))
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	mustDo(t, source.WriteManifest(account, "foo", image.Manifest.Digest.String(), image.Manifest.Contents))
+	mustDo(t, source.WriteManifest(account, "foo/bar", image.Manifest.Digest.String(), image.Manifest.Contents))
+	corruptedManifestDigest := test.NewBytes([]byte("something else")).Digest.String()
+	mustDo(t, source.WriteManifest(account, "foo", corruptedManifestDigest, image.Manifest.Contents))
+
+	//simulate an earlier migration run that was interrupted while copying blob2
+	mustDo(t, target.AppendToBlob(account, "blob2", 1, nil, strings.NewReader("the sec")))
+
+	newMigration := func() *storageMigration {
+		return &storageMigration{
+			Source: source,
+			Target: target,
+			FindBlob: func(account keppel.Account, storageID string) (*keppel.Blob, error) {
+				blob, exists := dbBlobs[storageID]
+				if !exists {
+					return nil, sql.ErrNoRows
+				}
+				return blob, nil
+			},
+			ChunkSize: 10,
+		}
+	}
+
+	//first run copies everything that can be copied
+	m := newMigration()
+	mustDo(t, m.MigrateAccount(account))
+	assert.DeepEqual(t, "stats after first run", m.Stats, migrationStats{
+		CopiedBlobs:      3,
+		CopiedManifests:  2,
+		SkippedBlobs:     2, //"orphaned" and "uploading"
+		SkippedManifests: 0,
+		FailedBlobs:      1,
+		FailedManifests:  1,
+	})
+
+	//check content parity
+	for _, storageID := range []string{"blob1", "blob2", "empty"} {
+		expectBlobContents(t, target, account, storageID, dbBlobs[storageID])
+	}
+	for _, repoName := range []string{"foo", "foo/bar"} {
+		contents, err := target.ReadManifest(account, repoName, image.Manifest.Digest.String())
+		mustDo(t, err)
+		assert.DeepEqual(t, "manifest contents in "+repoName, contents, image.Manifest.Contents)
+	}
+
+	//objects that failed verification were not written into the target
+	blobs, manifests, err := target.ListStorageContents(account)
+	mustDo(t, err)
+	if len(blobs) != 3 {
+		t.Errorf("expected 3 blobs in target storage, but got %#v", blobs)
+	}
+	if len(manifests) != 2 {
+		t.Errorf("expected 2 manifests in target storage, but got %#v", manifests)
+	}
+
+	//a second run skips everything that was already copied
+	m = newMigration()
+	mustDo(t, m.MigrateAccount(account))
+	assert.DeepEqual(t, "stats after second run", m.Stats, migrationStats{
+		CopiedBlobs:      0,
+		CopiedManifests:  0,
+		SkippedBlobs:     5,
+		SkippedManifests: 2,
+		FailedBlobs:      1,
+		FailedManifests:  1,
+	})
+}
+
+func mustNewInMemoryStorage(t *testing.T) keppel.StorageDriver {
+	t.Helper()
+	sd, err := keppel.NewStorageDriver("in-memory-for-testing", nil, keppel.Configuration{})
+	mustDo(t, err)
+	return sd
+}
+
+func expectBlobContents(t *testing.T, sd keppel.StorageDriver, account keppel.Account, storageID string, blob *keppel.Blob) {
+	t.Helper()
+	reader, sizeBytes, err := sd.ReadBlob(account, storageID)
+	if err != nil {
+		t.Errorf("expected blob %s to exist in target storage, but got: %s", storageID, err.Error())
+		return
+	}
+	defer reader.Close()
+	contents, err := io.ReadAll(reader)
+	mustDo(t, err)
+	if sizeBytes != blob.SizeBytes || uint64(len(contents)) != blob.SizeBytes {
+		t.Errorf("expected blob %s to have %d bytes, but got %d bytes", storageID, blob.SizeBytes, len(contents))
+	}
+	if actual := test.NewBytes(contents).Digest.String(); actual != blob.Digest {
+		t.Errorf("expected blob %s to have digest %s, but got %s", storageID, blob.Digest, actual)
+	}
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -53,8 +53,7 @@ type TestCase struct {
 	CannotDelete bool
 	RBACPolicy   keppel.RBACPolicy
 	//result
-	GrantedActions   string
-	AdditionalScopes []string
+	GrantedActions string
 }
 
 var (
@@ -149,21 +148,19 @@ var testCases = []TestCase{
 		CannotDelete: true, GrantedActions: "pull,push"},
 	{Scope: "repository:test1/foo:delete",
 		CannotDelete: true, GrantedActions: ""},
-	//catalog access always allowed if username/password are ok (access to
-	//specific accounts is filtered later)
+	//catalog access always allowed (access to specific repos is filtered later)
 	{Scope: "registry:catalog:*",
-		GrantedActions:   "*",
-		AdditionalScopes: []string{"keppel_account:test1:view"}},
+		GrantedActions: "*"},
 	{Scope: "registry:catalog:*",
 		CannotPull: true, GrantedActions: "*"},
 	{Scope: "registry:catalog:*",
-		CannotPush: true, GrantedActions: "*",
-		AdditionalScopes: []string{"keppel_account:test1:view"}},
+		CannotPush: true, GrantedActions: "*"},
 	{Scope: "registry:catalog:*",
 		CannotPull: true, CannotPush: true, GrantedActions: "*"},
 	{Scope: "registry:catalog:*",
-		CannotDelete: true, GrantedActions: "*",
-		AdditionalScopes: []string{"keppel_account:test1:view"}},
+		CannotDelete: true, GrantedActions: "*"},
+	{Scope: "registry:catalog:*", AnonymousLogin: true,
+		GrantedActions: "*"},
 	//unknown resources/actions for resource type "registry"
 	{Scope: "registry:test1/foo:pull",
 		GrantedActions: ""},
@@ -624,16 +621,6 @@ func TestIssueToken(t *testing.T) {
 				Actions: strings.Split(c.GrantedActions, ","),
 			}}
 		}
-		if len(c.AdditionalScopes) > 0 {
-			for _, scope := range c.AdditionalScopes {
-				fields := strings.SplitN(scope, ":", 3)
-				expectedContents.Access = append(expectedContents.Access, jwtAccess{
-					Type:    fields[0],
-					Name:    fields[1],
-					Actions: strings.Split(fields[2], ","),
-				})
-			}
-		}
 		req.ExpectBody = expectedContents
 
 		//execute request
@@ -819,8 +806,7 @@ func TestAnycastAndDomainRemappedTokens(t *testing.T) {
 			},
 		}.Check(t, h1)
 
-		//test that catalog access is allowed for domain-remapped APIs, but only
-		//for the account name specified in the domain
+		//test that catalog access is allowed for domain-remapped APIs
 		assert.HTTPRequest{
 			Method:       "GET",
 			Path:         fmt.Sprintf("/keppel/v1/auth?service=test1.%s&scope=registry:catalog:*", localService1),
@@ -832,7 +818,6 @@ func TestAnycastAndDomainRemappedTokens(t *testing.T) {
 				Subject:  "correctusername",
 				Access: []jwtAccess{
 					{Type: "registry", Name: "catalog", Actions: []string{"*"}},
-					{Type: "keppel_account", Name: "test1", Actions: []string{"view"}},
 				},
 			},
 		}.Check(t, h1)
@@ -847,7 +832,6 @@ func TestAnycastAndDomainRemappedTokens(t *testing.T) {
 				Subject:  "correctusername",
 				Access: []jwtAccess{
 					{Type: "registry", Name: "catalog", Actions: []string{"*"}},
-					//no keppel_account:test1:view since the API is restricted to the non-existent account "something-else"
 				},
 			},
 		}.Check(t, h1)
@@ -929,11 +913,6 @@ func TestMultiScope(t *testing.T) {
 				Name:    "catalog",
 				Actions: []string{"*"},
 			},
-			{
-				Type:    "keppel_account",
-				Name:    "test1",
-				Actions: []string{"view"},
-			},
 		}),
 	}.Check(t, h)
 }
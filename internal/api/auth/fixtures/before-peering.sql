@@ -1 +1 @@
-INSERT INTO peers (hostname, our_password, their_current_password_hash, their_previous_password_hash, last_peered_at) VALUES ('peer.example.org', '', '', '', NULL);
+INSERT INTO peers (hostname, our_password, their_current_password_hash, their_previous_password_hash, last_peered_at, their_cert_fingerprint, consecutive_peering_failures, next_peering_at) VALUES ('peer.example.org', '', '', '', NULL, '', 0, NULL);
@@ -19,7 +19,10 @@
 package authapi_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -122,3 +125,86 @@ func TestPeeringAPI(t *testing.T) {
 		easypg.AssertDBContent(t, s.DB.DbMap.Db, "fixtures/after-peering.sql")
 	})
 }
+
+func TestPeerAuthWithClientCertificate(t *testing.T) {
+	peerCert := test.GenerateCertificate(t, "peer.example.org")
+	otherCert := test.GenerateCertificate(t, "peer.example.org") //same name, but different key
+
+	//since assert.HTTPRequest cannot simulate a TLS connection, we need to build
+	//these requests manually
+	getToken := func(h http.Handler, cert tls.Certificate) *httptest.ResponseRecorder {
+		t.Helper()
+		query := url.Values{
+			"service": {"registry.example.org"},
+			"scope":   {"repository:test1/foo:pull"},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/keppel/v1/auth?"+query.Encode(), http.NoBody)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, mode := range []keppel.PeeringMode{keppel.PeeringModeMTLS, keppel.PeeringModePassword} {
+		t.Logf("----- test with peering mode %q -----", mode)
+		s := setupPrimary(t, test.WithPeeringMode(mode))
+		err := s.DB.Insert(&keppel.Peer{
+			HostName:             "peer.example.org",
+			TheirCertFingerprint: keppel.CertificateFingerprint(peerCert.Leaf),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//a client certificate with a known fingerprint identifies the peer (but
+		//only in mTLS mode; otherwise the certificate is ignored and the request is
+		//treated as anonymous)
+		expected := jwtContents{
+			Audience: "registry.example.org",
+			Issuer:   "keppel-api@registry.example.org",
+		}
+		if mode == keppel.PeeringModeMTLS {
+			expected.Subject = "replication@peer.example.org"
+			expected.Access = []jwtAccess{{Type: "repository", Name: "test1/foo", Actions: []string{"pull"}}}
+		}
+		rec := getToken(s.Handler, peerCert)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200 OK for known peer certificate, but got %d: %s", rec.Code, rec.Body.String())
+		} else {
+			expected.AssertResponseBody(t, "GET /keppel/v1/auth with known peer certificate", rec.Body.Bytes())
+		}
+
+		//a client certificate with an unknown fingerprint does not identify a
+		//peer, so the request is treated as anonymous in all modes
+		rec = getToken(s.Handler, otherCert)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200 OK for unknown peer certificate, but got %d: %s", rec.Code, rec.Body.String())
+		} else {
+			jwtContents{
+				Audience: "registry.example.org",
+				Issuer:   "keppel-api@registry.example.org",
+			}.AssertResponseBody(t, "GET /keppel/v1/auth with unknown peer certificate", rec.Body.Bytes())
+		}
+
+		//in particular, anonymous pulls still work for clients that present an
+		//unknown certificate
+		err = s.DB.Insert(&keppel.RBACPolicy{
+			AccountName:        "test1",
+			RepositoryPattern:  "foo",
+			CanPullAnonymously: true,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		rec = getToken(s.Handler, otherCert)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200 OK for anonymous pull with unknown peer certificate, but got %d: %s", rec.Code, rec.Body.String())
+		} else {
+			jwtContents{
+				Audience: "registry.example.org",
+				Issuer:   "keppel-api@registry.example.org",
+				Access:   []jwtAccess{{Type: "repository", Name: "test1/foo", Actions: []string{"pull"}}},
+			}.AssertResponseBody(t, "GET /keppel/v1/auth for anonymous pull with unknown peer certificate", rec.Body.Bytes())
+		}
+	}
+}
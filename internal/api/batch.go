@@ -0,0 +1,73 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package api
+
+import "encoding/json"
+
+// BatchResult is the outcome for a single reference in the response of a
+// batch endpoint. If OK is true, Data is filled; otherwise Error explains why
+// the reference could not be processed.
+type BatchResult[T any] struct {
+	Reference string `json:"reference"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	Data      *T     `json:"data,omitempty"`
+}
+
+// BatchResults collects the BatchResult for each reference given to a batch
+// endpoint. Results are rendered in the order in which they were added.
+type BatchResults[T any] struct {
+	results []BatchResult[T]
+	seen    map[string]bool
+}
+
+// NewBatchResults prepares a BatchResults instance for the given number of
+// references.
+func NewBatchResults[T any](count int) *BatchResults[T] {
+	return &BatchResults[T]{
+		results: make([]BatchResult[T], 0, count),
+		seen:    make(map[string]bool, count),
+	}
+}
+
+// Contains returns whether a result for this reference has already been added.
+// Batch endpoints use this to process each reference only once, even if it
+// appears several times in the request.
+func (b *BatchResults[T]) Contains(reference string) bool {
+	return b.seen[reference]
+}
+
+// AddSuccess adds a successful result for the given reference.
+func (b *BatchResults[T]) AddSuccess(reference string, data T) {
+	b.seen[reference] = true
+	b.results = append(b.results, BatchResult[T]{Reference: reference, OK: true, Data: &data})
+}
+
+// AddError adds a failed result for the given reference.
+func (b *BatchResults[T]) AddError(reference string, err error) {
+	b.seen[reference] = true
+	b.results = append(b.results, BatchResult[T]{Reference: reference, OK: false, Error: err.Error()})
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (b *BatchResults[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Results []BatchResult[T] `json:"results"`
+	}{b.results})
+}
@@ -0,0 +1,111 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package healthapi contains the deep health check endpoint of keppel-api.
+// The shallow liveness check is provided by httpapi.HealthCheckAPI instead.
+package healthapi
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// API contains state variables used by the readiness check endpoint.
+type API struct {
+	db *keppel.DB
+	sd keppel.StorageDriver
+}
+
+// NewAPI constructs a new API instance.
+func NewAPI(db *keppel.DB, sd keppel.StorageDriver) *API {
+	return &API{db, sd}
+}
+
+// AddTo implements the api.API interface.
+func (a *API) AddTo(r *mux.Router) {
+	r.Methods("GET", "HEAD").Path("/readyz").HandlerFunc(a.handleReadinessCheck)
+}
+
+// Report is the response body of the readiness check endpoint.
+type Report struct {
+	Status string `json:"status"`
+	//only set if Status is "failing"
+	FailingSubsystem string `json:"failing_subsystem,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+var errStopListing = errors.New("stop listing")
+
+func (a *API) handleReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/readyz")
+	httpapi.SkipRequestLog(r)
+
+	subsystem, err := a.check()
+	if err != nil {
+		logg.Error("readiness check failed for %s: %s", subsystem, err.Error())
+		respondwith.JSON(w, http.StatusServiceUnavailable, Report{
+			Status:           "failing",
+			FailingSubsystem: subsystem,
+			Error:            err.Error(),
+		})
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, Report{Status: "ok"})
+}
+
+// Returns the name of the failing subsystem together with the error.
+func (a *API) check() (string, error) {
+	//check that the DB is reachable
+	ok, err := a.db.SelectBool(`SELECT TRUE`)
+	if err == nil && !ok {
+		err = errors.New("unexpected result from SELECT TRUE")
+	}
+	if err != nil {
+		return "database", err
+	}
+
+	//check that the storage is reachable; since storage drivers can only list
+	//the contents of a specific account, we pick any account as a sentinel
+	//(and skip the check if there are no accounts yet)
+	var account keppel.Account
+	err = a.db.SelectOne(&account, `SELECT * FROM accounts ORDER BY name LIMIT 1`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "database", err
+	}
+	//to keep this cheap, the listing is aborted as soon as the first item is seen
+	err = a.sd.ListStorageContentsStream(account,
+		func(keppel.StoredBlobInfo) error { return errStopListing },
+		func(keppel.StoredManifestInfo) error { return errStopListing },
+	)
+	if err != nil && !errors.Is(err, errStopListing) {
+		return "storage", fmt.Errorf("cannot list storage contents of account %s: %w", account.Name, err)
+	}
+	return "", nil
+}
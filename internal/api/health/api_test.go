@@ -0,0 +1,102 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package healthapi_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/httpapi"
+
+	healthapi "github.com/sapcc/keppel/internal/api/health"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+// failingStorageDriver is a keppel.StorageDriver whose listing always fails.
+type failingStorageDriver struct {
+	keppel.StorageDriver
+}
+
+func (failingStorageDriver) ListStorageContentsStream(account keppel.Account, blobCallback func(keppel.StoredBlobInfo) error, manifestCallback func(keppel.StoredManifestInfo) error) error {
+	return errors.New("storage is on fire")
+}
+
+func TestReadinessCheck(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+
+	//happy case
+	h := httpapi.Compose(healthapi.NewAPI(s.DB, s.SD), httpapi.WithoutLogging())
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/readyz",
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"status": "ok"},
+	}.Check(t, h)
+
+	//storage down
+	h = httpapi.Compose(healthapi.NewAPI(s.DB, failingStorageDriver{s.SD}), httpapi.WithoutLogging())
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/readyz",
+		ExpectStatus: http.StatusServiceUnavailable,
+		ExpectBody: assert.JSONObject{
+			"status":            "failing",
+			"failing_subsystem": "storage",
+			"error":             "cannot list storage contents of account test1: storage is on fire",
+		},
+	}.Check(t, h)
+
+	//without accounts, there is nothing to list in the storage, so the storage check is skipped
+	_, err := s.DB.Exec(`DELETE FROM accounts`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/readyz",
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"status": "ok"},
+	}.Check(t, h)
+
+	//DB down (we use a separate connection pool here to avoid breaking the test setup)
+	db, err := keppel.InitDB(s.Config.DatabaseURL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = db.Db.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h = httpapi.Compose(healthapi.NewAPI(db, s.SD), httpapi.WithoutLogging())
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/readyz",
+		ExpectStatus: http.StatusServiceUnavailable,
+		ExpectBody: assert.JSONObject{
+			"status":            "failing",
+			"failing_subsystem": "database",
+			"error":             "sql: database is closed",
+		},
+	}.Check(t, h)
+}
@@ -19,15 +19,18 @@
 package keppelv1
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"mime"
 	"net/http"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,15 +50,28 @@ import (
 
 // Account represents an account in the API.
 type Account struct {
-	Name              string                `json:"name"`
-	AuthTenantID      string                `json:"auth_tenant_id"`
-	InMaintenance     bool                  `json:"in_maintenance"`
-	Metadata          map[string]string     `json:"metadata"`
-	GCPolicies        []keppel.GCPolicy     `json:"gc_policies,omitempty"`
-	RBACPolicies      []RBACPolicy          `json:"rbac_policies"`
-	ReplicationPolicy *ReplicationPolicy    `json:"replication,omitempty"`
-	ValidationPolicy  *ValidationPolicy     `json:"validation,omitempty"`
-	PlatformFilter    keppel.PlatformFilter `json:"platform_filter,omitempty"`
+	Name                 string                      `json:"name"`
+	AuthTenantID         string                      `json:"auth_tenant_id"`
+	InMaintenance        bool                        `json:"in_maintenance"`
+	Metadata             map[string]string           `json:"metadata"`
+	GCPolicies           []keppel.GCPolicy           `json:"gc_policies,omitempty"`
+	RBACPolicies         []RBACPolicy                `json:"rbac_policies"`
+	ReplicationPolicy    *ReplicationPolicy          `json:"replication,omitempty"`
+	ValidationPolicy     *ValidationPolicy           `json:"validation,omitempty"`
+	PlatformFilter       keppel.PlatformFilter       `json:"platform_filter,omitempty"`
+	ManifestRetention    *keppel.Duration            `json:"manifest_retention,omitempty"`
+	ImmutableTagPattern  string                      `json:"immutable_tag_pattern,omitempty"`
+	MaxManifestSizeBytes uint64                      `json:"max_manifest_size_bytes,omitempty"`
+	MaxBlobSizeBytes     uint64                      `json:"max_blob_size_bytes,omitempty"`
+	ManifestLimit        uint64                      `json:"manifest_limit,omitempty"`
+	VulnerabilityPolicy  *keppel.VulnerabilityPolicy `json:"vulnerability_policy,omitempty"`
+	//CustomManifestMediaTypes is not part of ValidationPolicy since it allows
+	//more manifests instead of restricting them.
+	CustomManifestMediaTypes []string                `json:"custom_manifest_media_types,omitempty"`
+	SignaturePolicy          *keppel.SignaturePolicy `json:"signature_policy,omitempty"`
+	//ReplicationRepoAllowlist is not part of ReplicationPolicy since it can be
+	//changed after the account was created.
+	ReplicationRepoAllowlist []string `json:"replication_repo_allowlist,omitempty"`
 }
 
 // RBACPolicy represents an RBAC policy in the API.
@@ -63,6 +79,7 @@ type RBACPolicy struct {
 	CidrPattern       string   `json:"match_cidr,omitempty"`
 	RepositoryPattern string   `json:"match_repository,omitempty"`
 	UserNamePattern   string   `json:"match_username,omitempty"`
+	GroupPattern      string   `json:"match_group,omitempty"`
 	Permissions       []string `json:"permissions"`
 }
 
@@ -139,7 +156,7 @@ func (a *API) renderAccount(dbAccount keppel.Account) (Account, error) {
 	}
 
 	var dbPolicies []keppel.RBACPolicy
-	_, err = a.db.Select(&dbPolicies, `SELECT * FROM rbac_policies WHERE account_name = $1 ORDER BY account_name, match_repository, match_username`, dbAccount.Name)
+	_, err = a.db.Select(&dbPolicies, `SELECT * FROM rbac_policies WHERE account_name = $1 ORDER BY account_name, match_repository, match_username, match_group`, dbAccount.Name)
 	if err != nil {
 		return Account{}, err
 	}
@@ -149,6 +166,24 @@ func (a *API) renderAccount(dbAccount keppel.Account) (Account, error) {
 		policies[idx] = renderRBACPolicy(p)
 	}
 
+	vulnPolicy, err := dbAccount.ParseVulnerabilityPolicy()
+	if err != nil {
+		return Account{}, fmt.Errorf("malformed vulnerability policy JSON: %q", dbAccount.VulnerabilityPolicyJSON)
+	}
+
+	signaturePolicy, err := dbAccount.ParseSignaturePolicy()
+	if err != nil {
+		return Account{}, fmt.Errorf("malformed signature policy JSON: %q", dbAccount.SignaturePolicyJSON)
+	}
+
+	var replicationRepoAllowlist []string
+	if dbAccount.ReplicationRepoAllowlistJSON != "" {
+		err := json.Unmarshal([]byte(dbAccount.ReplicationRepoAllowlistJSON), &replicationRepoAllowlist)
+		if err != nil {
+			return Account{}, fmt.Errorf("malformed replication repo allowlist JSON: %q", dbAccount.ReplicationRepoAllowlistJSON)
+		}
+	}
+
 	metadata := make(map[string]string)
 	if dbAccount.MetadataJSON != "" {
 		err := json.Unmarshal([]byte(dbAccount.MetadataJSON), &metadata)
@@ -158,18 +193,63 @@ func (a *API) renderAccount(dbAccount keppel.Account) (Account, error) {
 	}
 
 	return Account{
-		Name:              dbAccount.Name,
-		AuthTenantID:      dbAccount.AuthTenantID,
-		GCPolicies:        gcPolicies,
-		InMaintenance:     dbAccount.InMaintenance,
-		Metadata:          metadata,
-		RBACPolicies:      policies,
-		ReplicationPolicy: renderReplicationPolicy(dbAccount),
-		ValidationPolicy:  renderValidationPolicy(dbAccount),
-		PlatformFilter:    dbAccount.PlatformFilter,
+		Name:                     dbAccount.Name,
+		AuthTenantID:             dbAccount.AuthTenantID,
+		GCPolicies:               gcPolicies,
+		InMaintenance:            dbAccount.InMaintenance,
+		Metadata:                 metadata,
+		RBACPolicies:             policies,
+		ReplicationPolicy:        renderReplicationPolicy(dbAccount),
+		ValidationPolicy:         renderValidationPolicy(dbAccount),
+		PlatformFilter:           dbAccount.PlatformFilter,
+		ManifestRetention:        renderManifestRetention(dbAccount),
+		ImmutableTagPattern:      dbAccount.ImmutableTagPattern,
+		MaxManifestSizeBytes:     dbAccount.MaxManifestSizeBytes,
+		MaxBlobSizeBytes:         dbAccount.MaxBlobSizeBytes,
+		ManifestLimit:            dbAccount.ManifestLimit,
+		VulnerabilityPolicy:      vulnPolicy,
+		CustomManifestMediaTypes: renderCustomManifestMediaTypes(dbAccount),
+		SignaturePolicy:          signaturePolicy,
+		ReplicationRepoAllowlist: replicationRepoAllowlist,
 	}, nil
 }
 
+// accountETag computes the value of the ETag header for the given rendered
+// account. Clients can send this value back in an If-Match header to ensure
+// that their PUT does not overwrite changes that happened since their GET.
+func accountETag(account Account) string {
+	buf, _ := json.Marshal(account)
+	hash := sha256.Sum256(buf)
+	return fmt.Sprintf("%q", hex.EncodeToString(hash[:]))
+}
+
+// ifMatchSatisfied checks whether the given If-Match header value matches the
+// given ETag. Since If-Match requires strong comparison, weak ETags never match.
+func ifMatchSatisfied(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func renderCustomManifestMediaTypes(dbAccount keppel.Account) []string {
+	if dbAccount.CustomManifestMediaTypes == "" {
+		return nil
+	}
+	return strings.Split(dbAccount.CustomManifestMediaTypes, ",")
+}
+
+func renderManifestRetention(dbAccount keppel.Account) *keppel.Duration {
+	if dbAccount.ManifestRetentionSecs == 0 {
+		return nil
+	}
+	d := keppel.Duration(time.Duration(dbAccount.ManifestRetentionSecs) * time.Second)
+	return &d
+}
+
 func renderReplicationPolicy(dbAccount keppel.Account) *ReplicationPolicy {
 	if dbAccount.UpstreamPeerHostName != "" {
 		return &ReplicationPolicy{
@@ -206,6 +286,7 @@ func renderRBACPolicy(dbPolicy keppel.RBACPolicy) RBACPolicy {
 	result := RBACPolicy{
 		RepositoryPattern: dbPolicy.RepositoryPattern,
 		UserNamePattern:   dbPolicy.UserNamePattern,
+		GroupPattern:      dbPolicy.GroupPattern,
 	}
 	// treat cidr that matches everything as unset
 	if dbPolicy.CidrPattern != "0.0.0.0/0" {
@@ -238,6 +319,7 @@ func parseRBACPolicy(policy RBACPolicy) (keppel.RBACPolicy, error) {
 	result := keppel.RBACPolicy{
 		RepositoryPattern: policy.RepositoryPattern,
 		UserNamePattern:   policy.UserNamePattern,
+		GroupPattern:      policy.GroupPattern,
 	}
 	// validate cidr early to prevent errors
 	// this has also the nice side effect that we can use the cidr of the network incase an ip is used
@@ -245,15 +327,19 @@ func parseRBACPolicy(policy RBACPolicy) (keppel.RBACPolicy, error) {
 		// hack to mimic default value in database
 		result.CidrPattern = "0.0.0.0/0"
 	} else {
-		_, network, err := net.ParseCIDR(cidr)
+		// multiple networks (including IPv6 networks) can be given as a comma-separated list
+		networks, err := keppel.ParseCIDRList(cidr)
 		if err != nil {
-			// err.Error() sadly does not contain any useful information why the cidr is invalid
-			return result, fmt.Errorf("%q is not a valid cidr", cidr)
+			return result, err
 		}
-		if network.String() == "0.0.0.0/0" {
-			return result, errors.New("0.0.0.0/0 cannot be used as cidr because it matches everything")
+		normalized := make([]string, len(networks))
+		for idx, network := range networks {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				return result, fmt.Errorf("%s cannot be used as cidr because it matches everything", network.String())
+			}
+			normalized[idx] = network.String()
 		}
-		result.CidrPattern = network.String()
+		result.CidrPattern = strings.Join(normalized, ",")
 	}
 	for _, perm := range policy.Permissions {
 		switch perm {
@@ -275,23 +361,26 @@ func parseRBACPolicy(policy RBACPolicy) (keppel.RBACPolicy, error) {
 	if len(policy.Permissions) == 0 {
 		return result, errors.New(`RBAC policy must grant at least one permission`)
 	}
-	if result.CidrPattern == "0.0.0.0/0" && result.UserNamePattern == "" && result.RepositoryPattern == "" {
+	if result.CidrPattern == "0.0.0.0/0" && result.UserNamePattern == "" && result.GroupPattern == "" && result.RepositoryPattern == "" {
 		return result, errors.New(`RBAC policy must have at least one "match_..." attribute`)
 	}
 	if (result.CanPullAnonymously || result.CanFirstPullAnonymously) && result.UserNamePattern != "" {
 		return result, errors.New(`RBAC policy with "anonymous_pull" or "anonymous_first_pull" may not have the "match_username" attribute`)
 	}
-	if result.CanPull && result.CidrPattern == "0.0.0.0/0" && result.UserNamePattern == "" {
-		return result, errors.New(`RBAC policy with "pull" must have the "match_cidr" or "match_username" attribute`)
+	if (result.CanPullAnonymously || result.CanFirstPullAnonymously) && result.GroupPattern != "" {
+		return result, errors.New(`RBAC policy with "anonymous_pull" or "anonymous_first_pull" may not have the "match_group" attribute`)
+	}
+	if result.CanPull && result.CidrPattern == "0.0.0.0/0" && result.UserNamePattern == "" && result.GroupPattern == "" {
+		return result, errors.New(`RBAC policy with "pull" must have the "match_cidr", "match_username" or "match_group" attribute`)
 	}
 	if result.CanPush && !result.CanPull {
 		return result, errors.New(`RBAC policy with "push" must also grant "pull"`)
 	}
-	if result.CanDelete && result.UserNamePattern == "" {
-		return result, errors.New(`RBAC policy with "delete" must have the "match_username" attribute`)
+	if result.CanDelete && result.UserNamePattern == "" && result.GroupPattern == "" {
+		return result, errors.New(`RBAC policy with "delete" must have the "match_username" or "match_group" attribute`)
 	}
 
-	for _, pattern := range []string{policy.RepositoryPattern, policy.UserNamePattern} {
+	for _, pattern := range []string{policy.RepositoryPattern, policy.UserNamePattern, policy.GroupPattern} {
 		if pattern == "" {
 			continue
 		}
@@ -308,8 +397,20 @@ func parseRBACPolicy(policy RBACPolicy) (keppel.RBACPolicy, error) {
 
 func (a *API) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts")
+	//NOTE: The query does not have a LIMIT clause because we can only filter by
+	//visibility after authorization. The limit is applied to the filtered list.
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         "SELECT * FROM accounts WHERE $CONDITION ORDER BY name",
+		MarkerField: "name",
+		Options:     r.URL.Query(),
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var accounts []keppel.Account
-	_, err := a.db.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
+	_, err = a.db.Select(&accounts, query, bindValues...)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
@@ -331,20 +432,26 @@ func (a *API) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 			accountsFiltered = append(accountsFiltered, account)
 		}
 	}
-	//ensure that this serializes as a list, not as null
-	if len(accountsFiltered) == 0 {
-		accountsFiltered = []keppel.Account{}
+
+	var result struct {
+		Accounts    []Account `json:"accounts"`
+		IsTruncated bool      `json:"truncated,omitempty"`
+	}
+	if uint64(len(accountsFiltered)) > limit {
+		accountsFiltered = accountsFiltered[:limit]
+		result.IsTruncated = true
 	}
 
-	//render accounts to JSON
-	accountsRendered := make([]Account, len(accountsFiltered))
+	//render accounts to JSON (this also ensures that the list serializes as a
+	//list, not as null)
+	result.Accounts = make([]Account, len(accountsFiltered))
 	for idx, account := range accountsFiltered {
-		accountsRendered[idx], err = a.renderAccount(account)
+		result.Accounts[idx], err = a.renderAccount(account)
 		if respondwith.ErrorText(w, err) {
 			return
 		}
 	}
-	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"accounts": accountsRendered})
+	respondwith.JSON(w, http.StatusOK, result)
 }
 
 func (a *API) handleGetAccount(w http.ResponseWriter, r *http.Request) {
@@ -362,25 +469,39 @@ func (a *API) handleGetAccount(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
+	w.Header().Set("ETag", accountETag(accountRendered))
 	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
 }
 
 var looksLikeAPIVersionRx = regexp.MustCompile(`^v[0-9][1-9]*$`)
 
+// accountSpec is the part of the request body of PUT /keppel/v1/accounts/:account
+// that describes the desired state of the account.
+type accountSpec struct {
+	AuthTenantID             string                      `json:"auth_tenant_id"`
+	GCPolicies               []keppel.GCPolicy           `json:"gc_policies"`
+	InMaintenance            bool                        `json:"in_maintenance"`
+	Metadata                 map[string]string           `json:"metadata"`
+	RBACPolicies             []RBACPolicy                `json:"rbac_policies"`
+	ReplicationPolicy        *ReplicationPolicy          `json:"replication"`
+	ReplicationRepoAllowlist []string                    `json:"replication_repo_allowlist"`
+	ValidationPolicy         *ValidationPolicy           `json:"validation"`
+	PlatformFilter           keppel.PlatformFilter       `json:"platform_filter"`
+	ManifestRetention        *keppel.Duration            `json:"manifest_retention"`
+	ImmutableTagPattern      string                      `json:"immutable_tag_pattern"`
+	MaxManifestSizeBytes     uint64                      `json:"max_manifest_size_bytes"`
+	MaxBlobSizeBytes         uint64                      `json:"max_blob_size_bytes"`
+	ManifestLimit            uint64                      `json:"manifest_limit"`
+	VulnerabilityPolicy      *keppel.VulnerabilityPolicy `json:"vulnerability_policy"`
+	CustomManifestMediaTypes []string                    `json:"custom_manifest_media_types"`
+	SignaturePolicy          *keppel.SignaturePolicy     `json:"signature_policy"`
+}
+
 func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account")
 	//decode request body
 	var req struct {
-		Account struct {
-			AuthTenantID      string                `json:"auth_tenant_id"`
-			GCPolicies        []keppel.GCPolicy     `json:"gc_policies"`
-			InMaintenance     bool                  `json:"in_maintenance"`
-			Metadata          map[string]string     `json:"metadata"`
-			RBACPolicies      []RBACPolicy          `json:"rbac_policies"`
-			ReplicationPolicy *ReplicationPolicy    `json:"replication"`
-			ValidationPolicy  *ValidationPolicy     `json:"validation"`
-			PlatformFilter    keppel.PlatformFilter `json:"platform_filter"`
-		} `json:"account"`
+		Account accountSpec `json:"account"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
@@ -389,7 +510,14 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := a.authDriver.ValidateTenantID(req.Account.AuthTenantID); err != nil {
+	a.putAccount(w, r, mux.Vars(r)["account"], req.Account, false)
+}
+
+// putAccount implements PUT /keppel/v1/accounts/:account and
+// POST /keppel/v1/accounts/_import. If `createOnly` is true, the account must
+// not exist yet.
+func (a *API) putAccount(w http.ResponseWriter, r *http.Request, accountName string, spec accountSpec, createOnly bool) {
+	if err := a.authDriver.ValidateTenantID(spec.AuthTenantID); err != nil {
 		http.Error(w, `malformed attribute "account.auth_tenant_id" in request body: `+err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
@@ -399,7 +527,6 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	//APIs (we will soon start recognizing image-like URLs such as
 	//keppel.example.org/account/repo and offer redirection to a suitable UI;
 	//this requires the account name to not overlap with API endpoint paths)
-	accountName := mux.Vars(r)["account"]
 	if strings.HasPrefix(accountName, "keppel") {
 		http.Error(w, `account names with the prefix "keppel" are reserved for internal use`, http.StatusUnprocessableEntity)
 		return
@@ -409,7 +536,20 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, policy := range req.Account.GCPolicies {
+	//0 means "use the default" for these size limits; since the defaults exist
+	//to stop abuse, they can be lowered per account, but not raised
+	if spec.MaxManifestSizeBytes > keppel.DefaultMaxManifestSizeBytes {
+		msg := fmt.Sprintf(`attribute "account.max_manifest_size_bytes" may not be larger than %d`, keppel.DefaultMaxManifestSizeBytes)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if spec.MaxBlobSizeBytes > keppel.DefaultMaxBlobSizeBytes {
+		msg := fmt.Sprintf(`attribute "account.max_blob_size_bytes" may not be larger than %d`, keppel.DefaultMaxBlobSizeBytes)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+
+	for _, policy := range spec.GCPolicies {
 		err := policy.Validate()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
@@ -417,8 +557,9 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rbacPolicies := make([]keppel.RBACPolicy, len(req.Account.RBACPolicies))
-	for idx, policy := range req.Account.RBACPolicies {
+	var err error
+	rbacPolicies := make([]keppel.RBACPolicy, len(spec.RBACPolicies))
+	for idx, policy := range spec.RBACPolicies {
 		rbacPolicies[idx], err = parseRBACPolicy(policy)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
@@ -427,29 +568,48 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		//NOTE: There are some delayed checks below which require the existing account to be loaded from the DB first.
 	}
 
+	vulnPolicyJSONStr := ""
+	if spec.VulnerabilityPolicy != nil {
+		err := spec.VulnerabilityPolicy.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		//an empty policy is the same as no policy
+		if *spec.VulnerabilityPolicy != (keppel.VulnerabilityPolicy{}) {
+			vulnPolicyJSON, _ := json.Marshal(*spec.VulnerabilityPolicy)
+			vulnPolicyJSONStr = string(vulnPolicyJSON)
+		}
+	}
+
 	metadataJSONStr := ""
-	if len(req.Account.Metadata) > 0 {
-		metadataJSON, _ := json.Marshal(req.Account.Metadata)
+	if len(spec.Metadata) > 0 {
+		metadataJSON, _ := json.Marshal(spec.Metadata)
 		metadataJSONStr = string(metadataJSON)
 	}
 
 	gcPoliciesJSONStr := "[]"
-	if len(req.Account.GCPolicies) > 0 {
-		gcPoliciesJSON, _ := json.Marshal(req.Account.GCPolicies)
+	if len(spec.GCPolicies) > 0 {
+		gcPoliciesJSON, _ := json.Marshal(spec.GCPolicies)
 		gcPoliciesJSONStr = string(gcPoliciesJSON)
 	}
 
 	accountToCreate := keppel.Account{
-		Name:           accountName,
-		AuthTenantID:   req.Account.AuthTenantID,
-		InMaintenance:  req.Account.InMaintenance,
-		MetadataJSON:   metadataJSONStr,
-		GCPoliciesJSON: gcPoliciesJSONStr,
+		Name:                    accountName,
+		AuthTenantID:            spec.AuthTenantID,
+		InMaintenance:           spec.InMaintenance,
+		MetadataJSON:            metadataJSONStr,
+		GCPoliciesJSON:          gcPoliciesJSONStr,
+		VulnerabilityPolicyJSON: vulnPolicyJSONStr,
+		MaxManifestSizeBytes:    spec.MaxManifestSizeBytes,
+		MaxBlobSizeBytes:        spec.MaxBlobSizeBytes,
+		//0 means "no limit besides the tenant's quota", so this does not need any further validation
+		ManifestLimit: spec.ManifestLimit,
 	}
 
 	//validate replication policy
-	if req.Account.ReplicationPolicy != nil {
-		rp := *req.Account.ReplicationPolicy
+	if spec.ReplicationPolicy != nil {
+		rp := *spec.ReplicationPolicy
 
 		switch rp.Strategy {
 		case "on_first_use":
@@ -475,8 +635,8 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//validate validation policy
-	if req.Account.ValidationPolicy != nil {
-		vp := *req.Account.ValidationPolicy
+	if spec.ValidationPolicy != nil {
+		vp := *spec.ValidationPolicy
 		for _, label := range vp.RequiredLabels {
 			if strings.Contains(label, ",") {
 				http.Error(w, fmt.Sprintf(`invalid label name: %q`, label), http.StatusUnprocessableEntity)
@@ -488,12 +648,84 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//validate platform filter
-	if req.Account.PlatformFilter != nil {
-		if req.Account.ReplicationPolicy == nil {
+	if spec.PlatformFilter != nil {
+		if spec.ReplicationPolicy == nil {
 			http.Error(w, `platform filter is only allowed on replica accounts`, http.StatusUnprocessableEntity)
 			return
 		}
-		accountToCreate.PlatformFilter = req.Account.PlatformFilter
+		accountToCreate.PlatformFilter = spec.PlatformFilter
+	}
+
+	//validate replication repo allowlist
+	if len(spec.ReplicationRepoAllowlist) > 0 {
+		if spec.ReplicationPolicy == nil {
+			http.Error(w, `replication repo allowlist is only allowed on replica accounts`, http.StatusUnprocessableEntity)
+			return
+		}
+		for _, pattern := range spec.ReplicationRepoAllowlist {
+			_, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, pattern))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%q is not a valid regex: %s", pattern, err.Error()), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		allowlistJSON, _ := json.Marshal(spec.ReplicationRepoAllowlist)
+		accountToCreate.ReplicationRepoAllowlistJSON = string(allowlistJSON)
+	}
+
+	//validate manifest retention
+	if spec.ManifestRetention != nil {
+		retention := time.Duration(*spec.ManifestRetention)
+		if retention < 0 {
+			http.Error(w, `manifest retention may not be negative`, http.StatusUnprocessableEntity)
+			return
+		}
+		accountToCreate.ManifestRetentionSecs = int64(retention / time.Second)
+	}
+
+	//validate immutable tag pattern
+	if spec.ImmutableTagPattern != "" {
+		if spec.ReplicationPolicy != nil {
+			//replica accounts need to follow tags as they move in the upstream registry
+			http.Error(w, `immutable tags are not allowed on replica accounts`, http.StatusUnprocessableEntity)
+			return
+		}
+		_, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, spec.ImmutableTagPattern))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%q is not a valid regex: %s", spec.ImmutableTagPattern, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+		accountToCreate.ImmutableTagPattern = spec.ImmutableTagPattern
+	}
+
+	//validate custom manifest media types
+	for _, mediaType := range spec.CustomManifestMediaTypes {
+		parsedMediaType, params, err := mime.ParseMediaType(mediaType)
+		if err != nil || parsedMediaType != mediaType || len(params) > 0 {
+			http.Error(w, fmt.Sprintf("invalid media type: %q", mediaType), http.StatusUnprocessableEntity)
+			return
+		}
+		if keppel.IsManifestMediaType(mediaType) {
+			http.Error(w, fmt.Sprintf("%q is a standard manifest media type and does not need to be allowed explicitly", mediaType), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	accountToCreate.CustomManifestMediaTypes = strings.Join(spec.CustomManifestMediaTypes, ",")
+
+	//validate signature policy
+	if spec.SignaturePolicy != nil {
+		if spec.ReplicationPolicy != nil {
+			//signatures are not replicated, so replica accounts could never tag anything
+			http.Error(w, `signature policies are not allowed on replica accounts`, http.StatusUnprocessableEntity)
+			return
+		}
+		err := spec.SignaturePolicy.Validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		signaturePolicyJSON, _ := json.Marshal(*spec.SignaturePolicy)
+		accountToCreate.SignaturePolicyJSON = string(signaturePolicyJSON)
 	}
 
 	//check permission to create account
@@ -507,15 +739,37 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
-	if account != nil && account.AuthTenantID != req.Account.AuthTenantID {
+	if account != nil && createOnly {
+		http.Error(w, `account already exists`, http.StatusConflict)
+		return
+	}
+	if account != nil && account.AuthTenantID != spec.AuthTenantID {
 		http.Error(w, `account name already in use by a different tenant`, http.StatusConflict)
 		return
 	}
 
+	//if the client sent an If-Match header, only proceed if the account has not
+	//changed since the client last read it (without If-Match, the update is
+	//applied unconditionally)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if account == nil {
+			http.Error(w, `precondition failed: account does not exist`, http.StatusPreconditionFailed)
+			return
+		}
+		accountRendered, err := a.renderAccount(*account)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		if !ifMatchSatisfied(ifMatch, accountETag(accountRendered)) {
+			http.Error(w, `precondition failed: account was changed since it was last read`, http.StatusPreconditionFailed)
+			return
+		}
+	}
+
 	//late replication policy validations (could not do these earlier because we
 	//did not have `account` yet)
-	if req.Account.ReplicationPolicy != nil {
-		rp := *req.Account.ReplicationPolicy
+	if spec.ReplicationPolicy != nil {
+		rp := *spec.ReplicationPolicy
 
 		if rp.Strategy == "from_external_on_first_use" {
 			//for new accounts, we need either full credentials or none
@@ -542,18 +796,18 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//replication strategy may not be changed after account creation
-	if account != nil && req.Account.ReplicationPolicy != nil && !replicationPoliciesFunctionallyEqual(req.Account.ReplicationPolicy, renderReplicationPolicy(*account)) {
+	if account != nil && spec.ReplicationPolicy != nil && !replicationPoliciesFunctionallyEqual(spec.ReplicationPolicy, renderReplicationPolicy(*account)) {
 		http.Error(w, `cannot change replication policy on existing account`, http.StatusConflict)
 		return
 	}
-	if account != nil && req.Account.PlatformFilter != nil && !reflect.DeepEqual(req.Account.PlatformFilter, account.PlatformFilter) {
+	if account != nil && spec.PlatformFilter != nil && !reflect.DeepEqual(spec.PlatformFilter, account.PlatformFilter) {
 		http.Error(w, `cannot change platform filter on existing account`, http.StatusConflict)
 		return
 	}
 
 	//late RBAC policy validations (could not do these earlier because we did not
 	//have `account` yet)
-	isExternalReplica := req.Account.ReplicationPolicy != nil && req.Account.ReplicationPolicy.ExternalPeer.URL != ""
+	isExternalReplica := spec.ReplicationPolicy != nil && spec.ReplicationPolicy.ExternalPeer.URL != ""
 	if account != nil {
 		isExternalReplica = account.ExternalPeerURL != ""
 	}
@@ -594,8 +848,8 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Copy PlatformFilter when creating an account with the Replication Policy on_first_use
-		if req.Account.ReplicationPolicy != nil {
-			rp := *req.Account.ReplicationPolicy
+		if spec.ReplicationPolicy != nil {
+			rp := *spec.ReplicationPolicy
 			if rp.Strategy == "on_first_use" {
 				var peer keppel.Peer
 				err := a.db.SelectOne(&peer, `SELECT * FROM peers WHERE hostname = $1`, rp.UpstreamPeerHostName)
@@ -624,7 +878,7 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 				}
 				authReq.Header.Set("Authorization", "Bearer "+peerToken)
 
-				resp, err := http.DefaultClient.Do(authReq)
+				resp, err := a.cfg.PeerHTTPClient().Do(authReq)
 				if err != nil {
 					http.Error(w, "could not fetch platform filter: "+err.Error(), http.StatusUnauthorized)
 					return
@@ -653,11 +907,11 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 				}
 				upstreamAccount := upstreamAccountData.Account
 
-				if req.Account.PlatformFilter == nil {
+				if spec.PlatformFilter == nil {
 					accountToCreate.PlatformFilter = upstreamAccount.PlatformFilter
-				} else if !reflect.DeepEqual(req.Account.PlatformFilter, upstreamAccount.PlatformFilter) {
+				} else if !reflect.DeepEqual(spec.PlatformFilter, upstreamAccount.PlatformFilter) {
 					// check if the peer PlatformFilter matches the primary account PlatformFilter
-					jsonPlatformFilter, _ := json.Marshal(req.Account.PlatformFilter)
+					jsonPlatformFilter, _ := json.Marshal(spec.PlatformFilter)
 					jsonFilter, _ := json.Marshal(upstreamAccount.PlatformFilter)
 					msg := fmt.Sprintf("peer account filter needs to match primary account filter: primary account %s, peer account %s ", jsonPlatformFilter, jsonFilter)
 					http.Error(w, msg, http.StatusConflict)
@@ -666,6 +920,13 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		//new accounts that do not specify any GC policies get the default ones (but
+		//an explicitly empty list of GC policies is respected)
+		if spec.GCPolicies == nil && len(a.cfg.DefaultGCPolicies) > 0 {
+			gcPoliciesJSON, _ := json.Marshal(a.cfg.DefaultGCPolicies)
+			accountToCreate.GCPoliciesJSON = string(gcPoliciesJSON)
+		}
+
 		tx, err := a.db.Begin()
 		if respondwith.ErrorText(w, err) {
 			return
@@ -695,8 +956,8 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		//account != nil: update if necessary
+		accountBefore := *account
 		needsUpdate := false
-		needsAudit := false
 		if account.InMaintenance != accountToCreate.InMaintenance {
 			account.InMaintenance = accountToCreate.InMaintenance
 			needsUpdate = true
@@ -708,12 +969,47 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		if account.GCPoliciesJSON != accountToCreate.GCPoliciesJSON {
 			account.GCPoliciesJSON = accountToCreate.GCPoliciesJSON
 			needsUpdate = true
-			needsAudit = true
+		}
+		if account.VulnerabilityPolicyJSON != accountToCreate.VulnerabilityPolicyJSON {
+			account.VulnerabilityPolicyJSON = accountToCreate.VulnerabilityPolicyJSON
+			needsUpdate = true
 		}
 		if account.RequiredLabels != accountToCreate.RequiredLabels {
 			account.RequiredLabels = accountToCreate.RequiredLabels
 			needsUpdate = true
 		}
+		if account.ManifestRetentionSecs != accountToCreate.ManifestRetentionSecs {
+			account.ManifestRetentionSecs = accountToCreate.ManifestRetentionSecs
+			needsUpdate = true
+		}
+		if account.ImmutableTagPattern != accountToCreate.ImmutableTagPattern {
+			account.ImmutableTagPattern = accountToCreate.ImmutableTagPattern
+			needsUpdate = true
+		}
+		if account.MaxManifestSizeBytes != accountToCreate.MaxManifestSizeBytes {
+			account.MaxManifestSizeBytes = accountToCreate.MaxManifestSizeBytes
+			needsUpdate = true
+		}
+		if account.MaxBlobSizeBytes != accountToCreate.MaxBlobSizeBytes {
+			account.MaxBlobSizeBytes = accountToCreate.MaxBlobSizeBytes
+			needsUpdate = true
+		}
+		if account.ManifestLimit != accountToCreate.ManifestLimit {
+			account.ManifestLimit = accountToCreate.ManifestLimit
+			needsUpdate = true
+		}
+		if account.CustomManifestMediaTypes != accountToCreate.CustomManifestMediaTypes {
+			account.CustomManifestMediaTypes = accountToCreate.CustomManifestMediaTypes
+			needsUpdate = true
+		}
+		if account.SignaturePolicyJSON != accountToCreate.SignaturePolicyJSON {
+			account.SignaturePolicyJSON = accountToCreate.SignaturePolicyJSON
+			needsUpdate = true
+		}
+		if account.ReplicationRepoAllowlistJSON != accountToCreate.ReplicationRepoAllowlistJSON {
+			account.ReplicationRepoAllowlistJSON = accountToCreate.ReplicationRepoAllowlistJSON
+			needsUpdate = true
+		}
 		if account.ExternalPeerUserName != accountToCreate.ExternalPeerUserName {
 			account.ExternalPeerUserName = accountToCreate.ExternalPeerUserName
 			needsUpdate = true
@@ -728,7 +1024,8 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
-		if needsAudit {
+		//NOTE: Not every update is audited; e.g. a change of only the external peer password is not shown.
+		if changedBefore, _ := diffAccountAuditFields(accountBefore, *account); changedBefore != "{}" {
 			if userInfo := authz.UserIdentity.UserInfo(); userInfo != nil {
 				a.auditor.Record(audittools.EventParameters{
 					Time:       time.Now(),
@@ -736,7 +1033,7 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 					User:       userInfo,
 					ReasonCode: http.StatusOK,
 					Action:     cadf.UpdateAction,
-					Target:     AuditAccount{Account: *account},
+					Target:     AuditAccount{Account: *account, Before: &accountBefore},
 				})
 			}
 		}
@@ -768,6 +1065,7 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
+	w.Header().Set("ETag", accountETag(accountRendered))
 	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
 }
 
@@ -803,8 +1101,8 @@ func (a *API) putRBACPolicies(account keppel.Account, policies []keppel.RBACPoli
 
 	//put existing set of policies in a map to allow diff with new set
 	mapKey := func(p keppel.RBACPolicy) string {
-		//this mapping is collision-free because RepositoryPattern and UserNamePattern are valid regexes
-		return fmt.Sprintf("%s[%s][%s][%s]", p.AccountName, p.CidrPattern, p.RepositoryPattern, p.UserNamePattern)
+		//this mapping is collision-free because RepositoryPattern, UserNamePattern and GroupPattern are valid regexes
+		return fmt.Sprintf("%s[%s][%s][%s][%s]", p.AccountName, p.CidrPattern, p.RepositoryPattern, p.UserNamePattern, p.GroupPattern)
 	}
 	state := make(map[string]keppel.RBACPolicy)
 	for _, policy := range dbPolicies {
@@ -890,11 +1188,38 @@ func (a *API) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := a.deleteAccount(*account)
+	//render the account before deleting it, so that the audit event can show what was removed
+	accountRendered, err := a.renderAccount(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//with ?force=true, objects that remain in the storage after all DB records
+	//are gone are purged instead of blocking the account deletion
+	force := false
+	if forceStr := r.URL.Query().Get("force"); forceStr != "" {
+		force, err = strconv.ParseBool(forceStr)
+		if err != nil {
+			http.Error(w, "invalid value for force: "+forceStr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := a.deleteAccount(*account, force)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
 	if resp == nil {
+		if userInfo := authz.UserIdentity.UserInfo(); userInfo != nil {
+			a.auditor.Record(audittools.EventParameters{
+				Time:       time.Now(),
+				Request:    r,
+				User:       userInfo,
+				ReasonCode: http.StatusNoContent,
+				Action:     cadf.DeleteAction,
+				Target:     AuditAccountDeletion{Account: accountRendered},
+			})
+		}
 		w.WriteHeader(http.StatusNoContent)
 	} else {
 		respondwith.JSON(w, http.StatusConflict, resp)
@@ -920,11 +1245,12 @@ var (
 	`)
 	deleteAccountReposQuery                   = `DELETE FROM repos WHERE account_name = $1`
 	deleteAccountCountBlobsQuery              = `SELECT COUNT(id) FROM blobs WHERE account_name = $1`
+	deleteAccountCountSharedBlobsQuery        = `SELECT COUNT(id) FROM blobs WHERE storage_account_name = $1`
 	deleteAccountScheduleBlobSweepQuery       = `UPDATE accounts SET next_blob_sweep_at = $2 WHERE name = $1`
 	deleteAccountMarkAllBlobsForDeletionQuery = `UPDATE blobs SET can_be_deleted_at = $2 WHERE account_name = $1`
 )
 
-func (a *API) deleteAccount(account keppel.Account) (*deleteAccountResponse, error) {
+func (a *API) deleteAccount(account keppel.Account, force bool) (*deleteAccountResponse, error) {
 	if !account.InMaintenance {
 		return &deleteAccountResponse{
 			Error: "account must be set in maintenance first",
@@ -981,6 +1307,18 @@ func (a *API) deleteAccount(account keppel.Account) (*deleteAccountResponse, err
 		}, nil
 	}
 
+	//blobs in other accounts may still refer to this account's storage contents
+	//because of cross-account deduplication, so we cannot clean up the storage yet
+	sharedBlobCount, err := a.db.SelectInt(deleteAccountCountSharedBlobsQuery, account.Name)
+	if err != nil {
+		return nil, err
+	}
+	if sharedBlobCount > 0 {
+		return &deleteAccountResponse{
+			Error: fmt.Sprintf("cannot delete account while %d blobs in other accounts share its storage contents", sharedBlobCount),
+		}, nil
+	}
+
 	//start deleting the account in a transaction
 	tx, err := a.db.Begin()
 	if err != nil {
@@ -993,7 +1331,15 @@ func (a *API) deleteAccount(account keppel.Account) (*deleteAccountResponse, err
 	}
 
 	//before committing the transaction, confirm account deletion with the
-	//storage driver and the federation driver
+	//storage driver and the federation driver (when forced, leftovers in the
+	//storage are removed first; at this point, the DB does not reference any
+	//of them anymore)
+	if force {
+		err = keppel.PurgeStorageContents(a.sd, account)
+		if err != nil {
+			return &deleteAccountResponse{Error: err.Error()}, nil
+		}
+	}
 	err = a.sd.CleanupAccount(account)
 	if err != nil {
 		return &deleteAccountResponse{Error: err.Error()}, nil
@@ -1039,7 +1385,64 @@ func (a *API) handlePostAccountSublease(w http.ResponseWriter, r *http.Request)
 		serialized = ""
 	} else {
 		serialized = st.Serialize()
+		//NOTE: The audit event does not contain the token itself since the token is a credential.
+		if userInfo := authz.UserIdentity.UserInfo(); userInfo != nil {
+			a.auditor.Record(audittools.EventParameters{
+				Time:       time.Now(),
+				Request:    r,
+				User:       userInfo,
+				ReasonCode: http.StatusOK,
+				Action:     "create/sublease-token",
+				Target:     AuditAccount{Account: *account},
+			})
+		}
 	}
 
 	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"sublease_token": serialized})
 }
+
+func (a *API) handleGetAccountExport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_export")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanChangeAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+
+	//the export has the same format as the GET response, which can be given to
+	//POST /keppel/v1/accounts/_import as-is
+	accountRendered, err := a.renderAccount(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
+}
+
+var accountNameRx = regexp.MustCompile(`^[a-z0-9-]{1,48}$`)
+
+func (a *API) handlePostAccountImport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/_import")
+	//decode request body
+	var req struct {
+		Account struct {
+			Name string `json:"name"`
+			accountSpec
+		} `json:"account"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !accountNameRx.MatchString(req.Account.Name) {
+		http.Error(w, `malformed attribute "account.name" in request body`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	a.putAccount(w, r, req.Account.Name, req.Account.accountSpec, true)
+}
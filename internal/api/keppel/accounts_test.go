@@ -330,10 +330,10 @@ func TestAccountsAPI(t *testing.T) {
 		},
 	}.Check(t, h)
 	tr.DBChanges().AssertEqual(`
-		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json) VALUES ('first', 'tenant1', '', '', '{"bar":"barbar","foo":"foofoo"}', NULL, NULL, NULL, FALSE, '', '', '', '', '[]');
-		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json) VALUES ('second', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[{"match_repository":".*/database","except_repository":"archive/.*","time_constraint":{"on":"pushed_at","newer_than":{"value":10,"unit":"d"}},"action":"protect"},{"match_repository":".*","only_untagged":true,"action":"delete"}]');
-		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull) VALUES ('second', 'library/.*', '', TRUE, FALSE, FALSE, FALSE, '0.0.0.0/0', FALSE);
-		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull) VALUES ('second', 'library/alpine', '.*@tenant2', FALSE, TRUE, TRUE, FALSE, '0.0.0.0/0', FALSE);
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '{"bar":"barbar","foo":"foofoo"}', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '', 0, '', '', 0, '');
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('second', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[{"match_repository":".*/database","except_repository":"archive/.*","time_constraint":{"on":"pushed_at","newer_than":{"value":10,"unit":"d"}},"action":"protect"},{"match_repository":".*","only_untagged":true,"action":"delete"}]', 0, '', 0, '', 0, '', '', 0, '');
+		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull, match_group) VALUES ('second', 'library/.*', '', TRUE, FALSE, FALSE, FALSE, '0.0.0.0/0', FALSE, '');
+		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull, match_group) VALUES ('second', 'library/alpine', '.*@tenant2', FALSE, TRUE, TRUE, FALSE, '0.0.0.0/0', FALSE, '');
 	`)
 
 	//check editing of InMaintenance flag (this also tests editing of GC policies
@@ -378,24 +378,35 @@ func TestAccountsAPI(t *testing.T) {
 			},
 		}.Check(t, h)
 
-		//the first pass also generates an audit event since we're touching the GCPolicies
+		//the audit event shows the changed fields (the first pass also touches the GCPolicies)
+		changedBefore := fmt.Sprintf(`{"in_maintenance":%t}`, !inMaintenance)
+		changedAfter := fmt.Sprintf(`{"in_maintenance":%t}`, inMaintenance)
 		if inMaintenance {
-			s.Auditor.ExpectEvents(t,
-				cadf.Event{
-					RequestPath: "/keppel/v1/accounts/second",
-					Action:      cadf.UpdateAction,
-					Outcome:     "success",
-					Reason:      test.CADFReasonOK,
-					Target: cadf.Resource{
-						TypeURI:   "docker-registry/account",
-						ID:        "second",
-						ProjectID: "tenant1",
-					},
-				},
-			)
-		} else {
-			s.Auditor.ExpectEvents(t /*, nothing */)
+			changedBefore = fmt.Sprintf(`{"gc_policies":%s,"in_maintenance":false}`, gcPoliciesToJSON(gcPoliciesJSON))
+			changedAfter = `{"gc_policies":[],"in_maintenance":true}`
 		}
+		s.Auditor.ExpectEvents(t,
+			cadf.Event{
+				RequestPath: "/keppel/v1/accounts/second",
+				Action:      cadf.UpdateAction,
+				Outcome:     "success",
+				Reason:      test.CADFReasonOK,
+				Target: cadf.Resource{
+					TypeURI:   "docker-registry/account",
+					ID:        "second",
+					ProjectID: "tenant1",
+					Attachments: []cadf.Attachment{{
+						Name:    "payload-before",
+						TypeURI: "mime:application/json",
+						Content: changedBefore,
+					}, {
+						Name:    "payload",
+						TypeURI: "mime:application/json",
+						Content: changedAfter,
+					}},
+				},
+			},
+		)
 	}
 
 	//check editing of RBAC policies
@@ -557,9 +568,9 @@ func TestAccountsAPI(t *testing.T) {
 	}.Check(t, h)
 	tr.DBChanges().AssertEqual(`
 		UPDATE accounts SET gc_policies_json = '[]' WHERE name = 'second';
-		DELETE FROM rbac_policies WHERE account_name = 'second' AND match_repository = 'library/.*' AND match_username = '' AND match_cidr = '0.0.0.0/0';
-		UPDATE rbac_policies SET can_push = FALSE WHERE account_name = 'second' AND match_repository = 'library/alpine' AND match_username = '.*@tenant2' AND match_cidr = '0.0.0.0/0';
-		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull) VALUES ('second', 'library/alpine', '.*@tenant3', FALSE, TRUE, FALSE, TRUE, '0.0.0.0/0', FALSE);
+		DELETE FROM rbac_policies WHERE account_name = 'second' AND match_repository = 'library/.*' AND match_username = '' AND match_cidr = '0.0.0.0/0' AND match_group = '';
+		UPDATE rbac_policies SET can_push = FALSE WHERE account_name = 'second' AND match_repository = 'library/alpine' AND match_username = '.*@tenant2' AND match_cidr = '0.0.0.0/0' AND match_group = '';
+		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull, match_group) VALUES ('second', 'library/alpine', '.*@tenant3', FALSE, TRUE, FALSE, TRUE, '0.0.0.0/0', FALSE, '');
 	`)
 }
 
@@ -600,6 +611,82 @@ func TestGetAccountsErrorCases(t *testing.T) {
 	}.Check(t, h)
 }
 
+func TestGetAccountsPagination(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//setup 1500 visible accounts, plus one invisible account in between to
+	//check that the page size is applied after filtering by visibility
+	for idx := 1; idx <= 1500; idx++ {
+		mustInsert(t, s.DB, &keppel.Account{
+			Name:           fmt.Sprintf("account%04d", idx),
+			AuthTenantID:   "tenant1",
+			GCPoliciesJSON: "[]",
+		})
+	}
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "account0500-other",
+		AuthTenantID:   "tenant2",
+		GCPoliciesJSON: "[]",
+	})
+
+	getPage := func(path string) (names []string, isTruncated bool) {
+		t.Helper()
+		_, respBody := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var data struct {
+			Accounts []struct {
+				Name string `json:"name"`
+			} `json:"accounts"`
+			IsTruncated bool `json:"truncated"`
+		}
+		err := json.Unmarshal(respBody, &data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, account := range data.Accounts {
+			names = append(names, account.Name)
+		}
+		return names, data.IsTruncated
+	}
+
+	//first page is capped at 1000 results
+	names, isTruncated := getPage("/keppel/v1/accounts")
+	if len(names) != 1000 || !isTruncated {
+		t.Fatalf("expected 1000 accounts with truncated = true on first page, but got %d accounts with truncated = %t", len(names), isTruncated)
+	}
+	if names[0] != "account0001" || names[999] != "account1000" {
+		t.Errorf("unexpected first page: %s ... %s", names[0], names[999])
+	}
+
+	//second page continues after the marker and is not truncated
+	names, isTruncated = getPage("/keppel/v1/accounts?marker=" + names[999])
+	if len(names) != 500 || isTruncated {
+		t.Fatalf("expected 500 accounts with truncated = false on second page, but got %d accounts with truncated = %t", len(names), isTruncated)
+	}
+	if names[0] != "account1001" || names[499] != "account1500" {
+		t.Errorf("unexpected second page: %s ... %s", names[0], names[499])
+	}
+
+	//the hidden ?limit= feature can lower the page size
+	names, isTruncated = getPage("/keppel/v1/accounts?limit=2&marker=account0499")
+	if len(names) != 2 || !isTruncated || names[0] != "account0500" || names[1] != "account0501" {
+		t.Errorf("unexpected page with ?limit=2: %v with truncated = %t", names, isTruncated)
+	}
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?limit=foo",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("strconv.ParseUint: parsing \"foo\": invalid syntax\n"),
+	}.Check(t, h)
+}
+
 func TestPutAccountErrorCases(t *testing.T) {
 	s := test.NewSetup(t, test.WithKeppelAPI)
 	h := s.Handler
@@ -983,7 +1070,7 @@ func TestPutAccountErrorCases(t *testing.T) {
 			},
 		},
 		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("RBAC policy with \"pull\" must have the \"match_cidr\" or \"match_username\" attribute\n"),
+		ExpectBody:   assert.StringData("RBAC policy with \"pull\" must have the \"match_cidr\", \"match_username\" or \"match_group\" attribute\n"),
 	}.Check(t, h)
 	assert.HTTPRequest{
 		Method: "PUT",
@@ -999,7 +1086,7 @@ func TestPutAccountErrorCases(t *testing.T) {
 			},
 		},
 		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("RBAC policy with \"delete\" must have the \"match_username\" attribute\n"),
+		ExpectBody:   assert.StringData("RBAC policy with \"delete\" must have the \"match_username\" or \"match_group\" attribute\n"),
 	}.Check(t, h)
 	assert.HTTPRequest{
 		Method: "PUT",
@@ -1077,8 +1164,8 @@ func TestPutAccountErrorCases(t *testing.T) {
 		},
 	}.Check(t, h)
 	tr.DBChanges().AssertEqual(`
-		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]');
-		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull) VALUES ('first', '', '', FALSE, TRUE, FALSE, FALSE, '1.2.0.0/16', FALSE);
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '', 0, '', '', 0, '');
+		INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull, can_pull, can_push, can_delete, match_cidr, can_anon_first_pull, match_group) VALUES ('first', '', '', FALSE, TRUE, FALSE, FALSE, '1.2.0.0/16', FALSE, '');
 	`)
 	assert.HTTPRequest{
 		Method:       "GET",
@@ -2032,6 +2119,71 @@ func TestDeleteAccount(t *testing.T) {
 	easypg.AssertDBContent(t, s.DB.DbMap.Db, "fixtures/delete-account-003.sql")
 }
 
+func TestDeleteAccountWithResidualStorage(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", InMaintenance: true}),
+	)
+	h := s.Handler
+	account := *s.Accounts[0]
+
+	//simulate drift between DB and storage: the DB does not know about any
+	//blobs or manifests, but the storage still contains some
+	blobContents := []byte("leftover blob")
+	blobSize := uint64(len(blobContents))
+	storageID := s.SIDGenerator.Next()
+	err := s.SD.AppendToBlob(account, storageID, 1, &blobSize, bytes.NewReader(blobContents))
+	if err == nil {
+		err = s.SD.FinalizeBlob(account, storageID, 1)
+	}
+	if err == nil {
+		err = s.SD.WriteManifest(account, "foo", deterministicDummyDigest(1), []byte("leftover manifest"))
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//by default, the storage driver refuses to clean up the account
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody: assert.JSONObject{
+			"error": fmt.Sprintf("found undeleted blob during CleanupAccount: storageID = %q", storageID),
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1?force=maybe",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid value for force: maybe\n"),
+	}.Check(t, h)
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM accounts`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of accounts", count, int64(1))
+	assert.DeepEqual(t, "number of blobs in storage", s.SD.BlobCount(), 1)
+	assert.DeepEqual(t, "number of manifests in storage", s.SD.ManifestCount(), 1)
+
+	//when forced, the leftovers are purged and the account is deleted
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1?force=true",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	count, err = s.DB.SelectInt(`SELECT COUNT(*) FROM accounts`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of accounts", count, int64(0))
+	assert.DeepEqual(t, "number of blobs in storage", s.SD.BlobCount(), 0)
+	assert.DeepEqual(t, "number of manifests in storage", s.SD.ManifestCount(), 0)
+}
+
 //nolint:unparam
 func makeSubleaseToken(accountName, primaryHostname, secret string) string {
 	buf, _ := json.Marshal(assert.JSONObject{
@@ -2209,3 +2361,1278 @@ func TestReplicaAccountsInheritPlatformFilter(t *testing.T) {
 		}.Check(t, s2.Handler)
 	})
 }
+
+func TestPutAccountManifestRetention(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//negative retention periods are rejected
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"manifest_retention": assert.JSONObject{"value": -1, "unit": "d"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("manifest retention may not be negative\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//create an account with a retention period
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"manifest_retention": assert.JSONObject{"value": 7, "unit": "d"},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"in_maintenance":     false,
+				"metadata":           assert.JSONObject{},
+				"rbac_policies":      []assert.JSONObject{},
+				"manifest_retention": assert.JSONObject{"value": 1, "unit": "w"},
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 604800, '', 0, '', 0, '', '', 0, '');
+	`)
+
+	//omitting the retention period disables the trash again
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": false,
+				"metadata":       assert.JSONObject{},
+				"rbac_policies":  []assert.JSONObject{},
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET manifest_retention_secs = 0 WHERE name = 'first';
+	`)
+}
+
+func TestPutAccountImmutableTagPattern(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//invalid regexes are rejected
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":        "tenant1",
+				"immutable_tag_pattern": "v[0-9",
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("\"v[0-9\" is not a valid regex: error parsing regexp: missing closing ]: `[0-9)$`\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//immutable tags are not allowed on replica accounts
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"replication": assert.JSONObject{
+					"strategy": "from_external_on_first_use",
+					"upstream": assert.JSONObject{
+						"url": "registry.example.org",
+					},
+				},
+				"immutable_tag_pattern": "v[0-9.]+",
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("immutable tags are not allowed on replica accounts\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//create an account with an immutable tag pattern
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":        "tenant1",
+				"immutable_tag_pattern": "v[0-9.]+",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                  "first",
+				"auth_tenant_id":        "tenant1",
+				"in_maintenance":        false,
+				"metadata":              assert.JSONObject{},
+				"rbac_policies":         []assert.JSONObject{},
+				"immutable_tag_pattern": "v[0-9.]+",
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, 'v[0-9.]+', 0, '', 0, '', '', 0, '');
+	`)
+
+	//the pattern is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                  "first",
+				"auth_tenant_id":        "tenant1",
+				"in_maintenance":        false,
+				"metadata":              assert.JSONObject{},
+				"rbac_policies":         []assert.JSONObject{},
+				"immutable_tag_pattern": "v[0-9.]+",
+			},
+		},
+	}.Check(t, h)
+
+	//omitting the pattern makes all tags mutable again
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET immutable_tag_pattern = '' WHERE name = 'first';
+	`)
+}
+
+func TestPutAccountReplicationRepoAllowlist(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	replicationPolicy := assert.JSONObject{
+		"strategy": "from_external_on_first_use",
+		"upstream": assert.JSONObject{
+			"url": "registry.example.org",
+		},
+	}
+
+	//the allowlist is not allowed on primary accounts
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":             "tenant1",
+				"replication_repo_allowlist": []string{"library/.*"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("replication repo allowlist is only allowed on replica accounts\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//invalid regexes are rejected
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":             "tenant1",
+				"replication":                replicationPolicy,
+				"replication_repo_allowlist": []string{"library/.*", "foo[0-9"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("\"foo[0-9\" is not a valid regex: error parsing regexp: missing closing ]: `[0-9)$`\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//create a replica account with an allowlist
+	expectedAccount := assert.JSONObject{
+		"name":                       "first",
+		"auth_tenant_id":             "tenant1",
+		"in_maintenance":             false,
+		"metadata":                   assert.JSONObject{},
+		"rbac_policies":              []assert.JSONObject{},
+		"replication":                replicationPolicy,
+		"replication_repo_allowlist": []string{"library/.*", "foo"},
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":             "tenant1",
+				"replication":                replicationPolicy,
+				"replication_repo_allowlist": []string{"library/.*", "foo"},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": expectedAccount},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, 'registry.example.org', '', '', '', '[]', 0, '', 0, '', 0, '', '', 0, '["library/.*","foo"]');
+	`)
+
+	//the allowlist is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": expectedAccount},
+	}.Check(t, h)
+
+	//unlike the replication policy itself, the allowlist can be changed later
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":             "tenant1",
+				"replication":                replicationPolicy,
+				"replication_repo_allowlist": []string{"bar"},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET replication_repo_allowlist_json = '["bar"]' WHERE name = 'first';
+	`)
+
+	//omitting the allowlist allows replication of all repos again
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"replication":    replicationPolicy,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET replication_repo_allowlist_json = '' WHERE name = 'first';
+	`)
+}
+
+func TestPutAccountMaxManifestSize(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//create an account with a manifest size limit
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":          "tenant1",
+				"max_manifest_size_bytes": 65536,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                    "first",
+				"auth_tenant_id":          "tenant1",
+				"in_maintenance":          false,
+				"metadata":                assert.JSONObject{},
+				"rbac_policies":           []assert.JSONObject{},
+				"max_manifest_size_bytes": 65536,
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 65536, '', 0, '', '', 0, '');
+	`)
+
+	//the limit is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                    "first",
+				"auth_tenant_id":          "tenant1",
+				"in_maintenance":          false,
+				"metadata":                assert.JSONObject{},
+				"rbac_policies":           []assert.JSONObject{},
+				"max_manifest_size_bytes": 65536,
+			},
+		},
+	}.Check(t, h)
+
+	//omitting the limit restores the default
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET max_manifest_size_bytes = 0 WHERE name = 'first';
+	`)
+
+	//negative limits are rejected by the JSON parser
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":          "tenant1",
+				"max_manifest_size_bytes": -1,
+			},
+		},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//the default limit cannot be raised (this also keeps values out of the DB
+	//that do not fit into a BIGINT column)
+	for _, limit := range []uint64{keppel.DefaultMaxManifestSizeBytes + 1, 1 << 63} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id":          "tenant1",
+					"max_manifest_size_bytes": limit,
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData(fmt.Sprintf("attribute \"account.max_manifest_size_bytes\" may not be larger than %d\n", keppel.DefaultMaxManifestSizeBytes)),
+		}.Check(t, h)
+	}
+	tr.DBChanges().AssertEmpty()
+}
+
+func TestPutAccountMaxBlobSize(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//create an account with a blob size limit
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":      "tenant1",
+				"max_blob_size_bytes": 1073741824,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                "first",
+				"auth_tenant_id":      "tenant1",
+				"in_maintenance":      false,
+				"metadata":            assert.JSONObject{},
+				"rbac_policies":       []assert.JSONObject{},
+				"max_blob_size_bytes": 1073741824,
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '', 0, '', '', 1073741824, '');
+	`)
+
+	//the limit is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                "first",
+				"auth_tenant_id":      "tenant1",
+				"in_maintenance":      false,
+				"metadata":            assert.JSONObject{},
+				"rbac_policies":       []assert.JSONObject{},
+				"max_blob_size_bytes": 1073741824,
+			},
+		},
+	}.Check(t, h)
+
+	//omitting the limit restores the default
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET max_blob_size_bytes = 0 WHERE name = 'first';
+	`)
+
+	//negative limits are rejected by the JSON parser
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":      "tenant1",
+				"max_blob_size_bytes": -1,
+			},
+		},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//the default limit cannot be raised (this also keeps values out of the DB
+	//that do not fit into a BIGINT column)
+	for _, limit := range []uint64{keppel.DefaultMaxBlobSizeBytes + 1, 1 << 63} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id":      "tenant1",
+					"max_blob_size_bytes": limit,
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData(fmt.Sprintf("attribute \"account.max_blob_size_bytes\" may not be larger than %d\n", keppel.DefaultMaxBlobSizeBytes)),
+		}.Check(t, h)
+	}
+	tr.DBChanges().AssertEmpty()
+}
+
+func TestPutAccountDefaultGCPolicies(t *testing.T) {
+	//keep the 10 newest untagged images, delete all older untagged images
+	defaultPolicies := []keppel.GCPolicy{
+		{
+			RepositoryPattern: ".*",
+			OnlyUntagged:      true,
+			TimeConstraint:    &keppel.GCTimeConstraint{FieldName: "pushed_at", NewestCount: 10},
+			Action:            "protect",
+		},
+		{
+			RepositoryPattern: ".*",
+			OnlyUntagged:      true,
+			Action:            "delete",
+		},
+	}
+	defaultPoliciesJSON := []assert.JSONObject{
+		{
+			"match_repository": ".*",
+			"only_untagged":    true,
+			"time_constraint":  assert.JSONObject{"on": "pushed_at", "newest": 10},
+			"action":           "protect",
+		},
+		{
+			"match_repository": ".*",
+			"only_untagged":    true,
+			"action":           "delete",
+		},
+	}
+	explicitPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "foo",
+		"action":           "protect",
+	}}
+
+	s := test.NewSetup(t, test.WithKeppelAPI, test.WithDefaultGCPolicies(defaultPolicies...))
+	h := s.Handler
+
+	putAccount := func(name string, accountBody assert.JSONObject) {
+		t.Helper()
+		accountBody["auth_tenant_id"] = "tenant1"
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         "/keppel/v1/accounts/" + name,
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body:         assert.JSONObject{"account": accountBody},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+	}
+	expectGCPolicies := func(name string, policiesJSON []assert.JSONObject) {
+		t.Helper()
+		account := assert.JSONObject{
+			"name":           name,
+			"auth_tenant_id": "tenant1",
+			"in_maintenance": false,
+			"metadata":       assert.JSONObject{},
+			"rbac_policies":  []assert.JSONObject{},
+		}
+		if len(policiesJSON) > 0 {
+			account["gc_policies"] = policiesJSON
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/" + name,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"account": account},
+		}.Check(t, h)
+	}
+
+	//a new account without GC policies inherits the default policies
+	putAccount("first", assert.JSONObject{})
+	expectGCPolicies("first", defaultPoliciesJSON)
+
+	//an explicitly empty list of GC policies is respected...
+	putAccount("second", assert.JSONObject{"gc_policies": []assert.JSONObject{}})
+	expectGCPolicies("second", nil)
+
+	//...as are explicitly specified GC policies
+	putAccount("third", assert.JSONObject{"gc_policies": explicitPoliciesJSON})
+	expectGCPolicies("third", explicitPoliciesJSON)
+
+	//updating an account does not re-apply the default policies
+	putAccount("second", assert.JSONObject{"in_maintenance": false})
+	expectGCPolicies("second", nil)
+	putAccount("first", assert.JSONObject{"gc_policies": explicitPoliciesJSON})
+	expectGCPolicies("first", explicitPoliciesJSON)
+}
+
+func TestPutAccountVulnerabilityPolicy(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//create an account with a vulnerability policy
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"vulnerability_policy": assert.JSONObject{
+					"block_pulls_at_severity":   "Critical",
+					"block_pulls_while_pending": true,
+				},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": false,
+				"metadata":       assert.JSONObject{},
+				"rbac_policies":  []assert.JSONObject{},
+				"vulnerability_policy": assert.JSONObject{
+					"block_pulls_at_severity":   "Critical",
+					"block_pulls_while_pending": true,
+				},
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '{"block_pulls_at_severity":"Critical","block_pulls_while_pending":true}', 0, '', '', 0, '');
+	`)
+
+	//the policy can be changed
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"vulnerability_policy": assert.JSONObject{
+					"block_pulls_at_severity": "High",
+				},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET vuln_policy_json = '{"block_pulls_at_severity":"High"}' WHERE name = 'first';
+	`)
+
+	//only actual severities are accepted as threshold
+	for _, severity := range []string{"Clean", "Pending", "Dangerous"} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"vulnerability_policy": assert.JSONObject{
+						"block_pulls_at_severity": severity,
+					},
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData(fmt.Sprintf("%q is not a valid severity for a vulnerability policy\n", severity)),
+		}.Check(t, h)
+	}
+	tr.DBChanges().AssertEmpty()
+
+	//omitting the policy removes it
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": false,
+				"metadata":       assert.JSONObject{},
+				"rbac_policies":  []assert.JSONObject{},
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET vuln_policy_json = '' WHERE name = 'first';
+	`)
+}
+
+func TestPutAccountManifestLimit(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//create an account with a manifest limit
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"manifest_limit": 100,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": false,
+				"metadata":       assert.JSONObject{},
+				"rbac_policies":  []assert.JSONObject{},
+				"manifest_limit": 100,
+			},
+		},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '', 100, '', '', 0, '');
+	`)
+
+	//the limit is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": false,
+				"metadata":       assert.JSONObject{},
+				"rbac_policies":  []assert.JSONObject{},
+				"manifest_limit": 100,
+			},
+		},
+	}.Check(t, h)
+
+	//omitting the limit removes it
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET manifest_limit = 0 WHERE name = 'first';
+	`)
+}
+
+const testSignaturePolicyPublicKey = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEZssaD0pXl0AR2KfxvVM8x/118RO+
+7Kw139+D9F2xNCCwV8/Zwrcb1ZIp/S0y4qzqN5c5O05FtN8jWfGjpNOhEQ==
+-----END PUBLIC KEY-----
+`
+
+func TestPutAccountSignaturePolicy(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	tr, tr0 := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr0.AssertEmpty()
+
+	//malformed public keys are rejected
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":   "tenant1",
+				"signature_policy": assert.JSONObject{"public_key": "not a key"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("public key for signature policy is not in PEM format\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//signature policies are not allowed on replica accounts
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"replication": assert.JSONObject{
+					"strategy": "from_external_on_first_use",
+					"upstream": assert.JSONObject{
+						"url": "registry.example.org",
+					},
+				},
+				"signature_policy": assert.JSONObject{"public_key": testSignaturePolicyPublicKey},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("signature policies are not allowed on replica accounts\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	//create an account with a signature policy
+	expectedAccount := assert.JSONObject{
+		"name":             "first",
+		"auth_tenant_id":   "tenant1",
+		"in_maintenance":   false,
+		"metadata":         assert.JSONObject{},
+		"rbac_policies":    []assert.JSONObject{},
+		"signature_policy": assert.JSONObject{"public_key": testSignaturePolicyPublicKey},
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":   "tenant1",
+				"signature_policy": assert.JSONObject{"public_key": testSignaturePolicyPublicKey},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": expectedAccount},
+	}.Check(t, h)
+	policyJSON, err := json.Marshal(keppel.SignaturePolicy{PublicKey: testSignaturePolicyPublicKey})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.DBChanges().AssertEqualf(`
+		INSERT INTO accounts (name, auth_tenant_id, upstream_peer_hostname, required_labels, metadata_json, next_blob_sweep_at, next_storage_sweep_at, next_federation_announcement_at, in_maintenance, external_peer_url, external_peer_username, external_peer_password, platform_filter, gc_policies_json, manifest_retention_secs, immutable_tag_pattern, max_manifest_size_bytes, vuln_policy_json, manifest_limit, custom_manifest_media_types, signature_policy_json, max_blob_size_bytes, replication_repo_allowlist_json) VALUES ('first', 'tenant1', '', '', '', NULL, NULL, NULL, FALSE, '', '', '', '', '[]', 0, '', 0, '', 0, '', '%s', 0, '');
+	`, string(policyJSON))
+
+	//the policy is shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": expectedAccount},
+	}.Check(t, h)
+
+	//omitting the policy removes it
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`
+		UPDATE accounts SET signature_policy_json = '' WHERE name = 'first';
+	`)
+}
+
+func TestAccountAuditEvents(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//creating an account records the initial configuration
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"manifest_limit": 10,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/keppel/v1/accounts/first",
+		Action:      cadf.CreateAction,
+		Outcome:     "success",
+		Reason:      test.CADFReasonOK,
+		Target: cadf.Resource{
+			TypeURI:   "docker-registry/account",
+			ID:        "first",
+			ProjectID: "tenant1",
+		},
+	})
+
+	//updating an account records the changed fields before and after
+	gcPoliciesJSON := []assert.JSONObject{{
+		"match_repository": ".*",
+		"only_untagged":    true,
+		"action":           "delete",
+	}}
+	rbacPolicyJSON := assert.JSONObject{
+		"match_repository": "library/.*",
+		"permissions":      []string{"anonymous_pull"},
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"manifest_limit": 20,
+				"gc_policies":    gcPoliciesJSON,
+				"rbac_policies":  []assert.JSONObject{rbacPolicyJSON},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t,
+		cadf.Event{
+			RequestPath: "/keppel/v1/accounts/first",
+			Action:      cadf.UpdateAction,
+			Outcome:     "success",
+			Reason:      test.CADFReasonOK,
+			Target: cadf.Resource{
+				TypeURI:   "docker-registry/account",
+				ID:        "first",
+				ProjectID: "tenant1",
+				Attachments: []cadf.Attachment{{
+					Name:    "gc-policies",
+					TypeURI: "mime:application/json",
+					Content: gcPoliciesToJSON(gcPoliciesJSON),
+				}, {
+					Name:    "payload-before",
+					TypeURI: "mime:application/json",
+					Content: `{"gc_policies":[],"manifest_limit":10}`,
+				}, {
+					Name:    "payload",
+					TypeURI: "mime:application/json",
+					Content: fmt.Sprintf(`{"gc_policies":%s,"manifest_limit":20}`, gcPoliciesToJSON(gcPoliciesJSON)),
+				}},
+			},
+		},
+		cadf.Event{
+			RequestPath: "/keppel/v1/accounts/first",
+			Action:      "create/rbac-policy",
+			Outcome:     "success",
+			Reason:      test.CADFReasonOK,
+			Target: cadf.Resource{
+				TypeURI:   "docker-registry/account",
+				ID:        "first",
+				ProjectID: "tenant1",
+				Attachments: []cadf.Attachment{{
+					Name:    "payload",
+					TypeURI: "mime:application/json",
+					Content: test.ToJSON(rbacPolicyJSON),
+				}},
+			},
+		},
+	)
+
+	//issuing a sublease token is recorded (without the token itself)
+	s.FD.NextSubleaseTokenSecretToIssue = "this-is-the-token"
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/sublease",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/keppel/v1/accounts/first/sublease",
+		Action:      "create/sublease-token",
+		Outcome:     "success",
+		Reason:      test.CADFReasonOK,
+		Target: cadf.Resource{
+			TypeURI:   "docker-registry/account",
+			ID:        "first",
+			ProjectID: "tenant1",
+			Attachments: []cadf.Attachment{{
+				Name:    "gc-policies",
+				TypeURI: "mime:application/json",
+				Content: gcPoliciesToJSON(gcPoliciesJSON),
+			}},
+		},
+	})
+
+	//deleting an account records everything that was removed
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"in_maintenance": true,
+				"manifest_limit": 20,
+				"gc_policies":    gcPoliciesJSON,
+				"rbac_policies":  []assert.JSONObject{rbacPolicyJSON},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	s.Auditor.IgnoreEventsUntilNow()
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/keppel/v1/accounts/first",
+		Action:      cadf.DeleteAction,
+		Outcome:     "success",
+		Reason:      cadf.Reason{ReasonType: "HTTP", ReasonCode: "204"},
+		Target: cadf.Resource{
+			TypeURI:   "docker-registry/account",
+			ID:        "first",
+			ProjectID: "tenant1",
+			Attachments: []cadf.Attachment{{
+				Name:    "payload",
+				TypeURI: "mime:application/json",
+				Content: fmt.Sprintf(
+					`{"name":"first","auth_tenant_id":"tenant1","in_maintenance":true,"metadata":{},"gc_policies":%s,"rbac_policies":[%s],"manifest_limit":20}`,
+					gcPoliciesToJSON(gcPoliciesJSON), test.ToJSON(rbacPolicyJSON),
+				),
+			}},
+		},
+	})
+}
+
+func TestAccountExportImport(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//create an account with all kinds of policies
+	accountJSON := assert.JSONObject{
+		"name":           "first",
+		"auth_tenant_id": "tenant1",
+		"in_maintenance": false,
+		"metadata":       assert.JSONObject{"foo": "bar"},
+		"gc_policies": []assert.JSONObject{{
+			"match_repository": ".*",
+			"only_untagged":    true,
+			"action":           "delete",
+		}},
+		"rbac_policies": []assert.JSONObject{{
+			"match_repository": "library/.*",
+			"permissions":      []string{"anonymous_pull"},
+		}},
+		"validation":            assert.JSONObject{"required_labels": []string{"maintainer", "source_repo"}},
+		"manifest_retention":    assert.JSONObject{"value": 1, "unit": "d"},
+		"immutable_tag_pattern": "v[0-9]+",
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":        "tenant1",
+				"metadata":              accountJSON["metadata"],
+				"gc_policies":           accountJSON["gc_policies"],
+				"rbac_policies":         accountJSON["rbac_policies"],
+				"validation":            accountJSON["validation"],
+				"manifest_retention":    assert.JSONObject{"value": 1, "unit": "d"},
+				"immutable_tag_pattern": "v[0-9]+",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+
+	//exporting requires the permission to change the account
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	_, exportBytes := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": accountJSON},
+	}.Check(t, h)
+
+	//importing into an existing account is not allowed
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/_import",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.ByteData(exportBytes),
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("account already exists\n"),
+	}.Check(t, h)
+
+	//import into a fresh DB recreates the same account
+	s = test.NewSetup(t, test.WithKeppelAPI)
+	h = s.Handler
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/_import",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body:         assert.ByteData(exportBytes),
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/_import",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.ByteData(exportBytes),
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": accountJSON},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": accountJSON},
+	}.Check(t, h)
+
+	//error cases for import
+	testCases := []struct {
+		Account       assert.JSONObject
+		ExpectStatus  int
+		ExpectMessage string
+	}{
+		{
+			Account:       assert.JSONObject{"name": "Not-Valid", "auth_tenant_id": "tenant1"},
+			ExpectStatus:  http.StatusUnprocessableEntity,
+			ExpectMessage: `malformed attribute "account.name" in request body`,
+		},
+		{
+			Account:       assert.JSONObject{"name": "second", "auth_tenant_id": "invalid"},
+			ExpectStatus:  http.StatusUnprocessableEntity,
+			ExpectMessage: `malformed attribute "account.auth_tenant_id" in request body: must not be "invalid"`,
+		},
+		{
+			Account:       assert.JSONObject{"name": "keppel-second", "auth_tenant_id": "tenant1"},
+			ExpectStatus:  http.StatusUnprocessableEntity,
+			ExpectMessage: `account names with the prefix "keppel" are reserved for internal use`,
+		},
+		{
+			Account:       assert.JSONObject{"name": "second", "auth_tenant_id": "tenant1", "unknown_field": 42},
+			ExpectStatus:  http.StatusBadRequest,
+			ExpectMessage: `request body is not valid JSON: json: unknown field "unknown_field"`,
+		},
+	}
+	for _, tc := range testCases {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/_import",
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body:         assert.JSONObject{"account": tc.Account},
+			ExpectStatus: tc.ExpectStatus,
+			ExpectBody:   assert.StringData(tc.ExpectMessage + "\n"),
+		}.Check(t, h)
+	}
+}
+
+func TestAccountsInReadOnlyMode(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "first", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"}),
+	)
+	h := keppel.ReadOnlyMiddleware(s.Handler)
+
+	//reads pass through
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+
+	//writes are rejected
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/second",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{"auth_tenant_id": "tenant1"},
+		},
+		ExpectStatus: http.StatusServiceUnavailable,
+		ExpectBody:   assert.StringData("Keppel is in read-only mode, please try again later\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/second",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+}
+
+func TestPutAccountIfMatch(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	putAccount := func(header map[string]string, metadata assert.JSONObject, expectStatus int) *http.Response {
+		t.Helper()
+		header["X-Test-Perms"] = "change:tenant1"
+		resp, _ := assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: header,
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"metadata":       metadata,
+				},
+			},
+			ExpectStatus: expectStatus,
+		}.Check(t, h)
+		return resp
+	}
+	getAccount := func(metadata assert.JSONObject) string {
+		t.Helper()
+		resp, _ := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"in_maintenance": false,
+					"metadata":       metadata,
+					"rbac_policies":  []assert.JSONObject{},
+				},
+			},
+		}.Check(t, h)
+		return resp.Header.Get("ETag")
+	}
+
+	//If-Match on an account that does not exist yet fails
+	putAccount(map[string]string{"If-Match": "*"}, assert.JSONObject{}, http.StatusPreconditionFailed)
+
+	//without If-Match, PUT works unconditionally (this is the existing behavior)
+	resp := putAccount(map[string]string{}, assert.JSONObject{"foo": "bar"}, http.StatusOK)
+	etag1 := getAccount(assert.JSONObject{"foo": "bar"})
+	if etag1 == "" {
+		t.Fatal("expected ETag header on GET, but got none")
+	}
+	assert.DeepEqual(t, "ETag from PUT", resp.Header.Get("ETag"), etag1)
+
+	//a matching If-Match header allows the update to be applied
+	resp = putAccount(map[string]string{"If-Match": etag1}, assert.JSONObject{"foo": "baz"}, http.StatusOK)
+	etag2 := getAccount(assert.JSONObject{"foo": "baz"})
+	assert.DeepEqual(t, "ETag from PUT", resp.Header.Get("ETag"), etag2)
+	if etag1 == etag2 {
+		t.Errorf("expected ETag to change after update, but got %s both times", etag1)
+	}
+
+	//a stale If-Match header is rejected without changing the account
+	putAccount(map[string]string{"If-Match": etag1}, assert.JSONObject{"foo": "qux"}, http.StatusPreconditionFailed)
+	getAccount(assert.JSONObject{"foo": "baz"})
+
+	//If-Match may contain multiple ETags or a wildcard
+	putAccount(map[string]string{"If-Match": etag1 + ", " + etag2}, assert.JSONObject{"foo": "qux"}, http.StatusOK)
+	getAccount(assert.JSONObject{"foo": "qux"})
+	putAccount(map[string]string{"If-Match": "*"}, assert.JSONObject{}, http.StatusOK)
+	getAccount(assert.JSONObject{})
+
+	//since the ETag is derived from the account contents, reverting to an
+	//earlier state yields the earlier ETag
+	putAccount(map[string]string{}, assert.JSONObject{"foo": "bar"}, http.StatusOK)
+	assert.DeepEqual(t, "ETag after reverting", getAccount(assert.JSONObject{"foo": "bar"}), etag1)
+}
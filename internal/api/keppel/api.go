@@ -25,6 +25,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/respondwith"
@@ -43,11 +44,20 @@ type API struct {
 	icd        keppel.InboundCacheDriver
 	db         *keppel.DB
 	auditor    keppel.Auditor
+	ufl        *processor.UpstreamFetchLimiter //may be nil
+	//non-pure functions that can be replaced by deterministic doubles for unit tests
+	timeNow func() time.Time
 }
 
 // NewAPI constructs a new API instance.
-func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor) *API {
-	return &API{cfg, ad, fd, sd, icd, db, auditor}
+func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor, ufl *processor.UpstreamFetchLimiter) *API {
+	return &API{cfg, ad, fd, sd, icd, db, auditor, ufl, time.Now}
+}
+
+// OverrideTimeNow replaces time.Now with a test double.
+func (a *API) OverrideTimeNow(timeNow func() time.Time) *API {
+	a.timeNow = timeNow
+	return a
 }
 
 // AddTo implements the api.API interface.
@@ -61,23 +71,40 @@ func (a *API) AddTo(r *mux.Router) {
 	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(a.handlePutAccount)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(a.handleDeleteAccount)
 	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/sublease").HandlerFunc(a.handlePostAccountSublease)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_export").HandlerFunc(a.handleGetAccountExport)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_permissions").HandlerFunc(a.handleGetAccountPermissions)
+	r.Methods("POST").Path("/keppel/v1/accounts/_import").HandlerFunc(a.handlePostAccountImport)
 
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests").HandlerFunc(a.handleGetManifests)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/_exists").HandlerFunc(a.handlePostManifestsExists)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}").HandlerFunc(a.handleDeleteManifest)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/_validate").HandlerFunc(a.handlePostManifestValidate)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/vulnerability_report").HandlerFunc(a.handleGetVulnerabilityReport)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/labels").HandlerFunc(a.handleGetManifestLabels)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/_ancestry").HandlerFunc(a.handleGetManifestAncestry)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags").HandlerFunc(a.handleGetTags)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}").HandlerFunc(a.handleDeleteTag)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_retag").HandlerFunc(a.handlePostRetag)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_replicate").HandlerFunc(a.handlePostReplicate)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_deleted_manifests").HandlerFunc(a.handleGetDeletedManifests)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_deleted_manifests/{digest}/_restore").HandlerFunc(a.handlePostDeletedManifestRestore)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_pull_stats").HandlerFunc(a.handleGetPullStats)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_blobs").HandlerFunc(a.handleGetBlobs)
 
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories").HandlerFunc(a.handleGetRepositories)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}").HandlerFunc(a.handleDeleteRepository)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_rename").HandlerFunc(a.handlePostRepositoryRename)
+	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_metadata").HandlerFunc(a.handlePutRepositoryMetadata)
 
 	r.Methods("GET").Path("/keppel/v1/peers").HandlerFunc(a.handleGetPeers)
+	r.Methods("GET").Path("/keppel/v1/peers/{hostname}").HandlerFunc(a.handleGetPeer)
 
 	r.Methods("GET").Path("/keppel/v1/quotas/{auth_tenant_id}").HandlerFunc(a.handleGetQuotas)
 	r.Methods("PUT").Path("/keppel/v1/quotas/{auth_tenant_id}").HandlerFunc(a.handlePutQuotas)
 }
 
 func (a *API) processor() *processor.Processor {
-	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor)
+	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor).WithUpstreamFetchLimiter(a.ufl).OverrideTimeNow(a.timeNow)
 }
 
 func (a *API) handleGetAPIInfo(w http.ResponseWriter, r *http.Request) {
@@ -194,8 +221,12 @@ func isValidRepoName(name string) bool {
 type paginatedQuery struct {
 	SQL         string
 	MarkerField string
-	Options     url.Values
-	BindValues  []interface{}
+	//If MarkerCondition is not empty, it replaces the default condition
+	//`MarkerField > $MARKER` for selecting the rows after the marker. The
+	//placeholder $MARKER will be replaced by the marker's bind parameter.
+	MarkerCondition string
+	Options         url.Values
+	BindValues      []interface{}
 }
 
 func (q paginatedQuery) Prepare() (modifiedSQLQuery string, modifiedBindValues []interface{}, limit uint64, err error) {
@@ -220,6 +251,11 @@ func (q paginatedQuery) Prepare() (modifiedSQLQuery string, modifiedBindValues [
 		query = strings.Replace(query, `$CONDITION`, `TRUE`, 1)
 		return query, q.BindValues, limit, nil
 	}
-	query = strings.Replace(query, `$CONDITION`, q.MarkerField+` > $2`, 1)
+	condition := q.MarkerCondition
+	if condition == "" {
+		condition = q.MarkerField + ` > $MARKER`
+	}
+	condition = strings.ReplaceAll(condition, `$MARKER`, fmt.Sprintf(`$%d`, len(q.BindValues)+1))
+	query = strings.Replace(query, `$CONDITION`, condition, 1)
 	return query, append(q.BindValues, marker), limit, nil
 }
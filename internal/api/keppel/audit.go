@@ -20,6 +20,7 @@ package keppelv1
 
 import (
 	"encoding/json"
+	"reflect"
 
 	"github.com/sapcc/go-api-declarations/cadf"
 
@@ -29,6 +30,8 @@ import (
 // AuditAccount is an audittools.EventRenderer.
 type AuditAccount struct {
 	Account keppel.Account
+	//Before is given for updates, in order to show which fields were changed
+	Before *keppel.Account
 }
 
 // Render implements the audittools.EventRenderer interface.
@@ -48,9 +51,99 @@ func (a AuditAccount) Render() cadf.Resource {
 		})
 	}
 
+	if a.Account.VulnerabilityPolicyJSON != "" {
+		res.Attachments = append(res.Attachments, cadf.Attachment{
+			Name:    "vulnerability-policy",
+			TypeURI: "mime:application/json",
+			Content: a.Account.VulnerabilityPolicyJSON,
+		})
+	}
+
+	if a.Before != nil {
+		changedBefore, changedAfter := diffAccountAuditFields(*a.Before, a.Account)
+		res.Attachments = append(res.Attachments, cadf.Attachment{
+			Name:    "payload-before",
+			TypeURI: "mime:application/json",
+			Content: changedBefore,
+		}, cadf.Attachment{
+			Name:    "payload",
+			TypeURI: "mime:application/json",
+			Content: changedAfter,
+		})
+	}
+
 	return res
 }
 
+// accountAuditFields returns those attributes of an account that are shown in
+// audit events for account updates. Credentials (like the password for an
+// external peer) are deliberately not included.
+func accountAuditFields(account keppel.Account) map[string]interface{} {
+	rawJSONOrNil := func(str string) interface{} {
+		if str == "" {
+			return nil
+		}
+		return json.RawMessage(str)
+	}
+	return map[string]interface{}{
+		"in_maintenance":              account.InMaintenance,
+		"metadata":                    rawJSONOrNil(account.MetadataJSON),
+		"gc_policies":                 rawJSONOrNil(account.GCPoliciesJSON),
+		"vulnerability_policy":        rawJSONOrNil(account.VulnerabilityPolicyJSON),
+		"required_labels":             account.RequiredLabels,
+		"manifest_retention_secs":     account.ManifestRetentionSecs,
+		"immutable_tag_pattern":       account.ImmutableTagPattern,
+		"max_manifest_size_bytes":     account.MaxManifestSizeBytes,
+		"max_blob_size_bytes":         account.MaxBlobSizeBytes,
+		"manifest_limit":              account.ManifestLimit,
+		"custom_manifest_media_types": account.CustomManifestMediaTypes,
+		"signature_policy":            rawJSONOrNil(account.SignaturePolicyJSON),
+		"external_peer_username":      account.ExternalPeerUserName,
+		"replication_repo_allowlist":  rawJSONOrNil(account.ReplicationRepoAllowlistJSON),
+	}
+}
+
+// diffAccountAuditFields renders those fields from accountAuditFields() that
+// differ between the two given accounts. The result is two JSON objects with
+// the same set of keys. If nothing changed, both objects are empty.
+func diffAccountAuditFields(before, after keppel.Account) (changedBefore, changedAfter string) {
+	fieldsBefore := accountAuditFields(before)
+	fieldsAfter := accountAuditFields(after)
+	resultBefore := make(map[string]interface{})
+	resultAfter := make(map[string]interface{})
+	for key, valueAfter := range fieldsAfter {
+		valueBefore := fieldsBefore[key]
+		if !reflect.DeepEqual(valueBefore, valueAfter) {
+			resultBefore[key] = valueBefore
+			resultAfter[key] = valueAfter
+		}
+	}
+	bufBefore, _ := json.Marshal(resultBefore)
+	bufAfter, _ := json.Marshal(resultAfter)
+	return string(bufBefore), string(bufAfter)
+}
+
+// AuditAccountDeletion is an audittools.EventRenderer. It records the full
+// configuration of an account that was deleted (including its RBAC policies).
+type AuditAccountDeletion struct {
+	Account Account
+}
+
+// Render implements the audittools.EventRenderer interface.
+func (a AuditAccountDeletion) Render() cadf.Resource {
+	content, _ := json.Marshal(a.Account)
+	return cadf.Resource{
+		TypeURI:   "docker-registry/account",
+		ID:        a.Account.Name,
+		ProjectID: a.Account.AuthTenantID,
+		Attachments: []cadf.Attachment{{
+			Name:    "payload",
+			TypeURI: "mime:application/json",
+			Content: string(content),
+		}},
+	}
+}
+
 // AuditQuotas is an audittools.EventRenderer.
 type AuditQuotas struct {
 	QuotasBefore keppel.Quotas
@@ -80,9 +173,11 @@ func (a AuditQuotas) Render() cadf.Resource {
 
 func quotasToJSON(q keppel.Quotas) string {
 	data := struct {
-		ManifestCount uint64 `json:"manifests"`
+		ManifestCount uint64  `json:"manifests"`
+		StorageBytes  *uint64 `json:"storage_bytes,omitempty"`
 	}{
 		ManifestCount: q.ManifestCount,
+		StorageBytes:  q.StorageBytes,
 	}
 	buf, _ := json.Marshal(data)
 	return string(buf)
@@ -0,0 +1,106 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// Blob represents a blob mounted into a repository in the API.
+type Blob struct {
+	Digest    string `json:"digest"`
+	SizeBytes uint64 `json:"size_bytes"`
+	MediaType string `json:"media_type"`
+	PushedAt  int64  `json:"pushed_at"`
+	//IsReferenced is false if the blob is only mounted into the repository,
+	//without being referenced by any of the repository's manifests.
+	IsReferenced bool `json:"referenced"`
+}
+
+var blobListQuery = sqlext.SimplifyWhitespace(`
+	SELECT b.digest, b.size_bytes, b.media_type, b.pushed_at,
+	       EXISTS(SELECT 1 FROM manifest_blob_refs r WHERE r.repo_id = $1 AND r.blob_id = b.id)
+	  FROM blobs b
+	  JOIN blob_mounts bm ON bm.blob_id = b.id
+	 WHERE bm.repo_id = $1 AND $CONDITION
+	 ORDER BY b.digest ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetBlobs(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_blobs")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         blobListQuery,
+		MarkerField: "b.digest",
+		Options:     r.URL.Query(),
+		BindValues:  []interface{}{repo.ID},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result struct {
+		Blobs       []Blob `json:"blobs"`
+		IsTruncated bool   `json:"truncated,omitempty"`
+	}
+	result.Blobs = []Blob{}
+	err = sqlext.ForeachRow(a.db, query, bindValues, func(rows *sql.Rows) error {
+		if uint64(len(result.Blobs)) >= limit {
+			result.IsTruncated = true
+			return nil
+		}
+		var (
+			blob     Blob
+			pushedAt time.Time
+		)
+		err := rows.Scan(&blob.Digest, &blob.SizeBytes, &blob.MediaType, &pushedAt, &blob.IsReferenced)
+		if err != nil {
+			return err
+		}
+		blob.PushedAt = pushedAt.Unix()
+		result.Blobs = append(result.Blobs, blob)
+		return nil
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
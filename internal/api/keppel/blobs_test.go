@@ -0,0 +1,138 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestBlobsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	s.Clock.StepBy(1 * time.Hour)
+	fooRepo := keppel.Repository{AccountName: "test1", Name: "foo"}
+
+	//without blobs, the list is empty
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"blobs": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//push an image (whose blobs are referenced by its manifest) and an
+	//additional blob that is only mounted into the repo
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepo, "latest")
+	s.Clock.StepBy(1 * time.Minute)
+	orphan := test.GenerateExampleLayer(2)
+	orphan.MustUpload(t, s, fooRepo)
+
+	renderedBlobs := sortedBlobs(
+		assert.JSONObject{
+			"digest":     image.Layers[0].Digest.String(),
+			"size_bytes": len(image.Layers[0].Contents),
+			"media_type": schema2.MediaTypeLayer,
+			"pushed_at":  3600,
+			"referenced": true,
+		},
+		assert.JSONObject{
+			"digest":     image.Config.Digest.String(),
+			"size_bytes": len(image.Config.Contents),
+			"media_type": schema2.MediaTypeImageConfig,
+			"pushed_at":  3600,
+			"referenced": true,
+		},
+		assert.JSONObject{
+			"digest":     orphan.Digest.String(),
+			"size_bytes": len(orphan.Contents),
+			"media_type": "",
+			"pushed_at":  3660,
+			"referenced": false,
+		},
+	)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"blobs": renderedBlobs},
+	}.Check(t, h)
+
+	//test pagination
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs?limit=2",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"blobs": renderedBlobs[0:2], "truncated": true},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs?limit=2&marker=" + renderedBlobs[1]["digest"].(string),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"blobs": renderedBlobs[2:]},
+	}.Check(t, h)
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs?limit=foo",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/bar/_blobs",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+}
+
+// sortedBlobs orders the given blobs by digest, like the API does.
+func sortedBlobs(blobs ...assert.JSONObject) []assert.JSONObject {
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i]["digest"].(string) < blobs[j]["digest"].(string)
+	})
+	return blobs
+}
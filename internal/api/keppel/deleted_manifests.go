@@ -0,0 +1,116 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppelv1
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// DeletedManifest represents a deleted manifest in the API.
+type DeletedManifest struct {
+	Digest     string `json:"digest"`
+	MediaType  string `json:"media_type"`
+	SizeBytes  uint64 `json:"size_bytes"`
+	DeletedAt  int64  `json:"deleted_at"`
+	PurgeAfter int64  `json:"purge_after"`
+}
+
+func (a *API) handleGetDeletedManifests(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_deleted_manifests")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	var dbDeletedManifests []keppel.DeletedManifest
+	_, err := a.db.Select(&dbDeletedManifests,
+		`SELECT * FROM deleted_manifests WHERE repo_id = $1 AND purge_after > $2 ORDER BY deleted_at DESC, digest`,
+		repo.ID, a.timeNow())
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	result := make([]DeletedManifest, len(dbDeletedManifests))
+	for idx, dm := range dbDeletedManifests {
+		result[idx] = DeletedManifest{
+			Digest:     dm.Digest,
+			MediaType:  dm.MediaType,
+			SizeBytes:  dm.SizeBytes,
+			DeletedAt:  dm.DeletedAt.Unix(),
+			PurgeAfter: dm.PurgeAfter.Unix(),
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"deleted_manifests": result})
+}
+
+func (a *API) handlePostDeletedManifestRestore(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_deleted_manifests/:digest/_restore")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = a.processor().RestoreManifest(*account, *repo, parsedDigest.String(), keppel.AuditContext{
+		UserIdentity: authz.UserIdentity,
+		Request:      r,
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such deleted manifest", http.StatusNotFound)
+		return
+	}
+	if rerr, ok := err.(*keppel.RegistryV2Error); ok && rerr != nil {
+		rerr.WriteAsTextTo(w)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+/******************************************************************************
+*
+*  Copyright 2019 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestDeletedManifestsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", ManifestRetentionSecs: 86400}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	s.Clock.StepBy(1 * time.Hour)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, keppel.Repository{AccountName: "test1", Name: "foo"}, "")
+	digestStr := image.Manifest.Digest.String()
+
+	//the trash starts out empty
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"deleted_manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//delete the manifest, which moves it into the trash
+	deletedAt := s.Clock.Now()
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + digestStr,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	s.Clock.StepBy(1 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"deleted_manifests": []assert.JSONObject{{
+			"digest":      digestStr,
+			"media_type":  image.Manifest.MediaType,
+			"size_bytes":  image.SizeBytes(),
+			"deleted_at":  deletedAt.Unix(),
+			"purge_after": deletedAt.Add(24 * time.Hour).Unix(),
+		}}},
+	}.Check(t, h)
+
+	//test restore failure cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests/" + digestStr + "/_restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:push\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests/" + deterministicDummyDigest(1) + "/_restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such deleted manifest\n"),
+	}.Check(t, h)
+
+	//test restore happy case
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests/" + digestStr + "/_restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, digestStr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 1 {
+		t.Errorf("expected restored manifest to exist, but found %d manifests", count)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"deleted_manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//entries past their retention period are not shown and cannot be restored anymore
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + digestStr,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	s.Clock.StepBy(25 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"deleted_manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_deleted_manifests/" + digestStr + "/_restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such deleted manifest\n"),
+	}.Check(t, h)
+}
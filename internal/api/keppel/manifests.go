@@ -21,8 +21,14 @@ package keppelv1
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/opencontainers/go-digest"
@@ -30,6 +36,8 @@ import (
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
 
+	"github.com/sapcc/keppel/internal/api"
+	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/clair"
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -48,11 +56,15 @@ type Manifest struct {
 	VulnerabilityScanErrorMessage string                    `json:"vulnerability_scan_error,omitempty"`
 	MinLayerCreatedAt             *int64                    `json:"min_layer_created_at"`
 	MaxLayerCreatedAt             *int64                    `json:"max_layer_created_at"`
+	SubjectDigest                 string                    `json:"subject_digest,omitempty"`
 }
 
 // Tag represents a tag in the API.
 type Tag struct {
-	Name         string `json:"name"`
+	Name string `json:"name"`
+	//Digest is only shown when tags are listed on their own (when tags are
+	//shown as part of a manifest, the digest is implied)
+	Digest       string `json:"digest,omitempty"`
 	PushedAt     int64  `json:"pushed_at"`
 	LastPulledAt *int64 `json:"last_pulled_at"`
 }
@@ -60,8 +72,8 @@ type Tag struct {
 var manifestGetQuery = sqlext.SimplifyWhitespace(`
 	SELECT *
 	  FROM manifests
-	 WHERE repo_id = $1 AND $CONDITION
-	 ORDER BY digest ASC
+	 WHERE repo_id = $1 AND $FILTER AND $CONDITION
+	 ORDER BY $ORDER
 	 LIMIT $LIMIT
 `)
 
@@ -71,6 +83,83 @@ var tagGetQuery = sqlext.SimplifyWhitespace(`
 	 WHERE repo_id = $1 AND digest >= $2 AND digest <= $3
 `)
 
+// Values for the ?sort= query parameter on handleGetManifests, and the SQL
+// expressions that they translate into. NULL values are mapped to a definite
+// value because the tuple comparison in the marker condition does not work
+// with NULLs.
+var manifestSortExpressions = map[string]string{
+	"pushed_at":      "pushed_at",
+	"last_pulled_at": "COALESCE(last_pulled_at, TO_TIMESTAMP(0))",
+	"size":           "size_bytes",
+}
+
+// buildManifestListQuery translates the sorting and filtering options of
+// handleGetManifests into a paginatedQuery.
+func buildManifestListQuery(account keppel.Account, repo keppel.Repository, options url.Values) (paginatedQuery, error) {
+	q := paginatedQuery{
+		MarkerField: "digest",
+		Options:     options,
+		BindValues:  []interface{}{repo.ID},
+	}
+
+	//filters
+	filters := []string{"TRUE"}
+	if mediaType := options.Get("media_type"); mediaType != "" {
+		if !account.AcceptsManifestMediaType(mediaType) {
+			return q, fmt.Errorf("invalid value for media_type: %q", mediaType)
+		}
+		q.BindValues = append(q.BindValues, mediaType)
+		filters = append(filters, fmt.Sprintf("media_type = $%d", len(q.BindValues)))
+	}
+	if vulnStatus := options.Get("vuln_status"); vulnStatus != "" {
+		if !clair.VulnerabilityStatus(vulnStatus).IsValid() {
+			return q, fmt.Errorf("invalid value for vuln_status: %q", vulnStatus)
+		}
+		q.BindValues = append(q.BindValues, vulnStatus)
+		filters = append(filters, fmt.Sprintf("vuln_status = $%d", len(q.BindValues)))
+	}
+	if subject := options.Get("subject"); subject != "" {
+		subjectDigest, err := digest.Parse(subject)
+		if err != nil {
+			return q, fmt.Errorf("invalid value for subject: %q", subject)
+		}
+		q.BindValues = append(q.BindValues, subjectDigest.String())
+		filters = append(filters, fmt.Sprintf("subject_digest = $%d", len(q.BindValues)))
+	}
+
+	//sort order
+	var direction, comparison string
+	switch order := options.Get("order"); order {
+	case "", "asc":
+		direction, comparison = "ASC", ">"
+	case "desc":
+		direction, comparison = "DESC", "<"
+	default:
+		return q, fmt.Errorf("invalid value for order: %q", order)
+	}
+	var orderBy string
+	if sortField := options.Get("sort"); sortField == "" {
+		orderBy = "digest " + direction
+		q.MarkerCondition = "digest " + comparison + " $MARKER"
+	} else {
+		expr, exists := manifestSortExpressions[sortField]
+		if !exists {
+			return q, fmt.Errorf("invalid value for sort: %q", sortField)
+		}
+		//the digest is used as a tie-breaker to make the order (and thus the
+		//pagination) stable; the marker is still the digest of the last manifest
+		//on the previous page
+		orderBy = fmt.Sprintf("%s %s, digest %s", expr, direction, direction)
+		q.MarkerCondition = fmt.Sprintf(
+			"(%[1]s, digest) %[2]s (SELECT %[1]s, digest FROM manifests WHERE repo_id = $1 AND digest = $MARKER)",
+			expr, comparison)
+	}
+
+	q.SQL = strings.Replace(manifestGetQuery, "$FILTER", strings.Join(filters, " AND "), 1)
+	q.SQL = strings.Replace(q.SQL, "$ORDER", orderBy, 1)
+	return q, nil
+}
+
 func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
@@ -86,12 +175,26 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query, bindValues, limit, err := paginatedQuery{
-		SQL:         manifestGetQuery,
-		MarkerField: "digest",
-		Options:     r.URL.Query(),
-		BindValues:  []interface{}{repo.ID},
-	}.Prepare()
+	pq, err := buildManifestListQuery(*account, *repo, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//with a custom sort order, the marker condition looks up the sort key of
+	//the marker manifest; if that manifest was deleted in the meantime, the
+	//condition would not match anything and silently end the pagination
+	if marker := r.URL.Query().Get("marker"); marker != "" && r.URL.Query().Get("sort") != "" {
+		count, err := a.db.SelectInt(`SELECT COUNT(*) FROM manifests WHERE repo_id = $1 AND digest = $2`, repo.ID, marker)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		if count == 0 {
+			http.Error(w, "invalid value for marker: manifest does not exist (anymore), please restart the pagination", http.StatusBadRequest)
+			return
+		}
+	}
+	query, bindValues, limit, err := pq.Prepare()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -124,17 +227,26 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 			VulnerabilityScanErrorMessage: dbManifest.VulnerabilityScanErrorMessage,
 			MinLayerCreatedAt:             keppel.MaybeTimeToUnix(dbManifest.MinLayerCreatedAt),
 			MaxLayerCreatedAt:             keppel.MaybeTimeToUnix(dbManifest.MaxLayerCreatedAt),
+			SubjectDigest:                 dbManifest.SubjectDigest,
 		})
 	}
 
 	if len(result.Manifests) == 0 {
 		result.Manifests = []*Manifest{}
 	} else {
-		//since results were retrieved in sorted order, we know that for each
-		//manifest in the result set, its digest is >= the first digest and <= the
-		//last digest
+		//restrict the tag query to the range of digests in the result set (the
+		//results are not necessarily sorted by digest, so we need to look for the
+		//bounds explicitly)
 		firstDigest := result.Manifests[0].Digest
-		lastDigest := result.Manifests[len(result.Manifests)-1].Digest
+		lastDigest := result.Manifests[0].Digest
+		for _, manifest := range result.Manifests {
+			if manifest.Digest < firstDigest {
+				firstDigest = manifest.Digest
+			}
+			if manifest.Digest > lastDigest {
+				lastDigest = manifest.Digest
+			}
+		}
 		var dbTags []keppel.Tag
 		_, err = a.db.Select(&dbTags, tagGetQuery, repo.ID, firstDigest, lastDigest)
 		if respondwith.ErrorText(w, err) {
@@ -161,6 +273,88 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 	respondwith.JSON(w, http.StatusOK, result)
 }
 
+// ManifestExistence appears in the response of the bulk existence check for
+// each reference that refers to an existing manifest.
+type ManifestExistence struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	SizeBytes uint64 `json:"size_bytes"`
+}
+
+// maxManifestExistenceBatchSize is the maximum number of references that may
+// be checked in a single request to handlePostManifestsExists.
+const maxManifestExistenceBatchSize = 500
+
+var manifestByTagGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT m.*
+	  FROM manifests m
+	  JOIN tags t ON t.repo_id = m.repo_id AND t.digest = m.digest
+	 WHERE t.repo_id = $1 AND t.name = $2
+`)
+
+func (a *API) handlePostManifestsExists(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/_exists")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	var references []string
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&references)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(references) > maxManifestExistenceBatchSize {
+		msg := fmt.Sprintf("too many references: got %d, but at most %d are allowed per request", len(references), maxManifestExistenceBatchSize)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	result := api.NewBatchResults[ManifestExistence](len(references))
+	for _, reference := range references {
+		if result.Contains(reference) {
+			continue
+		}
+		ref, err := parseBatchReference(reference)
+		if err != nil {
+			result.AddError(reference, err)
+			continue
+		}
+
+		var manifest *keppel.Manifest
+		if ref.IsDigest() {
+			manifest, err = keppel.FindManifest(a.db, *repo, ref.Digest.String())
+		} else {
+			manifest = &keppel.Manifest{}
+			err = a.db.SelectOne(manifest, manifestByTagGetQuery, repo.ID, ref.Tag)
+		}
+		if err == sql.ErrNoRows {
+			result.AddError(reference, keppel.ErrManifestUnknown.With(""))
+			continue
+		}
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+		result.AddSuccess(reference, ManifestExistence{
+			Digest:    manifest.Digest,
+			MediaType: manifest.MediaType,
+			SizeBytes: manifest.SizeBytes,
+		})
+	}
+
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
 func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
@@ -196,6 +390,121 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ManifestValidationResult is the response body of POST .../_manifests/:digest/_validate.
+type ManifestValidationResult struct {
+	Digest       string `json:"digest"`
+	ValidatedAt  int64  `json:"validated_at"`
+	ErrorMessage string `json:"validation_error,omitempty"`
+}
+
+func (a *API) handlePostManifestValidate(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/_validate")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest.String())
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//NOTE: A failed validation (e.g. because of missing blobs) is not an error
+	//of this request. It is reported in the response body, same as it would be
+	//recorded by the janitor.
+	now := a.timeNow()
+	validationErr, err := a.processor().RevalidateExistingManifest(*account, *repo, manifest, now)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	result := ManifestValidationResult{
+		Digest:      manifest.Digest,
+		ValidatedAt: now.Unix(),
+	}
+	if validationErr != nil {
+		result.ErrorMessage = validationErr.Error()
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+var tagListQuery = sqlext.SimplifyWhitespace(`
+	SELECT *
+	  FROM tags
+	 WHERE repo_id = $1 AND LEFT(name, LENGTH($2)) = $2 AND $CONDITION
+	 ORDER BY name ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetTags(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//NOTE: The prefix filter does not use LIKE because "_" is a wildcard in
+	//LIKE patterns, but also commonly appears in tag names.
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         tagListQuery,
+		MarkerField: "name",
+		Options:     r.URL.Query(),
+		BindValues:  []interface{}{repo.ID, r.URL.Query().Get("name_prefix")},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dbTags []keppel.Tag
+	_, err = a.db.Select(&dbTags, query, bindValues...)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	var result struct {
+		Tags        []Tag `json:"tags"`
+		IsTruncated bool  `json:"truncated,omitempty"`
+	}
+	result.Tags = []Tag{}
+	for _, dbTag := range dbTags {
+		if uint64(len(result.Tags)) >= limit {
+			result.IsTruncated = true
+			break
+		}
+		result.Tags = append(result.Tags, Tag{
+			Name:         dbTag.Name,
+			Digest:       dbTag.Digest,
+			PushedAt:     dbTag.PushedAt.Unix(),
+			LastPulledAt: keppel.MaybeTimeToUnix(dbTag.LastPulledAt),
+		})
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
 func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags/:name")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
@@ -227,6 +536,104 @@ func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// tag name format as defined by the OCI distribution spec
+var tagNameRx = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// parseBatchReference parses a manifest reference given to one of the batch
+// endpoints. Malformed references are reported as an error for this reference
+// only, instead of failing the whole request.
+func parseBatchReference(reference string) (keppel.ManifestReference, error) {
+	ref := keppel.ParseManifestReference(reference)
+	if ref.IsTag() && !tagNameRx.MatchString(ref.Tag) {
+		return ref, errors.New("invalid reference")
+	}
+	return ref, nil
+}
+
+func (a *API) handlePostRetag(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_retag")
+
+	//parse request body (we need to know the target repo before we can authorize the request)
+	var req struct {
+		Tag              string `json:"tag"`
+		TargetRepository string `json:"target_repository"`
+		TargetTag        string `json:"target_tag"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.TargetRepository == "" {
+		req.TargetRepository = mux.Vars(r)["repo_name"]
+	}
+	if req.TargetTag == "" {
+		req.TargetTag = req.Tag
+	}
+	if !tagNameRx.MatchString(req.Tag) {
+		http.Error(w, fmt.Sprintf("invalid tag name: %q", req.Tag), http.StatusBadRequest)
+		return
+	}
+	if !tagNameRx.MatchString(req.TargetTag) {
+		http.Error(w, fmt.Sprintf("invalid tag name: %q", req.TargetTag), http.StatusBadRequest)
+		return
+	}
+	if !isValidRepoName(req.TargetRepository) {
+		http.Error(w, fmt.Sprintf("invalid repository name: %q", req.TargetRepository), http.StatusBadRequest)
+		return
+	}
+	if req.TargetRepository == mux.Vars(r)["repo_name"] && req.TargetTag == req.Tag {
+		http.Error(w, "source and target are identical", http.StatusBadRequest)
+		return
+	}
+
+	//we need to pull from the source repo and push into the target repo
+	scopes := repoScopeFromRequest(r, keppel.CanPullFromAccount)
+	scopes.Add(auth.Scope{
+		ResourceType: "repository",
+		ResourceName: fmt.Sprintf("%s/%s", mux.Vars(r)["account"], req.TargetRepository),
+		Actions:      []string{string(keppel.CanPushToAccount)},
+	})
+	authz := a.authenticateRequest(w, r, scopes)
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	sourceRepo := a.findRepositoryFromRequest(w, r, *account)
+	if sourceRepo == nil {
+		return
+	}
+
+	//in replica accounts, contents must match those in the upstream
+	if account.UpstreamPeerHostName != "" || account.ExternalPeerURL != "" {
+		http.Error(w, "cannot retag manifests in a replica account", http.StatusConflict)
+		return
+	}
+
+	_, err = a.processor().RetagManifest(*account, *sourceRepo, req.Tag, req.TargetRepository, req.TargetTag, keppel.AuditContext{
+		UserIdentity: authz.UserIdentity,
+		Request:      r,
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such tag", http.StatusNotFound)
+		return
+	}
+	if rerr, ok := err.(*keppel.RegistryV2Error); ok && rerr != nil {
+		rerr.WriteAsTextTo(w)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/vulnerability_report")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
@@ -247,6 +654,15 @@ func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	wantRaw := false
+	if rawStr := r.URL.Query().Get("raw"); rawStr != "" {
+		wantRaw, err = strconv.ParseBool(rawStr)
+		if err != nil {
+			http.Error(w, "invalid value for raw: "+rawStr, http.StatusBadRequest)
+			return
+		}
+	}
+
 	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest.String())
 	if err == sql.ErrNoRows {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -276,5 +692,171 @@ func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Reques
 	if respondwith.ErrorText(w, err) {
 		return
 	}
-	respondwith.JSON(w, http.StatusOK, clairReport)
+	if wantRaw || clairReport == nil {
+		respondwith.JSON(w, http.StatusOK, clairReport)
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, annotatedVulnerabilityReport{
+		VulnerabilityReport: clairReport.WithFixabilityAnnotations(),
+		Summary:             clairReport.FixabilitySummary(),
+	})
+}
+
+// annotatedVulnerabilityReport is the response body of GET .../vulnerability_report
+// (unless the raw report was requested): Clair's report with additional
+// information about which vulnerabilities can be fixed.
+type annotatedVulnerabilityReport struct {
+	clair.VulnerabilityReport
+	Summary clair.FixabilitySummary `json:"summary"`
+}
+
+func (a *API) handleGetManifestLabels(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/labels")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest.String())
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	labels := make(map[string]string)
+	if manifest.LabelsJSON != "" {
+		err := json.Unmarshal([]byte(manifest.LabelsJSON), &labels)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"labels": labels})
+}
+
+// ManifestAncestryNode represents a manifest in the response of
+// GET .../_ancestry.
+type ManifestAncestryNode struct {
+	Digest              string                    `json:"digest"`
+	MediaType           string                    `json:"media_type"`
+	SizeBytes           uint64                    `json:"size_bytes"`
+	VulnerabilityStatus clair.VulnerabilityStatus `json:"vulnerability_status"`
+	Children            []ManifestAncestryNode    `json:"children,omitempty"`
+	Parents             []ManifestAncestryNode    `json:"parents,omitempty"`
+}
+
+func renderManifestAncestryNode(m keppel.Manifest) ManifestAncestryNode {
+	return ManifestAncestryNode{
+		Digest:              m.Digest,
+		MediaType:           m.MediaType,
+		SizeBytes:           m.SizeBytes,
+		VulnerabilityStatus: m.VulnerabilityStatus,
+	}
+}
+
+var (
+	manifestChildrenQuery = sqlext.SimplifyWhitespace(`
+		SELECT child_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND parent_digest = $2 ORDER BY child_digest
+	`)
+	manifestParentsQuery = sqlext.SimplifyWhitespace(`
+		SELECT parent_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND child_digest = $2 ORDER BY parent_digest
+	`)
+)
+
+func (a *API) handleGetManifestAncestry(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/_ancestry")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest.String())
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	root := renderManifestAncestryNode(*manifest)
+	root.Children, err = a.collectManifestAncestry(*repo, manifest.Digest, false, make(map[string]bool))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	root.Parents, err = a.collectManifestAncestry(*repo, manifest.Digest, true, make(map[string]bool))
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"manifest": root})
+}
+
+// collectManifestAncestry recursively renders either the children or the
+// parents of the given manifest. The digests on the current path are tracked
+// in `onPath` so that we do not recurse forever if there ever is a cycle in
+// the manifest_manifest_refs table.
+func (a *API) collectManifestAncestry(repo keppel.Repository, digestStr string, upwards bool, onPath map[string]bool) ([]ManifestAncestryNode, error) {
+	query := manifestChildrenQuery
+	if upwards {
+		query = manifestParentsQuery
+	}
+	var digests []string
+	_, err := a.db.Select(&digests, query, repo.ID, digestStr)
+	if err != nil {
+		return nil, err
+	}
+
+	onPath[digestStr] = true
+	defer delete(onPath, digestStr)
+
+	var result []ManifestAncestryNode
+	for _, relatedDigest := range digests {
+		if onPath[relatedDigest] {
+			continue
+		}
+		relatedManifest, err := keppel.FindManifest(a.db, repo, relatedDigest)
+		if err != nil {
+			return nil, err
+		}
+		node := renderManifestAncestryNode(*relatedManifest)
+		related, err := a.collectManifestAncestry(repo, relatedDigest, upwards, onPath)
+		if err != nil {
+			return nil, err
+		}
+		if upwards {
+			node.Parents = related
+		} else {
+			node.Children = related
+		}
+		result = append(result, node)
+	}
+	return result, nil
 }
@@ -19,12 +19,16 @@
 package keppelv1_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/assert"
@@ -233,6 +237,112 @@ func TestManifestsAPI(t *testing.T) {
 			}.Check(t, h)
 		}
 
+		//test GET with custom sort order and filters
+		renderedManifestsByIndex := make(map[int]assert.JSONObject, 10)
+		for idx := 1; idx <= 10; idx++ {
+			for _, rm := range renderedManifests {
+				if rm["digest"] == deterministicDummyDigest(10+idx) {
+					renderedManifestsByIndex[idx] = rm
+				}
+			}
+		}
+		selectManifests := func(indexes ...int) []assert.JSONObject {
+			result := make([]assert.JSONObject, len(indexes))
+			for idx, manifestIdx := range indexes {
+				result[idx] = renderedManifestsByIndex[manifestIdx]
+			}
+			return result
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?sort=size&order=desc",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"manifests": selectManifests(10, 9, 8, 7, 6, 5, 4, 3, 2, 1)},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?sort=pushed_at&limit=4",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"manifests": selectManifests(1, 2, 3, 4),
+				"truncated": true,
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?sort=pushed_at&limit=4&marker=" + deterministicDummyDigest(14),
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"manifests": selectManifests(5, 6, 7, 8),
+				"truncated": true,
+			},
+		}.Check(t, h)
+		//only the first manifest has ever been pulled
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?sort=last_pulled_at&order=desc&limit=1",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"manifests": selectManifests(1),
+				"truncated": true,
+			},
+		}.Check(t, h)
+
+		//filtered listing with pagination (manifests 1, 2, 4, 7, 8 are clean)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?vuln_status=Clean&sort=size&limit=3",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"manifests": selectManifests(1, 2, 4),
+				"truncated": true,
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?vuln_status=Clean&sort=size&limit=3&marker=" + deterministicDummyDigest(14),
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"manifests": selectManifests(7, 8)},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?media_type=" + url.QueryEscape(manifestlist.MediaTypeManifestList),
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?media_type=" + url.QueryEscape(schema2.MediaTypeManifest) + "&limit=10",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"manifests": renderedManifests},
+		}.Check(t, h)
+
+		//test GET with invalid sort order or filters
+		invalidOptions := map[string]string{
+			"sort=digest":            `invalid value for sort: "digest"`,
+			"sort=size&order=random": `invalid value for order: "random"`,
+			"vuln_status=Dangerous":  `invalid value for vuln_status: "Dangerous"`,
+			"media_type=text/plain":  `invalid value for media_type: "text/plain"`,
+			"subject=latest":         `invalid value for subject: "latest"`,
+		}
+		for query, expectedError := range invalidOptions {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?" + query,
+				Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+				ExpectStatus: http.StatusBadRequest,
+				ExpectBody:   assert.StringData(expectedError + "\n"),
+			}.Check(t, h)
+		}
+
 		//test GET failure cases
 		assert.HTTPRequest{
 			Method:       "GET",
@@ -255,6 +365,119 @@ func TestManifestsAPI(t *testing.T) {
 			ExpectBody:   assert.StringData("strconv.ParseUint: parsing \"foo\": invalid syntax\n"),
 		}.Check(t, h)
 
+		//test that failed vulnerability scans are reported in the listing (the
+		//merged status of image list manifests is computed by the janitor and
+		//stored in the DB, so it also shows up here without further work)
+		errorDigest := renderedManifests[0]["digest"].(string)
+		mustExec(t, s.DB,
+			`UPDATE manifests SET vuln_status = $1, vuln_scan_error = $2 WHERE repo_id = 1 AND digest = $3`,
+			clair.ErrorVulnerabilityStatus, "scanner crashed", errorDigest,
+		)
+		errorManifest := assert.JSONObject{}
+		for k, v := range renderedManifests[0] {
+			errorManifest[k] = v
+		}
+		errorManifest["vulnerability_status"] = string(clair.ErrorVulnerabilityStatus)
+		errorManifest["vulnerability_scan_error"] = "scanner crashed"
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests?limit=1",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"manifests": []assert.JSONObject{errorManifest},
+				"truncated": true,
+			},
+		}.Check(t, h)
+		mustExec(t, s.DB,
+			`UPDATE manifests SET vuln_status = $1, vuln_scan_error = '' WHERE repo_id = 1 AND digest = $2`,
+			renderedManifests[0]["vulnerability_status"], errorDigest,
+		)
+
+		//test bulk existence check with a mix of hits, misses and malformed
+		//references (duplicate references are only reported once)
+		manifestUnknown := "manifest unknown"
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/_exists",
+			Header: map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			Body: assert.StringData(fmt.Sprintf(`["first","second","doesnotexist",%q,%q,"sha256:bogus","first"]`,
+				deterministicDummyDigest(13),
+				deterministicDummyDigest(21), //exists in repo1-2, but not in repo1-1
+			)),
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"results": []assert.JSONObject{
+					{
+						"reference": "first",
+						"ok":        true,
+						"data": assert.JSONObject{
+							"digest":     deterministicDummyDigest(11),
+							"media_type": schema2.MediaTypeManifest,
+							"size_bytes": 1000,
+						},
+					},
+					{
+						"reference": "second",
+						"ok":        true,
+						"data": assert.JSONObject{
+							"digest":     deterministicDummyDigest(12),
+							"media_type": schema2.MediaTypeManifest,
+							"size_bytes": 2000,
+						},
+					},
+					{"reference": "doesnotexist", "ok": false, "error": manifestUnknown},
+					{
+						"reference": deterministicDummyDigest(13),
+						"ok":        true,
+						"data": assert.JSONObject{
+							"digest":     deterministicDummyDigest(13),
+							"media_type": schema2.MediaTypeManifest,
+							"size_bytes": 3000,
+						},
+					},
+					{"reference": deterministicDummyDigest(21), "ok": false, "error": manifestUnknown},
+					{"reference": "sha256:bogus", "ok": false, "error": "invalid reference"},
+				},
+			},
+		}.Check(t, h)
+
+		//test bulk existence check failure cases
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/_exists",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			Body:         assert.StringData(`["first"]`),
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   assert.StringData("no permission for repository:test1/repo1-1:pull\n"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_manifests/_exists",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			Body:         assert.StringData(`["first"]`),
+			ExpectStatus: http.StatusNotFound,
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/_exists",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			Body:         assert.StringData(`{"first":true}`),
+			ExpectStatus: http.StatusBadRequest,
+		}.Check(t, h)
+		tooManyReferences := make([]string, 501)
+		for idx := range tooManyReferences {
+			tooManyReferences[idx] = fmt.Sprintf("%q", fmt.Sprintf("tag%d", idx))
+		}
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/_exists",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			Body:         assert.StringData("[" + strings.Join(tooManyReferences, ",") + "]"),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.StringData("too many references: got 501, but at most 500 are allowed per request\n"),
+		}.Check(t, h)
+
 		//test DELETE manifest happy case
 		easypg.AssertDBContent(t, s.DB.DbMap.Db, "fixtures/before-delete-manifest.sql")
 		assert.HTTPRequest{
@@ -275,6 +498,12 @@ func TestManifestsAPI(t *testing.T) {
 				Name:      "test1/repo1-1@" + deterministicDummyDigest(11),
 				ID:        deterministicDummyDigest(11),
 				ProjectID: "tenant1",
+				//the tags pointing to the manifest were deleted along with it
+				Attachments: []cadf.Attachment{{
+					Name:    "deleted-tags",
+					TypeURI: "mime:application/json",
+					Content: `["first","stillfirst"]`,
+				}},
 			},
 		})
 
@@ -413,11 +642,746 @@ func TestManifestsAPI(t *testing.T) {
 			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/" + deterministicDummyDigest(12) + "/vulnerability_report",
 			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
 			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONFixtureFile("fixtures/clair-report-vulnerable-annotated.json"),
+		}.Check(t, h)
+
+		//the report as generated by Clair is available on request
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/" + deterministicDummyDigest(12) + "/vulnerability_report?raw=true",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
 			ExpectBody:   assert.JSONFixtureFile("fixtures/clair-report-vulnerable.json"),
 		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_manifests/" + deterministicDummyDigest(12) + "/vulnerability_report?raw=maybe",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.StringData("invalid value for raw: maybe\n"),
+		}.Check(t, h)
 	})
 }
 
+func TestManifestsAPIPaginationWithDeletedMarker(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{Name: "repo1", AccountName: "test1"}),
+	)
+	h := s.Handler
+
+	for idx := 1; idx <= 3; idx++ {
+		pushedAt := time.Unix(int64(1000*idx), 0)
+		mustInsert(t, s.DB, &keppel.Manifest{
+			RepositoryID:        1,
+			Digest:              deterministicDummyDigest(idx),
+			MediaType:           schema2.MediaTypeManifest,
+			SizeBytes:           uint64(1000 * idx),
+			PushedAt:            pushedAt,
+			ValidatedAt:         pushedAt,
+			VulnerabilityStatus: clair.PendingVulnerabilityStatus,
+		})
+	}
+
+	//the first page ends on the oldest manifest...
+	_, respBody := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests?sort=pushed_at&limit=1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	var firstPage struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+		IsTruncated bool `json:"truncated"`
+	}
+	err := json.Unmarshal(respBody, &firstPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(firstPage.Manifests) != 1 || firstPage.Manifests[0].Digest != deterministicDummyDigest(1) || !firstPage.IsTruncated {
+		t.Fatalf("unexpected first page: %#v", firstPage)
+	}
+
+	//...which is then deleted before the next page is requested
+	_, err = s.DB.Exec(`DELETE FROM manifests WHERE digest = $1`, deterministicDummyDigest(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//this must not look like the end of the listing
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests?sort=pushed_at&limit=1&marker=" + deterministicDummyDigest(1),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid value for marker: manifest does not exist (anymore), please restart the pagination\n"),
+	}.Check(t, h)
+
+	//when sorting by digest, the marker does not need to exist
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests?limit=1&marker=" + deterministicDummyDigest(1),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+}
+
+func TestTagsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{Name: "repo1", AccountName: "test1"}),
+	)
+	h := s.Handler
+
+	//test empty GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tags": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//setup a manifest with more tags than fit on one page
+	mustInsert(t, s.DB, &keppel.Manifest{
+		RepositoryID: 1,
+		Digest:       deterministicDummyDigest(1),
+		MediaType:    schema2.MediaTypeManifest,
+		SizeBytes:    1000,
+		PushedAt:     time.Unix(1000, 0),
+		ValidatedAt:  time.Unix(1000, 0),
+	})
+	var tagNames []string
+	for idx := 0; idx <= 1000; idx++ {
+		tagNames = append(tagNames, fmt.Sprintf("v1.%04d", idx))
+	}
+	tagNames = append(tagNames, "latest", "v2.0", "v2.1")
+	sort.Strings(tagNames)
+
+	renderedTags := make(map[string]assert.JSONObject, len(tagNames))
+	for idx, tagName := range tagNames {
+		tag := keppel.Tag{
+			RepositoryID: 1,
+			Name:         tagName,
+			Digest:       deterministicDummyDigest(1),
+			PushedAt:     time.Unix(int64(2000+idx), 0),
+		}
+		rendered := assert.JSONObject{
+			"name":           tagName,
+			"digest":         deterministicDummyDigest(1),
+			"pushed_at":      2000 + idx,
+			"last_pulled_at": nil,
+		}
+		if tagName == "latest" {
+			tag.LastPulledAt = p2time(time.Unix(5000, 0))
+			rendered["last_pulled_at"] = 5000
+		}
+		mustInsert(t, s.DB, &tag)
+		renderedTags[tagName] = rendered
+	}
+	renderTags := func(names ...string) []assert.JSONObject {
+		result := make([]assert.JSONObject, len(names))
+		for idx, name := range names {
+			result[idx] = renderedTags[name]
+		}
+		return result
+	}
+
+	//without any options, the first 1000 tags are shown
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"tags":      renderTags(tagNames[0:1000]...),
+			"truncated": true,
+		},
+	}.Check(t, h)
+	//the rest can be obtained by paginating with the last tag name as a marker
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags?marker=" + tagNames[999],
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"tags": renderTags(tagNames[1000:]...),
+		},
+	}.Check(t, h)
+
+	//test prefix filter (the "_" in the prefix must not be treated as a wildcard)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags?name_prefix=v2.",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tags": renderTags("v2.0", "v2.1")},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags?name_prefix=v2_",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tags": []assert.JSONObject{}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags?name_prefix=v1.09&limit=2&marker=v1.0950",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"tags":      renderTags("v1.0951", "v1.0952"),
+			"truncated": true,
+		},
+	}.Check(t, h)
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/repo1:pull\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_tags?limit=foo",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, h)
+}
+
+func TestManifestLabelsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", RequiredLabels: "maintainer"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	fooRepo := keppel.Repository{AccountName: "test1", Name: "foo"}
+
+	//push an OCI image that has labels in its config as well as annotations
+	//(the required label "maintainer" only appears as an annotation)
+	image1 := test.GenerateImageWithCustomConfig(func(cfg map[string]interface{}) {
+		cfg["config"].(map[string]interface{})["Labels"] = map[string]string{"foo": "from-config", "bar": "from-config"}
+	}, test.GenerateExampleLayer(1)).WithOCIAnnotations(map[string]string{
+		"maintainer": "team-a",
+		"foo":        "from-annotation",
+	})
+	image1.MustUpload(t, s, fooRepo, "")
+
+	//config labels take precedence over annotations
+	image1Labels := assert.JSONObject{"foo": "from-config", "bar": "from-config", "maintainer": "team-a"}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image1.Manifest.Digest.String() + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"labels": image1Labels},
+	}.Check(t, h)
+
+	//push a second image with only annotations and an image list with both
+	//images; the list reports the labels that both images agree on
+	image2 := test.GenerateImage(test.GenerateExampleLayer(2)).WithOCIAnnotations(map[string]string{
+		"maintainer": "team-a",
+		"foo":        "something-else",
+	})
+	image2.MustUpload(t, s, fooRepo, "")
+	list := test.GenerateImageList(image1, image2)
+	list.MustUpload(t, s, fooRepo, "")
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image2.Manifest.Digest.String() + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"labels": assert.JSONObject{"foo": "something-else", "maintainer": "team-a"}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + list.Manifest.Digest.String() + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"labels": assert.JSONObject{"maintainer": "team-a"}},
+	}.Check(t, h)
+
+	//manifests without labels report an empty map
+	_, err := s.DB.Exec(`UPDATE accounts SET required_labels = ''`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	image3 := test.GenerateImage(test.GenerateExampleLayer(3))
+	image3.MustUpload(t, s, fooRepo, "")
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image3.Manifest.Digest.String() + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"labels": assert.JSONObject{}},
+	}.Check(t, h)
+
+	//error cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + deterministicDummyDigest(1) + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image1.Manifest.Digest.String() + "/labels",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+}
+
+func TestManifestSubjectAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	fooRepo := keppel.Repository{AccountName: "test1", Name: "foo"}
+
+	//push an image without subject, and an attestation referring to it
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepo, "")
+	attestation := test.GenerateImage(test.GenerateExampleLayer(2)).
+		WithOCISubject(image.Manifest, "application/vnd.in-toto+json")
+	attestation.MustUpload(t, s, fooRepo, "")
+
+	//the subject is only reported for the attestation
+	getManifests := func(query string) []assert.JSONObject {
+		t.Helper()
+		_, respBody := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var data struct {
+			Manifests []assert.JSONObject `json:"manifests"`
+		}
+		err := json.Unmarshal(respBody, &data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return data.Manifests
+	}
+	for _, manifest := range getManifests("") {
+		subjectDigest, exists := manifest["subject_digest"]
+		switch manifest["digest"] {
+		case image.Manifest.Digest.String():
+			if exists {
+				t.Errorf("expected no subject_digest on image, but got %v", subjectDigest)
+			}
+		case attestation.Manifest.Digest.String():
+			if subjectDigest != image.Manifest.Digest.String() {
+				t.Errorf("expected subject_digest = %q on attestation, but got %v", image.Manifest.Digest.String(), subjectDigest)
+			}
+		default:
+			t.Errorf("unexpected manifest: %v", manifest["digest"])
+		}
+	}
+
+	//filtering by subject only yields the attestation
+	manifests := getManifests("?subject=" + image.Manifest.Digest.String())
+	if len(manifests) != 1 || manifests[0]["digest"] != attestation.Manifest.Digest.String() {
+		t.Errorf("expected only the attestation to be listed, but got %v", manifests)
+	}
+	manifests = getManifests("?subject=" + attestation.Manifest.Digest.String())
+	if len(manifests) != 0 {
+		t.Errorf("expected no manifests to be listed, but got %v", manifests)
+	}
+}
+
+func TestManifestAncestryAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+	)
+	h := s.Handler
+
+	//setup a three-level structure: one index referencing two indexes that each
+	//reference two images (with one image being shared between both)
+	digests := make([]string, 6)
+	for idx := range digests {
+		digests[idx] = deterministicDummyDigest(idx + 1)
+		mediaType := schema2.MediaTypeManifest
+		if idx < 3 {
+			mediaType = manifestlist.MediaTypeManifestList
+		}
+		mustInsert(t, s.DB, &keppel.Manifest{
+			RepositoryID:        1,
+			Digest:              digests[idx],
+			MediaType:           mediaType,
+			SizeBytes:           uint64(1000 * (idx + 1)),
+			PushedAt:            time.Unix(int64(1000*(idx+1)), 0),
+			ValidatedAt:         time.Unix(int64(1000*(idx+1)), 0),
+			VulnerabilityStatus: deterministicDummyVulnStatus(idx + 1),
+		})
+	}
+	refs := [][2]int{{0, 1}, {0, 2}, {1, 3}, {1, 4}, {2, 4}, {2, 5}}
+	for _, ref := range refs {
+		mustExec(t, s.DB,
+			`INSERT INTO manifest_manifest_refs (repo_id, parent_digest, child_digest) VALUES (1, $1, $2)`,
+			digests[ref[0]], digests[ref[1]],
+		)
+	}
+
+	node := func(idx int, children, parents []assert.JSONObject) assert.JSONObject {
+		mediaType := schema2.MediaTypeManifest
+		if idx < 3 {
+			mediaType = manifestlist.MediaTypeManifestList
+		}
+		result := assert.JSONObject{
+			"digest":               digests[idx],
+			"media_type":           mediaType,
+			"size_bytes":           1000 * (idx + 1),
+			"vulnerability_status": deterministicDummyVulnStatus(idx + 1),
+		}
+		//related manifests are sorted by digest
+		for _, related := range [][]assert.JSONObject{children, parents} {
+			sort.Slice(related, func(i, j int) bool {
+				return related[i]["digest"].(string) < related[j]["digest"].(string)
+			})
+		}
+		if len(children) > 0 {
+			result["children"] = children
+		}
+		if len(parents) > 0 {
+			result["parents"] = parents
+		}
+		return result
+	}
+	leaf := func(idx int) assert.JSONObject { return node(idx, nil, nil) }
+	expectAncestry := func(idx int, expected assert.JSONObject) {
+		t.Helper()
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + digests[idx] + "/_ancestry",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"manifest": expected},
+		}.Check(t, h)
+	}
+
+	//the top-level index only has children
+	expectAncestry(0, node(0, []assert.JSONObject{
+		node(1, []assert.JSONObject{leaf(3), leaf(4)}, nil),
+		node(2, []assert.JSONObject{leaf(4), leaf(5)}, nil),
+	}, nil))
+	//the intermediate index has both children and parents
+	expectAncestry(1, node(1,
+		[]assert.JSONObject{leaf(3), leaf(4)},
+		[]assert.JSONObject{leaf(0)},
+	))
+	//the shared image has two parents with a common grandparent
+	expectAncestry(4, node(4, nil, []assert.JSONObject{
+		node(1, nil, []assert.JSONObject{leaf(0)}),
+		node(2, nil, []assert.JSONObject{leaf(0)}),
+	}))
+	//an image without relations is reported on its own
+	mustInsert(t, s.DB, &keppel.Manifest{
+		RepositoryID:        1,
+		Digest:              deterministicDummyDigest(7),
+		MediaType:           schema2.MediaTypeManifest,
+		SizeBytes:           7000,
+		PushedAt:            time.Unix(7000, 0),
+		ValidatedAt:         time.Unix(7000, 0),
+		VulnerabilityStatus: deterministicDummyVulnStatus(7),
+	})
+	digests = append(digests, deterministicDummyDigest(7))
+	expectAncestry(6, leaf(6))
+
+	//cycles should not exist, but must not cause infinite recursion
+	mustExec(t, s.DB,
+		`INSERT INTO manifest_manifest_refs (repo_id, parent_digest, child_digest) VALUES (1, $1, $2)`,
+		digests[3], digests[0],
+	)
+	expectAncestry(0, node(0,
+		[]assert.JSONObject{
+			node(1, []assert.JSONObject{leaf(3), leaf(4)}, nil),
+			node(2, []assert.JSONObject{leaf(4), leaf(5)}, nil),
+		},
+		[]assert.JSONObject{
+			node(3, nil, []assert.JSONObject{leaf(1)}),
+		},
+	))
+	//(the cycle needs to be removed again because it would confuse the DB cleanup in the next test)
+	mustExec(t, s.DB,
+		`DELETE FROM manifest_manifest_refs WHERE parent_digest = $1 AND child_digest = $2`,
+		digests[3], digests[0],
+	)
+
+	//error cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + deterministicDummyDigest(8) + "/_ancestry",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + digests[0] + "/_ancestry",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+}
+
+func TestRetagAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", ImmutableTagPattern: "release-.*"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	s.Clock.StepBy(1 * time.Hour)
+
+	fooRepo := keppel.Repository{AccountName: "test1", Name: "foo"}
+	image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+	image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+	imageList := test.GenerateImageList(image1, image2)
+	imageList.MustUpload(t, s, fooRepo, "latest")
+	image1.MustUpload(t, s, fooRepo, "single")
+
+	countRows := func(query string, args ...interface{}) int64 {
+		t.Helper()
+		count, err := s.DB.SelectInt(query, args...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return count
+	}
+	expectTag := func(repoName, tagName, expectedDigest string) {
+		t.Helper()
+		actualDigest, err := s.DB.SelectStr(
+			`SELECT t.digest FROM tags t JOIN repos r ON r.id = t.repo_id WHERE r.name = $1 AND t.name = $2`,
+			repoName, tagName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if actualDigest != expectedDigest {
+			t.Errorf("expected tag %s:%s to point to %q, but it points to %q", repoName, tagName, expectedDigest, actualDigest)
+		}
+	}
+
+	//error cases: malformed requests
+	for _, body := range []assert.JSONObject{
+		{"tag": ""},
+		{"tag": "latest", "target_tag": "-foo"},
+		{"tag": "latest", "target_repository": "Foo"},
+		{"tag": "latest"},
+		{"tag": "latest", "something_else": 42},
+	} {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+			Body:         body,
+			ExpectStatus: http.StatusBadRequest,
+		}.Check(t, h)
+	}
+
+	//error cases: insufficient permissions, missing source tag
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"tag": "latest", "target_repository": "bar"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/bar:push\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"tag": "doesnotexist", "target_repository": "bar"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such tag\n"),
+	}.Check(t, h)
+	//(the target repo shall not be created when the request fails)
+	assert.DeepEqual(t, "number of repos", countRows(`SELECT COUNT(*) FROM repos`), int64(1))
+
+	//happy case: retag within the same repo
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"tag": "single", "target_tag": "stable"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	expectTag("foo", "stable", image1.Manifest.Digest.String())
+	assert.DeepEqual(t, "number of manifests", countRows(`SELECT COUNT(*) FROM manifests`), int64(3))
+
+	//happy case: retag into a different repo (this copies the manifest and its
+	//child manifests, and mounts all referenced blobs into the new repo)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"tag": "latest", "target_repository": "bar", "target_tag": "release-1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	expectTag("bar", "release-1", imageList.Manifest.Digest.String())
+	barRepo, err := keppel.FindRepository(s.DB, "bar", keppel.Account{Name: "test1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of manifests in target repo",
+		countRows(`SELECT COUNT(*) FROM manifests WHERE repo_id = $1`, barRepo.ID), int64(3))
+	assert.DeepEqual(t, "number of blob mounts in target repo",
+		countRows(`SELECT COUNT(*) FROM blob_mounts WHERE repo_id = $1`, barRepo.ID), int64(4))
+	//no blob contents were moved
+	assert.DeepEqual(t, "number of blobs", countRows(`SELECT COUNT(*) FROM blobs`), int64(4))
+	for _, digestStr := range []string{imageList.Manifest.Digest.String(), image1.Manifest.Digest.String(), image2.Manifest.Digest.String()} {
+		s.ExpectManifestsExistInStorage(t, "bar", keppel.Manifest{RepositoryID: barRepo.ID, Digest: digestStr})
+	}
+
+	//retagging onto the same immutable tag again is a no-op...
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"tag": "latest", "target_repository": "bar", "target_tag": "release-1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	//...but moving an immutable tag to a different manifest is rejected
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_retag",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"tag": "single", "target_repository": "bar", "target_tag": "release-1"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody: assert.StringData(fmt.Sprintf(
+			"tag %q is immutable and already points to manifest %s\n", "release-1", imageList.Manifest.Digest.String(),
+		)),
+	}.Check(t, h)
+	expectTag("bar", "release-1", imageList.Manifest.Digest.String())
+}
+
 func p2time(x time.Time) *time.Time {
 	return &x
 }
+
+func TestValidateManifestAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	s.Clock.StepBy(1 * time.Hour)
+
+	fooRepoRef := keppel.Repository{AccountName: "test1", Name: "foo"}
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+	digestStr := image.Manifest.Digest.String()
+	validatePath := "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + digestStr + "/_validate"
+
+	expectValidationErrorMessage := func(expected string) {
+		t.Helper()
+		actual, err := s.DB.SelectStr(`SELECT validation_error_message FROM manifests WHERE digest = $1`, digestStr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if actual != expected {
+			t.Errorf("expected validation_error_message = %q, but got %q", expected, actual)
+		}
+	}
+
+	//a freshly pushed manifest validates cleanly
+	s.Clock.StepBy(1 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         validatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"digest":       digestStr,
+			"validated_at": s.Clock.Now().Unix(),
+		},
+	}.Check(t, h)
+	expectValidationErrorMessage("")
+
+	//when the layer blob goes missing, validation fails (but the request does not)
+	layerBlob, err := keppel.FindBlobByAccountName(s.DB, image.Layers[0].Digest, *s.Accounts[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mustExec(t, s.DB, `DELETE FROM manifest_blob_refs WHERE blob_id = $1`, layerBlob.ID)
+	mustExec(t, s.DB, `DELETE FROM blob_mounts WHERE blob_id = $1`, layerBlob.ID)
+	mustExec(t, s.DB, `DELETE FROM blobs WHERE id = $1`, layerBlob.ID)
+	expectedError := keppel.ErrManifestBlobUnknown.With("").WithDetail(image.Layers[0].Digest.String()).Error()
+
+	s.Clock.StepBy(1 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         validatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"digest":           digestStr,
+			"validated_at":     s.Clock.Now().Unix(),
+			"validation_error": expectedError,
+		},
+	}.Check(t, h)
+	expectValidationErrorMessage(expectedError)
+
+	//after the blob has been uploaded again, validation succeeds again
+	image.Layers[0].MustUpload(t, s, fooRepoRef)
+	s.Clock.StepBy(1 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         validatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"digest":       digestStr,
+			"validated_at": s.Clock.Now().Unix(),
+		},
+	}.Check(t, h)
+	expectValidationErrorMessage("")
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         validatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:push\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + deterministicDummyDigest(1) + "/_validate",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such manifest\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/sha256:foo/_validate",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+}
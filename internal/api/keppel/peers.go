@@ -19,7 +19,11 @@
 package keppelv1
 
 import (
+	"database/sql"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
 
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
@@ -32,22 +36,30 @@ import (
 
 // Peer represents a peer in the API.
 type Peer struct {
-	HostName string `json:"hostname"`
+	HostName     string `json:"hostname"`
+	LastPeeredAt *int64 `json:"last_peered_at"`
+	Status       string `json:"status"`
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // data conversion/validation functions
 
-func renderPeer(p keppel.Peer) Peer {
+func renderPeer(p keppel.Peer, now time.Time) Peer {
+	status := "ok"
+	if p.IsStale(now) {
+		status = "stale"
+	}
 	return Peer{
-		HostName: p.HostName,
+		HostName:     p.HostName,
+		LastPeeredAt: keppel.MaybeTimeToUnix(p.LastPeeredAt),
+		Status:       status,
 	}
 }
 
-func renderPeers(peers []keppel.Peer) []Peer {
+func renderPeers(peers []keppel.Peer, now time.Time) []Peer {
 	result := make([]Peer, len(peers))
 	for idx, peer := range peers {
-		result[idx] = renderPeer(peer)
+		result[idx] = renderPeer(peer, now)
 	}
 	return result
 }
@@ -68,5 +80,28 @@ func (a *API) handleGetPeers(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
-	respondwith.JSON(w, http.StatusOK, map[string][]Peer{"peers": renderPeers(peers)})
+	respondwith.JSON(w, http.StatusOK, map[string][]Peer{"peers": renderPeers(peers, a.timeNow())})
+}
+
+func (a *API) handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/peers/:hostname")
+	uid, authErr := a.authDriver.AuthenticateUserFromRequest(r)
+	if respondWithAuthError(w, authErr) {
+		return
+	}
+	if uid == nil {
+		respondWithAuthError(w, keppel.ErrUnauthorized.With("unauthorized"))
+		return
+	}
+
+	var peer keppel.Peer
+	err := a.db.SelectOne(&peer, `SELECT * FROM peers WHERE hostname = $1`, mux.Vars(r)["hostname"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]Peer{"peer": renderPeer(peer, a.timeNow())})
 }
@@ -21,6 +21,7 @@ package keppelv1_test
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/assert"
 
@@ -41,16 +42,22 @@ func TestPeersAPI(t *testing.T) {
 		ExpectBody:   assert.JSONObject{"peers": []interface{}{}},
 	}.Check(t, h)
 
-	//add some peers
-	expectedPeers := []assert.JSONObject{
-		{"hostname": "keppel.example.com"},
-		{"hostname": "keppel.example.org"},
+	//add some peers: one that was peered recently, one that was peered a long
+	//time ago, and one that was never peered
+	s.Clock.StepBy(2 * time.Hour)
+	now := s.Clock.Now()
+	peers := []keppel.Peer{
+		{HostName: "keppel.example.com", LastPeeredAt: p2time(now.Add(-5 * time.Minute))},
+		{HostName: "keppel.example.net"},
+		{HostName: "keppel.example.org", LastPeeredAt: p2time(now.Add(-90 * time.Minute))},
+	}
+	for _, peer := range peers {
+		mustInsert(t, s.DB, &peer)
 	}
-	for _, peer := range expectedPeers {
-		err := s.DB.Insert(&keppel.Peer{HostName: peer["hostname"].(string)})
-		if err != nil {
-			t.Fatal(err)
-		}
+	expectedPeers := []assert.JSONObject{
+		{"hostname": "keppel.example.com", "last_peered_at": now.Add(-5 * time.Minute).Unix(), "status": "ok"},
+		{"hostname": "keppel.example.net", "last_peered_at": nil, "status": "stale"},
+		{"hostname": "keppel.example.org", "last_peered_at": now.Add(-90 * time.Minute).Unix(), "status": "stale"},
 	}
 
 	//check non-empty response
@@ -61,4 +68,44 @@ func TestPeersAPI(t *testing.T) {
 		ExpectStatus: http.StatusOK,
 		ExpectBody:   assert.JSONObject{"peers": expectedPeers},
 	}.Check(t, h)
+
+	//check single-peer GET
+	for _, expectedPeer := range expectedPeers {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/peers/" + expectedPeer["hostname"].(string),
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"peer": expectedPeer},
+		}.Check(t, h)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/peers/keppel.example.invalid",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+
+	//the fresh peer becomes stale once the peering window has passed
+	s.Clock.StepBy(1 * time.Hour)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/peers/keppel.example.com",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"peer": assert.JSONObject{
+			"hostname":       "keppel.example.com",
+			"last_peered_at": now.Add(-5 * time.Minute).Unix(),
+			"status":         "stale",
+		}},
+	}.Check(t, h)
+
+	//check unauthenticated access
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/peers/keppel.example.com",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   assert.StringData("unauthorized\n"),
+	}.Check(t, h)
 }
@@ -0,0 +1,106 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func (a *API) handleGetAccountPermissions(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_permissions")
+	//we do not require any particular scope here: the point of this endpoint is
+	//to tell the caller which permissions they have, so all we need is their
+	//identity (which may also be the anonymous identity)
+	authz := a.authenticateRequest(w, r, auth.NewScopeSet())
+	if authz == nil {
+		return
+	}
+	account, err := keppel.FindAccount(a.db, mux.Vars(r)["account"])
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if account == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	uid := authz.UserIdentity
+	isGranted := map[keppel.Permission]bool{
+		keppel.CanViewAccount:       uid.HasPermission(keppel.CanViewAccount, account.AuthTenantID),
+		keppel.CanPullFromAccount:   uid.HasPermission(keppel.CanPullFromAccount, account.AuthTenantID),
+		keppel.CanPushToAccount:     uid.HasPermission(keppel.CanPushToAccount, account.AuthTenantID),
+		keppel.CanDeleteFromAccount: uid.HasPermission(keppel.CanDeleteFromAccount, account.AuthTenantID),
+		keppel.CanChangeAccount:     uid.HasPermission(keppel.CanChangeAccount, account.AuthTenantID),
+	}
+
+	//RBAC policies can grant additional permissions (this mirrors the logic in
+	//auth.filterRepoActions, except that we do not know a specific repository
+	//here, so a policy applies if it would match at least some repository)
+	var policies []keppel.RBACPolicy
+	_, err = a.db.Select(&policies, `SELECT * FROM rbac_policies WHERE account_name = $1`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	ip := keppel.GetRequesterIP(r, a.cfg.TrustedProxyNetworks)
+	userName := uid.UserName()
+	var groupNames []string
+	if gm, ok := uid.(keppel.GroupMembership); ok {
+		groupNames = gm.GroupNames()
+	}
+	isAnonymous := uid.UserType() == keppel.AnonymousUser
+	for _, policy := range policies {
+		policy.RepositoryPattern = ""
+		if !policy.Matches(ip, "", userName, groupNames) {
+			continue
+		}
+		if policy.CanPullAnonymously {
+			isGranted[keppel.CanPullFromAccount] = true
+		}
+		if policy.CanPull && !isAnonymous {
+			isGranted[keppel.CanPullFromAccount] = true
+		}
+		if policy.CanPush && !isAnonymous {
+			isGranted[keppel.CanPushToAccount] = true
+		}
+		if policy.CanDelete && !isAnonymous {
+			isGranted[keppel.CanDeleteFromAccount] = true
+		}
+	}
+
+	permissions := []keppel.Permission{}
+	for _, perm := range []keppel.Permission{keppel.CanViewAccount, keppel.CanPullFromAccount, keppel.CanPushToAccount, keppel.CanDeleteFromAccount, keppel.CanChangeAccount} {
+		if isGranted[perm] {
+			permissions = append(permissions, perm)
+		}
+	}
+
+	//do not reveal the existence of accounts that the caller cannot access at all
+	if len(permissions) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"permissions": permissions})
+}
@@ -0,0 +1,107 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestGetAccountPermissions(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+	s.AD.ExpectedUserName = "someuser"
+
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "test1",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+
+	expectPermissions := func(header map[string]string, permissions []string) {
+		t.Helper()
+		req := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/_permissions",
+			Header:       header,
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"permissions": permissions},
+		}
+		if permissions == nil {
+			req.ExpectStatus = http.StatusNotFound
+			req.ExpectBody = assert.StringData("not found\n")
+		}
+		req.Check(t, h)
+	}
+	adminHeader := map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1,delete:tenant1,change:tenant1"}
+	pullOnlyHeader := map[string]string{"X-Test-Perms": "pull:tenant1"}
+	otherTenantHeader := map[string]string{"X-Test-Perms": "view:tenant2,pull:tenant2"}
+	anonymousHeader := map[string]string{}
+
+	//an admin has all permissions
+	expectPermissions(adminHeader, []string{"view", "pull", "push", "delete", "change"})
+	//a pull-only user only has the pull permission (and can query it even
+	//without the view permission)
+	expectPermissions(pullOnlyHeader, []string{"pull"})
+	//users without any permissions on this account, including anonymous users,
+	//cannot even see that the account exists
+	expectPermissions(otherTenantHeader, nil)
+	expectPermissions(anonymousHeader, nil)
+
+	//nonexistent accounts are reported as such
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/doesnotexist/_permissions",
+		Header:       adminHeader,
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	//RBAC policies grant additional permissions, even if they only apply to
+	//some repositories
+	mustInsert(t, s.DB, &keppel.RBACPolicy{
+		AccountName:        "test1",
+		RepositoryPattern:  "library/.*",
+		CanPullAnonymously: true,
+	})
+	mustInsert(t, s.DB, &keppel.RBACPolicy{
+		AccountName:       "test1",
+		RepositoryPattern: "team/.*",
+		UserNamePattern:   "someuser",
+		CanPull:           true,
+		CanPush:           true,
+	})
+	mustInsert(t, s.DB, &keppel.RBACPolicy{
+		AccountName:     "test1",
+		UserNamePattern: "otheruser",
+		CanPull:         true,
+		CanPush:         true,
+		CanDelete:       true,
+	})
+
+	expectPermissions(adminHeader, []string{"view", "pull", "push", "delete", "change"})
+	expectPermissions(pullOnlyHeader, []string{"pull", "push"})
+	expectPermissions(otherTenantHeader, []string{"pull", "push"})
+	//anonymous users only get what is granted to them by anonymous pull policies
+	expectPermissions(anonymousHeader, []string{"pull"})
+}
@@ -0,0 +1,107 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// ManifestPullStats represents the pull counts of a single manifest in the API.
+type ManifestPullStats struct {
+	Digest string         `json:"digest"`
+	Total  uint64         `json:"total"`
+	Days   []DayPullCount `json:"days"`
+}
+
+// DayPullCount appears in type ManifestPullStats.
+type DayPullCount struct {
+	Day   string `json:"day"`
+	Count uint64 `json:"count"`
+}
+
+var pullStatsGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT digest, day, count FROM manifest_pull_stats
+	 WHERE repo_id = $1 AND day >= $2
+	 ORDER BY digest, day
+`)
+
+func (a *API) handleGetPullStats(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_pull_stats")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//we cannot report more days than we retain
+	maxDays := uint64(keppel.ManifestPullStatsRetention / (24 * time.Hour))
+	days := uint64(7)
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		var err error
+		days, err = strconv.ParseUint(daysStr, 10, 64)
+		if err != nil || days == 0 || days > maxDays {
+			http.Error(w, "invalid value for days: "+daysStr, http.StatusBadRequest)
+			return
+		}
+	}
+
+	//the current day counts as one of the requested days
+	y, m, d := a.timeNow().UTC().Date()
+	firstDay := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-int(days))
+
+	result := []ManifestPullStats{}
+	err := sqlext.ForeachRow(a.db, pullStatsGetQuery, []interface{}{repo.ID, firstDay.Format("2006-01-02")}, func(rows *sql.Rows) error {
+		var (
+			digest string
+			day    time.Time
+			count  uint64
+		)
+		err := rows.Scan(&digest, &day, &count)
+		if err != nil {
+			return err
+		}
+		if len(result) == 0 || result[len(result)-1].Digest != digest {
+			result = append(result, ManifestPullStats{Digest: digest, Days: []DayPullCount{}})
+		}
+		stats := &result[len(result)-1]
+		stats.Total += count
+		stats.Days = append(stats.Days, DayPullCount{Day: day.Format("2006-01-02"), Count: count})
+		return nil
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"pull_stats": result})
+}
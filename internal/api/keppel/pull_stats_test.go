@@ -0,0 +1,184 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestPullStatsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	s.Clock.StepBy(1 * time.Hour)
+
+	image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+	image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+	list := test.GenerateImageList(image1, image2)
+	list.MustUpload(t, s, keppel.Repository{AccountName: "test1", Name: "foo"}, "")
+
+	token := s.GetToken(t, "repository:test1/foo:pull")
+	pullManifest := func(method, digestStr, acceptHeader string, expectStatus int) {
+		t.Helper()
+		assert.HTTPRequest{
+			Method: method,
+			Path:   "/v2/test1/foo/manifests/" + digestStr,
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        acceptHeader,
+			},
+			ExpectStatus: expectStatus,
+		}.Check(t, h)
+	}
+	flush := func() {
+		t.Helper()
+		err := s.PullCounter.Flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//without pulls, there are no stats
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"pull_stats": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//on the first day, pull the first image twice (HEAD requests do not count)
+	pullManifest("GET", image1.Manifest.Digest.String(), image1.Manifest.MediaType, http.StatusOK)
+	pullManifest("GET", image1.Manifest.Digest.String(), image1.Manifest.MediaType, http.StatusOK)
+	pullManifest("HEAD", image1.Manifest.Digest.String(), image1.Manifest.MediaType, http.StatusOK)
+
+	//pulls are only visible after a flush
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"pull_stats": []assert.JSONObject{}},
+	}.Check(t, h)
+	flush()
+
+	//on the second day, pull the first image once more, and pull the image
+	//list through the redirect to its linux/amd64 image (this counts for the
+	//image list, and then for the image when the client follows the redirect)
+	s.Clock.StepBy(24 * time.Hour)
+	pullManifest("GET", image1.Manifest.Digest.String(), image1.Manifest.MediaType, http.StatusOK)
+	pullManifest("GET", list.Manifest.Digest.String(), schema2.MediaTypeManifest, http.StatusTemporaryRedirect)
+	pullManifest("GET", image1.Manifest.Digest.String(), schema2.MediaTypeManifest, http.StatusOK)
+	flush()
+
+	//counts are aggregated per day
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"pull_stats": sortedPullStats(
+			assert.JSONObject{
+				"digest": image1.Manifest.Digest.String(),
+				"total":  4,
+				"days": []assert.JSONObject{
+					{"day": "1970-01-01", "count": 2},
+					{"day": "1970-01-02", "count": 2},
+				},
+			},
+			assert.JSONObject{
+				"digest": list.Manifest.Digest.String(),
+				"total":  1,
+				"days": []assert.JSONObject{
+					{"day": "1970-01-02", "count": 1},
+				},
+			},
+		)},
+	}.Check(t, h)
+
+	//?days= restricts the time frame (the current day counts as one of the days)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats?days=1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"pull_stats": sortedPullStats(
+			assert.JSONObject{
+				"digest": image1.Manifest.Digest.String(),
+				"total":  2,
+				"days": []assert.JSONObject{
+					{"day": "1970-01-02", "count": 2},
+				},
+			},
+			assert.JSONObject{
+				"digest": list.Manifest.Digest.String(),
+				"total":  1,
+				"days": []assert.JSONObject{
+					{"day": "1970-01-02", "count": 1},
+				},
+			},
+		)},
+	}.Check(t, h)
+
+	//test failure cases
+	for _, days := range []string{"0", "31", "foo"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats?days=" + days,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.StringData("invalid value for days: " + days + "\n"),
+		}.Check(t, h)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_pull_stats",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/bar/_pull_stats",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+}
+
+// sortedPullStats orders the given pull stats by digest, like the API does.
+func sortedPullStats(stats ...assert.JSONObject) []assert.JSONObject {
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i]["digest"].(string) < stats[j]["digest"].(string)
+	})
+	return stats
+}
@@ -39,16 +39,30 @@ type quotaAndUsage struct {
 	Usage uint64 `json:"usage"`
 }
 
+// optionalQuotaAndUsage is like quotaAndUsage, but Quota is nil (i.e. null in
+// JSON) if usage is not limited.
+type optionalQuotaAndUsage struct {
+	Quota *uint64 `json:"quota"`
+	Usage uint64  `json:"usage"`
+}
+
 type quotaResponse struct {
-	Manifests quotaAndUsage `json:"manifests"`
+	Manifests    quotaAndUsage         `json:"manifests"`
+	StorageBytes optionalQuotaAndUsage `json:"storage_bytes"`
 }
 
 type justQuota struct {
 	Quota uint64 `json:"quota"`
 }
 
+type justOptionalQuota struct {
+	Quota *uint64 `json:"quota"`
+}
+
 type quotaRequest struct {
 	Manifests justQuota `json:"manifests"`
+	//StorageBytes is nil if the request does not want to change this quota.
+	StorageBytes *justOptionalQuota `json:"storage_bytes"`
 }
 
 func (a *API) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
@@ -71,12 +85,20 @@ func (a *API) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
 	if respondwith.ErrorText(w, err) {
 		return
 	}
+	storageBytes, err := quotas.GetStorageUsage(a.db)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
 
 	respondwith.JSON(w, http.StatusOK, quotaResponse{
 		Manifests: quotaAndUsage{
 			Quota: quotas.ManifestCount,
 			Usage: manifestCount,
 		},
+		StorageBytes: optionalQuotaAndUsage{
+			Quota: quotas.StorageBytes,
+			Usage: storageBytes,
+		},
 	})
 }
 
@@ -126,10 +148,25 @@ func (a *API) handlePutQuotas(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusUnprocessableEntity)
 		return
 	}
+	storageBytes, err := quotas.GetStorageUsage(tx)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	newStorageQuota := quotas.StorageBytes
+	if req.StorageBytes != nil {
+		newStorageQuota = req.StorageBytes.Quota
+	}
+	if newStorageQuota != nil && *newStorageQuota < storageBytes {
+		msg := fmt.Sprintf("requested storage quota (%d bytes) is below usage (%d bytes)",
+			*newStorageQuota, storageBytes)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
 
-	if quotas.ManifestCount != req.Manifests.Quota {
+	if quotas.ManifestCount != req.Manifests.Quota || !equalOptionalQuotas(quotas.StorageBytes, newStorageQuota) {
 		//apply quotas if necessary
 		quotas.ManifestCount = req.Manifests.Quota
+		quotas.StorageBytes = newStorageQuota
 		if isUpdate {
 			_, err = tx.Update(quotas)
 		} else {
@@ -161,5 +198,16 @@ func (a *API) handlePutQuotas(w http.ResponseWriter, r *http.Request) {
 			Quota: req.Manifests.Quota,
 			Usage: manifestCount,
 		},
+		StorageBytes: optionalQuotaAndUsage{
+			Quota: newStorageQuota,
+			Usage: storageBytes,
+		},
 	})
 }
+
+func equalOptionalQuotas(lhs, rhs *uint64) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
@@ -42,7 +42,8 @@ func TestQuotasAPI(t *testing.T) {
 		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
 		ExpectStatus: http.StatusOK,
 		ExpectBody: assert.JSONObject{
-			"manifests": assert.JSONObject{"quota": 0, "usage": 0},
+			"manifests":     assert.JSONObject{"quota": 0, "usage": 0},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 0},
 		},
 	}.Check(t, h)
 
@@ -71,7 +72,8 @@ func TestQuotasAPI(t *testing.T) {
 			},
 			ExpectStatus: http.StatusOK,
 			ExpectBody: assert.JSONObject{
-				"manifests": assert.JSONObject{"quota": 100, "usage": 0},
+				"manifests":     assert.JSONObject{"quota": 100, "usage": 0},
+				"storage_bytes": assert.JSONObject{"quota": nil, "usage": 0},
 			},
 		}.Check(t, h)
 
@@ -112,7 +114,8 @@ func TestQuotasAPI(t *testing.T) {
 		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
 		ExpectStatus: http.StatusOK,
 		ExpectBody: assert.JSONObject{
-			"manifests": assert.JSONObject{"quota": 100, "usage": 0},
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 0},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 0},
 		},
 	}.Check(t, h)
 
@@ -144,7 +147,8 @@ func TestQuotasAPI(t *testing.T) {
 		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
 		ExpectStatus: http.StatusOK,
 		ExpectBody: assert.JSONObject{
-			"manifests": assert.JSONObject{"quota": 100, "usage": 10},
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 0},
 		},
 	}.Check(t, h)
 
@@ -179,5 +183,194 @@ func TestQuotasAPI(t *testing.T) {
 		ExpectBody:   assert.StringData("requested manifest quota (5) is below usage (10)\n"),
 	}.Check(t, h)
 
-	//TODO audit events
+	//put some blobs in the DB, check that GET reflects storage usage (blobs
+	//mounted in multiple repos are counted only once, unbacked blobs are not
+	//counted at all)
+	mustInsert(t, s.DB, &keppel.Repository{
+		Name:        "repo2",
+		AccountName: "test1",
+	})
+	sidGen := test.StorageIDGenerator{}
+	for idx := 1; idx <= 3; idx++ {
+		storageID := ""
+		if idx != 3 {
+			storageID = sidGen.Next()
+		}
+		blob := keppel.Blob{
+			AccountName: "test1",
+			Digest:      deterministicDummyDigest(100 + idx),
+			SizeBytes:   uint64(1000 * idx),
+			StorageID:   storageID,
+			PushedAt:    time.Unix(20000, 0),
+			ValidatedAt: time.Unix(20000, 0),
+		}
+		mustInsert(t, s.DB, &blob)
+		for _, repoID := range []int64{1, 2} {
+			mustExec(t, s.DB, `INSERT INTO blob_mounts (blob_id, repo_id) VALUES ($1, $2)`, blob.ID, repoID)
+		}
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/quotas/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 3000},
+		},
+	}.Check(t, h)
+
+	//PUT with storage quota
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/quotas/tenant1",
+		Header: map[string]string{"X-Test-Perms": "changequota:tenant1"},
+		Body: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100},
+			"storage_bytes": assert.JSONObject{"quota": 2999},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("requested storage quota (2999 bytes) is below usage (3000 bytes)\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/quotas/tenant1",
+		Header: map[string]string{"X-Test-Perms": "changequota:tenant1"},
+		Body: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100},
+			"storage_bytes": assert.JSONObject{"quota": 5000},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": 5000, "usage": 3000},
+		},
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/keppel/v1/quotas/tenant1",
+		Action:      cadf.UpdateAction,
+		Outcome:     "success",
+		Reason:      test.CADFReasonOK,
+		Target: cadf.Resource{
+			TypeURI:   "docker-registry/project-quota",
+			ID:        "tenant1",
+			ProjectID: "tenant1",
+			Attachments: []cadf.Attachment{
+				{
+					Name:    "payload-before",
+					TypeURI: "mime:application/json",
+					Content: `{"manifests":100}`,
+				},
+				{
+					Name:    "payload",
+					TypeURI: "mime:application/json",
+					Content: `{"manifests":100,"storage_bytes":5000}`,
+				},
+			},
+		},
+	})
+
+	//omitting the storage quota leaves it unchanged
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/quotas/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "changequota:tenant1"},
+		Body:         assert.JSONObject{"manifests": assert.JSONObject{"quota": 100}},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": 5000, "usage": 3000},
+		},
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t /*, nothing */)
+
+	//GET reflects changes
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/quotas/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": 5000, "usage": 3000},
+		},
+	}.Check(t, h)
+
+	//null removes the storage quota again
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/quotas/tenant1",
+		Header: map[string]string{"X-Test-Perms": "changequota:tenant1"},
+		Body: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100},
+			"storage_bytes": assert.JSONObject{"quota": nil},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 100, "usage": 10},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 3000},
+		},
+	}.Check(t, h)
+}
+
+func TestQuotasAPIUsageAcrossAccounts(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//tenant1 owns two accounts, tenant2 owns one account whose usage must not be
+	//counted towards tenant1
+	accounts := []keppel.Account{
+		{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"},
+		{Name: "test2", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"},
+		{Name: "test3", AuthTenantID: "tenant2", GCPoliciesJSON: "[]"},
+	}
+	sidGen := test.StorageIDGenerator{}
+	manifestCounter := 0
+	for idx, account := range accounts {
+		mustInsert(t, s.DB, &account)
+		repo := keppel.Repository{Name: "repo", AccountName: account.Name}
+		mustInsert(t, s.DB, &repo)
+
+		//account N gets 2^N manifests and one blob of 2^N KiB
+		for idx2 := 0; idx2 < 1<<idx; idx2++ {
+			manifestCounter++
+			mustInsert(t, s.DB, &keppel.Manifest{
+				RepositoryID:        repo.ID,
+				Digest:              deterministicDummyDigest(manifestCounter),
+				SizeBytes:           1000,
+				PushedAt:            time.Unix(10000, 0),
+				ValidatedAt:         time.Unix(10000, 0),
+				VulnerabilityStatus: clair.PendingVulnerabilityStatus,
+			})
+		}
+		mustInsert(t, s.DB, &keppel.Blob{
+			AccountName: account.Name,
+			Digest:      deterministicDummyDigest(100 + idx),
+			SizeBytes:   uint64(1024 << idx),
+			StorageID:   sidGen.Next(),
+			PushedAt:    time.Unix(10000, 0),
+			ValidatedAt: time.Unix(10000, 0),
+		})
+	}
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/quotas/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 0, "usage": 3},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 3072},
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/quotas/tenant2",
+		Header:       map[string]string{"X-Test-Perms": "viewquota:tenant2"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"manifests":     assert.JSONObject{"quota": 0, "usage": 4},
+			"storage_bytes": assert.JSONObject{"quota": nil, "usage": 4096},
+		},
+	}.Check(t, h)
 }
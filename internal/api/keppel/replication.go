@@ -0,0 +1,116 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/api"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// ManifestReplicationResult appears in the response of the on-demand
+// replication endpoint for each reference that was replicated successfully.
+type ManifestReplicationResult struct {
+	Digest string `json:"digest"`
+}
+
+// maxManifestReplicationBatchSize is the maximum number of references that may
+// be replicated in a single request to handlePostReplicate. This is much lower
+// than for the existence check since each reference may incur several
+// requests to the upstream registry.
+const maxManifestReplicationBatchSize = 50
+
+func (a *API) handlePostReplicate(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_replicate")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	if account.UpstreamPeerHostName == "" && account.ExternalPeerURL == "" {
+		http.Error(w, "cannot replicate into a primary account", http.StatusConflict)
+		return
+	}
+	if account.InMaintenance {
+		http.Error(w, "account is in maintenance", http.StatusConflict)
+		return
+	}
+
+	var references []string
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&references)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(references) > maxManifestReplicationBatchSize {
+		msg := fmt.Sprintf("too many references: got %d, but at most %d are allowed per request", len(references), maxManifestReplicationBatchSize)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	//like on the first pull of an image, the repo is created if it does not exist yet
+	repoName := mux.Vars(r)["repo_name"]
+	if !isValidRepoName(repoName) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	repo, err := keppel.FindOrCreateRepository(a.db, repoName, *account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	result := api.NewBatchResults[ManifestReplicationResult](len(references))
+	proc := a.processor()
+	for _, reference := range references {
+		if result.Contains(reference) {
+			continue
+		}
+		ref, err := parseBatchReference(reference)
+		if err != nil {
+			result.AddError(reference, err)
+			continue
+		}
+
+		//this takes the same codepath as a pull of a missing manifest through the
+		//Registry API, except that it does not matter whether the manifest already
+		//exists locally: we always ask upstream to pick up moved tags
+		manifest, _, err := proc.ReplicateManifest(r.Context(), *account, *repo, ref, keppel.AuditContext{
+			UserIdentity: authz.UserIdentity,
+			Request:      r,
+		})
+		if err != nil {
+			result.AddError(reference, err)
+		} else {
+			result.AddSuccess(reference, ManifestReplicationResult{Digest: manifest.Digest})
+		}
+	}
+
+	respondwith.JSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,137 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestReplicateAPI(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s1 := test.NewSetup(t,
+			test.WithKeppelAPI,
+			test.WithPeerAPI,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+			test.WithQuotas,
+		)
+		s2 := test.NewSetup(t,
+			test.WithKeppelAPI,
+			test.WithPeerAPI,
+			test.IsSecondaryTo(&s1),
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", UpstreamPeerHostName: "registry.example.org"}),
+			test.WithQuotas,
+		)
+		mustExec(t, s2.DB, `UPDATE accounts SET platform_filter = $1`, `[{"os":"linux","architecture":"amd64"}]`)
+
+		//upload some images to the primary account
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		list := test.GenerateImageList(image1, image2)
+		fooRepo := keppel.Repository{AccountName: "test1", Name: "foo"}
+		image1.MustUpload(t, s1, fooRepo, "first")
+		image2.MustUpload(t, s1, fooRepo, "second")
+		list.MustUpload(t, s1, fooRepo, "list")
+
+		//replication requires push permission
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_replicate",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			Body:         assert.StringData(`["first"]`),
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   assert.StringData("no permission for repository:test1/foo:push\n"),
+		}.Check(t, s2.Handler)
+
+		//replication only makes sense in replica accounts
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_replicate",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+			Body:         assert.StringData(`["first"]`),
+			ExpectStatus: http.StatusConflict,
+			ExpectBody:   assert.StringData("cannot replicate into a primary account\n"),
+		}.Check(t, s1.Handler)
+
+		//replicate some tags, an unknown tag and a malformed reference into the
+		//replica (the repo does not exist there yet, but will be created on the fly)
+		_, respBody := assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_replicate",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+			Body:         assert.StringData(`["first","list","unknown","sha256:bogus"]`),
+			ExpectStatus: http.StatusOK,
+		}.Check(t, s2.Handler)
+
+		var result struct {
+			Results []struct {
+				Reference string `json:"reference"`
+				OK        bool   `json:"ok"`
+				Error     string `json:"error"`
+				Data      *struct {
+					Digest string `json:"digest"`
+				} `json:"data"`
+			} `json:"results"`
+		}
+		mustDo(t, json.Unmarshal(respBody, &result))
+		if len(result.Results) != 4 {
+			t.Fatalf("expected results for 4 references, but got %d", len(result.Results))
+		}
+		for idx, ref := range []string{"first", "list", "unknown", "sha256:bogus"} {
+			if result.Results[idx].Reference != ref {
+				t.Errorf("expected result #%d to be for %q, but got %q", idx, ref, result.Results[idx].Reference)
+			}
+		}
+		for idx, digest := range []string{image1.Manifest.Digest.String(), list.Manifest.Digest.String()} {
+			if r := result.Results[idx]; !r.OK || r.Data == nil || r.Data.Digest != digest || r.Error != "" {
+				t.Errorf("expected successful replication of %q to digest %s, but got %#v", r.Reference, digest, r)
+			}
+		}
+		if r := result.Results[2]; r.OK || r.Data != nil || r.Error == "" {
+			t.Errorf(`expected replication of "unknown" to fail, but got %#v`, r)
+		}
+		if r := result.Results[3]; r.OK || r.Error != "invalid reference" {
+			t.Errorf(`expected "sha256:bogus" to be rejected as malformed, but got %#v`, r)
+		}
+
+		//the requested tags are now available in the replica without any further
+		//upstream requests...
+		expectCount := func(expected int64, query string, args ...interface{}) {
+			t.Helper()
+			actual, err := s2.DB.SelectInt(query, args...)
+			mustDo(t, err)
+			if actual != expected {
+				t.Errorf("expected %d for %q, but got %d", expected, query, actual)
+			}
+		}
+		expectCount(1, `SELECT COUNT(*) FROM tags WHERE name = 'first' AND digest = $1`, image1.Manifest.Digest.String())
+		expectCount(1, `SELECT COUNT(*) FROM tags WHERE name = 'list' AND digest = $1`, list.Manifest.Digest.String())
+		expectCount(0, `SELECT COUNT(*) FROM tags WHERE name IN ('second', 'unknown')`)
+
+		//...but the submanifest that does not match the platform_filter was not replicated
+		expectCount(1, `SELECT COUNT(*) FROM manifests WHERE digest = $1`, image1.Manifest.Digest.String())
+		expectCount(0, `SELECT COUNT(*) FROM manifests WHERE digest = $1`, image2.Manifest.Digest.String())
+	})
+}
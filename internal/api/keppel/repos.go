@@ -20,10 +20,13 @@ package keppelv1
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -32,13 +35,18 @@ import (
 
 // Repository represents a repository in the API.
 type Repository struct {
-	Name          string `json:"name"`
-	ManifestCount uint64 `json:"manifest_count"`
-	TagCount      uint64 `json:"tag_count"`
-	SizeBytes     uint64 `json:"size_bytes,omitempty"`
-	PushedAt      int64  `json:"pushed_at,omitempty"`
+	Name          string            `json:"name"`
+	ManifestCount uint64            `json:"manifest_count"`
+	TagCount      uint64            `json:"tag_count"`
+	SizeBytes     uint64            `json:"size_bytes,omitempty"`
+	PushedAt      int64             `json:"pushed_at,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
 }
 
+// maxRepoMetadataSizeBytes limits how large the serialized metadata of a
+// single repository may be.
+const maxRepoMetadataSizeBytes = 4096
+
 var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 	WITH
 		blob_stats AS (
@@ -57,7 +65,7 @@ var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 			  FROM tags
 			 GROUP BY repo_id
 		)
-	SELECT r.name,
+	SELECT r.name, r.metadata_json,
 	       bs.size_bytes,
 	       ms.count, ms.pushed_at,
 	       ts.count, ts.pushed_at
@@ -99,6 +107,7 @@ func (a *API) handleGetRepositories(w http.ResponseWriter, r *http.Request) {
 	err = sqlext.ForeachRow(a.db, query, bindValues, func(rows *sql.Rows) error {
 		var (
 			name                string
+			metadataJSON        string
 			sizeBytes           *uint64
 			manifestCount       *uint64
 			maxManifestPushedAt *time.Time
@@ -106,21 +115,30 @@ func (a *API) handleGetRepositories(w http.ResponseWriter, r *http.Request) {
 			maxTagPushedAt      *time.Time
 		)
 		err := rows.Scan(
-			&name,
+			&name, &metadataJSON,
 			&sizeBytes,
 			&manifestCount, &maxManifestPushedAt,
 			&tagCount, &maxTagPushedAt,
 		)
-		if err == nil {
-			result.Repos = append(result.Repos, Repository{
-				Name:          name,
-				ManifestCount: unpackUint64OrZero(manifestCount),
-				TagCount:      unpackUint64OrZero(tagCount),
-				SizeBytes:     unpackUint64OrZero(sizeBytes),
-				PushedAt:      maxTimeToUnix(maxTagPushedAt, maxManifestPushedAt),
-			})
+		if err != nil {
+			return err
+		}
+		var metadata map[string]string
+		if metadataJSON != "" {
+			err := json.Unmarshal([]byte(metadataJSON), &metadata)
+			if err != nil {
+				return fmt.Errorf("malformed metadata JSON for repository %q: %q", name, metadataJSON)
+			}
 		}
-		return err
+		result.Repos = append(result.Repos, Repository{
+			Name:          name,
+			ManifestCount: unpackUint64OrZero(manifestCount),
+			TagCount:      unpackUint64OrZero(tagCount),
+			SizeBytes:     unpackUint64OrZero(sizeBytes),
+			PushedAt:      maxTimeToUnix(maxTagPushedAt, maxManifestPushedAt),
+			Metadata:      metadata,
+		})
+		return nil
 	})
 	if respondwith.ErrorText(w, err) {
 		return
@@ -216,3 +234,156 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (a *API) handlePostRepositoryRename(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_rename")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanChangeAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//parse request body
+	var req struct {
+		Name string `json:"name"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isValidRepoName(req.Name) {
+		http.Error(w, fmt.Sprintf("invalid repository name: %q", req.Name), http.StatusBadRequest)
+		return
+	}
+	if rerr := a.cfg.CheckNewRepoName(req.Name); rerr != nil {
+		http.Error(w, rerr.Message, http.StatusBadRequest)
+		return
+	}
+
+	//in replica accounts, repository names must match those in the upstream
+	if account.UpstreamPeerHostName != "" || account.ExternalPeerURL != "" {
+		http.Error(w, "cannot rename repositories in a replica account", http.StatusConflict)
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	otherRepoCount, err := tx.SelectInt(
+		`SELECT COUNT(*) FROM repos WHERE account_name = $1 AND name = $2`,
+		account.Name, req.Name,
+	)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if otherRepoCount > 0 {
+		http.Error(w, "another repository with this name exists already", http.StatusConflict)
+		return
+	}
+
+	//blobs, blob mounts, manifests and tags reference the repo by ID, so they
+	//do not need to be touched
+	oldName := repo.Name
+	_, err = tx.Exec(`UPDATE repos SET name = $1 WHERE id = $2`, req.Name, repo.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//manifests are stored under the repo name in the storage, so they need to be
+	//copied to the new name before the rename is committed (if we fail halfway
+	//through, the janitor will clean up the copies that were already written)
+	var manifestDigests []string
+	_, err = tx.Select(&manifestDigests, `SELECT digest FROM manifests WHERE repo_id = $1`, repo.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	for _, digest := range manifestDigests {
+		manifestBytes, err := a.sd.ReadManifest(*account, oldName, digest)
+		if err == nil {
+			err = a.sd.WriteManifest(*account, req.Name, digest, manifestBytes)
+		}
+		if err != nil {
+			respondwith.ErrorText(w, fmt.Errorf("cannot copy manifest %s to new repository name: %w", digest, err))
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//the old copies are not referenced by the DB anymore, so failing to delete
+	//them is not fatal (the janitor will clean them up eventually)
+	for _, digest := range manifestDigests {
+		err := a.sd.DeleteManifest(*account, oldName, digest)
+		if err != nil {
+			logg.Error("while renaming repository %s/%s to %s/%s: cannot delete manifest %s from old location: %s",
+				account.Name, oldName, account.Name, req.Name, digest, err.Error())
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handlePutRepositoryMetadata(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_metadata")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//parse request body
+	var req struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metadataJSONStr := ""
+	if len(req.Metadata) > 0 {
+		metadataJSON, _ := json.Marshal(req.Metadata)
+		if len(metadataJSON) > maxRepoMetadataSizeBytes {
+			msg := fmt.Sprintf("metadata may not be larger than %d bytes when serialized as JSON", maxRepoMetadataSizeBytes)
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		metadataJSONStr = string(metadataJSON)
+	}
+
+	_, err = a.db.Exec(`UPDATE repos SET metadata_json = $1 WHERE id = $2`, metadataJSONStr, repo.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	if req.Metadata == nil {
+		req.Metadata = map[string]string{}
+	}
+	respondwith.JSON(w, http.StatusOK, req)
+}
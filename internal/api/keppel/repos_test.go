@@ -22,8 +22,10 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -264,3 +266,301 @@ func TestReposAPI(t *testing.T) {
 		ExpectBody:   assert.StringData("cannot delete repository while there are still manifests in it\n"),
 	}.Check(t, h)
 }
+
+func TestReposPagination(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "test1",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+	mustExec(t, s.DB,
+		`INSERT INTO repos (account_name, name) SELECT 'test1', 'repo' || LPAD(idx::TEXT, 4, '0') FROM generate_series(1, 1500) AS idx`,
+	)
+
+	getPage := func(path string) (names []string, isTruncated bool) {
+		t.Helper()
+		_, respBody := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var data struct {
+			Repos []struct {
+				Name string `json:"name"`
+			} `json:"repositories"`
+			IsTruncated bool `json:"truncated"`
+		}
+		err := json.Unmarshal(respBody, &data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, repo := range data.Repos {
+			names = append(names, repo.Name)
+		}
+		return names, data.IsTruncated
+	}
+
+	//first page is capped at 1000 results
+	names, isTruncated := getPage("/keppel/v1/accounts/test1/repositories")
+	if len(names) != 1000 || !isTruncated {
+		t.Fatalf("expected 1000 repos with truncated = true on first page, but got %d repos with truncated = %t", len(names), isTruncated)
+	}
+	if names[0] != "repo0001" || names[999] != "repo1000" {
+		t.Errorf("unexpected first page: %s ... %s", names[0], names[999])
+	}
+
+	//second page continues after the marker and is not truncated
+	names, isTruncated = getPage("/keppel/v1/accounts/test1/repositories?marker=" + names[999])
+	if len(names) != 500 || isTruncated {
+		t.Fatalf("expected 500 repos with truncated = false on second page, but got %d repos with truncated = %t", len(names), isTruncated)
+	}
+	if names[0] != "repo1001" || names[499] != "repo1500" {
+		t.Errorf("unexpected second page: %s ... %s", names[0], names[499])
+	}
+}
+func TestRenameRepository(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	account := keppel.Account{
+		Name:           "test1",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	}
+	mustInsert(t, s.DB, &account)
+	repo := keppel.Repository{Name: "team/app", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo)
+	mustInsert(t, s.DB, &keppel.Repository{Name: "team/other", AccountName: "test1"})
+
+	//put a manifest with a tag and a blob into the repo
+	blob := keppel.Blob{
+		AccountName: "test1",
+		Digest:      deterministicDummyDigest(1),
+		SizeBytes:   1000,
+		PushedAt:    time.Unix(1000, 0),
+		ValidatedAt: time.Unix(1000, 0),
+	}
+	mustInsert(t, s.DB, &blob)
+	mustDo(t, keppel.MountBlobIntoRepo(s.DB, blob, repo))
+	manifestDigest := deterministicDummyDigest(2)
+	mustInsert(t, s.DB, &keppel.Manifest{
+		RepositoryID:        repo.ID,
+		Digest:              manifestDigest,
+		MediaType:           "application/vnd.docker.distribution.manifest.v2+json",
+		SizeBytes:           2000,
+		PushedAt:            time.Unix(2000, 0),
+		ValidatedAt:         time.Unix(2000, 0),
+		VulnerabilityStatus: clair.PendingVulnerabilityStatus,
+	})
+	mustInsert(t, s.DB, &keppel.Tag{
+		RepositoryID: repo.ID,
+		Name:         "latest",
+		Digest:       manifestDigest,
+		PushedAt:     time.Unix(2000, 0),
+	})
+	mustDo(t, s.SD.WriteManifest(account, "team/app", manifestDigest, []byte("manifest contents")))
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app-legacy"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app-legacy"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "Team/App"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid repository name: \"Team/App\"\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/other"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("another repository with this name exists already\n"),
+	}.Check(t, h)
+
+	//test happy case
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app-legacy"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	//the repo keeps its ID, so its manifests, tags and blob mounts are retained
+	repoName, err := s.DB.SelectStr(`SELECT name FROM repos WHERE id = $1`, repo.ID)
+	mustDo(t, err)
+	assert.DeepEqual(t, "repo name", repoName, "team/app-legacy")
+	tagDigest, err := s.DB.SelectStr(`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`, repo.ID, "latest")
+	mustDo(t, err)
+	assert.DeepEqual(t, "tag digest", tagDigest, manifestDigest)
+	mountCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blob_mounts WHERE repo_id = $1`, repo.ID)
+	mustDo(t, err)
+	assert.DeepEqual(t, "blob mount count", mountCount, int64(1))
+
+	//the manifest was moved in the storage
+	manifestBytes, err := s.SD.ReadManifest(account, "team/app-legacy", manifestDigest)
+	mustDo(t, err)
+	assert.DeepEqual(t, "manifest contents", string(manifestBytes), "manifest contents")
+	_, err = s.SD.ReadManifest(account, "team/app", manifestDigest)
+	if err == nil {
+		t.Error("expected manifest to be deleted from the old repository name, but it still exists")
+	}
+
+	//the old name is free for use again, the new name is taken
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/other/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app-legacy"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("another repository with this name exists already\n"),
+	}.Check(t, h)
+}
+
+func TestRepositoryMetadata(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "test1",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+	repo := keppel.Repository{Name: "team/app", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo)
+	mustInsert(t, s.DB, &keppel.Repository{Name: "team/other", AccountName: "test1"})
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+
+	//test failure cases
+	metadata := assert.JSONObject{"description": "the main application", "owner": "team-a"}
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body:         assert.JSONObject{"metadata": metadata},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": metadata},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": assert.JSONObject{"description": 42}},
+		ExpectStatus: http.StatusBadRequest,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": assert.JSONObject{"description": strings.Repeat("x", 5000)}},
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody:   assert.StringData("metadata may not be larger than 4096 bytes when serialized as JSON\n"),
+	}.Check(t, h)
+
+	tr.DBChanges().AssertEmpty()
+
+	//test happy case
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": metadata},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"metadata": metadata},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+			UPDATE repos SET metadata_json = '{"description":"the main application","owner":"team-a"}' WHERE id = %d;
+		`,
+		repo.ID,
+	)
+
+	expectedListing := assert.JSONObject{
+		"repositories": []assert.JSONObject{
+			{"name": "team/app", "manifest_count": 0, "tag_count": 0, "metadata": metadata},
+			{"name": "team/other", "manifest_count": 0, "tag_count": 0},
+		},
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   expectedListing,
+	}.Check(t, h)
+
+	//the metadata survives unrelated operations on the repo, like pushing
+	//content into it or renaming it
+	blob := keppel.Blob{
+		AccountName: "test1",
+		Digest:      deterministicDummyDigest(1),
+		SizeBytes:   1000,
+		PushedAt:    time.Unix(1000, 0),
+		ValidatedAt: time.Unix(1000, 0),
+	}
+	mustInsert(t, s.DB, &blob)
+	mustDo(t, keppel.MountBlobIntoRepo(s.DB, blob, repo))
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app/_rename",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "team/app-legacy"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"repositories": []assert.JSONObject{
+				{"name": "team/app-legacy", "manifest_count": 0, "tag_count": 0, "size_bytes": 1000, "metadata": metadata},
+				{"name": "team/other", "manifest_count": 0, "tag_count": 0},
+			},
+		},
+	}.Check(t, h)
+
+	//setting an empty metadata object clears the metadata
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/team/app-legacy/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": assert.JSONObject{}},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"metadata": assert.JSONObject{}},
+	}.Check(t, h)
+	metadataJSON, err := s.DB.SelectStr(`SELECT metadata_json FROM repos WHERE id = $1`, repo.ID)
+	mustDo(t, err)
+	assert.DeepEqual(t, "metadata JSON", metadataJSON, "")
+}
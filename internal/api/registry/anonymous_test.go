@@ -0,0 +1,105 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestDisableAnonymousAccess(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		for _, disableAnonymous := range []bool{false, true} {
+			opts := []test.SetupOption{
+				test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+				test.WithQuotas,
+			}
+			if disableAnonymous {
+				opts = append(opts, test.WithoutAnonymousAccess)
+			}
+			s := test.NewSetup(t, opts...)
+			h := s.Handler
+
+			image := test.GenerateImage(test.GenerateExampleLayer(1))
+			image.MustUpload(t, s, fooRepoRef, "latest")
+			err := s.DB.Insert(&keppel.RBACPolicy{
+				AccountName:        "test1",
+				RepositoryPattern:  "foo",
+				CanPullAnonymously: true,
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if disableAnonymous {
+				//anonymous pull is rejected despite the RBAC policy...
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/manifests/latest",
+					Header:       test.AddHeadersForCorrectAuthChallenge(nil),
+					ExpectStatus: http.StatusUnauthorized,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey: test.VersionHeaderValue,
+						"Www-Authenticate":    `Bearer realm="https://registry.example.org/keppel/v1/auth",service="registry.example.org",scope="repository:test1/foo:pull"`,
+					},
+					ExpectBody: test.ErrorCodeWithMessage{
+						Code:    keppel.ErrUnauthorized,
+						Message: "anonymous access is disabled",
+					},
+				}.Check(t, h)
+				//...and anonymous users cannot obtain a token either
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/keppel/v1/auth?service=registry.example.org&scope=repository:test1/foo:pull",
+					Header:       test.AddHeadersForCorrectAuthChallenge(nil),
+					ExpectStatus: http.StatusUnauthorized,
+				}.Check(t, h)
+			} else {
+				//by default, the RBAC policy allows anonymous pull
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/manifests/latest",
+					ExpectStatus: http.StatusOK,
+					ExpectHeader: test.VersionHeader,
+					ExpectBody:   assert.ByteData(image.Manifest.Contents),
+				}.Check(t, h)
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/keppel/v1/auth?service=registry.example.org&scope=repository:test1/foo:pull",
+					Header:       test.AddHeadersForCorrectAuthChallenge(nil),
+					ExpectStatus: http.StatusOK,
+				}.Check(t, h)
+			}
+
+			//authenticated pull is unaffected
+			token := s.GetToken(t, "repository:test1/foo:pull")
+			expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+
+			err = s.DB.Db.Close()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	})
+}
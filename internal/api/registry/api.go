@@ -20,7 +20,9 @@ package registryv2
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -45,14 +47,17 @@ type API struct {
 	db      *keppel.DB
 	auditor keppel.Auditor
 	rle     *keppel.RateLimitEngine //may be nil
+	pc      *keppel.PullCounter
+	lpd     *keppel.LastPulledDebouncer     //only used if cfg.LastPulledDebounceInterval > 0
+	ufl     *processor.UpstreamFetchLimiter //may be nil
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
 	generateStorageID func() string
 }
 
 // NewAPI constructs a new API instance.
-func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor, rle *keppel.RateLimitEngine) *API {
-	return &API{cfg, ad, fd, sd, icd, db, auditor, rle, time.Now, keppel.GenerateStorageID}
+func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor, rle *keppel.RateLimitEngine, pc *keppel.PullCounter, lpd *keppel.LastPulledDebouncer, ufl *processor.UpstreamFetchLimiter) *API {
+	return &API{cfg, ad, fd, sd, icd, db, auditor, rle, pc, lpd, ufl, time.Now, keppel.GenerateStorageID}
 }
 
 // OverrideTimeNow replaces time.Now with a test double.
@@ -84,7 +89,7 @@ func (a *API) AddTo(r *mux.Router) {
 		HandlerFunc(a.handleGetOrHeadBlob)
 	r.Methods("POST").
 		Path("/v2/{repository:.+}/blobs/uploads/").
-		HandlerFunc(a.handleStartBlobUpload)
+		HandlerFunc(limitRequestBody(a.cfg.MaxBlobBodySizeBytes, a.handleStartBlobUpload))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
 		HandlerFunc(a.handleDeleteBlobUpload)
@@ -93,10 +98,10 @@ func (a *API) AddTo(r *mux.Router) {
 		HandlerFunc(a.handleGetBlobUpload)
 	r.Methods("PATCH").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleContinueBlobUpload)
+		HandlerFunc(limitRequestBody(a.cfg.MaxBlobBodySizeBytes, a.handleContinueBlobUpload))
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleFinishBlobUpload)
+		HandlerFunc(limitRequestBody(a.cfg.MaxBlobBodySizeBytes, a.handleFinishBlobUpload))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/manifests/{reference}").
 		HandlerFunc(a.handleDeleteManifest)
@@ -105,14 +110,64 @@ func (a *API) AddTo(r *mux.Router) {
 		HandlerFunc(a.handleGetOrHeadManifest)
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handlePutManifest)
+		HandlerFunc(limitRequestBody(a.cfg.MaxManifestBodySizeBytes, a.handlePutManifest))
+	r.Methods("GET").
+		Path("/v2/{repository:.+}/referrers/{digest}").
+		HandlerFunc(a.handleListReferrers)
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/tags/list").
 		HandlerFunc(a.handleListTags)
 }
 
+// limitRequestBody wraps the handler for an endpoint that accepts potentially
+// large request bodies. If `maxBytes` is not zero, requests with larger bodies
+// are rejected with 413 (Request Entity Too Large).
+func limitRequestBody(maxBytes uint64, handler http.HandlerFunc) http.HandlerFunc {
+	if maxBytes == 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		//if the client announces the body size upfront, we can reject right away...
+		if r.ContentLength > 0 && uint64(r.ContentLength) > maxBytes {
+			requestBodyTooLargeError(maxBytes).WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		//...otherwise reading the body fails once the limit is exceeded, and
+		//respondWithError() turns that into a 413 response
+		r.Body = &limitedRequestBody{
+			ReadCloser: http.MaxBytesReader(w, r.Body, int64(maxBytes)),
+			maxBytes:   maxBytes,
+		}
+		handler(w, r)
+	}
+}
+
+// limitedRequestBody wraps the http.MaxBytesReader set up by
+// limitRequestBody() and remembers whether the limit was exceeded. We cannot
+// rely on finding the *http.MaxBytesError in the error chain since it may be
+// lost when the storage driver wraps the error from reading the body.
+type limitedRequestBody struct {
+	io.ReadCloser
+	maxBytes uint64
+	exceeded bool
+}
+
+// Read implements the io.Reader interface.
+func (b *limitedRequestBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+func requestBodyTooLargeError(maxBytes uint64) *keppel.RegistryV2Error {
+	return keppel.ErrSizeInvalid.With("request body exceeds the maximum size of %d bytes", maxBytes).WithStatus(http.StatusRequestEntityTooLarge)
+}
+
 func (a *API) processor() *processor.Processor {
-	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor).OverrideTimeNow(a.timeNow).OverrideGenerateStorageID(a.generateStorageID)
+	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor).WithUpstreamFetchLimiter(a.ufl).OverrideTimeNow(a.timeNow).OverrideGenerateStorageID(a.generateStorageID)
 }
 
 // This implements the GET /v2/ endpoint.
@@ -155,12 +210,21 @@ func respondWithError(w http.ResponseWriter, r *http.Request, err error) bool {
 		if err == nil {
 			return false
 		}
-		err.WriteAsRegistryV2ResponseTo(w, r)
+	}
+
+	//if the request body was cut off by limitRequestBody(), that is the root
+	//cause of whatever error we got while processing it
+	if body, ok := r.Body.(*limitedRequestBody); ok && body.exceeded {
+		requestBodyTooLargeError(body.maxBytes).WriteAsRegistryV2ResponseTo(w, r)
 		return true
-	default:
+	}
+
+	if rerr, ok := err.(*keppel.RegistryV2Error); ok {
+		rerr.WriteAsRegistryV2ResponseTo(w, r)
+	} else {
 		keppel.ErrUnknown.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
-		return true
 	}
+	return true
 }
 
 type repoAccessStrategy int
@@ -175,6 +239,7 @@ type anycastRequestInfo struct {
 	AccountName     string
 	RepoName        string
 	PrimaryHostName string //the peer who has this account
+	Audience        auth.Audience
 }
 
 func (info anycastRequestInfo) AsPrometheusLabels() prometheus.Labels {
@@ -251,7 +316,7 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 					keppel.ErrUnknown.With(msg).WriteAsRegistryV2ResponseTo(w, r)
 				} else {
 					mappedPrimaryHostName := authz.Audience.MapPeerHostname(primaryHostName)
-					anycastHandler(w, r, anycastRequestInfo{repoScope.AccountName, repoScope.RepositoryName, mappedPrimaryHostName})
+					anycastHandler(w, r, anycastRequestInfo{repoScope.AccountName, repoScope.RepositoryName, mappedPrimaryHostName, authz.Audience})
 				}
 				return nil, nil, nil
 			case keppel.ErrNoSuchPrimaryAccount:
@@ -280,14 +345,25 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 		canCreateRepoIfMissing = account.UpstreamPeerHostName != "" || (account.ExternalPeerURL != "" && (authz.UserIdentity.UserType() == keppel.RegularUser || canFirstPull))
 	}
 
+	//pushing cannot create repositories with names that the operator has
+	//forbidden (but existing repositories with such names can still be used)
+	var forbiddenNameErr *keppel.RegistryV2Error
+	if strategy == createRepoIfMissing {
+		forbiddenNameErr = a.cfg.CheckNewRepoName(repoScope.RepositoryName)
+	}
+
 	var repo *keppel.Repository
-	if canCreateRepoIfMissing {
+	if canCreateRepoIfMissing && forbiddenNameErr == nil {
 		repo, err = keppel.FindOrCreateRepository(a.db, repoScope.RepositoryName, *account)
 	} else {
 		repo, err = keppel.FindRepository(a.db, repoScope.RepositoryName, *account)
 	}
 	if err == sql.ErrNoRows || repo == nil {
-		keppel.ErrNameUnknown.With("repository not found").WriteAsRegistryV2ResponseTo(w, r)
+		if forbiddenNameErr != nil {
+			forbiddenNameErr.WriteAsRegistryV2ResponseTo(w, r)
+		} else {
+			keppel.ErrNameUnknown.With("repository not found").WriteAsRegistryV2ResponseTo(w, r)
+		}
 		return nil, nil, nil
 	} else if respondWithError(w, r, err) {
 		return nil, nil, nil
@@ -309,10 +385,19 @@ func (a *API) checkRateLimit(w http.ResponseWriter, r *http.Request, account kep
 		return true
 	}
 
-	allowed, result, err := a.rle.RateLimitAllows(account, action, amount)
+	sourceIP := keppel.GetRequesterIP(r, a.cfg.TrustedProxyNetworks)
+	allowed, result, err := a.rle.RateLimitAllows(account, sourceIP, action, amount)
 	if respondWithError(w, r, err) {
 		return false
 	}
+
+	//report the rate limit status on both allowed and denied responses, so that
+	//clients can pace themselves before running into 429 responses
+	hdr := w.Header()
+	hdr.Set("RateLimit-Limit", strconv.Itoa(result.Limit.Burst))
+	hdr.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	hdr.Set("RateLimit-Reset", strconv.FormatUint(uint64(result.ResetAfter/time.Second), 10))
+
 	if !allowed {
 		retryAfterStr := strconv.FormatUint(uint64(result.RetryAfter/time.Second), 10)
 		respondWithError(w, r, keppel.ErrTooManyRequests.With("").WithHeader("Retry-After", retryAfterStr))
@@ -322,6 +407,18 @@ func (a *API) checkRateLimit(w http.ResponseWriter, r *http.Request, account kep
 	return true
 }
 
+// Writes an error response and returns false if the account is in maintenance.
+// This is used by all endpoints that push new contents into an account. Pulls
+// and deletions are still allowed during maintenance (the latter because
+// deleting all manifests is part of the account deletion workflow).
+func checkNotInMaintenance(w http.ResponseWriter, r *http.Request, account keppel.Account) bool {
+	if account.InMaintenance {
+		keppel.ErrUnavailable.With("account is in maintenance").WriteAsRegistryV2ResponseTo(w, r)
+		return false
+	}
+	return true
+}
+
 // Returns the repository name as it appears in URL paths for this API.
 func getRepoNameForURLPath(repo keppel.Repository, authz *auth.Authorization) string {
 	//on the regular API, the URL path includes the account name
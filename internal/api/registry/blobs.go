@@ -21,9 +21,11 @@ package registryv2
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/opencontainers/go-digest"
@@ -86,29 +88,52 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//...and answer GET requests by replicating the blob contents
-		responseWasWritten, err := a.processor().ReplicateBlob(*blob, *account, *repo, w)
-
-		if err != nil {
-			if responseWasWritten {
-				//we cannot write to `w` if br.Execute() wrote a response there already
-				logg.Error("while trying to replicate blob %s in %s/%s: %s",
-					blob.Digest, account.Name, repo.Name, err.Error())
-			} else if err == processor.ErrConcurrentReplication {
-				//special handling for GET during ongoing replication (429 Too Many
-				//Requests is not a perfect match, but it's my best guess for getting
-				//clients to automatically retry the request after a few seconds)
-				w.Header().Set("Retry-After", "10")
-				msg := "currently replicating on a different worker, please retry in a few seconds"
-				keppel.ErrTooManyRequests.With(msg).WriteAsRegistryV2ResponseTo(w, r)
-			} else {
-				respondWithError(w, r, err)
+		responseWasWritten, err := a.processor().ReplicateBlob(r.Context(), *blob, *account, *repo, w)
+		switch {
+		case err == nil && responseWasWritten:
+			return
+		case err == nil:
+			//the blob was replicated by a concurrent request, so it can be served
+			//from our own storage below
+			blob, err = keppel.FindBlobByRepository(a.db, blobDigest, *repo)
+			if respondWithError(w, r, err) {
+				return
+			}
+			if blob.StorageID == "" {
+				respondWithError(w, r, errors.New("blob replication yielded neither blob contents nor an error"))
+				return
 			}
-		} else if !responseWasWritten {
-			respondWithError(w, r, errors.New("blob replication yielded neither blob contents nor an error"))
+		case responseWasWritten:
+			//we cannot write to `w` if br.Execute() wrote a response there already
+			logg.Error("while trying to replicate blob %s in %s/%s: %s",
+				blob.Digest, account.Name, repo.Name, err.Error())
+			return
+		case err == processor.ErrConcurrentReplication:
+			//special handling for GET during ongoing replication (429 Too Many
+			//Requests is not a perfect match, but it's my best guess for getting
+			//clients to automatically retry the request after a few seconds)
+			w.Header().Set("Retry-After", "10")
+			msg := "currently replicating on a different worker, please retry in a few seconds"
+			keppel.ErrTooManyRequests.With(msg).WriteAsRegistryV2ResponseTo(w, r)
+			return
+		default:
+			respondWithError(w, r, err)
+			return
 		}
+	}
 
+	//if the client only wants a part of the blob, figure out which part
+	br, err := parseRangeHeader(r.Header.Get("Range"), blob.SizeBytes)
+	if err == errRangeNotSatisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", blob.SizeBytes))
+		w.Header().Set("Docker-Content-Digest", blob.Digest)
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
+	responseSizeBytes := blob.SizeBytes
+	if br != nil {
+		responseSizeBytes = br.Length
+	}
 
 	//if a peer reverse-proxied to us to fulfill an anycast request, enforce the anycast rate limits
 	isAnycast := r.Header.Get("X-Keppel-Forwarded-By") != ""
@@ -116,7 +141,7 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		//AnycastBlobBytePullAction is only relevant for GET requests since it
 		//limits the size of the response body (which is empty for HEAD)
 		if r.Method == http.MethodGet {
-			if !a.checkRateLimit(w, r, *account, authz, keppel.AnycastBlobBytePullAction, blob.SizeBytes) {
+			if !a.checkRateLimit(w, r, *account, authz, keppel.AnycastBlobBytePullAction, responseSizeBytes) {
 				return
 			}
 		}
@@ -131,7 +156,13 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 			l["method"] = "registry-api+anycast"
 		}
 		api.BlobsPulledCounter.With(l).Inc()
-		api.BlobBytesPulledCounter.With(l).Add(float64(blob.SizeBytes))
+		api.BlobBytesPulledCounter.With(l).Add(float64(responseSizeBytes))
+	}
+
+	//the blob contents may be shared with a different account
+	storageAccount, err := keppel.FindBlobStorageAccount(a.db, *blob, *account)
+	if respondWithError(w, r, err) {
+		return
 	}
 
 	//prefer redirecting the client to a storage URL if the storage driver can give us one
@@ -142,7 +173,7 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 	//CORS happens correctly. This is important for web UIs reading image config
 	//blobs in order to render informational UIs.
 	if !isImageConfigBlobMediaType[blob.MediaType] {
-		url, err := a.sd.URLForBlob(*account, blob.StorageID)
+		url, err := a.sd.URLForBlob(storageAccount, blob.StorageID)
 		if err == nil {
 			w.Header().Set("Docker-Content-Digest", blob.Digest)
 			w.Header().Set("Location", url)
@@ -155,17 +186,30 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//return the blob contents to the client directly (TODO: support range requests)
-	reader, lengthBytes, err := a.sd.ReadBlob(*account, blob.StorageID)
+	//return the blob contents to the client directly
+	var (
+		reader      io.ReadCloser
+		lengthBytes uint64
+		statusCode  = http.StatusOK
+	)
+	if br == nil {
+		reader, lengthBytes, err = a.sd.ReadBlob(storageAccount, blob.StorageID)
+	} else {
+		reader, err = a.sd.ReadBlobRange(storageAccount, blob.StorageID, br.Offset, br.Length)
+		lengthBytes = br.Length
+		statusCode = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", br.Offset, br.Offset+br.Length-1, blob.SizeBytes))
+	}
 	if respondWithError(w, r, err) {
 		return
 	}
 	defer reader.Close()
 
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", strconv.FormatUint(lengthBytes, 10))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Docker-Content-Digest", blob.Digest)
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 	if r.Method != http.MethodHead {
 		_, err = io.Copy(w, reader)
 		if err != nil {
@@ -174,16 +218,104 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// byteRange is a contiguous range of bytes within a blob, as requested by the
+// client through the Range header.
+type byteRange struct {
+	Offset uint64
+	Length uint64
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRangeHeader parses the Range header of a request for a blob of the
+// given size. If the header is absent or cannot be interpreted, (nil, nil) is
+// returned and the whole blob shall be served. (RFC 7233 allows servers to
+// ignore the Range header. We use this to avoid having to generate
+// multipart/byteranges responses when multiple ranges are requested.)
+func parseRangeHeader(header string, sizeBytes uint64) (*byteRange, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if header == "" || spec == header || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	firstStr, lastStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	//suffix range like "bytes=-500" (the last 500 bytes)
+	if firstStr == "" {
+		suffixLength, err := strconv.ParseUint(lastStr, 10, 64)
+		if err != nil {
+			return nil, nil //nolint:nilerr // invalid Range headers are ignored (see above)
+		}
+		if suffixLength == 0 || sizeBytes == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		if suffixLength > sizeBytes {
+			suffixLength = sizeBytes
+		}
+		return &byteRange{Offset: sizeBytes - suffixLength, Length: suffixLength}, nil
+	}
+
+	//regular range like "bytes=500-999" or open-ended range like "bytes=500-"
+	first, err := strconv.ParseUint(firstStr, 10, 64)
+	if err != nil {
+		return nil, nil //nolint:nilerr // invalid Range headers are ignored (see above)
+	}
+	last := sizeBytes - 1
+	if lastStr != "" {
+		last, err = strconv.ParseUint(lastStr, 10, 64)
+		if err != nil || last < first {
+			return nil, nil //nolint:nilerr // invalid Range headers are ignored (see above)
+		}
+	}
+	if first >= sizeBytes {
+		return nil, errRangeNotSatisfiable
+	}
+	if last >= sizeBytes {
+		last = sizeBytes - 1
+	}
+	return &byteRange{Offset: first, Length: last - first + 1}, nil
+}
+
 func (a *API) handleGetOrHeadBlobAnycast(w http.ResponseWriter, r *http.Request, info anycastRequestInfo) {
+	peerHostName, err := a.selectPeerForAnycastBlobPull(r, info)
+	if respondWithError(w, r, err) {
+		return
+	}
+	w.Header().Set("X-Keppel-Anycast-Peer", peerHostName)
+
 	//NOTE: Rate limits are enforced by the peer that we reverse-proxy to, not by
 	//us. We couldn't enforce them anyway because we don't have this account.
-	err := a.cfg.ReverseProxyAnycastRequestToPeer(w, r, info.PrimaryHostName)
+	err = a.cfg.ReverseProxyAnycastRequestToPeer(w, r, peerHostName)
 	if respondWithError(w, r, err) {
 		return
 	}
 	api.BlobsPulledCounter.With(info.AsPrometheusLabels()).Inc()
 }
 
+// Blob pulls are not necessarily forwarded to the primary account: Any peer
+// can serve them if it has a replica of the account, so we spread the load
+// across all peers (see keppel.SelectAnycastPeer for details).
+func (a *API) selectPeerForAnycastBlobPull(r *http.Request, info anycastRequestInfo) (string, error) {
+	//if the request was already forwarded to us, we are the peer that was
+	//selected, but we don't have the account; so we need to ask the primary
+	//(this also ensures that requests cannot be forwarded in circles)
+	if r.Header.Get("X-Keppel-Forwarded-By") != "" {
+		return info.PrimaryHostName, nil
+	}
+
+	var peers []keppel.Peer
+	_, err := a.db.Select(&peers, `SELECT * FROM peers ORDER BY hostname`)
+	if err != nil {
+		return "", err
+	}
+	for idx, peer := range peers {
+		peers[idx].HostName = info.Audience.MapPeerHostname(peer.HostName)
+	}
+	return keppel.SelectAnycastPeer(peers, info.PrimaryHostName, info.AccountName, info.RepoName, a.timeNow()), nil
+}
+
 // This implements the DELETE /v2/<account>/<repository>/blobs/<digest> endpoint.
 func (a *API) handleDeleteBlob(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v2/:account/:repo/blobs/:digest")
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"testing"
@@ -66,10 +67,10 @@ func TestBlobMonolithicUpload(t *testing.T) {
 					"Content-Type":   "application/octet-stream",
 				},
 				Body:         assert.ByteData(blob.Contents),
-				ExpectStatus: http.StatusMethodNotAllowed,
+				ExpectStatus: http.StatusServiceUnavailable,
 				ExpectHeader: test.VersionHeader,
 				ExpectBody: test.ErrorCodeWithMessage{
-					Code:    keppel.ErrUnsupported,
+					Code:    keppel.ErrUnavailable,
 					Message: "account is in maintenance",
 				},
 			}.Check(t, h)
@@ -275,10 +276,10 @@ func TestBlobStreamedAndChunkedUpload(t *testing.T) {
 						"Content-Type":   "application/octet-stream",
 					},
 					Body:         assert.ByteData(blob.Contents),
-					ExpectStatus: http.StatusMethodNotAllowed,
+					ExpectStatus: http.StatusServiceUnavailable,
 					ExpectHeader: test.VersionHeader,
 					ExpectBody: test.ErrorCodeWithMessage{
-						Code:    keppel.ErrUnsupported,
+						Code:    keppel.ErrUnavailable,
 						Message: "account is in maintenance",
 					},
 				}.Check(t, h)
@@ -882,3 +883,397 @@ func TestCrossRepositoryBlobMount(t *testing.T) {
 		expectBlobExists(t, h, otherRepoToken, "test1/bar", blob, nil)
 	})
 }
+
+func TestBlobUploadStorageQuota(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		blob1 := test.NewBytes([]byte("just some random data"))
+		blob2 := test.NewBytes([]byte("just some other random data"))
+		mustExec := func(query string, args ...interface{}) {
+			t.Helper()
+			_, err := s.DB.Exec(query, args...)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		mustExec(`UPDATE quotas SET storage_bytes = $1 WHERE auth_tenant_id = $2`, len(blob1.Contents)+10, authTenantID)
+
+		//uploading a blob within the storage quota works
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob1.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob1.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob1.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+		expectBlobExists(t, h, token, "test1/foo", blob1, nil)
+
+		//uploading another blob exceeds the storage quota, both with a monolithic upload...
+		expectedError := test.ErrorCodeWithMessage{
+			Code: keppel.ErrDenied,
+			Message: fmt.Sprintf("storage quota exceeded (quota = %d bytes, usage = %d bytes, blob size = %d bytes)",
+				len(blob1.Contents)+10, len(blob1.Contents), len(blob2.Contents)),
+		}
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob2.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob2.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob2.Contents),
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   expectedError,
+		}.Check(t, h)
+
+		//...and with a chunked upload
+		uploadURL := getBlobUploadURL(t, h, token, "test1/foo")
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   keppel.AppendQuery(uploadURL, url.Values{"digest": {blob2.Digest.String()}}),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob2.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob2.Contents),
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   expectedError,
+		}.Check(t, h)
+
+		//re-pushing a blob that already exists does not consume any additional
+		//storage, so this works even though the quota is almost exhausted
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob1.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob1.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob1.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		//neither of the failed uploads shall leave anything behind
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM uploads`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if count > 0 {
+			t.Errorf("expected 0 uploads in the DB, but found %d uploads", count)
+		}
+		if s.SD.BlobCount() != 1 {
+			t.Errorf("expected 1 blob in the storage, but found %d blobs", s.SD.BlobCount())
+		}
+
+		//after removing the quota, the upload works
+		mustExec(`UPDATE quotas SET storage_bytes = NULL WHERE auth_tenant_id = $1`, authTenantID)
+		blob2.MustUpload(t, s, keppel.Repository{Name: "foo", AccountName: "test1"})
+		expectBlobExists(t, h, token, "test1/foo", blob2, nil)
+	})
+}
+
+func TestBlobUploadSizeLimit(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		blob := test.NewBytes([]byte("just some random data that is a bit too large"))
+		_, err := s.DB.Exec(`UPDATE accounts SET max_blob_size_bytes = $1 WHERE name = $2`, 30, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expectedError := test.ErrorCodeWithMessage{
+			Code:    keppel.ErrBlobUploadInvalid,
+			Message: "blob exceeds the maximum size of 30 bytes for this account",
+		}
+
+		//a monolithic upload over the limit is rejected based on its Content-Length
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusRequestEntityTooLarge,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   expectedError,
+		}.Check(t, h)
+
+		//a chunked upload is aborted as soon as it crosses the limit, both when the
+		//chunk size is announced in advance and when the chunk is streamed
+		chunk1, chunk2 := blob.Contents[0:20], blob.Contents[20:]
+		for _, isChunked := range []bool{true, false} {
+			resp, _ := assert.HTTPRequest{
+				Method: "PATCH",
+				Path:   getBlobUploadURL(t, h, token, "test1/foo"),
+				Header: map[string]string{
+					"Authorization":  "Bearer " + token,
+					"Content-Length": strconv.Itoa(len(chunk1)),
+					"Content-Range":  fmt.Sprintf("0-%d", len(chunk1)-1),
+					"Content-Type":   "application/octet-stream",
+				},
+				Body:         assert.ByteData(chunk1),
+				ExpectStatus: http.StatusAccepted,
+			}.Check(t, h)
+
+			hdr := map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  "application/octet-stream",
+			}
+			if isChunked {
+				hdr["Content-Length"] = strconv.Itoa(len(chunk2))
+				hdr["Content-Range"] = fmt.Sprintf("%d-%d", len(chunk1), len(blob.Contents)-1)
+			}
+			assert.HTTPRequest{
+				Method:       "PATCH",
+				Path:         resp.Header.Get("Location"),
+				Header:       hdr,
+				Body:         assert.ByteData(chunk2),
+				ExpectStatus: http.StatusRequestEntityTooLarge,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectedError,
+			}.Check(t, h)
+
+			//the upload was aborted, so it cannot be continued
+			assert.HTTPRequest{
+				Method:       "PUT",
+				Path:         keppel.AppendQuery(resp.Header.Get("Location"), url.Values{"digest": {blob.Digest.String()}}),
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusNotFound,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrBlobUploadUnknown),
+			}.Check(t, h)
+		}
+
+		//none of the failed uploads shall leave anything behind
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM uploads`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if count > 0 {
+			t.Errorf("expected 0 uploads in the DB, but found %d uploads", count)
+		}
+		if s.SD.BlobCount() != 0 {
+			t.Errorf("expected 0 blobs in the storage, but found %d blobs", s.SD.BlobCount())
+		}
+
+		//blobs within the limit can be uploaded
+		smallBlob := test.NewBytes(chunk1)
+		smallBlob.MustUpload(t, s, keppel.Repository{Name: "foo", AccountName: "test1"})
+		expectBlobExists(t, h, token, "test1/foo", smallBlob, nil)
+	})
+}
+
+func TestBlobUploadBodySizeLimit(t *testing.T) {
+	blob := test.NewBytes([]byte("just some random data that is a bit too large"))
+	limit := 30
+
+	s := test.NewSetup(t,
+		test.WithMaxBlobBodySize(uint64(limit)),
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+	expectedError := test.ErrorCodeWithMessage{
+		Code:    keppel.ErrSizeInvalid,
+		Message: fmt.Sprintf("request body exceeds the maximum size of %d bytes", limit),
+	}
+
+	//a monolithic upload over the limit is rejected based on its Content-Length
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+		Header: map[string]string{
+			"Authorization":  "Bearer " + token,
+			"Content-Length": strconv.Itoa(len(blob.Contents)),
+			"Content-Type":   "application/octet-stream",
+		},
+		Body:         assert.ByteData(blob.Contents),
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   expectedError,
+	}.Check(t, h)
+
+	//a streamed chunk over the limit is rejected once the limit is crossed
+	//while the storage driver reads the request body
+	uploadURL := getBlobUploadURL(t, h, token, "test1/foo")
+	req := httptest.NewRequest(http.MethodPatch, uploadURL, bytes.NewReader(blob.Contents))
+	req.ContentLength = -1
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for oversized streamed blob chunk, but got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	//the upload was aborted, so it cannot be continued
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         keppel.AppendQuery(uploadURL, url.Values{"digest": {blob.Digest.String()}}),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusNotFound,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrBlobUploadUnknown),
+	}.Check(t, h)
+	if s.SD.BlobCount() != 0 {
+		t.Errorf("expected 0 blobs in the storage, but found %d blobs", s.SD.BlobCount())
+	}
+
+	//blobs within the limit can be uploaded
+	smallBlob := test.NewBytes(blob.Contents[0:limit])
+	smallBlob.MustUpload(t, s, fooRepoRef)
+	expectBlobExists(t, h, token, "test1/foo", smallBlob, nil)
+}
+
+func TestGetBlobRange(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		blob := test.NewBytes([]byte("0123456789abcdefghij"))
+		blob.MustUpload(t, s, fooRepoRef)
+
+		expectRange := func(rangeHeader, expectedContentRange, expectedBody string) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/blobs/" + blob.Digest.String(),
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Range":         rangeHeader,
+				},
+				ExpectStatus: http.StatusPartialContent,
+				ExpectHeader: map[string]string{
+					test.VersionHeaderKey:   test.VersionHeaderValue,
+					"Content-Length":        strconv.Itoa(len(expectedBody)),
+					"Content-Range":         expectedContentRange,
+					"Docker-Content-Digest": blob.Digest.String(),
+				},
+				ExpectBody: assert.StringData(expectedBody),
+			}.Check(t, h)
+		}
+
+		//range in the middle of the blob
+		expectRange("bytes=5-9", "bytes 5-9/20", "56789")
+		//open-ended range (as used by clients to resume an interrupted download)
+		expectRange("bytes=15-", "bytes 15-19/20", "fghij")
+		//suffix range
+		expectRange("bytes=-3", "bytes 17-19/20", "hij")
+		//range that extends past the end of the blob is truncated
+		expectRange("bytes=18-100", "bytes 18-19/20", "ij")
+
+		//unsatisfiable range
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/blobs/" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Range":         "bytes=20-",
+			},
+			ExpectStatus: http.StatusRequestedRangeNotSatisfiable,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Content-Range":       "bytes */20",
+			},
+		}.Check(t, h)
+
+		//multiple ranges and malformed Range headers are ignored, so the whole blob is served
+		for _, rangeHeader := range []string{"bytes=0-1,5-6", "bytes=5-1", "items=0-5"} {
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/blobs/" + blob.Digest.String(),
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Range":         rangeHeader,
+				},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: map[string]string{
+					test.VersionHeaderKey: test.VersionHeaderValue,
+					"Accept-Ranges":       "bytes",
+					"Content-Length":      "20",
+				},
+				ExpectBody: assert.ByteData(blob.Contents),
+			}.Check(t, h)
+		}
+	})
+}
+
+func TestCrossAccountBlobDeduplication(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithCrossAccountBlobDedup,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithAccount(keppel.Account{Name: "test2", AuthTenantID: authTenantID}),
+		test.WithAccount(keppel.Account{Name: "test3", AuthTenantID: "otherauthtenant"}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	repo1 := keppel.Repository{AccountName: "test1", Name: "foo"}
+	repo2 := keppel.Repository{AccountName: "test2", Name: "foo"}
+	repo3 := keppel.Repository{AccountName: "test3", Name: "foo"}
+
+	//the first upload of a blob needs to write into the storage as usual
+	blob := test.NewBytes([]byte("just some random data"))
+	dbBlob1 := blob.MustUpload(t, s, repo1)
+	assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), 1)
+	assert.DeepEqual(t, "storage account name of first blob", dbBlob1.StorageAccountName, "")
+
+	//pushing the same blob into a different account of the same auth tenant
+	//reuses the existing storage contents without writing into the storage
+	dbBlob2 := blob.MustUpload(t, s, repo2)
+	assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), 1)
+	assert.DeepEqual(t, "storage account name of second blob", dbBlob2.StorageAccountName, "test1")
+	assert.DeepEqual(t, "storage ID of second blob", dbBlob2.StorageID, dbBlob1.StorageID)
+
+	//the deduplicated blob can be pulled from the second account
+	token := s.GetToken(t, "repository:test2/foo:pull")
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test2/foo/blobs/" + blob.Digest.String(),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{
+			test.VersionHeaderKey:   test.VersionHeaderValue,
+			"Docker-Content-Digest": blob.Digest.String(),
+		},
+		ExpectBody: assert.ByteData(blob.Contents),
+	}.Check(t, h)
+
+	//deduplication still requires the client to send the correct blob contents
+	token = s.GetToken(t, "repository:test2/bar:pull,push")
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/v2/test2/bar/blobs/uploads/?digest=" + blob.Digest.String(),
+		Header: map[string]string{
+			"Authorization":  "Bearer " + token,
+			"Content-Length": strconv.Itoa(len(blob.Contents)),
+			"Content-Type":   "application/octet-stream",
+		},
+		Body:         assert.ByteData(bytes.Repeat([]byte("x"), len(blob.Contents))),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+	}.Check(t, h)
+
+	//accounts in different auth tenants do not share storage contents
+	dbBlob3 := blob.MustUpload(t, s, repo3)
+	assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), 2)
+	assert.DeepEqual(t, "storage account name of third blob", dbBlob3.StorageAccountName, "")
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
 )
 
 const maxLimit = 100
@@ -47,6 +48,11 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 		Scopes:                auth.NewScopeSet(auth.CatalogEndpointScope),
 		AllowsAnycast:         false,
 		AllowsDomainRemapping: true,
+		//anonymous users may use the catalog (and will only see repos with
+		//anonymous pull access), but only with an explicitly requested token;
+		//otherwise nobody would ever be presented with the auth challenge and all
+		//clients would assume that they get the same result without auth
+		NoImplicitAnonymous: true,
 	}.Authorize(a.cfg, a.ad, a.db)
 	if rerr != nil {
 		rerr.WriteAsRegistryV2ResponseTo(w, r)
@@ -96,15 +102,18 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//find accessible accounts
-	accountNames := authz.ScopeSet.AccountsWithCatalogAccess(markerAccountName)
-	sort.Strings(accountNames)
+	//find candidate accounts (which repos are visible to the user is decided below)
+	accounts, err := a.getCatalogAccounts(authz.Audience, markerAccountName)
+	if respondWithError(w, r, err) {
+		return
+	}
 
 	//collect repository names from backend
+	ip := keppel.GetRequesterIP(r, a.cfg.TrustedProxyNetworks)
 	var allNames []string
 	partialResult := false
-	for idx, accountName := range accountNames {
-		names, err := a.getCatalogForAccount(accountName, includeAccountName)
+	for idx, account := range accounts {
+		names, err := a.getCatalogForAccount(account, ip, authz.UserIdentity, includeAccountName)
 		if respondWithError(w, r, err) {
 			return
 		}
@@ -145,23 +154,47 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (a *API) getCatalogAccounts(audience auth.Audience, markerAccountName string) ([]keppel.Account, error) {
+	//on a domain-remapped API, only that API's account is accessible (if it exists)
+	if audience.AccountName != "" {
+		account, err := keppel.FindAccount(a.db, audience.AccountName)
+		if err != nil || account == nil {
+			return nil, err
+		}
+		return []keppel.Account{*account}, nil
+	}
+
+	//when paginating, we don't need to care about accounts before the marker
+	var accounts []keppel.Account
+	_, err := a.db.Select(&accounts, `SELECT * FROM accounts WHERE name >= $1 ORDER BY name`, markerAccountName)
+	return accounts, err
+}
+
 const catalogGetQuery = `SELECT name FROM repos WHERE account_name = $1 ORDER BY name`
 
-func (a *API) getCatalogForAccount(accountName string, includeAccountName bool) ([]string, error) {
-	var result []string
-	err := sqlext.ForeachRow(a.db, catalogGetQuery, []interface{}{accountName},
+func (a *API) getCatalogForAccount(account keppel.Account, ip string, uid keppel.UserIdentity, includeAccountName bool) ([]string, error) {
+	var names []string
+	err := sqlext.ForeachRow(a.db, catalogGetQuery, []interface{}{account.Name},
 		func(rows *sql.Rows) error {
 			var name string
 			err := rows.Scan(&name)
-			if err == nil {
-				if includeAccountName {
-					result = append(result, fmt.Sprintf("%s/%s", accountName, name))
-				} else {
-					result = append(result, name)
-				}
-			}
+			names = append(names, name)
 			return err
 		},
 	)
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+
+	//only list repos that the user can pull from
+	names, err = auth.FilterPullableRepositories(ip, uid, account, names, a.db)
+	if err != nil {
+		return nil, err
+	}
+	if includeAccountName {
+		for idx, name := range names {
+			names[idx] = fmt.Sprintf("%s/%s", account.Name, name)
+		}
+	}
+	return names, nil
 }
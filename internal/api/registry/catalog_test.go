@@ -19,6 +19,7 @@
 package registryv2_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -63,9 +64,90 @@ func TestCatalogEndpoint(t *testing.T) {
 	testNoCatalogOnAnycast(t, s)
 }
 
+func TestCatalogEndpointFiltersByPullPermission(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithAccount(keppel.Account{Name: "test2", AuthTenantID: "otherauthtenant"}),
+		test.WithAccount(keppel.Account{Name: "test3", AuthTenantID: authTenantID}),
+	)
+	h := s.Handler
+	for _, accountName := range []string{"test1", "test2", "test3"} {
+		for _, repoName := range []string{"foo", "bar", "qux"} {
+			err := s.DB.Insert(&keppel.Repository{Name: repoName, AccountName: accountName})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	err := s.DB.Insert(&keppel.RBACPolicy{
+		AccountName:        "test2",
+		RepositoryPattern:  "qux",
+		CanPullAnonymously: true,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the user can pull from all repos in the auth tenant of test1 and test3,
+	//but only from those repos in test2 that allow anonymous pull
+	token := s.GetToken(t, "registry:catalog:*", "repository:test1/foo:pull")
+	expectPages := func(token string, limit int, pages [][]string) {
+		t.Helper()
+		path := fmt.Sprintf("/v2/_catalog?n=%d", limit)
+		for idx, page := range pages {
+			expectedHeaders := map[string]string{test.VersionHeaderKey: test.VersionHeaderValue}
+			if idx < len(pages)-1 {
+				expectedHeaders["Link"] = fmt.Sprintf(`</v2/_catalog?last=%s&n=%d>; rel="next"`,
+					strings.Replace(page[len(page)-1], "/", "%2F", -1), limit,
+				)
+			}
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         path,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: expectedHeaders,
+				ExpectBody:   assert.JSONObject{"repositories": page},
+			}.Check(t, h)
+			path = fmt.Sprintf("/v2/_catalog?n=%d&last=%s", limit, page[len(page)-1])
+		}
+	}
+	expectPages(token, 100, [][]string{{
+		"test1/bar", "test1/foo", "test1/qux",
+		"test2/qux",
+		"test3/bar", "test3/foo", "test3/qux",
+	}})
+	expectPages(token, 3, [][]string{
+		{"test1/bar", "test1/foo", "test1/qux"},
+		{"test2/qux", "test3/bar", "test3/foo"},
+		{"test3/qux"},
+	})
+	expectPages(token, 4, [][]string{
+		{"test1/bar", "test1/foo", "test1/qux", "test2/qux"},
+		{"test3/bar", "test3/foo", "test3/qux"},
+	})
+
+	//anonymous users need to obtain a token explicitly, and then only see the
+	//repos that allow anonymous pull
+	_, respBody := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/auth?service=registry.example.org&scope=registry:catalog:*",
+		Header:       test.AddHeadersForCorrectAuthChallenge(nil),
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	err = json.Unmarshal(respBody, &tokenResp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectPages(tokenResp.Token, 100, [][]string{{"test2/qux"}})
+}
+
 func testEmptyCatalog(t *testing.T, s test.Setup) {
 	//token without any account-level permissions is able to call the endpoint,
-	//but cannot list repos in any account, so the list is empty
+	//but cannot pull from any repo, so the list is empty
 	h := s.Handler
 	token := s.GetToken(t, "registry:catalog:*")
 
@@ -90,11 +172,11 @@ func testEmptyCatalog(t *testing.T, s test.Setup) {
 
 func testNonEmptyCatalog(t *testing.T, s test.Setup) {
 	h := s.Handler
+	//since all accounts are in the same auth tenant, pull access to one repo
+	//means pull access to all repos in all accounts
 	token := s.GetToken(t,
 		"registry:catalog:*",
-		"keppel_account:test1:view",
-		"keppel_account:test2:view",
-		"keppel_account:test3:view",
+		"repository:test1/foo:pull",
 	)
 
 	allRepos := []string{
@@ -183,7 +265,7 @@ func testDomainRemappedCatalog(t *testing.T, s test.Setup) {
 	h := s.Handler
 	token := s.GetDomainRemappedToken(t, "test1",
 		"registry:catalog:*",
-		"keppel_account:test1:view",
+		"repository:foo:pull",
 	)
 
 	//test unpaginated
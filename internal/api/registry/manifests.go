@@ -31,6 +31,7 @@ import (
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/gorilla/mux"
 	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/logg"
@@ -56,6 +57,16 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 	dbManifest, err := a.findManifestInDB(*repo, reference)
 	var manifestBytes []byte
 
+	//if the digest does not belong to a stored manifest, it may belong to a
+	//manifest that we converted on the fly earlier (see below)
+	var translation *keppel.ManifestTranslation
+	if err == sql.ErrNoRows && !reference.IsTag() {
+		translation, err = a.processor().FindManifestTranslation(*repo, reference.Digest)
+		if err == nil {
+			dbManifest, err = a.findManifestInDB(*repo, keppel.ManifestReference{Digest: digest.Digest(translation.SourceDigest)})
+		}
+	}
+
 	if err != sql.ErrNoRows {
 		if respondWithError(w, r, err) {
 			return
@@ -80,7 +91,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			dbManifest, manifestBytes, err = a.processor().ReplicateManifest(*account, *repo, reference, keppel.AuditContext{
+			dbManifest, manifestBytes, err = a.processor().ReplicateManifest(r.Context(), *account, *repo, reference, keppel.AuditContext{
 				UserIdentity: authz.UserIdentity,
 				Request:      r,
 			})
@@ -91,7 +102,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 			keppel.ErrManifestUnknown.With("").WithDetail(reference.Tag).WriteAsRegistryV2ResponseTo(w, r)
 			return
 		}
-	} else {
+	} else if translation == nil {
 		//if manifest was found in our DB, fetch the contents from the DB (or fall
 		//back to the storage if the DB entry is not there for some reason)
 		manifestBytes, err = a.getManifestContentFromDB(repo.ID, dbManifest.Digest)
@@ -107,59 +118,96 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//verify Accept header, if any
-	if r.Header.Get("Accept") != "" {
-		accepted := false
-		acceptableByRecursingIntoDefaultImage := false
-		for _, acceptHeader := range r.Header["Accept"] {
-			for _, acceptField := range strings.Split(acceptHeader, ",") {
-				acceptField = strings.SplitN(acceptField, ";", 2)[0]
-				acceptField = strings.TrimSpace(acceptField)
-				// Accept: */* is used by curl(1)
-				// Accept: application/json is used by go-containerregistry
-				//         (they also send application/vnd.docker.distribution.manifest.v2+json
-				//         with higher prio, but that doesn't help when we have an image list manifest)
-				if acceptField == dbManifest.MediaType || acceptField == "application/json" || acceptField == "*/*" {
-					accepted = true
-				}
-				// Accept: application/vnd.docker.distribution.manifest.v2+json is an ultra-special case (see below)
-				if acceptField == schema2.MediaTypeManifest {
-					if dbManifest.MediaType == manifestlist.MediaTypeManifestList {
-						acceptableByRecursingIntoDefaultImage = true
-					}
-				}
-			}
+	//the response may be a converted manifest instead of the stored one
+	mediaType, digestStr := dbManifest.MediaType, dbManifest.Digest
+	if translation != nil {
+		mediaType, digestStr, manifestBytes = translation.MediaType, translation.TargetDigest, translation.Content
+	}
+
+	//if the client asks for a specific platform, we can save them a roundtrip
+	//by serving the matching submanifest of an image list directly
+	taggedDigest := dbManifest.Digest
+	if platformStr := r.URL.Query().Get("platform"); platformStr != "" && translation == nil {
+		dbManifest, manifestBytes, err = a.resolveManifestForPlatform(*account, *repo, *dbManifest, manifestBytes, platformStr)
+		if respondWithError(w, r, err) {
+			return
 		}
+		mediaType, digestStr = dbManifest.MediaType, dbManifest.Digest
+	}
 
-		if !accepted && acceptableByRecursingIntoDefaultImage {
-			//We have an application/vnd.docker.distribution.manifest.list.v2+json manifest, but the
-			//client only accepts application/vnd.docker.distribution.manifest.v2+json. To stay
-			//compatible with the reference implementation of Docker Hub, we serve this case by recursing
-			//into the image list and returning the linux/amd64 manifest to the client.
-			manifestParsed, _, err := keppel.ParseManifest(dbManifest.MediaType, manifestBytes)
+	//enforce the account's vulnerability policy (HEAD requests do not transfer
+	//the image and are thus allowed; peers are exempt since replica accounts
+	//scan and enforce on their own)
+	if r.Method == http.MethodGet && authz.UserIdentity.UserType() != keppel.PeerUser {
+		policy, err := account.ParseVulnerabilityPolicy()
+		if respondWithError(w, r, err) {
+			return
+		}
+		if policy != nil {
+			err := policy.CheckPull(dbManifest.VulnerabilityStatus)
 			if err != nil {
-				keppel.ErrManifestInvalid.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
+				keppel.ErrDenied.With(err.Error()).WithStatus(http.StatusForbidden).WriteAsRegistryV2ResponseTo(w, r)
 				return
 			}
-			for _, subManifestDesc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
-				if subManifestDesc.Platform.OS == "linux" && subManifestDesc.Platform.Architecture == "amd64" {
-					url := fmt.Sprintf("/v2/%s/manifests/%s", getRepoNameForURLPath(*repo, authz), subManifestDesc.Digest.String())
-					w.Header().Set("Docker-Content-Digest", subManifestDesc.Digest.String())
-					w.Header().Set("Location", url)
-					w.WriteHeader(http.StatusTemporaryRedirect)
-					return
+		}
+	}
+
+	//verify Accept header, if any
+	if r.Header.Get("Accept") != "" {
+		acceptedMediaTypes := parseAcceptHeader(r)
+		// Accept: */* is used by curl(1)
+		// Accept: application/json is used by go-containerregistry
+		//         (they also send application/vnd.docker.distribution.manifest.v2+json
+		//         with higher prio, but that doesn't help when we have an image list manifest)
+		accepted := acceptedMediaTypes[mediaType] || acceptedMediaTypes["application/json"] || acceptedMediaTypes["*/*"]
+
+		if !accepted && (mediaType == manifestlist.MediaTypeManifestList || mediaType == imagespec.MediaTypeImageIndex) {
+			//We have an image list, but the client only accepts single-image
+			//manifests. To stay compatible with the reference implementation of
+			//Docker Hub, we serve this case by recursing into the image list and
+			//redirecting the client to the linux/amd64 manifest, as long as that
+			//one has an acceptable type.
+			subManifestDesc, err := a.findAcceptableSubmanifest(*account, *repo, *dbManifest, manifestBytes, acceptedMediaTypes)
+			if respondWithError(w, r, err) {
+				return
+			}
+			if subManifestDesc != nil {
+				//the client pulls the image list through this redirect, so it counts
+				//as a pull of the image list (the pull of the submanifest will be
+				//counted when the client follows the redirect)
+				if r.Method == http.MethodGet && r.Header.Get("X-Keppel-No-Count-Towards-Last-Pulled") != "1" && !a.cfg.ReadOnly {
+					a.pc.Record(dbManifest.RepositoryID, dbManifest.Digest, a.timeNow())
 				}
+				url := fmt.Sprintf("/v2/%s/manifests/%s", getRepoNameForURLPath(*repo, authz), subManifestDesc.Digest.String())
+				w.Header().Set("Docker-Content-Digest", subManifestDesc.Digest.String())
+				w.Header().Set("Location", url)
+				w.WriteHeader(http.StatusTemporaryRedirect)
+				return
+			}
+		}
+
+		if !accepted && mediaType == schema2.MediaTypeManifest && acceptedMediaTypes[imagespec.MediaTypeImageManifest] {
+			//We have an application/vnd.docker.distribution.manifest.v2+json manifest, but the client
+			//only accepts application/vnd.oci.image.manifest.v1+json. Both formats are equivalent for
+			//image manifests, so we can serve a converted manifest. Since the conversion changes the
+			//digest, the converted manifest is remembered such that it can also be pulled by digest.
+			mt, err := a.processor().ConvertManifestToOCI(*repo, *dbManifest, manifestBytes)
+			if err == nil {
+				mediaType, digestStr, manifestBytes = mt.MediaType, mt.TargetDigest, mt.Content
+				accepted = true
+			} else {
+				logg.Info("cannot convert manifest %s@%s to OCI: %s", repo.FullName(), dbManifest.Digest, err.Error())
 			}
 		}
 
 		if !accepted {
 			if logg.ShowDebug {
 				for _, acceptHeader := range r.Header["Accept"] {
-					logg.Debug("manifest type %s is not covered by Accept: %s", dbManifest.MediaType, acceptHeader)
+					logg.Debug("manifest type %s is not covered by Accept: %s", mediaType, acceptHeader)
 				}
 			}
-			msg := fmt.Sprintf("manifest type %s is not covered by Accept header", dbManifest.MediaType)
-			keppel.ErrManifestUnknown.With(msg).WriteAsRegistryV2ResponseTo(w, r)
+			msg := fmt.Sprintf("manifest type %s is not covered by Accept header", mediaType)
+			keppel.ErrManifestUnknown.With(msg).WithStatus(http.StatusNotAcceptable).WriteAsRegistryV2ResponseTo(w, r)
 			return
 		}
 	}
@@ -168,10 +216,12 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		return strconv.FormatInt(t.Unix(), 10)
 	}
 
-	//write response
+	//write response (NOTE: `digestStr` must always match `manifestBytes` since
+	//clients use the Docker-Content-Digest header to verify what they receive,
+	//so every branch above that replaces the content also replaces the digest)
 	w.Header().Set("Content-Length", strconv.FormatUint(uint64(len(manifestBytes)), 10))
-	w.Header().Set("Content-Type", dbManifest.MediaType)
-	w.Header().Set("Docker-Content-Digest", dbManifest.Digest)
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digestStr)
 	w.Header().Set("X-Keppel-Vulnerability-Status", string(dbManifest.VulnerabilityStatus))
 	if dbManifest.MinLayerCreatedAt != nil {
 		w.Header().Set("X-Keppel-Min-Layer-Created-At", timeToString(*dbManifest.MinLayerCreatedAt))
@@ -189,6 +239,21 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 		api.ManifestsPulledCounter.With(l).Inc()
 
+		//in read-only mode, pulls are not recorded in the DB at all
+		if a.cfg.ReadOnly {
+			return
+		}
+		a.pc.Record(dbManifest.RepositoryID, dbManifest.Digest, a.timeNow())
+
+		//when debouncing is enabled, last_pulled_at is written later on
+		if a.cfg.LastPulledDebounceInterval > 0 {
+			a.lpd.RecordManifestPull(dbManifest.RepositoryID, dbManifest.Digest, a.timeNow())
+			if reference.IsTag() {
+				a.lpd.RecordTagPull(dbManifest.RepositoryID, taggedDigest, reference.Tag, a.timeNow())
+			}
+			return
+		}
+
 		//update manifests.last_pulled_at
 		_, err := a.db.Exec(
 			`UPDATE manifests SET last_pulled_at = $1 WHERE repo_id = $2 AND digest = $3`,
@@ -205,7 +270,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		if reference.IsTag() {
 			_, err := a.db.Exec(
 				`UPDATE tags SET last_pulled_at = $1 WHERE repo_id = $2 AND digest = $3 AND name = $4`,
-				a.timeNow(), dbManifest.RepositoryID, dbManifest.Digest, reference.Tag,
+				a.timeNow(), dbManifest.RepositoryID, taggedDigest, reference.Tag,
 			)
 			if err != nil {
 				logg.Error(
@@ -245,13 +310,138 @@ func (a *API) findManifestInDB(repo keppel.Repository, reference keppel.Manifest
 	return &dbManifest, err
 }
 
+// resolveManifestForPlatform implements the `?platform=` query parameter on
+// GET/HEAD of manifests. If the given manifest is an image list, the
+// submanifest matching the requested platform is returned instead. Other
+// manifests are returned unchanged.
+func (a *API) resolveManifestForPlatform(account keppel.Account, repo keppel.Repository, dbManifest keppel.Manifest, manifestBytes []byte, platformStr string) (*keppel.Manifest, []byte, error) {
+	fields := strings.Split(platformStr, "/")
+	if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+		msg := fmt.Sprintf("malformed platform %q (expected \"os/architecture\" or \"os/architecture/variant\")", platformStr)
+		return nil, nil, keppel.ErrUnsupported.With(msg).WithStatus(http.StatusBadRequest)
+	}
+	platform := manifestlist.PlatformSpec{OS: fields[0], Architecture: fields[1]}
+	if len(fields) == 3 {
+		platform.Variant = fields[2]
+	}
+
+	if dbManifest.MediaType != manifestlist.MediaTypeManifestList && dbManifest.MediaType != imagespec.MediaTypeImageIndex {
+		return &dbManifest, manifestBytes, nil
+	}
+	manifestParsed, _, err := keppel.ParseManifest(dbManifest.MediaType, manifestBytes)
+	if err != nil {
+		return nil, nil, keppel.ErrManifestInvalid.With(err.Error())
+	}
+
+	//only consider submanifests that we actually have
+	isChild, err := a.findChildManifestDigests(repo, dbManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, subManifestDesc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
+		p := subManifestDesc.Platform
+		if p.OS != platform.OS || p.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && p.Variant != platform.Variant {
+			continue
+		}
+		if !isChild[subManifestDesc.Digest.String()] {
+			continue
+		}
+
+		childManifest, err := a.findManifestInDB(repo, keppel.ManifestReference{Digest: subManifestDesc.Digest})
+		if err != nil {
+			return nil, nil, err
+		}
+		childBytes, err := a.getManifestContentFromDB(repo.ID, childManifest.Digest)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				logg.Info("could not read manifest %s@%s from DB (falling back to read from storage): %s",
+					repo.FullName(), childManifest.Digest, err.Error())
+			}
+			childBytes, err = a.sd.ReadManifest(account, repo.Name, childManifest.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return childManifest, childBytes, nil
+	}
+
+	msg := fmt.Sprintf("image list %s does not contain a manifest for platform %s", dbManifest.Digest, platformStr)
+	return nil, nil, keppel.ErrManifestUnknown.With(msg)
+}
+
+// Returns the set of media types listed in the request's Accept header(s).
+func parseAcceptHeader(r *http.Request) map[string]bool {
+	result := make(map[string]bool)
+	for _, acceptHeader := range r.Header["Accept"] {
+		for _, acceptField := range strings.Split(acceptHeader, ",") {
+			acceptField = strings.SplitN(acceptField, ";", 2)[0]
+			result[strings.TrimSpace(acceptField)] = true
+		}
+	}
+	return result
+}
+
+// Selects the submanifest that a client shall be redirected to when it pulls
+// the given image list, but does not accept image lists. Returns nil if no
+// submanifest is acceptable to the client.
+func (a *API) findAcceptableSubmanifest(account keppel.Account, repo keppel.Repository, dbManifest keppel.Manifest, manifestBytes []byte, acceptedMediaTypes map[string]bool) (*manifestlist.ManifestDescriptor, error) {
+	manifestParsed, _, err := keppel.ParseManifest(dbManifest.MediaType, manifestBytes)
+	if err != nil {
+		return nil, keppel.ErrManifestInvalid.With(err.Error())
+	}
+	isChild, err := a.findChildManifestDigests(repo, dbManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subManifestDesc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
+		if subManifestDesc.Platform.OS != "linux" || subManifestDesc.Platform.Architecture != "amd64" {
+			continue
+		}
+		if !isChild[subManifestDesc.Digest.String()] {
+			continue
+		}
+		//Docker manifests can be served to clients that only accept OCI manifests by conversion (see above)
+		if acceptedMediaTypes[subManifestDesc.MediaType] || (subManifestDesc.MediaType == schema2.MediaTypeManifest && acceptedMediaTypes[imagespec.MediaTypeImageManifest]) {
+			return &subManifestDesc, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the digests of all submanifests of the given image list that we
+// actually have (this can differ from the list contents for replica accounts
+// with a platform filter).
+func (a *API) findChildManifestDigests(repo keppel.Repository, dbManifest keppel.Manifest) (map[string]bool, error) {
+	var childDigests []string
+	_, err := a.db.Select(&childDigests,
+		`SELECT child_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND parent_digest = $2`,
+		repo.ID, dbManifest.Digest,
+	)
+	if err != nil {
+		return nil, err
+	}
+	isChild := make(map[string]bool, len(childDigests))
+	for _, childDigest := range childDigests {
+		isChild[childDigest] = true
+	}
+	return isChild, nil
+}
+
 func (a *API) getManifestContentFromDB(repoID int64, digestStr string) ([]byte, error) {
 	var result []byte
 	err := a.db.SelectOne(&result,
 		`SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`,
 		repoID, digestStr,
 	)
-	return result, err
+	if err != nil {
+		return nil, err
+	}
+	return keppel.DecodeManifestContent(result)
 }
 
 func (a *API) handleGetOrHeadManifestAnycast(w http.ResponseWriter, r *http.Request, info anycastRequestInfo) {
@@ -321,13 +511,13 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//forbid pushing during maintenance
-	if account.InMaintenance {
-		keppel.ErrUnsupported.With("account is in maintenance").WithStatus(http.StatusMethodNotAllowed).WriteAsRegistryV2ResponseTo(w, r)
+	if !checkNotInMaintenance(w, r, *account) {
 		return
 	}
 
-	//read manifest from request
-	manifestBytes, err := io.ReadAll(r.Body)
+	//read manifest from request (if the manifest exceeds the size limit, reading
+	//one byte beyond the limit is enough for the processor to reject it)
+	manifestBytes, err := io.ReadAll(io.LimitReader(r.Body, int64(account.EffectiveMaxManifestSizeBytes())+1))
 	if respondWithError(w, r, err) {
 		return
 	}
@@ -354,5 +544,9 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Docker-Content-Digest", manifest.Digest)
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", getRepoNameForURLPath(*repo, authz), manifest.Digest))
+	if manifest.SubjectDigest != "" {
+		//tells the client that we support the referrers API, so it does not need to maintain a referrers tag
+		w.Header().Set("OCI-Subject", manifest.SubjectDigest)
+	}
 	w.WriteHeader(http.StatusCreated)
 }
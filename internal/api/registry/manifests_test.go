@@ -20,13 +20,17 @@ package registryv2_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
@@ -106,9 +110,9 @@ func TestImageManifestLifecycle(t *testing.T) {
 						"Content-Type":  image.Manifest.MediaType,
 					},
 					Body:         assert.ByteData(image.Manifest.Contents),
-					ExpectStatus: http.StatusMethodNotAllowed,
+					ExpectStatus: http.StatusServiceUnavailable,
 					ExpectBody: test.ErrorCodeWithMessage{
-						Code:    keppel.ErrUnsupported,
+						Code:    keppel.ErrUnavailable,
 						Message: "account is in maintenance",
 					},
 				}.Check(t, h)
@@ -486,6 +490,33 @@ func TestImageListManifestLifecycle(t *testing.T) {
 		expectManifestExists(t, h, token, "test1/foo", list2.Manifest, "list", map[string]string{
 			"Accept": "application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.list.v2+json",
 		})
+		//clients that only accept OCI image manifests are redirected as well,
+		//since the linux/amd64 manifest can be converted for them
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/list",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        imagespec.MediaTypeImageManifest,
+			},
+			ExpectStatus: http.StatusTemporaryRedirect,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Location":            "/v2/test1/foo/manifests/" + image1.Manifest.Digest.String(),
+			},
+		}.Check(t, h)
+		//clients that accept neither the list nor any of its manifests get 406
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/list",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			},
+			ExpectStatus: http.StatusNotAcceptable,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+		}.Check(t, h)
 
 		//DELETE success case
 		assert.HTTPRequest{
@@ -500,6 +531,86 @@ func TestImageListManifestLifecycle(t *testing.T) {
 	})
 }
 
+func TestImageListManifestPlatformSelection(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		//upload an image list with linux/amd64 and linux/arm
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "")
+		image2.MustUpload(t, s, fooRepoRef, "")
+		list := test.GenerateImageList(image1, image2)
+		list.MustUpload(t, s, fooRepoRef, "list")
+
+		//when a platform is requested, the matching submanifest is served directly
+		//(both by tag and by digest of the list)
+		for _, ref := range []string{"list", list.Manifest.Digest.String()} {
+			expectManifestExists(t, h, token, "test1/foo", image1.Manifest, ref+"?platform=linux/amd64", nil)
+			expectManifestExists(t, h, token, "test1/foo", image2.Manifest, ref+"?platform=linux/arm", nil)
+		}
+
+		//requesting a platform on a single-arch image is a no-op
+		expectManifestExists(t, h, token, "test1/foo", image1.Manifest, image1.Manifest.Digest.String()+"?platform=linux/arm", nil)
+
+		//no matching submanifest
+		for _, platform := range []string{"linux/arm64", "windows/amd64", "linux/arm/v7"} {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/list?platform=" + platform,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusNotFound,
+				ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+			}.Check(t, h)
+		}
+
+		//malformed platform
+		for _, platform := range []string{"linux", "linux/", "linux/arm/v7/extra"} {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/list?platform=" + platform,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusBadRequest,
+				ExpectBody:   test.ErrorCode(keppel.ErrUnsupported),
+			}.Check(t, h)
+		}
+	})
+}
+
+func TestPullAndPushDuringMaintenance(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		otherImage := test.GenerateImage(test.GenerateExampleLayer(2))
+
+		testWithAccountInMaintenance(t, s.DB, "test1", func() {
+			//pulls continue to work
+			expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+			expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+
+			//pushes are rejected
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/other",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  otherImage.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(otherImage.Manifest.Contents),
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectBody: test.ErrorCodeWithMessage{
+					Code:    keppel.ErrUnavailable,
+					Message: "account is in maintenance",
+				},
+			}.Check(t, h)
+		})
+	})
+}
+
 func TestManifestQuotaExceeded(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		h := s.Handler
@@ -617,9 +728,40 @@ func TestManifestRequiredLabels(t *testing.T) {
 		}, image.Layers[0])
 		otherImage.MustUpload(t, s, fooRepoRef, "other")
 
-		//required_labels does not apply to image lists (since image list manifests
-		//do not have labels at all), so we can upload this list manifest without
-		//any additional considerations
+		//image list manifests do not have labels of their own, so required_labels
+		//is checked on their constituent manifests instead; to test the failure
+		//case, we need a child manifest that was pushed before the required
+		//labels were configured
+		_, err = s.DB.Exec(`UPDATE accounts SET required_labels = '' WHERE name = $1`, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		unlabeledImage := test.GenerateImage(image.Layers[0])
+		unlabeledImage.MustUpload(t, s, fooRepoRef, "unlabeled")
+		_, err = s.DB.Exec(`UPDATE accounts SET required_labels = $1 WHERE name = $2`, "foo,bar", "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		badList := test.GenerateImageList(image, unlabeledImage)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/badlist",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  manifestlist.MediaTypeManifestList,
+			},
+			Body:         assert.ByteData(badList.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: "missing required labels on manifest " + unlabeledImage.Manifest.Digest.String() + ": foo, bar",
+			},
+		}.Check(t, h)
+
+		//when all constituent manifests have the required labels, the list
+		//manifest can be pushed
 		list := test.GenerateImageList(image, otherImage)
 		assert.HTTPRequest{
 			Method: "PUT",
@@ -700,3 +842,771 @@ func TestImageManifestCmdEntrypointAsString(t *testing.T) {
 		}
 	})
 }
+
+func TestImageManifestConversionToOCI(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		deleteToken := s.GetToken(t, "repository:test1/foo:delete")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s.Clock.Step()
+		image.MustUpload(t, s, fooRepoRef, "latest")
+
+		convertedBytes, convertedDesc, err := keppel.ConvertManifestToOCI(image.Manifest.MediaType, image.Manifest.Contents)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if convertedDesc.Digest == image.Manifest.Digest {
+			t.Fatal("expected converted manifest to have a different digest than the original")
+		}
+
+		//clients that only accept OCI manifests get a converted manifest (both by tag and by digest of the original)...
+		for _, ref := range []string{"latest", image.Manifest.Digest.String()} {
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/manifests/" + ref,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Accept":        imagespec.MediaTypeImageManifest,
+				},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: map[string]string{
+					test.VersionHeaderKey:   test.VersionHeaderValue,
+					"Content-Type":          imagespec.MediaTypeImageManifest,
+					"Docker-Content-Digest": convertedDesc.Digest.String(),
+				},
+				ExpectBody: assert.ByteData(convertedBytes),
+			}.Check(t, h)
+		}
+
+		//...which is computed only once...
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifest_translations`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if count != 1 {
+			t.Errorf("expected 1 manifest translation, but got %d", count)
+		}
+
+		//...and can then also be pulled by its own digest
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/" + convertedDesc.Digest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        imagespec.MediaTypeImageManifest,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Content-Type":          imagespec.MediaTypeImageManifest,
+				"Docker-Content-Digest": convertedDesc.Digest.String(),
+			},
+			ExpectBody: assert.ByteData(convertedBytes),
+		}.Check(t, h)
+
+		//clients that accept Docker manifests still get the original manifest
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", map[string]string{
+			"Accept": schema2.MediaTypeManifest + ", " + imagespec.MediaTypeImageManifest,
+		})
+
+		//when the original manifest is deleted, the converted manifest goes away as well
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + deleteToken},
+			ExpectStatus: http.StatusAccepted,
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + convertedDesc.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+		}.Check(t, h)
+	})
+}
+
+func TestImmutableTags(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		_, err := s.DB.Exec(`UPDATE accounts SET immutable_tag_pattern = $1 WHERE name = $2`, `v[0-9.]+`, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		s.Clock.Step()
+		image1.MustUpload(t, s, fooRepoRef, "v1.0")
+		image1.MustUpload(t, s, fooRepoRef, "latest")
+		s.Clock.Step()
+		image2.MustUpload(t, s, fooRepoRef, "")
+
+		pushManifest := func(image test.Image, tagName string, expectStatus int, expectBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tagName,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: expectStatus,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectBody,
+			}.Check(t, h)
+		}
+
+		//moving an immutable tag to a different manifest is rejected
+		pushManifest(image2, "v1.0", http.StatusConflict, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrDenied,
+			Message: fmt.Sprintf("tag \"v1.0\" is immutable and already points to manifest %s", image1.Manifest.Digest),
+		})
+		expectManifestExists(t, h, token, "test1/foo", image1.Manifest, "v1.0", nil)
+
+		//re-pushing the same manifest to an immutable tag is fine
+		pushManifest(image1, "v1.0", http.StatusCreated, nil)
+		expectManifestExists(t, h, token, "test1/foo", image1.Manifest, "v1.0", nil)
+
+		//tags that do not match the pattern can be moved as usual
+		pushManifest(image2, "latest", http.StatusCreated, nil)
+		expectManifestExists(t, h, token, "test1/foo", image2.Manifest, "latest", nil)
+
+		//new tags matching the pattern can be created as usual
+		pushManifest(image2, "v2.0", http.StatusCreated, nil)
+		expectManifestExists(t, h, token, "test1/foo", image2.Manifest, "v2.0", nil)
+	})
+}
+
+func TestManifestSizeLimit(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		for _, blob := range []test.Bytes{image1.Config, image1.Layers[0], image2.Config, image2.Layers[0]} {
+			blob.MustUpload(t, s, fooRepoRef)
+		}
+
+		setLimit := func(limit int) {
+			t.Helper()
+			_, err := s.DB.Exec(`UPDATE accounts SET max_manifest_size_bytes = $1 WHERE name = $2`, limit, "test1")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		//a manifest that is just under the limit can be pushed...
+		setLimit(len(image1.Manifest.Contents))
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/first",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image1.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image1.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		//...but a manifest that is just over the limit is rejected
+		setLimit(len(image2.Manifest.Contents) - 1)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/second",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image2.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image2.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code: keppel.ErrManifestInvalid,
+				Message: fmt.Sprintf("manifest is too large: got %d bytes, but this account only allows up to %d bytes",
+					len(image2.Manifest.Contents), len(image2.Manifest.Contents)-1),
+			},
+		}.Check(t, h)
+
+		//nothing was stored for the rejected manifest
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, image2.Manifest.Digest.String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if count != 0 {
+			t.Errorf("expected rejected manifest to not be stored, but found %d DB entries", count)
+		}
+	})
+}
+
+func TestManifestLimitPerAccount(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		//as a setup, upload two images and the blobs for a third one
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image3 := test.GenerateImage(test.GenerateExampleLayer(3))
+		image1.MustUpload(t, s, fooRepoRef, "first")
+		image2.MustUpload(t, s, fooRepoRef, "second")
+		for _, blob := range []test.Bytes{image3.Config, image3.Layers[0]} {
+			blob.MustUpload(t, s, fooRepoRef)
+		}
+
+		setLimits := func(tenantQuota, accountLimit int) {
+			t.Helper()
+			_, err := s.DB.Exec(`UPDATE quotas SET manifests = $1`, tenantQuota)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			_, err = s.DB.Exec(`UPDATE accounts SET manifest_limit = $1 WHERE name = $2`, accountLimit, "test1")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expectPushDenied := func(message string) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/third",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image3.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image3.Manifest.Contents),
+				ExpectStatus: http.StatusConflict,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCodeWithMessage{Code: keppel.ErrDenied, Message: message},
+			}.Check(t, h)
+		}
+
+		//without an account limit, only the tenant quota applies
+		setLimits(2, 0)
+		expectPushDenied("manifest quota exceeded (quota = 2, usage = 2)")
+
+		//when the account limit is lower than the tenant quota, it is binding
+		setLimits(10, 2)
+		expectPushDenied("manifest limit for account exceeded (limit = 2, usage = 2)")
+
+		//when the tenant quota is lower than the account limit, it is binding
+		setLimits(2, 10)
+		expectPushDenied("manifest quota exceeded (quota = 2, usage = 2)")
+
+		//the account limit also stops new blob uploads
+		setLimits(10, 2)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/v2/test1/foo/blobs/uploads/",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrDenied,
+				Message: "manifest limit for account exceeded (limit = 2, usage = 2)",
+			},
+		}.Check(t, h)
+
+		//when both limits allow it, the push goes through
+		setLimits(10, 3)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/third",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image3.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image3.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+		expectManifestExists(t, h, token, "test1/foo", image3.Manifest, "third", nil)
+	})
+}
+
+func TestVulnerabilityPolicy(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+
+		setPolicy := func(policyJSON string) {
+			t.Helper()
+			_, err := s.DB.Exec(`UPDATE accounts SET vuln_policy_json = $1 WHERE name = $2`, policyJSON, "test1")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		setVulnStatus := func(status clair.VulnerabilityStatus) {
+			t.Helper()
+			_, err := s.DB.Exec(`UPDATE manifests SET vuln_status = $1 WHERE digest = $2`, status, image.Manifest.Digest.String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expectPullAllowed := func(status clair.VulnerabilityStatus) {
+			t.Helper()
+			expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", map[string]string{
+				"X-Keppel-Vulnerability-Status": string(status),
+			})
+		}
+		expectPullDenied := func(message string) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/latest",
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusForbidden,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCodeWithMessage{Code: keppel.ErrDenied, Message: message},
+			}.Check(t, h)
+			//HEAD is still allowed since it does not transfer the image
+			assert.HTTPRequest{
+				Method:       "HEAD",
+				Path:         "/v2/test1/foo/manifests/latest",
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: test.VersionHeader,
+			}.Check(t, h)
+		}
+
+		//without a policy, everything can be pulled
+		setVulnStatus(clair.CriticalSeverity)
+		expectPullAllowed(clair.CriticalSeverity)
+
+		//with a threshold of "Critical", Critical images are denied...
+		setPolicy(`{"block_pulls_at_severity":"Critical"}`)
+		expectPullDenied("image has vulnerability status Critical, and this account does not allow pulling images with vulnerabilities of severity Critical or higher")
+		setVulnStatus(clair.Defcon1Severity)
+		expectPullDenied("image has vulnerability status Defcon1, and this account does not allow pulling images with vulnerabilities of severity Critical or higher")
+
+		//...but less severe images are allowed
+		setVulnStatus(clair.MediumSeverity)
+		expectPullAllowed(clair.MediumSeverity)
+
+		//images that have not been scanned yet are allowed unless the policy says otherwise
+		setVulnStatus(clair.PendingVulnerabilityStatus)
+		expectPullAllowed(clair.PendingVulnerabilityStatus)
+		setPolicy(`{"block_pulls_at_severity":"Critical","block_pulls_while_pending":true}`)
+		expectPullDenied("image has vulnerability status Pending, and this account does not allow pulling images before their vulnerability scan has finished")
+		setVulnStatus(clair.CleanSeverity)
+		expectPullAllowed(clair.CleanSeverity)
+	})
+}
+
+func TestCustomManifestMediaTypes(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		//build a manifest with a nonstandard media type that references a blob
+		const customMediaType = "application/vnd.example.artifact.manifest.v1+json"
+		layer := test.GenerateExampleLayer(1)
+		layer.MustUpload(t, s, fooRepoRef)
+		buildManifest := func(mediaType string, layer test.Bytes) test.Bytes {
+			buf, err := json.Marshal(map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     mediaType,
+				"layers": []map[string]interface{}{{
+					"mediaType": layer.MediaType,
+					"digest":    layer.Digest.String(),
+					"size":      len(layer.Contents),
+				}},
+			})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			return test.Bytes{Contents: buf, Digest: digest.FromBytes(buf), MediaType: mediaType}
+		}
+		manifest := buildManifest(customMediaType, layer)
+		pushManifest := func(m test.Bytes, tag string) assert.HTTPRequest {
+			return assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tag,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  m.MediaType,
+				},
+				Body:         assert.ByteData(m.Contents),
+				ExpectHeader: test.VersionHeader,
+			}
+		}
+
+		//without the media type being allowed for the account, the push is rejected...
+		req := pushManifest(manifest, "custom")
+		req.ExpectStatus = http.StatusBadRequest
+		req.ExpectBody = test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "unsupported manifest media type: " + customMediaType,
+		}
+		req.Check(t, h)
+
+		//...but once it is allowed, the push succeeds
+		_, err := s.DB.Exec(`UPDATE accounts SET custom_manifest_media_types = $1 WHERE name = $2`,
+			"application/vnd.example.other+json,"+customMediaType, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req = pushManifest(manifest, "custom")
+		req.ExpectStatus = http.StatusCreated
+		req.Check(t, h)
+
+		//the manifest is stored with the declared media type, and the referenced blob is recorded
+		mediaType, err := s.DB.SelectStr(`SELECT media_type FROM manifests WHERE digest = $1`, manifest.Digest.String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if mediaType != customMediaType {
+			t.Errorf("expected manifest to be stored with media type %q, but got %q", customMediaType, mediaType)
+		}
+		blobRefCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifest_blob_refs WHERE digest = $1`, manifest.Digest.String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if blobRefCount != 1 {
+			t.Errorf("expected 1 manifest-blob ref, but got %d", blobRefCount)
+		}
+
+		//the manifest can be pulled again
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/custom",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        customMediaType,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Content-Type":          customMediaType,
+				"Docker-Content-Digest": manifest.Digest.String(),
+			},
+			ExpectBody: assert.ByteData(manifest.Contents),
+		}.Check(t, h)
+
+		//referenced blobs must still exist
+		missingLayer := test.GenerateExampleLayer(2)
+		req = pushManifest(buildManifest(customMediaType, missingLayer), "broken")
+		req.ExpectStatus = http.StatusBadRequest
+		req.ExpectBody = test.ErrorCode(keppel.ErrManifestBlobUnknown)
+		req.Check(t, h)
+
+		//media types that are not allowed are still rejected
+		const otherMediaType = "application/vnd.example.unknown.manifest.v1+json"
+		req = pushManifest(buildManifest(otherMediaType, layer), "other")
+		req.ExpectStatus = http.StatusBadRequest
+		req.ExpectBody = test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "unsupported manifest media type: " + otherMediaType,
+		}
+		req.Check(t, h)
+	})
+}
+
+func TestManifestDigestHeaderMatchesBody(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "latest")
+		image2.MustUpload(t, s, fooRepoRef, "")
+		list := test.GenerateImageList(image1, image2)
+		list.MustUpload(t, s, fooRepoRef, "list")
+		_, convertedDesc, err := keppel.ConvertManifestToOCI(image1.Manifest.MediaType, image1.Manifest.Contents)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		testCases := []struct {
+			Reference string
+			Accept    string
+		}{
+			//tag pulls and digest pulls
+			{"latest", ""},
+			{image1.Manifest.Digest.String(), ""},
+			{"list", ""},
+			{list.Manifest.Digest.String(), ""},
+			//content-type conversion (first on the fly, then by the digest of the converted manifest)
+			{"latest", imagespec.MediaTypeImageManifest},
+			{image1.Manifest.Digest.String(), imagespec.MediaTypeImageManifest},
+			{convertedDesc.Digest.String(), imagespec.MediaTypeImageManifest},
+			//platform selection
+			{"list?platform=linux/arm", ""},
+			{list.Manifest.Digest.String() + "?platform=linux/amd64", ""},
+		}
+
+		for _, tc := range testCases {
+			headers := make(map[string]string)
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req := httptest.NewRequest(method, "/v2/test1/foo/manifests/"+tc.Reference, http.NoBody)
+				req.Header.Set("Authorization", "Bearer "+token)
+				if tc.Accept != "" {
+					req.Header.Set("Accept", tc.Accept)
+				}
+				resp := httptest.NewRecorder()
+				h.ServeHTTP(resp, req)
+				if resp.Code != http.StatusOK {
+					t.Errorf("%s %s: expected status 200, but got %d", method, tc.Reference, resp.Code)
+					continue
+				}
+				headers[method] = resp.Header().Get("Docker-Content-Digest")
+
+				//for GET, the header must be the digest of the actually served content
+				if method == http.MethodGet {
+					actualDigest := digest.FromBytes(resp.Body.Bytes()).String()
+					if headers[method] != actualDigest {
+						t.Errorf("GET %s (Accept: %q): expected Docker-Content-Digest %q, but got %q",
+							tc.Reference, tc.Accept, actualDigest, headers[method])
+					}
+				}
+			}
+
+			//HEAD must report the same digest as GET
+			if headers[http.MethodGet] != headers[http.MethodHead] {
+				t.Errorf("%s (Accept: %q): expected Docker-Content-Digest %q on HEAD, but got %q",
+					tc.Reference, tc.Accept, headers[http.MethodGet], headers[http.MethodHead])
+			}
+		}
+	})
+}
+
+func TestForbiddenRepoNames(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+			test.WithRepo(keppel.Repository{AccountName: "test1", Name: "internal/existing"}),
+			test.WithQuotas,
+			test.WithForbiddenRepoNamePatterns(`internal/.*`, `tmp`),
+		)
+		h := s.Handler
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+
+		//pushing into a new repo with a forbidden name is rejected before the repo is created
+		forbiddenNames := map[string]string{
+			"internal/foo": `^(?:internal/.*)$`,
+			"tmp":          `^(?:tmp)$`,
+		}
+		for repoName, pattern := range forbiddenNames {
+			token := s.GetToken(t, fmt.Sprintf("repository:test1/%s:pull,push", repoName))
+			assert.HTTPRequest{
+				Method: "POST",
+				Path:   fmt.Sprintf("/v2/test1/%s/blobs/uploads/", repoName),
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+				},
+				ExpectStatus: http.StatusBadRequest,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody: test.ErrorCodeWithMessage{
+					Code:    keppel.ErrNameInvalid,
+					Message: fmt.Sprintf("cannot create repository %q: name matches forbidden pattern %s", repoName, pattern),
+				},
+			}.Check(t, h)
+		}
+
+		//names that only partially match a pattern are not affected, and new repos
+		//are created as usual
+		image.MustUpload(t, s, keppel.Repository{AccountName: "test1", Name: "tmp/foo"}, "latest")
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		//existing repos with forbidden names can still be pushed into
+		image.MustUpload(t, s, keppel.Repository{AccountName: "test1", Name: "internal/existing"}, "latest")
+
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM repos WHERE account_name = $1`, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		//(i.e. test1/foo, test1/tmp/foo and test1/internal/existing, but not the forbidden ones)
+		if count != 3 {
+			t.Errorf("expected 3 repos to exist, but got %d", count)
+		}
+	})
+}
+
+func TestLastPulledDebounce(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithLastPulledDebounceInterval(1*time.Minute),
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+	token := s.GetToken(t, "repository:test1/foo:pull")
+	pullManifest := func(ref string, extraHeaders map[string]string) {
+		t.Helper()
+		hdr := map[string]string{"Authorization": "Bearer " + token}
+		for k, v := range extraHeaders {
+			hdr[k] = v
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + ref,
+			Header:       hdr,
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s.Handler)
+	}
+
+	//rapid pulls do not write into the DB immediately...
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	s.Clock.StepBy(1 * time.Hour)
+	pullManifest("latest", nil)
+	s.Clock.StepBy(1 * time.Second)
+	pullManifest(image.Manifest.Digest.String(), nil)
+	s.Clock.StepBy(1 * time.Second)
+	pullManifest("latest", nil)
+	tr.DBChanges().AssertEmpty()
+
+	//...but are coalesced into one update per manifest and tag on the next flush
+	err := s.LPD.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET last_pulled_at = %[2]d WHERE repo_id = 1 AND digest = '%[1]s';
+			UPDATE tags SET last_pulled_at = %[2]d WHERE repo_id = 1 AND name = 'latest';
+		`,
+		image.Manifest.Digest, s.Clock.Now().Unix(),
+	)
+
+	//pulls that do not count towards last_pulled_at are not recorded at all
+	s.Clock.StepBy(1 * time.Minute)
+	pullManifest("latest", map[string]string{"X-Keppel-No-Count-Towards-Last-Pulled": "1"})
+	err = s.LPD.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.DBChanges().AssertEmpty()
+
+	//a pull by digest only updates the manifest, not the tag
+	pullManifest(image.Manifest.Digest.String(), nil)
+	err = s.LPD.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET last_pulled_at = %[2]d WHERE repo_id = 1 AND digest = '%[1]s';
+		`,
+		image.Manifest.Digest, s.Clock.Now().Unix(),
+	)
+}
+
+func TestManifestContentCompression(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithManifestContentCompression,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	token := s.GetToken(t, "repository:test1/foo:pull")
+
+	//when pushing with compression enabled, the manifest is stored in compressed form...
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+	content, err := s.DB.SelectStr(`SELECT content FROM manifest_contents WHERE digest = $1`, image.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(content, "\x1f\x8b") {
+		t.Errorf("expected manifest content to be gzip-compressed, but got %q", content)
+	}
+
+	//...and can be read back (we remove the manifest from the storage to ensure
+	//that the contents are served from the DB)
+	err = s.SD.DeleteManifest(*s.Accounts[0], "foo", image.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+
+	//legacy rows with uncompressed contents can still be read
+	otherImage := test.GenerateImage(test.GenerateExampleLayer(2))
+	otherImage.MustUpload(t, s, fooRepoRef, "other")
+	_, err = s.DB.Exec(`UPDATE manifest_contents SET content = $1 WHERE digest = $2`,
+		otherImage.Manifest.Contents, otherImage.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.SD.DeleteManifest(*s.Accounts[0], "foo", otherImage.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectManifestExists(t, h, token, "test1/foo", otherImage.Manifest, "other", nil)
+}
+
+func TestManifestBodySizeLimit(t *testing.T) {
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	limit := len(image.Manifest.Contents)
+
+	s := test.NewSetup(t,
+		test.WithMaxManifestBodySize(uint64(limit)),
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+	for _, blob := range []test.Bytes{image.Config, image.Layers[0]} {
+		blob.MustUpload(t, s, fooRepoRef)
+	}
+
+	//a manifest that fits within the limit can be pushed...
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/first",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  image.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(image.Manifest.Contents),
+		ExpectStatus: http.StatusCreated,
+		ExpectHeader: test.VersionHeader,
+	}.Check(t, h)
+
+	//...but a larger request body is rejected (padding the manifest with
+	//whitespace keeps it valid, so the 413 can only come from the body limit)
+	oversizedContents := append(append([]byte(nil), image.Manifest.Contents...), '\n')
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/second",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  image.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(oversizedContents),
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody: test.ErrorCodeWithMessage{
+			Code:    keppel.ErrSizeInvalid,
+			Message: fmt.Sprintf("request body exceeds the maximum size of %d bytes", limit),
+		},
+	}.Check(t, h)
+
+	//the same applies when the client does not announce the body size upfront
+	req := httptest.NewRequest(http.MethodPut, "/v2/test1/foo/manifests/second", strings.NewReader(string(oversizedContents)))
+	req.ContentLength = -1
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", image.Manifest.MediaType)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for oversized chunked manifest push, but got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	//nothing was stored for the rejected pushes
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM tags WHERE name = $1`, "second")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 0 {
+		t.Errorf("expected rejected manifest to not be tagged, but found %d DB entries", count)
+	}
+}
@@ -19,6 +19,7 @@
 package registryv2_test
 
 import (
+	"math"
 	"net/http"
 	"strconv"
 	"testing"
@@ -104,8 +105,15 @@ func TestRateLimits(t *testing.T) {
 			s.Clock.StepBy(time.Hour)
 
 			//we can always execute 1 request initially, and then we can burst on top
-			//of that
+			//of that (each request consumes 30 seconds of the burst budget, minus the
+			//one second that we wait in between)
 			for i := 0; i < limit.Burst; i++ {
+				req.ExpectHeader = map[string]string{
+					test.VersionHeaderKey: test.VersionHeaderValue,
+					"RateLimit-Limit":     strconv.Itoa(limit.Burst),
+					"RateLimit-Remaining": strconv.Itoa(limit.Burst - 1 - i),
+					"RateLimit-Reset":     strconv.Itoa(30 + 29*i),
+				}
 				req.Check(t, h)
 				s.Clock.StepBy(time.Second)
 			}
@@ -117,26 +125,71 @@ func TestRateLimits(t *testing.T) {
 			failingReq.ExpectHeader = map[string]string{
 				test.VersionHeaderKey: test.VersionHeaderValue,
 				"Retry-After":         strconv.Itoa(30 - limit.Burst),
+				"RateLimit-Limit":     strconv.Itoa(limit.Burst),
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     strconv.Itoa(90 - limit.Burst),
 			}
 			failingReq.Check(t, h)
 
 			//be impatient
 			s.Clock.StepBy(time.Duration(29-limit.Burst) * time.Second)
 			failingReq.ExpectHeader["Retry-After"] = "1"
+			failingReq.ExpectHeader["RateLimit-Reset"] = "61"
 			failingReq.Check(t, h)
 
-			//finally!
+			//finally! (but this is the last request that the burst budget allows)
 			s.Clock.StepBy(time.Second)
+			req.ExpectHeader["RateLimit-Remaining"] = "0"
+			req.ExpectHeader["RateLimit-Reset"] = "90"
 			req.Check(t, h)
 
 			//aaaand... we're rate-limited again immediately because we haven't
 			//recovered our burst budget yet
 			failingReq.ExpectHeader["Retry-After"] = "30"
+			failingReq.ExpectHeader["RateLimit-Reset"] = "90"
 			failingReq.Check(t, h)
 		}
 	})
 }
 
+func TestRateLimitHeadersWithoutLimit(t *testing.T) {
+	rld := basic.RateLimitDriver{
+		Limits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			//no limits at all
+		},
+	}
+	rle := &keppel.RateLimitEngine{Driver: rld, Client: nil}
+
+	testWithPrimary(t, rle, func(s test.Setup) {
+		sr := miniredis.RunT(t)
+		sr.SetTime(s.Clock.Now())
+		s.Clock.MiniRedis = sr
+		rle.Client = redis.NewClient(&redis.Options{Addr: sr.Addr()})
+
+		_, err := keppel.FindOrCreateRepository(s.DB, "foo", keppel.Account{Name: "test1"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//even when no rate limit applies, the headers shall be reported
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		unlimited := strconv.FormatInt(math.MaxInt64, 10)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/blobs/sha256:" + sha256Of([]byte("something else")),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"RateLimit-Limit":     unlimited,
+				"RateLimit-Remaining": unlimited,
+				"RateLimit-Reset":     "0",
+			},
+			ExpectBody: test.ErrorCode(keppel.ErrBlobUnknown),
+		}.Check(t, s.Handler)
+	})
+}
+
 func TestAnycastRateLimits(t *testing.T) {
 	blob := test.NewBytes([]byte("the blob for our test case"))
 
@@ -196,6 +249,9 @@ func TestAnycastRateLimits(t *testing.T) {
 					ExpectHeader: map[string]string{
 						test.VersionHeaderKey: test.VersionHeaderValue,
 						"Retry-After":         "30",
+						"RateLimit-Limit":     strconv.Itoa(limit.Burst),
+						"RateLimit-Remaining": "0",
+						"RateLimit-Reset":     "60",
 					},
 				}.Check(t, h2)
 
@@ -205,3 +261,60 @@ func TestAnycastRateLimits(t *testing.T) {
 		})
 	})
 }
+
+func TestRateLimitsPerSourceIP(t *testing.T) {
+	rld := basic.RateLimitDriver{
+		Limits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.ManifestPullAction: {Rate: 2, Period: time.Minute, Burst: 10},
+		},
+		PerSourceIPLimits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.ManifestPullAction: {Rate: 2, Period: time.Minute, Burst: 2},
+		},
+	}
+	rle := &keppel.RateLimitEngine{Driver: rld, Client: nil}
+
+	testWithPrimary(t, rle, func(s test.Setup) {
+		sr := miniredis.RunT(t)
+		sr.SetTime(s.Clock.Now())
+		s.Clock.MiniRedis = sr
+		rle.Client = redis.NewClient(&redis.Options{Addr: sr.Addr()})
+
+		_, err := keppel.FindOrCreateRepository(s.DB, "foo", keppel.Account{Name: "test1"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		bogusDigest := "sha256:" + sha256Of([]byte("something else"))
+
+		expectManifestPull := func(sourceIP string, expectAllowed bool) {
+			t.Helper()
+			req := assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/manifests/" + bogusDigest,
+				Header: map[string]string{
+					"Authorization":   "Bearer " + token,
+					"X-Forwarded-For": sourceIP,
+				},
+				ExpectStatus: http.StatusNotFound,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+			}
+			if !expectAllowed {
+				req.ExpectStatus = http.StatusTooManyRequests
+				req.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+			}
+			req.Check(t, h)
+		}
+
+		//two clients share the same account, but the first one gets throttled on its own
+		expectManifestPull("192.0.2.1", true)
+		expectManifestPull("192.0.2.1", true)
+		expectManifestPull("192.0.2.1", false)
+		expectManifestPull("192.0.2.2", true)
+		expectManifestPull("192.0.2.2", true)
+		expectManifestPull("192.0.2.2", false)
+		expectManifestPull("192.0.2.3", true)
+	})
+}
@@ -0,0 +1,118 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var referrersListQuery = sqlext.SimplifyWhitespace(`
+	SELECT m.media_type, m.digest, m.artifact_type, mc.content
+	  FROM manifests m
+	  JOIN manifest_contents mc ON mc.repo_id = m.repo_id AND mc.digest = m.digest
+	 WHERE m.repo_id = $1 AND m.subject_digest = $2 AND ($3 = '' OR m.artifact_type = $3)
+	 ORDER BY m.digest
+`)
+
+// referrerDescriptor appears in the response of the referrers API.
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	SizeBytes    int               `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// This implements the GET /v2/<account>/<repository>/referrers/<digest> endpoint.
+func (a *API) handleListReferrers(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v2/:account/:repo/referrers/:digest")
+	account, repo, _ := a.checkAccountAccess(w, r, failIfRepoMissing, nil)
+	if account == nil {
+		return
+	}
+
+	subjectDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		keppel.ErrDigestInvalid.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+	artifactType := r.URL.Query().Get("artifactType")
+
+	//NOTE: The subject manifest does not need to exist. If it does not, or if
+	//nothing refers to it, we just return an empty list.
+	referrers := []referrerDescriptor{}
+	queryArgs := []interface{}{repo.ID, subjectDigest.String(), artifactType}
+	err = sqlext.ForeachRow(a.db, referrersListQuery, queryArgs, func(rows *sql.Rows) error {
+		var (
+			desc     referrerDescriptor
+			contents []byte
+		)
+		err := rows.Scan(&desc.MediaType, &desc.Digest, &desc.ArtifactType, &contents)
+		if err != nil {
+			return err
+		}
+		contents, err = keppel.DecodeManifestContent(contents)
+		if err != nil {
+			return err
+		}
+		desc.SizeBytes = len(contents)
+		manifest, _, err := keppel.ParseManifest(desc.MediaType, contents)
+		if err != nil {
+			return err
+		}
+		desc.Annotations = manifest.Annotations()
+		referrers = append(referrers, desc)
+		return nil
+	})
+	if respondWithError(w, r, err) {
+		return
+	}
+
+	buf, err := json.Marshal(struct {
+		SchemaVersion int                  `json:"schemaVersion"`
+		MediaType     string               `json:"mediaType"`
+		Manifests     []referrerDescriptor `json:"manifests"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     imagespec.MediaTypeImageIndex,
+		Manifests:     referrers,
+	})
+	if respondWithError(w, r, err) {
+		return
+	}
+
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", imagespec.MediaTypeImageIndex)
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
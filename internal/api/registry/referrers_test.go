@@ -0,0 +1,143 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2_test
+
+import (
+	"net/http"
+	"testing"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestListReferrers(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		readOnlyToken := s.GetToken(t, "repository:test1/foo:pull")
+
+		//upload an image, and two artifacts referring to it: a signature with an
+		//explicit artifact type, and an SBOM-like artifact whose artifact type is
+		//derived from its config media type
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+
+		signatureType := "application/vnd.dev.cosign.artifact.sig.v1+json"
+		signature := test.GenerateImage(test.GenerateExampleLayer(2)).
+			WithOCIAnnotations(map[string]string{"dev.cosignproject.cosign/signature": "foo"}).
+			WithOCISubject(image.Manifest, signatureType)
+		signature.MustUpload(t, s, fooRepoRef, "")
+		sbom := test.GenerateImage(test.GenerateExampleLayer(3)).WithOCISubject(image.Manifest, "")
+		sbom.MustUpload(t, s, fooRepoRef, "")
+
+		//pushing a manifest with a subject reports the subject back to the client
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/" + signature.Manifest.Digest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + s.GetToken(t, "repository:test1/foo:pull,push"),
+				"Content-Type":  signature.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(signature.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"OCI-Subject":         image.Manifest.Digest.String(),
+			},
+		}.Check(t, h)
+
+		signatureDesc := assert.JSONObject{
+			"mediaType":    imagespec.MediaTypeImageManifest,
+			"digest":       signature.Manifest.Digest.String(),
+			"size":         len(signature.Manifest.Contents),
+			"artifactType": signatureType,
+			"annotations":  assert.JSONObject{"dev.cosignproject.cosign/signature": "foo"},
+		}
+		sbomDesc := assert.JSONObject{
+			"mediaType":    imagespec.MediaTypeImageManifest,
+			"digest":       sbom.Manifest.Digest.String(),
+			"size":         len(sbom.Manifest.Contents),
+			"artifactType": imagespec.MediaTypeImageConfig,
+		}
+		expectReferrers := func(path string, filtered bool, descs ...assert.JSONObject) {
+			t.Helper()
+			expectedHeader := map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Content-Type":        imagespec.MediaTypeImageIndex,
+			}
+			if filtered {
+				expectedHeader["OCI-Filters-Applied"] = "artifactType"
+			}
+			if descs == nil {
+				descs = []assert.JSONObject{}
+			}
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         path,
+				Header:       map[string]string{"Authorization": "Bearer " + readOnlyToken},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: expectedHeader,
+				ExpectBody: assert.JSONObject{
+					"schemaVersion": 2,
+					"mediaType":     imagespec.MediaTypeImageIndex,
+					"manifests":     descs,
+				},
+			}.Check(t, h)
+		}
+
+		//list all referrers (sorted by digest)
+		path := "/v2/test1/foo/referrers/" + image.Manifest.Digest.String()
+		if signature.Manifest.Digest < sbom.Manifest.Digest {
+			expectReferrers(path, false, signatureDesc, sbomDesc)
+		} else {
+			expectReferrers(path, false, sbomDesc, signatureDesc)
+		}
+
+		//filter by artifact type
+		expectReferrers(path+"?artifactType="+signatureType, true, signatureDesc)
+		expectReferrers(path+"?artifactType="+imagespec.MediaTypeImageConfig, true, sbomDesc)
+		expectReferrers(path+"?artifactType=application/unknown", true)
+
+		//manifests without referrers (or that do not exist) yield an empty list
+		expectReferrers("/v2/test1/foo/referrers/"+signature.Manifest.Digest.String(), false)
+		expectReferrers("/v2/test1/foo/referrers/"+test.GenerateExampleLayer(4).Digest.String(), false)
+
+		//malformed digests are rejected
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/referrers/latest",
+			Header:       map[string]string{"Authorization": "Bearer " + readOnlyToken},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+
+		//referrers of a manifest in a different repo are not visible
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/bar/referrers/" + image.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + s.GetToken(t, "repository:test1/bar:pull")},
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrNameUnknown),
+		}.Check(t, h)
+	})
+}
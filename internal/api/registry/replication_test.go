@@ -23,7 +23,10 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
@@ -260,6 +263,36 @@ func TestReplicationManifestQuotaExceeded(t *testing.T) {
 	})
 }
 
+func TestReplicationIgnoresStorageQuota(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		//upload image to primary account
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "first")
+
+		testWithAllReplicaTypes(t, s1, func(strategy string, firstPass bool, s2 test.Setup) {
+			if !firstPass {
+				return
+			}
+
+			//exhaust the storage quota in the secondary account...
+			_, err := s2.DB.Exec(`UPDATE quotas SET storage_bytes = $1`, 0)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			//...which does not prevent replication: the manifest was already accepted
+			//upstream, so refusing its blobs would only leave a half-replicated image
+			h2 := s2.Handler
+			token := s2.GetToken(t, "repository:test1/foo:pull")
+			expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "first", nil)
+			for _, blob := range []test.Bytes{image.Config, image.Layers[0]} {
+				expectBlobExists(t, h2, token, "test1/foo", blob, nil)
+			}
+		})
+	})
+}
+
 func TestReplicationUseCachedBlobMetadata(t *testing.T) {
 	testWithPrimary(t, nil, func(s1 test.Setup) {
 		//upload image to primary account
@@ -419,6 +452,100 @@ func TestReplicationAllowAnonymousReplicationFromExternal(t *testing.T) {
 	})
 }
 
+func TestReplicationNegativeCacheForAnonymousFirstPull(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "first")
+
+		//this is mostly like testWithReplica(), but we need the inbound cache to
+		//remember nonexistent manifests, and we only need one pass
+		s2 := test.NewSetup(t,
+			test.IsSecondaryTo(&s1),
+			test.WithAnycast(currentlyWithAnycast),
+			test.WithAccount(keppel.Account{
+				Name:                 "test1",
+				AuthTenantID:         authTenantID,
+				ExternalPeerURL:      "registry.example.org/test1",
+				ExternalPeerUserName: "replication@registry-secondary.example.org",
+				ExternalPeerPassword: test.GetReplicationPassword(),
+			}),
+			test.WithQuotas,
+			test.WithPeerAPI,
+			test.WithInboundCacheNegativeTTL(time.Minute),
+		)
+		defer func() {
+			_, err := s1.DB.Exec(`DELETE FROM peers`)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			tt := http.DefaultTransport.(*test.RoundTripper) //nolint:errcheck
+			tt.Handlers["registry-secondary.example.org"] = nil
+		}()
+		h2 := s2.Handler
+
+		//enable anonymous pull and replication on test1/foo
+		err := s2.DB.Insert(&keppel.RBACPolicy{
+			AccountName:             "test1",
+			RepositoryPattern:       "foo",
+			CanPullAnonymously:      true,
+			CanFirstPullAnonymously: true,
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//get an anonymous token
+		_, tokenBodyBytes := assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/keppel/v1/auth?service=registry-secondary.example.org&scope=repository:test1/foo:pull,anonymous_first_pull",
+			Header: map[string]string{
+				"X-Forwarded-Host":  "registry-secondary.example.org",
+				"X-Forwarded-Proto": "https",
+			},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h2)
+		var tokenBodyData struct {
+			Token string `json:"token"`
+		}
+		err = json.Unmarshal(tokenBodyBytes, &tokenBodyData)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		anonToken := tokenBodyData.Token
+		token := s2.GetToken(t, "repository:test1/foo:pull")
+
+		expectManifestMissing := func(token, tag string) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/" + tag,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusNotFound,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+			}.Check(t, h2)
+		}
+
+		//anonymous pull of a nonexistent tag places a negative entry in the inbound cache...
+		expectManifestMissing(anonToken, "second")
+		image.MustUpload(t, s1, fooRepoRef, "second")
+		//...so further anonymous pulls do not ask upstream again until the entry expires...
+		expectManifestMissing(anonToken, "second")
+		//...but authenticated users always ask upstream (which replaces the negative entry)
+		expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "second", nil)
+		expectManifestExists(t, h2, anonToken, "test1/foo", image.Manifest, "second", nil)
+
+		//negative entries expire after the configured TTL
+		s2.Clock.StepBy(2 * time.Minute)
+		expectManifestMissing(anonToken, "fourth")
+		image.MustUpload(t, s1, fooRepoRef, "fourth")
+		expectManifestMissing(anonToken, "fourth")
+		s2.Clock.StepBy(2 * time.Minute)
+		expectManifestExists(t, h2, anonToken, "test1/foo", image.Manifest, "fourth", nil)
+	})
+}
+
 func TestReplicationImageListWithPlatformFilter(t *testing.T) {
 	testWithPrimary(t, nil, func(s1 test.Setup) {
 		//This test is mostly identical to TestReplicationImageList(), but the
@@ -475,6 +602,51 @@ func TestReplicationImageListWithPlatformFilter(t *testing.T) {
 	})
 }
 
+func TestReplicationRepoAllowlist(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		//upload the same image into two repos in the primary account
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "first")
+		image.MustUpload(t, s1, barRepoRef, "first")
+
+		testWithAllReplicaTypes(t, s1, func(strategy string, firstPass bool, s2 test.Setup) {
+			//only allow replication of the "foo" repo
+			_, err := s2.DB.Exec(`UPDATE accounts SET replication_repo_allowlist_json = $1`, `["fo+"]`)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			h2 := s2.Handler
+			token := s2.GetToken(t, "repository:test1/foo:pull", "repository:test1/bar:pull")
+
+			//the allowlisted repo gets replicated as usual...
+			expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "first", nil)
+
+			//...but the other repo does not, even though the image exists upstream
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/bar/manifests/first",
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusForbidden,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody: test.ErrorCodeWithMessage{
+					Code:    keppel.ErrDenied,
+					Message: "repository test1/bar may not be replicated into this account",
+				},
+			}.Check(t, h2)
+
+			count, err := s2.DB.SelectInt(`SELECT COUNT(*) FROM manifests m JOIN repos r ON m.repo_id = r.id WHERE r.name = $1`, "bar")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if count != 0 {
+				t.Errorf("expected no manifests to be replicated into test1/bar, but found %d", count)
+			}
+		})
+	})
+}
+
 func TestReplicationFailingOverIntoPullDelegation(t *testing.T) {
 	//This test is more contrived than the others because we have *three* registries involved instead of two.
 	//- Primary and secondary are, as usual, set up as peers of each other with a replicated account "test1".
@@ -559,3 +731,128 @@ func TestReplicationFailingOverIntoPullDelegation(t *testing.T) {
 		})
 	})
 }
+
+func TestReplicationConcurrentBlobPulls(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		//upload image to primary account
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "first")
+		layer := image.Layers[0]
+
+		testWithReplica(t, s1, "on_first_use", func(firstPass bool, s2 test.Setup) {
+			//need only one pass for this test
+			if !firstPass {
+				return
+			}
+
+			//replicate the manifest (this leaves the layer blob unbacked)
+			h2 := s2.Handler
+			token := s2.GetToken(t, "repository:test1/foo:pull")
+			expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "first", nil)
+
+			//count upstream fetches of the layer blob, and hold them back until all
+			//pulls on the secondary side have been started
+			tt := http.DefaultTransport.(*test.RoundTripper) //nolint:errcheck
+			primaryHandler := tt.Handlers["registry.example.org"]
+			defer func() {
+				tt.Handlers["registry.example.org"] = primaryHandler
+			}()
+			var upstreamFetchCount int32
+			releaseUpstreamFetches := make(chan struct{})
+			tt.Handlers["registry.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+layer.Digest.String()) {
+					atomic.AddInt32(&upstreamFetchCount, 1)
+					<-releaseUpstreamFetches
+				}
+				primaryHandler.ServeHTTP(w, r)
+			})
+
+			//pull the same blob many times at once: all pulls shall succeed...
+			var wg sync.WaitGroup
+			for idx := 0; idx < 10; idx++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.HTTPRequest{
+						Method:       "GET",
+						Path:         "/v2/test1/foo/blobs/" + layer.Digest.String(),
+						Header:       map[string]string{"Authorization": "Bearer " + token},
+						ExpectStatus: http.StatusOK,
+						ExpectHeader: test.VersionHeader,
+						ExpectBody:   assert.ByteData(layer.Contents),
+					}.Check(t, h2)
+				}()
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(releaseUpstreamFetches)
+			wg.Wait()
+
+			//...but only one of them shall have gone to the upstream registry
+			if count := atomic.LoadInt32(&upstreamFetchCount); count != 1 {
+				t.Errorf("expected exactly 1 upstream fetch of the blob, but got %d", count)
+			}
+		})
+	})
+}
+
+func TestPullInReadOnlyMode(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "latest")
+
+		//pulls from a primary account work, but do not leave any trace in the DB
+		//(neither immediately nor after flushing the pull statistics)
+		h1 := s1.ReadOnlyRegistryHandler()
+		token := s1.GetToken(t, "repository:test1/foo:pull")
+		tr, _ := easypg.NewTracker(t, s1.DB.DbMap.Db)
+		s1.Clock.Step()
+		expectManifestExists(t, h1, token, "test1/foo", image.Manifest, "latest", nil)
+		expectManifestExists(t, h1, token, "test1/foo", image.Manifest, "", nil)
+		expectBlobExists(t, h1, token, "test1/foo", image.Layers[0], nil)
+		err := s1.PullCounter.Flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = s1.LPD.Flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tr.DBChanges().AssertEmpty()
+
+		//in a replica account, replication is not possible
+		testWithReplica(t, s1, "on_first_use", func(firstPass bool, s2 test.Setup) {
+			if !firstPass {
+				return
+			}
+			h2 := s2.ReadOnlyRegistryHandler()
+			token := s2.GetToken(t, "repository:test1/foo:pull")
+			tr, _ := easypg.NewTracker(t, s2.DB.DbMap.Db)
+
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/latest",
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrUnavailable),
+			}.Check(t, h2)
+			tr.DBChanges().AssertEmpty()
+
+			//after the manifest was replicated outside of read-only mode, its blobs
+			//still cannot be replicated in read-only mode
+			expectManifestExists(t, s2.Handler, token, "test1/foo", image.Manifest, "latest", nil)
+			tr, _ = easypg.NewTracker(t, s2.DB.DbMap.Db)
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrUnavailable),
+			}.Check(t, h2)
+			tr.DBChanges().AssertEmpty()
+		})
+	})
+}
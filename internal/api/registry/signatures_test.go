@@ -0,0 +1,118 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestSignaturePolicy(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		//set up a signature policy with a freshly generated key
+		key := mustGenerateSigningKey(t)
+		otherKey := mustGenerateSigningKey(t)
+		keyBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		policyJSON, err := json.Marshal(keppel.SignaturePolicy{
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyBytes})),
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = s.DB.Exec(`UPDATE accounts SET signature_policy_json = $1 WHERE name = $2`, string(policyJSON), "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		tagManifest := func(m test.Bytes, tag string, expectStatus int) {
+			t.Helper()
+			req := assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tag,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  m.MediaType,
+				},
+				Body:         assert.ByteData(m.Contents),
+				ExpectStatus: expectStatus,
+				ExpectHeader: test.VersionHeader,
+			}
+			if expectStatus == http.StatusForbidden {
+				req.ExpectBody = test.ErrorCodeWithMessage{
+					Code:    keppel.ErrDenied,
+					Message: "manifest " + m.Digest.String() + " cannot be tagged because it does not have a valid signature, as required by this account's signature policy",
+				}
+			}
+			req.Check(t, h)
+		}
+
+		//pushing an unsigned image by digest works, but tagging it does not
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "")
+		tagManifest(image.Manifest, "latest", http.StatusForbidden)
+
+		//a signature made with the wrong key is not sufficient
+		test.GenerateCosignSignature(image.Manifest, otherKey).MustUpload(t, s, fooRepoRef, "")
+		tagManifest(image.Manifest, "latest", http.StatusForbidden)
+
+		//a signature made with the right key allows tagging
+		test.GenerateCosignSignature(image.Manifest, key).MustUpload(t, s, fooRepoRef, "")
+		tagManifest(image.Manifest, "latest", http.StatusCreated)
+
+		//a signature for a different manifest does not help another image
+		otherImage := test.GenerateImage(test.GenerateExampleLayer(2))
+		otherImage.MustUpload(t, s, fooRepoRef, "")
+		tagManifest(otherImage.Manifest, "other", http.StatusForbidden)
+
+		//pushing an unsigned image directly by tag is rejected as well
+		unsignedImage := test.GenerateImage(test.GenerateExampleLayer(3))
+		for _, layer := range unsignedImage.Layers {
+			layer.MustUpload(t, s, fooRepoRef)
+		}
+		unsignedImage.Config.MustUpload(t, s, fooRepoRef)
+		tagManifest(unsignedImage.Manifest, "unsigned", http.StatusForbidden)
+
+	})
+}
+
+func mustGenerateSigningKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return key
+}
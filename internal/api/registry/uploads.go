@@ -76,8 +76,7 @@ func (a *API) handleStartBlobUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//forbid pushing during maintenance
-	if account.InMaintenance {
-		keppel.ErrUnsupported.With("account is in maintenance").WithStatus(http.StatusMethodNotAllowed).WriteAsRegistryV2ResponseTo(w, r)
+	if !checkNotInMaintenance(w, r, *account) {
 		return
 	}
 
@@ -86,24 +85,10 @@ func (a *API) handleStartBlobUpload(w http.ResponseWriter, r *http.Request) {
 	//This is not strictly necessary to enforce the manifest quota, but it's
 	//useful to avoid the accumulation of unreferenced blobs in the account's
 	//backing storage.
-	quotas, err := keppel.FindQuotas(a.db, account.AuthTenantID)
+	err := a.processor().CheckQuotaForManifestPush(*account)
 	if respondWithError(w, r, err) {
 		return
 	}
-	if quotas == nil {
-		quotas = keppel.DefaultQuotas(account.AuthTenantID)
-	}
-	manifestUsage, err := quotas.GetManifestUsage(a.db)
-	if respondWithError(w, r, err) {
-		return
-	}
-	if manifestUsage >= quotas.ManifestCount {
-		msg := fmt.Sprintf("manifest quota exceeded (quota = %d, usage = %d)",
-			quotas.ManifestCount, manifestUsage,
-		)
-		keppel.ErrDenied.With(msg).WithStatus(http.StatusConflict).WriteAsRegistryV2ResponseTo(w, r)
-		return
-	}
 
 	//special case: request for cross-repo blob mount
 	query := r.URL.Query()
@@ -217,6 +202,31 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		return false
 	}
 
+	//enforce the account's blob size limit before any data is written into the storage
+	if sizeBytes > account.EffectiveMaxBlobSizeBytes() {
+		blobTooLargeError(account).WriteAsRegistryV2ResponseTo(w, r)
+		return false
+	}
+
+	//since the size is known in advance, the storage quota can also be checked
+	//before any data is written into the storage
+	err = a.processor().CheckQuotaForBlobPush(account, blobDigest, sizeBytes)
+	if respondWithError(w, r, err) {
+		return false
+	}
+
+	//with cross-account deduplication, we might be able to reuse the storage
+	//contents of an identical blob in a different account
+	if a.cfg.EnableCrossAccountBlobDedup {
+		sourceBlob, err := keppel.FindBlobForDeduplication(a.db, blobDigest, account)
+		if err != sql.ErrNoRows {
+			if respondWithError(w, r, err) {
+				return false
+			}
+			return a.performDeduplicatedUpload(w, r, account, repo, authz, blobDigest, sizeBytes, *sourceBlob)
+		}
+	}
+
 	//stream request body into the storage backend while also computing the digest and length
 	upload := keppel.Upload{
 		StorageID: a.generateStorageID(),
@@ -294,6 +304,92 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 	return true
 }
 
+var lockBlobForDeduplicationQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM blobs WHERE id = $1 AND storage_account_name = '' FOR SHARE
+`)
+
+// performDeduplicatedUpload is the variant of performMonolithicUpload when
+// cross-account deduplication is possible. The request body is only read to
+// verify its digest and length, and the new blob reuses the storage contents
+// of `sourceBlob` (which is located in a different account).
+func (a *API) performDeduplicatedUpload(w http.ResponseWriter, r *http.Request, account keppel.Account, repo keppel.Repository, authz *auth.Authorization, blobDigest digest.Digest, sizeBytes uint64, sourceBlob keppel.Blob) (ok bool) {
+	defer func() {
+		if !ok {
+			countAbortedBlobUpload(account)
+		}
+	}()
+
+	//validate digest and length (we read at most one byte more than announced,
+	//which is enough to detect a mismatch)
+	dw := digestWriter{Hash: sha256.New()}
+	_, err := io.Copy(&dw, io.LimitReader(r.Body, int64(sizeBytes)+1))
+	if respondWithError(w, r, err) {
+		return false
+	}
+	if dw.bytesWritten != sizeBytes {
+		keppel.ErrSizeInvalid.With("Content-Length was %d, but %d bytes were sent", sizeBytes, dw.bytesWritten).WriteAsRegistryV2ResponseTo(w, r)
+		return false
+	}
+	actualDigest := digest.NewDigest(digest.SHA256, dw.Hash)
+	if actualDigest != blobDigest {
+		keppel.ErrDigestInvalid.With("expected %s, but actual digest was %s", blobDigest.String(), actualDigest.String()).WriteAsRegistryV2ResponseTo(w, r)
+		return false
+	}
+
+	//record blob in DB
+	tx, err := a.db.Begin()
+	if respondWithError(w, r, err) {
+		return false
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	//lock the source blob to ensure that its storage contents are not deleted
+	//before our transaction is committed (once our blob refers to them, the
+	//blob sweep will not delete them anymore)
+	err = tx.SelectOne(&sourceBlob, lockBlobForDeduplicationQuery, sourceBlob.ID)
+	if err == sql.ErrNoRows {
+		//the source blob was deleted in the meantime; a retry by the client will
+		//not try to deduplicate against it anymore
+		err = fmt.Errorf("blob %s was deleted from account %s while being used for deduplication, please retry",
+			blobDigest, sourceBlob.AccountName)
+	}
+	if respondWithError(w, r, err) {
+		return false
+	}
+
+	_, err = tx.Exec(insertDeduplicatedBlobIfMissingQuery,
+		account.Name, blobDigest.String(), sourceBlob.SizeBytes, sourceBlob.StorageID, a.timeNow(), sourceBlob.AccountName,
+	)
+	if respondWithError(w, r, err) {
+		return false
+	}
+	//NOTE: If there was a conflict because this account already has a blob with
+	//this digest, we just reuse that blob instead.
+	blob, err := keppel.FindBlobByAccountName(tx, blobDigest, account)
+	if respondWithError(w, r, err) {
+		return false
+	}
+	err = keppel.MountBlobIntoRepo(tx, *blob, repo)
+	if respondWithError(w, r, err) {
+		return false
+	}
+	err = tx.Commit()
+	if respondWithError(w, r, err) {
+		return false
+	}
+
+	//the spec wants a Blob-Upload-Session-Id header even though the upload is done, so just make something up
+	uuidV4, err := uuid.NewV4()
+	if respondWithError(w, r, err) {
+		return false
+	}
+	w.Header().Set("Blob-Upload-Session-Id", uuidV4.String())
+	w.Header().Set("Content-Length", "0")
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", getRepoNameForURLPath(repo, authz), blobDigest.String()))
+	w.WriteHeader(http.StatusCreated)
+	return true
+}
+
 // This implements the DELETE /v2/<account>/<repository>/blobs/uploads/<uuid> endpoint.
 func (a *API) handleDeleteBlobUpload(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v2/:account/:repo/blobs/uploads/:uuid")
@@ -360,6 +456,9 @@ func (a *API) handleContinueBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	if !checkNotInMaintenance(w, r, *account) {
+		return
+	}
 	upload := a.findUpload(w, r, *repo)
 	if upload == nil {
 		return
@@ -393,10 +492,24 @@ func (a *API) handleContinueBlobUpload(w http.ResponseWriter, r *http.Request) {
 		chunkSizeBytes = &val
 	}
 
-	//append request body to upload
-	digestState, err := a.streamIntoUpload(*account, upload, dw, r.Body, chunkSizeBytes)
-	if respondWithError(w, r, err) {
-		return
+	var digestState string
+	if chunkSizeBytes == nil && r.ContentLength == 0 {
+		//an empty PATCH is a heartbeat that keeps the upload alive (e.g. while the
+		//client is busy compressing the next chunk) without appending anything; we
+		//don't forward it to the storage driver because it would count as a chunk
+		digestState = r.URL.Query().Get("state")
+		upload.UpdatedAt = a.timeNow()
+		_, err := a.db.Update(upload)
+		if respondWithError(w, r, err) {
+			return
+		}
+	} else {
+		//append request body to upload
+		var err error
+		digestState, err = a.streamIntoUpload(*account, upload, dw, r.Body, chunkSizeBytes)
+		if respondWithError(w, r, err) {
+			return
+		}
 	}
 
 	query := url.Values{}
@@ -415,6 +528,9 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	if !checkNotInMaintenance(w, r, *account) {
+		return
+	}
 	upload := a.findUpload(w, r, *repo)
 	if upload == nil {
 		return
@@ -442,6 +558,21 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//now that the full blob size is known, check that it fits in the storage quota
+	err := a.processor().CheckQuotaForBlobPush(*account, digest.Digest(upload.Digest), upload.SizeBytes)
+	if respondWithError(w, r, err) {
+		countAbortedBlobUpload(*account)
+		_, err := a.db.Delete(upload)
+		if err != nil {
+			logg.Error("additional error encountered while deleting Upload from DB after quota check: " + err.Error())
+		}
+		err = a.sd.AbortBlobUpload(*account, upload.StorageID, upload.NumChunks)
+		if err != nil {
+			logg.Error("additional error encountered during AbortBlobUpload() after quota check: " + err.Error())
+		}
+		return
+	}
+
 	//convert the Upload into a Blob in both the storage backend and the DB
 	//
 	//NOTE 1: This is written a bit funny to avoid duplicating error handling
@@ -451,7 +582,7 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	//storage that the DB does not know about, but the storage sweep can clean
 	//that up later.
 	var blob *keppel.Blob
-	err := a.sd.FinalizeBlob(*account, upload.StorageID, upload.NumChunks)
+	err = a.sd.FinalizeBlob(*account, upload.StorageID, upload.NumChunks)
 	if err == nil {
 		blob, err = a.createBlobFromUpload(*account, *repo, *upload, query.Get("digest"))
 	}
@@ -616,9 +747,22 @@ func (a *API) streamIntoUpload(account keppel.Account, upload *keppel.Upload, dw
 		}
 	}()
 
+	//enforce the account's blob size limit: if the chunk size is known, we can
+	//reject the chunk right away; otherwise we stop reading as soon as the
+	//limit is crossed
+	maxSizeBytes := account.EffectiveMaxBlobSizeBytes()
+	if upload.SizeBytes > maxSizeBytes || (chunkSizeBytes != nil && *chunkSizeBytes > maxSizeBytes-upload.SizeBytes) {
+		return "", blobTooLargeError(account)
+	}
+	limitedChunk := &blobSizeLimitReader{wrapped: chunk, remainingBytes: maxSizeBytes - upload.SizeBytes}
+
 	//stream data from request body into storage
 	sizeBytesBefore := upload.SizeBytes
-	err := a.processor().AppendToBlob(account, upload, io.TeeReader(chunk, dw), chunkSizeBytes)
+	err := a.processor().AppendToBlob(account, upload, io.TeeReader(limitedChunk, dw), chunkSizeBytes)
+	if limitedChunk.exceeded {
+		//the storage driver may have wrapped our error, so report it explicitly
+		return "", blobTooLargeError(account)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -694,6 +838,12 @@ var insertBlobIfMissingQuery = sqlext.SimplifyWhitespace(`
 	ON CONFLICT DO NOTHING
 `)
 
+var insertDeduplicatedBlobIfMissingQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO blobs (account_name, digest, size_bytes, storage_id, pushed_at, validated_at, storage_account_name)
+	VALUES ($1, $2, $3, $4, $5, $5, $6)
+	ON CONFLICT DO NOTHING
+`)
+
 // Insert a Blob object in the database. This is similar to building a
 // keppel.Blob and doing tx.Insert(blob), but handles a collision where another
 // blob with the same account name and digest already exists in the database.
@@ -742,6 +892,33 @@ func (w *digestWriter) Write(buf []byte) (n int, err error) {
 	return n, err
 }
 
+func blobTooLargeError(account keppel.Account) *keppel.RegistryV2Error {
+	return keppel.ErrBlobUploadInvalid.
+		With("blob exceeds the maximum size of %d bytes for this account", account.EffectiveMaxBlobSizeBytes()).
+		WithStatus(http.StatusRequestEntityTooLarge)
+}
+
+// blobSizeLimitReader is an io.Reader that fails once more than
+// `remainingBytes` are read from it.
+type blobSizeLimitReader struct {
+	wrapped        io.Reader
+	remainingBytes uint64
+	exceeded       bool
+}
+
+var errBlobSizeLimitExceeded = errors.New("blob size limit exceeded")
+
+// Read implements the io.Reader interface.
+func (r *blobSizeLimitReader) Read(buf []byte) (int, error) {
+	n, err := r.wrapped.Read(buf)
+	if uint64(n) > r.remainingBytes {
+		r.exceeded = true
+		return 0, errBlobSizeLimitExceeded
+	}
+	r.remainingBytes -= uint64(n)
+	return n, err
+}
+
 func countAbortedBlobUpload(account keppel.Account) {
 	l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 	api.UploadsAbortedCounter.With(l).Inc()
@@ -20,7 +20,7 @@
 package auth
 
 import (
-	"github.com/sapcc/go-bits/httpext"
+	"fmt"
 
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -28,12 +28,8 @@ import (
 // Produces a new ScopeSet containing only those scopes that the given
 // `uid` is permitted to access and only those actions therein which this `uid`
 // is permitted to perform.
-func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (ScopeSet, error) {
+func filterAuthorized(cfg keppel.Configuration, ir IncomingRequest, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (ScopeSet, error) {
 	result := make(ScopeSet, 0, len(ir.Scopes))
-	//make sure that additional scopes get appended at the end, on the offchance
-	//that a client might parse its token and look at access[0] to check for its
-	//authorization
-	var additional ScopeSet
 
 	var err error
 	for _, scope := range ir.Scopes {
@@ -44,28 +40,17 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 				//we cannot allow catalog access on the anycast API since there is no way
 				//to decide which peer does the authentication in this case
 				filtered.Actions = nil
-			} else if uid.UserType() == keppel.AnonymousUser {
-				//we don't allow catalog access to anonymous users:
-				//
-				//1. if we did, nobody would ever be presented with the auth challenge
-				//and thus all clients would assume that they get the same result
-				//without auth (which is very much not true)
-				//
-				//2. anon users do not get any keppel_account:*:view permissions, so it
-				//does not help them to get access to the catalog endpoint anyway
-				filtered.Actions = nil
 			} else if scope.Contains(CatalogEndpointScope) {
+				//catalog access is always allowed; the catalog endpoint itself only
+				//lists those repositories that the user identity can pull from (for
+				//anonymous users, that's the ones with anonymous pull access)
 				filtered.Actions = CatalogEndpointScope.Actions
-				err = addCatalogAccess(&additional, uid, audience, db)
-				if err != nil {
-					return nil, err
-				}
 			} else {
 				filtered.Actions = nil
 			}
 
 		case "repository":
-			ip := httpext.GetRequesterIPFor(ir.HTTPRequest)
+			ip := keppel.GetRequesterIP(ir.HTTPRequest, cfg.TrustedProxyNetworks)
 			filtered.Actions, err = filterRepoActions(ip, *scope, uid, audience, db)
 			if err != nil {
 				return nil, err
@@ -117,39 +102,7 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 		result.Add(filtered)
 	}
 
-	return append(result, additional...), nil
-}
-
-func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience, db *keppel.DB) error {
-	var accounts []keppel.Account
-	if audience.AccountName == "" {
-		//on the standard API, all accounts are potentially accessible
-		_, err := db.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
-		if err != nil {
-			return err
-		}
-	} else {
-		//on a domain-remapped API, only that API's account is accessible (if it exists)
-		account, err := keppel.FindAccount(db, audience.AccountName)
-		if err != nil {
-			return err
-		}
-		if account != nil {
-			accounts = []keppel.Account{*account}
-		}
-	}
-
-	for _, account := range accounts {
-		if uid.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
-			ss.Add(Scope{
-				ResourceType: "keppel_account",
-				ResourceName: account.Name,
-				Actions:      []string{"view"},
-			})
-		}
-	}
-
-	return nil
+	return result, nil
 }
 
 func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience Audience, db *keppel.DB) ([]string, error) {
@@ -181,8 +134,12 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 		return nil, err
 	}
 	userName := uid.UserName()
+	var groupNames []string
+	if gm, ok := uid.(keppel.GroupMembership); ok {
+		groupNames = gm.GroupNames()
+	}
 	for _, policy := range policies {
-		if policy.Matches(ip, repoScope.FullRepositoryName, userName) {
+		if policy.Matches(ip, repoScope.FullRepositoryName, userName, groupNames) {
 			if policy.CanPullAnonymously {
 				isAllowedAction["pull"] = true
 			}
@@ -213,6 +170,52 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 	return result, nil
 }
 
+// FilterPullableRepositories returns those of the given repository names
+// (which must all belong to the given account) that the given user identity
+// is permitted to pull from, either because of its permissions on the account's
+// auth tenant or because of the account's RBAC policies. This follows the same
+// rules as the token issuance for "repository:...:pull" scopes.
+//
+// For use with the /v2/_catalog endpoint.
+func FilterPullableRepositories(ip string, uid keppel.UserIdentity, account keppel.Account, repoNames []string, db *keppel.DB) ([]string, error) {
+	if uid.HasPermission(keppel.CanPullFromAccount, account.AuthTenantID) {
+		return repoNames, nil
+	}
+
+	//only RBAC policies granting pull access to this user are relevant here
+	var allPolicies []keppel.RBACPolicy
+	_, err := db.Select(&allPolicies, "SELECT * FROM rbac_policies WHERE account_name = $1", account.Name)
+	if err != nil {
+		return nil, err
+	}
+	var policies []keppel.RBACPolicy
+	for _, policy := range allPolicies {
+		if policy.CanPullAnonymously || (policy.CanPull && uid.UserType() != keppel.AnonymousUser) {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	userName := uid.UserName()
+	var groupNames []string
+	if gm, ok := uid.(keppel.GroupMembership); ok {
+		groupNames = gm.GroupNames()
+	}
+	var result []string
+	for _, repoName := range repoNames {
+		fullRepoName := fmt.Sprintf("%s/%s", account.Name, repoName)
+		for _, policy := range policies {
+			if policy.Matches(ip, fullRepoName, userName, groupNames) {
+				result = append(result, repoName)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
 func filterAuthTenantActions(authTenantID string, actions []string, uid keppel.UserIdentity) []string {
 	if authTenantID == "" {
 		return nil
@@ -0,0 +1,87 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package auth
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var (
+	authRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_auth_requests",
+			Help: "Counter for authentication attempts on incoming API requests, by auth driver and outcome.",
+		},
+		[]string{"driver", "outcome"},
+	)
+	authDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keppel_auth_duration_seconds",
+			Help:    "Histogram of the time spent on authenticating incoming API requests.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"driver"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(authRequestCounter)
+	prometheus.MustRegister(authDurationHistogram)
+}
+
+// Values for the "outcome" label of authRequestCounter.
+const (
+	authOutcomeSuccess        = "success"
+	authOutcomeBadCredentials = "bad_credentials"
+	authOutcomeAnonymous      = "anonymous"
+	authOutcomeError          = "error"
+)
+
+// observeAuthentication records the result of IncomingRequest.authenticate()
+// in the respective metrics.
+func observeAuthentication(driverName string, duration time.Duration, authz *Authorization, noCredentials bool, rerr *keppel.RegistryV2Error) {
+	authDurationHistogram.WithLabelValues(driverName).Observe(duration.Seconds())
+	authRequestCounter.WithLabelValues(driverName, classifyAuthOutcome(authz, noCredentials, rerr)).Inc()
+}
+
+func classifyAuthOutcome(authz *Authorization, noCredentials bool, rerr *keppel.RegistryV2Error) string {
+	//requests without any credentials are rejected on some endpoints (most
+	//notably GET /v2/, to produce an auth challenge), but this is part of the
+	//normal auth workflow and must not look like a failed login attempt
+	if noCredentials {
+		return authOutcomeAnonymous
+	}
+	if rerr != nil {
+		switch rerr.Code {
+		case keppel.ErrUnauthorized, keppel.ErrDenied:
+			return authOutcomeBadCredentials
+		default:
+			//e.g. database errors or an unreachable auth backend
+			return authOutcomeError
+		}
+	}
+	if authz.UserIdentity.UserType() == keppel.AnonymousUser {
+		return authOutcomeAnonymous
+	}
+	return authOutcomeSuccess
+}
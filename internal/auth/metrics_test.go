@@ -0,0 +1,148 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/audittools"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// metricsTestAuthDriver is a minimal AuthDriver that accepts the password
+// "secret" for any user, and reports the backend as unavailable for the
+// password "unavailable".
+type metricsTestAuthDriver struct{}
+
+type metricsTestUserIdentity struct {
+	Name string
+}
+
+func (metricsTestAuthDriver) DriverName() string                     { return "metrics-test" }
+func (metricsTestAuthDriver) ValidateTenantID(tenantID string) error { return nil }
+func (metricsTestAuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	return nil, nil
+}
+func (metricsTestAuthDriver) AuthenticateUser(userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	switch password {
+	case "secret":
+		return metricsTestUserIdentity{userName}, nil
+	case "unavailable":
+		return nil, keppel.ErrUnavailable.With("auth backend is down")
+	default:
+		return nil, keppel.ErrUnauthorized.With("invalid username or password")
+	}
+}
+
+func (uid metricsTestUserIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
+	return false
+}
+func (uid metricsTestUserIdentity) UserType() keppel.UserType     { return keppel.RegularUser }
+func (uid metricsTestUserIdentity) UserName() string              { return uid.Name }
+func (uid metricsTestUserIdentity) UserInfo() audittools.UserInfo { return nil }
+func (uid metricsTestUserIdentity) SerializeToJSON() (string, []byte, error) {
+	return "", nil, nil
+}
+
+func TestAuthMetrics(t *testing.T) {
+	cfg := keppel.Configuration{APIPublicHostname: "registry.example.org"}
+	ad := metricsTestAuthDriver{}
+
+	authorizeRequest := func(authHeader string, ir IncomingRequest) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "https://registry.example.org/v2/", http.NoBody)
+		if authHeader != "" {
+			r.Header.Set("Authorization", authHeader)
+		}
+		ir.HTTPRequest = r
+		//no scopes (besides InfoAPIScope) are requested, so no database access is needed
+		_, _ = ir.Authorize(cfg, ad, nil)
+	}
+	authorize := func(authHeader string, forTokenIssuance bool) {
+		t.Helper()
+		var ir IncomingRequest
+		if forTokenIssuance {
+			ir.AudienceForTokenIssuance = &Audience{}
+		}
+		authorizeRequest(authHeader, ir)
+	}
+
+	expectCount := func(outcome string, before, expectedDelta float64) {
+		t.Helper()
+		actual := testutil.ToFloat64(authRequestCounter.WithLabelValues("metrics-test", outcome)) - before
+		if actual != expectedDelta {
+			t.Errorf("expected %g increments for outcome %q, but got %g", expectedDelta, outcome, actual)
+		}
+	}
+
+	outcomes := []string{authOutcomeSuccess, authOutcomeBadCredentials, authOutcomeAnonymous, authOutcomeError}
+	before := make(map[string]float64)
+	for _, outcome := range outcomes {
+		before[outcome] = testutil.ToFloat64(authRequestCounter.WithLabelValues("metrics-test", outcome))
+	}
+	observationsBefore := countAuthDurationObservations(t)
+
+	basicAuth := func(userName, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(userName+":"+password))
+	}
+	authorize(basicAuth("alice", "secret"), true)
+	authorize(basicAuth("alice", "wrong"), true)
+	authorize(basicAuth("alice", "unavailable"), true)
+	authorize("Bogus", false)
+	//requests without any credentials are counted separately from failures
+	authorize("", false)
+	authorize("", false)
+	//this is also true when the request gets rejected because of the missing
+	//credentials, as happens for unauthenticated requests on GET /v2/ (which
+	//every client does before logging in)...
+	authorizeRequest("", IncomingRequest{
+		NoImplicitAnonymous: true,
+		Scopes:              NewScopeSet(InfoAPIScope),
+	})
+	//...or for driver auth without any driver-specific credentials
+	authorize("keppel", false)
+
+	expectCount(authOutcomeSuccess, before[authOutcomeSuccess], 1)
+	expectCount(authOutcomeBadCredentials, before[authOutcomeBadCredentials], 2)
+	expectCount(authOutcomeError, before[authOutcomeError], 1)
+	expectCount(authOutcomeAnonymous, before[authOutcomeAnonymous], 4)
+
+	//every authentication attempt is timed
+	observations := countAuthDurationObservations(t) - observationsBefore
+	if observations != 8 {
+		t.Errorf("expected 8 observations in keppel_auth_duration_seconds, but got %d", observations)
+	}
+}
+
+func countAuthDurationObservations(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	err := authDurationHistogram.WithLabelValues("metrics-test").(prometheus.Histogram).Write(&m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return m.GetHistogram().GetSampleCount()
+}
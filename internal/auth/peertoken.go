@@ -36,10 +36,13 @@ func GetPeerToken(cfg keppel.Configuration, peer keppel.Peer, scope Scope) (stri
 	if err != nil {
 		return "", err
 	}
-	ourUserName := "replication@" + cfg.APIPublicHostname
-	req.Header.Set("Authorization", keppel.BuildBasicAuthHeader(ourUserName, peer.OurPassword))
+	if cfg.PeeringMode != keppel.PeeringModeMTLS {
+		//in mTLS mode, we are identified by our client certificate instead
+		ourUserName := "replication@" + cfg.APIPublicHostname
+		req.Header.Set("Authorization", keppel.BuildBasicAuthHeader(ourUserName, peer.OurPassword))
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.PeerHTTPClient().Do(req)
 	if err != nil {
 		return "", err
 	}
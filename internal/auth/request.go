@@ -25,6 +25,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -98,12 +99,84 @@ func (ir IncomingRequest) Authorize(cfg keppel.Configuration, ad keppel.AuthDriv
 	}
 
 	//obtain Authorization through one of the various supported methods
-	var (
-		authHeader     = r.Header.Get("Authorization")
-		allowChallenge = false
-		tokenFound     = false
-		authz          *Authorization
-	)
+	startedAt := time.Now()
+	authz, tokenFound, allowChallenge, noCredentials, rerr := ir.authenticate(cfg, ad, audience, db)
+	observeAuthentication(ad.DriverName(), time.Since(startedAt), authz, noCredentials, rerr)
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	//when anonymous access is disabled globally, this overrides any RBAC
+	//policies that grant anonymous access (this also covers tokens that were
+	//issued to anonymous users before the switch was flipped)
+	if cfg.DisableAnonymousAccess && authz.UserIdentity.UserType() == keppel.AnonymousUser {
+		return nil, keppel.ErrUnauthorized.With("anonymous access is disabled").WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+	}
+
+	//check if requested scope is covered by Authorization
+	if !ir.PartialAccessAllowed {
+		for _, scope := range ir.Scopes {
+			//to ensure that GET /v2/ produces an auth challenge without any scopes,
+			//we do not render InfoAPIScope into auth challenges; conversely, since
+			//we don't challenge anyone to obtain tokens for InfoAPIScope, we need to
+			//skip this scope here as well
+			if InfoAPIScope.Contains(*scope) {
+				continue
+			}
+
+			if !authz.ScopeSet.Contains(*scope) {
+				//not covered -> generate error, possibly with auth challenge
+				rerr := keppel.ErrUnauthorized.With("no bearer token found in request headers")
+				if authz.UserIdentity.UserType() != keppel.AnonymousUser {
+					if tokenFound {
+						rerr = keppel.ErrDenied.With("token does not cover scope %s", scope.String())
+					} else {
+						rerr = keppel.ErrDenied.With("no permission for %s", scope.String())
+					}
+				}
+				if allowChallenge {
+					if tokenFound {
+						rerr = rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, "insufficient_scope"))
+					} else {
+						rerr = rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+					}
+				}
+				if ir.CorrectlyReturn403 {
+					rerr = rerr.WithStatus(http.StatusForbidden)
+				}
+				return nil, rerr
+			}
+		}
+	}
+
+	return authz, nil
+}
+
+// authenticate obtains an Authorization through one of the various supported
+// methods, but does not yet check whether it covers the requested scopes.
+// If the request was rejected because it did not contain any credentials at
+// all, `noCredentials` is true.
+func (ir IncomingRequest) authenticate(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audience, db *keppel.DB) (authz *Authorization, tokenFound, allowChallenge, noCredentials bool, rerr *keppel.RegistryV2Error) {
+	r := ir.HTTPRequest
+	authHeader := r.Header.Get("Authorization")
+
+	//in mTLS peering mode, peers identify themselves with a client certificate
+	//(but other clients may present a certificate as well, so an unknown
+	//certificate does not prevent using any of the other methods below)
+	if authHeader == "" && cfg.PeeringMode == keppel.PeeringModeMTLS && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		peer, err := checkPeerCertificate(db, r.TLS.PeerCertificates[0])
+		if err != nil {
+			return nil, false, false, false, keppel.AsRegistryV2Error(err)
+		}
+		if peer != nil {
+			authz, err = ir.authorizeViaUserIdentity(cfg, PeerUserIdentity{PeerHostName: peer.HostName}, audience, db)
+			if err != nil {
+				return nil, false, false, false, keppel.AsRegistryV2Error(err)
+			}
+			return authz, false, false, false, nil
+		}
+	}
+
 	switch {
 	case strings.HasPrefix(authHeader, "Basic "):
 		//clearly a request for basic auth
@@ -111,23 +184,40 @@ func (ir IncomingRequest) Authorize(cfg keppel.Configuration, ad keppel.AuthDriv
 			//I'm being deliberately harsh with the wording of this error message
 			//here; I've seen clients use basic auth on endpoints like GET /v2/ even
 			//though that is completely nonsensical
-			return nil, keppel.ErrUnauthorized.With("basic auth is not supported on this endpoint, your library's auth workflow is probably broken").WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+			return nil, false, false, false, keppel.ErrUnauthorized.With("basic auth is not supported on this endpoint, your library's auth workflow is probably broken").WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
 		}
 		uid, err := checkBasicAuth(authHeader, ad, db)
 		if err != nil {
-			return nil, keppel.AsRegistryV2Error(err)
+			return nil, false, false, false, keppel.AsRegistryV2Error(err)
 		}
-		authz, err = ir.authorizeViaUserIdentity(uid, audience, db)
+		authz, err = ir.authorizeViaUserIdentity(cfg, uid, audience, db)
 		if err != nil {
-			return nil, keppel.AsRegistryV2Error(err)
+			return nil, false, false, false, keppel.AsRegistryV2Error(err)
 		}
 
 	case strings.HasPrefix(authHeader, "Bearer "):
 		//clearly a request for token auth
-		var rerr *keppel.RegistryV2Error
-		authz, rerr = parseToken(cfg, ad, audience, strings.TrimPrefix(authHeader, "Bearer "))
+		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+		btad, ok := keppel.UnwrapAuthDriver(ad).(keppel.BearerTokenAuthDriver)
+		if ok && !isIssuedByKeppel(tokenStr) {
+			//token was issued by an external identity provider, so only the auth
+			//driver can validate it
+			uid, rerr := btad.AuthenticateUserFromBearerToken(tokenStr)
+			if rerr != nil {
+				return nil, false, false, false, rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+			}
+			var err error
+			authz, err = ir.authorizeViaUserIdentity(cfg, uid, audience, db)
+			if err != nil {
+				return nil, false, false, false, keppel.AsRegistryV2Error(err)
+			}
+			allowChallenge = true
+			break
+		}
+
+		authz, rerr = parseToken(cfg, ad, audience, tokenStr)
 		if rerr != nil {
-			return nil, rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+			return nil, false, false, false, rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
 		}
 		tokenFound = true
 		allowChallenge = true
@@ -137,14 +227,14 @@ func (ir IncomingRequest) Authorize(cfg keppel.Configuration, ad keppel.AuthDriv
 		//if driver auth does not detect any matching headers
 		uid, rerr := ad.AuthenticateUserFromRequest(r)
 		if rerr != nil {
-			return nil, rerr
+			return nil, false, false, false, rerr
 		}
 		if uid == nil {
 			if authHeader == "keppel" {
 				//do not fallback if we were explicitly instructed to only use driver auth
-				return nil, keppel.ErrUnauthorized.With("no credentials found in request")
+				return nil, false, false, true, keppel.ErrUnauthorized.With("no credentials found in request")
 			} else if ir.NoImplicitAnonymous {
-				return nil, keppel.ErrUnauthorized.With("no bearer token found in request headers").WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
+				return nil, false, false, true, keppel.ErrUnauthorized.With("no bearer token found in request headers").WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
 			} else {
 				uid = AnonymousUserIdentity
 				allowChallenge = true
@@ -152,52 +242,16 @@ func (ir IncomingRequest) Authorize(cfg keppel.Configuration, ad keppel.AuthDriv
 		}
 
 		var err error
-		authz, err = ir.authorizeViaUserIdentity(uid, audience, db)
+		authz, err = ir.authorizeViaUserIdentity(cfg, uid, audience, db)
 		if err != nil {
-			return nil, keppel.AsRegistryV2Error(err)
+			return nil, false, false, false, keppel.AsRegistryV2Error(err)
 		}
 
 	default:
-		return nil, errMalformedAuthHeader
+		return nil, false, false, false, errMalformedAuthHeader
 	}
 
-	//check if requested scope is covered by Authorization
-	if !ir.PartialAccessAllowed {
-		for _, scope := range ir.Scopes {
-			//to ensure that GET /v2/ produces an auth challenge without any scopes,
-			//we do not render InfoAPIScope into auth challenges; conversely, since
-			//we don't challenge anyone to obtain tokens for InfoAPIScope, we need to
-			//skip this scope here as well
-			if InfoAPIScope.Contains(*scope) {
-				continue
-			}
-
-			if !authz.ScopeSet.Contains(*scope) {
-				//not covered -> generate error, possibly with auth challenge
-				rerr := keppel.ErrUnauthorized.With("no bearer token found in request headers")
-				if authz.UserIdentity.UserType() != keppel.AnonymousUser {
-					if tokenFound {
-						rerr = keppel.ErrDenied.With("token does not cover scope %s", scope.String())
-					} else {
-						rerr = keppel.ErrDenied.With("no permission for %s", scope.String())
-					}
-				}
-				if allowChallenge {
-					if tokenFound {
-						rerr = rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, "insufficient_scope"))
-					} else {
-						rerr = rerr.WithHeader("Www-Authenticate", ir.buildAuthChallenge(cfg, audience, ""))
-					}
-				}
-				if ir.CorrectlyReturn403 {
-					rerr = rerr.WithStatus(http.StatusForbidden)
-				}
-				return nil, rerr
-			}
-		}
-	}
-
-	return authz, nil
+	return authz, tokenFound, allowChallenge, false, nil
 }
 
 func (ir IncomingRequest) buildAuthChallenge(cfg keppel.Configuration, audience Audience, errorMessage string) string {
@@ -262,8 +316,8 @@ func safelyReturnRegistryError(rerr *keppel.RegistryV2Error) error {
 	return rerr
 }
 
-func (ir IncomingRequest) authorizeViaUserIdentity(uid keppel.UserIdentity, audience Audience, db *keppel.DB) (*Authorization, error) {
-	ss, err := filterAuthorized(ir, uid, audience, db)
+func (ir IncomingRequest) authorizeViaUserIdentity(cfg keppel.Configuration, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (*Authorization, error) {
+	ss, err := filterAuthorized(cfg, ir, uid, audience, db)
 	if err != nil {
 		return nil, err
 	}
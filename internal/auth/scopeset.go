@@ -78,35 +78,3 @@ func (ss ScopeSet) Flatten() []Scope {
 	}
 	return result
 }
-
-// AccountsWithCatalogAccess returns the names of all accounts whose contents
-// can be listed with the access level in this ScopeSet. If `markerAccountName`
-// is not empty, only accounts with `name > markerAccountName` will be returned.
-//
-// For use with the /v2/_catalog endpoint.
-func (ss ScopeSet) AccountsWithCatalogAccess(markerAccountName string) []string {
-	var result []string
-	for _, scope := range ss {
-		accountName, ok := isKeppelAccountViewScope(*scope)
-		if !ok {
-			continue
-		}
-		//when paginating, we don't need to care about accounts before the marker
-		if markerAccountName == "" || accountName >= markerAccountName {
-			result = append(result, accountName)
-		}
-	}
-	return result
-}
-
-func isKeppelAccountViewScope(s Scope) (string, bool) {
-	if s.ResourceType != "keppel_account" {
-		return "", false
-	}
-	for _, action := range s.Actions {
-		if action == "view" {
-			return s.ResourceName, true
-		}
-	}
-	return "", false
-}
@@ -109,6 +109,20 @@ func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audienc
 	}, nil
 }
 
+// isIssuedByKeppel checks whether the given token looks like it was issued by
+// a Keppel API, without validating it. This is used to decide which of
+// parseToken() and keppel.BearerTokenAuthDriver shall validate the token.
+func isIssuedByKeppel(tokenStr string) bool {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		//malformed tokens are also rejected by parseToken()
+		return true
+	}
+	//we always include our public key in the token header (see IssueToken)
+	_, exists := token.Header["jwk"]
+	return exists
+}
+
 // TokenResponse is the format expected by Docker in an auth response. The Token
 // field contains a Java Web Token (JWT).
 type TokenResponse struct {
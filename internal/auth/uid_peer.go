@@ -20,6 +20,8 @@
 package auth
 
 import (
+	"crypto/x509"
+	"database/sql"
 	"encoding/json"
 
 	"github.com/sapcc/go-bits/audittools"
@@ -97,3 +99,19 @@ func checkPeerCredentials(db *keppel.DB, peerHostName, password string) (*keppel
 	}
 	return nil, nil
 }
+
+// Returns the peer that presented the given TLS client certificate in
+// PeeringModeMTLS. If the certificate does not belong to any of our peers,
+// (nil, nil) is returned. Error values are only returned for unexpected
+// failures.
+func checkPeerCertificate(db *keppel.DB, cert *x509.Certificate) (*keppel.Peer, error) {
+	var peer keppel.Peer
+	err := db.SelectOne(&peer, `SELECT * FROM peers WHERE their_cert_fingerprint = $1`, keppel.CertificateFingerprint(cert))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
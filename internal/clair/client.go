@@ -20,15 +20,20 @@
 package clair
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/sapcc/go-bits/logg"
 )
 
 // Client is a client for accessing the Clair vulnerability scanning service.
@@ -37,6 +42,13 @@ type Client struct {
 	BaseURL url.URL
 	//PresharedKey is used to sign auth tokens for use with Clair.
 	PresharedKey []byte
+	//HTTPClient is used for all requests to Clair. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	//MaxRetries is how often a request is retried when Clair cannot be reached
+	//or responds with a server error (5xx). Between retries, we wait for
+	//RetryBackoff, and the wait time doubles after each retry.
+	MaxRetries   int
+	RetryBackoff time.Duration
 	//isEmptyManifest tracks when we did not submit a manifest because it does
 	//not contain any actual layers.
 	isEmptyManifest map[string]bool
@@ -48,7 +60,92 @@ func (c *Client) requestURL(pathElements ...string) string {
 	return requestURL.String()
 }
 
+// UnavailableError is returned by Client methods when Clair could not be
+// reached or responded with a server error, even after retrying. This usually
+// indicates a transient outage of Clair.
+type UnavailableError struct {
+	Message string
+}
+
+// Error implements the builtin/error interface.
+func (e UnavailableError) Error() string {
+	return e.Message
+}
+
+// HTTPClientOptions contains the configuration for NewHTTPClient.
+type HTTPClientOptions struct {
+	//Timeout applies to each individual request (including retries).
+	Timeout time.Duration
+	//CACertPath, if not empty, points to a PEM bundle of CA certificates that
+	//are trusted for Clair's server certificate (instead of the system roots).
+	CACertPath string
+	//ClientCertPath and ClientKeyPath, if not empty, point to a PEM-encoded
+	//client certificate and private key that are presented to Clair.
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+// NewHTTPClient builds an http.Client for use in Client.HTTPClient.
+func NewHTTPClient(opts HTTPClientOptions) (*http.Client, error) {
+	var t *http.Transport
+	if base, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = base.Clone()
+	} else {
+		t = &http.Transport{}
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if opts.CACertPath != "" {
+		buf, err := os.ReadFile(opts.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACertPath)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	if opts.ClientCertPath != "" || opts.ClientKeyPath != "" {
+		if opts.ClientCertPath == "" || opts.ClientKeyPath == "" {
+			return nil, errors.New("client certificate and private key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertPath, opts.ClientKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{Transport: t, Timeout: opts.Timeout}, nil
+}
+
 func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.doRequestOnce(req, respBody)
+		var uerr UnavailableError
+		if attempt >= c.MaxRetries || !errors.As(err, &uerr) {
+			return err
+		}
+		logg.Info("retrying in %s: %s", backoff.String(), err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+
+		//the request body was consumed by the previous attempt
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) doRequestOnce(req *http.Request, respBody interface{}) error {
 	//add auth token to request
 	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
@@ -71,9 +168,13 @@ func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
 	req.Header.Set("Accept", "application/json")
 
 	//run request
-	resp, err := http.DefaultClient.Do(req)
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
+		return UnavailableError{fmt.Sprintf("cannot %s %s: %s", req.Method, req.URL.String(), err.Error())}
 	}
 	respBodyBytes, err := io.ReadAll(resp.Body)
 	if err == nil {
@@ -82,10 +183,13 @@ func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
 		resp.Body.Close()
 	}
 	if err != nil {
-		return fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
+		return UnavailableError{fmt.Sprintf("cannot %s %s: %s", req.Method, req.URL.String(), err.Error())}
 	}
 
 	//expect 2xx response
+	if resp.StatusCode >= 500 {
+		return UnavailableError{fmt.Sprintf("cannot %s %s: got %d response: %q", req.Method, req.URL.String(), resp.StatusCode, string(respBodyBytes))}
+	}
 	if resp.StatusCode >= 299 {
 		return fmt.Errorf("cannot %s %s: got %d response: %q", req.Method, req.URL.String(), resp.StatusCode, string(respBodyBytes))
 	}
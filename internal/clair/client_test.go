@@ -0,0 +1,234 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package clair
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestClient builds a Client that talks to the given test server, with
+// fast retries to keep the test runtime low.
+func newTestClient(t *testing.T, srv *httptest.Server, httpClient *http.Client) *Client {
+	t.Helper()
+	baseURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &Client{
+		BaseURL:      *baseURL,
+		PresharedKey: []byte("doesnotmatter"),
+		HTTPClient:   httpClient,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	//this server fails with 503 until `failCount` reaches zero
+	var (
+		requestCount int
+		failCount    int
+		statusCode   = http.StatusServiceUnavailable
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if failCount > 0 {
+			failCount--
+			http.Error(w, "Clair is overloaded", statusCode)
+			return
+		}
+		w.Write([]byte(`{"state":"IndexFinished"}`)) //nolint:errcheck
+	}))
+	defer srv.Close()
+	c := newTestClient(t, srv, nil)
+
+	expect := func(initialFailCount, expectedRequestCount int, expectUnavailable bool) {
+		t.Helper()
+		requestCount = 0
+		failCount = initialFailCount
+		var result indexReport
+		err := c.SendRequest(http.MethodGet, "/indexer/api/v1/index_report/foo", &result)
+
+		var uerr UnavailableError
+		switch {
+		case expectUnavailable && !errors.As(err, &uerr):
+			t.Errorf("expected UnavailableError, but got %#v", err)
+		case !expectUnavailable && statusCode >= 500 && err != nil:
+			t.Errorf("expected success, but got: %s", err.Error())
+		case !expectUnavailable && statusCode < 500 && (err == nil || errors.As(err, &uerr)):
+			t.Errorf("expected non-transient error, but got %#v", err)
+		}
+		if requestCount != expectedRequestCount {
+			t.Errorf("expected %d requests, but got %d", expectedRequestCount, requestCount)
+		}
+	}
+
+	//transient 503s are retried
+	expect(0, 1, false)
+	expect(2, 3, false)
+	expect(3, 4, false)
+	//persistent 503s eventually give up
+	expect(10, 4, true)
+	//4xx errors are not retried
+	statusCode = http.StatusBadRequest
+	expect(10, 1, false)
+}
+
+func TestClientRetriesOnTimeout(t *testing.T) {
+	requestCount := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		//hang until the client gives up
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	httpClient, err := NewHTTPClient(HTTPClientOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c := newTestClient(t, srv, httpClient)
+
+	var result indexReport
+	err = c.SendRequest(http.MethodGet, "/indexer/api/v1/index_report/foo", &result)
+	var uerr UnavailableError
+	if !errors.As(err, &uerr) {
+		t.Errorf("expected UnavailableError, but got %#v", err)
+	}
+	if requestCount != 4 {
+		t.Errorf("expected 4 requests, but got %d", requestCount)
+	}
+}
+
+func writeTestCertificate(t *testing.T, dir, name string, extKeyUsage x509.ExtKeyUsage) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{extKeyUsage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return certPath, keyPath
+}
+
+func TestClientTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCertPath, clientKeyPath := writeTestCertificate(t, dir, "keppel", x509.ExtKeyUsageClientAuth)
+	clientCertPEM, err := os.ReadFile(clientCertPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCertPEM)
+
+	//this server requires our client certificate
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"state":"IndexFinished"}`)) //nolint:errcheck
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPath := filepath.Join(dir, "ca.pem")
+	err = os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := func(opts HTTPClientOptions, expectSuccess bool) {
+		t.Helper()
+		httpClient, err := NewHTTPClient(opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		c := newTestClient(t, srv, httpClient)
+		c.MaxRetries = 0
+		var result indexReport
+		err = c.SendRequest(http.MethodGet, "/indexer/api/v1/index_report/foo", &result)
+		if expectSuccess && err != nil {
+			t.Errorf("expected success with %#v, but got: %s", opts, err.Error())
+		}
+		if !expectSuccess && err == nil {
+			t.Errorf("expected error with %#v, but got success", opts)
+		}
+	}
+
+	//server certificate is only accepted with the custom CA bundle, and the
+	//server only accepts our client certificate
+	expect(HTTPClientOptions{Timeout: time.Second, CACertPath: caPath, ClientCertPath: clientCertPath, ClientKeyPath: clientKeyPath}, true)
+	expect(HTTPClientOptions{Timeout: time.Second, ClientCertPath: clientCertPath, ClientKeyPath: clientKeyPath}, false)
+	expect(HTTPClientOptions{Timeout: time.Second, CACertPath: caPath}, false)
+
+	//invalid configurations are rejected
+	_, err = NewHTTPClient(HTTPClientOptions{ClientCertPath: clientCertPath})
+	if err == nil {
+		t.Error("expected error when client key is missing, but got none")
+	}
+	_, err = NewHTTPClient(HTTPClientOptions{CACertPath: clientKeyPath})
+	if err == nil {
+		t.Error("expected error for CA bundle without certificates, but got none")
+	}
+}
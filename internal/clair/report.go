@@ -50,12 +50,72 @@ func (r VulnerabilityReport) VulnerabilityStatus() VulnerabilityStatus {
 	return MergeVulnerabilityStatuses(sevs...)
 }
 
+// FixabilityCounts appears in type FixabilitySummary.
+type FixabilityCounts struct {
+	Fixable   uint64 `json:"fixable"`
+	Unfixable uint64 `json:"unfixable"`
+}
+
+// FixabilitySummary counts the vulnerabilities in a report by severity and by
+// whether a fixed version of the affected package exists.
+type FixabilitySummary map[VulnerabilityStatus]FixabilityCounts
+
+// FixabilitySummary returns a summary of the vulnerabilities in this report.
+func (r VulnerabilityReport) FixabilitySummary() FixabilitySummary {
+	result := make(FixabilitySummary)
+	for _, v := range r.Vulnerabilities {
+		if v == nil {
+			continue
+		}
+		counts := result[v.NormalizedSeverity]
+		if v.IsFixable() {
+			counts.Fixable++
+		} else {
+			counts.Unfixable++
+		}
+		result[v.NormalizedSeverity] = counts
+	}
+	return result
+}
+
+// WithFixabilityAnnotations returns a copy of this report where each
+// vulnerability has an additional field "fixable" that indicates whether a
+// fixed version of the affected package exists. The original report is not
+// modified.
+func (r VulnerabilityReport) WithFixabilityAnnotations() VulnerabilityReport {
+	vulns := make(map[string]*Vulnerability, len(r.Vulnerabilities))
+	for id, v := range r.Vulnerabilities {
+		if v == nil {
+			vulns[id] = nil
+			continue
+		}
+		contents := make(map[string]interface{}, len(v.Contents)+1)
+		for key, value := range v.Contents {
+			contents[key] = value
+		}
+		contents["fixable"] = v.IsFixable()
+		vulns[id] = &Vulnerability{
+			Contents:           contents,
+			NormalizedSeverity: v.NormalizedSeverity,
+			FixedInVersion:     v.FixedInVersion,
+		}
+	}
+	r.Vulnerabilities = vulns
+	return r
+}
+
 // Vulnerability appears in type VulnerabilityReport.
 type Vulnerability struct {
 	//all data relating to this vulnerability (for serializing into JSON)
 	Contents map[string]interface{}
 	//some individual fields from .Contents, prepared for internal processing
 	NormalizedSeverity VulnerabilityStatus
+	FixedInVersion     string
+}
+
+// IsFixable returns whether a fixed version of the affected package exists.
+func (v Vulnerability) IsFixable() bool {
+	return v.FixedInVersion != ""
 }
 
 // MarshalJSON implements the json.Marshaler interface.
@@ -75,6 +135,7 @@ func (v *Vulnerability) UnmarshalJSON(buf []byte) error {
 
 	var parsed struct {
 		NormalizedSeverity VulnerabilityStatus `json:"normalized_severity"`
+		FixedInVersion     string              `json:"fixed_in_version"`
 	}
 	err = json.Unmarshal(buf, &parsed)
 	if err != nil {
@@ -82,6 +143,7 @@ func (v *Vulnerability) UnmarshalJSON(buf []byte) error {
 	}
 
 	v.NormalizedSeverity = parsed.NormalizedSeverity
+	v.FixedInVersion = parsed.FixedInVersion
 	return nil
 }
 
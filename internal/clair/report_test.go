@@ -0,0 +1,67 @@
+/*******************************************************************************
+*
+* Copyright 2021 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package clair
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFixabilitySummary(t *testing.T) {
+	var report VulnerabilityReport
+	err := json.Unmarshal([]byte(`{
+		"manifest_hash": "sha256:3ee5f0d83bf791f0fb4d750a5719ce19d6d352ef7e5a4264e4b760f0f9c15014",
+		"vulnerabilities": {
+			"1": { "name": "CVE-2023-0001", "normalized_severity": "High", "fixed_in_version": "1.2.3-1" },
+			"2": { "name": "CVE-2023-0002", "normalized_severity": "High", "fixed_in_version": "" },
+			"3": { "name": "CVE-2023-0003", "normalized_severity": "High" },
+			"4": { "name": "CVE-2023-0004", "normalized_severity": "Low", "fixed_in_version": "0:4.5.6" },
+			"5": { "name": "CVE-2023-0005", "normalized_severity": "Critical", "fixed_in_version": "" }
+		}
+	}`), &report)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := FixabilitySummary{
+		HighSeverity:     {Fixable: 1, Unfixable: 2},
+		LowSeverity:      {Fixable: 1, Unfixable: 0},
+		CriticalSeverity: {Fixable: 0, Unfixable: 1},
+	}
+	actual := report.FixabilitySummary()
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected summary %#v, but got %#v", expected, actual)
+	}
+
+	//annotations are added to a copy of the report, the original stays intact
+	annotated := report.WithFixabilityAnnotations()
+	for id, expectedFixable := range map[string]bool{"1": true, "2": false, "3": false, "4": true, "5": false} {
+		if actual := annotated.Vulnerabilities[id].Contents["fixable"]; actual != expectedFixable {
+			t.Errorf("expected vulnerability %s to have fixable = %t, but got %#v", id, expectedFixable, actual)
+		}
+		if _, exists := report.Vulnerabilities[id].Contents["fixable"]; exists {
+			t.Errorf("expected original vulnerability %s to not be annotated", id)
+		}
+	}
+	if annotated.VulnerabilityStatus() != CriticalSeverity {
+		t.Errorf("expected annotated report to have vulnerability status %s, but got %s", CriticalSeverity, annotated.VulnerabilityStatus())
+	}
+}
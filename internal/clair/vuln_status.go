@@ -61,6 +61,19 @@ var sevMap = map[VulnerabilityStatus]uint{
 	Defcon1Severity:                8,
 }
 
+// IsValid checks whether this is one of the predefined VulnerabilityStatus values.
+func (s VulnerabilityStatus) IsValid() bool {
+	_, exists := sevMap[s]
+	return exists
+}
+
+// IsAtLeast checks whether this VulnerabilityStatus describes actual findings
+// (i.e. not Error, Pending or Unsupported) with a severity that is equal to or
+// higher than the given one.
+func (s VulnerabilityStatus) IsAtLeast(threshold VulnerabilityStatus) bool {
+	return sevMap[s] > 0 && sevMap[s] >= sevMap[threshold]
+}
+
 // HasReport checks whether a manifest with this VulnerabilityStatus has a
 // vulnerability report available.
 func (s VulnerabilityStatus) HasReport() bool {
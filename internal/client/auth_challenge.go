@@ -91,7 +91,7 @@ func ParseAuthChallenge(hdr http.Header) (AuthChallenge, error) {
 }
 
 // GetToken obtains a token that satisfies this challenge.
-func (c AuthChallenge) GetToken(userName, password string) (string, error) {
+func (c AuthChallenge) GetToken(client *http.Client, userName, password string) (string, error) {
 	req, err := http.NewRequest(http.MethodGet, c.Realm, http.NoBody)
 	if err != nil {
 		return "", err
@@ -104,7 +104,7 @@ func (c AuthChallenge) GetToken(userName, password string) (string, error) {
 	q.Set("scope", c.Scope)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
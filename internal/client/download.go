@@ -19,6 +19,8 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -29,9 +31,23 @@ import (
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
+// DownloadBlobOpts appears in func DownloadBlob.
+type DownloadBlobOpts struct {
+	//If true, the returned reader computes the digest of the streamed content,
+	//and its Close() method returns an error if the content does not match the
+	//requested digest (or if the content was not read completely).
+	VerifyDigest bool
+	//If greater than zero, the returned reader transparently recovers from up
+	//to this many transient errors (e.g. connection resets) while reading by
+	//resuming the download with a Range request.
+	MaxRetries int
+}
+
 // DownloadBlob fetches a blob's contents from this repository. If an error is
 // returned, it's usually a *keppel.RegistryV2Error.
-func (c *RepoClient) DownloadBlob(blobDigest digest.Digest) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
+//
+// If opts is nil, the response body is returned as-is.
+func (c *RepoClient) DownloadBlob(blobDigest digest.Digest, opts *DownloadBlobOpts) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
 	resp, err := c.doRequest(repoRequest{
 		Method:       "GET",
 		Path:         "blobs/" + blobDigest.String(),
@@ -45,41 +61,154 @@ func (c *RepoClient) DownloadBlob(blobDigest digest.Digest) (contents io.ReadClo
 		resp.Body.Close()
 		return nil, 0, err
 	}
-	return resp.Body, sizeBytes, nil
+	if opts == nil || (!opts.VerifyDigest && opts.MaxRetries <= 0) {
+		return resp.Body, sizeBytes, nil
+	}
+
+	r := &blobReader{
+		client:      c,
+		blobDigest:  blobDigest,
+		sizeBytes:   sizeBytes,
+		body:        resp.Body,
+		retriesLeft: opts.MaxRetries,
+	}
+	if opts.VerifyDigest {
+		r.digester = blobDigest.Algorithm().Digester()
+	}
+	return r, sizeBytes, nil
+}
+
+// blobReader is the io.ReadCloser returned by DownloadBlob when options are given.
+type blobReader struct {
+	client      *RepoClient
+	blobDigest  digest.Digest
+	sizeBytes   uint64
+	body        io.ReadCloser
+	bytesRead   uint64
+	retriesLeft int
+	digester    digest.Digester //only set if digest verification was requested
+}
+
+// Read implements the io.Reader interface.
+func (r *blobReader) Read(buf []byte) (int, error) {
+	for {
+		n, err := r.body.Read(buf)
+		r.bytesRead += uint64(n)
+		if r.digester != nil {
+			r.digester.Hash().Write(buf[:n]) //never returns an error
+		}
+
+		//a premature EOF means that the connection was closed before the full blob was transferred
+		if err == io.EOF && r.bytesRead < r.sizeBytes {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF || r.retriesLeft <= 0 {
+			return n, err
+		}
+
+		//try to resume the download where the previous attempt broke off
+		r.retriesLeft--
+		resumeErr := r.resume()
+		if resumeErr != nil {
+			return n, fmt.Errorf("%w (and could not resume download: %s)", err, resumeErr.Error())
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *blobReader) resume() error {
+	r.body.Close()
+	resp, err := r.client.doRequest(repoRequest{
+		Method:           "GET",
+		Path:             "blobs/" + r.blobDigest.String(),
+		Headers:          http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.bytesRead)}},
+		ExpectStatus:     http.StatusPartialContent,
+		AlsoAcceptStatus: http.StatusOK,
+	})
+	if err != nil {
+		//make sure that Close() does not close the previous body twice
+		r.body = http.NoBody
+		return err
+	}
+	r.body = resp.Body
+
+	//if the server does not support Range requests, skip over the part that we already have
+	if resp.StatusCode == http.StatusOK {
+		_, err := io.CopyN(io.Discard, r.body, int64(r.bytesRead))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// DownloadManifestOpts appears in func DownloadManifest.
+// Close implements the io.Closer interface.
+func (r *blobReader) Close() error {
+	err := r.body.Close()
+	if err != nil || r.digester == nil {
+		return err
+	}
+	actualDigest := r.digester.Digest()
+	if r.bytesRead != r.sizeBytes || actualDigest != r.blobDigest {
+		return fmt.Errorf("digest mismatch for downloaded blob: expected %s, but got %s after reading %d of %d bytes",
+			r.blobDigest, actualDigest, r.bytesRead, r.sizeBytes)
+	}
+	return nil
+}
+
+// ErrManifestNotModified is returned by DownloadManifest() when
+// DownloadManifestOpts.IfNoneMatch is given and the server reports that the
+// manifest has not changed.
+var ErrManifestNotModified = errors.New("manifest not modified")
+
+// DownloadManifestOpts appears in func DownloadManifest and CheckManifest.
 type DownloadManifestOpts struct {
 	DoNotCountTowardsLastPulled bool
 	ExtraHeaders                http.Header
+	//If not empty, DownloadManifest() makes a conditional request and returns
+	//ErrManifestNotModified if the manifest still has this digest.
+	IfNoneMatch digest.Digest
 }
 
-// DownloadManifest fetches a manifest from this repository. If an error is
-// returned, it's usually a *keppel.RegistryV2Error.
-func (c *RepoClient) DownloadManifest(reference keppel.ManifestReference, opts *DownloadManifestOpts) (contents []byte, mediaType string, returnErr error) {
-	if opts == nil {
-		opts = &DownloadManifestOpts{}
-	}
-
+func (opts DownloadManifestOpts) buildHeaders() http.Header {
 	hdr := http.Header{"Accept": distribution.ManifestMediaTypes()}
 	if opts.DoNotCountTowardsLastPulled {
 		hdr.Set("X-Keppel-No-Count-Towards-Last-Pulled", "1")
 	}
+	if opts.IfNoneMatch != "" {
+		hdr.Set("If-None-Match", fmt.Sprintf("%q", opts.IfNoneMatch.String()))
+	}
 	for k, v := range opts.ExtraHeaders {
 		if len(v) > 0 {
 			hdr[k] = v
 		}
 	}
+	return hdr
+}
+
+// DownloadManifest fetches a manifest from this repository. If an error is
+// returned, it's usually a *keppel.RegistryV2Error.
+func (c *RepoClient) DownloadManifest(reference keppel.ManifestReference, opts *DownloadManifestOpts) (contents []byte, mediaType string, returnErr error) {
+	if opts == nil {
+		opts = &DownloadManifestOpts{}
+	}
 
 	resp, err := c.doRequest(repoRequest{
-		Method:       "GET",
-		Path:         "manifests/" + reference.String(),
-		Headers:      hdr,
-		ExpectStatus: http.StatusOK,
+		Method:           "GET",
+		Path:             "manifests/" + reference.String(),
+		Headers:          opts.buildHeaders(),
+		ExpectStatus:     http.StatusOK,
+		AlsoAcceptStatus: http.StatusNotModified,
 	})
 	if err != nil {
 		return nil, "", err
 	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, "", ErrManifestNotModified
+	}
 
 	respBytes, err := io.ReadAll(resp.Body)
 	if err == nil {
@@ -93,3 +222,56 @@ func (c *RepoClient) DownloadManifest(reference keppel.ManifestReference, opts *
 
 	return respBytes, resp.Header.Get("Content-Type"), nil
 }
+
+// ManifestInfo is returned by CheckManifest.
+type ManifestInfo struct {
+	Digest    digest.Digest
+	MediaType string
+	SizeBytes uint64
+}
+
+// CheckManifest checks whether a manifest exists in this repository, and
+// returns its metadata without downloading its contents. If an error is
+// returned, it's usually a *keppel.RegistryV2Error. The IfNoneMatch option is
+// ignored.
+func (c *RepoClient) CheckManifest(reference keppel.ManifestReference, opts *DownloadManifestOpts) (ManifestInfo, error) {
+	if opts == nil {
+		opts = &DownloadManifestOpts{}
+	}
+	hdr := opts.buildHeaders()
+	hdr.Del("If-None-Match")
+
+	resp, err := c.doRequest(repoRequest{
+		Method:       "HEAD",
+		Path:         "manifests/" + reference.String(),
+		Headers:      hdr,
+		ExpectStatus: http.StatusOK,
+	})
+	if err != nil {
+		//responses to HEAD do not have a body that could contain a RegistryV2Error
+		var uerr unexpectedStatusCodeError
+		if errors.As(err, &uerr) && uerr.actualStatusCode == http.StatusNotFound {
+			return ManifestInfo{}, keppel.ErrManifestUnknown.With("").WithStatus(http.StatusNotFound)
+		}
+		return ManifestInfo{}, err
+	}
+	resp.Body.Close()
+
+	var info ManifestInfo
+	if digestStr := resp.Header.Get("Docker-Content-Digest"); digestStr != "" {
+		info.Digest, err = digest.Parse(digestStr)
+		if err != nil {
+			return ManifestInfo{}, fmt.Errorf("malformed Docker-Content-Digest header in response to HEAD %s: %w", reference, err)
+		}
+	} else if reference.IsDigest() {
+		info.Digest = reference.Digest
+	} else {
+		return ManifestInfo{}, fmt.Errorf("missing Docker-Content-Digest header in response to HEAD %s", reference)
+	}
+	info.MediaType = resp.Header.Get("Content-Type")
+	info.SizeBytes, err = strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return ManifestInfo{}, fmt.Errorf("malformed Content-Length header in response to HEAD %s: %w", reference, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,279 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+const (
+	testManifestContents  = `{"schemaVersion":2}`
+	testManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var testManifestDigest = digest.FromString(testManifestContents)
+
+// stubRegistry serves a single manifest under the tag "latest" in the repo "foo".
+type stubRegistry struct {
+	LastRequest *http.Request
+}
+
+func (s *stubRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.LastRequest = r
+	if r.URL.Path != "/v2/foo/manifests/latest" && r.URL.Path != "/v2/foo/manifests/"+testManifestDigest.String() {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keppel.ErrManifestUnknown.With("").WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", testManifestDigest.String())
+	w.Header().Set("Etag", strconv.Quote(testManifestDigest.String()))
+	if r.Header.Get("If-None-Match") == strconv.Quote(testManifestDigest.String()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", testManifestMediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(testManifestContents)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(testManifestContents))
+	}
+}
+
+func setupStubRegistry(t *testing.T) (*stubRegistry, *RepoClient) {
+	s := &stubRegistry{}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "foo",
+	}
+	return s, c
+}
+
+func TestCheckManifest(t *testing.T) {
+	s, c := setupStubRegistry(t)
+
+	//200: metadata is reported without downloading the body
+	info, err := c.CheckManifest(keppel.ManifestReference{Tag: "latest"}, &DownloadManifestOpts{DoNotCountTowardsLastPulled: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := ManifestInfo{
+		Digest:    testManifestDigest,
+		MediaType: testManifestMediaType,
+		SizeBytes: uint64(len(testManifestContents)),
+	}
+	if info != expected {
+		t.Errorf("expected %#v, but got %#v", expected, info)
+	}
+	if s.LastRequest.Method != http.MethodHead {
+		t.Errorf("expected HEAD request, but got %s", s.LastRequest.Method)
+	}
+	if s.LastRequest.Header.Get("X-Keppel-No-Count-Towards-Last-Pulled") != "1" {
+		t.Error("expected X-Keppel-No-Count-Towards-Last-Pulled header to be sent on HEAD")
+	}
+
+	//404: reported as MANIFEST_UNKNOWN even though HEAD responses have no body
+	_, err = c.CheckManifest(keppel.ManifestReference{Tag: "missing"}, nil)
+	var rerr *keppel.RegistryV2Error
+	if !errors.As(err, &rerr) || rerr.Code != keppel.ErrManifestUnknown {
+		t.Errorf("expected %s error, but got %v", keppel.ErrManifestUnknown, err)
+	}
+}
+
+func TestDownloadManifestConditional(t *testing.T) {
+	s, c := setupStubRegistry(t)
+	ref := keppel.ManifestReference{Tag: "latest"}
+
+	//200: without If-None-Match, or with a non-matching digest
+	for _, opts := range []*DownloadManifestOpts{nil, {IfNoneMatch: digest.FromString("something else")}} {
+		contents, mediaType, err := c.DownloadManifest(ref, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(contents) != testManifestContents || mediaType != testManifestMediaType {
+			t.Errorf("unexpected manifest download result: %q (%s)", string(contents), mediaType)
+		}
+	}
+
+	//304: sentinel error is returned
+	_, _, err := c.DownloadManifest(ref, &DownloadManifestOpts{
+		IfNoneMatch:                 testManifestDigest,
+		DoNotCountTowardsLastPulled: true,
+	})
+	if err != ErrManifestNotModified {
+		t.Errorf("expected ErrManifestNotModified, but got %v", err)
+	}
+	if s.LastRequest.Header.Get("X-Keppel-No-Count-Towards-Last-Pulled") != "1" {
+		t.Error("expected X-Keppel-No-Count-Towards-Last-Pulled header to be sent on conditional GET")
+	}
+
+	//404: RegistryV2Error from the response body is reported
+	_, _, err = c.DownloadManifest(keppel.ManifestReference{Tag: "missing"}, &DownloadManifestOpts{IfNoneMatch: testManifestDigest})
+	var rerr *keppel.RegistryV2Error
+	if !errors.As(err, &rerr) || rerr.Code != keppel.ErrManifestUnknown {
+		t.Errorf("expected %s error, but got %v", keppel.ErrManifestUnknown, err)
+	}
+}
+
+// stubBlobServer serves a single blob in the repo "foo". The first
+// `ResetCount` responses are cut off after half of the requested content.
+type stubBlobServer struct {
+	Contents    []byte
+	Digest      digest.Digest
+	ResetCount  int
+	RangeHeader []string
+}
+
+func (s *stubBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/foo/blobs/"+s.Digest.String() {
+		keppel.ErrBlobUnknown.With("").WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+	s.RangeHeader = append(s.RangeHeader, r.Header.Get("Range"))
+
+	contents := s.Contents
+	status := http.StatusOK
+	if rangeStr := r.Header.Get("Range"); rangeStr != "" {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeStr, "bytes="), "-"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contents = contents[offset:]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+	w.WriteHeader(status)
+	if s.ResetCount == 0 {
+		w.Write(contents)
+		return
+	}
+
+	//simulate a connection reset in the middle of the transfer
+	s.ResetCount--
+	w.Write(contents[:len(contents)/2])
+	w.(http.Flusher).Flush()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func setupStubBlobServer(t *testing.T, contents []byte) (*stubBlobServer, *RepoClient) {
+	s := &stubBlobServer{Contents: contents, Digest: digest.FromBytes(contents)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "foo",
+	}
+	return s, c
+}
+
+func downloadBlobForTest(c *RepoClient, blobDigest digest.Digest, opts *DownloadBlobOpts) (contents []byte, readErr, closeErr error) {
+	readCloser, _, err := c.DownloadBlob(blobDigest, opts)
+	if err != nil {
+		return nil, err, nil
+	}
+	contents, readErr = io.ReadAll(readCloser)
+	closeErr = readCloser.Close()
+	return contents, readErr, closeErr
+}
+
+func TestDownloadBlob(t *testing.T) {
+	blobContents := []byte(strings.Repeat("keppel", 10000))
+	s, c := setupStubBlobServer(t, blobContents)
+
+	//clean download, with and without options
+	for _, opts := range []*DownloadBlobOpts{nil, {VerifyDigest: true, MaxRetries: 3}} {
+		contents, readErr, closeErr := downloadBlobForTest(c, s.Digest, opts)
+		if readErr != nil || closeErr != nil {
+			t.Fatalf("unexpected errors: %v, %v", readErr, closeErr)
+		}
+		if !bytes.Equal(contents, blobContents) {
+			t.Errorf("expected %d bytes of blob contents, but got %d bytes", len(blobContents), len(contents))
+		}
+	}
+
+	//digest mismatch: the server serves something else than requested
+	s.Contents = []byte("something else")
+	s.Digest = digest.FromBytes(blobContents)
+	_, readErr, closeErr := downloadBlobForTest(c, s.Digest, &DownloadBlobOpts{VerifyDigest: true})
+	if readErr != nil {
+		t.Errorf("unexpected read error: %s", readErr.Error())
+	}
+	if closeErr == nil || !strings.Contains(closeErr.Error(), "digest mismatch") {
+		t.Errorf("expected digest mismatch error on Close(), but got %v", closeErr)
+	}
+	//without verification, the mismatch goes unnoticed (same as before the option existed)
+	_, readErr, closeErr = downloadBlobForTest(c, s.Digest, nil)
+	if readErr != nil || closeErr != nil {
+		t.Errorf("unexpected errors: %v, %v", readErr, closeErr)
+	}
+}
+
+func TestDownloadBlobResumesAfterReset(t *testing.T) {
+	blobContents := []byte(strings.Repeat("keppel", 10000))
+	s, c := setupStubBlobServer(t, blobContents)
+
+	//two resets are recovered from by resuming the download with Range requests
+	s.ResetCount = 2
+	contents, readErr, closeErr := downloadBlobForTest(c, s.Digest, &DownloadBlobOpts{VerifyDigest: true, MaxRetries: 2})
+	if readErr != nil || closeErr != nil {
+		t.Fatalf("unexpected errors: %v, %v", readErr, closeErr)
+	}
+	if !bytes.Equal(contents, blobContents) {
+		t.Errorf("expected %d bytes of blob contents, but got %d bytes", len(blobContents), len(contents))
+	}
+	expectedRanges := []string{"", fmt.Sprintf("bytes=%d-", len(blobContents)/2), fmt.Sprintf("bytes=%d-", len(blobContents)/2+len(blobContents)/4)}
+	if !reflect.DeepEqual(s.RangeHeader, expectedRanges) {
+		t.Errorf("expected Range headers %#v, but got %#v", expectedRanges, s.RangeHeader)
+	}
+
+	//when the retries are exhausted, the error is reported, and the verification fails
+	s.ResetCount = 2
+	_, readErr, closeErr = downloadBlobForTest(c, s.Digest, &DownloadBlobOpts{VerifyDigest: true, MaxRetries: 1})
+	if readErr == nil {
+		t.Error("expected read error, but got none")
+	}
+	if closeErr == nil || !strings.Contains(closeErr.Error(), "digest mismatch") {
+		t.Errorf("expected digest mismatch error on Close(), but got %v", closeErr)
+	}
+}
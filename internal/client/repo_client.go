@@ -40,16 +40,30 @@ type RepoClient struct {
 	UserName string
 	Password string
 
+	//if nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
 	//auth state
 	token string
 }
 
 type repoRequest struct {
-	Method       string
-	Path         string
+	Method string
+	Path   string
+	//if not empty, this is used instead of Path (e.g. for following Location headers)
+	URL          string
 	Headers      http.Header
 	Body         io.ReadSeeker
 	ExpectStatus int
+	//if not 0, this status code is accepted in addition to ExpectStatus
+	AlsoAcceptStatus int
+}
+
+func (c *RepoClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
 }
 
 func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
@@ -57,8 +71,11 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 		c.Scheme = "https"
 	}
 
-	uri := fmt.Sprintf("%s://%s/v2/%s/%s",
-		c.Scheme, c.Host, c.RepoName, r.Path)
+	uri := r.URL
+	if uri == "" {
+		uri = fmt.Sprintf("%s://%s/v2/%s/%s",
+			c.Scheme, c.Host, c.RepoName, r.Path)
+	}
 
 	//send GET request for manifest
 	req, err := http.NewRequest(r.Method, uri, r.Body)
@@ -71,7 +88,7 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 	if c.token != "" {
 		req.Header.Set("Authorization", "Bearer "+c.token)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return nil, keppel.ErrUnavailable.With(err.Error())
 	}
@@ -82,7 +99,7 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 		if err != nil {
 			return nil, fmt.Errorf("cannot parse auth challenge from 401 response to %s %s: %s", r.Method, uri, err.Error())
 		}
-		c.token, err = authChallenge.GetToken(c.UserName, c.Password)
+		c.token, err = authChallenge.GetToken(c.httpClient(), c.UserName, c.Password)
 		if err != nil {
 			return nil, fmt.Errorf("authentication failed: %s", err.Error())
 		}
@@ -105,12 +122,15 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 			reqWithToken.Header[k] = v
 		}
 		reqWithToken.Header.Set("Authorization", "Bearer "+c.token)
-		resp, err = http.DefaultClient.Do(reqWithToken)
+		resp, err = c.httpClient().Do(reqWithToken)
 		if err != nil {
 			return nil, keppel.ErrUnavailable.With(err.Error())
 		}
 	}
 
+	if r.AlsoAcceptStatus != 0 && resp.StatusCode == r.AlsoAcceptStatus {
+		return resp, nil
+	}
 	if resp.StatusCode != r.ExpectStatus {
 		//on error, try to parse the upstream RegistryV2Error so that we can proxy it
 		//through to the client correctly
@@ -132,7 +152,7 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 			}
 		}
 		resp.Body.Close()
-		return nil, unexpectedStatusCodeError{req, http.StatusOK, resp.Status}
+		return nil, unexpectedStatusCodeError{req, http.StatusOK, resp.StatusCode, resp.Status}
 	}
 
 	return resp, nil
@@ -141,9 +161,10 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 ////////////////////////////////////////////////////////////////////////////////
 
 type unexpectedStatusCodeError struct {
-	req            *http.Request
-	expectedStatus int
-	actualStatus   string
+	req              *http.Request
+	expectedStatus   int
+	actualStatusCode int
+	actualStatus     string
 }
 
 func (e unexpectedStatusCodeError) Error() string {
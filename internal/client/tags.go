@@ -0,0 +1,112 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var linkNextRx = regexp.MustCompile(`^<([^>]+)>;\s*rel="next"$`)
+
+// ListTags returns the names of all tags in this repository. If the server
+// paginates the result, all pages are retrieved. If an error is returned,
+// it's usually a *keppel.RegistryV2Error.
+func (c *RepoClient) ListTags() ([]string, error) {
+	var (
+		result   []string
+		nextURL  string
+		pageData struct {
+			Tags []string `json:"tags"`
+		}
+	)
+	for {
+		resp, err := c.doRequest(repoRequest{
+			Method:       "GET",
+			Path:         "tags/list",
+			URL:          nextURL,
+			ExpectStatus: http.StatusOK,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pageData.Tags = nil
+		err = json.NewDecoder(resp.Body).Decode(&pageData)
+		if err == nil {
+			err = resp.Body.Close()
+		} else {
+			resp.Body.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse response to GET %s: %w", resp.Request.URL.String(), err)
+		}
+		result = append(result, pageData.Tags...)
+
+		//follow the Link header to the next page, if any
+		linkHeader := resp.Header.Get("Link")
+		if linkHeader == "" {
+			return result, nil
+		}
+		match := linkNextRx.FindStringSubmatch(linkHeader)
+		if match == nil {
+			return nil, fmt.Errorf("cannot parse Link header in response to GET %s: %q", resp.Request.URL.String(), linkHeader)
+		}
+		linkURL, err := url.Parse(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse Link header in response to GET %s: %w", resp.Request.URL.String(), err)
+		}
+		nextURL = resp.Request.URL.ResolveReference(linkURL).String()
+	}
+}
+
+// DeleteTag deletes a tag from this repository. The manifest that the tag
+// points to is not deleted. If an error is returned, it's usually a
+// *keppel.RegistryV2Error.
+//
+// NOTE: The registry API does not have a standardized way to delete tags, so
+// this only works with Keppel and other registries that accept
+// DELETE /v2/<repo>/manifests/<tag>.
+func (c *RepoClient) DeleteTag(tagName string) error {
+	return c.deleteManifestReference(keppel.ManifestReference{Tag: tagName})
+}
+
+// DeleteManifest deletes a manifest (and all tags pointing to it) from this
+// repository. If an error is returned, it's usually a *keppel.RegistryV2Error.
+func (c *RepoClient) DeleteManifest(manifestDigest digest.Digest) error {
+	return c.deleteManifestReference(keppel.ManifestReference{Digest: manifestDigest})
+}
+
+func (c *RepoClient) deleteManifestReference(reference keppel.ManifestReference) error {
+	resp, err := c.doRequest(repoRequest{
+		Method:       "DELETE",
+		Path:         "manifests/" + reference.String(),
+		ExpectStatus: http.StatusAccepted,
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,178 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// stubTagsRegistry implements just enough of the registry API for ListTags(),
+// DeleteTag() and DeleteManifest(), including the token auth workflow.
+type stubTagsRegistry struct {
+	Tags []string
+	//how many tags are returned per page
+	PageSize int
+
+	Requests []string
+}
+
+func (s *stubTagsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.Header.Get("Authorization") != keppel.BuildBasicAuthHeader("alice", "swordfish") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"valid-token"}`)) //nolint:errcheck
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer valid-token" {
+		w.Header().Set("Www-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="registry.example.org",scope="repository:test1/foo:pull,delete"`)
+		keppel.ErrUnauthorized.With("no bearer token found in request headers").WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+	s.Requests = append(s.Requests, r.Method+" "+r.URL.RequestURI())
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/test1/foo/tags/list":
+		//paginate by index into s.Tags
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			for idx, tag := range s.Tags {
+				if tag == last {
+					start = idx + 1
+				}
+			}
+		}
+		end := start + s.PageSize
+		if end < len(s.Tags) {
+			w.Header().Set("Link", `</v2/test1/foo/tags/list?last=`+s.Tags[end-1]+`&n=2>; rel="next"`)
+		} else {
+			end = len(s.Tags)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "test1/foo", "tags": s.Tags[start:end]}) //nolint:errcheck
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v2/test1/foo/manifests/"):
+		ref := strings.TrimPrefix(r.URL.Path, "/v2/test1/foo/manifests/")
+		if ref == "missing" {
+			keppel.ErrManifestUnknown.With("no such manifest").WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func setupTagsTest(t *testing.T, s *stubTagsRegistry) *RepoClient {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "test1/foo",
+		UserName: "alice",
+		Password: "swordfish",
+	}
+}
+
+func TestListTags(t *testing.T) {
+	s := &stubTagsRegistry{
+		Tags:     []string{"latest", "v1.0", "v1.1", "v2.0", "v2.1"},
+		PageSize: 2,
+	}
+	c := setupTagsTest(t, s)
+
+	tags, err := c.ListTags()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(tags, s.Tags) {
+		t.Errorf("expected tags %#v, but got %#v", s.Tags, tags)
+	}
+	expectedRequests := []string{
+		"GET /v2/test1/foo/tags/list",
+		"GET /v2/test1/foo/tags/list?last=v1.0&n=2",
+		"GET /v2/test1/foo/tags/list?last=v2.0&n=2",
+	}
+	if !reflect.DeepEqual(s.Requests, expectedRequests) {
+		t.Errorf("expected requests %#v, but got %#v", expectedRequests, s.Requests)
+	}
+
+	//an empty repo yields an empty list without pagination
+	s = &stubTagsRegistry{PageSize: 2}
+	c = setupTagsTest(t, s)
+	tags, err = c.ListTags()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tags) != 0 {
+		t.Errorf("expected no tags, but got %#v", tags)
+	}
+}
+
+func TestDeleteTagAndManifest(t *testing.T) {
+	s := &stubTagsRegistry{}
+	c := setupTagsTest(t, s)
+
+	err := c.DeleteTag("latest")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	manifestDigest := digest.Canonical.FromString("manifest")
+	err = c.DeleteManifest(manifestDigest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedRequests := []string{
+		"DELETE /v2/test1/foo/manifests/latest",
+		"DELETE /v2/test1/foo/manifests/" + manifestDigest.String(),
+	}
+	if !reflect.DeepEqual(s.Requests, expectedRequests) {
+		t.Errorf("expected requests %#v, but got %#v", expectedRequests, s.Requests)
+	}
+
+	//errors from the registry are reported as RegistryV2Error
+	err = c.DeleteTag("missing")
+	rerr, ok := err.(*keppel.RegistryV2Error)
+	if !ok || rerr.Code != keppel.ErrManifestUnknown {
+		t.Errorf("expected RegistryV2Error with code %s, but got %#v", keppel.ErrManifestUnknown, err)
+	}
+
+	//auth failures are reported as well
+	c.Password = "wrong"
+	c.token = ""
+	err = c.DeleteTag("latest")
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("expected authentication failure, but got %v", err)
+	}
+}
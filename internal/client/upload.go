@@ -20,10 +20,16 @@ package client
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
 )
 
 // UploadMonolithicBlob performs a monolithic blob upload. On success, the
@@ -46,6 +52,278 @@ func (c *RepoClient) UploadMonolithicBlob(contents []byte) (digest.Digest, error
 	return d, err
 }
 
+// UploadBlobOpts appears in func UploadBlob.
+type UploadBlobOpts struct {
+	//If not empty, UploadBlob() first tries to mount the blob from this
+	//repository (given as full name including the account name) instead of
+	//uploading it.
+	MountFrom string
+	//The size of each chunk in the chunked upload. Defaults to
+	//DefaultUploadChunkSizeBytes.
+	ChunkSizeBytes int
+}
+
+// DefaultUploadChunkSizeBytes is the default for UploadBlobOpts.ChunkSizeBytes.
+const DefaultUploadChunkSizeBytes = 8 << 20 // 8 MiB
+
+// UploadBlob uploads a blob. If opts.MountFrom is given, a cross-repository
+// blob mount is attempted first. If the mount is not possible (e.g. because
+// the blob does not exist in the source repository), the blob contents are
+// uploaded in chunks instead. On success, the blob's digest is returned.
+func (c *RepoClient) UploadBlob(contents []byte, opts *UploadBlobOpts) (digest.Digest, error) {
+	if opts == nil {
+		opts = &UploadBlobOpts{}
+	}
+	chunkSize := opts.ChunkSizeBytes
+	if chunkSize <= 0 {
+		chunkSize = DefaultUploadChunkSizeBytes
+	}
+	d := digest.Canonical.FromBytes(contents)
+
+	var uploadURL string
+	if opts.MountFrom != "" {
+		//attempt a cross-repository blob mount: 201 means that the blob was
+		//mounted, 202 means that the registry has started a regular upload instead
+		query := url.Values{"mount": {d.String()}, "from": {opts.MountFrom}}
+		resp, err := c.doRequest(repoRequest{
+			Method:           "POST",
+			Path:             "blobs/uploads/?" + query.Encode(),
+			Headers:          http.Header{"Content-Length": {"0"}},
+			ExpectStatus:     http.StatusCreated,
+			AlsoAcceptStatus: http.StatusAccepted,
+		})
+		var rerr *keppel.RegistryV2Error
+		switch {
+		case err == nil:
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusCreated {
+				return d, nil
+			}
+			uploadURL, err = resolveLocation(resp)
+			if err != nil {
+				return d, err
+			}
+		case errors.As(err, &rerr) && (rerr.Code == keppel.ErrBlobUnknown || rerr.Code == keppel.ErrNameUnknown):
+			//Keppel reports an error instead of falling back to a regular upload
+			//when the blob cannot be mounted, so we need to start the upload ourselves
+		default:
+			return d, err
+		}
+	}
+
+	//start a regular upload (unless the mount attempt already did that)
+	if uploadURL == "" {
+		resp, err := c.doRequest(repoRequest{
+			Method:       "POST",
+			Path:         "blobs/uploads/",
+			Headers:      http.Header{"Content-Length": {"0"}},
+			ExpectStatus: http.StatusAccepted,
+		})
+		if err != nil {
+			return d, err
+		}
+		resp.Body.Close()
+		uploadURL, err = resolveLocation(resp)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	_, err := c.uploadChunksAndFinish(uploadURL, d, bytes.NewReader(contents), 0, chunkSize)
+	return d, err
+}
+
+// UploadBlobChunkedOpts appears in func UploadBlobChunked.
+type UploadBlobChunkedOpts struct {
+	//The size of each chunk in the chunked upload. Defaults to
+	//DefaultUploadChunkSizeBytes.
+	ChunkSizeBytes int
+	//If not empty, the upload is resumed from this upload URL instead of
+	//starting a new upload. This is usually the ResumeURL from a previous
+	//BlobUploadInterruptedError.
+	ResumeURL string
+}
+
+// BlobUploadInterruptedError is returned by UploadBlobChunked() when an upload
+// fails after it was started. The upload can be resumed by calling
+// UploadBlobChunked() again with the same contents and with
+// UploadBlobChunkedOpts.ResumeURL set to this ResumeURL.
+type BlobUploadInterruptedError struct {
+	Inner     error
+	ResumeURL string
+}
+
+// Error implements the builtin/error interface.
+func (e BlobUploadInterruptedError) Error() string {
+	return "blob upload was interrupted: " + e.Inner.Error()
+}
+
+// Unwrap implements the interface implied by errors.Unwrap().
+func (e BlobUploadInterruptedError) Unwrap() error {
+	return e.Inner
+}
+
+// UploadBlobChunked uploads a blob with the given digest by streaming the
+// given reader into a chunked upload. Unlike UploadBlob(), the blob contents
+// do not need to be held in memory all at once.
+//
+// If the upload fails after it was started, a BlobUploadInterruptedError is
+// returned that can be used to resume the upload. When resuming, the reader
+// must yield the blob contents from the start again; the parts that were
+// already uploaded are skipped.
+//
+// The upload is only considered successful if the digest computed by the
+// registry matches the given digest.
+func (c *RepoClient) UploadBlobChunked(d digest.Digest, r io.Reader, opts *UploadBlobChunkedOpts) error {
+	if opts == nil {
+		opts = &UploadBlobChunkedOpts{}
+	}
+	chunkSize := opts.ChunkSizeBytes
+	if chunkSize <= 0 {
+		chunkSize = DefaultUploadChunkSizeBytes
+	}
+
+	var (
+		uploadURL string
+		offset    int64
+	)
+	if opts.ResumeURL == "" {
+		//start a new upload
+		resp, err := c.doRequest(repoRequest{
+			Method:       "POST",
+			Path:         "blobs/uploads/",
+			Headers:      http.Header{"Content-Length": {"0"}},
+			ExpectStatus: http.StatusAccepted,
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		uploadURL, err = resolveLocation(resp)
+		if err != nil {
+			return err
+		}
+	} else {
+		//ask the registry how much of the upload it already has
+		uploadURL = opts.ResumeURL
+		resp, err := c.doRequest(repoRequest{
+			Method:       "GET",
+			URL:          uploadURL,
+			ExpectStatus: http.StatusNoContent,
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		offset, err = parseUploadRange(resp)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(io.Discard, r, offset)
+		if err != nil {
+			return fmt.Errorf("cannot skip the first %d bytes of blob contents: %w", offset, err)
+		}
+	}
+
+	lastUploadURL, err := c.uploadChunksAndFinish(uploadURL, d, r, offset, chunkSize)
+	if err != nil {
+		return BlobUploadInterruptedError{Inner: err, ResumeURL: lastUploadURL}
+	}
+	return nil
+}
+
+// uploadChunksAndFinish implements the second half of UploadBlob() and
+// UploadBlobChunked(): The contents of `r` are uploaded in chunks, starting at
+// the given offset within the blob, then the upload is finished. On error, the
+// URL of the last successful step of the upload is returned.
+func (c *RepoClient) uploadChunksAndFinish(uploadURL string, d digest.Digest, r io.Reader, offset int64, chunkSize int) (string, error) {
+	//upload contents in chunks
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return uploadURL, err
+		}
+		chunk := buf[:n]
+		resp, err := c.doRequest(repoRequest{
+			Method: "PATCH",
+			URL:    uploadURL,
+			Headers: http.Header{
+				"Content-Length": {strconv.Itoa(len(chunk))},
+				"Content-Range":  {fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1)},
+				"Content-Type":   {"application/octet-stream"},
+			},
+			Body:         bytes.NewReader(chunk),
+			ExpectStatus: http.StatusAccepted,
+		})
+		if err != nil {
+			return uploadURL, err
+		}
+		resp.Body.Close()
+		uploadURL, err = resolveLocation(resp)
+		if err != nil {
+			return uploadURL, err
+		}
+		offset += int64(len(chunk))
+		if n < chunkSize {
+			break
+		}
+	}
+
+	//finish upload
+	finishURL, err := url.Parse(uploadURL)
+	if err != nil {
+		return uploadURL, err
+	}
+	query := finishURL.Query()
+	query.Set("digest", d.String())
+	finishURL.RawQuery = query.Encode()
+	resp, err := c.doRequest(repoRequest{
+		Method:       "PUT",
+		URL:          finishURL.String(),
+		Headers:      http.Header{"Content-Length": {"0"}},
+		ExpectStatus: http.StatusCreated,
+	})
+	if err != nil {
+		return uploadURL, err
+	}
+	resp.Body.Close()
+
+	//double-check that the registry arrived at the same digest
+	if actual := resp.Header.Get("Docker-Content-Digest"); actual != "" && actual != d.String() {
+		return uploadURL, fmt.Errorf("expected registry to compute digest %s for uploaded blob, but got %s", d, actual)
+	}
+	return uploadURL, nil
+}
+
+// parseUploadRange returns the number of bytes that the registry has received
+// for an upload, as reported in the Range header of the given response.
+func parseUploadRange(resp *http.Response) (int64, error) {
+	rangeStr := resp.Header.Get("Range")
+	//NOTE: "0-0" is ambiguous, but registries (including Keppel) report it for empty uploads
+	if rangeStr == "" || rangeStr == "0-0" {
+		return 0, nil
+	}
+	var start, end int64
+	_, err := fmt.Sscanf(rangeStr, "%d-%d", &start, &end)
+	if err != nil || start != 0 || end < start {
+		return 0, fmt.Errorf("malformed Range header in response to %s %s: %q", resp.Request.Method, resp.Request.URL.String(), rangeStr)
+	}
+	return end + 1, nil
+}
+
+// resolveLocation returns the absolute URL from the Location header of the given response.
+func resolveLocation(resp *http.Response) (string, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("cannot read Location header in response to %s %s: %w", resp.Request.Method, resp.Request.URL.String(), err)
+	}
+	return loc.String(), nil
+}
+
 // UploadManifest uploads a manifest. If `tagName` is not empty, this tag name
 // is used, otherwise the manifest is uploaded to its canonical digest. On
 // success, the manifest's digest is returned.
@@ -0,0 +1,300 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// stubUploadRegistry implements just enough of the blob upload API for
+// UploadBlob(). Blobs can be mounted from the repo "test1/bar" if they are
+// listed in MountableBlobs.
+type stubUploadRegistry struct {
+	MountableBlobs map[digest.Digest]bool
+	//if true, failed mounts are reported as errors (like Keppel does) instead
+	//of falling back to a regular upload (like the spec says)
+	MountFailsWithError bool
+
+	//if not 0, PATCH requests fail once this many chunks have been uploaded
+	FailAfterChunks int
+	//if true, the digest reported when finishing an upload is wrong
+	ReportWrongDigest bool
+
+	Requests []string
+	Uploaded []byte
+	Chunks   int
+	Stored   map[digest.Digest][]byte
+}
+
+func (s *stubUploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Requests = append(s.Requests, r.Method+" "+r.URL.Path)
+	const uploadPath = "/v2/test1/foo/blobs/uploads/"
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == uploadPath:
+		query := r.URL.Query()
+		if query.Get("from") != "" {
+			d := digest.Digest(query.Get("mount"))
+			if query.Get("from") == "test1/bar" && s.MountableBlobs[d] {
+				w.Header().Set("Location", "/v2/test1/foo/blobs/"+d.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			if s.MountFailsWithError {
+				keppel.ErrBlobUnknown.With("blob does not exist in source repository").WriteAsRegistryV2ResponseTo(w, r)
+				return
+			}
+		}
+		s.Uploaded = nil
+		w.Header().Set("Location", uploadPath+"session")
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodGet && r.URL.Path == uploadPath+"session":
+		if len(s.Uploaded) == 0 {
+			w.Header().Set("Range", "0-0")
+		} else {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(s.Uploaded)-1))
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPatch && r.URL.Path == uploadPath+"session":
+		if s.FailAfterChunks != 0 && s.Chunks >= s.FailAfterChunks {
+			keppel.ErrUnavailable.With("simulated interruption").WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		s.Chunks++
+		expectedRange := fmt.Sprintf("%d-", len(s.Uploaded))
+		if !strings.HasPrefix(r.Header.Get("Content-Range"), expectedRange) {
+			keppel.ErrBlobUploadInvalid.With("unexpected Content-Range").WithStatus(http.StatusRequestedRangeNotSatisfiable).WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		s.Uploaded = append(s.Uploaded, buf...)
+		w.Header().Set("Location", uploadPath+"session")
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == http.MethodPut && r.URL.Path == uploadPath+"session":
+		d := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.Canonical.FromBytes(s.Uploaded) != d {
+			keppel.ErrDigestInvalid.With("").WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		s.Stored[d] = s.Uploaded
+		if s.ReportWrongDigest {
+			d = digest.Canonical.FromString("something else")
+		}
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Header().Set("Location", "/v2/test1/foo/blobs/"+d.String())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func TestUploadBlob(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	d := digest.Canonical.FromBytes(contents)
+
+	testCases := []struct {
+		Name                string
+		Opts                *UploadBlobOpts
+		Mountable           bool
+		MountFailsWithError bool
+		ExpectedRequests    []string
+	}{
+		{
+			Name:      "mount shortcut",
+			Opts:      &UploadBlobOpts{MountFrom: "test1/bar"},
+			Mountable: true,
+			ExpectedRequests: []string{
+				"POST /v2/test1/foo/blobs/uploads/",
+			},
+		},
+		{
+			Name:      "fallback after 202 response to mount",
+			Opts:      &UploadBlobOpts{MountFrom: "test1/bar", ChunkSizeBytes: 40},
+			Mountable: false,
+			ExpectedRequests: []string{
+				"POST /v2/test1/foo/blobs/uploads/",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PUT /v2/test1/foo/blobs/uploads/session",
+			},
+		},
+		{
+			Name:                "fallback after error response to mount",
+			Opts:                &UploadBlobOpts{MountFrom: "test1/bar", ChunkSizeBytes: 60},
+			Mountable:           false,
+			MountFailsWithError: true,
+			ExpectedRequests: []string{
+				"POST /v2/test1/foo/blobs/uploads/",
+				"POST /v2/test1/foo/blobs/uploads/",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PUT /v2/test1/foo/blobs/uploads/session",
+			},
+		},
+		{
+			Name: "no mount requested",
+			Opts: nil,
+			ExpectedRequests: []string{
+				"POST /v2/test1/foo/blobs/uploads/",
+				"PATCH /v2/test1/foo/blobs/uploads/session",
+				"PUT /v2/test1/foo/blobs/uploads/session",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		s := &stubUploadRegistry{
+			MountableBlobs:      map[digest.Digest]bool{d: tc.Mountable},
+			MountFailsWithError: tc.MountFailsWithError,
+			Stored:              make(map[digest.Digest][]byte),
+		}
+		srv := httptest.NewServer(s)
+		c := &RepoClient{
+			Scheme:   "http",
+			Host:     strings.TrimPrefix(srv.URL, "http://"),
+			RepoName: "test1/foo",
+		}
+
+		actualDigest, err := c.UploadBlob(contents, tc.Opts)
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.Name, err.Error())
+			continue
+		}
+		if actualDigest != d {
+			t.Errorf("%s: expected digest %s, but got %s", tc.Name, d, actualDigest)
+		}
+		if strings.Join(s.Requests, "\n") != strings.Join(tc.ExpectedRequests, "\n") {
+			t.Errorf("%s: expected requests %#v, but got %#v", tc.Name, tc.ExpectedRequests, s.Requests)
+		}
+		if !tc.Mountable && !bytes.Equal(s.Stored[d], contents) {
+			t.Errorf("%s: expected blob contents to be uploaded, but got %q", tc.Name, string(s.Stored[d]))
+		}
+	}
+}
+
+func TestUploadBlobChunked(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	d := digest.Canonical.FromBytes(contents)
+
+	newClient := func(s *stubUploadRegistry) *RepoClient {
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+		return &RepoClient{
+			Scheme:   "http",
+			Host:     strings.TrimPrefix(srv.URL, "http://"),
+			RepoName: "test1/foo",
+		}
+	}
+	expectRequests := func(s *stubUploadRegistry, expected ...string) {
+		t.Helper()
+		if strings.Join(s.Requests, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("expected requests %#v, but got %#v", expected, s.Requests)
+		}
+	}
+	expectStored := func(s *stubUploadRegistry) {
+		t.Helper()
+		if !bytes.Equal(s.Stored[d], contents) {
+			t.Errorf("expected blob contents to be uploaded, but got %q", string(s.Stored[d]))
+		}
+	}
+
+	//single chunk
+	s := &stubUploadRegistry{Stored: make(map[digest.Digest][]byte)}
+	err := newClient(s).UploadBlobChunked(d, bytes.NewReader(contents), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRequests(s,
+		"POST /v2/test1/foo/blobs/uploads/",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PUT /v2/test1/foo/blobs/uploads/session",
+	)
+	expectStored(s)
+
+	//multiple chunks (the last one being shorter than the others)
+	s = &stubUploadRegistry{Stored: make(map[digest.Digest][]byte)}
+	err = newClient(s).UploadBlobChunked(d, bytes.NewReader(contents), &UploadBlobChunkedOpts{ChunkSizeBytes: 30})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRequests(s,
+		"POST /v2/test1/foo/blobs/uploads/",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PUT /v2/test1/foo/blobs/uploads/session",
+	)
+	expectStored(s)
+
+	//interrupted upload...
+	s = &stubUploadRegistry{Stored: make(map[digest.Digest][]byte), FailAfterChunks: 2}
+	c := newClient(s)
+	err = c.UploadBlobChunked(d, bytes.NewReader(contents), &UploadBlobChunkedOpts{ChunkSizeBytes: 30})
+	var ierr BlobUploadInterruptedError
+	if !errors.As(err, &ierr) {
+		t.Fatalf("expected BlobUploadInterruptedError, but got %#v", err)
+	}
+	var rerr *keppel.RegistryV2Error
+	if !errors.As(err, &rerr) || rerr.Code != keppel.ErrUnavailable {
+		t.Errorf("expected interruption to be caused by %s, but got %s", keppel.ErrUnavailable, err.Error())
+	}
+	if !strings.HasSuffix(ierr.ResumeURL, "/v2/test1/foo/blobs/uploads/session") {
+		t.Errorf("unexpected ResumeURL: %q", ierr.ResumeURL)
+	}
+
+	//...can be resumed where it left off
+	s.FailAfterChunks = 0
+	s.Requests = nil
+	err = c.UploadBlobChunked(d, bytes.NewReader(contents), &UploadBlobChunkedOpts{ChunkSizeBytes: 30, ResumeURL: ierr.ResumeURL})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectRequests(s,
+		"GET /v2/test1/foo/blobs/uploads/session",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PATCH /v2/test1/foo/blobs/uploads/session",
+		"PUT /v2/test1/foo/blobs/uploads/session",
+	)
+	expectStored(s)
+
+	//mismatching digest reported by the registry
+	s = &stubUploadRegistry{Stored: make(map[digest.Digest][]byte), ReportWrongDigest: true}
+	err = newClient(s).UploadBlobChunked(d, bytes.NewReader(contents), nil)
+	if err == nil || !strings.Contains(err.Error(), "expected registry to compute digest "+d.String()) {
+		t.Errorf("expected digest mismatch error, but got %v", err)
+	}
+}
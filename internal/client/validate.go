@@ -103,7 +103,7 @@ func (c *RepoClient) doValidateManifest(reference keppel.ManifestReference, leve
 // ValidateBlobContents fetches the given blob from the repo and verifies that
 // the contents produce the correct digest.
 func (c *RepoClient) ValidateBlobContents(blobDigest digest.Digest) (returnErr error) {
-	readCloser, _, err := c.DownloadBlob(blobDigest)
+	readCloser, _, err := c.DownloadBlob(blobDigest, nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,350 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The version of the Blob Storage REST API that we use (for both requests and SAS tokens).
+const apiVersion = "2021-08-06"
+
+// azureClient is a minimal client for the Azure Blob Storage REST API.
+type azureClient struct {
+	BaseURL     string //e.g. "https://myaccount.blob.core.windows.net"
+	AccountName string
+	AccountKey  []byte //decoded from base64
+	Container   string
+}
+
+// azureError is returned by azureClient when Azure returns an unexpected status code.
+type azureError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+// Error implements the builtin/error interface.
+func (e azureError) Error() string {
+	return fmt.Sprintf("%s %s returned unexpected status %d: %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var aerr azureError
+	return errors.As(err, &aerr) && aerr.StatusCode == http.StatusNotFound
+}
+
+// stringToSignForSharedKey builds the string that is signed for the
+// Authorization header of the request.
+//
+// Reference: <https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key>
+func (c *azureClient) stringToSignForSharedKey(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = fmt.Sprintf("%d", req.ContentLength)
+	}
+
+	//all x-ms-* headers, in lowercase and sorted by name
+	var headerNames []string
+	for name := range req.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-ms-") {
+			headerNames = append(headerNames, lowerName)
+		}
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+
+	//the resource path, followed by all query parameters sorted by name
+	canonicalResource := "/" + c.AccountName + req.URL.EscapedPath()
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	for _, key := range queryKeys {
+		values := query[key]
+		sort.Strings(values)
+		canonicalResource += fmt.Sprintf("\n%s:%s", strings.ToLower(key), strings.Join(values, ","))
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", //Date (we use x-ms-date instead)
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonicalHeaders.String() + canonicalResource,
+	}, "\n")
+}
+
+func (c *azureClient) sign(stringToSign string) string {
+	mac := hmac.New(sha256.New, c.AccountKey)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Do executes an authenticated request against Azure. The response body is
+// closed automatically unless the response has one of the expected status
+// codes.
+func (c *azureClient) Do(req *http.Request, expectedStatusCodes ...int) (*http.Response, error) {
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", apiVersion)
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", c.AccountName, c.sign(c.stringToSignForSharedKey(req))))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expectedStatusCodes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	return nil, azureError{req.Method, req.URL.String(), resp.StatusCode, strings.TrimSpace(string(msg))}
+}
+
+func (c *azureClient) blobURL(blobName string, query url.Values) string {
+	//NOTE: blob names are escaped segment by segment, but slashes are kept
+	segments := strings.Split(blobName, "/")
+	for idx, segment := range segments {
+		segments[idx] = url.PathEscape(segment)
+	}
+	result := fmt.Sprintf("%s/%s/%s", c.BaseURL, url.PathEscape(c.Container), strings.Join(segments, "/"))
+	if len(query) > 0 {
+		result += "?" + query.Encode()
+	}
+	return result
+}
+
+// GetBlob returns a reader for the contents of the given blob, and the blob's size.
+func (c *azureClient) GetBlob(blobName string) (io.ReadCloser, uint64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.blobURL(blobName, nil), http.NoBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.Do(req, http.StatusOK)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("GET %s did not report the blob size", req.URL.String())
+	}
+	return resp.Body, uint64(resp.ContentLength), nil
+}
+
+// GetBlobRange returns a reader for `length` bytes of the contents of the
+// given blob, starting at byte offset `offset`.
+func (c *azureClient) GetBlobRange(blobName string, offset, length uint64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.blobURL(blobName, nil), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.Do(req, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutBlob uploads a small blob in a single request.
+func (c *azureClient) PutBlob(blobName string, contents []byte) error {
+	req, err := http.NewRequest(http.MethodPut, c.blobURL(blobName, nil), bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	resp, err := c.Do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteBlob deletes the given blob.
+func (c *azureClient) DeleteBlob(blobName string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.blobURL(blobName, nil), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PutBlock stages a block for the given blob. The block does not become part
+// of the blob until it is committed with PutBlockList.
+func (c *azureClient) PutBlock(blobName, blockID string, contents []byte) error {
+	query := url.Values{}
+	query.Set("comp", "block")
+	query.Set("blockid", blockID)
+	req, err := http.NewRequest(http.MethodPut, c.blobURL(blobName, query), bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+// PutBlockList commits the given staged blocks (in this order) as the
+// contents of the given blob. All other uncommitted blocks of the blob are
+// discarded.
+func (c *azureClient) PutBlockList(blobName string, blockIDs []string) error {
+	buf, err := xml.Marshal(blockList{Latest: blockIDs})
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("comp", "blocklist")
+	req, err := http.NewRequest(http.MethodPut, c.blobURL(blobName, query), bytes.NewReader(append([]byte(xml.Header), buf...)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("X-Ms-Blob-Content-Type", "application/octet-stream")
+	resp, err := c.Do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ListBlobs calls the callback once for each (committed) blob name with the given prefix.
+func (c *azureClient) ListBlobs(prefix string, callback func(blobName string) error) error {
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		query.Set("prefix", prefix)
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		listURL := fmt.Sprintf("%s/%s?%s", c.BaseURL, url.PathEscape(c.Container), query.Encode())
+		req, err := http.NewRequest(http.MethodGet, listURL, http.NoBody)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+
+		var data struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot decode blob listing for %s: %w", prefix, err)
+		}
+
+		for _, blob := range data.Blobs {
+			err := callback(blob.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if data.NextMarker == "" {
+			return nil
+		}
+		marker = data.NextMarker
+	}
+}
+
+// SignedURL generates a URL with a service SAS that allows reading the given
+// blob without further authentication.
+//
+// Reference: <https://learn.microsoft.com/en-us/rest/api/storageservices/create-service-sas>
+func (c *azureClient) SignedURL(blobName string, now time.Time, validity time.Duration) string {
+	//allow for some clock skew between us and Azure
+	start := now.UTC().Add(-5 * time.Minute).Format(time.RFC3339)
+	expiry := now.UTC().Add(validity).Format(time.RFC3339)
+
+	stringToSign := strings.Join([]string{
+		"r", //signedPermissions
+		start,
+		expiry,
+		fmt.Sprintf("/blob/%s/%s/%s", c.AccountName, c.Container, blobName), //canonicalizedResource
+		"",         //signedIdentifier
+		"",         //signedIP
+		"",         //signedProtocol
+		apiVersion, //signedVersion
+		"b",        //signedResource
+		"",         //signedSnapshotTime
+		"",         //signedEncryptionScope
+		"",         //rscc (Cache-Control)
+		"",         //rscd (Content-Disposition)
+		"",         //rsce (Content-Encoding)
+		"",         //rscl (Content-Language)
+		"",         //rsct (Content-Type)
+	}, "\n")
+
+	query := url.Values{}
+	query.Set("sp", "r")
+	query.Set("st", start)
+	query.Set("se", expiry)
+	query.Set("sv", apiVersion)
+	query.Set("sr", "b")
+	query.Set("sig", c.sign(stringToSign))
+	return c.blobURL(blobName, query)
+}
@@ -0,0 +1,327 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+// Package azure contains the StorageDriver "azure": Image data is stored in
+// block blobs in an Azure Blob Storage container.
+package azure
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// How much data we buffer in memory before staging it as a block. Since a
+// block blob can have at most 50000 blocks, this limits the blob size to about
+// 390 GiB.
+const blockSize = 8 << 20
+
+type azureDriver struct {
+	client *azureClient
+}
+
+func init() {
+	keppel.RegisterStorageDriver("azure", func(_ keppel.AuthDriver, _ keppel.Configuration) (keppel.StorageDriver, error) {
+		accountName := os.Getenv("KEPPEL_AZURE_ACCOUNT")
+		if accountName == "" {
+			return nil, errors.New("missing required environment variable: KEPPEL_AZURE_ACCOUNT")
+		}
+		containerName := os.Getenv("KEPPEL_AZURE_CONTAINER")
+		if containerName == "" {
+			return nil, errors.New("missing required environment variable: KEPPEL_AZURE_CONTAINER")
+		}
+		accountKeyStr := os.Getenv("KEPPEL_AZURE_ACCOUNT_KEY")
+		if accountKeyStr == "" {
+			return nil, errors.New("missing required environment variable: KEPPEL_AZURE_ACCOUNT_KEY")
+		}
+		accountKey, err := base64.StdEncoding.DecodeString(accountKeyStr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed KEPPEL_AZURE_ACCOUNT_KEY: %w", err)
+		}
+		baseURL := os.Getenv("KEPPEL_AZURE_ENDPOINT")
+		if baseURL == "" {
+			baseURL = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+		}
+
+		return &azureDriver{
+			client: &azureClient{
+				BaseURL:     strings.TrimSuffix(baseURL, "/"),
+				AccountName: accountName,
+				AccountKey:  accountKey,
+				Container:   containerName,
+			},
+		}, nil
+	})
+}
+
+//All accounts share the same container, so all blob names are prefixed with the account name.
+
+func blobName(account keppel.Account, storageID string) string {
+	return fmt.Sprintf("%s/_blobs/%s/%s/%s", account.Name, storageID[0:2], storageID[2:4], storageID[4:])
+}
+
+func chunkMarkerName(account keppel.Account, storageID string, chunkNumber uint32) string {
+	//NOTE: uint32 numbers never have more than 10 digits
+	return fmt.Sprintf("%s/_chunks/%s/%s/%s/%010d", account.Name, storageID[0:2], storageID[2:4], storageID[4:], chunkNumber)
+}
+
+func manifestName(account keppel.Account, repoName, digest string) string {
+	return fmt.Sprintf("%s/%s/_manifests/%s", account.Name, repoName, digest)
+}
+
+// blockID returns the ID of the n-th staged block of a blob. Azure requires all
+// block IDs within a blob to have the same length.
+func blockID(n uint64) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", n)))
+}
+
+// uploadState is persisted in the chunk marker for the most recent chunk of a
+// blob upload.
+//
+// While an upload is in progress, its contents only exist as uncommitted
+// blocks on the target blob, which do not show up in blob listings. The chunk
+// marker makes ongoing uploads visible to ListStorageContents(), and tells
+// FinalizeBlob() which blocks to commit.
+type uploadState struct {
+	BlockCount uint64 `json:"block_count"`
+}
+
+func (d *azureDriver) loadUploadState(account keppel.Account, storageID string, chunkNumber uint32) (uploadState, error) {
+	var state uploadState
+	reader, _, err := d.client.GetBlob(chunkMarkerName(account, storageID, chunkNumber))
+	if err != nil {
+		return state, err
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&state)
+	return state, err
+}
+
+func (d *azureDriver) storeUploadState(account keppel.Account, storageID string, chunkNumber uint32, state uploadState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return d.client.PutBlob(chunkMarkerName(account, storageID, chunkNumber), buf)
+}
+
+// AppendToBlob implements the keppel.StorageDriver interface.
+func (d *azureDriver) AppendToBlob(account keppel.Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	var (
+		state uploadState
+		err   error
+	)
+	if chunkNumber > 1 {
+		state, err = d.loadUploadState(account, storageID, chunkNumber-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	//stage the chunk contents as one or more blocks
+	name := blobName(account, storageID)
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(chunk, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n > 0 {
+			err := d.client.PutBlock(name, blockID(state.BlockCount+1), buf[:n])
+			if err != nil {
+				return err
+			}
+			state.BlockCount++
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+
+	//persist the new state before cleaning up the previous one
+	err = d.storeUploadState(account, storageID, chunkNumber, state)
+	if err != nil {
+		return err
+	}
+	if chunkNumber > 1 {
+		return d.client.DeleteBlob(chunkMarkerName(account, storageID, chunkNumber-1))
+	}
+	return nil
+}
+
+// FinalizeBlob implements the keppel.StorageDriver interface.
+func (d *azureDriver) FinalizeBlob(account keppel.Account, storageID string, chunkCount uint32) error {
+	if chunkCount == 0 {
+		//empty blob without any chunks
+		return d.client.PutBlob(blobName(account, storageID), nil)
+	}
+
+	state, err := d.loadUploadState(account, storageID, chunkCount)
+	if err != nil {
+		return err
+	}
+	blockIDs := make([]string, state.BlockCount)
+	for idx := range blockIDs {
+		blockIDs[idx] = blockID(uint64(idx) + 1)
+	}
+	err = d.client.PutBlockList(blobName(account, storageID), blockIDs)
+	if err != nil {
+		return err
+	}
+	return d.client.DeleteBlob(chunkMarkerName(account, storageID, chunkCount))
+}
+
+// AbortBlobUpload implements the keppel.StorageDriver interface.
+func (d *azureDriver) AbortBlobUpload(account keppel.Account, storageID string, chunkCount uint32) error {
+	if chunkCount == 0 {
+		return nil
+	}
+
+	//Azure does not have an operation for discarding uncommitted blocks, but
+	//committing an empty block list discards all uncommitted blocks, and leaves
+	//an empty blob that we can delete
+	name := blobName(account, storageID)
+	err := d.client.PutBlockList(name, nil)
+	if err != nil {
+		return err
+	}
+	err = d.client.DeleteBlob(name)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	err = d.client.DeleteBlob(chunkMarkerName(account, storageID, chunkCount))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadBlob implements the keppel.StorageDriver interface.
+func (d *azureDriver) ReadBlob(account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	return d.client.GetBlob(blobName(account, storageID))
+}
+
+// ReadBlobRange implements the keppel.StorageDriver interface.
+func (d *azureDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	return d.client.GetBlobRange(blobName(account, storageID), offset, length)
+}
+
+// URLForBlob implements the keppel.StorageDriver interface.
+func (d *azureDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
+	return d.client.SignedURL(blobName(account, storageID), time.Now(), 20*time.Minute), nil
+}
+
+// DeleteBlob implements the keppel.StorageDriver interface.
+func (d *azureDriver) DeleteBlob(account keppel.Account, storageID string) error {
+	return d.client.DeleteBlob(blobName(account, storageID))
+}
+
+// ReadManifest implements the keppel.StorageDriver interface.
+func (d *azureDriver) ReadManifest(account keppel.Account, repoName, digest string) ([]byte, error) {
+	reader, _, err := d.client.GetBlob(manifestName(account, repoName, digest))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// WriteManifest implements the keppel.StorageDriver interface.
+func (d *azureDriver) WriteManifest(account keppel.Account, repoName, digest string, contents []byte) error {
+	return d.client.PutBlob(manifestName(account, repoName, digest), contents)
+}
+
+// DeleteManifest implements the keppel.StorageDriver interface.
+func (d *azureDriver) DeleteManifest(account keppel.Account, repoName, digest string) error {
+	return d.client.DeleteBlob(manifestName(account, repoName, digest))
+}
+
+var (
+	//These regexes are used to reconstruct the storage ID from a blob's or chunk marker's name.
+	//It's kinda the reverse of func blobName() or func chunkMarkerName(). The account name prefix is removed beforehand.
+	blobNameRx        = regexp.MustCompile(`^_blobs/([^/]{2})/([^/]{2})/([^/]+)$`)
+	chunkMarkerNameRx = regexp.MustCompile(`^_chunks/([^/]{2})/([^/]{2})/([^/]+)/([0-9]+)$`)
+	//This regex recovers the repo name and manifest digest from a manifest's blob name.
+	//It's kinda the reverse of func manifestName().
+	manifestNameRx = regexp.MustCompile(`^(.+)/_manifests/([^/]+)$`)
+)
+
+// ListStorageContents implements the keppel.StorageDriver interface.
+func (d *azureDriver) ListStorageContents(account keppel.Account) ([]keppel.StoredBlobInfo, []keppel.StoredManifestInfo, error) {
+	return keppel.CollectStorageContents(d, account)
+}
+
+// ListStorageContentsStream implements the keppel.StorageDriver interface.
+func (d *azureDriver) ListStorageContentsStream(account keppel.Account, blobCallback func(keppel.StoredBlobInfo) error, manifestCallback func(keppel.StoredManifestInfo) error) error {
+	prefix := account.Name + "/"
+	return d.client.ListBlobs(prefix, func(fullName string) error {
+		name := strings.TrimPrefix(fullName, prefix)
+		if match := blobNameRx.FindStringSubmatch(name); match != nil {
+			return blobCallback(keppel.StoredBlobInfo{
+				StorageID:  match[1] + match[2] + match[3],
+				ChunkCount: 0,
+			})
+		}
+		if match := chunkMarkerNameRx.FindStringSubmatch(name); match != nil {
+			//NOTE: There is only one chunk marker per upload since AppendToBlob() removes the previous one.
+			chunkNumber, err := strconv.ParseUint(match[4], 10, 32)
+			if err != nil {
+				return fmt.Errorf("while parsing chunk marker name %s: %s", fullName, err.Error())
+			}
+			return blobCallback(keppel.StoredBlobInfo{
+				StorageID:  match[1] + match[2] + match[3],
+				ChunkCount: uint32(chunkNumber),
+			})
+		}
+		if match := manifestNameRx.FindStringSubmatch(name); match != nil {
+			return manifestCallback(keppel.StoredManifestInfo{
+				RepoName: match[1],
+				Digest:   match[2],
+			})
+		}
+		return fmt.Errorf("encountered unexpected blob while listing storage contents of account %s: %s", account.Name, fullName)
+	})
+}
+
+// CleanupAccount implements the keppel.StorageDriver interface.
+func (d *azureDriver) CleanupAccount(account keppel.Account) error {
+	//since all accounts share the same container, there is nothing to delete here;
+	//we only verify that the account's part of the container is empty
+	var names []string
+	err := d.client.ListBlobs(account.Name+"/", func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("found undeleted blobs for account %s: %s", account.Name, strings.Join(names, ", "))
+	}
+	return nil
+}
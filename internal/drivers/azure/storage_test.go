@@ -0,0 +1,414 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package azure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// fake Azure Blob Storage server
+
+// fakeAzure implements the subset of the Blob Storage REST API that azureClient uses.
+type fakeAzure struct {
+	client *azureClient //for verifying request signatures
+	mutex  sync.Mutex
+	//key = blob name
+	blobs map[string][]byte
+	//key = blob name, then block ID
+	uncommittedBlocks map[string]map[string][]byte
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	expectedAuth := fmt.Sprintf("SharedKey %s:%s", f.client.AccountName, f.client.sign(f.client.stringToSignForSharedKey(r)))
+	if r.Header.Get("Authorization") != expectedAuth {
+		http.Error(w, "signature mismatch", http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Ms-Version") != apiVersion {
+		http.Error(w, "unexpected API version", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if r.URL.Path == "/test-container" && query.Get("restype") == "container" && query.Get("comp") == "list" {
+		f.serveList(w, query)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/test-container/") {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/test-container/")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.uncommittedBlocks[name] == nil {
+			f.uncommittedBlocks[name] = make(map[string][]byte)
+		}
+		f.uncommittedBlocks[name][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list blockList
+		err := xml.Unmarshal(body, &list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var contents []byte
+		for _, id := range list.Latest {
+			block, exists := f.uncommittedBlocks[name][id]
+			if !exists {
+				http.Error(w, "no such block: "+id, http.StatusBadRequest)
+				return
+			}
+			contents = append(contents, block...)
+		}
+		f.blobs[name] = contents
+		delete(f.uncommittedBlocks, name)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			http.Error(w, "unexpected blob type", http.StatusBadRequest)
+			return
+		}
+		f.blobs[name] = body
+		delete(f.uncommittedBlocks, name)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodGet:
+		contents, exists := f.blobs[name]
+		if !exists {
+			http.Error(w, "no such blob: "+name, http.StatusNotFound)
+			return
+		}
+		//ServeContent() takes care of Range headers for us
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
+
+	case r.Method == http.MethodDelete:
+		if _, exists := f.blobs[name]; !exists {
+			http.Error(w, "no such blob: "+name, http.StatusNotFound)
+			return
+		}
+		delete(f.blobs, name)
+		delete(f.uncommittedBlocks, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeAzure) serveList(w http.ResponseWriter, query url.Values) {
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, query.Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	//return at most two blobs per page to exercise the pagination
+	offset, _ := strconv.Atoi(query.Get("marker"))
+	type blob struct {
+		Name string `xml:"Name"`
+	}
+	var data struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string   `xml:"NextMarker"`
+	}
+	for idx := offset; idx < len(names) && idx < offset+2; idx++ {
+		data.Blobs = append(data.Blobs, blob{names[idx]})
+	}
+	if offset+2 < len(names) {
+		data.NextMarker = strconv.Itoa(offset + 2)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// test setup
+
+func setupFakeAzure(t *testing.T) (*azureDriver, *fakeAzure) {
+	t.Helper()
+	client := &azureClient{
+		AccountName: "testaccount",
+		AccountKey:  []byte("not-a-real-account-key"),
+		Container:   "test-container",
+	}
+	fake := &fakeAzure{
+		client:            client,
+		blobs:             make(map[string][]byte),
+		uncommittedBlocks: make(map[string]map[string][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client.BaseURL = server.URL
+
+	return &azureDriver{client}, fake
+}
+
+func mustSucceed(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func makeRandomBytes(t *testing.T, length int) []byte {
+	t.Helper()
+	buf := make([]byte, length)
+	_, err := rand.Read(buf)
+	mustSucceed(t, err)
+	return buf
+}
+
+var testAccount = keppel.Account{Name: "test1"}
+
+const testStorageID = "0123456789abcdef"
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestChunkedUploadAndFinalize(t *testing.T) {
+	d, fake := setupFakeAzure(t)
+
+	//the last chunk is larger than a block, so it needs to be staged as multiple blocks
+	chunks := [][]byte{
+		makeRandomBytes(t, 100<<10),
+		makeRandomBytes(t, 300<<10),
+		makeRandomBytes(t, blockSize+700<<10),
+	}
+	for idx, chunk := range chunks {
+		chunkLength := uint64(len(chunk))
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, uint32(idx+1), &chunkLength, bytes.NewReader(chunk)))
+	}
+	targetName := blobName(testAccount, testStorageID)
+	if len(fake.uncommittedBlocks[targetName]) != 4 {
+		t.Errorf("expected 4 uncommitted blocks, but got %d", len(fake.uncommittedBlocks[targetName]))
+	}
+
+	//the unfinished upload must show up in the storage listing
+	blobs, manifests, err := d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedBlobs := []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 3}}
+	if fmt.Sprint(blobs) != fmt.Sprint(expectedBlobs) || len(manifests) != 0 {
+		t.Errorf("expected storage contents %v, but got %v and %v", expectedBlobs, blobs, manifests)
+	}
+
+	mustSucceed(t, d.FinalizeBlob(testAccount, testStorageID, 3))
+	if len(fake.uncommittedBlocks) != 0 {
+		t.Errorf("expected all blocks to be committed, but %d blobs have uncommitted blocks", len(fake.uncommittedBlocks))
+	}
+
+	//read back the finalized blob
+	reader, sizeBytes, err := d.ReadBlob(testAccount, testStorageID)
+	mustSucceed(t, err)
+	contents, err := io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	expectedContents := bytes.Join(chunks, nil)
+	if sizeBytes != uint64(len(expectedContents)) {
+		t.Errorf("expected blob size %d, but got %d", len(expectedContents), sizeBytes)
+	}
+	if !bytes.Equal(contents, expectedContents) {
+		t.Error("blob contents do not match the uploaded chunks")
+	}
+
+	//read back a part of the finalized blob
+	reader, err = d.ReadBlobRange(testAccount, testStorageID, 1000, 5000)
+	mustSucceed(t, err)
+	contents, err = io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	if !bytes.Equal(contents, expectedContents[1000:6000]) {
+		t.Error("partial blob contents do not match the uploaded chunks")
+	}
+
+	//only the finalized blob should remain
+	blobs, _, err = d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedBlobs = []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 0}}
+	if fmt.Sprint(blobs) != fmt.Sprint(expectedBlobs) {
+		t.Errorf("expected storage contents %v, but got %v", expectedBlobs, blobs)
+	}
+
+	mustSucceed(t, d.DeleteBlob(testAccount, testStorageID))
+	mustSucceed(t, d.CleanupAccount(testAccount))
+}
+
+func TestEmptyBlob(t *testing.T) {
+	d, _ := setupFakeAzure(t)
+
+	mustSucceed(t, d.FinalizeBlob(testAccount, testStorageID, 0))
+	reader, sizeBytes, err := d.ReadBlob(testAccount, testStorageID)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	if sizeBytes != 0 {
+		t.Errorf("expected empty blob, but got size %d", sizeBytes)
+	}
+	mustSucceed(t, d.DeleteBlob(testAccount, testStorageID))
+}
+
+func TestAbortUpload(t *testing.T) {
+	d, fake := setupFakeAzure(t)
+
+	for chunkNumber := uint32(1); chunkNumber <= 2; chunkNumber++ {
+		chunk := makeRandomBytes(t, 300<<10)
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, chunkNumber, nil, bytes.NewReader(chunk)))
+	}
+	if len(fake.uncommittedBlocks) != 1 {
+		t.Fatalf("expected 1 blob with uncommitted blocks, but got %d", len(fake.uncommittedBlocks))
+	}
+
+	mustSucceed(t, d.AbortBlobUpload(testAccount, testStorageID, 2))
+	if len(fake.uncommittedBlocks) != 0 {
+		t.Errorf("expected uncommitted blocks to be discarded, but %d blobs have some left", len(fake.uncommittedBlocks))
+	}
+	if len(fake.blobs) != 0 {
+		t.Errorf("expected no blobs to be left, but got %d", len(fake.blobs))
+	}
+	mustSucceed(t, d.CleanupAccount(testAccount))
+
+	//aborting again (e.g. from the janitor) is not an error
+	mustSucceed(t, d.AbortBlobUpload(testAccount, testStorageID, 2))
+}
+
+func TestManifests(t *testing.T) {
+	d, _ := setupFakeAzure(t)
+
+	contents := []byte(`{"schemaVersion":2}`)
+	digest := "sha256:" + strings.Repeat("0", 64)
+	mustSucceed(t, d.WriteManifest(testAccount, "foo/bar", digest, contents))
+
+	readContents, err := d.ReadManifest(testAccount, "foo/bar", digest)
+	mustSucceed(t, err)
+	if !bytes.Equal(readContents, contents) {
+		t.Errorf("expected manifest contents %q, but got %q", contents, readContents)
+	}
+
+	_, manifests, err := d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedManifests := []keppel.StoredManifestInfo{{RepoName: "foo/bar", Digest: digest}}
+	if fmt.Sprint(manifests) != fmt.Sprint(expectedManifests) {
+		t.Errorf("expected manifests %v, but got %v", expectedManifests, manifests)
+	}
+
+	//CleanupAccount refuses to clean up while blobs remain
+	if d.CleanupAccount(testAccount) == nil {
+		t.Error("expected CleanupAccount to fail while a manifest exists")
+	}
+	mustSucceed(t, d.DeleteManifest(testAccount, "foo/bar", digest))
+	mustSucceed(t, d.CleanupAccount(testAccount))
+}
+
+func TestSharedKeyStringToSign(t *testing.T) {
+	c := &azureClient{AccountName: "testaccount", Container: "test-container"}
+	req, err := http.NewRequest(http.MethodPut, "https://testaccount.blob.core.windows.net/test-container/foo/bar?comp=block&blockid=MDAwMDAwMDAwMQ%3D%3D", strings.NewReader("hello"))
+	mustSucceed(t, err)
+	req.Header.Set("X-Ms-Version", apiVersion)
+	req.Header.Set("X-Ms-Date", "Fri, 01 Sep 2023 12:00:00 GMT")
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	expected := strings.Join([]string{
+		"PUT",
+		"",  //Content-Encoding
+		"",  //Content-Language
+		"5", //Content-Length
+		"",  //Content-MD5
+		"application/octet-stream",
+		"", //Date
+		"", //If-Modified-Since
+		"", //If-Match
+		"", //If-None-Match
+		"", //If-Unmodified-Since
+		"", //Range
+		"x-ms-date:Fri, 01 Sep 2023 12:00:00 GMT",
+		"x-ms-version:" + apiVersion,
+		"/testaccount/test-container/foo/bar",
+		"blockid:MDAwMDAwMDAwMQ==",
+		"comp:block",
+	}, "\n")
+	actual := c.stringToSignForSharedKey(req)
+	if actual != expected {
+		t.Errorf("expected string to sign %q, but got %q", expected, actual)
+	}
+}
+
+func TestURLForBlob(t *testing.T) {
+	d, _ := setupFakeAzure(t)
+
+	now := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	signedURL := d.client.SignedURL(blobName(testAccount, testStorageID), now, 20*time.Minute)
+
+	u, err := url.Parse(signedURL)
+	mustSucceed(t, err)
+	if u.Path != "/test-container/test1/_blobs/01/23/456789abcdef" {
+		t.Errorf("unexpected path in signed URL: %q", u.Path)
+	}
+	query := u.Query()
+	expectedQuery := map[string]string{
+		"sp": "r",
+		"st": "2023-09-01T11:55:00Z",
+		"se": "2023-09-01T12:20:00Z",
+		"sv": apiVersion,
+		"sr": "b",
+	}
+	for key, value := range expectedQuery {
+		if query.Get(key) != value {
+			t.Errorf("expected %s=%q in signed URL, but got %q", key, value, query.Get(key))
+		}
+	}
+
+	//verify the signature by reconstructing the string to sign
+	stringToSign := "r\n2023-09-01T11:55:00Z\n2023-09-01T12:20:00Z\n/blob/testaccount/test-container/test1/_blobs/01/23/456789abcdef\n\n\n\n" +
+		apiVersion + "\nb\n\n\n\n\n\n\n"
+	if query.Get("sig") != d.client.sign(stringToSign) {
+		t.Errorf("signature in signed URL does not match the expected string to sign")
+	}
+}
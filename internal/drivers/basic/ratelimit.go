@@ -35,6 +35,8 @@ import (
 // RateLimitDriver is the rate limit driver "basic".
 type RateLimitDriver struct {
 	Limits map[keppel.RateLimitedAction]redis_rate.Limit
+	//PerSourceIPLimits is optional.
+	PerSourceIPLimits map[keppel.RateLimitedAction]redis_rate.Limit
 }
 
 type envVarSet struct {
@@ -61,21 +63,28 @@ var (
 func init() {
 	keppel.RegisterRateLimitDriver("basic", func(keppel.AuthDriver, keppel.Configuration) (keppel.RateLimitDriver, error) {
 		limits := make(map[keppel.RateLimitedAction]redis_rate.Limit)
+		perSourceIPLimits := make(map[keppel.RateLimitedAction]redis_rate.Limit)
 		for action, envVars := range envVars {
-			rate, err := parseRateLimit(envVars.RateLimit)
+			limit, err := parseLimit(envVars, !strings.HasSuffix(envVars.RateLimit, "_BYTES"))
 			if err != nil {
 				return nil, err
 			}
-			if rate != nil {
-				burst, err := parseBurst(envVars.Burst)
-				if err != nil {
-					return nil, err
-				}
-				limits[action] = redis_rate.Limit{Rate: rate.Rate, Burst: burst}
-				logg.Debug("parsed rate quota for %s is %#v", action, limits[action])
+			if limit != nil {
+				limits[action] = *limit
+				logg.Debug("parsed rate quota for %s is %#v", action, *limit)
+			}
+
+			//per-IP limits are always optional
+			limit, err = parseLimit(envVarSet{envVars.RateLimit + "_PER_IP", envVars.Burst + "_PER_IP"}, false)
+			if err != nil {
+				return nil, err
+			}
+			if limit != nil {
+				perSourceIPLimits[action] = *limit
+				logg.Debug("parsed per-IP rate quota for %s is %#v", action, *limit)
 			}
 		}
-		return RateLimitDriver{limits}, nil
+		return RateLimitDriver{limits, perSourceIPLimits}, nil
 	})
 }
 
@@ -88,15 +97,36 @@ func (d RateLimitDriver) GetRateLimit(account keppel.Account, action keppel.Rate
 	return nil
 }
 
-func parseRateLimit(envVar string) (*redis_rate.Limit, error) {
+// GetPerSourceIPRateLimit implements the keppel.RateLimitDriver interface.
+func (d RateLimitDriver) GetPerSourceIPRateLimit(account keppel.Account, action keppel.RateLimitedAction) *redis_rate.Limit {
+	quota, ok := d.PerSourceIPLimits[action]
+	if ok {
+		return &quota
+	}
+	return nil
+}
+
+func parseLimit(envVars envVarSet, isRequired bool) (*redis_rate.Limit, error) {
+	rate, err := parseRateLimit(envVars.RateLimit, isRequired)
+	if err != nil || rate == nil {
+		return nil, err
+	}
+	burst, err := parseBurst(envVars.Burst)
+	if err != nil {
+		return nil, err
+	}
+	return &redis_rate.Limit{Rate: rate.Rate, Period: rate.Period, Burst: burst}, nil
+}
+
+func parseRateLimit(envVar string, isRequired bool) (*redis_rate.Limit, error) {
 	var valStr string
-	if strings.HasSuffix(envVar, "_BYTES") {
+	if isRequired {
+		valStr = osext.MustGetenv(envVar)
+	} else {
 		valStr = os.Getenv(envVar)
 		if valStr == "" {
 			return nil, nil
 		}
-	} else {
-		valStr = osext.MustGetenv(envVar)
 	}
 
 	match := valueRx.FindStringSubmatch(valStr)
@@ -114,7 +144,7 @@ func parseRateLimit(envVar string) (*redis_rate.Limit, error) {
 func parseBurst(envVar string) (int, error) {
 	valStr := os.Getenv(envVar)
 	if valStr == "" {
-		if strings.HasSuffix(envVar, "_BYTES") {
+		if strings.Contains(envVar, "_BYTES") {
 			valStr = "0"
 		} else {
 			valStr = "5"
@@ -0,0 +1,448 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package gcs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// serviceAccountKey contains the fields that we need from a service account
+// key file as downloaded from the GCP console.
+type serviceAccountKey struct {
+	Type          string `json:"type"`
+	ClientEmail   string `json:"client_email"`
+	PrivateKeyPEM string `json:"private_key"`
+	TokenURI      string `json:"token_uri"`
+
+	privateKey *rsa.PrivateKey
+}
+
+func loadServiceAccountKey(path string) (*serviceAccountKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key serviceAccountKey
+	err = json.Unmarshal(buf, &key)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", path, err)
+	}
+
+	if key.Type != "service_account" {
+		return nil, fmt.Errorf("while parsing %s: expected type %q, but got %q", path, "service_account", key.Type)
+	}
+	if key.ClientEmail == "" {
+		return nil, fmt.Errorf("while parsing %s: missing value for %q", path, "client_email")
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	key.privateKey, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKeyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: cannot parse private key: %w", path, err)
+	}
+	return &key, nil
+}
+
+// gcsClient is a minimal client for the GCS JSON API.
+type gcsClient struct {
+	BaseURL string //e.g. "https://storage.googleapis.com"
+	Bucket  string
+	Key     *serviceAccountKey
+
+	token          string
+	tokenExpiresAt time.Time
+	tokenMutex     sync.Mutex
+}
+
+// gcsError is returned by gcsClient when GCS returns an unexpected status code.
+type gcsError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+// Error implements the builtin/error interface.
+func (e gcsError) Error() string {
+	return fmt.Sprintf("%s %s returned unexpected status %d: %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var gerr gcsError
+	return errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound
+}
+
+func (c *gcsClient) getToken() (string, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	//reuse the token until shortly before it expires
+	if c.token != "" && time.Until(c.tokenExpiresAt) > time.Minute {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   c.Key.ClientEmail,
+		"scope": gcsScope,
+		"aud":   c.Key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(c.Key.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	resp, err := http.PostForm(c.Key.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", gcsError{http.MethodPost, c.Key.TokenURI, resp.StatusCode, string(msg)}
+	}
+
+	var data struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode token response from %s: %w", c.Key.TokenURI, err)
+	}
+	c.token = data.AccessToken
+	c.tokenExpiresAt = now.Add(time.Duration(data.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// Do executes an authenticated request against GCS. The response body is
+// closed automatically unless the response has one of the expected status
+// codes.
+func (c *gcsClient) Do(req *http.Request, expectedStatusCodes ...int) (*http.Response, error) {
+	token, err := c.getToken()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expectedStatusCodes {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(resp.Body)
+	return nil, gcsError{req.Method, req.URL.String(), resp.StatusCode, strings.TrimSpace(string(msg))}
+}
+
+func (c *gcsClient) objectURL(objectName string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", c.BaseURL, url.PathEscape(c.Bucket), url.PathEscape(objectName))
+}
+
+func (c *gcsClient) uploadURL(uploadType, objectName string) string {
+	query := url.Values{}
+	query.Set("uploadType", uploadType)
+	query.Set("name", objectName)
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", c.BaseURL, url.PathEscape(c.Bucket), query.Encode())
+}
+
+// GetObjectSize returns the size of the given object.
+func (c *gcsClient) GetObjectSize(objectName string) (uint64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(objectName), http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.Do(req, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	//NOTE: GCS reports the size as a string because JSON numbers are not precise enough for uint64
+	var data struct {
+		Size uint64 `json:"size,string"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data.Size, err
+}
+
+// DownloadObject returns a reader for the contents of the given object.
+func (c *gcsClient) DownloadObject(objectName string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(objectName)+"?alt=media", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadObjectRange returns a reader for `length` bytes of the contents of
+// the given object, starting at byte offset `offset`.
+func (c *gcsClient) DownloadObjectRange(objectName string, offset, length uint64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(objectName)+"?alt=media", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.Do(req, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// UploadObject uploads a small object in a single request.
+func (c *gcsClient) UploadObject(objectName string, contents io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, c.uploadURL("media", objectName), contents)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.Do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteObject deletes the given object.
+func (c *gcsClient) DeleteObject(objectName string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.objectURL(objectName), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// ListObjects calls the callback once for each object name with the given prefix.
+func (c *gcsClient) ListObjects(prefix string, callback func(objectName string) error) error {
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("fields", "items(name),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", c.BaseURL, url.PathEscape(c.Bucket), query.Encode())
+		req, err := http.NewRequest(http.MethodGet, listURL, http.NoBody)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+
+		var data struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot decode object listing for %s: %w", prefix, err)
+		}
+
+		for _, item := range data.Items {
+			err := callback(item.Name)
+			if err != nil {
+				return err
+			}
+		}
+		if data.NextPageToken == "" {
+			return nil
+		}
+		pageToken = data.NextPageToken
+	}
+}
+
+// StartResumableUpload initiates a resumable upload session and returns the session URI.
+func (c *gcsClient) StartResumableUpload(objectName string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, c.uploadURL("resumable", objectName), http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	resp, err := c.Do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	sessionURI := resp.Header.Get("Location")
+	if sessionURI == "" {
+		return "", fmt.Errorf("POST %s did not return a session URI", req.URL.String())
+	}
+	return sessionURI, nil
+}
+
+// UploadToSession sends a segment of data into a resumable upload session.
+// The segment starts at the given offset. If totalSize is nil, the upload is
+// not complete after this segment, and the segment length must be a multiple
+// of resumableUploadQuantum. Otherwise, the upload is completed by this call.
+func (c *gcsClient) UploadToSession(sessionURI string, offset uint64, segment []byte, totalSize *uint64) error {
+	req, err := http.NewRequest(http.MethodPut, sessionURI, bytes.NewReader(segment))
+	if err != nil {
+		return err
+	}
+
+	total := "*"
+	if totalSize != nil {
+		total = fmt.Sprintf("%d", *totalSize)
+	}
+	if len(segment) == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%s", total))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+uint64(len(segment))-1, total))
+	}
+
+	//GCS answers with 308 Resume Incomplete while the upload is not complete yet
+	expectedStatus := http.StatusPermanentRedirect
+	if totalSize != nil {
+		expectedStatus = http.StatusOK
+	}
+	resp, err := c.Do(req, expectedStatus, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// CancelResumableUpload aborts a resumable upload session.
+func (c *gcsClient) CancelResumableUpload(sessionURI string) error {
+	req, err := http.NewRequest(http.MethodDelete, sessionURI, http.NoBody)
+	if err != nil {
+		return err
+	}
+	//GCS answers with 499 Client Closed Request when the cancellation was successful
+	resp, err := c.Do(req, 499, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SignedURL generates a V4 signed URL for downloading the given object.
+//
+// Reference: <https://cloud.google.com/storage/docs/access-control/signing-urls-manually>
+func (c *gcsClient) SignedURL(objectName string, now time.Time, validity time.Duration) (string, error) {
+	baseURL, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	datestamp := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	credentialScope := datestamp + "/auto/storage/goog4_request"
+
+	//NOTE: object names are escaped segment by segment, but slashes are kept
+	segments := strings.Split(objectName, "/")
+	for idx, segment := range segments {
+		segments[idx] = rfc3986Escape(segment)
+	}
+	canonicalPath := fmt.Sprintf("/%s/%s", rfc3986Escape(c.Bucket), strings.Join(segments, "/"))
+
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    c.Key.ClientEmail + "/" + credentialScope,
+		"X-Goog-Date":          timestamp,
+		"X-Goog-Expires":       fmt.Sprintf("%d", int64(validity/time.Second)),
+		"X-Goog-SignedHeaders": "host",
+	}
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	queryParts := make([]string, len(queryKeys))
+	for idx, key := range queryKeys {
+		queryParts[idx] = rfc3986Escape(key) + "=" + rfc3986Escape(query[key])
+	}
+	canonicalQuery := strings.Join(queryParts, "&")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalPath,
+		canonicalQuery,
+		"host:" + baseURL.Host + "\n", //canonical headers end with a newline
+		"host",                        //signed headers
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		timestamp,
+		credentialScope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+	stringToSignHash := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(nil, c.Key.privateKey, crypto.SHA256, stringToSignHash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Goog-Signature=%s",
+		baseURL.Scheme, baseURL.Host, canonicalPath, canonicalQuery, hex.EncodeToString(signature),
+	), nil
+}
+
+// Like url.QueryEscape, but uses the RFC 3986 encoding for spaces that GCS
+// expects in canonical requests.
+func rfc3986Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
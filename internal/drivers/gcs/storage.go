@@ -0,0 +1,324 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// All segments of a resumable upload except for the last one must have a size
+// that is a multiple of this value.
+const resumableUploadQuantum = 256 << 10
+
+// How much data we buffer in memory before sending it into a resumable upload
+// session. Must be a multiple of resumableUploadQuantum.
+const resumableUploadBlockSize = 32 * resumableUploadQuantum
+
+type gcsDriver struct {
+	client *gcsClient
+}
+
+func init() {
+	keppel.RegisterStorageDriver("gcs", func(_ keppel.AuthDriver, _ keppel.Configuration) (keppel.StorageDriver, error) {
+		bucketName := os.Getenv("KEPPEL_GCS_BUCKET")
+		if bucketName == "" {
+			return nil, errors.New("missing required environment variable: KEPPEL_GCS_BUCKET")
+		}
+		keyPath := os.Getenv("KEPPEL_GCS_CREDENTIALS_PATH")
+		if keyPath == "" {
+			return nil, errors.New("missing required environment variable: KEPPEL_GCS_CREDENTIALS_PATH")
+		}
+		key, err := loadServiceAccountKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &gcsDriver{
+			client: &gcsClient{
+				BaseURL: "https://storage.googleapis.com",
+				Bucket:  bucketName,
+				Key:     key,
+			},
+		}, nil
+	})
+}
+
+//All accounts share the same bucket, so all object names are prefixed with the account name.
+
+func blobObjectName(account keppel.Account, storageID string) string {
+	return fmt.Sprintf("%s/_blobs/%s/%s/%s", account.Name, storageID[0:2], storageID[2:4], storageID[4:])
+}
+
+func chunkObjectName(account keppel.Account, storageID string, chunkNumber uint32) string {
+	//NOTE: uint32 numbers never have more than 10 digits
+	return fmt.Sprintf("%s/_chunks/%s/%s/%s/%010d", account.Name, storageID[0:2], storageID[2:4], storageID[4:], chunkNumber)
+}
+
+func manifestObjectName(account keppel.Account, repoName, digest string) string {
+	return fmt.Sprintf("%s/%s/_manifests/%s", account.Name, repoName, digest)
+}
+
+// uploadState is persisted in the chunk object for the most recent chunk of a
+// blob upload. It describes the resumable upload session that the blob
+// contents are written into.
+//
+// Since GCS only accepts upload segments that are multiples of
+// resumableUploadQuantum (except for the last one), the bytes of each chunk
+// that do not fill a full quantum are stored in Tail until the next chunk (or
+// FinalizeBlob) comes along.
+type uploadState struct {
+	SessionURI string `json:"session_uri"`
+	Offset     uint64 `json:"offset"`
+	Tail       []byte `json:"tail"`
+}
+
+func (d *gcsDriver) loadUploadState(account keppel.Account, storageID string, chunkNumber uint32) (uploadState, error) {
+	var state uploadState
+	reader, err := d.client.DownloadObject(chunkObjectName(account, storageID, chunkNumber))
+	if err != nil {
+		return state, err
+	}
+	defer reader.Close()
+	err = json.NewDecoder(reader).Decode(&state)
+	return state, err
+}
+
+func (d *gcsDriver) storeUploadState(account keppel.Account, storageID string, chunkNumber uint32, state uploadState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return d.client.UploadObject(chunkObjectName(account, storageID, chunkNumber), bytes.NewReader(buf))
+}
+
+// AppendToBlob implements the keppel.StorageDriver interface.
+func (d *gcsDriver) AppendToBlob(account keppel.Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	//the first chunk opens the resumable upload session, all further chunks continue it
+	var (
+		state uploadState
+		err   error
+	)
+	if chunkNumber == 1 {
+		state.SessionURI, err = d.client.StartResumableUpload(blobObjectName(account, storageID))
+	} else {
+		state, err = d.loadUploadState(account, storageID, chunkNumber-1)
+	}
+	if err != nil {
+		return err
+	}
+
+	//send everything that fills complete quanta, and keep the rest as the new tail
+	reader := io.MultiReader(bytes.NewReader(state.Tail), chunk)
+	buf := make([]byte, resumableUploadBlockSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sendable := n - n%resumableUploadQuantum
+		if sendable > 0 {
+			err := d.client.UploadToSession(state.SessionURI, state.Offset, buf[:sendable], nil)
+			if err != nil {
+				return err
+			}
+			state.Offset += uint64(sendable)
+		}
+		if n < len(buf) {
+			state.Tail = append([]byte(nil), buf[sendable:n]...)
+			break
+		}
+	}
+
+	//persist the new state before cleaning up the previous one
+	err = d.storeUploadState(account, storageID, chunkNumber, state)
+	if err != nil {
+		return err
+	}
+	if chunkNumber > 1 {
+		return d.client.DeleteObject(chunkObjectName(account, storageID, chunkNumber-1))
+	}
+	return nil
+}
+
+// FinalizeBlob implements the keppel.StorageDriver interface.
+func (d *gcsDriver) FinalizeBlob(account keppel.Account, storageID string, chunkCount uint32) error {
+	if chunkCount == 0 {
+		//empty blob without any chunks
+		return d.client.UploadObject(blobObjectName(account, storageID), bytes.NewReader(nil))
+	}
+
+	state, err := d.loadUploadState(account, storageID, chunkCount)
+	if err != nil {
+		return err
+	}
+	totalSize := state.Offset + uint64(len(state.Tail))
+	err = d.client.UploadToSession(state.SessionURI, state.Offset, state.Tail, &totalSize)
+	if err != nil {
+		return err
+	}
+	return d.client.DeleteObject(chunkObjectName(account, storageID, chunkCount))
+}
+
+// AbortBlobUpload implements the keppel.StorageDriver interface.
+func (d *gcsDriver) AbortBlobUpload(account keppel.Account, storageID string, chunkCount uint32) error {
+	if chunkCount == 0 {
+		return nil
+	}
+
+	state, err := d.loadUploadState(account, storageID, chunkCount)
+	if err != nil {
+		if isNotFound(err) {
+			//nothing to clean up (e.g. because FinalizeBlob already went through)
+			return nil
+		}
+		return err
+	}
+
+	err = d.client.CancelResumableUpload(state.SessionURI)
+	if err != nil {
+		//keep going to clean up as much as we can
+		logg.Error("could not cancel resumable upload for blob %s in account %s: %s", storageID, account.Name, err.Error())
+	}
+	return d.client.DeleteObject(chunkObjectName(account, storageID, chunkCount))
+}
+
+// ReadBlob implements the keppel.StorageDriver interface.
+func (d *gcsDriver) ReadBlob(account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	objectName := blobObjectName(account, storageID)
+	sizeBytes, err := d.client.GetObjectSize(objectName)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, err := d.client.DownloadObject(objectName)
+	return reader, sizeBytes, err
+}
+
+// ReadBlobRange implements the keppel.StorageDriver interface.
+func (d *gcsDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	return d.client.DownloadObjectRange(blobObjectName(account, storageID), offset, length)
+}
+
+// URLForBlob implements the keppel.StorageDriver interface.
+func (d *gcsDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
+	return d.client.SignedURL(blobObjectName(account, storageID), time.Now(), 20*time.Minute)
+}
+
+// DeleteBlob implements the keppel.StorageDriver interface.
+func (d *gcsDriver) DeleteBlob(account keppel.Account, storageID string) error {
+	return d.client.DeleteObject(blobObjectName(account, storageID))
+}
+
+// ReadManifest implements the keppel.StorageDriver interface.
+func (d *gcsDriver) ReadManifest(account keppel.Account, repoName, digest string) ([]byte, error) {
+	reader, err := d.client.DownloadObject(manifestObjectName(account, repoName, digest))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// WriteManifest implements the keppel.StorageDriver interface.
+func (d *gcsDriver) WriteManifest(account keppel.Account, repoName, digest string, contents []byte) error {
+	return d.client.UploadObject(manifestObjectName(account, repoName, digest), bytes.NewReader(contents))
+}
+
+// DeleteManifest implements the keppel.StorageDriver interface.
+func (d *gcsDriver) DeleteManifest(account keppel.Account, repoName, digest string) error {
+	return d.client.DeleteObject(manifestObjectName(account, repoName, digest))
+}
+
+var (
+	//These regexes are used to reconstruct the storage ID from a blob's or chunk's object name.
+	//It's kinda the reverse of func blobObjectName() or func chunkObjectName(). The account name prefix is removed beforehand.
+	blobObjectNameRx  = regexp.MustCompile(`^_blobs/([^/]{2})/([^/]{2})/([^/]+)$`)
+	chunkObjectNameRx = regexp.MustCompile(`^_chunks/([^/]{2})/([^/]{2})/([^/]+)/([0-9]+)$`)
+	//This regex recovers the repo name and manifest digest from a manifest's object name.
+	//It's kinda the reverse of func manifestObjectName().
+	manifestObjectNameRx = regexp.MustCompile(`^(.+)/_manifests/([^/]+)$`)
+)
+
+// ListStorageContents implements the keppel.StorageDriver interface.
+func (d *gcsDriver) ListStorageContents(account keppel.Account) ([]keppel.StoredBlobInfo, []keppel.StoredManifestInfo, error) {
+	return keppel.CollectStorageContents(d, account)
+}
+
+// ListStorageContentsStream implements the keppel.StorageDriver interface.
+func (d *gcsDriver) ListStorageContentsStream(account keppel.Account, blobCallback func(keppel.StoredBlobInfo) error, manifestCallback func(keppel.StoredManifestInfo) error) error {
+	prefix := account.Name + "/"
+	return d.client.ListObjects(prefix, func(objectName string) error {
+		name := strings.TrimPrefix(objectName, prefix)
+		if match := blobObjectNameRx.FindStringSubmatch(name); match != nil {
+			return blobCallback(keppel.StoredBlobInfo{
+				StorageID:  match[1] + match[2] + match[3],
+				ChunkCount: 0,
+			})
+		}
+		if match := chunkObjectNameRx.FindStringSubmatch(name); match != nil {
+			//NOTE: There is only one chunk object per upload since AppendToBlob() removes the previous one.
+			chunkNumber, err := strconv.ParseUint(match[4], 10, 32)
+			if err != nil {
+				return fmt.Errorf("while parsing chunk object name %s: %s", objectName, err.Error())
+			}
+			return blobCallback(keppel.StoredBlobInfo{
+				StorageID:  match[1] + match[2] + match[3],
+				ChunkCount: uint32(chunkNumber),
+			})
+		}
+		if match := manifestObjectNameRx.FindStringSubmatch(name); match != nil {
+			return manifestCallback(keppel.StoredManifestInfo{
+				RepoName: match[1],
+				Digest:   match[2],
+			})
+		}
+		return fmt.Errorf("encountered unexpected object while listing storage contents of account %s: %s", account.Name, objectName)
+	})
+}
+
+// CleanupAccount implements the keppel.StorageDriver interface.
+func (d *gcsDriver) CleanupAccount(account keppel.Account) error {
+	//since all accounts share the same bucket, there is nothing to delete here;
+	//we only verify that the account's part of the bucket is empty
+	var objectNames []string
+	err := d.client.ListObjects(account.Name+"/", func(objectName string) error {
+		objectNames = append(objectNames, objectName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(objectNames) > 0 {
+		return fmt.Errorf("found undeleted objects for account %s: %s", account.Name, strings.Join(objectNames, ", "))
+	}
+	return nil
+}
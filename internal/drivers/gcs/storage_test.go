@@ -0,0 +1,449 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package gcs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// fake GCS server
+
+// fakeGCS implements the subset of the GCS JSON API that gcsClient uses.
+type fakeGCS struct {
+	URL      string
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	sessions map[string]*fakeSession
+	nextID   int
+}
+
+type fakeSession struct {
+	ObjectName string
+	Contents   []byte
+}
+
+var contentRangeRx = regexp.MustCompile(`^bytes (?:\*|(\d+)-(\d+))/(\*|\d+)$`)
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path == "/token" {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.FormValue("assertion") == "" {
+			http.Error(w, "invalid token request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"fake-token","expires_in":3600}`)) //nolint:errcheck
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer fake-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	escapedPath := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(escapedPath, "/upload/storage/v1/b/test-bucket/o"):
+		f.serveUpload(w, r, query)
+	case escapedPath == "/storage/v1/b/test-bucket/o" && r.Method == http.MethodGet:
+		f.serveList(w, query)
+	case strings.HasPrefix(escapedPath, "/storage/v1/b/test-bucket/o/"):
+		objectName, err := url.PathUnescape(strings.TrimPrefix(escapedPath, "/storage/v1/b/test-bucket/o/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contents, exists := f.objects[objectName]
+		if !exists {
+			http.Error(w, "no such object: "+objectName, http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && query.Get("alt") == "media":
+			//ServeContent() takes care of Range headers for us
+			http.ServeContent(w, r, objectName, time.Time{}, bytes.NewReader(contents))
+		case r.Method == http.MethodGet:
+			fmt.Fprintf(w, `{"name":%q,"size":"%d"}`, objectName, len(contents))
+		case r.Method == http.MethodDelete:
+			delete(f.objects, objectName)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) serveUpload(w http.ResponseWriter, r *http.Request, query url.Values) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Get("uploadType") == "media":
+		f.objects[query.Get("name")] = body
+		w.Write([]byte(`{}`)) //nolint:errcheck
+
+	case r.Method == http.MethodPost && query.Get("uploadType") == "resumable":
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.sessions[id] = &fakeSession{ObjectName: query.Get("name")}
+		w.Header().Set("Location", fmt.Sprintf("%s/upload/storage/v1/b/test-bucket/o?uploadType=resumable&upload_id=%s", f.URL, id))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPut:
+		session := f.sessions[query.Get("upload_id")]
+		if session == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		match := contentRangeRx.FindStringSubmatch(r.Header.Get("Content-Range"))
+		if match == nil {
+			http.Error(w, "malformed Content-Range", http.StatusBadRequest)
+			return
+		}
+		isFinal := match[3] != "*"
+		if match[1] != "" {
+			start, _ := strconv.Atoi(match[1])
+			end, _ := strconv.Atoi(match[2])
+			if start != len(session.Contents) || end-start+1 != len(body) {
+				http.Error(w, "Content-Range does not match session state", http.StatusBadRequest)
+				return
+			}
+			if !isFinal && len(body)%resumableUploadQuantum != 0 {
+				http.Error(w, "non-final segment is not a multiple of 256 KiB", http.StatusBadRequest)
+				return
+			}
+			session.Contents = append(session.Contents, body...)
+		}
+		if !isFinal {
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		if total, _ := strconv.Atoi(match[3]); total != len(session.Contents) {
+			http.Error(w, "total size does not match session state", http.StatusBadRequest)
+			return
+		}
+		f.objects[session.ObjectName] = session.Contents
+		delete(f.sessions, query.Get("upload_id"))
+		w.Write([]byte(`{}`)) //nolint:errcheck
+
+	case r.Method == http.MethodDelete:
+		delete(f.sessions, query.Get("upload_id"))
+		w.WriteHeader(499)
+
+	default:
+		http.Error(w, "unexpected upload request", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) serveList(w http.ResponseWriter, query url.Values) {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, query.Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	//return at most two objects per page to exercise the pagination
+	offset, _ := strconv.Atoi(query.Get("pageToken"))
+	type item struct {
+		Name string `json:"name"`
+	}
+	var data struct {
+		Items         []item `json:"items,omitempty"`
+		NextPageToken string `json:"nextPageToken,omitempty"`
+	}
+	for idx := offset; idx < len(names) && idx < offset+2; idx++ {
+		data.Items = append(data.Items, item{names[idx]})
+	}
+	if offset+2 < len(names) {
+		data.NextPageToken = strconv.Itoa(offset + 2)
+	}
+	json.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// test setup
+
+func setupFakeGCS(t *testing.T) (*gcsDriver, *fakeGCS, *rsa.PrivateKey) {
+	t.Helper()
+	fake := &fakeGCS{
+		objects:  make(map[string][]byte),
+		sessions: make(map[string]*fakeSession),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	fake.URL = server.URL
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	})
+	keyJSON, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "keppel@example.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    server.URL + "/token",
+	})
+	keyPath := filepath.Join(t.TempDir(), "key.json")
+	err = os.WriteFile(keyPath, keyJSON, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadServiceAccountKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &gcsDriver{client: &gcsClient{
+		BaseURL: server.URL,
+		Bucket:  "test-bucket",
+		Key:     key,
+	}}
+	return d, fake, privateKey
+}
+
+func mustSucceed(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func makeRandomBytes(t *testing.T, length int) []byte {
+	t.Helper()
+	buf := make([]byte, length)
+	_, err := rand.Read(buf)
+	mustSucceed(t, err)
+	return buf
+}
+
+var testAccount = keppel.Account{Name: "test1"}
+
+const testStorageID = "0123456789abcdef"
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestChunkedUploadAndFinalize(t *testing.T) {
+	d, fake, _ := setupFakeGCS(t)
+
+	//use chunk sizes that do not line up with the resumable upload quantum
+	chunks := [][]byte{
+		makeRandomBytes(t, 100<<10),
+		makeRandomBytes(t, 300<<10),
+		makeRandomBytes(t, resumableUploadBlockSize+700<<10),
+	}
+	for idx, chunk := range chunks {
+		chunkLength := uint64(len(chunk))
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, uint32(idx+1), &chunkLength, bytes.NewReader(chunk)))
+	}
+
+	//the unfinished upload must show up in the storage listing
+	blobs, manifests, err := d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedBlobs := []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 3}}
+	if fmt.Sprint(blobs) != fmt.Sprint(expectedBlobs) || len(manifests) != 0 {
+		t.Errorf("expected storage contents %v, but got %v and %v", expectedBlobs, blobs, manifests)
+	}
+
+	mustSucceed(t, d.FinalizeBlob(testAccount, testStorageID, 3))
+	if len(fake.sessions) != 0 {
+		t.Errorf("expected all upload sessions to be completed, but %d are left", len(fake.sessions))
+	}
+
+	//read back the finalized blob
+	reader, sizeBytes, err := d.ReadBlob(testAccount, testStorageID)
+	mustSucceed(t, err)
+	contents, err := io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	expectedContents := bytes.Join(chunks, nil)
+	if sizeBytes != uint64(len(expectedContents)) {
+		t.Errorf("expected blob size %d, but got %d", len(expectedContents), sizeBytes)
+	}
+	if !bytes.Equal(contents, expectedContents) {
+		t.Error("blob contents do not match the uploaded chunks")
+	}
+
+	//read back a part of the finalized blob
+	reader, err = d.ReadBlobRange(testAccount, testStorageID, 1000, 5000)
+	mustSucceed(t, err)
+	contents, err = io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	if !bytes.Equal(contents, expectedContents[1000:6000]) {
+		t.Error("partial blob contents do not match the uploaded chunks")
+	}
+
+	//only the finalized blob should remain
+	blobs, _, err = d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedBlobs = []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 0}}
+	if fmt.Sprint(blobs) != fmt.Sprint(expectedBlobs) {
+		t.Errorf("expected storage contents %v, but got %v", expectedBlobs, blobs)
+	}
+
+	mustSucceed(t, d.DeleteBlob(testAccount, testStorageID))
+	mustSucceed(t, d.CleanupAccount(testAccount))
+}
+
+func TestAbortUpload(t *testing.T) {
+	d, fake, _ := setupFakeGCS(t)
+
+	for chunkNumber := uint32(1); chunkNumber <= 2; chunkNumber++ {
+		chunk := makeRandomBytes(t, 300<<10)
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, chunkNumber, nil, bytes.NewReader(chunk)))
+	}
+	if len(fake.sessions) != 1 {
+		t.Fatalf("expected 1 upload session, but got %d", len(fake.sessions))
+	}
+
+	mustSucceed(t, d.AbortBlobUpload(testAccount, testStorageID, 2))
+	if len(fake.sessions) != 0 {
+		t.Errorf("expected upload session to be cancelled, but %d are left", len(fake.sessions))
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("expected no objects to be left, but got %d", len(fake.objects))
+	}
+	mustSucceed(t, d.CleanupAccount(testAccount))
+
+	//aborting again (e.g. from the janitor) is not an error
+	mustSucceed(t, d.AbortBlobUpload(testAccount, testStorageID, 2))
+}
+
+func TestManifests(t *testing.T) {
+	d, _, _ := setupFakeGCS(t)
+
+	contents := []byte(`{"schemaVersion":2}`)
+	digest := "sha256:" + strings.Repeat("0", 64)
+	mustSucceed(t, d.WriteManifest(testAccount, "foo/bar", digest, contents))
+
+	readContents, err := d.ReadManifest(testAccount, "foo/bar", digest)
+	mustSucceed(t, err)
+	if !bytes.Equal(readContents, contents) {
+		t.Errorf("expected manifest contents %q, but got %q", contents, readContents)
+	}
+
+	_, manifests, err := d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	expectedManifests := []keppel.StoredManifestInfo{{RepoName: "foo/bar", Digest: digest}}
+	if fmt.Sprint(manifests) != fmt.Sprint(expectedManifests) {
+		t.Errorf("expected manifests %v, but got %v", expectedManifests, manifests)
+	}
+
+	//CleanupAccount refuses to clean up while objects remain
+	if d.CleanupAccount(testAccount) == nil {
+		t.Error("expected CleanupAccount to fail while a manifest exists")
+	}
+	mustSucceed(t, d.DeleteManifest(testAccount, "foo/bar", digest))
+	mustSucceed(t, d.CleanupAccount(testAccount))
+}
+
+func TestURLForBlob(t *testing.T) {
+	d, _, privateKey := setupFakeGCS(t)
+
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	signedURL, err := d.client.SignedURL(blobObjectName(testAccount, testStorageID), now, 20*time.Minute)
+	mustSucceed(t, err)
+
+	u, err := url.Parse(signedURL)
+	mustSucceed(t, err)
+	if u.Path != "/test-bucket/test1/_blobs/01/23/456789abcdef" {
+		t.Errorf("unexpected path in signed URL: %q", u.Path)
+	}
+	query := u.Query()
+	expectedQuery := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    "keppel@example.iam.gserviceaccount.com/20220901/auto/storage/goog4_request",
+		"X-Goog-Date":          "20220901T120000Z",
+		"X-Goog-Expires":       "1200",
+		"X-Goog-SignedHeaders": "host",
+	}
+	for key, value := range expectedQuery {
+		if query.Get(key) != value {
+			t.Errorf("expected %s=%q in signed URL, but got %q", key, value, query.Get(key))
+		}
+	}
+
+	//verify the signature by reconstructing the string to sign
+	canonicalQuery := strings.SplitN(u.RawQuery, "&X-Goog-Signature=", 2)[0]
+	canonicalRequest := fmt.Sprintf("GET\n%s\n%s\nhost:%s\n\nhost\nUNSIGNED-PAYLOAD", u.EscapedPath(), canonicalQuery, u.Host)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("GOOG4-RSA-SHA256\n20220901T120000Z\n20220901/auto/storage/goog4_request\n%s",
+		hex.EncodeToString(canonicalRequestHash[:]))
+	stringToSignHash := sha256.Sum256([]byte(stringToSign))
+	signature, err := hex.DecodeString(query.Get("X-Goog-Signature"))
+	mustSucceed(t, err)
+	err = rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, stringToSignHash[:], signature)
+	if err != nil {
+		t.Errorf("signature in signed URL does not verify: %s", err.Error())
+	}
+}
+
+func TestLoadServiceAccountKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "key.json")
+	mustSucceed(t, os.WriteFile(keyPath, []byte(`{"type":"authorized_user","client_email":"foo@example.com"}`), 0600))
+	_, err := loadServiceAccountKey(keyPath)
+	if err == nil || !strings.Contains(err.Error(), `expected type "service_account"`) {
+		t.Errorf("expected error for wrong key type, but got %v", err)
+	}
+
+	_, err = loadServiceAccountKey(filepath.Join(t.TempDir(), "nonexistent.json"))
+	if err == nil {
+		t.Error("expected error for nonexistent key file, but got none")
+	}
+}
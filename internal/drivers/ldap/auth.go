@@ -0,0 +1,287 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+// Package ldap contains the AuthDriver "ldap": Users are authenticated by
+// binding to an LDAP server, and their group memberships are mapped to Keppel
+// permissions through a static mapping file.
+package ldap
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/go-redis/redis/v8"
+	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// ldapConn is the subset of *goldap.Conn that we use. This interface allows
+// unit tests to substitute a mock LDAP server.
+type ldapConn interface {
+	Bind(userName, password string) error
+	Search(req *goldap.SearchRequest) (*goldap.SearchResult, error)
+	Close()
+}
+
+type ldapConfig struct {
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	GroupAttribute string
+}
+
+type authDriver struct {
+	cfg     ldapConfig
+	mapping keppel.PermissionMapping
+	dial    func() (ldapConn, error)
+}
+
+func init() {
+	keppel.RegisterUserIdentity("ldap", deserializeLDAPUserIdentity)
+	keppel.RegisterAuthDriver("ldap", func(rc *redis.Client) (keppel.AuthDriver, error) {
+		uri, err := url.Parse(osext.MustGetenv("KEPPEL_LDAP_URI"))
+		if err != nil {
+			return nil, fmt.Errorf("malformed KEPPEL_LDAP_URI: %w", err)
+		}
+		if uri.Scheme != "ldap" && uri.Scheme != "ldaps" {
+			return nil, fmt.Errorf(`malformed KEPPEL_LDAP_URI: expected scheme "ldap" or "ldaps", but got %q`, uri.Scheme)
+		}
+		startTLS := osext.GetenvBool("KEPPEL_LDAP_START_TLS")
+		if startTLS && uri.Scheme == "ldaps" {
+			return nil, errors.New("KEPPEL_LDAP_START_TLS cannot be used with an ldaps:// URI")
+		}
+
+		//NOTE: DNs are case-insensitive
+		mapping, err := keppel.LoadPermissionMapping(osext.MustGetenv("KEPPEL_LDAP_GROUP_MAPPING_PATH"), "group", true)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := ldapConfig{
+			BindDN:         os.Getenv("KEPPEL_LDAP_BIND_DN"),
+			BindPassword:   os.Getenv("KEPPEL_LDAP_BIND_PASSWORD"),
+			BaseDN:         osext.MustGetenv("KEPPEL_LDAP_BASE_DN"),
+			UserFilter:     osext.GetenvOrDefault("KEPPEL_LDAP_USER_FILTER", "(uid=%s)"),
+			GroupAttribute: osext.GetenvOrDefault("KEPPEL_LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		}
+		if strings.Count(cfg.UserFilter, "%s") != 1 {
+			return nil, fmt.Errorf("malformed KEPPEL_LDAP_USER_FILTER: expected exactly one %%s placeholder, but got %q", cfg.UserFilter)
+		}
+
+		dial := func() (ldapConn, error) {
+			conn, err := goldap.DialURL(uri.String(), goldap.DialWithTLSConfig(&tls.Config{ServerName: uri.Hostname()})) //nolint:gosec // TLS version is chosen by Go
+			if err != nil {
+				return nil, err
+			}
+			if startTLS {
+				err = conn.StartTLS(&tls.Config{ServerName: uri.Hostname()}) //nolint:gosec // TLS version is chosen by Go
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		}
+
+		//binding to LDAP for every request with Basic auth is rather slow, so
+		//successful logins are cached for a short while (if Redis is available)
+		return keppel.WithAuthCache(&authDriver{cfg, mapping, dial}, rc, 5*time.Minute), nil
+	})
+}
+
+// connect opens a connection to the LDAP server and binds as the service user
+// (if configured).
+func (d *authDriver) connect() (ldapConn, error) {
+	conn, err := d.dial()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to LDAP server: %w", err)
+	}
+	if d.cfg.BindDN != "" {
+		err = conn.Bind(d.cfg.BindDN, d.cfg.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot bind to LDAP server as %s: %w", d.cfg.BindDN, err)
+		}
+	}
+	return conn, nil
+}
+
+// DriverName implements the keppel.AuthDriver interface.
+func (d *authDriver) DriverName() string {
+	return "ldap"
+}
+
+// ValidateTenantID implements the keppel.AuthDriver interface.
+func (d *authDriver) ValidateTenantID(tenantID string) error {
+	if tenantID == "" {
+		return errors.New("may not be empty")
+	}
+
+	//tenants that appear in the group mapping are always valid
+	if d.mapping.ReferencesAuthTenant(tenantID) {
+		return nil
+	}
+
+	//otherwise, the tenant must exist as an OU below the base DN
+	conn, err := d.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	result, err := conn.Search(goldap.NewSearchRequest(
+		d.cfg.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 1, 0, false,
+		fmt.Sprintf("(&(objectClass=organizationalUnit)(ou=%s))", goldap.EscapeFilter(tenantID)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		return fmt.Errorf("cannot search for OU in LDAP: %w", err)
+	}
+	if result == nil || len(result.Entries) == 0 {
+		return errors.New("no such OU in LDAP, and not referenced in group mapping")
+	}
+	return nil
+}
+
+// AuthenticateUser implements the keppel.AuthDriver interface.
+func (d *authDriver) AuthenticateUser(userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	//NOTE: An empty password would cause an unauthenticated bind, which succeeds on most LDAP servers.
+	if userName == "" || password == "" {
+		return nil, keppel.ErrUnauthorized.With(`invalid username or password`)
+	}
+
+	conn, err := d.connect()
+	if err != nil {
+		logg.Error("while authenticating user %q: %s", userName, err.Error())
+		return nil, keppel.ErrUnavailable.With("cannot reach LDAP server")
+	}
+	defer conn.Close()
+
+	//find user entry
+	result, err := conn.Search(goldap.NewSearchRequest(
+		d.cfg.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(d.cfg.UserFilter, goldap.EscapeFilter(userName)),
+		[]string{"dn", d.cfg.GroupAttribute}, nil,
+	))
+	if err != nil {
+		logg.Error("while searching for LDAP user %q: %s", userName, err.Error())
+		return nil, keppel.ErrUnavailable.With("cannot search for user in LDAP")
+	}
+	if len(result.Entries) != 1 {
+		return nil, keppel.ErrUnauthorized.With(`invalid username or password`)
+	}
+	entry := result.Entries[0]
+
+	//verify password
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, keppel.ErrUnauthorized.With(`invalid username or password`)
+		}
+		logg.Error("while binding as LDAP user %q: %s", entry.DN, err.Error())
+		return nil, keppel.ErrUnavailable.With("cannot verify password with LDAP")
+	}
+
+	groupDNs := entry.GetAttributeValues(d.cfg.GroupAttribute)
+	return userIdentity{
+		Name:        userName,
+		Groups:      groupDNs,
+		Permissions: d.mapping.ComputePermissions(groupDNs),
+	}, nil
+}
+
+// AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+func (d *authDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	if r.Header.Get("Authorization") == "" {
+		//fallback to anonymous auth
+		return nil, nil
+	}
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, keppel.ErrUnauthorized.With("malformed Authorization header (expected Basic auth)")
+	}
+	return d.AuthenticateUser(userName, password)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type userIdentity
+
+type userIdentity struct {
+	Name string `json:"name"`
+	//DNs of the groups that the user belongs to, for matching by RBAC policies
+	Groups []string `json:"groups,omitempty"`
+	//key = auth tenant ID (or "" for global permissions)
+	Permissions map[string][]keppel.Permission `json:"perms"`
+}
+
+func deserializeLDAPUserIdentity(in []byte, ad keppel.AuthDriver) (keppel.UserIdentity, error) {
+	if _, ok := ad.(*authDriver); !ok {
+		return nil, keppel.ErrAuthDriverMismatch
+	}
+	var uid userIdentity
+	err := json.Unmarshal(in, &uid)
+	return uid, err
+}
+
+// HasPermission implements the keppel.UserIdentity interface.
+func (uid userIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
+	for _, p := range uid.Permissions[tenantID] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupNames implements the keppel.GroupMembership interface.
+func (uid userIdentity) GroupNames() []string {
+	return uid.Groups
+}
+
+// UserType implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserType() keppel.UserType {
+	return keppel.RegularUser
+}
+
+// UserName implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserName() string {
+	return uid.Name
+}
+
+// UserInfo implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserInfo() audittools.UserInfo {
+	return nil
+}
+
+// SerializeToJSON implements the keppel.UserIdentity interface.
+func (uid userIdentity) SerializeToJSON() (typeName string, payload []byte, err error) {
+	payload, err = json.Marshal(uid)
+	return "ldap", payload, err
+}
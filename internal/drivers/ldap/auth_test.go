@@ -0,0 +1,383 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package ldap
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// mock LDAP server
+
+type mockUser struct {
+	DN       string
+	Password string
+	Groups   []string
+}
+
+// mockLDAP is an in-memory LDAP server that understands the bind and search
+// operations that authDriver performs.
+type mockLDAP struct {
+	Users    map[string]mockUser //key = uid
+	OUs      []string
+	BoundDNs []string
+}
+
+type mockConn struct {
+	server *mockLDAP
+}
+
+var (
+	userFilterRx = regexp.MustCompile(`^\(uid=([^)]*)\)$`)
+	ouFilterRx   = regexp.MustCompile(`^\(&\(objectClass=organizationalUnit\)\(ou=([^)]*)\)\)$`)
+)
+
+func (c mockConn) Bind(userName, password string) error {
+	if userName == "cn=keppel,dc=example,dc=com" && password == "service-secret" {
+		c.server.BoundDNs = append(c.server.BoundDNs, userName)
+		return nil
+	}
+	for _, user := range c.server.Users {
+		if user.DN == userName && user.Password == password {
+			c.server.BoundDNs = append(c.server.BoundDNs, userName)
+			return nil
+		}
+	}
+	return goldap.NewError(goldap.LDAPResultInvalidCredentials, nil)
+}
+
+func (c mockConn) Search(req *goldap.SearchRequest) (*goldap.SearchResult, error) {
+	result := &goldap.SearchResult{}
+	if match := userFilterRx.FindStringSubmatch(req.Filter); match != nil {
+		if user, exists := c.server.Users[match[1]]; exists {
+			entry := goldap.NewEntry(user.DN, map[string][]string{"memberOf": user.Groups})
+			result.Entries = append(result.Entries, entry)
+		}
+		return result, nil
+	}
+	if match := ouFilterRx.FindStringSubmatch(req.Filter); match != nil {
+		for _, ou := range c.server.OUs {
+			if ou == match[1] {
+				result.Entries = append(result.Entries, goldap.NewEntry("ou="+ou+",dc=example,dc=com", nil))
+			}
+		}
+		return result, nil
+	}
+	return nil, goldap.NewError(goldap.LDAPResultFilterError, nil)
+}
+
+func (c mockConn) Close() {}
+
+////////////////////////////////////////////////////////////////////////////////
+// test setup
+
+const testGroupMapping = `[
+	{ "group": "cn=developers,ou=groups,dc=example,dc=com", "auth_tenant_id": "team1", "permissions": ["view", "pull", "push"] },
+	{ "group": "CN=Operators,OU=Groups,DC=example,DC=com", "auth_tenant_id": "team1", "permissions": ["view", "delete", "change"] },
+	{ "group": "cn=operators,ou=groups,dc=example,dc=com", "permissions": ["keppeladmin"] }
+]`
+
+func setupDriver(t *testing.T) (*authDriver, *mockLDAP) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(path, []byte(testGroupMapping), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mapping, err := keppel.LoadPermissionMapping(path, "group", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := &mockLDAP{
+		Users: map[string]mockUser{
+			"alice": {
+				DN:       "uid=alice,ou=people,dc=example,dc=com",
+				Password: "alice-secret",
+				Groups:   []string{"cn=developers,ou=groups,dc=example,dc=com"},
+			},
+			"bob": {
+				DN:       "uid=bob,ou=people,dc=example,dc=com",
+				Password: "bob-secret",
+				Groups:   []string{"cn=developers,ou=groups,dc=example,dc=com", "cn=operators,ou=groups,dc=example,dc=com"},
+			},
+			"mallory": {
+				DN:       "uid=mallory,ou=people,dc=example,dc=com",
+				Password: "mallory-secret",
+				Groups:   []string{"cn=visitors,ou=groups,dc=example,dc=com"},
+			},
+		},
+		OUs: []string{"team2"},
+	}
+
+	d := &authDriver{
+		cfg: ldapConfig{
+			BindDN:         "cn=keppel,dc=example,dc=com",
+			BindPassword:   "service-secret",
+			BaseDN:         "dc=example,dc=com",
+			UserFilter:     "(uid=%s)",
+			GroupAttribute: "memberOf",
+		},
+		mapping: mapping,
+		dial:    func() (ldapConn, error) { return mockConn{server}, nil },
+	}
+	return d, server
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestAuthenticateUserSuccess(t *testing.T) {
+	d, server := setupDriver(t)
+
+	uid, rerr := d.AuthenticateUser("alice", "alice-secret")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	if uid.UserName() != "alice" {
+		t.Errorf("expected user name %q, but got %q", "alice", uid.UserName())
+	}
+	if uid.UserType() != keppel.RegularUser {
+		t.Errorf("expected regular user, but got user type %d", uid.UserType())
+	}
+	expectedBinds := []string{"cn=keppel,dc=example,dc=com", "uid=alice,ou=people,dc=example,dc=com"}
+	if !reflect.DeepEqual(server.BoundDNs, expectedBinds) {
+		t.Errorf("expected binds %v, but got %v", expectedBinds, server.BoundDNs)
+	}
+
+	//AuthenticateUserFromRequest reads the same credentials from a Basic auth header
+	r, _ := http.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("Authorization", keppel.BuildBasicAuthHeader("alice", "alice-secret"))
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	if uid.UserName() != "alice" {
+		t.Errorf("expected user name %q, but got %q", "alice", uid.UserName())
+	}
+
+	//requests without Authorization header are anonymous
+	r.Header.Del("Authorization")
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected anonymous request to yield (nil, nil), but got (%v, %v)", uid, rerr)
+	}
+}
+
+func TestAuthenticateUserFailure(t *testing.T) {
+	d, _ := setupDriver(t)
+
+	testCases := []struct {
+		UserName string
+		Password string
+	}{
+		{"alice", "wrong-password"},
+		{"alice", ""}, //must not be treated as an unauthenticated bind
+		{"nobody", "alice-secret"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		uid, rerr := d.AuthenticateUser(tc.UserName, tc.Password)
+		if uid != nil {
+			t.Errorf("expected authentication of %q with password %q to fail, but got user %q", tc.UserName, tc.Password, uid.UserName())
+		}
+		if rerr == nil || rerr.Code != keppel.ErrUnauthorized {
+			t.Errorf("expected authentication of %q with password %q to fail with %s, but got %v", tc.UserName, tc.Password, keppel.ErrUnauthorized, rerr)
+		}
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("Authorization", keppel.BuildBasicAuthHeader("alice", "wrong-password"))
+	_, rerr := d.AuthenticateUserFromRequest(r)
+	if rerr == nil || rerr.Code != keppel.ErrUnauthorized {
+		t.Errorf("expected AuthenticateUserFromRequest to fail with %s, but got %v", keppel.ErrUnauthorized, rerr)
+	}
+}
+
+func TestAuthCacheForBasicAuthRequests(t *testing.T) {
+	d, server := setupDriver(t)
+	sr := miniredis.RunT(t)
+	ad := keppel.WithAuthCache(d, redis.NewClient(&redis.Options{Addr: sr.Addr()}), 5*time.Minute)
+
+	//only the first of two requests with the same Basic auth credentials shall
+	//bind to LDAP (once as the service user, once as the user itself)
+	for idx := 0; idx < 2; idx++ {
+		r, _ := http.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+		r.Header.Set("Authorization", keppel.BuildBasicAuthHeader("alice", "alice-secret"))
+		uid, rerr := ad.AuthenticateUserFromRequest(r)
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+		if uid.UserName() != "alice" {
+			t.Errorf("expected user name %q, but got %q", "alice", uid.UserName())
+		}
+	}
+	if len(server.BoundDNs) != 2 {
+		t.Errorf("expected 2 binds, but got %d binds: %v", len(server.BoundDNs), server.BoundDNs)
+	}
+}
+
+func TestGroupMapping(t *testing.T) {
+	d, _ := setupDriver(t)
+
+	type permCheck struct {
+		Perm     keppel.Permission
+		TenantID string
+		Expected bool
+	}
+	testCases := map[string][]permCheck{
+		"alice": {
+			{keppel.CanViewAccount, "team1", true},
+			{keppel.CanPushToAccount, "team1", true},
+			{keppel.CanDeleteFromAccount, "team1", false},
+			{keppel.CanPullFromAccount, "team2", false},
+			{keppel.CanAdministrateKeppel, "", false},
+		},
+		"bob": {
+			{keppel.CanPushToAccount, "team1", true},
+			{keppel.CanDeleteFromAccount, "team1", true},
+			{keppel.CanChangeAccount, "team1", true},
+			{keppel.CanChangeQuotas, "team1", false},
+			{keppel.CanAdministrateKeppel, "", true},
+		},
+		"mallory": {
+			{keppel.CanViewAccount, "team1", false},
+			{keppel.CanAdministrateKeppel, "", false},
+		},
+	}
+
+	for userName, checks := range testCases {
+		uid, rerr := d.AuthenticateUser(userName, userName+"-secret")
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+
+		//permissions must survive the serialization roundtrip for inclusion in tokens
+		typeName, payload, err := uid.SerializeToJSON()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		uid2, err := keppel.DeserializeUserIdentity(typeName, payload, d)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, check := range checks {
+			for _, u := range []keppel.UserIdentity{uid, uid2} {
+				actual := u.HasPermission(check.Perm, check.TenantID)
+				if actual != check.Expected {
+					t.Errorf("expected HasPermission(%q, %q) = %t for user %q, but got %t",
+						check.Perm, check.TenantID, check.Expected, userName, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestGroupMembershipForRBACPolicies(t *testing.T) {
+	d, _ := setupDriver(t)
+	policy := keppel.RBACPolicy{
+		AccountName:  "test1",
+		GroupPattern: "cn=operators,ou=groups,dc=example,dc=com",
+		CanPull:      true,
+	}
+
+	testCases := map[string]bool{
+		"alice": false,
+		"bob":   true,
+	}
+	for userName, expected := range testCases {
+		uid, rerr := d.AuthenticateUser(userName, userName+"-secret")
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+
+		//group memberships must survive the serialization roundtrip for inclusion in tokens
+		typeName, payload, err := uid.SerializeToJSON()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		uid2, err := keppel.DeserializeUserIdentity(typeName, payload, d)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, u := range []keppel.UserIdentity{uid, uid2} {
+			gm, ok := u.(keppel.GroupMembership)
+			if !ok {
+				t.Fatalf("expected LDAP user identity to implement keppel.GroupMembership, but got %T", u)
+			}
+			actual := policy.Matches("127.0.0.1", "test1/foo", userName, gm.GroupNames())
+			if actual != expected {
+				t.Errorf("expected RBAC policy with match_group to return %t for user %q, but got %t", expected, userName, actual)
+			}
+		}
+	}
+}
+
+func TestValidateTenantID(t *testing.T) {
+	d, _ := setupDriver(t)
+
+	//"team1" is referenced in the group mapping, "team2" exists as an OU
+	for _, tenantID := range []string{"team1", "team2"} {
+		err := d.ValidateTenantID(tenantID)
+		if err != nil {
+			t.Errorf("expected tenant ID %q to be valid, but got: %s", tenantID, err.Error())
+		}
+	}
+	for _, tenantID := range []string{"", "team3"} {
+		err := d.ValidateTenantID(tenantID)
+		if err == nil {
+			t.Errorf("expected tenant ID %q to be invalid, but got no error", tenantID)
+		}
+	}
+}
+
+func TestLoadGroupMappingRulesValidation(t *testing.T) {
+	testCases := map[string]string{
+		`[{"auth_tenant_id":"team1","permissions":["view"]}]`:                     `missing the "group" attribute`,
+		`[{"group":"cn=foo","permissions":["view"]}]`:                             `needs the "auth_tenant_id" attribute`,
+		`[{"group":"cn=foo","auth_tenant_id":"t","permissions":["keppeladmin"]}]`: `cannot grant the global permission`,
+		`[{"group":"cn=foo","auth_tenant_id":"t","permissions":["fly"]}]`:         `unknown permission "fly"`,
+	}
+	for input, expectedError := range testCases {
+		path := filepath.Join(t.TempDir(), "mapping.json")
+		err := os.WriteFile(path, []byte(input), 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = keppel.LoadPermissionMapping(path, "group", true)
+		if err == nil || !regexp.MustCompile(regexp.QuoteMeta(expectedError)).MatchString(err.Error()) {
+			t.Errorf("expected error containing %q for input %s, but got %v", expectedError, input, err)
+		}
+	}
+}
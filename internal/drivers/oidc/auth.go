@@ -0,0 +1,220 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+// Package oidc contains the AuthDriver "oidc": Users are authenticated with
+// JWTs issued by an OpenID Connect provider, and the values of one of the
+// token's claims are mapped to Keppel permissions through a static mapping file.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+type oidcConfig struct {
+	IssuerURL        string
+	Audience         string
+	UserNameClaim    string
+	PermissionsClaim string
+}
+
+type authDriver struct {
+	cfg     oidcConfig
+	mapping keppel.PermissionMapping
+	keys    *keySet
+}
+
+func init() {
+	keppel.RegisterUserIdentity("oidc", deserializeOIDCUserIdentity)
+	keppel.RegisterAuthDriver("oidc", func(rc *redis.Client) (keppel.AuthDriver, error) {
+		mapping, err := keppel.LoadPermissionMapping(osext.MustGetenv("KEPPEL_OIDC_CLAIM_MAPPING_PATH"), "claim_value", false)
+		if err != nil {
+			return nil, err
+		}
+		cfg := oidcConfig{
+			IssuerURL:        strings.TrimSuffix(osext.MustGetenv("KEPPEL_OIDC_ISSUER_URL"), "/"),
+			Audience:         osext.MustGetenv("KEPPEL_OIDC_AUDIENCE"),
+			UserNameClaim:    osext.GetenvOrDefault("KEPPEL_OIDC_USERNAME_CLAIM", "sub"),
+			PermissionsClaim: osext.GetenvOrDefault("KEPPEL_OIDC_PERMISSIONS_CLAIM", "groups"),
+		}
+		return &authDriver{cfg, mapping, newKeySet(cfg.IssuerURL)}, nil
+	})
+}
+
+// DriverName implements the keppel.AuthDriver interface.
+func (d *authDriver) DriverName() string {
+	return "oidc"
+}
+
+// ValidateTenantID implements the keppel.AuthDriver interface.
+func (d *authDriver) ValidateTenantID(tenantID string) error {
+	if tenantID == "" {
+		return errors.New("may not be empty")
+	}
+	//the OIDC provider does not know about tenants, so the claim mapping is the
+	//only source of truth
+	if d.mapping.ReferencesAuthTenant(tenantID) {
+		return nil
+	}
+	return errors.New("not referenced in claim mapping")
+}
+
+// AuthenticateUser implements the keppel.AuthDriver interface.
+//
+// Since this driver does not know any passwords, clients that can only do
+// Basic auth (e.g. `docker login`) must supply a token issued by the OIDC
+// provider as password. The username must match the token's username claim.
+func (d *authDriver) AuthenticateUser(userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	uid, rerr := d.AuthenticateUserFromBearerToken(password)
+	if rerr != nil {
+		return nil, rerr
+	}
+	if uid.UserName() != userName {
+		return nil, keppel.ErrUnauthorized.With("token was issued for a different user")
+	}
+	return uid, nil
+}
+
+// AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+func (d *authDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || authHeader == "keppel" {
+		//fallback to anonymous auth
+		return nil, nil
+	}
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, keppel.ErrUnauthorized.With("malformed Authorization header (expected Bearer token)")
+	}
+	return d.AuthenticateUserFromBearerToken(strings.TrimPrefix(authHeader, "Bearer "))
+}
+
+// AuthenticateUserFromBearerToken implements the keppel.BearerTokenAuthDriver interface.
+func (d *authDriver) AuthenticateUserFromBearerToken(tokenStr string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, d.keys.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+	)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, keppel.ErrUnauthorized.With("token expired")
+		}
+		return nil, keppel.ErrUnauthorized.With("token invalid: %s", err.Error())
+	}
+
+	//ParseWithClaims() only checks the "exp" and "nbf" claims if they exist,
+	//but tokens without expiry are not acceptable
+	if _, exists := claims["exp"]; !exists {
+		return nil, keppel.ErrUnauthorized.With("token does not expire")
+	}
+	if !claims.VerifyIssuer(d.cfg.IssuerURL, true) {
+		return nil, keppel.ErrUnauthorized.With("token has wrong issuer (expected %s)", d.cfg.IssuerURL)
+	}
+	if !claims.VerifyAudience(d.cfg.Audience, true) {
+		return nil, keppel.ErrUnauthorized.With("token has wrong audience (expected %s)", d.cfg.Audience)
+	}
+
+	userName, ok := claims[d.cfg.UserNameClaim].(string)
+	if !ok || userName == "" {
+		return nil, keppel.ErrUnauthorized.With("token does not contain the %q claim", d.cfg.UserNameClaim)
+	}
+
+	//the permissions claim can either be a single string or a list of strings
+	var claimValues []string
+	switch value := claims[d.cfg.PermissionsClaim].(type) {
+	case string:
+		claimValues = []string{value}
+	case []interface{}:
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				claimValues = append(claimValues, s)
+			}
+		}
+	}
+
+	return userIdentity{
+		Name:        userName,
+		Groups:      claimValues,
+		Permissions: d.mapping.ComputePermissions(claimValues),
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type userIdentity
+
+type userIdentity struct {
+	Name string `json:"name"`
+	//values of the permissions claim, for matching by RBAC policies
+	Groups []string `json:"groups,omitempty"`
+	//key = auth tenant ID (or "" for global permissions)
+	Permissions map[string][]keppel.Permission `json:"perms"`
+}
+
+func deserializeOIDCUserIdentity(in []byte, ad keppel.AuthDriver) (keppel.UserIdentity, error) {
+	if _, ok := ad.(*authDriver); !ok {
+		return nil, keppel.ErrAuthDriverMismatch
+	}
+	var uid userIdentity
+	err := json.Unmarshal(in, &uid)
+	return uid, err
+}
+
+// HasPermission implements the keppel.UserIdentity interface.
+func (uid userIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
+	for _, p := range uid.Permissions[tenantID] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupNames implements the keppel.GroupMembership interface.
+func (uid userIdentity) GroupNames() []string {
+	return uid.Groups
+}
+
+// UserType implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserType() keppel.UserType {
+	return keppel.RegularUser
+}
+
+// UserName implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserName() string {
+	return uid.Name
+}
+
+// UserInfo implements the keppel.UserIdentity interface.
+func (uid userIdentity) UserInfo() audittools.UserInfo {
+	return nil
+}
+
+// SerializeToJSON implements the keppel.UserIdentity interface.
+func (uid userIdentity) SerializeToJSON() (typeName string, payload []byte, err error) {
+	payload, err = json.Marshal(uid)
+	return "oidc", payload, err
+}
@@ -0,0 +1,367 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// mock OIDC provider
+
+type mockProvider struct {
+	Server *httptest.Server
+	Key    *rsa.PrivateKey
+	//if not nil, requests for the key set hang until this channel is closed
+	StallKeys chan struct{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	p := &mockProvider{Key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"issuer": p.Server.URL, "jwks_uri": p.Server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if p.StallKeys != nil {
+			select {
+			case <-p.StallKeys:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kid": "key1",
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data) //nolint:errcheck
+}
+
+// IssueToken signs a token with the given claims. The issuer, audience and
+// expiry are filled with valid defaults unless given explicitly. Claims with a
+// nil value are removed.
+func (p *mockProvider) IssueToken(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	defaults := jwt.MapClaims{
+		"iss": p.Server.URL,
+		"aud": "keppel",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range defaults {
+		if _, exists := claims[k]; !exists {
+			claims[k] = v
+		}
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(claims, k)
+		}
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key1"
+	tokenStr, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tokenStr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// test setup
+
+const testClaimMapping = `[
+	{ "claim_value": "developers", "auth_tenant_id": "team1", "permissions": ["view", "pull", "push"] },
+	{ "claim_value": "operators", "auth_tenant_id": "team1", "permissions": ["view", "delete", "change"] },
+	{ "claim_value": "operators", "permissions": ["keppeladmin"] }
+]`
+
+func setupDriver(t *testing.T) (*authDriver, *mockProvider) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(path, []byte(testClaimMapping), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mapping, err := keppel.LoadPermissionMapping(path, "claim_value", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	p := newMockProvider(t)
+	d := &authDriver{
+		cfg: oidcConfig{
+			IssuerURL:        p.Server.URL,
+			Audience:         "keppel",
+			UserNameClaim:    "preferred_username",
+			PermissionsClaim: "groups",
+		},
+		mapping: mapping,
+		keys:    newKeySet(p.Server.URL),
+	}
+	return d, p
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestValidToken(t *testing.T) {
+	d, p := setupDriver(t)
+	tokenStr := p.IssueToken(t, p.Key, jwt.MapClaims{
+		"preferred_username": "alice",
+		"groups":             []string{"developers", "unrelated"},
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("Authorization", "Bearer "+tokenStr)
+	uid, rerr := d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	if uid.UserName() != "alice" {
+		t.Errorf("expected user name %q, but got %q", "alice", uid.UserName())
+	}
+	if !uid.HasPermission(keppel.CanPushToAccount, "team1") {
+		t.Error("expected user to have push permission in team1")
+	}
+	if uid.HasPermission(keppel.CanDeleteFromAccount, "team1") {
+		t.Error("expected user to not have delete permission in team1")
+	}
+
+	//permissions must survive the serialization roundtrip for inclusion in tokens
+	typeName, payload, err := uid.SerializeToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	uid2, err := keppel.DeserializeUserIdentity(typeName, payload, d)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !uid2.HasPermission(keppel.CanPushToAccount, "team1") {
+		t.Error("expected deserialized user to have push permission in team1")
+	}
+	groupNames := uid2.(keppel.GroupMembership).GroupNames()
+	if !reflect.DeepEqual(groupNames, []string{"developers", "unrelated"}) {
+		t.Errorf("expected group names to survive the serialization roundtrip, but got %v", groupNames)
+	}
+
+	//the same token can be used as a password for Basic auth
+	_, rerr = d.AuthenticateUser("alice", tokenStr)
+	if rerr != nil {
+		t.Errorf("expected AuthenticateUser to accept the token as password, but got: %s", rerr.Error())
+	}
+	_, rerr = d.AuthenticateUser("bob", tokenStr)
+	if rerr == nil || rerr.Code != keppel.ErrUnauthorized {
+		t.Errorf("expected AuthenticateUser to reject a token issued for a different user, but got %v", rerr)
+	}
+
+	//a single string is also accepted for the permissions claim
+	tokenStr = p.IssueToken(t, p.Key, jwt.MapClaims{
+		"preferred_username": "bob",
+		"groups":             "operators",
+	})
+	uid, rerr = d.AuthenticateUserFromBearerToken(tokenStr)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	if !uid.HasPermission(keppel.CanAdministrateKeppel, "") {
+		t.Error("expected user to have keppeladmin permission")
+	}
+
+	//requests without Authorization header are anonymous
+	r.Header.Del("Authorization")
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected anonymous request to yield (nil, nil), but got (%v, %v)", uid, rerr)
+	}
+}
+
+func TestInvalidTokens(t *testing.T) {
+	d, p := setupDriver(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Description   string
+		Token         string
+		ExpectedError string
+	}{
+		{
+			Description: "expired token",
+			Token: p.IssueToken(t, p.Key, jwt.MapClaims{
+				"preferred_username": "alice",
+				"exp":                time.Now().Add(-time.Hour).Unix(),
+			}),
+			ExpectedError: "token expired",
+		},
+		{
+			Description: "token without expiry",
+			Token: p.IssueToken(t, p.Key, jwt.MapClaims{
+				"preferred_username": "alice",
+				"exp":                nil,
+			}),
+			ExpectedError: "token does not expire",
+		},
+		{
+			Description: "wrong audience",
+			Token: p.IssueToken(t, p.Key, jwt.MapClaims{
+				"preferred_username": "alice",
+				"aud":                "someone-else",
+			}),
+			ExpectedError: "token has wrong audience (expected keppel)",
+		},
+		{
+			Description: "wrong issuer",
+			Token: p.IssueToken(t, p.Key, jwt.MapClaims{
+				"preferred_username": "alice",
+				"iss":                "https://evil.example.com",
+			}),
+			ExpectedError: "token has wrong issuer (expected " + p.Server.URL + ")",
+		},
+		{
+			Description:   "missing username",
+			Token:         p.IssueToken(t, p.Key, jwt.MapClaims{"sub": "123"}),
+			ExpectedError: `token does not contain the "preferred_username" claim`,
+		},
+		{
+			Description:   "wrong signature",
+			Token:         p.IssueToken(t, otherKey, jwt.MapClaims{"preferred_username": "alice"}),
+			ExpectedError: "token invalid: crypto/rsa: verification error",
+		},
+		{
+			Description:   "garbage",
+			Token:         "not-a-jwt",
+			ExpectedError: "token invalid: token contains an invalid number of segments",
+		},
+	}
+
+	for _, tc := range testCases {
+		uid, rerr := d.AuthenticateUserFromBearerToken(tc.Token)
+		if uid != nil {
+			t.Errorf("%s: expected authentication to fail, but got user %q", tc.Description, uid.UserName())
+		}
+		if rerr == nil || rerr.Code != keppel.ErrUnauthorized {
+			t.Errorf("%s: expected authentication to fail with %s, but got %v", tc.Description, keppel.ErrUnauthorized, rerr)
+		} else if rerr.Message != tc.ExpectedError {
+			t.Errorf("%s: expected error message %q, but got %q", tc.Description, tc.ExpectedError, rerr.Message)
+		}
+	}
+}
+
+func TestHungProviderDoesNotBlockKnownKeys(t *testing.T) {
+	d, p := setupDriver(t)
+	tokenStr := p.IssueToken(t, p.Key, jwt.MapClaims{"preferred_username": "alice"})
+	_, rerr := d.AuthenticateUserFromBearerToken(tokenStr)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+
+	//let the provider hang, and allow the next refresh to happen right away
+	stall := make(chan struct{})
+	defer close(stall)
+	p.StallKeys = stall
+	d.keys.refreshMutex.Lock()
+	d.keys.lastRefresh = time.Time{}
+	d.keys.refreshMutex.Unlock()
+	oldTimeout := providerHTTPClient.Timeout
+	providerHTTPClient.Timeout = 500 * time.Millisecond
+	defer func() { providerHTTPClient.Timeout = oldTimeout }()
+
+	//a token signed by an unknown key triggers a refresh that eventually times out...
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                p.Server.URL,
+		"aud":                "keppel",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alice",
+	})
+	token.Header["kid"] = "key2"
+	unknownKeyTokenStr, err := token.SignedString(p.Key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	errChan := make(chan *keppel.RegistryV2Error, 1)
+	go func() {
+		_, rerr := d.AuthenticateUserFromBearerToken(unknownKeyTokenStr)
+		errChan <- rerr
+	}()
+
+	//...while tokens signed by known keys are still accepted in the meantime
+	time.Sleep(100 * time.Millisecond)
+	startedAt := time.Now()
+	_, rerr = d.AuthenticateUserFromBearerToken(tokenStr)
+	if rerr != nil {
+		t.Error(rerr.Error())
+	}
+	if duration := time.Since(startedAt); duration > 200*time.Millisecond {
+		t.Errorf("expected token with known key to be validated immediately, but it took %s", duration)
+	}
+
+	if rerr := <-errChan; rerr == nil {
+		t.Error("expected token with unknown key to be rejected, but it was accepted")
+	}
+}
+
+func TestValidateTenantID(t *testing.T) {
+	d, _ := setupDriver(t)
+	err := d.ValidateTenantID("team1")
+	if err != nil {
+		t.Errorf("expected tenant ID %q to be valid, but got: %s", "team1", err.Error())
+	}
+	for _, tenantID := range []string{"", "team2"} {
+		err := d.ValidateTenantID(tenantID)
+		if err == nil {
+			t.Errorf("expected tenant ID %q to be invalid, but got no error", tenantID)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// keySet holds the public keys of the OIDC provider. Keys are fetched lazily
+// from the provider's JWKS endpoint (as advertised in the discovery document),
+// and refetched when a token refers to an unknown key ID since providers
+// rotate their keys from time to time.
+type keySet struct {
+	issuerURL string
+	mutex     sync.Mutex             //only protects `keys`
+	keys      map[string]interface{} //key = key ID
+	//Refreshes are serialized by a separate mutex, so that tokens signed by
+	//known keys can be validated while a refresh is in progress.
+	refreshMutex sync.Mutex
+	lastRefresh  time.Time
+}
+
+// To avoid hammering the provider with requests for tokens signed by garbage
+// keys, the key set is refreshed at most this often.
+const keySetMinRefreshInterval = time.Minute
+
+// Used for requests to the OIDC provider. Without a timeout, a hung provider
+// would block every validation of a token signed by an unknown key.
+var providerHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func newKeySet(issuerURL string) *keySet {
+	return &keySet{issuerURL: issuerURL}
+}
+
+// keyFunc implements the jwt.Keyfunc interface.
+func (ks *keySet) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, exists := ks.findKey(kid)
+	if exists {
+		return key, nil
+	}
+
+	ks.refreshMutex.Lock()
+	defer ks.refreshMutex.Unlock()
+
+	//a concurrent refresh may have found the key while we were waiting
+	key, exists = ks.findKey(kid)
+	if exists {
+		return key, nil
+	}
+	if time.Since(ks.lastRefresh) < keySetMinRefreshInterval {
+		return nil, fmt.Errorf("token signed by unknown key %q", kid)
+	}
+
+	err := ks.refresh()
+	if err != nil {
+		return nil, err
+	}
+	key, exists = ks.findKey(kid)
+	if !exists {
+		return nil, fmt.Errorf("token signed by unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (ks *keySet) findKey(kid string) (interface{}, bool) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	//tokens without key ID are only acceptable if there is no ambiguity
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, exists := ks.keys[kid]
+	return key, exists
+}
+
+type discoveryDocument struct {
+	JWKSURI string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	KeyID   string `json:"kid"`
+	KeyType string `json:"kty"`
+	Use     string `json:"use"`
+	//for RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+	//for EC keys
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func (ks *keySet) refresh() error {
+	ks.lastRefresh = time.Now()
+
+	var doc discoveryDocument
+	err := getJSON(ks.issuerURL+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return fmt.Errorf("cannot get OIDC discovery document: %w", err)
+	}
+	if doc.JWKSURI == "" {
+		return errors.New("cannot get OIDC discovery document: missing jwks_uri")
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = getJSON(doc.JWKSURI, &jwks)
+	if err != nil {
+		return fmt.Errorf("cannot get OIDC key set: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			return fmt.Errorf("cannot parse OIDC key %q: %w", jwk.KeyID, err)
+		}
+		if key != nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	ks.mutex.Lock()
+	ks.keys = keys
+	ks.mutex.Unlock()
+	return nil
+}
+
+// PublicKey returns the public key described by this JWK, or nil if the key
+// type is not supported.
+func (jwk jsonWebKey) PublicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %q", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(input string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(input)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func getJSON(url string, target interface{}) error {
+	resp, err := providerHTTPClient.Get(url) //nolint:gosec // URL is from configuration
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
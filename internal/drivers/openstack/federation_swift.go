@@ -22,6 +22,7 @@ package openstack
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -44,16 +45,18 @@ import (
 )
 
 type federationDriverSwift struct {
-	Container   *schwift.Container
-	OwnHostName string
+	Container        *schwift.Container
+	OwnHostName      string
+	SubleaseTokenTTL time.Duration
 }
 
 func init() {
 	keppel.RegisterFederationDriver("swift", func(_ keppel.AuthDriver, cfg keppel.Configuration) (keppel.FederationDriver, error) {
 		container, err := initSwiftContainerConnection("KEPPEL_FEDERATION_")
 		return &federationDriverSwift{
-			Container:   container,
-			OwnHostName: cfg.APIPublicHostname,
+			Container:        container,
+			OwnHostName:      cfg.APIPublicHostname,
+			SubleaseTokenTTL: cfg.SubleaseTokenTTL,
 		}, err
 	})
 }
@@ -95,10 +98,23 @@ func initSwiftContainerConnection(envPrefix string) (*schwift.Container, error)
 }
 
 type accountFile struct {
-	AccountName         string   `json:"-"`
-	PrimaryHostName     string   `json:"primary_hostname"`
-	ReplicaHostNames    []string `json:"replica_hostnames"`
-	SubleaseTokenSecret string   `json:"sublease_token_secret"`
+	AccountName      string   `json:"-"`
+	PrimaryHostName  string   `json:"primary_hostname"`
+	ReplicaHostNames []string `json:"replica_hostnames"`
+	//We only store the hash of the sublease token secret, see keppel.HashSubleaseTokenSecret().
+	SubleaseTokenHash string `json:"sublease_token_hash,omitempty"`
+	//UNIX timestamp, or 0 if the sublease token does not expire.
+	SubleaseTokenExpiresAt int64 `json:"sublease_token_expires_at,omitempty"`
+	//Sublease token secrets issued before we started storing only hashes are
+	//stored as-is. These are replaced by their hash on the next write.
+	LegacySubleaseTokenSecret string `json:"sublease_token_secret,omitempty"`
+}
+
+func (file *accountFile) migrateLegacySubleaseToken() {
+	if file.LegacySubleaseTokenSecret != "" {
+		file.SubleaseTokenHash = keppel.HashSubleaseTokenSecret(file.LegacySubleaseTokenSecret)
+		file.LegacySubleaseTokenSecret = ""
+	}
 }
 
 func (fd *federationDriverSwift) accountFileObj(accountName string) *schwift.Object {
@@ -135,6 +151,7 @@ func (fd *federationDriverSwift) modifyAccountFile(accountName string, modify fu
 	//check if we are actually changing anything at all (this is a very important
 	//optimization for RecordExistingAccount which is a no-op most of the time)
 	fileOldModified := fileOld
+	fileOldModified.migrateLegacySubleaseToken()
 	err = modify(&fileOldModified, true)
 	if err != nil {
 		return err
@@ -165,6 +182,7 @@ func (fd *federationDriverSwift) modifyAccountFile(accountName string, modify fu
 		return err
 	}
 	fileNewModified := fileNew
+	fileNewModified.migrateLegacySubleaseToken()
 	err = modify(&fileNewModified, false)
 	if err != nil {
 		return err
@@ -230,11 +248,17 @@ func (fd *federationDriverSwift) claimReplicaAccount(account keppel.Account, sub
 	err = fd.modifyAccountFile(account.Name, func(file *accountFile, firstPass bool) error {
 		//verify the sublease token only on first pass (in the second pass, it was already cleared)
 		if firstPass {
-			if file.SubleaseTokenSecret != subleaseTokenSecret {
+			tokenHash := keppel.HashSubleaseTokenSecret(subleaseTokenSecret)
+			if subtle.ConstantTimeCompare([]byte(file.SubleaseTokenHash), []byte(tokenHash)) != 1 {
 				isUserError = true
 				return errors.New("invalid sublease token (or token was already used)")
 			}
-			file.SubleaseTokenSecret = ""
+			if file.SubleaseTokenExpiresAt != 0 && time.Now().Unix() >= file.SubleaseTokenExpiresAt {
+				isUserError = true
+				return errors.New("sublease token has expired")
+			}
+			file.SubleaseTokenHash = ""
+			file.SubleaseTokenExpiresAt = 0
 		}
 
 		//validate the primary account
@@ -259,6 +283,11 @@ func (fd *federationDriverSwift) IssueSubleaseTokenSecret(account keppel.Account
 		return "", fmt.Errorf("could not generate token: %s", err.Error())
 	}
 	tokenStr := base64.StdEncoding.EncodeToString(tokenBytes)
+	tokenHash := keppel.HashSubleaseTokenSecret(tokenStr)
+	tokenExpiresAt := int64(0)
+	if fd.SubleaseTokenTTL > 0 {
+		tokenExpiresAt = time.Now().Add(fd.SubleaseTokenTTL).Unix()
+	}
 
 	return tokenStr, fd.modifyAccountFile(account.Name, func(file *accountFile, firstPass bool) error {
 		//defense in depth - the caller should already have verified this
@@ -272,7 +301,8 @@ func (fd *federationDriverSwift) IssueSubleaseTokenSecret(account keppel.Account
 			return err
 		}
 
-		file.SubleaseTokenSecret = tokenStr
+		file.SubleaseTokenHash = tokenHash
+		file.SubleaseTokenExpiresAt = tokenExpiresAt
 		return nil
 	})
 }
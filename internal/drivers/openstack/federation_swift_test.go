@@ -0,0 +1,108 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package openstack
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func setupSwiftFederationDrivers(t *testing.T) (primary, replica *federationDriverSwift, fake *fakeSwift) {
+	t.Helper()
+	d, fake := setupFakeSwift(t)
+	container, err := d.mainAccount.Container("keppel-federation").EnsureExists()
+	mustSucceed(t, err)
+	primary = &federationDriverSwift{container, "registry.example.org", time.Hour}
+	replica = &federationDriverSwift{container, "registry-secondary.example.org", time.Hour}
+
+	result, err := primary.ClaimAccountName(keppel.Account{Name: "test1"}, "")
+	if err != nil || result != keppel.ClaimSucceeded {
+		t.Fatalf("could not claim primary account: result = %d, err = %v", result, err)
+	}
+	return primary, replica, fake
+}
+
+func expectSwiftClaimReplicaAccount(t *testing.T, replica *federationDriverSwift, tokenSecret string, expectedResult keppel.ClaimResult, expectedError string) {
+	t.Helper()
+	account := keppel.Account{Name: "test1", UpstreamPeerHostName: "registry.example.org"}
+	result, err := replica.ClaimAccountName(account, tokenSecret)
+	if result != expectedResult {
+		t.Errorf("expected claim result %d, but got %d", expectedResult, result)
+	}
+	switch {
+	case expectedError == "" && err != nil:
+		t.Errorf("expected claim to succeed, but got: %s", err.Error())
+	case expectedError != "" && err == nil:
+		t.Errorf("expected claim to fail with %q, but it succeeded", expectedError)
+	case expectedError != "" && err.Error() != expectedError:
+		t.Errorf("expected claim to fail with %q, but got %q", expectedError, err.Error())
+	}
+}
+
+func storedAccountFile(fake *fakeSwift) string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return string(fake.containers["AUTH_keppel/keppel-federation"].Objects["accounts/test1.json"].Contents)
+}
+
+func TestSwiftSubleaseTokenIsSingleUse(t *testing.T) {
+	primary, replica, fake := setupSwiftFederationDrivers(t)
+	tokenSecret, err := primary.IssueSubleaseTokenSecret(keppel.Account{Name: "test1"})
+	mustSucceed(t, err)
+
+	//only the hash of the token is stored in Swift
+	contents := storedAccountFile(fake)
+	if !strings.Contains(contents, keppel.HashSubleaseTokenSecret(tokenSecret)) || strings.Contains(contents, tokenSecret) {
+		t.Errorf("expected account file to contain the hash of the token secret, but got %s", contents)
+	}
+
+	const errMsg = "invalid sublease token (or token was already used)"
+	expectSwiftClaimReplicaAccount(t, replica, "wrong", keppel.ClaimFailed, errMsg)
+	expectSwiftClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimSucceeded, "")
+	expectSwiftClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimFailed, errMsg)
+}
+
+func TestSwiftLegacySubleaseTokenIsStillAccepted(t *testing.T) {
+	primary, replica, fake := setupSwiftFederationDrivers(t)
+
+	//before we started storing only hashes, the token secret was stored as-is
+	const tokenSecret = "bGVnYWN5LXRva2Vu"
+	fake.mutex.Lock()
+	fake.containers["AUTH_keppel/keppel-federation"].Objects["accounts/test1.json"] = &fakeObject{
+		Contents: []byte(`{"primary_hostname":"registry.example.org","replica_hostnames":[],"sublease_token_secret":"` + tokenSecret + `"}`),
+	}
+	fake.mutex.Unlock()
+
+	//the next write replaces the token secret by its hash...
+	err := primary.RecordExistingAccount(keppel.Account{Name: "test1"}, time.Now())
+	mustSucceed(t, err)
+	contents := storedAccountFile(fake)
+	if !strings.Contains(contents, keppel.HashSubleaseTokenSecret(tokenSecret)) || strings.Contains(contents, tokenSecret) {
+		t.Errorf("expected account file to contain the hash of the legacy token secret, but got %s", contents)
+	}
+
+	//...but the token can still be redeemed exactly once
+	const errMsg = "invalid sublease token (or token was already used)"
+	expectSwiftClaimReplicaAccount(t, replica, "wrong", keppel.ClaimFailed, errMsg)
+	expectSwiftClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimSucceeded, "")
+	expectSwiftClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimFailed, errMsg)
+}
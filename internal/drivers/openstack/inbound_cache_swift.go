@@ -28,6 +28,7 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/majewsky/schwift"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -40,7 +41,7 @@ type inboundCacheDriverSwift struct {
 }
 
 func init() {
-	keppel.RegisterInboundCacheDriver("swift", func(_ keppel.Configuration) (keppel.InboundCacheDriver, error) {
+	keppel.RegisterInboundCacheDriver("swift", func(_ keppel.Configuration, _ *redis.Client) (keppel.InboundCacheDriver, error) {
 		container, err := initSwiftContainerConnection("KEPPEL_INBOUND_CACHE_")
 		if err != nil {
 			return nil, err
@@ -100,6 +101,13 @@ func (d *inboundCacheDriverSwift) LoadManifest(location keppel.ImageReference, n
 	if err != nil {
 		return nil, "", err
 	}
+	//Swift only deletes expired objects eventually, so we need to check the expiry ourselves
+	if hdr.ExpiresAt().Exists() && !hdr.ExpiresAt().Get().After(now) {
+		return nil, "", sql.ErrNoRows
+	}
+	if hdr.Metadata().Get("Not-Found") == "true" {
+		return nil, "", keppel.ErrManifestNotFoundUpstream
+	}
 	return contents, hdr.ContentType().Get(), nil
 }
 
@@ -121,6 +129,24 @@ func (d *inboundCacheDriverSwift) StoreManifest(location keppel.ImageReference,
 	return nil
 }
 
+// StoreManifestNotFound implements the keppel.InboundCacheDriver interface.
+func (d *inboundCacheDriverSwift) StoreManifestNotFound(location keppel.ImageReference, now time.Time, ttl time.Duration) error {
+	if d.skip(location) {
+		return nil
+	}
+
+	hdr := schwift.NewObjectHeaders()
+	hdr.Metadata().Set("Not-Found", "true")
+	hdr.ExpiresAt().Set(now.Add(ttl))
+
+	obj := d.objectFor(location)
+	err := obj.Upload(bytes.NewReader(nil), nil, hdr.ToOpts())
+	if err != nil {
+		return fmt.Errorf("while populating the inbound cache: %w", err)
+	}
+	return nil
+}
+
 func (d *inboundCacheDriverSwift) objectFor(imageRef keppel.ImageReference) *schwift.Object {
 	var name string
 	if imageRef.Reference.IsTag() {
@@ -259,6 +259,13 @@ func (d *swiftDriver) ReadBlob(account keppel.Account, storageID string) (io.Rea
 	return reader, hdr.SizeBytes().Get(), err
 }
 
+// ReadBlobRange implements the keppel.StorageDriver interface.
+func (d *swiftDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	//NOTE: Swift supports range requests, but schwift's Object.Download() only
+	//accepts 200 responses, so we cannot ask for 206 Partial Content here.
+	return keppel.ReadBlobRangeBySkipping(d, account, storageID, offset, length)
+}
+
 // URLForBlob implements the keppel.StorageDriver interface.
 func (d *swiftDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
 	c, info, err := d.getBackendConnection(account)
@@ -335,71 +342,70 @@ var (
 
 // ListStorageContents implements the keppel.StorageDriver interface.
 func (d *swiftDriver) ListStorageContents(account keppel.Account) ([]keppel.StoredBlobInfo, []keppel.StoredManifestInfo, error) {
+	return keppel.CollectStorageContents(d, account)
+}
+
+// ListStorageContentsStream implements the keppel.StorageDriver interface.
+func (d *swiftDriver) ListStorageContentsStream(account keppel.Account, blobCallback func(keppel.StoredBlobInfo) error, manifestCallback func(keppel.StoredManifestInfo) error) error {
 	c, _, err := d.getBackendConnection(account)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	chunkCounts := make(map[string]uint32) //key = storage ID, value = same semantics as keppel.StoredBlobInfo.ChunkCount
-	var manifests []keppel.StoredManifestInfo
-
-	err = c.Objects().Foreach(func(o *schwift.Object) error {
-		if match := blobObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
-			storageID := match[1] + match[2] + match[3]
-			mergeChunkCount(chunkCounts, storageID, 0)
+	//Since Swift lists objects in lexicographical order, all chunks belonging to
+	//the same storage ID are listed consecutively. We only report each group of
+	//chunks once, when we have seen the last chunk in the group.
+	var pendingChunks *keppel.StoredBlobInfo
+	flushPendingChunks := func() error {
+		if pendingChunks == nil {
 			return nil
 		}
+		info := *pendingChunks
+		pendingChunks = nil
+		return blobCallback(info)
+	}
+
+	err = c.Objects().Foreach(func(o *schwift.Object) error {
 		if match := chunkObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
 			storageID := match[1] + match[2] + match[3]
 			chunkNumber, err := strconv.ParseUint(match[4], 10, 32)
 			if err != nil {
 				return fmt.Errorf("while parsing chunk object name %s: %s", o.Name(), err.Error())
 			}
-			mergeChunkCount(chunkCounts, storageID, uint32(chunkNumber))
+			if pendingChunks != nil && pendingChunks.StorageID == storageID {
+				pendingChunks.ChunkCount = keppel.MergeChunkCounts(pendingChunks.ChunkCount, uint32(chunkNumber))
+				return nil
+			}
+			err = flushPendingChunks()
+			if err != nil {
+				return err
+			}
+			pendingChunks = &keppel.StoredBlobInfo{StorageID: storageID, ChunkCount: uint32(chunkNumber)}
 			return nil
 		}
+
+		err := flushPendingChunks()
+		if err != nil {
+			return err
+		}
+		if match := blobObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
+			return blobCallback(keppel.StoredBlobInfo{
+				StorageID:  match[1] + match[2] + match[3],
+				ChunkCount: 0,
+			})
+		}
 		if match := manifestObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
-			manifests = append(manifests, keppel.StoredManifestInfo{
+			return manifestCallback(keppel.StoredManifestInfo{
 				RepoName: match[1],
 				Digest:   match[2],
 			})
-			return nil
 		}
 		return fmt.Errorf("encountered unexpected object while listing storage contents of account %s: %s", account.Name, o.Name())
 	})
 	if err != nil {
-		return nil, nil, err
-	}
-
-	blobs := make([]keppel.StoredBlobInfo, 0, len(chunkCounts))
-	for storageID, chunkCount := range chunkCounts {
-		blobs = append(blobs, keppel.StoredBlobInfo{
-			StorageID:  storageID,
-			ChunkCount: chunkCount,
-		})
-	}
-
-	return blobs, manifests, nil
-}
-
-// See comment on keppel.StoredBlobInfo.ChunkCount for explanation of semantics.
-func mergeChunkCount(chunkCounts map[string]uint32, key string, chunkNumber uint32) {
-	prevCount, exists := chunkCounts[key]
-	if !exists {
-		//nothing to merge, just record the new value
-		chunkCounts[key] = chunkNumber
-		return
-	}
-
-	//The value 0 indicates a finalized blob and therefore takes precedence over actual chunk numbers.
-	if prevCount == 0 || chunkNumber == 0 {
-		chunkCounts[key] = 0
-		return
-	}
-	//If 0 is not involved, remember the largest chunk number as that's gonna be the chunk count.
-	if chunkNumber > prevCount {
-		chunkCounts[key] = chunkNumber
+		return err
 	}
+	return flushPendingChunks()
 }
 
 // CleanupAccount implements the keppel.StorageDriver interface.
@@ -0,0 +1,441 @@
+/*******************************************************************************
+*
+* Copyright 2018 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package openstack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"  //nolint:gosec // Swift uses MD5 for Etags
+	"crypto/sha1" //nolint:gosec // Swift uses HMAC-SHA1 for temp URLs
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// fake Swift server
+
+// fakeSwift implements the subset of the Swift API that swiftDriver uses,
+// including static large objects and temp URLs.
+type fakeSwift struct {
+	mutex      sync.Mutex
+	containers map[string]*fakeContainer //key = "AUTH_xxx/containername"
+}
+
+type fakeContainer struct {
+	TempURLKey string
+	Objects    map[string]*fakeObject
+}
+
+type fakeObject struct {
+	Contents    []byte
+	SLOSegments []fakeSLOSegment //only for static large objects
+}
+
+type fakeSLOSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes uint64 `json:"size_bytes"`
+}
+
+func etagOf(buf []byte) string {
+	sum := md5.Sum(buf) //nolint:gosec // Swift uses MD5 for Etags
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path == "/info" {
+		//no bulk middleware -> schwift falls back to deleting objects one by one
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"swift":{"version":"fake"}}`)) //nolint:errcheck
+		return
+	}
+
+	fields := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/", 3)
+	if len(fields) < 2 {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	containerKey := fields[0] + "/" + fields[1]
+
+	//temp URLs are the only way to access objects without a token
+	if r.URL.Query().Get("temp_url_sig") != "" {
+		if len(fields) != 3 || !f.isValidTempURL(r, containerKey) {
+			http.Error(w, "invalid temp URL", http.StatusUnauthorized)
+			return
+		}
+	} else if r.Header.Get("X-Auth-Token") != "fake-token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if len(fields) == 2 {
+		f.serveContainer(w, r, containerKey)
+	} else {
+		f.serveObject(w, r, containerKey, fields[2])
+	}
+}
+
+func (f *fakeSwift) isValidTempURL(r *http.Request, containerKey string) bool {
+	c := f.containers[containerKey]
+	if c == nil || r.Method != http.MethodGet {
+		return false
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("temp_url_expires"), 10, 64)
+	if err != nil || time.Unix(expires, 0).Before(time.Now()) {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(c.TempURLKey))
+	fmt.Fprintf(mac, "%s\n%d\n%s", r.Method, expires, r.URL.Path)
+	return hex.EncodeToString(mac.Sum(nil)) == r.URL.Query().Get("temp_url_sig")
+}
+
+func (f *fakeSwift) serveContainer(w http.ResponseWriter, r *http.Request, containerKey string) {
+	c := f.containers[containerKey]
+	if c == nil && r.Method != http.MethodPut {
+		http.Error(w, "no such container", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("X-Container-Object-Count", strconv.Itoa(len(c.Objects)))
+		if c.TempURLKey != "" {
+			w.Header().Set("X-Container-Meta-Temp-Url-Key", c.TempURLKey)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		if c == nil {
+			c = &fakeContainer{Objects: make(map[string]*fakeObject)}
+			f.containers[containerKey] = c
+		}
+		if key := r.Header.Get("X-Container-Meta-Temp-Url-Key"); key != "" {
+			c.TempURLKey = key
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if len(c.Objects) > 0 {
+			http.Error(w, "container not empty", http.StatusConflict)
+			return
+		}
+		delete(f.containers, containerKey)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		//list object names in plain format
+		query := r.URL.Query()
+		var names []string
+		for name := range c.Objects {
+			if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit < len(names) {
+			names = names[:limit]
+		}
+		if len(names) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Join(names, "\n") + "\n")) //nolint:errcheck
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) serveObject(w http.ResponseWriter, r *http.Request, containerKey, objectName string) {
+	c := f.containers[containerKey]
+	if c == nil {
+		http.Error(w, "no such container", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+
+	if r.Method == http.MethodPut {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.Get("multipart-manifest") != "put" {
+			c.Objects[objectName] = &fakeObject{Contents: body}
+			w.Header().Set("Etag", etagOf(body))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		//static large object: validate segments and concatenate their contents
+		var segments []fakeSLOSegment
+		err = json.Unmarshal(body, &segments)
+		if err != nil {
+			http.Error(w, "malformed SLO manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var contents []byte
+		for _, s := range segments {
+			so := f.lookupObject(swiftAccountOf(containerKey), s.Path)
+			if so == nil || etagOf(so.Contents) != s.Etag || uint64(len(so.Contents)) != s.SizeBytes {
+				http.Error(w, "invalid SLO segment: "+s.Path, http.StatusBadRequest)
+				return
+			}
+			contents = append(contents, so.Contents...)
+		}
+		c.Objects[objectName] = &fakeObject{Contents: contents, SLOSegments: segments}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	o := c.Objects[objectName]
+	if o == nil {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		contents := o.Contents
+		if o.SLOSegments != nil {
+			w.Header().Set("X-Static-Large-Object", "True")
+			if query.Get("multipart-manifest") == "get" {
+				contents, _ = json.Marshal(o.SLOSegments)
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.Header().Set("Etag", etagOf(contents))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(contents) //nolint:errcheck
+		}
+	case http.MethodDelete:
+		delete(c.Objects, objectName)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+// lookupObject finds an object by a path like "/container/object" within the
+// given Swift account.
+func (f *fakeSwift) lookupObject(accountName, path string) *fakeObject {
+	fields := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(fields) != 2 {
+		return nil
+	}
+	c := f.containers[accountName+"/"+fields[0]]
+	if c == nil {
+		return nil
+	}
+	return c.Objects[fields[1]]
+}
+
+func swiftAccountOf(containerKey string) string {
+	return strings.SplitN(containerKey, "/", 2)[0]
+}
+
+// fakeSwiftBackend is a schwift.Backend that talks to a fakeSwift.
+type fakeSwiftBackend struct {
+	endpointURL string
+}
+
+func (b fakeSwiftBackend) EndpointURL() string { return b.endpointURL }
+
+func (b fakeSwiftBackend) Clone(newEndpointURL string) schwift.Backend {
+	return fakeSwiftBackend{newEndpointURL}
+}
+
+func (b fakeSwiftBackend) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Auth-Token", "fake-token")
+	req.Header.Set("User-Agent", schwift.DefaultUserAgent)
+	return http.DefaultClient.Do(req)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// test setup
+
+func setupFakeSwift(t *testing.T) (*swiftDriver, *fakeSwift) {
+	t.Helper()
+	fake := &fakeSwift{containers: make(map[string]*fakeContainer)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	mainAccount, err := schwift.InitializeAccount(fakeSwiftBackend{server.URL + "/v1/AUTH_keppel/"})
+	mustSucceed(t, err)
+	d := &swiftDriver{
+		mainAccount:    mainAccount,
+		containerInfos: make(map[string]*swiftContainerInfo),
+	}
+	return d, fake
+}
+
+func mustSucceed(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+var testAccount = keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+
+const testStorageID = "0123456789abcdef"
+
+func expectStorageContents(t *testing.T, d *swiftDriver, expectedBlobs []keppel.StoredBlobInfo, expectedManifests []keppel.StoredManifestInfo) {
+	t.Helper()
+	blobs, manifests, err := d.ListStorageContents(testAccount)
+	mustSucceed(t, err)
+	if fmt.Sprint(blobs) != fmt.Sprint(expectedBlobs) {
+		t.Errorf("expected blobs %v, but got %v", expectedBlobs, blobs)
+	}
+	if fmt.Sprint(manifests) != fmt.Sprint(expectedManifests) {
+		t.Errorf("expected manifests %v, but got %v", expectedManifests, manifests)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func TestSwiftSegmentedUpload(t *testing.T) {
+	d, fake := setupFakeSwift(t)
+
+	chunks := [][]byte{[]byte("first chunk;"), []byte("second chunk;"), []byte("third chunk")}
+	for idx, chunk := range chunks {
+		chunkLength := uint64(len(chunk))
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, uint32(idx+1), &chunkLength, bytes.NewReader(chunk)))
+	}
+
+	//the container is created on first use, in the Swift account of the auth tenant
+	c := fake.containers["AUTH_tenant1/keppel-test1"]
+	if c == nil || c.TempURLKey == "" {
+		t.Fatal("expected container AUTH_tenant1/keppel-test1 to be created with a temp URL key")
+	}
+
+	//the unfinished upload must show up in the storage listing
+	expectStorageContents(t, d, []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 3}}, nil)
+
+	//finalizing creates an SLO that refers to the chunks
+	mustSucceed(t, d.FinalizeBlob(testAccount, testStorageID, 3))
+	blobObjectName := "_blobs/01/23/456789abcdef"
+	if o := c.Objects[blobObjectName]; o == nil || len(o.SLOSegments) != 3 {
+		t.Errorf("expected %s to be an SLO with 3 segments, but got %#v", blobObjectName, o)
+	}
+
+	//read back the finalized blob
+	reader, sizeBytes, err := d.ReadBlob(testAccount, testStorageID)
+	mustSucceed(t, err)
+	contents, err := io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	expectedContents := bytes.Join(chunks, nil)
+	if sizeBytes != uint64(len(expectedContents)) {
+		t.Errorf("expected blob size %d, but got %d", len(expectedContents), sizeBytes)
+	}
+	if !bytes.Equal(contents, expectedContents) {
+		t.Errorf("expected blob contents %q, but got %q", expectedContents, contents)
+	}
+
+	//read back a part of the finalized blob
+	reader, err = d.ReadBlobRange(testAccount, testStorageID, 6, 10)
+	mustSucceed(t, err)
+	contents, err = io.ReadAll(reader)
+	mustSucceed(t, err)
+	mustSucceed(t, reader.Close())
+	if !bytes.Equal(contents, expectedContents[6:16]) {
+		t.Errorf("expected partial blob contents %q, but got %q", expectedContents[6:16], contents)
+	}
+
+	//the blob can be downloaded through its temp URL without a token
+	blobURL, err := d.URLForBlob(testAccount, testStorageID)
+	mustSucceed(t, err)
+	resp, err := http.Get(blobURL) //nolint:noctx
+	mustSucceed(t, err)
+	contents, err = io.ReadAll(resp.Body)
+	mustSucceed(t, err)
+	mustSucceed(t, resp.Body.Close())
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(contents, expectedContents) {
+		t.Errorf("expected temp URL to serve the blob contents, but got %d %q", resp.StatusCode, contents)
+	}
+
+	//deleting the blob also deletes its segments
+	mustSucceed(t, d.DeleteBlob(testAccount, testStorageID))
+	expectStorageContents(t, d, nil, nil)
+}
+
+func TestSwiftAbortBlobUpload(t *testing.T) {
+	d, _ := setupFakeSwift(t)
+
+	for chunkNumber := uint32(1); chunkNumber <= 2; chunkNumber++ {
+		chunk := []byte(fmt.Sprintf("chunk %d", chunkNumber))
+		mustSucceed(t, d.AppendToBlob(testAccount, testStorageID, chunkNumber, nil, bytes.NewReader(chunk)))
+	}
+	expectStorageContents(t, d, []keppel.StoredBlobInfo{{StorageID: testStorageID, ChunkCount: 2}}, nil)
+
+	mustSucceed(t, d.AbortBlobUpload(testAccount, testStorageID, 2))
+	expectStorageContents(t, d, nil, nil)
+
+	//the blob was never finalized, so it cannot be read
+	_, _, err := d.ReadBlob(testAccount, testStorageID)
+	if !schwift.Is(err, http.StatusNotFound) {
+		t.Errorf("expected 404 when reading aborted blob, but got %v", err)
+	}
+}
+
+func TestSwiftManifestsAndCleanup(t *testing.T) {
+	d, fake := setupFakeSwift(t)
+
+	manifestContents := []byte(`{"schemaVersion":2}`)
+	mustSucceed(t, d.WriteManifest(testAccount, "library/foo", "sha256:abc", manifestContents))
+	mustSucceed(t, d.WriteManifest(testAccount, "bar", "sha256:def", manifestContents))
+	contents, err := d.ReadManifest(testAccount, "library/foo", "sha256:abc")
+	mustSucceed(t, err)
+	if !bytes.Equal(contents, manifestContents) {
+		t.Errorf("expected manifest contents %q, but got %q", manifestContents, contents)
+	}
+	expectStorageContents(t, d, nil, []keppel.StoredManifestInfo{
+		{RepoName: "bar", Digest: "sha256:def"},
+		{RepoName: "library/foo", Digest: "sha256:abc"},
+	})
+
+	//account cleanup fails while the container is not empty
+	if d.CleanupAccount(testAccount) == nil {
+		t.Error("expected CleanupAccount to fail while manifests are still stored")
+	}
+	mustSucceed(t, d.DeleteManifest(testAccount, "library/foo", "sha256:abc"))
+	mustSucceed(t, d.DeleteManifest(testAccount, "bar", "sha256:def"))
+	expectStorageContents(t, d, nil, nil)
+	mustSucceed(t, d.CleanupAccount(testAccount))
+	if len(fake.containers) != 0 {
+		t.Errorf("expected container to be deleted, but got %d containers", len(fake.containers))
+	}
+}
@@ -21,7 +21,10 @@ package redis
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -33,9 +36,10 @@ import (
 )
 
 type federationDriver struct {
-	ownHostname string
-	prefix      string
-	rc          *redis.Client
+	ownHostname      string
+	prefix           string
+	rc               *redis.Client
+	subleaseTokenTTL time.Duration
 }
 
 func init() {
@@ -46,9 +50,10 @@ func init() {
 			return nil, fmt.Errorf("cannot parse federation Redis URL: %s", err.Error())
 		}
 		return &federationDriver{
-			ownHostname: cfg.APIPublicHostname,
-			prefix:      osext.GetenvOrDefault("KEPPEL_FEDERATION_REDIS_PREFIX", "keppel"),
-			rc:          redis.NewClient(opts),
+			ownHostname:      cfg.APIPublicHostname,
+			prefix:           osext.GetenvOrDefault("KEPPEL_FEDERATION_REDIS_PREFIX", "keppel"),
+			rc:               redis.NewClient(opts),
+			subleaseTokenTTL: cfg.SubleaseTokenTTL,
 		}, nil
 	})
 }
@@ -72,6 +77,14 @@ const (
 		end
 		return 0
 	`
+	checkAndReplaceScript = `
+		local v = redis.call('GET', KEYS[1])
+		if v == ARGV[1] then
+			redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+			return 1
+		end
+		return 0
+	`
 )
 
 // ClaimAccountName implements the keppel.FederationDriver interface.
@@ -115,13 +128,42 @@ func (d *federationDriver) claimReplicaAccount(account keppel.Account, subleaseT
 		return keppel.ClaimFailed, errors.New("missing sublease token")
 	}
 
-	//validate the sublease token secret
-	ok, err := d.rc.Eval(context.Background(), checkAndClearScript, []string{d.tokenKey(account.Name)}, subleaseTokenSecret).Bool()
+	//validate the sublease token secret (expired tokens have been removed by
+	//Redis already, so they are rejected in the same way as used tokens)
+	errInvalidToken := errors.New("invalid sublease token (or token was already used or has expired)")
+	key := d.tokenKey(account.Name)
+	storedHash, err := d.rc.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return keppel.ClaimFailed, errInvalidToken
+	}
+	if err != nil {
+		return keppel.ClaimErrored, err
+	}
+
+	//tokens issued before we started storing only hashes are stored in plain
+	//text; these are replaced by their hash on first use
+	if !isSubleaseTokenHash(storedHash) {
+		legacyToken := storedHash
+		storedHash = keppel.HashSubleaseTokenSecret(legacyToken)
+		ok, err := d.rc.Eval(context.Background(), checkAndReplaceScript, []string{key}, legacyToken, storedHash).Bool()
+		if err != nil {
+			return keppel.ClaimErrored, err
+		}
+		if !ok {
+			return keppel.ClaimFailed, errInvalidToken
+		}
+	}
+
+	tokenHash := keppel.HashSubleaseTokenSecret(subleaseTokenSecret)
+	if subtle.ConstantTimeCompare([]byte(storedHash), []byte(tokenHash)) != 1 {
+		return keppel.ClaimFailed, errInvalidToken
+	}
+	ok, err := d.rc.Eval(context.Background(), checkAndClearScript, []string{key}, storedHash).Bool()
 	if err != nil {
 		return keppel.ClaimErrored, err
 	}
 	if !ok {
-		return keppel.ClaimFailed, errors.New("invalid sublease token (or token was already used)")
+		return keppel.ClaimFailed, errInvalidToken
 	}
 
 	//validate the primary account
@@ -138,6 +180,11 @@ func (d *federationDriver) claimReplicaAccount(account keppel.Account, subleaseT
 	return keppel.ClaimSucceeded, nil
 }
 
+func isSubleaseTokenHash(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil && len(value) == 2*sha256.Size
+}
+
 // IssueSubleaseTokenSecret implements the keppel.FederationDriver interface.
 func (d *federationDriver) IssueSubleaseTokenSecret(account keppel.Account) (string, error) {
 	//defense in depth - the caller should already have verified this
@@ -159,8 +206,9 @@ func (d *federationDriver) IssueSubleaseTokenSecret(account keppel.Account) (str
 	}
 	tokenStr := base64.StdEncoding.EncodeToString(tokenBytes)
 
-	//store the random token in Redis
-	err = d.rc.Set(context.Background(), d.tokenKey(account.Name), tokenStr, 0).Err()
+	//store the hash of the random token in Redis (a TTL of 0 means no expiry)
+	tokenHash := keppel.HashSubleaseTokenSecret(tokenStr)
+	err = d.rc.Set(context.Background(), d.tokenKey(account.Name), tokenHash, d.subleaseTokenTTL).Err()
 	if err != nil {
 		return "", fmt.Errorf("could not store token: %s", err.Error())
 	}
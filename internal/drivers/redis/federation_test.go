@@ -0,0 +1,125 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func setupFederationDrivers(t *testing.T) (primary, replica *federationDriver, sr *miniredis.Miniredis) {
+	t.Helper()
+	sr = miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: sr.Addr()})
+	primary = &federationDriver{"registry.example.org", "keppel", rc, time.Hour}
+	replica = &federationDriver{"registry-secondary.example.org", "keppel", rc, time.Hour}
+
+	result, err := primary.ClaimAccountName(keppel.Account{Name: "test1"}, "")
+	if err != nil || result != keppel.ClaimSucceeded {
+		t.Fatalf("could not claim primary account: result = %d, err = %v", result, err)
+	}
+	return primary, replica, sr
+}
+
+func expectClaimReplicaAccount(t *testing.T, replica *federationDriver, tokenSecret string, expectedResult keppel.ClaimResult, expectedError string) {
+	t.Helper()
+	account := keppel.Account{Name: "test1", UpstreamPeerHostName: "registry.example.org"}
+	result, err := replica.ClaimAccountName(account, tokenSecret)
+	if result != expectedResult {
+		t.Errorf("expected claim result %d, but got %d", expectedResult, result)
+	}
+	switch {
+	case expectedError == "" && err != nil:
+		t.Errorf("expected claim to succeed, but got: %s", err.Error())
+	case expectedError != "" && err == nil:
+		t.Errorf("expected claim to fail with %q, but it succeeded", expectedError)
+	case expectedError != "" && err.Error() != expectedError:
+		t.Errorf("expected claim to fail with %q, but got %q", expectedError, err.Error())
+	}
+}
+
+func TestSubleaseTokenIsSingleUse(t *testing.T) {
+	primary, replica, sr := setupFederationDrivers(t)
+	tokenSecret, err := primary.IssueSubleaseTokenSecret(keppel.Account{Name: "test1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//only the hash of the token is stored in Redis
+	storedValue, err := sr.Get("keppel-token-test1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if storedValue != keppel.HashSubleaseTokenSecret(tokenSecret) || strings.Contains(storedValue, tokenSecret) {
+		t.Errorf("expected Redis to contain the hash of the token secret, but found %q", storedValue)
+	}
+
+	//a wrong token does not consume the correct one
+	const errMsg = "invalid sublease token (or token was already used or has expired)"
+	expectClaimReplicaAccount(t, replica, "wrong", keppel.ClaimFailed, errMsg)
+	//claim within the TTL succeeds
+	sr.FastForward(59 * time.Minute)
+	expectClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimSucceeded, "")
+	//reusing the token fails
+	expectClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimFailed, errMsg)
+}
+
+func TestLegacySubleaseTokenIsStillAccepted(t *testing.T) {
+	_, replica, sr := setupFederationDrivers(t)
+
+	//before we started storing only hashes, the token secret was stored as-is
+	const tokenSecret = "bGVnYWN5LXRva2Vu"
+	err := sr.Set("keppel-token-test1", tokenSecret)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//on first use, the token secret is replaced by its hash...
+	const errMsg = "invalid sublease token (or token was already used or has expired)"
+	expectClaimReplicaAccount(t, replica, "wrong", keppel.ClaimFailed, errMsg)
+	storedValue, err := sr.Get("keppel-token-test1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if storedValue != keppel.HashSubleaseTokenSecret(tokenSecret) {
+		t.Errorf("expected Redis to contain the hash of the legacy token secret, but found %q", storedValue)
+	}
+
+	//...but the token can still be redeemed exactly once
+	expectClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimSucceeded, "")
+	expectClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimFailed, errMsg)
+}
+
+func TestSubleaseTokenExpires(t *testing.T) {
+	primary, replica, sr := setupFederationDrivers(t)
+	tokenSecret, err := primary.IssueSubleaseTokenSecret(keppel.Account{Name: "test1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	sr.FastForward(61 * time.Minute)
+	expectClaimReplicaAccount(t, replica, tokenSecret, keppel.ClaimFailed,
+		"invalid sublease token (or token was already used or has expired)")
+}
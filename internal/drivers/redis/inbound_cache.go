@@ -0,0 +1,136 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package redis
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+type inboundCacheDriver struct {
+	prefix string
+	ttl    time.Duration
+	rc     *redis.Client
+}
+
+type inboundCacheEntry struct {
+	Contents  []byte    `json:"contents,omitempty"`
+	MediaType string    `json:"media_type,omitempty"`
+	NotFound  bool      `json:"not_found,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func init() {
+	keppel.RegisterInboundCacheDriver("redis", func(_ keppel.Configuration, rc *redis.Client) (keppel.InboundCacheDriver, error) {
+		if rc == nil {
+			return nil, errors.New("the redis inbound cache driver requires Redis to be configured (see KEPPEL_REDIS_ENABLE)")
+		}
+		ttlStr := osext.GetenvOrDefault("KEPPEL_INBOUND_CACHE_REDIS_TTL", "3h")
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed KEPPEL_INBOUND_CACHE_REDIS_TTL: %w", err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("malformed KEPPEL_INBOUND_CACHE_REDIS_TTL: expected a positive duration, but got %q", ttlStr)
+		}
+		return &inboundCacheDriver{
+			prefix: osext.GetenvOrDefault("KEPPEL_INBOUND_CACHE_REDIS_PREFIX", "keppel"),
+			ttl:    ttl,
+			rc:     rc,
+		}, nil
+	})
+}
+
+func (d *inboundCacheDriver) cacheKey(location keppel.ImageReference) string {
+	if location.Reference.IsTag() {
+		return fmt.Sprintf("%s-inbound-cache-%s/%s/_tags/%s",
+			d.prefix, location.Host, location.RepoName, location.Reference.Tag)
+	}
+	return fmt.Sprintf("%s-inbound-cache-%s/%s/_manifests/%s",
+		d.prefix, location.Host, location.RepoName, location.Reference.Digest.String())
+}
+
+// LoadManifest implements the keppel.InboundCacheDriver interface.
+func (d *inboundCacheDriver) LoadManifest(location keppel.ImageReference, now time.Time) (contents []byte, mediaType string, err error) {
+	buf, err := d.rc.Get(context.Background(), d.cacheKey(location)).Bytes()
+	if err == redis.Nil {
+		return nil, "", sql.ErrNoRows
+	}
+	if err != nil {
+		//the cache is not essential, so we can just pull from upstream instead
+		logg.Error("while performing a lookup in the inbound cache for %s: %s", location.String(), err.Error())
+		return nil, "", sql.ErrNoRows
+	}
+
+	var entry inboundCacheEntry
+	err = json.Unmarshal(buf, &entry)
+	if err != nil {
+		logg.Error("while decoding inbound cache entry for %s: %s", location.String(), err.Error())
+		return nil, "", sql.ErrNoRows
+	}
+
+	//Redis expires keys by its own clock, but we also need to respect the clock given by the caller
+	if !entry.ExpiresAt.After(now) {
+		return nil, "", sql.ErrNoRows
+	}
+	if entry.NotFound {
+		return nil, "", keppel.ErrManifestNotFoundUpstream
+	}
+	return entry.Contents, entry.MediaType, nil
+}
+
+// StoreManifest implements the keppel.InboundCacheDriver interface.
+func (d *inboundCacheDriver) StoreManifest(location keppel.ImageReference, contents []byte, mediaType string, now time.Time) error {
+	d.store(location, inboundCacheEntry{
+		Contents:  contents,
+		MediaType: mediaType,
+		ExpiresAt: now.Add(d.ttl),
+	}, d.ttl)
+	return nil
+}
+
+// StoreManifestNotFound implements the keppel.InboundCacheDriver interface.
+func (d *inboundCacheDriver) StoreManifestNotFound(location keppel.ImageReference, now time.Time, ttl time.Duration) error {
+	d.store(location, inboundCacheEntry{
+		NotFound:  true,
+		ExpiresAt: now.Add(ttl),
+	}, ttl)
+	return nil
+}
+
+func (d *inboundCacheDriver) store(location keppel.ImageReference, entry inboundCacheEntry, ttl time.Duration) {
+	buf, err := json.Marshal(entry)
+	if err == nil {
+		err = d.rc.Set(context.Background(), d.cacheKey(location), buf, ttl).Err()
+	}
+	if err != nil {
+		//the cache is not essential, so a failure to populate it does not need to fail the request
+		logg.Error("while populating the inbound cache for %s: %s", location.String(), err.Error())
+	}
+}
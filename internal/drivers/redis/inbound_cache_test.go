@@ -0,0 +1,161 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package redis
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func setupInboundCache(t *testing.T) (keppel.InboundCacheDriver, *miniredis.Miniredis) {
+	t.Helper()
+	t.Setenv("KEPPEL_INBOUND_CACHE_REDIS_TTL", "1h")
+	sr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: sr.Addr()})
+	icd, err := keppel.NewInboundCacheDriver("redis", keppel.Configuration{}, rc)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return icd, sr
+}
+
+func mustParseImageReference(t *testing.T, input string) keppel.ImageReference {
+	t.Helper()
+	imageRef, _, err := keppel.ParseImageReference(input)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return imageRef
+}
+
+func expectCacheMiss(t *testing.T, icd keppel.InboundCacheDriver, location keppel.ImageReference, now time.Time) {
+	t.Helper()
+	_, _, err := icd.LoadManifest(location, now)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected cache miss for %s, but got err = %v", location.String(), err)
+	}
+}
+
+func expectCacheHit(t *testing.T, icd keppel.InboundCacheDriver, location keppel.ImageReference, now time.Time, expectedContents, expectedMediaType string) {
+	t.Helper()
+	contents, mediaType, err := icd.LoadManifest(location, now)
+	if err != nil {
+		t.Errorf("expected cache hit for %s, but got: %s", location.String(), err.Error())
+		return
+	}
+	if string(contents) != expectedContents || mediaType != expectedMediaType {
+		t.Errorf("expected cache hit for %s to yield %q with media type %q, but got %q with media type %q",
+			location.String(), expectedContents, expectedMediaType, string(contents), mediaType)
+	}
+}
+
+func TestInboundCacheStoreAndLoad(t *testing.T) {
+	icd, sr := setupInboundCache(t)
+	now := time.Unix(10000, 0)
+	tagRef := mustParseImageReference(t, "registry.example.org/library/alpine:3.17")
+	otherRef := mustParseImageReference(t, "registry.example.org/library/alpine:3.16")
+
+	//nothing is cached initially
+	expectCacheMiss(t, icd, tagRef, now)
+
+	//store and load
+	err := icd.StoreManifest(tagRef, []byte("{}"), "application/vnd.oci.image.manifest.v1+json", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCacheHit(t, icd, tagRef, now.Add(30*time.Minute), "{}", "application/vnd.oci.image.manifest.v1+json")
+	expectCacheMiss(t, icd, otherRef, now)
+	if !sr.Exists("keppel-inbound-cache-registry.example.org/library/alpine/_tags/3.17") {
+		t.Errorf("expected cache key to exist, but got keys %v", sr.Keys())
+	}
+
+	//entries expire according to the clock given by the caller...
+	expectCacheMiss(t, icd, tagRef, now.Add(time.Hour))
+
+	//...and are also evicted by Redis after the TTL
+	sr.FastForward(2 * time.Hour)
+	expectCacheMiss(t, icd, tagRef, now)
+	if len(sr.Keys()) != 0 {
+		t.Errorf("expected Redis to have evicted all keys, but got %v", sr.Keys())
+	}
+}
+
+func TestInboundCacheNegativeEntries(t *testing.T) {
+	icd, _ := setupInboundCache(t)
+	now := time.Unix(10000, 0)
+	tagRef := mustParseImageReference(t, "registry.example.org/library/alpine:bogus")
+
+	err := icd.StoreManifestNotFound(tagRef, now, time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, _, err = icd.LoadManifest(tagRef, now.Add(30*time.Second))
+	if err != keppel.ErrManifestNotFoundUpstream {
+		t.Errorf("expected negative cache hit, but got err = %v", err)
+	}
+	//negative entries expire after their own TTL
+	expectCacheMiss(t, icd, tagRef, now.Add(time.Minute))
+
+	//storing the actual manifest replaces the negative entry
+	err = icd.StoreManifestNotFound(tagRef, now, time.Minute)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = icd.StoreManifest(tagRef, []byte("{}"), "application/vnd.oci.image.manifest.v1+json", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectCacheHit(t, icd, tagRef, now, "{}", "application/vnd.oci.image.manifest.v1+json")
+}
+
+func TestInboundCacheWithRedisFailure(t *testing.T) {
+	icd, sr := setupInboundCache(t)
+	now := time.Unix(10000, 0)
+	tagRef := mustParseImageReference(t, "registry.example.org/library/alpine:3.17")
+
+	err := icd.StoreManifest(tagRef, []byte("{}"), "application/vnd.oci.image.manifest.v1+json", now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//when Redis fails, the cache behaves as if it was empty, so that the caller falls back to the upstream registry
+	sr.SetError("simulated failure")
+	expectCacheMiss(t, icd, tagRef, now)
+	err = icd.StoreManifest(tagRef, []byte("{}"), "application/vnd.oci.image.manifest.v1+json", now)
+	if err != nil {
+		t.Errorf("expected StoreManifest to ignore Redis errors, but got: %s", err.Error())
+	}
+
+	//once Redis is back, the cache works again
+	sr.SetError("")
+	expectCacheHit(t, icd, tagRef, now, "{}", "application/vnd.oci.image.manifest.v1+json")
+}
+
+func TestInboundCacheRequiresRedis(t *testing.T) {
+	_, err := keppel.NewInboundCacheDriver("redis", keppel.Configuration{}, nil)
+	if err == nil {
+		t.Error("expected redis inbound cache driver to fail without Redis, but got no error")
+	}
+}
@@ -23,13 +23,15 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/go-redis/redis/v8"
+
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
 type inboundCacheDriver struct{}
 
 func init() {
-	keppel.RegisterInboundCacheDriver("trivial", func(_ keppel.Configuration) (keppel.InboundCacheDriver, error) {
+	keppel.RegisterInboundCacheDriver("trivial", func(_ keppel.Configuration, _ *redis.Client) (keppel.InboundCacheDriver, error) {
 		return inboundCacheDriver{}, nil
 	})
 }
@@ -45,3 +47,9 @@ func (inboundCacheDriver) StoreManifest(location keppel.ImageReference, contents
 	//no-op
 	return nil
 }
+
+// StoreManifestNotFound implements the keppel.InboundCacheDriver interface.
+func (inboundCacheDriver) StoreManifestNotFound(location keppel.ImageReference, now time.Time, ttl time.Duration) error {
+	//no-op
+	return nil
+}
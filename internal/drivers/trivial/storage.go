@@ -115,6 +115,18 @@ func (d *StorageDriver) ReadBlob(account keppel.Account, storageID string) (io.R
 	return io.NopCloser(bytes.NewReader(contents)), uint64(len(contents)), nil
 }
 
+// ReadBlobRange implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	contents, exists := d.blobs[blobKey(account, storageID)]
+	if !exists {
+		return nil, errNoSuchBlob
+	}
+	if offset+length > uint64(len(contents)) {
+		return nil, fmt.Errorf("requested range %d-%d is outside of blob with %d bytes", offset, offset+length-1, len(contents))
+	}
+	return io.NopCloser(bytes.NewReader(contents[offset : offset+length])), nil
+}
+
 // URLForBlob implements the keppel.StorageDriver interface.
 func (d *StorageDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
 	if d.AllowDummyURLs {
@@ -165,19 +177,22 @@ func (d *StorageDriver) DeleteManifest(account keppel.Account, repoName, digest
 
 // ListStorageContents implements the keppel.StorageDriver interface.
 func (d *StorageDriver) ListStorageContents(account keppel.Account) ([]keppel.StoredBlobInfo, []keppel.StoredManifestInfo, error) {
-	var (
-		blobs     []keppel.StoredBlobInfo
-		manifests []keppel.StoredManifestInfo
-	)
+	return keppel.CollectStorageContents(d, account)
+}
 
+// ListStorageContentsStream implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ListStorageContentsStream(account keppel.Account, blobCallback func(keppel.StoredBlobInfo) error, manifestCallback func(keppel.StoredManifestInfo) error) error {
 	rx := regexp.MustCompile(`^` + blobKey(account, `(.*)`) + `$`)
 	for key := range d.blobs {
 		match := rx.FindStringSubmatch(key)
 		if match != nil {
-			blobs = append(blobs, keppel.StoredBlobInfo{
+			err := blobCallback(keppel.StoredBlobInfo{
 				StorageID:  match[1],
 				ChunkCount: d.blobChunkCounts[key],
 			})
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -185,14 +200,17 @@ func (d *StorageDriver) ListStorageContents(account keppel.Account) ([]keppel.St
 	for key := range d.manifests {
 		match := rx.FindStringSubmatch(key)
 		if match != nil {
-			manifests = append(manifests, keppel.StoredManifestInfo{
+			err := manifestCallback(keppel.StoredManifestInfo{
 				RepoName: match[1],
 				Digest:   match[2],
 			})
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return blobs, manifests, nil
+	return nil
 }
 
 // CleanupAccount implements the keppel.StorageDriver interface.
@@ -0,0 +1,133 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package trivial
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestListStorageContentsStream(t *testing.T) {
+	sd, err := keppel.NewStorageDriver("in-memory-for-testing", nil, keppel.Configuration{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	account := keppel.Account{Name: "test1"}
+	otherAccount := keppel.Account{Name: "test2"}
+
+	//setup a synthetic account with lots of blobs (every tenth blob is an
+	//unfinished upload) plus some contents in a different account that must not
+	//be reported
+	const blobCount = 50000
+	for idx := 0; idx < blobCount; idx++ {
+		storageID := fmt.Sprintf("%064x", idx)
+		err := sd.AppendToBlob(account, storageID, 1, nil, bytes.NewReader([]byte("x")))
+		if err == nil && idx%10 != 0 {
+			err = sd.FinalizeBlob(account, storageID, 1)
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for idx := 0; idx < 10; idx++ {
+		err := sd.AppendToBlob(otherAccount, fmt.Sprintf("%064x", idx), 1, nil, bytes.NewReader([]byte("x")))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = sd.WriteManifest(account, "foo", "sha256:abc", []byte("{}"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//count the listing results without retaining them
+	var (
+		finalizedCount   int
+		unfinalizedCount int
+		manifestCount    int
+	)
+	err = sd.ListStorageContentsStream(account,
+		func(blob keppel.StoredBlobInfo) error {
+			if blob.ChunkCount == 0 {
+				finalizedCount++
+			} else {
+				unfinalizedCount++
+			}
+			return nil
+		},
+		func(manifest keppel.StoredManifestInfo) error {
+			manifestCount++
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if finalizedCount != blobCount*9/10 || unfinalizedCount != blobCount/10 || manifestCount != 1 {
+		t.Errorf("expected %d finalized blobs, %d unfinalized blobs and 1 manifest, but got %d, %d and %d",
+			blobCount*9/10, blobCount/10, finalizedCount, unfinalizedCount, manifestCount)
+	}
+
+	//the non-streaming variant must report the same contents
+	blobs, manifests, err := sd.ListStorageContents(account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(blobs) != blobCount || len(manifests) != 1 {
+		t.Errorf("expected ListStorageContents to report %d blobs and 1 manifest, but got %d and %d",
+			blobCount, len(blobs), len(manifests))
+	}
+
+	//errors from callbacks abort the listing
+	errStop := errors.New("stop")
+	callCount := 0
+	err = sd.ListStorageContentsStream(account,
+		func(blob keppel.StoredBlobInfo) error {
+			callCount++
+			return errStop
+		},
+		func(manifest keppel.StoredManifestInfo) error { return nil },
+	)
+	if err != errStop || callCount != 1 {
+		t.Errorf("expected listing to abort after the first callback with %q, but got %d calls and error %v", errStop.Error(), callCount, err)
+	}
+}
+
+func TestMergeChunkCounts(t *testing.T) {
+	testCases := []struct {
+		LHS, RHS, Expected uint32
+	}{
+		{0, 0, 0},
+		{0, 5, 0},
+		{5, 0, 0},
+		{3, 5, 5},
+		{5, 3, 5},
+	}
+	for _, tc := range testCases {
+		actual := keppel.MergeChunkCounts(tc.LHS, tc.RHS)
+		if actual != tc.Expected {
+			t.Errorf("expected MergeChunkCounts(%d, %d) = %d, but got %d", tc.LHS, tc.RHS, tc.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// SelectAnycastPeer chooses the peer that an anycast request for the given
+// repository shall be forwarded to. The primary hostname refers to the peer
+// that hosts the primary account for this repository.
+//
+// To maximize cache hits on peers that hold replicas of the account, the same
+// repository should always be routed to the same peer. This is achieved with
+// rendezvous hashing (a variant of consistent hashing): All candidate peers
+// are ranked by a hash of their hostname and the repository name, and the
+// best-ranked healthy peer wins. When peers are added or removed, this only
+// changes the routing of those repositories that are affected by this peer.
+//
+// Stale peers (see Peer.IsStale) are skipped. If no candidate is healthy, the
+// primary is chosen.
+func SelectAnycastPeer(peers []Peer, primaryHostName, accountName, repoName string, now time.Time) string {
+	candidates := make([]Peer, 0, len(peers)+1)
+	hasPrimary := false
+	for _, peer := range peers {
+		candidates = append(candidates, peer)
+		if peer.HostName == primaryHostName {
+			hasPrimary = true
+		}
+	}
+	if !hasPrimary {
+		//we do not know the health of the primary, so assume that it is healthy
+		lastPeeredAt := now
+		candidates = append(candidates, Peer{HostName: primaryHostName, LastPeeredAt: &lastPeeredAt})
+	}
+
+	scores := make(map[string]uint64, len(candidates))
+	for _, peer := range candidates {
+		scores[peer.HostName] = anycastRoutingScore(peer.HostName, accountName, repoName)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].HostName] > scores[candidates[j].HostName]
+	})
+
+	for _, peer := range candidates {
+		if !peer.IsStale(now) {
+			return peer.HostName
+		}
+	}
+	return primaryHostName
+}
+
+func anycastRoutingScore(peerHostName, accountName, repoName string) uint64 {
+	hash := sha256.Sum256([]byte(peerHostName + "\x00" + accountName + "/" + repoName))
+	return binary.BigEndian.Uint64(hash[:8])
+}
@@ -0,0 +1,101 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSelectAnycastPeer(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	recently := now.Add(-10 * time.Minute)
+	longAgo := now.Add(-2 * PeerStaleAfter)
+
+	peers := []Peer{
+		{HostName: "registry-a.example.org", LastPeeredAt: &recently},
+		{HostName: "registry-b.example.org", LastPeeredAt: &recently},
+		{HostName: "registry-c.example.org", LastPeeredAt: &recently},
+		{HostName: "registry-d.example.org", LastPeeredAt: &recently},
+	}
+	const primary = "registry-a.example.org"
+
+	//selection is stable for the same repo, and does not depend on the order of peers
+	selected := SelectAnycastPeer(peers, primary, "test1", "foo", now)
+	reversedPeers := []Peer{peers[3], peers[2], peers[1], peers[0]}
+	for _, p := range [][]Peer{peers, reversedPeers} {
+		actual := SelectAnycastPeer(p, primary, "test1", "foo", now)
+		if actual != selected {
+			t.Errorf("expected stable selection of %s for test1/foo, but got %s", selected, actual)
+		}
+	}
+
+	//different repos are spread across the peers
+	seen := make(map[string]bool)
+	for idx := 0; idx < 100; idx++ {
+		seen[SelectAnycastPeer(peers, primary, "test1", fmt.Sprintf("repo%d", idx), now)] = true
+	}
+	if len(seen) != len(peers) {
+		t.Errorf("expected 100 repos to be spread across all %d peers, but only saw %v", len(peers), seen)
+	}
+
+	//when the selected peer becomes stale, we fail over to another peer, and
+	//other repos are not affected by this
+	var otherRepo string
+	for idx := 0; otherRepo == ""; idx++ {
+		repoName := fmt.Sprintf("repo%d", idx)
+		if SelectAnycastPeer(peers, primary, "test1", repoName, now) != selected {
+			otherRepo = repoName
+		}
+	}
+	otherSelected := SelectAnycastPeer(peers, primary, "test1", otherRepo, now)
+	peersWithStale := make([]Peer, len(peers))
+	copy(peersWithStale, peers)
+	for idx, peer := range peersWithStale {
+		if peer.HostName == selected {
+			peersWithStale[idx].LastPeeredAt = &longAgo
+		}
+	}
+	failover := SelectAnycastPeer(peersWithStale, primary, "test1", "foo", now)
+	if failover == selected {
+		t.Errorf("expected failover away from stale peer %s, but it was still selected", selected)
+	}
+	if SelectAnycastPeer(peersWithStale, primary, "test1", "foo", now) != failover {
+		t.Error("expected failover selection to be stable")
+	}
+	if actual := SelectAnycastPeer(peersWithStale, primary, "test1", otherRepo, now); actual != otherSelected {
+		t.Errorf("expected selection for %s to stay at %s, but got %s", otherRepo, otherSelected, actual)
+	}
+
+	//peers that never peered are also stale
+	peersWithNeverPeered := []Peer{{HostName: "registry-x.example.org"}}
+	if actual := SelectAnycastPeer(peersWithNeverPeered, "registry-y.example.org", "test1", "foo", now); actual != "registry-y.example.org" {
+		t.Errorf("expected the primary to be selected when all other peers are stale, but got %s", actual)
+	}
+
+	//if all peers (including the primary) are stale, the primary is selected
+	allStale := []Peer{
+		{HostName: "registry-a.example.org", LastPeeredAt: &longAgo},
+		{HostName: "registry-b.example.org"},
+	}
+	if actual := SelectAnycastPeer(allStale, primary, "test1", "foo", now); actual != primary {
+		t.Errorf("expected the primary to be selected when all peers are stale, but got %s", actual)
+	}
+}
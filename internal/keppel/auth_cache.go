@@ -0,0 +1,149 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// WithAuthCache wraps an AuthDriver such that successful results of
+// AuthenticateUser() are cached in Redis for the given duration. Failed
+// authentications are never cached. If the Redis client is nil, the AuthDriver
+// is returned unchanged.
+//
+// Drivers can opt into this behavior by wrapping their return value in the
+// factory function given to RegisterAuthDriver():
+//
+//	keppel.RegisterAuthDriver("foo", func(rc *redis.Client) (keppel.AuthDriver, error) {
+//		d := &fooDriver{...}
+//		return keppel.WithAuthCache(d, rc, 5*time.Minute), nil
+//	})
+//
+// The cached UserIdentity is stored in serialized form, so the UserIdentity
+// type used by the driver must be registered with RegisterUserIdentity().
+//
+// Requests with Basic auth that are given to AuthenticateUserFromRequest() are
+// also served through the cache, so drivers wrapped in this must interpret
+// Basic auth credentials in that method in the same way as AuthenticateUser().
+func WithAuthCache(inner AuthDriver, rc *redis.Client, ttl time.Duration) AuthDriver {
+	if rc == nil {
+		return inner
+	}
+	return &cachingAuthDriver{inner, rc, ttl}
+}
+
+type cachingAuthDriver struct {
+	inner AuthDriver
+	rc    *redis.Client
+	ttl   time.Duration
+}
+
+// UnwrapAuthDriver returns the AuthDriver that was given to WithAuthCache(), or
+// the argument itself if it was not wrapped. This is useful for functions that
+// need to type-cast the AuthDriver into the driver's concrete type.
+func UnwrapAuthDriver(ad AuthDriver) AuthDriver {
+	if d, ok := ad.(*cachingAuthDriver); ok {
+		return d.inner
+	}
+	return ad
+}
+
+type cachedUserIdentity struct {
+	TypeName string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func (d *cachingAuthDriver) cacheKey(userName, password string) string {
+	//the password is hashed together with the username, so neither can be recovered from the key
+	hash := sha256.Sum256([]byte(userName + "\x00" + password))
+	return "keppel-auth-" + d.inner.DriverName() + "-" + hex.EncodeToString(hash[:])
+}
+
+// DriverName implements the AuthDriver interface.
+func (d *cachingAuthDriver) DriverName() string {
+	return d.inner.DriverName()
+}
+
+// ValidateTenantID implements the AuthDriver interface.
+func (d *cachingAuthDriver) ValidateTenantID(tenantID string) error {
+	return d.inner.ValidateTenantID(tenantID)
+}
+
+// AuthenticateUser implements the AuthDriver interface.
+func (d *cachingAuthDriver) AuthenticateUser(userName, password string) (UserIdentity, *RegistryV2Error) {
+	key := d.cacheKey(userName, password)
+	ctx := context.Background()
+
+	//try to serve from cache
+	buf, err := d.rc.Get(ctx, key).Bytes()
+	switch {
+	case err == redis.Nil:
+		//cache miss
+	case err != nil:
+		logg.Error("cannot retrieve cached user identity from Redis: %s", err.Error())
+	default:
+		var cached cachedUserIdentity
+		err := json.Unmarshal(buf, &cached)
+		if err == nil {
+			var uid UserIdentity
+			uid, err = DeserializeUserIdentity(cached.TypeName, cached.Payload, d.inner)
+			if err == nil {
+				return uid, nil
+			}
+		}
+		logg.Error("cannot deserialize cached user identity: %s", err.Error())
+	}
+
+	//cache miss -> ask the actual driver, and only cache successful results
+	uid, rerr := d.inner.AuthenticateUser(userName, password)
+	if rerr != nil {
+		return nil, rerr
+	}
+	typeName, payload, err := uid.SerializeToJSON()
+	if err == nil {
+		buf, err = json.Marshal(cachedUserIdentity{typeName, payload})
+	}
+	if err == nil {
+		err = d.rc.Set(ctx, key, buf, d.ttl).Err()
+	}
+	if err != nil {
+		logg.Error("cannot cache user identity in Redis: %s", err.Error())
+	}
+	return uid, nil
+}
+
+// AuthenticateUserFromRequest implements the AuthDriver interface.
+func (d *cachingAuthDriver) AuthenticateUserFromRequest(r *http.Request) (UserIdentity, *RegistryV2Error) {
+	//if the inner driver handled Basic auth by itself, it would call its own
+	//AuthenticateUser() and thus bypass the cache
+	userName, password, ok := r.BasicAuth()
+	if ok {
+		return d.AuthenticateUser(userName, password)
+	}
+	return d.inner.AuthenticateUserFromRequest(r)
+}
@@ -0,0 +1,137 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/sapcc/go-bits/audittools"
+)
+
+// countingAuthDriver is an AuthDriver that counts calls to AuthenticateUser().
+type countingAuthDriver struct {
+	CallCount int
+}
+
+type countingUserIdentity struct {
+	Name string `json:"name"`
+}
+
+func init() {
+	RegisterUserIdentity("counting", func(in []byte, ad AuthDriver) (UserIdentity, error) {
+		if _, ok := ad.(*countingAuthDriver); !ok {
+			return nil, ErrAuthDriverMismatch
+		}
+		var uid countingUserIdentity
+		err := json.Unmarshal(in, &uid)
+		return uid, err
+	})
+}
+
+func (d *countingAuthDriver) DriverName() string                     { return "counting" }
+func (d *countingAuthDriver) ValidateTenantID(tenantID string) error { return nil }
+func (d *countingAuthDriver) AuthenticateUserFromRequest(r *http.Request) (UserIdentity, *RegistryV2Error) {
+	return nil, nil
+}
+func (d *countingAuthDriver) AuthenticateUser(userName, password string) (UserIdentity, *RegistryV2Error) {
+	d.CallCount++
+	if password != "secret" {
+		return nil, ErrUnauthorized.With("invalid username or password")
+	}
+	return countingUserIdentity{userName}, nil
+}
+
+func (uid countingUserIdentity) HasPermission(perm Permission, tenantID string) bool { return true }
+func (uid countingUserIdentity) UserType() UserType                                  { return RegularUser }
+func (uid countingUserIdentity) UserName() string                                    { return uid.Name }
+func (uid countingUserIdentity) UserInfo() audittools.UserInfo                       { return nil }
+func (uid countingUserIdentity) SerializeToJSON() (string, []byte, error) {
+	payload, err := json.Marshal(uid)
+	return "counting", payload, err
+}
+
+func TestAuthCache(t *testing.T) {
+	sr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: sr.Addr()})
+	inner := &countingAuthDriver{}
+	ad := WithAuthCache(inner, rc, time.Minute)
+
+	expectAuth := func(userName, password string, expectSuccess bool, expectedCallCount int) {
+		t.Helper()
+		uid, rerr := ad.AuthenticateUser(userName, password)
+		if expectSuccess {
+			if rerr != nil {
+				t.Errorf("expected authentication of %q to succeed, but got: %s", userName, rerr.Error())
+			} else if uid.UserName() != userName {
+				t.Errorf("expected user name %q, but got %q", userName, uid.UserName())
+			}
+		} else if rerr == nil {
+			t.Errorf("expected authentication of %q with password %q to fail, but it succeeded", userName, password)
+		}
+		if inner.CallCount != expectedCallCount {
+			t.Errorf("expected %d calls to the inner driver, but got %d", expectedCallCount, inner.CallCount)
+		}
+	}
+
+	//first login hits the inner driver, second login within TTL is served from cache
+	expectAuth("alice", "secret", true, 1)
+	expectAuth("alice", "secret", true, 1)
+	//different user or password is not served from the cache
+	expectAuth("bob", "secret", true, 2)
+	expectAuth("alice", "wrong", false, 3)
+	//failures are not cached
+	expectAuth("alice", "wrong", false, 4)
+	//after the TTL expires, the inner driver is asked again
+	sr.FastForward(2 * time.Minute)
+	expectAuth("alice", "secret", true, 5)
+	expectAuth("alice", "secret", true, 5)
+
+	//cache keys are scoped by driver name
+	for _, key := range sr.Keys() {
+		if !strings.HasPrefix(key, "keppel-auth-counting-") {
+			t.Errorf("unexpected cache key: %q", key)
+		}
+	}
+
+	//token payloads from the wrapped driver can be deserialized with the wrapper
+	uid, _ := ad.AuthenticateUser("alice", "secret")
+	typeName, payload, err := uid.SerializeToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = DeserializeUserIdentity(typeName, payload, ad)
+	if err != nil {
+		t.Errorf("expected deserialization through the wrapper to work, but got: %s", err.Error())
+	}
+}
+
+func TestAuthCacheWithoutRedis(t *testing.T) {
+	inner := &countingAuthDriver{}
+	ad := WithAuthCache(inner, nil, time.Minute)
+	if ad != AuthDriver(inner) {
+		t.Error("expected WithAuthCache to return the inner driver unchanged when Redis is not available")
+	}
+}
@@ -80,6 +80,17 @@ type AuthDriver interface {
 	AuthenticateUserFromRequest(r *http.Request) (UserIdentity, *RegistryV2Error)
 }
 
+// BearerTokenAuthDriver is an optional extension of the AuthDriver interface
+// for drivers that accept bearer tokens issued by an external identity
+// provider (e.g. an OpenID Connect provider). When a request carries a bearer
+// token in the "Authorization" header that was not issued by Keppel itself,
+// the token is given to AuthenticateUserFromBearerToken() instead of being
+// rejected.
+type BearerTokenAuthDriver interface {
+	AuthDriver
+	AuthenticateUserFromBearerToken(token string) (UserIdentity, *RegistryV2Error)
+}
+
 var authDriverFactories = make(map[string]func(*redis.Client) (AuthDriver, error))
 
 // NewAuthDriver creates a new AuthDriver using one of the factory functions
@@ -21,13 +21,17 @@ package keppel
 
 import (
 	"crypto"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v4"
@@ -48,6 +52,50 @@ type Configuration struct {
 	JWTIssuerKeys            []crypto.PrivateKey
 	AnycastJWTIssuerKeys     []crypto.PrivateKey
 	ClairClient              *clair.Client
+	//If not empty, the X-Forwarded-For header is only honored for requests coming from these networks.
+	TrustedProxyNetworks []net.IPNet
+	//How long the inbound cache remembers that a manifest does not exist upstream (0 = not at all).
+	InboundCacheNegativeTTL time.Duration
+	//How long sublease tokens issued by the federation driver remain valid (0 = indefinitely).
+	SubleaseTokenTTL time.Duration
+	//How many blobs can be fetched from upstream registries concurrently during
+	//replication (0 = unlimited).
+	MaxConcurrentUpstreamFetches int
+	//How peers authenticate with each other.
+	PeeringMode PeeringMode
+	//Only set in PeeringModeMTLS: The certificate that we present to our peers
+	//(both as client and server), and the transport that presents it.
+	PeeringCertificate *tls.Certificate
+	PeerTransport      http.RoundTripper
+	//If true, anonymous requests are always rejected, regardless of any RBAC
+	//policies granting anonymous access.
+	DisableAnonymousAccess bool
+	//Repositories whose names match any of these regexes cannot be created by
+	//pushing into them. Existing repositories are not affected.
+	ForbiddenRepoNamePatterns []*regexp.Regexp
+	//GC policies for new accounts that are created without specifying any GC
+	//policies.
+	DefaultGCPolicies []GCPolicy
+	//If true, a monolithic blob upload whose digest matches an existing blob in
+	//a different account of the same auth tenant reuses that blob's storage
+	//contents instead of writing them into the storage again.
+	EnableCrossAccountBlobDedup bool
+	//If not zero, updates of last_pulled_at caused by manifest pulls are
+	//collected in memory and written into the DB at most once per this interval
+	//(0 = every pull is written immediately).
+	LastPulledDebounceInterval time.Duration
+	//If true, manifest contents are stored in the DB in gzip-compressed form.
+	//Uncompressed contents are still accepted when reading.
+	CompressManifestContents bool
+	//If not zero, request bodies of manifest pushes (or blob uploads,
+	//respectively) that are larger than this many bytes are rejected with 413
+	//(0 = no limit beyond the per-account size limits).
+	MaxManifestBodySizeBytes uint64
+	MaxBlobBodySizeBytes     uint64
+	//If true, Keppel refuses all writes (see ReadOnlyMiddleware). This also
+	//suppresses the DB writes that would otherwise be caused by pulls, i.e.
+	//replication into replica accounts and recording of pull statistics.
+	ReadOnly bool
 }
 
 var (
@@ -86,6 +134,33 @@ func ParseIssuerKey(in string) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("neither an ed25519 private key (%q) nor an RSA private key (%q)", err1.Error(), err2.Error())
 }
 
+// ParseRepoNamePatterns parses the contents of the
+// KEPPEL_FORBIDDEN_REPO_NAME_PATTERNS variable, a whitespace-separated list of
+// regexes. Each regex must match the entire repository name (excluding the
+// account name).
+func ParseRepoNamePatterns(in string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range strings.Fields(in) {
+		rx, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		result = append(result, rx)
+	}
+	return result, nil
+}
+
+// CheckNewRepoName returns an error if a repository with the given name may not
+// be created because its name matches one of cfg.ForbiddenRepoNamePatterns.
+func (cfg Configuration) CheckNewRepoName(repoName string) *RegistryV2Error {
+	for _, rx := range cfg.ForbiddenRepoNamePatterns {
+		if rx.MatchString(repoName) {
+			return ErrNameInvalid.With("cannot create repository %q: name matches forbidden pattern %s", repoName, rx.String())
+		}
+	}
+	return nil
+}
+
 // ParseConfiguration obtains a keppel.Configuration instance from the
 // corresponding environment variables. Aborts on error.
 func ParseConfiguration() Configuration {
@@ -123,6 +198,73 @@ func ParseConfiguration() Configuration {
 		cfg.AnycastJWTIssuerKeys = parseIssuerKeys("KEPPEL_ANYCAST")
 	}
 
+	if cidrs := os.Getenv("KEPPEL_TRUSTED_PROXY_CIDRS"); cidrs != "" {
+		var err error
+		cfg.TrustedProxyNetworks, err = ParseCIDRList(cidrs)
+		if err != nil {
+			logg.Fatal("failed to read KEPPEL_TRUSTED_PROXY_CIDRS: %s", err.Error())
+		}
+	}
+
+	negativeTTL, err := time.ParseDuration(osext.GetenvOrDefault("KEPPEL_INBOUND_CACHE_NEGATIVE_TTL", "1m"))
+	if err != nil || negativeTTL < 0 {
+		logg.Fatal("malformed KEPPEL_INBOUND_CACHE_NEGATIVE_TTL: expected a non-negative duration like \"1m\"")
+	}
+	cfg.InboundCacheNegativeTTL = negativeTTL
+
+	subleaseTokenTTL, err := time.ParseDuration(osext.GetenvOrDefault("KEPPEL_SUBLEASE_TOKEN_TTL", "24h"))
+	if err != nil || subleaseTokenTTL <= 0 {
+		logg.Fatal("malformed KEPPEL_SUBLEASE_TOKEN_TTL: expected a positive duration like \"1h\"")
+	}
+	cfg.SubleaseTokenTTL = subleaseTokenTTL
+
+	lastPulledDebounceInterval, err := time.ParseDuration(osext.GetenvOrDefault("KEPPEL_LAST_PULLED_DEBOUNCE_INTERVAL", "0"))
+	if err != nil || lastPulledDebounceInterval < 0 {
+		logg.Fatal("malformed KEPPEL_LAST_PULLED_DEBOUNCE_INTERVAL: expected a non-negative duration like \"1m\"")
+	}
+	cfg.LastPulledDebounceInterval = lastPulledDebounceInterval
+
+	if maxFetchesStr := os.Getenv("KEPPEL_MAX_CONCURRENT_UPSTREAM_FETCHES"); maxFetchesStr != "" {
+		maxFetches, err := strconv.Atoi(maxFetchesStr)
+		if err != nil || maxFetches <= 0 {
+			logg.Fatal("malformed KEPPEL_MAX_CONCURRENT_UPSTREAM_FETCHES: expected a positive integer, but got %q", maxFetchesStr)
+		}
+		cfg.MaxConcurrentUpstreamFetches = maxFetches
+	}
+
+	cfg.MaxManifestBodySizeBytes = parseBodySizeLimit("KEPPEL_MAX_MANIFEST_BODY_SIZE_BYTES")
+	cfg.MaxBlobBodySizeBytes = parseBodySizeLimit("KEPPEL_MAX_BLOB_BODY_SIZE_BYTES")
+
+	cfg.DisableAnonymousAccess = osext.GetenvBool("KEPPEL_DISABLE_ANONYMOUS")
+	cfg.ReadOnly = osext.GetenvBool("KEPPEL_READONLY")
+	cfg.EnableCrossAccountBlobDedup = osext.GetenvBool("KEPPEL_ENABLE_CROSS_ACCOUNT_BLOB_DEDUP")
+	cfg.CompressManifestContents = osext.GetenvBool("KEPPEL_COMPRESS_MANIFEST_CONTENTS")
+
+	cfg.ForbiddenRepoNamePatterns, err = ParseRepoNamePatterns(os.Getenv("KEPPEL_FORBIDDEN_REPO_NAME_PATTERNS"))
+	if err != nil {
+		logg.Fatal("malformed KEPPEL_FORBIDDEN_REPO_NAME_PATTERNS: %s", err.Error())
+	}
+
+	if policiesStr := os.Getenv("KEPPEL_DEFAULT_GC_POLICIES"); policiesStr != "" {
+		cfg.DefaultGCPolicies, err = ParseGCPolicyList(policiesStr)
+		if err != nil {
+			logg.Fatal("malformed KEPPEL_DEFAULT_GC_POLICIES: %s", err.Error())
+		}
+	}
+
+	cfg.PeeringMode = PeeringMode(osext.GetenvOrDefault("KEPPEL_PEERING_MODE", string(PeeringModePassword)))
+	if !cfg.PeeringMode.IsValid() {
+		logg.Fatal("malformed KEPPEL_PEERING_MODE: expected %q or %q, but got %q", PeeringModePassword, PeeringModeMTLS, cfg.PeeringMode)
+	}
+	if cfg.PeeringMode == PeeringModeMTLS {
+		cert, err := tls.LoadX509KeyPair(osext.MustGetenv("KEPPEL_PEERING_CERT_PATH"), osext.MustGetenv("KEPPEL_PEERING_KEY_PATH"))
+		if err != nil {
+			logg.Fatal("failed to read peering certificate: " + err.Error())
+		}
+		cfg.PeeringCertificate = &cert
+		cfg.PeerTransport = NewPeerTransport(cert)
+	}
+
 	clairURL := mayGetenvURL("KEPPEL_CLAIR_URL")
 	if clairURL != nil {
 		//Clair does a base64 decode of the key given in its configuration; I find
@@ -132,9 +274,29 @@ func ParseConfiguration() Configuration {
 		if err != nil {
 			logg.Fatal("failed to read KEPPEL_CLAIR_PRESHARED_KEY: " + err.Error())
 		}
+		timeout, err := time.ParseDuration(osext.GetenvOrDefault("KEPPEL_CLAIR_TIMEOUT", "1m"))
+		if err != nil || timeout <= 0 {
+			logg.Fatal("malformed KEPPEL_CLAIR_TIMEOUT: expected a positive duration like \"1m\"")
+		}
+		maxRetries, err := strconv.Atoi(osext.GetenvOrDefault("KEPPEL_CLAIR_MAX_RETRIES", "3"))
+		if err != nil || maxRetries < 0 {
+			logg.Fatal("malformed KEPPEL_CLAIR_MAX_RETRIES: expected a non-negative integer")
+		}
+		httpClient, err := clair.NewHTTPClient(clair.HTTPClientOptions{
+			Timeout:        timeout,
+			CACertPath:     os.Getenv("KEPPEL_CLAIR_CA_CERT_PATH"),
+			ClientCertPath: os.Getenv("KEPPEL_CLAIR_CLIENT_CERT_PATH"),
+			ClientKeyPath:  os.Getenv("KEPPEL_CLAIR_CLIENT_KEY_PATH"),
+		})
+		if err != nil {
+			logg.Fatal("failed to setup HTTP client for Clair: " + err.Error())
+		}
 		cfg.ClairClient = &clair.Client{
 			BaseURL:      *clairURL,
 			PresharedKey: key,
+			HTTPClient:   httpClient,
+			MaxRetries:   maxRetries,
+			RetryBackoff: 1 * time.Second,
 		}
 	}
 
@@ -177,3 +339,28 @@ func GetRedisOptions(prefix string) (*redis.Options, error) {
 		DB:       db,
 	}, nil
 }
+
+// InitRedis connects to the Redis configured by the KEPPEL_REDIS_* variables,
+// or returns nil if KEPPEL_REDIS_ENABLE is not set.
+func InitRedis() (*redis.Client, error) {
+	if !osext.GetenvBool("KEPPEL_REDIS_ENABLE") {
+		return nil, nil
+	}
+	opts, err := GetRedisOptions("KEPPEL")
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse Redis URL: %s", err.Error())
+	}
+	return redis.NewClient(opts), nil
+}
+
+func parseBodySizeLimit(key string) uint64 {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return 0
+	}
+	value, err := strconv.ParseUint(valueStr, 10, 63)
+	if err != nil {
+		logg.Fatal("malformed %s: expected a non-negative integer, but got %q", key, valueStr)
+	}
+	return value
+}
@@ -0,0 +1,77 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import "testing"
+
+func TestParseRepoNamePatterns(t *testing.T) {
+	cfg := Configuration{}
+	var err error
+	cfg.ForbiddenRepoNamePatterns, err = ParseRepoNamePatterns("  internal/.*\ttmp  ")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := map[string]bool{
+		"internal/foo":   true,
+		"internal/a/b":   true,
+		"tmp":            true,
+		"foo":            false,
+		"foo/internal/x": false, //patterns must match the whole name
+		"tmp/foo":        false,
+	}
+	for repoName, expectForbidden := range testCases {
+		rerr := cfg.CheckNewRepoName(repoName)
+		if expectForbidden && rerr == nil {
+			t.Errorf("expected repo name %q to be forbidden, but it is allowed", repoName)
+		}
+		if !expectForbidden && rerr != nil {
+			t.Errorf("expected repo name %q to be allowed, but got: %s", repoName, rerr.Error())
+		}
+	}
+
+	//malformed regexes are rejected at load time
+	_, err = ParseRepoNamePatterns("foo (bar")
+	if err == nil {
+		t.Error("expected malformed pattern to be rejected, but it was accepted")
+	}
+}
+
+func TestParseGCPolicyList(t *testing.T) {
+	policies, err := ParseGCPolicyList(`[{"match_repository":".*","only_untagged":true,"action":"delete"}]`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(policies) != 1 || policies[0].Action != "delete" || !policies[0].OnlyUntagged {
+		t.Errorf("unexpected result: %#v", policies)
+	}
+
+	//malformed and invalid policies are rejected at load time
+	for _, input := range []string{
+		`{"match_repository":".*","action":"delete"}`,
+		`[{"match_repository":".*","action":"delete","unknown_field":true}]`,
+		`[{"match_repository":".*","action":"explode"}]`,
+		`[{"action":"delete"}]`,
+	} {
+		_, err := ParseGCPolicyList(input)
+		if err == nil {
+			t.Errorf("expected %s to be rejected, but it was accepted", input)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/rs/cors"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// ParseCORSOptions builds the CORS policy for keppel-api from the
+// KEPPEL_CORS_* environment variables. Each variable that is not set falls
+// back to the permissive defaults that keppel-api has always used.
+func ParseCORSOptions() (cors.Options, error) {
+	opts := cors.Options{
+		AllowedOrigins:   getenvList("KEPPEL_CORS_ALLOWED_ORIGINS", []string{"*"}),
+		AllowedMethods:   getenvList("KEPPEL_CORS_ALLOWED_METHODS", []string{"HEAD", "GET", "POST", "PUT", "DELETE"}),
+		AllowedHeaders:   getenvList("KEPPEL_CORS_ALLOWED_HEADERS", []string{"Content-Type", "User-Agent", "Authorization", "X-Auth-Token", "X-Keppel-Sublease-Token", RequestIDHeader}),
+		AllowCredentials: osext.GetenvBool("KEPPEL_CORS_ALLOW_CREDENTIALS"),
+	}
+
+	//with credentials, a wildcard origin would allow any website to make
+	//authenticated requests on behalf of the user (rs/cors would reflect the
+	//requesting origin instead of sending "*")
+	if opts.AllowCredentials {
+		for _, origin := range opts.AllowedOrigins {
+			if origin == "*" {
+				return cors.Options{}, errors.New("KEPPEL_CORS_ALLOW_CREDENTIALS cannot be combined with a wildcard origin in KEPPEL_CORS_ALLOWED_ORIGINS")
+			}
+		}
+	}
+	return opts, nil
+}
+
+// Parses a comma-separated list from the given environment variable, or
+// returns the default if the variable is empty.
+func getenvList(key string, defaultValue []string) []string {
+	var result []string
+	for _, field := range strings.Split(os.Getenv(key), ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			result = append(result, field)
+		}
+	}
+	if len(result) == 0 {
+		return defaultValue
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/cors"
+)
+
+func TestCORSOptions(t *testing.T) {
+	testCases := []struct {
+		Origins           string
+		AllowCredentials  string
+		RequestOrigin     string
+		ExpectedOrigin    string
+		ExpectCredentials bool
+	}{
+		//default: any origin is allowed, without credentials
+		{"", "", "https://example.com", "*", false},
+		//explicit origins are reflected only if they match
+		{"https://ui.example.com, https://other.example.com", "", "https://ui.example.com", "https://ui.example.com", false},
+		{"https://ui.example.com,https://other.example.com", "", "https://evil.example.org", "", false},
+		//credentials are allowed with explicit origins
+		{"https://ui.example.com", "true", "https://ui.example.com", "https://ui.example.com", true},
+		{"https://ui.example.com", "true", "https://evil.example.org", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Setenv("KEPPEL_CORS_ALLOWED_ORIGINS", tc.Origins)
+		t.Setenv("KEPPEL_CORS_ALLOW_CREDENTIALS", tc.AllowCredentials)
+		opts, err := ParseCORSOptions()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		h := cors.New(opts).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		//check both a simple request and a preflight request
+		for _, method := range []string{http.MethodGet, http.MethodOptions} {
+			r := httptest.NewRequest(method, "/keppel/v1/accounts", http.NoBody)
+			r.Header.Set("Origin", tc.RequestOrigin)
+			if method == http.MethodOptions {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+				r.Header.Set("Access-Control-Request-Headers", "Authorization, X-Keppel-Request-Id")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			actualOrigin := w.Header().Get("Access-Control-Allow-Origin")
+			if actualOrigin != tc.ExpectedOrigin {
+				t.Errorf("with origins %q, expected %s from %q to yield Access-Control-Allow-Origin %q, but got %q",
+					tc.Origins, method, tc.RequestOrigin, tc.ExpectedOrigin, actualOrigin)
+			}
+			actualCredentials := w.Header().Get("Access-Control-Allow-Credentials") == "true"
+			if actualCredentials != tc.ExpectCredentials {
+				t.Errorf("with origins %q, expected %s from %q to yield Access-Control-Allow-Credentials = %t, but got %t",
+					tc.Origins, method, tc.RequestOrigin, tc.ExpectCredentials, actualCredentials)
+			}
+		}
+	}
+}
+
+func TestCORSOptionsCustomMethodsAndHeaders(t *testing.T) {
+	t.Setenv("KEPPEL_CORS_ALLOWED_METHODS", "GET, HEAD")
+	t.Setenv("KEPPEL_CORS_ALLOWED_HEADERS", "Authorization")
+	opts, err := ParseCORSOptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h := cors.New(opts).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	testCases := []struct {
+		Method        string
+		Headers       string
+		ExpectAllowed bool
+	}{
+		{http.MethodGet, "Authorization", true},
+		{http.MethodPut, "Authorization", false},
+		{http.MethodGet, "X-Auth-Token", false},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodOptions, "/v2/", http.NoBody)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", tc.Method)
+		r.Header.Set("Access-Control-Request-Headers", tc.Headers)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		isAllowed := w.Header().Get("Access-Control-Allow-Origin") != ""
+		if isAllowed != tc.ExpectAllowed {
+			t.Errorf("expected preflight for %s with headers %q to be allowed = %t, but got %t", tc.Method, tc.Headers, tc.ExpectAllowed, isAllowed)
+		}
+	}
+}
+
+func TestCORSOptionsRejectCredentialsWithWildcard(t *testing.T) {
+	for _, origins := range []string{"", "*", "https://ui.example.com,*"} {
+		t.Setenv("KEPPEL_CORS_ALLOWED_ORIGINS", origins)
+		t.Setenv("KEPPEL_CORS_ALLOW_CREDENTIALS", "true")
+		_, err := ParseCORSOptions()
+		if err == nil {
+			t.Errorf("expected error for credentials with origins %q, but got none", origins)
+		}
+	}
+}
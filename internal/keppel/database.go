@@ -20,9 +20,15 @@
 package keppel
 
 import (
+	"database/sql"
+	"fmt"
 	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/osext"
 	gorp "gopkg.in/gorp.v2"
 )
 
@@ -478,6 +484,177 @@ var sqlMigrations = map[string]string{
 		ALTER TABLE blobs
 			DROP COLUMN blocks_vuln_scanning ;
 `,
+	"031_add_rbac_policies_match_group.up.sql": `
+		ALTER TABLE rbac_policies
+			DROP CONSTRAINT rbac_policies_pkey;
+		ALTER TABLE rbac_policies
+			ADD COLUMN match_group TEXT NOT NULL DEFAULT '';
+		ALTER TABLE rbac_policies
+			ADD PRIMARY KEY (account_name, match_cidr, match_repository, match_username, match_group);
+	`,
+	"031_add_rbac_policies_match_group.down.sql": `
+		ALTER TABLE rbac_policies
+			DROP CONSTRAINT rbac_policies_pkey;
+		ALTER TABLE rbac_policies
+			DROP COLUMN match_group;
+		ALTER TABLE rbac_policies
+			ADD PRIMARY KEY (account_name, match_cidr, match_repository, match_username);
+	`,
+	"032_add_quotas_storage_bytes.up.sql": `
+		ALTER TABLE quotas
+			ADD COLUMN storage_bytes BIGINT DEFAULT NULL;
+	`,
+	"032_add_quotas_storage_bytes.down.sql": `
+		ALTER TABLE quotas
+			DROP COLUMN storage_bytes;
+	`,
+	"033_add_deleted_manifests.up.sql": `
+		ALTER TABLE accounts
+			ADD COLUMN manifest_retention_secs BIGINT NOT NULL DEFAULT 0;
+		CREATE TABLE deleted_manifests (
+			repo_id     BIGINT      NOT NULL REFERENCES repos ON DELETE CASCADE,
+			digest      TEXT        NOT NULL,
+			media_type  TEXT        NOT NULL,
+			size_bytes  BIGINT      NOT NULL,
+			content     BYTEA       NOT NULL,
+			deleted_at  TIMESTAMPTZ NOT NULL,
+			purge_after TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (repo_id, digest)
+		);
+		CREATE TABLE deleted_manifest_blob_refs (
+			repo_id BIGINT NOT NULL,
+			digest  TEXT   NOT NULL,
+			blob_id BIGINT NOT NULL REFERENCES blobs ON DELETE RESTRICT,
+			FOREIGN KEY (repo_id, digest) REFERENCES deleted_manifests ON DELETE CASCADE,
+			PRIMARY KEY (repo_id, digest, blob_id)
+		);
+	`,
+	"033_add_deleted_manifests.down.sql": `
+		DROP TABLE deleted_manifest_blob_refs;
+		DROP TABLE deleted_manifests;
+		ALTER TABLE accounts
+			DROP COLUMN manifest_retention_secs;
+	`,
+	"034_add_manifest_translations.up.sql": `
+		CREATE TABLE manifest_translations (
+			repo_id       BIGINT NOT NULL,
+			source_digest TEXT   NOT NULL,
+			target_digest TEXT   NOT NULL,
+			media_type    TEXT   NOT NULL,
+			content       BYTEA  NOT NULL,
+			FOREIGN KEY (repo_id, source_digest) REFERENCES manifests ON DELETE CASCADE,
+			PRIMARY KEY (repo_id, source_digest, media_type),
+			UNIQUE (repo_id, target_digest)
+		);
+	`,
+	"034_add_manifest_translations.down.sql": `
+		DROP TABLE manifest_translations;
+	`,
+	"035_add_accounts_immutable_tag_pattern.up.sql": `
+		ALTER TABLE accounts ADD COLUMN immutable_tag_pattern TEXT NOT NULL DEFAULT '';
+	`,
+	"035_add_accounts_immutable_tag_pattern.down.sql": `
+		ALTER TABLE accounts DROP COLUMN immutable_tag_pattern;
+	`,
+	"036_add_accounts_max_manifest_size_bytes.up.sql": `
+		ALTER TABLE accounts ADD COLUMN max_manifest_size_bytes BIGINT NOT NULL DEFAULT 0;
+	`,
+	"036_add_accounts_max_manifest_size_bytes.down.sql": `
+		ALTER TABLE accounts DROP COLUMN max_manifest_size_bytes;
+	`,
+	"037_add_peers_their_cert_fingerprint.up.sql": `
+		ALTER TABLE peers ADD COLUMN their_cert_fingerprint TEXT NOT NULL DEFAULT '';
+	`,
+	"037_add_peers_their_cert_fingerprint.down.sql": `
+		ALTER TABLE peers DROP COLUMN their_cert_fingerprint;
+	`,
+	"038_add_peers_backoff.up.sql": `
+		ALTER TABLE peers
+			ADD COLUMN consecutive_peering_failures INT NOT NULL DEFAULT 0,
+			ADD COLUMN next_peering_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"038_add_peers_backoff.down.sql": `
+		ALTER TABLE peers
+			DROP COLUMN consecutive_peering_failures,
+			DROP COLUMN next_peering_at;
+	`,
+	"039_add_repos_next_size_check_at.up.sql": `
+		ALTER TABLE repos ADD COLUMN next_size_check_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"039_add_repos_next_size_check_at.down.sql": `
+		ALTER TABLE repos DROP COLUMN next_size_check_at;
+	`,
+	"040_add_manifests_subject_digest.up.sql": `
+		ALTER TABLE manifests ADD COLUMN subject_digest TEXT NOT NULL DEFAULT '';
+		ALTER TABLE manifests ADD COLUMN artifact_type TEXT NOT NULL DEFAULT '';
+		CREATE INDEX manifests_subject_digest_idx ON manifests (repo_id, subject_digest) WHERE subject_digest != '';
+	`,
+	"040_add_manifests_subject_digest.down.sql": `
+		DROP INDEX manifests_subject_digest_idx;
+		ALTER TABLE manifests DROP COLUMN subject_digest;
+		ALTER TABLE manifests DROP COLUMN artifact_type;
+	`,
+	"041_add_accounts_vuln_policy_json.up.sql": `
+		ALTER TABLE accounts ADD COLUMN vuln_policy_json TEXT NOT NULL DEFAULT '';
+	`,
+	"041_add_accounts_vuln_policy_json.down.sql": `
+		ALTER TABLE accounts DROP COLUMN vuln_policy_json;
+	`,
+	"042_add_accounts_manifest_limit.up.sql": `
+		ALTER TABLE accounts ADD COLUMN manifest_limit BIGINT NOT NULL DEFAULT 0;
+	`,
+	"042_add_accounts_manifest_limit.down.sql": `
+		ALTER TABLE accounts DROP COLUMN manifest_limit;
+	`,
+	"043_add_manifest_pull_stats.up.sql": `
+		CREATE TABLE manifest_pull_stats (
+			repo_id BIGINT NOT NULL REFERENCES repos ON DELETE CASCADE,
+			digest  TEXT   NOT NULL,
+			day     DATE   NOT NULL,
+			count   BIGINT NOT NULL,
+			PRIMARY KEY (repo_id, digest, day)
+		);
+		CREATE INDEX manifest_pull_stats_day_idx ON manifest_pull_stats (day);
+	`,
+	"043_add_manifest_pull_stats.down.sql": `
+		DROP TABLE manifest_pull_stats;
+	`,
+	"044_add_accounts_custom_manifest_media_types.up.sql": `
+		ALTER TABLE accounts ADD COLUMN custom_manifest_media_types TEXT NOT NULL DEFAULT '';
+	`,
+	"044_add_accounts_custom_manifest_media_types.down.sql": `
+		ALTER TABLE accounts DROP COLUMN custom_manifest_media_types;
+	`,
+	"045_add_accounts_signature_policy_json.up.sql": `
+		ALTER TABLE accounts ADD COLUMN signature_policy_json TEXT NOT NULL DEFAULT '';
+	`,
+	"045_add_accounts_signature_policy_json.down.sql": `
+		ALTER TABLE accounts DROP COLUMN signature_policy_json;
+	`,
+	"046_add_accounts_max_blob_size_bytes.up.sql": `
+		ALTER TABLE accounts ADD COLUMN max_blob_size_bytes BIGINT NOT NULL DEFAULT 0;
+	`,
+	"046_add_accounts_max_blob_size_bytes.down.sql": `
+		ALTER TABLE accounts DROP COLUMN max_blob_size_bytes;
+	`,
+	"047_add_repos_metadata_json.up.sql": `
+		ALTER TABLE repos ADD COLUMN metadata_json TEXT NOT NULL DEFAULT '';
+	`,
+	"047_add_repos_metadata_json.down.sql": `
+		ALTER TABLE repos DROP COLUMN metadata_json;
+	`,
+	"048_add_blobs_storage_account_name.up.sql": `
+		ALTER TABLE blobs ADD COLUMN storage_account_name TEXT NOT NULL DEFAULT '';
+	`,
+	"048_add_blobs_storage_account_name.down.sql": `
+		ALTER TABLE blobs DROP COLUMN storage_account_name;
+	`,
+	"049_add_accounts_replication_repo_allowlist_json.up.sql": `
+		ALTER TABLE accounts ADD COLUMN replication_repo_allowlist_json TEXT NOT NULL DEFAULT '';
+	`,
+	"049_add_accounts_replication_repo_allowlist_json.down.sql": `
+		ALTER TABLE accounts DROP COLUMN replication_repo_allowlist_json;
+	`,
 }
 
 // DB adds convenience functions on top of gorp.DbMap.
@@ -493,8 +670,66 @@ func (db *DB) SelectBool(query string, args ...interface{}) (bool, error) {
 	return result, err
 }
 
-// InitDB connects to the Postgres database.
+// DBPoolOptions contains the sizing parameters for the DB connection pool.
+type DBPoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration //0 = unlimited
+}
+
+// ParseDBPoolOptions reads the DB connection pool sizing from the environment
+// variables KEPPEL_DB_MAX_CONNECTIONS, KEPPEL_DB_MAX_IDLE_CONNECTIONS and
+// KEPPEL_DB_CONNECTION_MAX_LIFETIME.
+//
+// The default of 16 open connections is chosen such that this process does not
+// starve other Keppel processes for DB connections: Postgres only allows a
+// limited number of connections in total (100 by default), and that budget is
+// shared by all keppel-api and keppel-janitor replicas. When raising this limit
+// on large deployments, make sure that the sum over all replicas still fits
+// into the server's max_connections.
+func ParseDBPoolOptions() (DBPoolOptions, error) {
+	var (
+		opts DBPoolOptions
+		err  error
+	)
+	opts.MaxOpenConns, err = strconv.Atoi(osext.GetenvOrDefault("KEPPEL_DB_MAX_CONNECTIONS", "16"))
+	if err != nil || opts.MaxOpenConns < 1 {
+		return DBPoolOptions{}, fmt.Errorf("malformed KEPPEL_DB_MAX_CONNECTIONS: expected a positive integer, but got %q", os.Getenv("KEPPEL_DB_MAX_CONNECTIONS"))
+	}
+
+	//the default matches the default of database/sql
+	opts.MaxIdleConns, err = strconv.Atoi(osext.GetenvOrDefault("KEPPEL_DB_MAX_IDLE_CONNECTIONS", "2"))
+	if err != nil || opts.MaxIdleConns < 0 {
+		return DBPoolOptions{}, fmt.Errorf("malformed KEPPEL_DB_MAX_IDLE_CONNECTIONS: expected a non-negative integer, but got %q", os.Getenv("KEPPEL_DB_MAX_IDLE_CONNECTIONS"))
+	}
+	if opts.MaxIdleConns > opts.MaxOpenConns {
+		//database/sql would silently reduce MaxIdleConns, but this is most likely a configuration mistake
+		return DBPoolOptions{}, fmt.Errorf("KEPPEL_DB_MAX_IDLE_CONNECTIONS (%d) may not be larger than KEPPEL_DB_MAX_CONNECTIONS (%d)",
+			opts.MaxIdleConns, opts.MaxOpenConns)
+	}
+
+	opts.ConnMaxLifetime, err = time.ParseDuration(osext.GetenvOrDefault("KEPPEL_DB_CONNECTION_MAX_LIFETIME", "0s"))
+	if err != nil || opts.ConnMaxLifetime < 0 {
+		return DBPoolOptions{}, fmt.Errorf("malformed KEPPEL_DB_CONNECTION_MAX_LIFETIME: expected a non-negative duration like \"30m\", but got %q", os.Getenv("KEPPEL_DB_CONNECTION_MAX_LIFETIME"))
+	}
+
+	return opts, nil
+}
+
+func (opts DBPoolOptions) applyTo(db *sql.DB) {
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+}
+
+// InitDB connects to the Postgres database. The connection pool is sized
+// according to ParseDBPoolOptions().
 func InitDB(dbURL *url.URL) (*DB, error) {
+	poolOpts, err := ParseDBPoolOptions()
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := easypg.Connect(easypg.Configuration{
 		PostgresURL: dbURL,
 		Migrations:  sqlMigrations,
@@ -502,8 +737,7 @@ func InitDB(dbURL *url.URL) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	//ensure that this process does not starve other Keppel processes for DB connections
-	db.SetMaxOpenConns(16)
+	poolOpts.applyTo(db)
 
 	result := &DB{DbMap: gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}}
 	initModels(&result.DbMap)
@@ -0,0 +1,83 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestParseDBPoolOptions(t *testing.T) {
+	//defaults
+	opts, err := ParseDBPoolOptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := DBPoolOptions{MaxOpenConns: 16, MaxIdleConns: 2, ConnMaxLifetime: 0}
+	if opts != expected {
+		t.Errorf("expected default options %#v, but got %#v", expected, opts)
+	}
+
+	//overrides
+	t.Setenv("KEPPEL_DB_MAX_CONNECTIONS", "50")
+	t.Setenv("KEPPEL_DB_MAX_IDLE_CONNECTIONS", "10")
+	t.Setenv("KEPPEL_DB_CONNECTION_MAX_LIFETIME", "30m")
+	opts, err = ParseDBPoolOptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected = DBPoolOptions{MaxOpenConns: 50, MaxIdleConns: 10, ConnMaxLifetime: 30 * time.Minute}
+	if opts != expected {
+		t.Errorf("expected options %#v, but got %#v", expected, opts)
+	}
+
+	//the options are applied to the connection pool (sql.Open() does not
+	//connect yet, so this works without a database server)
+	db, err := sql.Open("postgres", "postgres://localhost/keppel")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	opts.applyTo(db)
+	if actual := db.Stats().MaxOpenConnections; actual != 50 {
+		t.Errorf("expected MaxOpenConnections = 50, but got %d", actual)
+	}
+
+	//nonsense values are rejected
+	testCases := []map[string]string{
+		{"KEPPEL_DB_MAX_CONNECTIONS": "0"},
+		{"KEPPEL_DB_MAX_CONNECTIONS": "lots"},
+		{"KEPPEL_DB_MAX_IDLE_CONNECTIONS": "-1"},
+		{"KEPPEL_DB_MAX_IDLE_CONNECTIONS": "100"},
+		{"KEPPEL_DB_CONNECTION_MAX_LIFETIME": "-5m"},
+		{"KEPPEL_DB_CONNECTION_MAX_LIFETIME": "forever"},
+	}
+	for _, tc := range testCases {
+		t.Run("", func(t *testing.T) {
+			for k, v := range tc {
+				t.Setenv(k, v)
+			}
+			_, err := ParseDBPoolOptions()
+			if err == nil {
+				t.Errorf("expected error for %v, but got none", tc)
+			}
+		})
+	}
+}
@@ -19,6 +19,8 @@
 package keppel
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 )
@@ -63,6 +65,11 @@ type FederationDriver interface {
 	//Keppels can use to verify that the caller is allowed to create a replica
 	//account for this primary account.
 	//
+	//Implementations shall only store a hash of the token secret (see
+	//HashSubleaseTokenSecret), and shall reject the token in ClaimAccountName
+	//once it has been used, or once Configuration.SubleaseTokenTTL has passed
+	//since it was issued.
+	//
 	//Sublease tokens are optional. If ClaimAccountName does not inspect its
 	//`subleaseTokenSecret` parameter, this method shall return ("", nil).
 	IssueSubleaseTokenSecret(account Account) (string, error)
@@ -89,6 +96,15 @@ type FederationDriver interface {
 	FindPrimaryAccount(accountName string) (peerHostName string, err error)
 }
 
+// HashSubleaseTokenSecret computes the representation of a sublease token
+// secret that a FederationDriver stores in its shared storage. Only storing the
+// hash ensures that issued tokens cannot be taken from the storage and
+// replayed.
+func HashSubleaseTokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
 var federationDriverFactories = make(map[string]func(AuthDriver, Configuration) (FederationDriver, error))
 
 // NewFederationDriver creates a new FederationDriver using one of the factory
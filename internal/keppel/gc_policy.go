@@ -37,6 +37,7 @@ type GCPolicy struct {
 	NegativeTagPattern        string            `json:"except_tag,omitempty"`
 	OnlyUntagged              bool              `json:"only_untagged,omitempty"`
 	TimeConstraint            *GCTimeConstraint `json:"time_constraint,omitempty"`
+	TagRetention              *GCTagRetention   `json:"tag_retention,omitempty"`
 	Action                    string            `json:"action"`
 
 	//cache for pre-compiled regexes, as an optimization for repeated calls to MatchesTags()
@@ -53,6 +54,15 @@ type GCTimeConstraint struct {
 	MaxAge      Duration `json:"newer_than,omitempty"`
 }
 
+// GCTagRetention appears in type GCPolicy. It is only used by policies with
+// action "retain_tags".
+type GCTagRetention struct {
+	//how many of the matching tags to keep (ordered by pushed_at, newest first)
+	NewestCount uint64 `json:"newest"`
+	//if non-zero, matching tags that have been pulled within this duration are kept as well
+	ProtectPulledWithin Duration `json:"protect_pulled_within,omitempty"`
+}
+
 // MatchesRepository evaluates the repository regexes in this policy.
 func (g GCPolicy) MatchesRepository(repoName string) bool {
 	//Notes:
@@ -140,6 +150,13 @@ func (g GCPolicy) MatchesTimeConstraint(manifest Manifest, allManifestsInRepo []
 			}
 			return *m.LastPulledAt
 		}
+	case "last_pulled_or_pushed_at":
+		getTime = func(m Manifest) time.Time {
+			if m.LastPulledAt == nil {
+				return m.PushedAt
+			}
+			return *m.LastPulledAt
+		}
 	default:
 		panic(fmt.Sprintf("unexpected GC policy time constraint target: %q (why was this not caught by Validate!?)", tc.FieldName))
 	}
@@ -214,6 +231,23 @@ func (g GCPolicy) Validate() error {
 		}
 	}
 
+	if g.Action == "retain_tags" {
+		if g.OnlyUntagged {
+			return fmt.Errorf(`GC policy with action %q cannot set the "only_untagged" attribute`, g.Action)
+		}
+		if g.TimeConstraint != nil {
+			return fmt.Errorf(`GC policy with action %q cannot set the "time_constraint" attribute`, g.Action)
+		}
+		if g.TagRetention == nil {
+			return fmt.Errorf(`GC policy with action %q must have the "tag_retention" attribute`, g.Action)
+		}
+		if g.TagRetention.NewestCount == 0 {
+			return errors.New(`GC policy tag retention must have the "newest" attribute`)
+		}
+	} else if g.TagRetention != nil {
+		return fmt.Errorf(`GC policy with action %q cannot set the "tag_retention" attribute`, g.Action)
+	}
+
 	if g.TimeConstraint != nil {
 		tc := *g.TimeConstraint
 		var tcFilledFields []string
@@ -239,7 +273,7 @@ func (g GCPolicy) Validate() error {
 		switch tc.FieldName {
 		case "":
 			return errors.New(`GC policy time constraint must have the "on" attribute`)
-		case "last_pulled_at", "pushed_at":
+		case "last_pulled_at", "last_pulled_or_pushed_at", "pushed_at":
 			if len(tcFilledFields) == 0 {
 				return fmt.Errorf(`GC policy time constraint needs to set at least one attribute other than "on"`)
 			}
@@ -249,10 +283,16 @@ func (g GCPolicy) Validate() error {
 		default:
 			return fmt.Errorf(`%q is not a valid target for a GC policy time constraint`, tc.FieldName)
 		}
+
+		//this time constraint is intended for cleaning up images that are not used
+		//anymore, so tagged images must never be deleted by it
+		if tc.FieldName == "last_pulled_or_pushed_at" && g.Action == "delete" && !g.OnlyUntagged {
+			return fmt.Errorf(`GC policy with action %q and time constraint on %q must set the "only_untagged" attribute`, g.Action, tc.FieldName)
+		}
 	}
 
 	switch g.Action {
-	case "delete", "protect":
+	case "delete", "protect", "retain_tags":
 		//valid
 		return nil
 	case "":
@@ -272,6 +312,24 @@ func (a Account) ParseGCPolicies() ([]GCPolicy, error) {
 	return policies, err
 }
 
+// ParseGCPolicyList parses and validates a JSON array of GC policies.
+func ParseGCPolicyList(in string) ([]GCPolicy, error) {
+	var policies []GCPolicy
+	decoder := json.NewDecoder(strings.NewReader(in))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&policies)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		err := policy.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
 // GCStatus documents the current status of a manifest with regard to image GC.
 // It is stored in serialized form in the GCStatusJSON field of type Manifest.
 //
@@ -290,6 +348,12 @@ type GCStatus struct {
 	//If the image is not protected, contains all policies with action "delete"
 	//that could delete this image in the future.
 	RelevantPolicies []GCPolicy `json:"relevant_policies,omitempty"`
+	//Only filled by dry runs: If the image would have been deleted, contains
+	//the definition of the policy that would have deleted it.
+	WouldBeDeletedByPolicy *GCPolicy `json:"would_be_deleted_by_policy,omitempty"`
+	//Only filled by dry runs: Contains the names of the tags of this image
+	//that would have been deleted by a policy with action "retain_tags".
+	WouldDeleteTags []string `json:"would_delete_tags,omitempty"`
 }
 
 // IsProtected returns whether any of the ProtectedBy... fields is filled.
@@ -22,6 +22,8 @@ package keppel
 import (
 	"errors"
 	"time"
+
+	"github.com/go-redis/redis/v8"
 )
 
 // InboundCacheDriver is the abstract interface for a caching strategy for
@@ -29,32 +31,51 @@ import (
 type InboundCacheDriver interface {
 	//LoadManifest pulls a manifest from the cache. If the given manifest is not
 	//cached, or if the cache entry has expired, sql.ErrNoRows shall be returned.
+	//If the cache contains an unexpired negative entry for the given manifest
+	//(see StoreManifestNotFound), ErrManifestNotFoundUpstream shall be returned.
 	//
 	//time.Now() is given in the second argument to allow for tests to use an
 	//artificial wall clock.
 	LoadManifest(location ImageReference, now time.Time) (contents []byte, mediaType string, err error)
-	//StoreManifest places a manifest in the cache for later retrieval.
+	//StoreManifest places a manifest in the cache for later retrieval. This
+	//replaces any negative entry for the same location.
 	//
 	//time.Now() is given in the last argument to allow for tests to use an
 	//artificial wall clock.
 	StoreManifest(location ImageReference, contents []byte, mediaType string, now time.Time) error
+	//StoreManifestNotFound places a negative entry in the cache, to remember
+	//that the given manifest does not exist in the external registry. The entry
+	//shall expire after the given TTL. Drivers that do not cache anything may
+	//implement this as a no-op.
+	//
+	//time.Now() is given in the second argument to allow for tests to use an
+	//artificial wall clock.
+	StoreManifestNotFound(location ImageReference, now time.Time, ttl time.Duration) error
 }
 
-var inboundCacheDriverFactories = make(map[string]func(Configuration) (InboundCacheDriver, error))
+// ErrManifestNotFoundUpstream is returned by InboundCacheDriver.LoadManifest()
+// when the cache remembers that the requested manifest does not exist in the
+// external registry.
+var ErrManifestNotFoundUpstream = errors.New("manifest not found in external registry (cached result)")
+
+var inboundCacheDriverFactories = make(map[string]func(Configuration, *redis.Client) (InboundCacheDriver, error))
 
 // NewInboundCacheDriver creates a new InboundCacheDriver using one of the
 // factory functions registered with RegisterInboundCacheDriver().
-func NewInboundCacheDriver(name string, cfg Configuration) (InboundCacheDriver, error) {
+func NewInboundCacheDriver(name string, cfg Configuration, rc *redis.Client) (InboundCacheDriver, error) {
 	factory := inboundCacheDriverFactories[name]
 	if factory != nil {
-		return factory(cfg)
+		return factory(cfg, rc)
 	}
 	return nil, errors.New("no such inbound cache driver: " + name)
 }
 
 // RegisterInboundCacheDriver registers an InboundCacheDriver. Call this from
 // func init() of the package defining the InboundCacheDriver.
-func RegisterInboundCacheDriver(name string, factory func(Configuration) (InboundCacheDriver, error)) {
+//
+// Warning: The *redis.Client argument of the factory function is optional!
+// Drivers that require Redis shall return an error if it is nil.
+func RegisterInboundCacheDriver(name string, factory func(Configuration, *redis.Client) (InboundCacheDriver, error)) {
 	if _, exists := inboundCacheDriverFactories[name]; exists {
 		panic("attempted to register multiple inbound cache drivers with name = " + name)
 	}
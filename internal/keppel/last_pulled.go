@@ -0,0 +1,147 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/sqlext"
+)
+
+// LastPulledDebouncer collects the timestamps of manifest pulls in memory and
+// writes them into the last_pulled_at columns of the manifests and tags tables
+// in batches. When a manifest is pulled many times between two flushes, only
+// the latest timestamp is written, which avoids a database write for every
+// single pull of a hot image.
+type LastPulledDebouncer struct {
+	db        *DB
+	mutex     sync.Mutex
+	manifests map[lastPulledManifestKey]time.Time
+	tags      map[lastPulledTagKey]time.Time
+}
+
+type lastPulledManifestKey struct {
+	RepoID int64
+	Digest string
+}
+
+type lastPulledTagKey struct {
+	RepoID  int64
+	Digest  string
+	TagName string
+}
+
+// NewLastPulledDebouncer creates a new LastPulledDebouncer. Recorded pulls are
+// only written into the DB when Flush() is called, so most callers will want
+// to call Flush() periodically through StartPeriodicFlusher().
+func NewLastPulledDebouncer(db *DB) *LastPulledDebouncer {
+	return &LastPulledDebouncer{
+		db:        db,
+		manifests: make(map[lastPulledManifestKey]time.Time),
+		tags:      make(map[lastPulledTagKey]time.Time),
+	}
+}
+
+// RecordManifestPull remembers that the given manifest was pulled at the given time.
+func (d *LastPulledDebouncer) RecordManifestPull(repoID int64, digest string, now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.recordManifest(lastPulledManifestKey{repoID, digest}, now)
+}
+
+// RecordTagPull remembers that the given tag was pulled at the given time
+// while it pointed to the given digest.
+func (d *LastPulledDebouncer) RecordTagPull(repoID int64, digest, tagName string, now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.recordTag(lastPulledTagKey{repoID, digest, tagName}, now)
+}
+
+func (d *LastPulledDebouncer) recordManifest(key lastPulledManifestKey, t time.Time) {
+	if existing, exists := d.manifests[key]; !exists || existing.Before(t) {
+		d.manifests[key] = t
+	}
+}
+
+func (d *LastPulledDebouncer) recordTag(key lastPulledTagKey, t time.Time) {
+	if existing, exists := d.tags[key]; !exists || existing.Before(t) {
+		d.tags[key] = t
+	}
+}
+
+// NOTE: The timestamps are only ever moved forward, in case a different
+// keppel-api instance (or the replica sync) has written a newer timestamp in
+// the meantime.
+var (
+	flushManifestLastPulledQuery = sqlext.SimplifyWhitespace(`
+		UPDATE manifests SET last_pulled_at = $3
+		 WHERE repo_id = $1 AND digest = $2 AND (last_pulled_at IS NULL OR last_pulled_at < $3)
+	`)
+	flushTagLastPulledQuery = sqlext.SimplifyWhitespace(`
+		UPDATE tags SET last_pulled_at = $4
+		 WHERE repo_id = $1 AND digest = $2 AND name = $3 AND (last_pulled_at IS NULL OR last_pulled_at < $4)
+	`)
+)
+
+// Flush writes all pull timestamps recorded so far into the DB. If the write
+// fails, the timestamps are retained for the next attempt.
+func (d *LastPulledDebouncer) Flush() (returnErr error) {
+	d.mutex.Lock()
+	manifests, tags := d.manifests, d.tags
+	d.manifests = make(map[lastPulledManifestKey]time.Time)
+	d.tags = make(map[lastPulledTagKey]time.Time)
+	d.mutex.Unlock()
+	if len(manifests) == 0 && len(tags) == 0 {
+		return nil
+	}
+
+	defer func() {
+		if returnErr != nil {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			for key, t := range manifests {
+				d.recordManifest(key, t)
+			}
+			for key, t := range tags {
+				d.recordTag(key, t)
+			}
+		}
+	}()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	for key, t := range manifests {
+		_, err := tx.Exec(flushManifestLastPulledQuery, key.RepoID, key.Digest, t)
+		if err != nil {
+			return err
+		}
+	}
+	for key, t := range tags {
+		_, err := tx.Exec(flushTagLastPulledQuery, key.RepoID, key.Digest, key.TagName, t)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -20,9 +20,13 @@
 package keppel
 
 import (
+	"encoding/json"
 	"fmt"
+	"mime"
 
 	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	//distribution.UnmarshalManifest() relies on the following packages
 	//registering their manifest schemas.
@@ -35,6 +39,15 @@ import (
 //anymore since it's legacy anyway and the implementation is a lot simpler
 //when we don't have to rewrite manifests between schema1 and schema2.
 
+const (
+	// HelmChartConfigMediaType is the media type of the config blob of a Helm
+	// chart that was pushed as an OCI artifact.
+	HelmChartConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	// HelmChartContentLayerMediaType is the media type of the layer containing
+	// the packaged chart in a Helm chart that was pushed as an OCI artifact.
+	HelmChartContentLayerMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
 // IsManifestMediaType returns whether the given media type is for a manifest.
 func IsManifestMediaType(mediaType string) bool {
 	for _, mt := range distribution.ManifestMediaTypes() {
@@ -59,26 +72,134 @@ type ParsedManifest interface {
 	BlobReferences() []distribution.Descriptor
 	//ManifestReferences returns all manifests referenced by this manifest.
 	ManifestReferences(pf PlatformFilter) []manifestlist.ManifestDescriptor
+	//Annotations returns the annotations of this manifest, or nil if the
+	//manifest format does not support annotations.
+	Annotations() map[string]string
+	//Subject returns the descriptor of the manifest that this manifest refers
+	//to via its "subject" field (as defined in OCI 1.1), or nil if there is none.
+	Subject() *distribution.Descriptor
+	//ArtifactType returns the artifact type of this manifest as reported by the
+	//referrers API, or the empty string if the manifest format does not support
+	//artifact types.
+	ArtifactType() string
 }
 
 // ParseManifest parses a manifest. It also returns a Descriptor describing the manifest itself.
+//
+// Manifests with a nonstandard media type are parsed as custom manifests (see
+// Account.AcceptsManifestMediaType). Callers that accept manifests from users
+// need to check whether the account allows the media type before calling this.
 func ParseManifest(mediaType string, contents []byte) (ParsedManifest, distribution.Descriptor, error) {
+	if mediaType != "" && !IsManifestMediaType(mediaType) {
+		parsedMediaType, _, err := mime.ParseMediaType(mediaType)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+		if !IsManifestMediaType(parsedMediaType) {
+			return parseCustomManifest(parsedMediaType, contents)
+		}
+	}
+
 	m, desc, err := distribution.UnmarshalManifest(mediaType, contents)
 	if err != nil {
 		return nil, distribution.Descriptor{}, err
 	}
+
+	//the vendored manifest types predate OCI 1.1, so we need to parse the
+	//fields relating to the referrers API separately
+	var rf ociReferrerFields
+	switch m.(type) {
+	case *ocischema.DeserializedManifest, *manifestlist.DeserializedManifestList:
+		err := json.Unmarshal(contents, &rf)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+	}
+
 	switch m := m.(type) {
 	case *schema2.DeserializedManifest:
 		return v2ManifestAdapter{m}, desc, nil
 	case *ocischema.DeserializedManifest:
-		return ociManifestAdapter{m}, desc, nil
+		return ociManifestAdapter{m, rf}, desc, nil
 	case *manifestlist.DeserializedManifestList:
-		return listManifestAdapter{m}, desc, nil
+		return listManifestAdapter{m, rf}, desc, nil
 	default:
 		panic(fmt.Sprintf("unexpected manifest type: %T", m))
 	}
 }
 
+// ociMediaTypeForDockerMediaType maps the media types of blobs referenced by
+// Docker schema2 manifests to their OCI equivalents.
+var ociMediaTypeForDockerMediaType = map[string]string{
+	schema2.MediaTypeImageConfig:       imagespec.MediaTypeImageConfig,
+	schema2.MediaTypeLayer:             imagespec.MediaTypeImageLayerGzip,
+	schema2.MediaTypeUncompressedLayer: imagespec.MediaTypeImageLayer,
+	schema2.MediaTypeForeignLayer:      imagespec.MediaTypeImageLayerNonDistributableGzip, //nolint:staticcheck // deprecated, but still the correct equivalent
+}
+
+// ConvertManifestToOCI converts a Docker schema2 image manifest into the
+// equivalent OCI image manifest. The converted manifest references the same
+// blobs, but since its contents differ, it has a different digest than the
+// original. An error is returned if the manifest is not a Docker schema2 image
+// manifest, or if it references blobs that have no OCI equivalent (e.g.
+// plugin configs).
+func ConvertManifestToOCI(mediaType string, contents []byte) ([]byte, distribution.Descriptor, error) {
+	if mediaType != schema2.MediaTypeManifest {
+		return nil, distribution.Descriptor{}, fmt.Errorf("cannot convert manifest of type %s to OCI", mediaType)
+	}
+	m, _, err := distribution.UnmarshalManifest(mediaType, contents)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	sm, ok := m.(*schema2.DeserializedManifest)
+	if !ok {
+		return nil, distribution.Descriptor{}, fmt.Errorf("unexpected manifest type: %T", m)
+	}
+
+	convertDescriptor := func(d distribution.Descriptor) (distribution.Descriptor, error) {
+		ociMediaType, exists := ociMediaTypeForDockerMediaType[d.MediaType]
+		if !exists {
+			return d, fmt.Errorf("cannot convert blob of type %s to OCI", d.MediaType)
+		}
+		d.MediaType = ociMediaType
+		return d, nil
+	}
+
+	var om ocischema.Manifest
+	om.SchemaVersion = 2
+	om.MediaType = imagespec.MediaTypeImageManifest
+	om.Config, err = convertDescriptor(sm.Config)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	om.Layers = make([]distribution.Descriptor, len(sm.Layers))
+	for idx, layer := range sm.Layers {
+		om.Layers[idx], err = convertDescriptor(layer)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+	}
+
+	dm, err := ocischema.FromStruct(om)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	_, converted, err := dm.Payload()
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	//reparse to obtain the descriptor (and to double-check that the result is valid)
+	_, desc, err := distribution.UnmarshalManifest(imagespec.MediaTypeImageManifest, converted)
+	return converted, desc, err
+}
+
+// ociReferrerFields contains the fields that OCI 1.1 added to image manifests
+// and image indexes.
+type ociReferrerFields struct {
+	ArtifactType string                   `json:"artifactType,omitempty"`
+	Subject      *distribution.Descriptor `json:"subject,omitempty"`
+}
+
 // v2ManifestAdapter provides the ParsedManifest interface for the contained type.
 type v2ManifestAdapter struct {
 	m *schema2.DeserializedManifest
@@ -100,19 +221,45 @@ func (a v2ManifestAdapter) ManifestReferences(pf PlatformFilter) []manifestlist.
 	return nil
 }
 
+func (a v2ManifestAdapter) Annotations() map[string]string {
+	return nil
+}
+
+func (a v2ManifestAdapter) Subject() *distribution.Descriptor {
+	return nil
+}
+
+func (a v2ManifestAdapter) ArtifactType() string {
+	return ""
+}
+
 // ociManifestAdapter provides the ParsedManifest interface for the contained type.
 type ociManifestAdapter struct {
-	m *ocischema.DeserializedManifest
+	m  *ocischema.DeserializedManifest
+	rf ociReferrerFields
 }
 
 func (a ociManifestAdapter) FindImageConfigBlob() *distribution.Descriptor {
+	//Helm charts are not images, so their config does not have the structure of an image config
+	if a.isHelmChart() {
+		return nil
+	}
 	return &a.m.Config
 }
 
 func (a ociManifestAdapter) FindImageLayerBlobs() []distribution.Descriptor {
+	if a.isHelmChart() {
+		return nil
+	}
 	return a.m.Layers
 }
 
+// isHelmChart returns whether this manifest describes a Helm chart rather than
+// a container image.
+func (a ociManifestAdapter) isHelmChart() bool {
+	return a.m.Config.MediaType == HelmChartConfigMediaType
+}
+
 func (a ociManifestAdapter) BlobReferences() []distribution.Descriptor {
 	return a.m.References()
 }
@@ -121,9 +268,27 @@ func (a ociManifestAdapter) ManifestReferences(pf PlatformFilter) []manifestlist
 	return nil
 }
 
+func (a ociManifestAdapter) Annotations() map[string]string {
+	return a.m.Annotations
+}
+
+func (a ociManifestAdapter) Subject() *distribution.Descriptor {
+	return a.rf.Subject
+}
+
+func (a ociManifestAdapter) ArtifactType() string {
+	//as per the OCI distribution spec, the config media type is reported as
+	//artifact type if the manifest does not declare one explicitly
+	if a.rf.ArtifactType != "" {
+		return a.rf.ArtifactType
+	}
+	return a.m.Config.MediaType
+}
+
 // listManifestAdapter provides the ParsedManifest interface for the contained type.
 type listManifestAdapter struct {
-	m *manifestlist.DeserializedManifestList
+	m  *manifestlist.DeserializedManifestList
+	rf ociReferrerFields
 }
 
 func (a listManifestAdapter) FindImageConfigBlob() *distribution.Descriptor {
@@ -147,3 +312,89 @@ func (a listManifestAdapter) ManifestReferences(pf PlatformFilter) []manifestlis
 	}
 	return result
 }
+
+func (a listManifestAdapter) Annotations() map[string]string {
+	return nil
+}
+
+func (a listManifestAdapter) Subject() *distribution.Descriptor {
+	return a.rf.Subject
+}
+
+func (a listManifestAdapter) ArtifactType() string {
+	return a.rf.ArtifactType
+}
+
+// customManifest is the structure that we expect from manifests with a
+// nonstandard media type. This is the same structure as an OCI image manifest,
+// except that the config blob is optional.
+type customManifest struct {
+	SchemaVersion int                       `json:"schemaVersion"`
+	MediaType     string                    `json:"mediaType,omitempty"`
+	Config        *distribution.Descriptor  `json:"config,omitempty"`
+	Layers        []distribution.Descriptor `json:"layers"`
+	AnnotationMap map[string]string         `json:"annotations,omitempty"`
+	ociReferrerFields
+}
+
+func parseCustomManifest(mediaType string, contents []byte) (ParsedManifest, distribution.Descriptor, error) {
+	var m customManifest
+	err := json.Unmarshal(contents, &m)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	if m.SchemaVersion != 2 {
+		return nil, distribution.Descriptor{}, fmt.Errorf("unsupported schemaVersion for manifest of type %s: %d", mediaType, m.SchemaVersion)
+	}
+	if m.MediaType != "" && m.MediaType != mediaType {
+		return nil, distribution.Descriptor{}, fmt.Errorf("mediaType in manifest should be %q, not %q", mediaType, m.MediaType)
+	}
+
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(contents)),
+		Digest:    digest.FromBytes(contents),
+	}
+	return customManifestAdapter{m}, desc, nil
+}
+
+// customManifestAdapter provides the ParsedManifest interface for the contained type.
+type customManifestAdapter struct {
+	m customManifest
+}
+
+func (a customManifestAdapter) FindImageConfigBlob() *distribution.Descriptor {
+	//custom manifests are not images, so we cannot make any assumptions about the config
+	return nil
+}
+
+func (a customManifestAdapter) FindImageLayerBlobs() []distribution.Descriptor {
+	return nil
+}
+
+func (a customManifestAdapter) BlobReferences() []distribution.Descriptor {
+	var result []distribution.Descriptor
+	if a.m.Config != nil {
+		result = append(result, *a.m.Config)
+	}
+	return append(result, a.m.Layers...)
+}
+
+func (a customManifestAdapter) ManifestReferences(pf PlatformFilter) []manifestlist.ManifestDescriptor {
+	return nil
+}
+
+func (a customManifestAdapter) Annotations() map[string]string {
+	return a.m.AnnotationMap
+}
+
+func (a customManifestAdapter) Subject() *distribution.Descriptor {
+	return a.m.Subject
+}
+
+func (a customManifestAdapter) ArtifactType() string {
+	if a.m.ArtifactType != "" || a.m.Config == nil {
+		return a.m.ArtifactType
+	}
+	return a.m.Config.MediaType
+}
@@ -0,0 +1,63 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipMagic is the magic number at the start of every gzip stream. Since
+// manifests are JSON documents, an uncompressed manifest never starts with
+// these bytes, so this can be used to tell compressed and uncompressed
+// manifest contents apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// CompressManifestContent compresses the given manifest contents for storage
+// in the manifest_contents table. Use DecodeManifestContent() to reverse this.
+func CompressManifestContent(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeManifestContent takes a value from the manifest_contents.content
+// column and returns the actual manifest contents. Both compressed and
+// uncompressed values are supported, since rows written before compression
+// was enabled (or while it was disabled) are not compressed.
+func DecodeManifestContent(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, gzipMagic) {
+		return stored, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,55 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestManifestContentCompression(t *testing.T) {
+	compressed, err := CompressManifestContent([]byte(testSchema2Manifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.HasPrefix(compressed, gzipMagic) {
+		t.Error("expected compressed content to start with the gzip magic number")
+	}
+	if len(compressed) >= len(testSchema2Manifest) {
+		t.Errorf("expected compressed content to be smaller than %d bytes, but got %d bytes", len(testSchema2Manifest), len(compressed))
+	}
+
+	//compressed content can be read back
+	decoded, err := DecodeManifestContent(compressed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(decoded) != testSchema2Manifest {
+		t.Errorf("expected compressed content to decode into the original manifest, but got %q", string(decoded))
+	}
+
+	//legacy uncompressed content is returned unchanged
+	decoded, err = DecodeManifestContent([]byte(testSchema2Manifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(decoded) != testSchema2Manifest {
+		t.Errorf("expected uncompressed content to be returned unchanged, but got %q", string(decoded))
+	}
+}
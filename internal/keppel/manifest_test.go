@@ -0,0 +1,157 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testSchema2Manifest = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+	"config": {
+		"mediaType": "application/vnd.docker.container.image.v1+json",
+		"size": 1469,
+		"digest": "sha256:e7d92cdc71feacf90708cb59182d0df1b911f8ae022d29e8e95d75ca6a99776a"
+	},
+	"layers": [
+		{
+			"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			"size": 2814446,
+			"digest": "sha256:2408cc74d12b6cd092bb8b516ba7d5e290f485d3eb9672efc00f0583730179e8"
+		},
+		{
+			"mediaType": "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+			"size": 1024,
+			"digest": "sha256:8c3e6a6da09ca4a7a1a6e1a0d8e9c0f3de2a4a6a5e0c2f1f8e7a2d4b6c8e0f2a",
+			"urls": ["https://example.org/layer.tar.gz"]
+		}
+	]
+}`
+
+func TestConvertManifestToOCI(t *testing.T) {
+	converted, desc, err := ConvertManifestToOCI(schema2.MediaTypeManifest, []byte(testSchema2Manifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if desc.MediaType != imagespec.MediaTypeImageManifest {
+		t.Errorf("expected media type %q, but got %q", imagespec.MediaTypeImageManifest, desc.MediaType)
+	}
+	if desc.Digest != digest.FromBytes(converted) {
+		t.Errorf("expected digest %s, but got %s", digest.FromBytes(converted), desc.Digest)
+	}
+	if desc.Digest == digest.FromString(testSchema2Manifest) {
+		t.Error("expected converted manifest to have a different digest than the original")
+	}
+
+	//the result must be a valid OCI manifest referencing the same blobs
+	var m ocischema.DeserializedManifest
+	err = m.UnmarshalJSON(converted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if m.Config.MediaType != imagespec.MediaTypeImageConfig {
+		t.Errorf("expected config media type %q, but got %q", imagespec.MediaTypeImageConfig, m.Config.MediaType)
+	}
+	if m.Config.Digest.String() != "sha256:e7d92cdc71feacf90708cb59182d0df1b911f8ae022d29e8e95d75ca6a99776a" || m.Config.Size != 1469 {
+		t.Errorf("config descriptor was not preserved: %#v", m.Config)
+	}
+	expectedLayerMediaTypes := []string{imagespec.MediaTypeImageLayerGzip, imagespec.MediaTypeImageLayerNonDistributableGzip} //nolint:staticcheck // deprecated, but still correct here
+	if len(m.Layers) != len(expectedLayerMediaTypes) {
+		t.Fatalf("expected %d layers, but got %d", len(expectedLayerMediaTypes), len(m.Layers))
+	}
+	for idx, layer := range m.Layers {
+		if layer.MediaType != expectedLayerMediaTypes[idx] {
+			t.Errorf("expected media type %q for layer %d, but got %q", expectedLayerMediaTypes[idx], idx, layer.MediaType)
+		}
+	}
+	if len(m.Layers[1].URLs) != 1 {
+		t.Errorf("expected URLs of foreign layer to be preserved, but got %#v", m.Layers[1].URLs)
+	}
+	parsed, _, err := ParseManifest(desc.MediaType, converted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(parsed.BlobReferences()) != 3 {
+		t.Errorf("expected 3 blob references, but got %d", len(parsed.BlobReferences()))
+	}
+
+	//manifests that are not Docker image manifests cannot be converted
+	_, _, err = ConvertManifestToOCI(imagespec.MediaTypeImageManifest, converted)
+	if err == nil {
+		t.Error("expected conversion of OCI manifest to fail, but it succeeded")
+	}
+}
+
+const testOCIArtifactManifest = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.manifest.v1+json",
+	"config": {
+		"mediaType": "application/vnd.oci.empty.v1+json",
+		"size": 2,
+		"digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	},
+	"layers": [],
+	"subject": {
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"size": 1234,
+		"digest": "sha256:e7d92cdc71feacf90708cb59182d0df1b911f8ae022d29e8e95d75ca6a99776a"
+	},
+	"annotations": { "org.example.signature": "foo" }
+}`
+
+func TestParseManifestSubject(t *testing.T) {
+	//OCI manifest with subject: artifact type falls back to config media type
+	parsed, _, err := ParseManifest(imagespec.MediaTypeImageManifest, []byte(testOCIArtifactManifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	subject := parsed.Subject()
+	if subject == nil || subject.Digest.String() != "sha256:e7d92cdc71feacf90708cb59182d0df1b911f8ae022d29e8e95d75ca6a99776a" {
+		t.Errorf("unexpected subject: %#v", subject)
+	}
+	if parsed.ArtifactType() != "application/vnd.oci.empty.v1+json" {
+		t.Errorf("expected artifact type from config, but got %q", parsed.ArtifactType())
+	}
+
+	//explicit artifact type takes precedence
+	withArtifactType := strings.Replace(testOCIArtifactManifest, `"layers": [],`, `"layers": [], "artifactType": "application/vnd.example.sig",`, 1)
+	parsed, _, err = ParseManifest(imagespec.MediaTypeImageManifest, []byte(withArtifactType))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if parsed.ArtifactType() != "application/vnd.example.sig" {
+		t.Errorf("expected explicit artifact type, but got %q", parsed.ArtifactType())
+	}
+
+	//Docker manifests do not have subjects
+	parsed, _, err = ParseManifest(schema2.MediaTypeManifest, []byte(testSchema2Manifest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if parsed.Subject() != nil {
+		t.Errorf("expected no subject, but got %#v", parsed.Subject())
+	}
+}
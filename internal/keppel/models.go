@@ -21,9 +21,12 @@ package keppel
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"mime"
 	"net"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/opencontainers/go-digest"
@@ -58,12 +61,128 @@ type Account struct {
 	MetadataJSON string `db:"metadata_json"`
 	//GCPoliciesJSON contains a JSON string of []keppel.GCPolicy, or the empty string.
 	GCPoliciesJSON string `db:"gc_policies_json"`
+	//VulnerabilityPolicyJSON contains a JSON string of keppel.VulnerabilityPolicy, or the empty string.
+	VulnerabilityPolicyJSON string `db:"vuln_policy_json"`
+
+	//ManifestRetentionSecs is how long deleted manifests are kept in the
+	//`deleted_manifests` table before being purged. If 0, deleted manifests are
+	//purged immediately.
+	ManifestRetentionSecs int64 `db:"manifest_retention_secs"`
+	//ImmutableTagPattern is a regex (with implicit anchors) that matches tags
+	//which, once pushed, may not be moved to a different manifest. If empty, all
+	//tags can be moved.
+	ImmutableTagPattern string `db:"immutable_tag_pattern"`
+	//MaxManifestSizeBytes limits the size of manifests that can be uploaded
+	//into this account. If 0, DefaultMaxManifestSizeBytes applies.
+	MaxManifestSizeBytes uint64 `db:"max_manifest_size_bytes"`
+	//ManifestLimit limits how many manifests can exist in this account. This is
+	//enforced in addition to the manifest quota of the account's auth tenant.
+	//If 0, only the tenant's quota applies.
+	ManifestLimit uint64 `db:"manifest_limit"`
+	//CustomManifestMediaTypes is a comma-separated list of nonstandard manifest
+	//media types that may be pushed into this account in addition to the
+	//standard ones.
+	CustomManifestMediaTypes string `db:"custom_manifest_media_types"`
+	//SignaturePolicyJSON contains a JSON string of keppel.SignaturePolicy, or the empty string.
+	SignaturePolicyJSON string `db:"signature_policy_json"`
+	//MaxBlobSizeBytes limits the size of blobs that can be uploaded into this
+	//account. If 0, DefaultMaxBlobSizeBytes applies.
+	MaxBlobSizeBytes uint64 `db:"max_blob_size_bytes"`
+	//ReplicationRepoAllowlistJSON contains a JSON string of []string, or the
+	//empty string. If not empty, only those repositories whose names match one
+	//of these regexes (with implicit anchors) can be replicated from upstream.
+	ReplicationRepoAllowlistJSON string `db:"replication_repo_allowlist_json"`
 
 	NextBlobSweepedAt            *time.Time `db:"next_blob_sweep_at"`              //see tasks.SweepBlobsInNextAccount
 	NextStorageSweepedAt         *time.Time `db:"next_storage_sweep_at"`           //see tasks.SweepStorageInNextAccount
 	NextFederationAnnouncementAt *time.Time `db:"next_federation_announcement_at"` //see tasks.AnnounceNextAccountToFederation
 }
 
+// DefaultMaxManifestSizeBytes is the manifest size limit for accounts that do
+// not have a MaxManifestSizeBytes configured. This is much larger than any
+// sensible manifest, and only exists to stop abuse.
+const DefaultMaxManifestSizeBytes = 16 << 20 // 16 MiB
+
+// EffectiveMaxManifestSizeBytes returns the manifest size limit that applies
+// to this account. The default is also the upper bound, even for accounts
+// that were configured with a larger limit before that was enforced.
+func (a Account) EffectiveMaxManifestSizeBytes() uint64 {
+	if a.MaxManifestSizeBytes == 0 || a.MaxManifestSizeBytes > DefaultMaxManifestSizeBytes {
+		return DefaultMaxManifestSizeBytes
+	}
+	return a.MaxManifestSizeBytes
+}
+
+// DefaultMaxBlobSizeBytes is the blob size limit for accounts that do not
+// have a MaxBlobSizeBytes configured. This is larger than any sensible image
+// layer, and only exists to stop a single upload from exhausting the storage.
+const DefaultMaxBlobSizeBytes = 32 << 30 // 32 GiB
+
+// EffectiveMaxBlobSizeBytes returns the blob size limit that applies to this
+// account. Like for manifests, the default is also the upper bound.
+func (a Account) EffectiveMaxBlobSizeBytes() uint64 {
+	if a.MaxBlobSizeBytes == 0 || a.MaxBlobSizeBytes > DefaultMaxBlobSizeBytes {
+		return DefaultMaxBlobSizeBytes
+	}
+	return a.MaxBlobSizeBytes
+}
+
+// AcceptsManifestMediaType returns whether manifests with this media type may
+// be pushed into this account. This is true for all standard manifest media
+// types, and for the account's CustomManifestMediaTypes.
+func (a Account) AcceptsManifestMediaType(mediaType string) bool {
+	parsedMediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return false
+	}
+	if IsManifestMediaType(parsedMediaType) {
+		return true
+	}
+	for _, customMediaType := range strings.Split(a.CustomManifestMediaTypes, ",") {
+		if customMediaType == parsedMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTagImmutable returns whether the given tag matches the account's
+// ImmutableTagPattern.
+func (a Account) IsTagImmutable(tagName string) (bool, error) {
+	if a.ImmutableTagPattern == "" {
+		return false, nil
+	}
+	rx, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, a.ImmutableTagPattern))
+	if err != nil {
+		return false, err
+	}
+	return rx.MatchString(tagName), nil
+}
+
+// IsRepoAllowedForReplication returns whether the repository with the given
+// name (without the account name) may be replicated from upstream into this
+// account according to the account's ReplicationRepoAllowlistJSON.
+func (a Account) IsRepoAllowedForReplication(repoName string) (bool, error) {
+	if a.ReplicationRepoAllowlistJSON == "" {
+		return true, nil
+	}
+	var patterns []string
+	err := json.Unmarshal([]byte(a.ReplicationRepoAllowlistJSON), &patterns)
+	if err != nil {
+		return false, fmt.Errorf("malformed replication repo allowlist JSON: %q", a.ReplicationRepoAllowlistJSON)
+	}
+	for _, pattern := range patterns {
+		rx, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, pattern))
+		if err != nil {
+			return false, err
+		}
+		if rx.MatchString(repoName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // SwiftContainerName returns the name of the Swift container backing this
 // Keppel account.
 func (a Account) SwiftContainerName() string {
@@ -90,6 +209,7 @@ type RBACPolicy struct {
 	CidrPattern             string `db:"match_cidr"`
 	RepositoryPattern       string `db:"match_repository"`
 	UserNamePattern         string `db:"match_username"`
+	GroupPattern            string `db:"match_group"`
 	CanPullAnonymously      bool   `db:"can_anon_pull"`
 	CanFirstPullAnonymously bool   `db:"can_anon_first_pull"`
 	CanPull                 bool   `db:"can_pull"`
@@ -97,12 +217,15 @@ type RBACPolicy struct {
 	CanDelete               bool   `db:"can_delete"`
 }
 
-// Matches evaluates the cidr and regexes in this policy.
-func (r RBACPolicy) Matches(ip, repoName, userName string) bool {
-	if r.CidrPattern != "" {
-		ip := net.ParseIP(ip)
-		_, network, err := net.ParseCIDR(r.CidrPattern)
-		if err != nil || !network.Contains(ip) {
+// Matches evaluates the cidr and regexes in this policy. The groupNames are
+// only relevant if the policy has a GroupPattern (see type GroupMembership).
+func (r RBACPolicy) Matches(ip, repoName, userName string, groupNames []string) bool {
+	//NOTE: "0.0.0.0/0" is the default value in the DB and means "no restriction"
+	//(this is relevant for clients connecting via IPv6)
+	if r.CidrPattern != "" && r.CidrPattern != "0.0.0.0/0" {
+		parsedIP := net.ParseIP(ip)
+		networks, err := ParseCIDRList(r.CidrPattern)
+		if err != nil || parsedIP == nil || !networksContain(networks, parsedIP) {
 			return false
 		}
 	}
@@ -123,6 +246,23 @@ func (r RBACPolicy) Matches(ip, repoName, userName string) bool {
 		}
 	}
 
+	if r.GroupPattern != "" {
+		rx, err := regexp.Compile(fmt.Sprintf(`^(?:%s)$`, r.GroupPattern))
+		if err != nil {
+			return false
+		}
+		isMember := false
+		for _, groupName := range groupNames {
+			if rx.MatchString(groupName) {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -150,6 +290,66 @@ type Blob struct {
 	ValidationErrorMessage string     `db:"validation_error_message"`
 	CanBeDeletedAt         *time.Time `db:"can_be_deleted_at"` //see tasks.SweepBlobsInNextAccount
 	BlocksVulnScanning     *bool      `db:"blocks_vuln_scanning"`
+	//StorageAccountName is only set if the blob contents are not stored in the
+	//storage area of the blob's own account, but are shared with the blob with
+	//the same digest in the account of this name (see
+	//Configuration.EnableCrossAccountBlobDedup). In this case, StorageID refers
+	//to a storage location in that other account.
+	StorageAccountName string `db:"storage_account_name"`
+}
+
+// FindBlobStorageAccount returns the account in whose storage area the
+// contents of the given blob are located. This is usually the blob's own
+// account, except for blobs that were deduplicated across accounts.
+func FindBlobStorageAccount(db gorp.SqlExecutor, blob Blob, account Account) (Account, error) {
+	if blob.StorageAccountName == "" || blob.StorageAccountName == account.Name {
+		return account, nil
+	}
+	storageAccount, err := FindAccount(db, blob.StorageAccountName)
+	if err != nil {
+		return Account{}, err
+	}
+	if storageAccount == nil {
+		return Account{}, fmt.Errorf("contents of blob %s in account %s are stored in account %s, which does not exist",
+			blob.Digest, account.Name, blob.StorageAccountName)
+	}
+	return *storageAccount, nil
+}
+
+var findBlobForDeduplicationQuery = sqlext.SimplifyWhitespace(`
+	SELECT b.* FROM blobs b
+	  JOIN accounts a ON a.name = b.account_name
+	 WHERE b.digest = $1 AND b.storage_id != '' AND b.storage_account_name = ''
+	   AND a.auth_tenant_id = $2 AND a.name != $3
+	 ORDER BY b.id LIMIT 1
+`)
+
+// FindBlobForDeduplication looks for a blob with the given digest in a
+// different account of the same auth tenant whose storage contents can be
+// reused for a new blob in the given account. Only blobs that own their
+// storage contents are considered, so that there is only ever one level of
+// indirection. If no such blob exists, sql.ErrNoRows is returned.
+func FindBlobForDeduplication(db gorp.SqlExecutor, blobDigest digest.Digest, account Account) (*Blob, error) {
+	var blob Blob
+	err := db.SelectOne(&blob, findBlobForDeduplicationQuery, blobDigest.String(), account.AuthTenantID, account.Name)
+	return &blob, err
+}
+
+// IsBlobStorageShared returns whether the storage contents of the given blob
+// are also referenced by blobs in other accounts, and therefore must not be
+// deleted together with this blob.
+func IsBlobStorageShared(db gorp.SqlExecutor, blob Blob) (bool, error) {
+	if blob.StorageAccountName != "" {
+		//the contents are owned by a different account (once all blobs
+		//referencing them are gone, they will be removed by the storage sweep of
+		//the owning account)
+		return true, nil
+	}
+	count, err := db.SelectInt(
+		`SELECT COUNT(*) FROM blobs WHERE storage_account_name = $1 AND storage_id = $2`,
+		blob.AccountName, blob.StorageID,
+	)
+	return count > 0, err
 }
 
 var blobGetQueryByRepoName = sqlext.SimplifyWhitespace(`
@@ -242,6 +442,9 @@ type Repository struct {
 	NextBlobMountSweepAt    *time.Time `db:"next_blob_mount_sweep_at"` //see tasks.SweepBlobMountsInNextRepo
 	NextManifestSyncAt      *time.Time `db:"next_manifest_sync_at"`    //see tasks.SyncManifestsInNextRepo (only set for replica accounts)
 	NextGarbageCollectionAt *time.Time `db:"next_gc_at"`               //see tasks.GarbageCollectManifestsInNextRepo
+	NextSizeCheckAt         *time.Time `db:"next_size_check_at"`       //see tasks.CheckManifestSizesInNextRepo
+	//MetadataJSON contains a JSON string of a map[string]string, or the empty string.
+	MetadataJSON string `db:"metadata_json"`
 }
 
 // FindOrCreateRepository works similar to db.SelectOne(), but autovivifies a
@@ -302,6 +505,10 @@ type Manifest struct {
 	GCStatusJSON      string     `db:"gc_status_json"`
 	MinLayerCreatedAt *time.Time `db:"min_layer_created_at"`
 	MaxLayerCreatedAt *time.Time `db:"max_layer_created_at"`
+	//SubjectDigest and ArtifactType are only filled for manifests that refer to
+	//another manifest through their "subject" field (see OCI referrers API).
+	SubjectDigest string `db:"subject_digest"`
+	ArtifactType  string `db:"artifact_type"`
 }
 
 // FindManifest is a convenience wrapper around db.SelectOne(). If the
@@ -341,15 +548,43 @@ type Tag struct {
 type ManifestContent struct {
 	RepositoryID int64  `db:"repo_id"`
 	Digest       string `db:"digest"`
+	Content      []byte `db:"content"` //may be compressed, use DecodeManifestContent() to read
+}
+
+// ManifestTranslation contains a record from the `manifest_translations`
+// table. When a client only accepts a manifest format that differs from the
+// stored one, a compatible manifest may be converted on the fly. Since the
+// conversion changes the manifest's digest, the converted manifest is
+// remembered here, so that clients can pull it again by its own digest.
+type ManifestTranslation struct {
+	RepositoryID int64  `db:"repo_id"`
+	SourceDigest string `db:"source_digest"`
+	TargetDigest string `db:"target_digest"`
+	MediaType    string `db:"media_type"`
 	Content      []byte `db:"content"`
 }
 
+// DeletedManifest contains a record from the `deleted_manifests` table. When
+// an account has a manifest retention period, deleted manifests are moved into
+// this table until the retention period expires, so that they can be restored.
+type DeletedManifest struct {
+	RepositoryID int64     `db:"repo_id"`
+	Digest       string    `db:"digest"`
+	MediaType    string    `db:"media_type"`
+	SizeBytes    uint64    `db:"size_bytes"`
+	Content      []byte    `db:"content"`
+	DeletedAt    time.Time `db:"deleted_at"`
+	PurgeAfter   time.Time `db:"purge_after"`
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Quotas contains a record from the `quotas` table.
 type Quotas struct {
 	AuthTenantID  string `db:"auth_tenant_id"`
 	ManifestCount uint64 `db:"manifests"`
+	//StorageBytes is nil if storage usage is not limited.
+	StorageBytes *uint64 `db:"storage_bytes"`
 }
 
 // FindQuotas works similar to db.SelectOne(), but returns nil instead of
@@ -382,6 +617,20 @@ var manifestUsageQuery = sqlext.SimplifyWhitespace(`
 	 WHERE a.auth_tenant_id = $1
 `)
 
+var accountManifestUsageQuery = sqlext.SimplifyWhitespace(`
+	SELECT COUNT(m.digest)
+	  FROM manifests m
+	  JOIN repos r ON m.repo_id = r.id
+	 WHERE r.account_name = $1
+`)
+
+// GetManifestUsage returns how many manifests currently exist in repos in
+// this account.
+func (a Account) GetManifestUsage(db gorp.SqlExecutor) (uint64, error) {
+	manifestCount, err := db.SelectInt(accountManifestUsageQuery, a.Name)
+	return uint64(manifestCount), err
+}
+
 // GetManifestUsage returns how many manifests currently exist in repos in
 // accounts connected to this quota set's auth tenant.
 func (q Quotas) GetManifestUsage(db gorp.SqlExecutor) (uint64, error) {
@@ -389,6 +638,23 @@ func (q Quotas) GetManifestUsage(db gorp.SqlExecutor) (uint64, error) {
 	return uint64(manifestCount), err
 }
 
+// NOTE: Blobs are stored once per account, no matter how many repos they are
+// mounted in, so each blob is counted once per account. Unbacked blobs (those
+// that are still being replicated) do not occupy any storage yet.
+var storageUsageQuery = sqlext.SimplifyWhitespace(`
+	SELECT COALESCE(SUM(b.size_bytes), 0)
+	  FROM blobs b
+	  JOIN accounts a ON a.name = b.account_name
+	 WHERE a.auth_tenant_id = $1 AND b.storage_id != ''
+`)
+
+// GetStorageUsage returns the total size in bytes of all blobs in accounts
+// connected to this quota set's auth tenant.
+func (q Quotas) GetStorageUsage(db gorp.SqlExecutor) (uint64, error) {
+	storageBytes, err := db.SelectInt(storageUsageQuery, q.AuthTenantID)
+	return uint64(storageBytes), err
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Peer contains a record from the `peers` table.
@@ -408,6 +674,26 @@ type Peer struct {
 
 	//LastPeeredAt is when we last issued a new password for this peer.
 	LastPeeredAt *time.Time `db:"last_peered_at"` //see tasks.IssueNewPasswordForPeer
+
+	//TheirCertFingerprint identifies the client certificate that the peer
+	//presents to us in PeeringModeMTLS (see CertificateFingerprint).
+	TheirCertFingerprint string `db:"their_cert_fingerprint"`
+
+	//When issuing a new password fails, further attempts are delayed with
+	//exponential backoff (see tasks.IssueNewPasswordForPeer).
+	ConsecutivePeeringFailures int        `db:"consecutive_peering_failures"`
+	NextPeeringAt              *time.Time `db:"next_peering_at"`
+}
+
+// Peering with each peer is supposed to happen every 10 minutes (see
+// tasks.IssueNewPasswordForPeer). If it did not happen for much longer than
+// that, the peer is considered stale.
+const PeerStaleAfter = 1 * time.Hour
+
+// IsStale returns whether we have not successfully peered with this peer in a
+// while, which indicates that the peer is unhealthy.
+func (p Peer) IsStale(now time.Time) bool {
+	return p.LastPeeredAt == nil || now.Sub(*p.LastPeeredAt) > PeerStaleAfter
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -455,13 +741,15 @@ type UnknownManifest struct {
 
 func initModels(db *gorp.DbMap) {
 	db.AddTableWithName(Account{}, "accounts").SetKeys(false, "name")
-	db.AddTableWithName(RBACPolicy{}, "rbac_policies").SetKeys(false, "account_name", "match_repository", "match_username")
+	db.AddTableWithName(RBACPolicy{}, "rbac_policies").SetKeys(false, "account_name", "match_repository", "match_username", "match_group")
 	db.AddTableWithName(Blob{}, "blobs").SetKeys(true, "id")
 	db.AddTableWithName(Upload{}, "uploads").SetKeys(false, "repo_id", "uuid")
 	db.AddTableWithName(Repository{}, "repos").SetKeys(true, "id")
 	db.AddTableWithName(Manifest{}, "manifests").SetKeys(false, "repo_id", "digest")
 	db.AddTableWithName(Tag{}, "tags").SetKeys(false, "repo_id", "name")
 	db.AddTableWithName(ManifestContent{}, "manifest_contents").SetKeys(false, "repo_id", "digest")
+	db.AddTableWithName(DeletedManifest{}, "deleted_manifests").SetKeys(false, "repo_id", "digest")
+	db.AddTableWithName(ManifestTranslation{}, "manifest_translations").SetKeys(false, "repo_id", "source_digest", "media_type")
 	db.AddTableWithName(Quotas{}, "quotas").SetKeys(false, "auth_tenant_id")
 	db.AddTableWithName(Peer{}, "peers").SetKeys(false, "hostname")
 	db.AddTableWithName(PendingBlob{}, "pending_blobs").SetKeys(false, "account_name", "digest")
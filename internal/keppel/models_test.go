@@ -0,0 +1,126 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import "testing"
+
+func TestRBACPolicyMatches(t *testing.T) {
+	usernameOnly := RBACPolicy{AccountName: "test1", UserNamePattern: "alice|bob"}
+	groupOnly := RBACPolicy{AccountName: "test1", GroupPattern: "dev.*"}
+	combined := RBACPolicy{AccountName: "test1", RepositoryPattern: "app/.*", UserNamePattern: "alice", GroupPattern: "developers"}
+
+	testCases := []struct {
+		Policy     RBACPolicy
+		RepoName   string
+		UserName   string
+		GroupNames []string
+		Expected   bool
+	}{
+		//username-only policies are not affected by group membership
+		{usernameOnly, "test1/foo", "alice", nil, true},
+		{usernameOnly, "test1/foo", "bob", []string{"operators"}, true},
+		{usernameOnly, "test1/foo", "mallory", []string{"developers"}, false},
+		//group-only policies match anyone in a matching group
+		{groupOnly, "test1/foo", "mallory", []string{"operators", "developers"}, true},
+		{groupOnly, "test1/foo", "mallory", []string{"devops"}, true},
+		{groupOnly, "test1/foo", "alice", []string{"operators"}, false},
+		{groupOnly, "test1/foo", "alice", nil, false},
+		//the group pattern must match the entire group name
+		{groupOnly, "test1/foo", "alice", []string{"my-developers"}, false},
+		//combined policies require all attributes to match
+		{combined, "test1/app/api", "alice", []string{"developers"}, true},
+		{combined, "test1/app/api", "bob", []string{"developers"}, false},
+		{combined, "test1/app/api", "alice", []string{"operators"}, false},
+		{combined, "test1/other", "alice", []string{"developers"}, false},
+	}
+
+	for _, tc := range testCases {
+		actual := tc.Policy.Matches("127.0.0.1", tc.RepoName, tc.UserName, tc.GroupNames)
+		if actual != tc.Expected {
+			t.Errorf("expected policy %#v to return %t for repo %q, user %q and groups %v, but got %t",
+				tc.Policy, tc.Expected, tc.RepoName, tc.UserName, tc.GroupNames, actual)
+		}
+	}
+}
+
+func TestRBACPolicyMatchesCIDR(t *testing.T) {
+	defaultCIDR := RBACPolicy{AccountName: "test1", CidrPattern: "0.0.0.0/0", RepositoryPattern: "foo"}
+	singleCIDR := RBACPolicy{AccountName: "test1", CidrPattern: "10.0.0.0/8"}
+	multiCIDR := RBACPolicy{AccountName: "test1", CidrPattern: "192.0.2.0/24,198.51.100.0/24,2001:db8::/32"}
+
+	testCases := []struct {
+		Policy   RBACPolicy
+		IP       string
+		Expected bool
+	}{
+		//the default value matches all clients, including IPv6 clients
+		{defaultCIDR, "192.0.2.1", true},
+		{defaultCIDR, "2001:db8::1", true},
+		{singleCIDR, "10.1.2.3", true},
+		{singleCIDR, "192.0.2.1", false},
+		{singleCIDR, "2001:db8::1", false},
+		{multiCIDR, "192.0.2.1", true},
+		{multiCIDR, "198.51.100.1", true},
+		{multiCIDR, "2001:db8::1", true},
+		{multiCIDR, "203.0.113.1", false},
+		{multiCIDR, "2001:db9::1", false},
+		{multiCIDR, "", false},
+	}
+
+	for _, tc := range testCases {
+		actual := tc.Policy.Matches(tc.IP, "test1/foo", "alice", nil)
+		if actual != tc.Expected {
+			t.Errorf("expected policy with cidr %q to return %t for IP %q, but got %t",
+				tc.Policy.CidrPattern, tc.Expected, tc.IP, actual)
+		}
+	}
+}
+
+func TestAccountIsRepoAllowedForReplication(t *testing.T) {
+	withoutAllowlist := Account{Name: "test1"}
+	withAllowlist := Account{Name: "test1", ReplicationRepoAllowlistJSON: `["library/.*","foo"]`}
+
+	testCases := []struct {
+		Account  Account
+		RepoName string
+		Expected bool
+	}{
+		{withoutAllowlist, "foo", true},
+		{withoutAllowlist, "library/alpine", true},
+		{withAllowlist, "foo", true},
+		{withAllowlist, "library/alpine", true},
+		//patterns must match the entire repo name
+		{withAllowlist, "foobar", false},
+		{withAllowlist, "other/library/alpine", false},
+		{withAllowlist, "bar", false},
+	}
+
+	for _, tc := range testCases {
+		actual, err := tc.Account.IsRepoAllowedForReplication(tc.RepoName)
+		if err != nil {
+			t.Errorf("unexpected error for repo %q: %s", tc.RepoName, err.Error())
+			continue
+		}
+		if actual != tc.Expected {
+			t.Errorf("expected IsRepoAllowedForReplication(%q) to return %t for allowlist %q, but got %t",
+				tc.RepoName, tc.Expected, tc.Account.ReplicationRepoAllowlistJSON, actual)
+		}
+	}
+}
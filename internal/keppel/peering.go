@@ -0,0 +1,95 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PeeringMode is an enum of the ways in which peers can authenticate with each other.
+type PeeringMode string
+
+const (
+	// PeeringModePassword is the default peering mode. Peers regularly issue
+	// service user passwords to each other (see tasks.IssueNewPasswordForPeer).
+	PeeringModePassword PeeringMode = "password"
+	// PeeringModeMTLS is the peering mode where peers present TLS client
+	// certificates to each other. Peers are identified by the fingerprint of
+	// their certificate, as recorded in the `peers` table.
+	PeeringModeMTLS PeeringMode = "mtls"
+)
+
+// IsValid returns whether this is one of the known peering modes.
+func (m PeeringMode) IsValid() bool {
+	return m == PeeringModePassword || m == PeeringModeMTLS
+}
+
+// CertificateFingerprint returns the fingerprint by which a peer is identified
+// in PeeringModeMTLS. The format is "sha256:" followed by the hex-encoded
+// SHA-256 digest of the DER-encoded certificate.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ParseCertificateFingerprint normalizes a certificate fingerprint given in
+// the configuration. Besides the format returned by CertificateFingerprint(),
+// the colon-separated uppercase format that is printed by `openssl x509
+// -fingerprint -sha256` is accepted as well.
+func ParseCertificateFingerprint(in string) (string, error) {
+	hexStr := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(in, "sha256:"), ":", ""))
+	buf, err := hex.DecodeString(hexStr)
+	if err != nil || len(buf) != sha256.Size {
+		return "", fmt.Errorf("malformed certificate fingerprint: %q", in)
+	}
+	return "sha256:" + hexStr, nil
+}
+
+// NewPeerTransport builds the http.RoundTripper that is used for requests to
+// peers in PeeringModeMTLS. It behaves like http.DefaultTransport, but
+// presents the given client certificate during the TLS handshake.
+func NewPeerTransport(cert tls.Certificate) http.RoundTripper {
+	var t *http.Transport
+	if base, ok := http.DefaultTransport.(*http.Transport); ok {
+		t = base.Clone()
+	} else {
+		t = &http.Transport{}
+	}
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return t
+}
+
+// PeerHTTPClient returns the http.Client that shall be used for all requests
+// to peers.
+func (cfg Configuration) PeerHTTPClient() *http.Client {
+	if cfg.PeerTransport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: cfg.PeerTransport}
+}
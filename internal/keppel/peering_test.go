@@ -0,0 +1,143 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateTestCertificate(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestParseCertificateFingerprint(t *testing.T) {
+	cert := generateTestCertificate(t, "peer.example.org")
+	fingerprint := CertificateFingerprint(cert.Leaf)
+	if !strings.HasPrefix(fingerprint, "sha256:") {
+		t.Errorf("expected fingerprint to start with %q, but got %q", "sha256:", fingerprint)
+	}
+
+	//the OpenSSL format is accepted as well
+	hexStr := strings.TrimPrefix(fingerprint, "sha256:")
+	var pairs []string
+	for idx := 0; idx < len(hexStr); idx += 2 {
+		pairs = append(pairs, strings.ToUpper(hexStr[idx:idx+2]))
+	}
+	for _, input := range []string{fingerprint, hexStr, strings.Join(pairs, ":")} {
+		parsed, err := ParseCertificateFingerprint(input)
+		if err != nil {
+			t.Errorf("expected %q to parse, but got: %s", input, err.Error())
+		} else if parsed != fingerprint {
+			t.Errorf("expected %q to parse into %q, but got %q", input, fingerprint, parsed)
+		}
+	}
+
+	for _, input := range []string{"", "sha256:", "sha256:xyz", hexStr[2:]} {
+		_, err := ParseCertificateFingerprint(input)
+		if err == nil {
+			t.Errorf("expected %q to be rejected, but it parsed successfully", input)
+		}
+	}
+}
+
+func TestPeerTransport(t *testing.T) {
+	ourCert := generateTestCertificate(t, "registry.example.org")
+	otherCert := generateTestCertificate(t, "registry.example.org")
+
+	//this server accepts only clients that present `ourCert`, similar to how
+	//auth.IncomingRequest.Authorize() only accepts known peer certificates
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		if CertificateFingerprint(r.TLS.PeerCertificates[0]) != CertificateFingerprint(ourCert.Leaf) {
+			http.Error(w, "unknown client certificate", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok")) //nolint:errcheck
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert, MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	expectResponse := func(transport http.RoundTripper, expectedStatus int, expectedBody string) {
+		t.Helper()
+		if tr, ok := transport.(*http.Transport); ok {
+			tr.TLSClientConfig.RootCAs = roots
+		}
+		resp, err := Configuration{PeerTransport: transport}.PeerHTTPClient().Get(srv.URL)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if resp.StatusCode != expectedStatus || strings.TrimSpace(string(body)) != expectedBody {
+			t.Errorf("expected %d %q, but got %d %q", expectedStatus, expectedBody, resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+	}
+
+	expectResponse(NewPeerTransport(ourCert), http.StatusOK, "ok")
+	expectResponse(NewPeerTransport(otherCert), http.StatusUnauthorized, "unknown client certificate")
+	expectResponse(&http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12}}, http.StatusUnauthorized, "no client certificate")
+
+	//without a PeerTransport, the default client is used
+	if (Configuration{}).PeerHTTPClient() != http.DefaultClient {
+		t.Error("expected PeerHTTPClient() to return http.DefaultClient in password mode")
+	}
+}
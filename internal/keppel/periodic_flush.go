@@ -0,0 +1,79 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// PeriodicFlusher calls a flush function (e.g. PullCounter.Flush or
+// LastPulledDebouncer.Flush) in a fixed interval in a background goroutine.
+type PeriodicFlusher struct {
+	flush       func() error
+	description string
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// StartPeriodicFlusher starts a goroutine that calls `flush` in the given
+// interval until Stop() is called. The description says what is being
+// flushed, and is used in the log messages for failed flushes.
+func StartPeriodicFlusher(interval time.Duration, description string, flush func() error) *PeriodicFlusher {
+	f := &PeriodicFlusher{
+		flush:       flush,
+		description: description,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go f.run(interval)
+	return f
+}
+
+func (f *PeriodicFlusher) run(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.flushAndLog()
+		case <-f.stop:
+			f.flushAndLog()
+			return
+		}
+	}
+}
+
+func (f *PeriodicFlusher) flushAndLog() {
+	err := f.flush()
+	if err != nil {
+		logg.Error("could not write %s into DB: %s", f.description, err.Error())
+	}
+}
+
+// Stop ends the background goroutine and blocks until it has completed a
+// final flush. To avoid losing data, this must only be called once nothing
+// records into the flushed buffer anymore (e.g. after the HTTP server has
+// finished all requests).
+func (f *PeriodicFlusher) Stop() {
+	close(f.stop)
+	<-f.done
+}
@@ -0,0 +1,43 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeriodicFlusherFinalFlush(t *testing.T) {
+	var flushCount int64
+	flush := func() error {
+		//make the flush slow enough that Stop() would observably return too
+		//early if it did not wait for the final flush
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt64(&flushCount, 1)
+		return nil
+	}
+
+	//with an interval this long, only the final flush in Stop() can happen
+	f := StartPeriodicFlusher(time.Hour, "test data", flush)
+	f.Stop()
+	if count := atomic.LoadInt64(&flushCount); count != 1 {
+		t.Errorf("expected exactly 1 flush after Stop() returned, but got %d", count)
+	}
+}
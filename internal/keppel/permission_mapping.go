@@ -0,0 +1,155 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PermissionMappingRule grants permissions to all users for which the auth
+// driver reports a certain value (e.g. an LDAP group DN or a value in an OIDC
+// token claim). Global permissions have an empty AuthTenantID.
+type PermissionMappingRule struct {
+	Value        string       `json:"-"`
+	AuthTenantID string       `json:"auth_tenant_id,omitempty"`
+	Permissions  []Permission `json:"permissions"`
+}
+
+// PermissionMapping is a list of PermissionMappingRule, as used by auth
+// drivers that map attributes of external user accounts to Keppel permissions.
+type PermissionMapping struct {
+	Rules      []PermissionMappingRule
+	ignoreCase bool
+}
+
+var isTenantPermission = map[Permission]bool{
+	CanViewAccount:       true,
+	CanPullFromAccount:   true,
+	CanPushToAccount:     true,
+	CanDeleteFromAccount: true,
+	CanChangeAccount:     true,
+	CanViewQuotas:        true,
+	CanChangeQuotas:      true,
+}
+
+// LoadPermissionMapping reads a PermissionMapping from a JSON file containing
+// a list of rules like
+//
+//	{ "<valueKey>": "foo", "auth_tenant_id": "team1", "permissions": ["view", "pull"] }
+//
+// If ignoreCase is true, rule values are compared case-insensitively.
+func LoadPermissionMapping(path, valueKey string, ignoreCase bool) (PermissionMapping, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return PermissionMapping{}, err
+	}
+	var rawRules []json.RawMessage
+	err = json.Unmarshal(buf, &rawRules)
+	if err != nil {
+		return PermissionMapping{}, fmt.Errorf("while parsing %s: %w", path, err)
+	}
+
+	rules := make([]PermissionMappingRule, len(rawRules))
+	for idx, rawRule := range rawRules {
+		rule := &rules[idx]
+		err := json.Unmarshal(rawRule, rule)
+		if err != nil {
+			return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d: %w", path, idx+1, err)
+		}
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(rawRule, &fields)
+		if err != nil {
+			return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d: %w", path, idx+1, err)
+		}
+		if rawValue, exists := fields[valueKey]; exists {
+			err = json.Unmarshal(rawValue, &rule.Value)
+			if err != nil {
+				return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d has an invalid %q attribute: %w", path, idx+1, valueKey, err)
+			}
+		}
+
+		if rule.Value == "" {
+			return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d is missing the %q attribute", path, idx+1, valueKey)
+		}
+		for _, perm := range rule.Permissions {
+			switch {
+			case perm == CanAdministrateKeppel:
+				if rule.AuthTenantID != "" {
+					return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d cannot grant the global permission %q within an auth tenant", path, idx+1, perm)
+				}
+			case isTenantPermission[perm]:
+				if rule.AuthTenantID == "" {
+					return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d needs the %q attribute to grant permission %q", path, idx+1, "auth_tenant_id", perm)
+				}
+			default:
+				return PermissionMapping{}, fmt.Errorf("while parsing %s: rule #%d grants unknown permission %q", path, idx+1, perm)
+			}
+		}
+	}
+	return PermissionMapping{rules, ignoreCase}, nil
+}
+
+// ReferencesAuthTenant returns whether any rule grants permissions within the
+// given auth tenant.
+func (m PermissionMapping) ReferencesAuthTenant(tenantID string) bool {
+	for _, rule := range m.Rules {
+		if rule.AuthTenantID == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// ComputePermissions evaluates the mapping for a user for which the auth
+// driver reports the given values. The result maps auth tenant IDs to granted
+// permissions, with global permissions appearing under the empty tenant ID.
+func (m PermissionMapping) ComputePermissions(values []string) map[string][]Permission {
+	result := make(map[string][]Permission)
+	hasPermission := make(map[string]map[Permission]bool)
+
+	for _, rule := range m.Rules {
+		if !m.containsValue(values, rule.Value) {
+			continue
+		}
+
+		if hasPermission[rule.AuthTenantID] == nil {
+			hasPermission[rule.AuthTenantID] = make(map[Permission]bool)
+		}
+		for _, perm := range rule.Permissions {
+			if !hasPermission[rule.AuthTenantID][perm] {
+				hasPermission[rule.AuthTenantID][perm] = true
+				result[rule.AuthTenantID] = append(result[rule.AuthTenantID], perm)
+			}
+		}
+	}
+
+	return result
+}
+
+func (m PermissionMapping) containsValue(values []string, expected string) bool {
+	for _, value := range values {
+		if value == expected || (m.ignoreCase && strings.EqualFold(value, expected)) {
+			return true
+		}
+	}
+	return false
+}
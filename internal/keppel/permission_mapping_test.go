@@ -0,0 +1,69 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPermissionMapping = `[
+	{ "value": "Developers", "auth_tenant_id": "team1", "permissions": ["view", "pull"] },
+	{ "value": "developers", "auth_tenant_id": "team1", "permissions": ["pull", "push"] },
+	{ "value": "admins", "permissions": ["keppeladmin"] }
+]`
+
+func TestPermissionMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(path, []byte(testPermissionMapping), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		IgnoreCase bool
+		Values     []string
+		Expected   map[string][]Permission
+	}{
+		{false, []string{"developers"}, map[string][]Permission{"team1": {CanPullFromAccount, CanPushToAccount}}},
+		{true, []string{"developers"}, map[string][]Permission{"team1": {CanViewAccount, CanPullFromAccount, CanPushToAccount}}},
+		{false, []string{"DEVELOPERS", "admins"}, map[string][]Permission{"": {CanAdministrateKeppel}}},
+		{false, nil, map[string][]Permission{}},
+	}
+	for _, tc := range testCases {
+		m, err := LoadPermissionMapping(path, "value", tc.IgnoreCase)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		actual := m.ComputePermissions(tc.Values)
+		if !reflect.DeepEqual(actual, tc.Expected) {
+			t.Errorf("expected permissions %v for values %v (ignoreCase = %t), but got %v", tc.Expected, tc.Values, tc.IgnoreCase, actual)
+		}
+	}
+
+	m, err := LoadPermissionMapping(path, "value", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !m.ReferencesAuthTenant("team1") || m.ReferencesAuthTenant("team2") {
+		t.Error("ReferencesAuthTenant returned unexpected results")
+	}
+}
@@ -0,0 +1,107 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/sqlext"
+)
+
+// ManifestPullStatsRetention is how long the per-day pull counts in the
+// manifest_pull_stats table are kept before the janitor removes them.
+const ManifestPullStatsRetention = 30 * 24 * time.Hour
+
+// PullCounter collects manifest pulls in memory and writes them into the
+// manifest_pull_stats table in batches. This avoids adding a database write
+// to every single manifest pull.
+type PullCounter struct {
+	db     *DB
+	mutex  sync.Mutex
+	counts map[pullCounterKey]uint64
+}
+
+type pullCounterKey struct {
+	RepoID int64
+	Digest string
+	Day    string //in the format "YYYY-MM-DD"
+}
+
+// NewPullCounter creates a new PullCounter. Recorded pulls are only written
+// into the DB when Flush() is called, so most callers will want to call Flush()
+// periodically through StartPeriodicFlusher().
+func NewPullCounter(db *DB) *PullCounter {
+	return &PullCounter{db: db, counts: make(map[pullCounterKey]uint64)}
+}
+
+// Record counts a pull of the given manifest at the given time.
+func (c *PullCounter) Record(repoID int64, digest string, now time.Time) {
+	key := pullCounterKey{repoID, digest, now.UTC().Format("2006-01-02")}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[key]++
+}
+
+var flushPullCountsQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO manifest_pull_stats (repo_id, digest, day, count) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (repo_id, digest, day) DO UPDATE SET count = manifest_pull_stats.count + EXCLUDED.count
+`)
+
+// Flush writes all pull counts recorded so far into the DB. If the write
+// fails, the counts are retained for the next attempt.
+func (c *PullCounter) Flush() (returnErr error) {
+	c.mutex.Lock()
+	counts := c.counts
+	c.counts = make(map[pullCounterKey]uint64)
+	c.mutex.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	defer func() {
+		if returnErr != nil {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			for key, count := range counts {
+				c.counts[key] += count
+			}
+		}
+	}()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	stmt, err := tx.Prepare(flushPullCountsQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, count := range counts {
+		_, err := stmt.Exec(key.RepoID, key.Digest, key.Day, count)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
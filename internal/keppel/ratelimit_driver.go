@@ -51,7 +51,19 @@ const (
 // each account.
 type RateLimitDriver interface {
 	//GetRateLimit shall return nil if the given action has no rate limit.
+	//
+	//The Burst field of the result is optional: If non-zero, it defines how
+	//many units (requests, or bytes for AnycastBlobBytePullAction) may be
+	//consumed at once when the rate limit has not been used for a while. This
+	//allows to express limits like "60 per minute, but allow bursts of 10". If
+	//zero, the burst budget defaults to the Rate, i.e. one full Period's worth
+	//of units.
 	GetRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit
+	//GetPerSourceIPRateLimit is like GetRateLimit, but the returned limit
+	//applies separately to each client IP within the account. It shall return
+	//nil if the given action has no per-IP rate limit. Per-IP rate limits
+	//apply in addition to the account-wide limit from GetRateLimit().
+	GetPerSourceIPRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit
 }
 
 var rateLimitDriverFactories = make(map[string]func(AuthDriver, Configuration) (RateLimitDriver, error))
@@ -88,25 +100,88 @@ type RateLimitEngine struct {
 	Client *redis.Client
 }
 
-// RateLimitAllows checks whether the given action on the given account is allowed by
-// the account's rate limit.
-func (e RateLimitEngine) RateLimitAllows(account Account, action RateLimitedAction, amount uint64) (bool, *redis_rate.Result, error) {
-	rateQuota := e.Driver.GetRateLimit(account, action)
-	if rateQuota == nil {
-		//no rate limit for this account and action
-		return true, &redis_rate.Result{
-			Limit:      redis_rate.Limit{Rate: math.MaxInt64, Period: time.Second},
+// RateLimitAllows checks whether the given action on the given account is
+// allowed by the account's rate limit. If the client IP is known (i.e. if
+// sourceIP is not empty), the per-IP rate limit is checked as well, so that a
+// single noisy client cannot consume the entire budget of the account. Both
+// limits must allow the action, and an action that is denied by either limit
+// does not consume the budget of the other one.
+//
+// If the action is denied, the returned result describes the limit that
+// denied it. Otherwise, it describes the limit with the least remaining
+// budget.
+func (e RateLimitEngine) RateLimitAllows(account Account, sourceIP string, action RateLimitedAction, amount uint64) (bool, *redis_rate.Result, error) {
+	//the per-IP limit is checked first: if this client is throttled, it shall
+	//not consume the budget of the other clients in the same account
+	var (
+		ipKey    string
+		ipLimit  *redis_rate.Limit
+		ipResult *redis_rate.Result
+	)
+	if sourceIP != "" {
+		ipLimit = e.Driver.GetPerSourceIPRateLimit(account, action)
+		if ipLimit != nil {
+			ipKey = fmt.Sprintf("keppel-ratelimit-%s-%s-%s", string(action), account.Name, sourceIP)
+			allowed, result, err := e.allowN(ipKey, *ipLimit, amount)
+			if err != nil || !allowed {
+				return false, result, err
+			}
+			ipResult = result
+		}
+	}
+
+	var accountResult *redis_rate.Result
+	accountLimit := e.Driver.GetRateLimit(account, action)
+	if accountLimit == nil {
+		//no account-wide rate limit for this account and action
+		accountResult = &redis_rate.Result{
+			Limit:      redis_rate.Limit{Rate: math.MaxInt64, Burst: math.MaxInt64, Period: time.Second},
 			Remaining:  math.MaxInt64,
 			ResetAfter: 0,
 			RetryAfter: -1,
-		}, nil
+		}
+	} else {
+		key := fmt.Sprintf("keppel-ratelimit-%s-%s", string(action), account.Name)
+		allowed, result, err := e.allowN(key, *accountLimit, amount)
+		if err == nil && !allowed && ipResult != nil {
+			//the client shall not be charged for an action that it did not get to do
+			err = e.refundN(ipKey, *ipLimit, amount)
+		}
+		if err != nil || !allowed {
+			return false, result, err
+		}
+		accountResult = result
+	}
+
+	if ipResult != nil && ipResult.Remaining < accountResult.Remaining {
+		return true, ipResult, nil
+	}
+	return true, accountResult, nil
+}
+
+func (e RateLimitEngine) allowN(key string, limit redis_rate.Limit, amount uint64) (bool, *redis_rate.Result, error) {
+	if limit.Burst == 0 {
+		limit.Burst = limit.Rate
 	}
 
 	limiter := redis_rate.NewLimiter(e.Client)
-	key := fmt.Sprintf("keppel-ratelimit-%s-%s", string(action), account.Name)
-	result, err := limiter.AllowN(context.Background(), key, *rateQuota, int(amount))
+	result, err := limiter.AllowN(context.Background(), key, limit, int(amount))
 	if err != nil {
 		return false, &redis_rate.Result{}, err
 	}
 	return result.Allowed > 0, result, err
 }
+
+// refundN reverts a previous allowN() call that allowed the given amount.
+func (e RateLimitEngine) refundN(key string, limit redis_rate.Limit, amount uint64) error {
+	if limit.Burst == 0 {
+		limit.Burst = limit.Rate
+	}
+
+	//redis_rate does not have a dedicated method for this, but a negative cost
+	//moves the bucket state back by the same amount that a positive cost moved
+	//it forward
+	limiter := redis_rate.NewLimiter(e.Client)
+	_, err := limiter.AllowN(context.Background(), key, limit, -int(amount))
+	return err
+}
@@ -0,0 +1,192 @@
+/*******************************************************************************
+*
+* Copyright 2022 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redis_rate/v9"
+)
+
+type staticRateLimitDriver map[RateLimitedAction]redis_rate.Limit
+
+func (d staticRateLimitDriver) GetRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit {
+	limit, ok := d[action]
+	if !ok {
+		return nil
+	}
+	return &limit
+}
+
+func (d staticRateLimitDriver) GetPerSourceIPRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit {
+	return nil
+}
+
+type staticRateLimitDriverWithPerSourceIPLimits struct {
+	AccountLimits     staticRateLimitDriver
+	PerSourceIPLimits staticRateLimitDriver
+}
+
+func (d staticRateLimitDriverWithPerSourceIPLimits) GetRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit {
+	return d.AccountLimits.GetRateLimit(account, action)
+}
+
+func (d staticRateLimitDriverWithPerSourceIPLimits) GetPerSourceIPRateLimit(account Account, action RateLimitedAction) *redis_rate.Limit {
+	return d.PerSourceIPLimits.GetRateLimit(account, action)
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	sr := miniredis.RunT(t)
+	sr.SetTime(time.Unix(1e9, 0))
+	rle := RateLimitEngine{
+		Driver: staticRateLimitDriver{
+			//"60 per minute, but allow bursts of 10"
+			BlobPullAction: {Rate: 60, Period: time.Minute, Burst: 10},
+			//no explicit burst -> defaults to one minute's worth of bytes
+			AnycastBlobBytePullAction: {Rate: 1000, Period: time.Minute},
+		},
+		Client: redis.NewClient(&redis.Options{Addr: sr.Addr()}),
+	}
+	account := Account{Name: "test1"}
+
+	expect := func(action RateLimitedAction, amount uint64, expectAllowed bool) {
+		t.Helper()
+		allowed, _, err := rle.RateLimitAllows(account, "", action, amount)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if allowed != expectAllowed {
+			t.Errorf("expected allowed = %t for %s with amount %d, but got %t", expectAllowed, action, amount, allowed)
+		}
+	}
+
+	//the steady rate is 1 per second, but the burst allows to consume up to 10
+	//at once
+	expect(BlobPullAction, 4, true)
+	expect(BlobPullAction, 6, true)
+	expect(BlobPullAction, 1, false)
+	//after 3 seconds, we have recovered 3 units of budget
+	sr.SetTime(time.Unix(1e9+3, 0))
+	expect(BlobPullAction, 4, false)
+	expect(BlobPullAction, 3, true)
+	//amounts exceeding the burst are never allowed
+	sr.SetTime(time.Unix(1e9+3600, 0))
+	expect(BlobPullAction, 11, false)
+	expect(BlobPullAction, 10, true)
+
+	//without explicit burst, a full period's worth of units may be consumed at once
+	expect(AnycastBlobBytePullAction, 800, true)
+	expect(AnycastBlobBytePullAction, 200, true)
+	expect(AnycastBlobBytePullAction, 1, false)
+
+	//actions without rate limit are always allowed
+	expect(ManifestPushAction, 1000000, true)
+
+	//the Redis key format must remain stable to not reset existing counters
+	//(NOTE: redis_rate adds the "rate:" prefix)
+	if !sr.Exists("rate:keppel-ratelimit-pullblob-test1") {
+		t.Errorf("expected Redis key %q to exist, but got keys %v", "rate:keppel-ratelimit-pullblob-test1", sr.Keys())
+	}
+}
+
+func TestRateLimitPerSourceIP(t *testing.T) {
+	sr := miniredis.RunT(t)
+	sr.SetTime(time.Unix(1e9, 0))
+	accountLimits := staticRateLimitDriver{
+		BlobPullAction: {Rate: 60, Period: time.Minute, Burst: 5},
+	}
+	perSourceIPLimits := staticRateLimitDriver{
+		BlobPullAction:     {Rate: 60, Period: time.Minute, Burst: 3},
+		ManifestPullAction: {Rate: 60, Period: time.Minute, Burst: 1},
+	}
+	rle := RateLimitEngine{
+		Driver: staticRateLimitDriverWithPerSourceIPLimits{
+			AccountLimits:     accountLimits,
+			PerSourceIPLimits: perSourceIPLimits,
+		},
+		Client: redis.NewClient(&redis.Options{Addr: sr.Addr()}),
+	}
+	account := Account{Name: "test1"}
+
+	expect := func(sourceIP string, action RateLimitedAction, expectAllowed bool, expectedRemaining int) {
+		t.Helper()
+		allowed, result, err := rle.RateLimitAllows(account, sourceIP, action, 1)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if allowed != expectAllowed {
+			t.Errorf("expected allowed = %t for %s from %q, but got %t", expectAllowed, action, sourceIP, allowed)
+		}
+		if result.Remaining != expectedRemaining {
+			t.Errorf("expected remaining = %d for %s from %q, but got %d", expectedRemaining, action, sourceIP, result.Remaining)
+		}
+	}
+
+	//the first client exhausts its own budget (the result reports the more restrictive limit)...
+	expect("192.0.2.1", BlobPullAction, true, 2)
+	expect("192.0.2.1", BlobPullAction, true, 1)
+	expect("192.0.2.1", BlobPullAction, true, 0)
+	expect("192.0.2.1", BlobPullAction, false, 0)
+	expect("192.0.2.1", BlobPullAction, false, 0)
+	//...but the second client in the same account is not affected by this, since
+	//throttled requests do not consume the account's budget
+	expect("192.0.2.2", BlobPullAction, true, 1)
+	expect("192.0.2.2", BlobPullAction, true, 0)
+	//the account-wide limit still applies to all clients together
+	expect("192.0.2.2", BlobPullAction, false, 0)
+	expect("192.0.2.3", BlobPullAction, false, 0)
+
+	//when the client IP is not known, only the account-wide limit applies
+	sr.SetTime(time.Unix(1e9+3600, 0))
+	for idx := 4; idx >= 0; idx-- {
+		expect("", BlobPullAction, true, idx)
+	}
+	expect("", BlobPullAction, false, 0)
+
+	//per-IP limits can also exist without an account-wide limit
+	expect("192.0.2.1", ManifestPullAction, true, 0)
+	expect("192.0.2.1", ManifestPullAction, false, 0)
+	expect("192.0.2.2", ManifestPullAction, true, 0)
+
+	//when the account-wide limit denies an action, the client's own budget is
+	//not consumed by it
+	sr.SetTime(time.Unix(1e9+7200, 0))
+	accountLimits[BlobPushAction] = redis_rate.Limit{Rate: 60, Period: time.Minute, Burst: 1}
+	perSourceIPLimits[BlobPushAction] = redis_rate.Limit{Rate: 60, Period: time.Minute, Burst: 3}
+	expect("192.0.2.1", BlobPushAction, true, 0)
+	expect("192.0.2.1", BlobPushAction, false, 0)
+	expect("192.0.2.1", BlobPushAction, false, 0)
+	expect("192.0.2.1", BlobPushAction, false, 0)
+	delete(accountLimits, BlobPushAction)
+	expect("192.0.2.1", BlobPushAction, true, 1)
+	expect("192.0.2.1", BlobPushAction, true, 0)
+	expect("192.0.2.1", BlobPushAction, false, 0)
+
+	//the per-IP Redis keys include the client IP
+	//(NOTE: redis_rate adds the "rate:" prefix)
+	for _, key := range []string{"rate:keppel-ratelimit-pullblob-test1", "rate:keppel-ratelimit-pullblob-test1-192.0.2.1", "rate:keppel-ratelimit-pullmanifest-test1-192.0.2.2"} {
+		if !sr.Exists(key) {
+			t.Errorf("expected Redis key %q to exist, but got keys %v", key, sr.Keys())
+		}
+	}
+}
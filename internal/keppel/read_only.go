@@ -0,0 +1,52 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"net/http"
+	"strings"
+)
+
+const readOnlyMessage = "Keppel is in read-only mode, please try again later"
+
+// ReadOnlyError returns the error that is reported for operations that cannot
+// be performed because Configuration.ReadOnly is set.
+func ReadOnlyError() *RegistryV2Error {
+	return ErrUnavailable.With(readOnlyMessage)
+}
+
+// ReadOnlyMiddleware is a global middleware for httpapi.Compose() that rejects
+// all requests with mutating methods (PUT, POST, PATCH, DELETE) with status
+// 503. GET, HEAD and OPTIONS requests pass through. This is installed by
+// keppel-api when KEPPEL_READONLY is set.
+func ReadOnlyMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			inner.ServeHTTP(w, r)
+		default:
+			//respond in the error format that the respective API client expects
+			if strings.HasPrefix(r.URL.Path, "/v2/") {
+				ReadOnlyError().WriteAsRegistryV2ResponseTo(w, r)
+			} else {
+				http.Error(w, readOnlyMessage, http.StatusServiceUnavailable)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	h := ReadOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	testCases := []struct {
+		Method         string
+		Path           string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{http.MethodGet, "/keppel/v1/accounts", http.StatusTeapot, ""},
+		{http.MethodHead, "/v2/test1/foo/manifests/latest", http.StatusTeapot, ""},
+		{http.MethodOptions, "/keppel/v1/accounts/test1", http.StatusTeapot, ""},
+		{http.MethodPut, "/keppel/v1/accounts/test1", http.StatusServiceUnavailable, readOnlyMessage},
+		{http.MethodDelete, "/keppel/v1/accounts/test1", http.StatusServiceUnavailable, readOnlyMessage},
+		{http.MethodPost, "/v2/test1/foo/blobs/uploads/", http.StatusServiceUnavailable, `"code":"UNAVAILABLE"`},
+		{http.MethodPatch, "/v2/test1/foo/blobs/uploads/abc", http.StatusServiceUnavailable, `"code":"UNAVAILABLE"`},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.Method, tc.Path, http.NoBody))
+		if w.Code != tc.ExpectedStatus {
+			t.Errorf("expected %s %s to return status %d, but got %d", tc.Method, tc.Path, tc.ExpectedStatus, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tc.ExpectedBody) {
+			t.Errorf("expected %s %s to return a body containing %q, but got %q", tc.Method, tc.Path, tc.ExpectedBody, w.Body.String())
+		}
+	}
+}
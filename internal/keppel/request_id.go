@@ -0,0 +1,61 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// RequestIDHeader is the name of the header that carries the request ID. It is
+// set on incoming requests by RequestIDMiddleware(), reported back to the
+// client in the response, and forwarded to peers when anycast requests are
+// reverse-proxied.
+const RequestIDHeader = "X-Keppel-Request-Id"
+
+// Request IDs supplied by clients are only accepted if they match this format,
+// to avoid garbage ending up in log lines.
+var requestIDRx = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestIDMiddleware is a global middleware for httpapi.Compose() that
+// ensures that each request carries a request ID. A request ID supplied by the
+// client (or by a peer forwarding an anycast request) is preserved if it is
+// well-formed. Otherwise, a new random request ID is generated.
+func RequestIDMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !requestIDRx.MatchString(requestID) {
+			requestID = generateRequestID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func generateRequestID() string {
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(buf[:])
+}
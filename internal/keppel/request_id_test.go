@@ -0,0 +1,121 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seenRequestID string
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenRequestID = r.Header.Get(RequestIDHeader)
+	}))
+
+	check := func(incomingRequestID string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/v2/", http.NoBody)
+		if incomingRequestID != "" {
+			r.Header.Set(RequestIDHeader, incomingRequestID)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		responseRequestID := w.Header().Get(RequestIDHeader)
+		if responseRequestID == "" {
+			t.Errorf("expected response to carry a request ID, but got none")
+		}
+		if responseRequestID != seenRequestID {
+			t.Errorf("expected handler to see request ID %q, but got %q", responseRequestID, seenRequestID)
+		}
+		return responseRequestID
+	}
+
+	//request ID is generated when absent, and different for each request
+	first := check("")
+	second := check("")
+	if first == second {
+		t.Errorf("expected generated request IDs to differ, but got %q twice", first)
+	}
+
+	//well-formed request ID is preserved
+	if actual := check("abc-123.def_456"); actual != "abc-123.def_456" {
+		t.Errorf("expected request ID to be preserved, but got %q", actual)
+	}
+
+	//malformed request ID is replaced
+	for _, malformed := range []string{"foo bar", "foo\nbar", strings.Repeat("a", 129)} {
+		if actual := check(malformed); actual == malformed {
+			t.Errorf("expected malformed request ID %q to be replaced", malformed)
+		}
+	}
+}
+
+type captureRoundTripper struct {
+	Requests []*http.Request
+}
+
+func (rt *captureRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.Requests = append(rt.Requests, r)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("ok")),
+		Request:    r,
+	}, nil
+}
+
+func TestReverseProxyForwardsRequestID(t *testing.T) {
+	rt := &captureRoundTripper{}
+	defer func(orig http.RoundTripper) { http.DefaultTransport = orig }(http.DefaultTransport)
+	http.DefaultTransport = rt
+
+	cfg := Configuration{APIPublicHostname: "registry.example.org"}
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := cfg.ReverseProxyAnycastRequestToPeer(w, r, "registry-secondary.example.org")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v2/test1/foo/manifests/latest", http.NoBody)
+	r.Header.Set(RequestIDHeader, "original-request")
+	r.Header.Set("X-Not-Forwarded", "1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(rt.Requests) != 1 {
+		t.Fatalf("expected 1 forwarded request, but got %d", len(rt.Requests))
+	}
+	req := rt.Requests[0]
+	if actual := req.Header.Get(RequestIDHeader); actual != "original-request" {
+		t.Errorf("expected forwarded request ID %q, but got %q", "original-request", actual)
+	}
+	if actual := req.URL.Query().Get("request-id"); actual != "original-request" {
+		t.Errorf("expected request ID %q in forwarded URL, but got %q", "original-request", actual)
+	}
+	if actual := req.Header.Get("X-Keppel-Forwarded-By"); actual != "registry.example.org" {
+		t.Errorf("expected forwarding from %q, but got %q", "registry.example.org", actual)
+	}
+	if req.Header.Get("X-Not-Forwarded") != "" {
+		t.Error("expected non-allowlisted header to be discarded")
+	}
+}
@@ -0,0 +1,159 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JSONRequestLogMiddleware returns a global middleware for httpapi.Compose()
+// that writes one JSON object per request into the given writer. This is
+// installed by keppel-api when KEPPEL_LOG_FORMAT is "json", in place of the
+// plain-text request log of httpapi.Compose() (which must then be disabled
+// with httpapi.WithoutLogging()). The client IP is determined in the same way
+// as for RBAC policies, see GetRequesterIP().
+func JSONRequestLogMiddleware(out io.Writer, trustedProxies []net.IPNet) func(http.Handler) http.Handler {
+	var mutex sync.Mutex
+	return func(inner http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startedAt := time.Now()
+			writer := &loggingResponseWriter{inner: w, statusCode: http.StatusOK}
+			inner.ServeHTTP(writer, r)
+			duration := time.Since(startedAt)
+
+			//like the plain-text request log, skip successful health checks
+			if r.URL.Path == "/healthcheck" && writer.statusCode < 500 {
+				return
+			}
+
+			line := jsonRequestLogLine{
+				Time:        startedAt.UTC().Format(time.RFC3339Nano),
+				RemoteAddr:  GetRequesterIP(r, trustedProxies),
+				Method:      r.Method,
+				Path:        r.URL.Path,
+				Status:      writer.statusCode,
+				BytesSent:   writer.bytesWritten,
+				DurationSec: duration.Seconds(),
+				Account:     accountNameFromRequestPath(r.URL.Path),
+				RequestID:   r.Header.Get(RequestIDHeader),
+				UserAgent:   r.Header.Get("User-Agent"),
+				Error:       strings.TrimSpace(writer.errorMessageBuf.String()),
+			}
+			buf, err := json.Marshal(line)
+			if err != nil {
+				//cannot happen since all fields are plain strings and numbers
+				panic(err.Error())
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			out.Write(append(buf, '\n')) //nolint:errcheck // there is no sensible way to handle errors when logging
+		})
+	}
+}
+
+type jsonRequestLogLine struct {
+	Time        string  `json:"time"`
+	RemoteAddr  string  `json:"remote_addr"`
+	Method      string  `json:"method"`
+	Path        string  `json:"path"`
+	Status      int     `json:"status"`
+	BytesSent   int     `json:"bytes_sent"`
+	DurationSec float64 `json:"duration_seconds"`
+	Account     string  `json:"account,omitempty"`
+	RequestID   string  `json:"request_id,omitempty"`
+	UserAgent   string  `json:"user_agent,omitempty"`
+	//Only filled for server errors, same as in the plain-text request log.
+	Error string `json:"error,omitempty"`
+}
+
+// accountNameFromRequestPath extracts the account name from the paths of the
+// Registry V2 API and the Keppel API. This is necessarily a best-effort
+// guess since the global middleware runs before any routing takes place.
+func accountNameFromRequestPath(path string) string {
+	var rest string
+	switch {
+	case strings.HasPrefix(path, "/keppel/v1/accounts/"):
+		rest = strings.TrimPrefix(path, "/keppel/v1/accounts/")
+	case strings.HasPrefix(path, "/v2/"):
+		rest = strings.TrimPrefix(path, "/v2/")
+		//the first path component is only an account name if a repository name follows
+		if !strings.Contains(rest, "/") {
+			return ""
+		}
+	default:
+		return ""
+	}
+	accountName, _, _ := strings.Cut(rest, "/")
+	//skip pseudo-components like "_import" and "_catalog"
+	if strings.HasPrefix(accountName, "_") {
+		return ""
+	}
+	return accountName
+}
+
+// loggingResponseWriter captures the response metadata that
+// JSONRequestLogMiddleware reports.
+type loggingResponseWriter struct {
+	inner           http.ResponseWriter
+	statusCode      int
+	bytesWritten    int
+	headersWritten  bool
+	errorMessageBuf bytes.Buffer
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *loggingResponseWriter) Header() http.Header {
+	return w.inner.Header()
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *loggingResponseWriter) WriteHeader(statusCode int) {
+	if !w.headersWritten {
+		w.statusCode = statusCode
+		w.headersWritten = true
+	}
+	w.inner.WriteHeader(statusCode)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *loggingResponseWriter) Write(buf []byte) (int, error) {
+	w.headersWritten = true
+	//for server errors, the response body is the error message
+	if w.statusCode >= 500 {
+		w.errorMessageBuf.Write(buf)
+	}
+	n, err := w.inner.Write(buf)
+	w.bytesWritten += n
+	return n, err
+}
+
+// Flush implements the http.Flusher interface.
+func (w *loggingResponseWriter) Flush() {
+	if flusher, ok := w.inner.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
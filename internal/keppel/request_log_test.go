@@ -0,0 +1,125 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONRequestLogMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	trustedProxies, err := ParseCIDRList("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h := JSONRequestLogMiddleware(&out, trustedProxies)(RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthcheck":
+			http.Error(w, "ok", http.StatusOK)
+		case "/keppel/v1/accounts/test1":
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello")) //nolint:errcheck
+		}
+	})))
+
+	serve := func(method, path string) {
+		t.Helper()
+		r := httptest.NewRequest(method, path, http.NoBody)
+		r.Header.Set(RequestIDHeader, "req-"+strings.ToLower(method))
+		//the first entry was not written by our trusted proxy (httptest uses 192.0.2.1 as peer address)
+		r.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.5")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	serve(http.MethodPut, "/v2/test1/foo/manifests/latest")
+	serve(http.MethodGet, "/healthcheck")
+	serve(http.MethodDelete, "/keppel/v1/accounts/test1")
+
+	//each non-healthcheck request produces exactly one line of valid JSON
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, but got %d: %q", len(lines), out.String())
+	}
+	parse := func(line string) map[string]interface{} {
+		t.Helper()
+		var result map[string]interface{}
+		err := json.Unmarshal([]byte(line), &result)
+		if err != nil {
+			t.Fatalf("expected log line to be valid JSON, but got %s: %q", err.Error(), line)
+		}
+		if _, ok := result["duration_seconds"].(float64); !ok {
+			t.Errorf("expected log line to contain duration, but got %q", line)
+		}
+		if _, ok := result["time"].(string); !ok {
+			t.Errorf("expected log line to contain timestamp, but got %q", line)
+		}
+		return result
+	}
+	expectFields := func(actual map[string]interface{}, expected map[string]interface{}) {
+		t.Helper()
+		for key, value := range expected {
+			if actual[key] != value {
+				t.Errorf("expected %s = %#v, but got %#v", key, value, actual[key])
+			}
+		}
+	}
+
+	expectFields(parse(lines[0]), map[string]interface{}{
+		"method":      "PUT",
+		"path":        "/v2/test1/foo/manifests/latest",
+		"remote_addr": "203.0.113.5",
+		"status":      float64(http.StatusCreated),
+		"bytes_sent":  float64(5),
+		"account":     "test1",
+		"request_id":  "req-put",
+		"error":       nil,
+	})
+	expectFields(parse(lines[1]), map[string]interface{}{
+		"method":     "DELETE",
+		"path":       "/keppel/v1/accounts/test1",
+		"status":     float64(http.StatusInternalServerError),
+		"account":    "test1",
+		"request_id": "req-delete",
+		"error":      "something went wrong",
+	})
+}
+
+func TestAccountNameFromRequestPath(t *testing.T) {
+	testCases := map[string]string{
+		"/v2/":                                   "",
+		"/v2/_catalog":                           "",
+		"/v2/test1/foo/bar/manifests/latest":     "test1",
+		"/keppel/v1/accounts":                    "",
+		"/keppel/v1/accounts/test1":              "test1",
+		"/keppel/v1/accounts/test1/repositories": "test1",
+		"/keppel/v1/accounts/_import":            "",
+		"/healthcheck":                           "",
+	}
+	for path, expected := range testCases {
+		if actual := accountNameFromRequestPath(path); actual != expected {
+			t.Errorf("expected account name %q for path %q, but got %q", expected, path, actual)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRList parses a comma-separated list of CIDRs, like those found in
+// RBACPolicy.CidrPattern or in the KEPPEL_TRUSTED_PROXY_CIDRS variable. Both
+// IPv4 and IPv6 networks are accepted.
+func ParseCIDRList(in string) ([]net.IPNet, error) {
+	var result []net.IPNet
+	for _, field := range strings.Split(in, ",") {
+		field = strings.TrimSpace(field)
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			//err.Error() sadly does not contain any useful information why the cidr is invalid
+			return nil, fmt.Errorf("%q is not a valid cidr", field)
+		}
+		result = append(result, *network)
+	}
+	return result, nil
+}
+
+func networksContain(networks []net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRequesterIP returns the IP address of the client that made the given
+// request, or the empty string if it cannot be determined.
+//
+// If trustedProxies is empty, the first entry of the X-Forwarded-For header is
+// taken at face value (if the header is present). Otherwise, the
+// X-Forwarded-For header is only honored as far as it was written by trusted
+// proxies: Starting from the direct peer, we walk backwards through the
+// X-Forwarded-For entries until we find an address that does not belong to a
+// trusted proxy.
+func GetRequesterIP(r *http.Request, trustedProxies []net.IPNet) string {
+	remoteAddr := r.RemoteAddr
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err == nil {
+		remoteAddr = host
+	}
+
+	var forwardedFor []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, field := range strings.Split(value, ",") {
+			forwardedFor = append(forwardedFor, strings.TrimSpace(field))
+		}
+	}
+	if len(forwardedFor) == 0 {
+		return remoteAddr
+	}
+
+	if len(trustedProxies) == 0 {
+		return forwardedFor[0]
+	}
+
+	ip := net.ParseIP(remoteAddr)
+	for idx := len(forwardedFor) - 1; idx >= 0; idx-- {
+		if ip == nil || !networksContain(trustedProxies, ip) {
+			break
+		}
+		nextIP := net.ParseIP(forwardedFor[idx])
+		if nextIP == nil {
+			//do not trust anything beyond a malformed entry
+			break
+		}
+		ip = nextIP
+	}
+	if ip == nil {
+		return remoteAddr
+	}
+	return ip.String()
+}
@@ -0,0 +1,75 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetRequesterIP(t *testing.T) {
+	trustedProxies, err := ParseCIDRList("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		RemoteAddr     string
+		ForwardedFor   []string
+		TrustedProxies bool
+		Expected       string
+	}{
+		//without X-Forwarded-For, the remote address is used
+		{"198.51.100.1:1234", nil, false, "198.51.100.1"},
+		{"198.51.100.1:1234", nil, true, "198.51.100.1"},
+		{"[2001:db8::1]:1234", nil, true, "2001:db8::1"},
+		//without trusted proxies, the first X-Forwarded-For entry is taken at face value
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, false, "198.51.100.1"},
+		{"198.51.100.1:1234", []string{"203.0.113.1, 10.0.0.2"}, false, "203.0.113.1"},
+		//with trusted proxies, X-Forwarded-For is only honored when it was written by a trusted proxy
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, true, "198.51.100.1"},
+		{"198.51.100.1:1234", []string{"203.0.113.1"}, true, "198.51.100.1"},
+		{"[fd00::1]:1234", []string{"2001:db8::1"}, true, "2001:db8::1"},
+		//with multiple proxies, spoofed entries to the left of the actual client are ignored
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, true, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1", "10.0.0.2"}, true, "198.51.100.1"},
+		//if all entries are trusted proxies, the leftmost one is the best guess
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, true, "10.0.0.3"},
+		//malformed entries stop the search
+		{"10.0.0.1:1234", []string{"198.51.100.1, garbage"}, true, "10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		r, _ := http.NewRequest(http.MethodGet, "/", http.NoBody)
+		r.RemoteAddr = tc.RemoteAddr
+		for _, value := range tc.ForwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		var networks = trustedProxies
+		if !tc.TrustedProxies {
+			networks = nil
+		}
+		actual := GetRequesterIP(r, networks)
+		if actual != tc.Expected {
+			t.Errorf("expected requester IP %q for remote address %q with X-Forwarded-For %v (trusted proxies: %t), but got %q",
+				tc.Expected, tc.RemoteAddr, tc.ForwardedFor, tc.TrustedProxies, actual)
+		}
+	}
+}
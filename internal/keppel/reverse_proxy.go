@@ -31,6 +31,7 @@ import (
 var reverseProxyHeaders = []string{
 	"Accept",
 	"Authorization",
+	RequestIDHeader,
 }
 
 // ReverseProxyAnycastRequestToPeer takes a http.Request for the anycast API and
@@ -49,6 +50,10 @@ func (cfg Configuration) ReverseProxyAnycastRequestToPeer(w http.ResponseWriter,
 	//make the forwarding visible in the other Keppel's log file
 	query := r.URL.Query()
 	query.Set("forwarded-by", cfg.APIPublicHostname)
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID != "" {
+		query.Set("request-id", requestID)
+	}
 	reqURL.RawQuery = query.Encode()
 
 	//when sending proxy request, do not follow redirects (we want to pass on 3xx
@@ -87,7 +92,7 @@ func (cfg Configuration) ReverseProxyAnycastRequestToPeer(w http.ResponseWriter,
 			resp.Body.Close()
 		}
 		if err != nil {
-			logg.Error("while forwarding reverse-proxy response to caller: " + err.Error())
+			logg.Error("while forwarding reverse-proxy response for request %s to caller: %s", requestID, err.Error())
 		}
 	}
 
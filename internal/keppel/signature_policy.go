@@ -0,0 +1,144 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// CosignSimpleSigningMediaType is the media type of the layers in a cosign
+	// signature manifest. Each such layer contains a signed payload.
+	CosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// CosignSignatureAnnotation is the annotation on a layer in a cosign
+	// signature manifest that contains the Base64-encoded signature of the
+	// layer's payload.
+	CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// SignaturePolicy is a policy requiring that images in an account are signed
+// with cosign before they can be tagged. It is stored in serialized form in
+// the SignaturePolicyJSON field of type Account.
+//
+// Signatures are discovered through the referrers mechanism, i.e. the
+// signature manifest must refer to the signed manifest in its "subject" field
+// and must be located in the same repository.
+type SignaturePolicy struct {
+	//PublicKey is the PEM-encoded public key (ECDSA, RSA or Ed25519) that
+	//signatures must verify against.
+	PublicKey string `json:"public_key"`
+}
+
+// Validate returns an error if this policy is invalid.
+func (p SignaturePolicy) Validate() error {
+	_, err := p.parsePublicKey()
+	return err
+}
+
+func (p SignaturePolicy) parsePublicKey() (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(p.PublicKey))
+	if block == nil {
+		return nil, errors.New("public key for signature policy is not in PEM format")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key for signature policy: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported type of public key for signature policy: %T", key)
+	}
+}
+
+// cosignPayload is the subset of the cosign "simple signing" payload format
+// that we need to inspect.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// VerifyCosignSignature checks that the given signature (Base64-encoded, as
+// found in the CosignSignatureAnnotation) was made over the given payload
+// with the private key belonging to this policy's public key, and that the
+// payload refers to the manifest with the given digest.
+func (p SignaturePolicy) VerifyCosignSignature(payload []byte, signatureBase64, signedManifestDigest string) error {
+	key, err := p.parsePublicKey()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return fmt.Errorf("signature is not valid Base64: %w", err)
+	}
+
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return errors.New("signature does not match public key")
+		}
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+		if err != nil {
+			return errors.New("signature does not match public key")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return errors.New("signature does not match public key")
+		}
+	}
+
+	//the signature is only relevant if it refers to the manifest in question
+	var pl cosignPayload
+	err = json.Unmarshal(payload, &pl)
+	if err != nil {
+		return fmt.Errorf("cannot parse signature payload: %w", err)
+	}
+	if pl.Critical.Image.DockerManifestDigest != signedManifestDigest {
+		return fmt.Errorf("signature payload refers to manifest %q instead of %s",
+			pl.Critical.Image.DockerManifestDigest, signedManifestDigest)
+	}
+	return nil
+}
+
+// ParseSignaturePolicy parses the signature policy for the given account. If
+// the account does not have a signature policy, nil is returned.
+func (a Account) ParseSignaturePolicy() (*SignaturePolicy, error) {
+	if a.SignaturePolicyJSON == "" {
+		return nil, nil
+	}
+	var policy SignaturePolicy
+	err := json.Unmarshal([]byte(a.SignaturePolicyJSON), &policy)
+	return &policy, err
+}
@@ -23,7 +23,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+
+	"github.com/sapcc/go-bits/logg"
 )
 
 // StorageDriver is the abstract interface for a multi-tenant-capable storage
@@ -50,6 +53,13 @@ type StorageDriver interface {
 	AbortBlobUpload(account Account, storageID string, chunkCount uint32) error
 
 	ReadBlob(account Account, storageID string) (contents io.ReadCloser, sizeBytes uint64, err error)
+	//ReadBlobRange() is like ReadBlob(), but only returns `length` bytes of
+	//the blob contents, starting at byte offset `offset`. The caller guarantees
+	//that the requested range lies within the blob.
+	//
+	//Implementations that cannot seek within a blob can use
+	//ReadBlobRangeBySkipping() to implement this in terms of ReadBlob().
+	ReadBlobRange(account Account, storageID string, offset, length uint64) (contents io.ReadCloser, err error)
 	//If the blob can be retrieved by a publicly accessible URL, URLForBlob shall
 	//return it. Otherwise ErrCannotGenerateURL shall be returned to instruct the
 	//caller fall back to ReadBlob().
@@ -69,7 +79,20 @@ type StorageDriver interface {
 	//lists, that does not necessarily mean it does not exist in the storage.
 	//This is because storage implementations may be backed by object stores with
 	//eventual consistency.
+	//
+	//Implementations can use CollectStorageContents() to implement this in terms
+	//of ListStorageContentsStream().
 	ListStorageContents(account Account) (blobs []StoredBlobInfo, manifests []StoredManifestInfo, err error)
+	//This is a streaming variant of ListStorageContents() that does not need to
+	//hold the entire listing in memory at once. The callbacks are called once
+	//for each blob and manifest that is found. If a callback returns an error,
+	//the listing is aborted and that error is returned.
+	//
+	//Unlike in ListStorageContents(), the same storage ID may be reported
+	//multiple times (e.g. once for the finalized blob, and once for chunks
+	//that remain in the storage), so the caller needs to merge the ChunkCount
+	//values using MergeChunkCounts().
+	ListStorageContentsStream(account Account, blobCallback func(StoredBlobInfo) error, manifestCallback func(StoredManifestInfo) error) error
 
 	//This method can be used by the StorageDriver to perform last-minute cleanup
 	//on an account that we are about to delete. This cleanup should be
@@ -78,7 +101,8 @@ type StorageDriver interface {
 	CleanupAccount(account Account) error
 }
 
-// StoredBlobInfo is returned by StorageDriver.ListStorageContents().
+// StoredBlobInfo is returned by StorageDriver.ListStorageContents() and
+// StorageDriver.ListStorageContentsStream().
 type StoredBlobInfo struct {
 	StorageID string
 	//ChunkCount is 0 for finalized blobs (that can be deleted with DeleteBlob)
@@ -86,12 +110,117 @@ type StoredBlobInfo struct {
 	ChunkCount uint32
 }
 
-// StoredManifestInfo is returned by StorageDriver.ListStorageContents().
+// StoredManifestInfo is returned by StorageDriver.ListStorageContents() and
+// StorageDriver.ListStorageContentsStream().
 type StoredManifestInfo struct {
 	RepoName string
 	Digest   string
 }
 
+// MergeChunkCounts merges two StoredBlobInfo.ChunkCount values that were
+// reported for the same storage ID by StorageDriver.ListStorageContentsStream().
+func MergeChunkCounts(lhs, rhs uint32) uint32 {
+	//The value 0 indicates a finalized blob and therefore takes precedence over actual chunk numbers.
+	if lhs == 0 || rhs == 0 {
+		return 0
+	}
+	//If 0 is not involved, the largest chunk number is gonna be the chunk count.
+	if lhs > rhs {
+		return lhs
+	}
+	return rhs
+}
+
+// CollectStorageContents implements StorageDriver.ListStorageContents() in
+// terms of StorageDriver.ListStorageContentsStream().
+func CollectStorageContents(sd StorageDriver, account Account) ([]StoredBlobInfo, []StoredManifestInfo, error) {
+	chunkCounts := make(map[string]uint32) //key = storage ID, value = same semantics as StoredBlobInfo.ChunkCount
+	var manifests []StoredManifestInfo
+
+	err := sd.ListStorageContentsStream(account,
+		func(blob StoredBlobInfo) error {
+			if prevCount, exists := chunkCounts[blob.StorageID]; exists {
+				chunkCounts[blob.StorageID] = MergeChunkCounts(prevCount, blob.ChunkCount)
+			} else {
+				chunkCounts[blob.StorageID] = blob.ChunkCount
+			}
+			return nil
+		},
+		func(manifest StoredManifestInfo) error {
+			manifests = append(manifests, manifest)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blobs := make([]StoredBlobInfo, 0, len(chunkCounts))
+	for storageID, chunkCount := range chunkCounts {
+		blobs = append(blobs, StoredBlobInfo{
+			StorageID:  storageID,
+			ChunkCount: chunkCount,
+		})
+	}
+	return blobs, manifests, nil
+}
+
+// ReadBlobRangeBySkipping implements StorageDriver.ReadBlobRange() in terms
+// of StorageDriver.ReadBlob() by discarding all bytes before the requested
+// range.
+func ReadBlobRangeBySkipping(sd StorageDriver, account Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	reader, _, err := sd.ReadBlob(account, storageID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(io.Discard, reader, int64(offset))
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return limitedReadCloser{io.LimitReader(reader, int64(length)), reader}, nil
+}
+
+// PurgeStorageContents deletes all blobs, blob uploads and manifests that
+// StorageDriver.ListStorageContents() reports for the given account. Every
+// deleted object is logged.
+//
+// This is only intended for cleaning up after drift between the DB and the
+// storage, at a point where the DB does not reference any of the account's
+// objects anymore (e.g. before StorageDriver.CleanupAccount() during a forced
+// account deletion).
+func PurgeStorageContents(sd StorageDriver, account Account) error {
+	blobs, manifests, err := sd.ListStorageContents(account)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if blob.ChunkCount > 0 {
+			logg.Info("purging residual blob upload from storage: account = %s, storageID = %s, chunks = %d", account.Name, blob.StorageID, blob.ChunkCount)
+			err = sd.AbortBlobUpload(account, blob.StorageID, blob.ChunkCount)
+		} else {
+			logg.Info("purging residual blob from storage: account = %s, storageID = %s", account.Name, blob.StorageID)
+			err = sd.DeleteBlob(account, blob.StorageID)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot purge blob %s: %w", blob.StorageID, err)
+		}
+	}
+	for _, manifest := range manifests {
+		logg.Info("purging residual manifest from storage: %s/%s@%s", account.Name, manifest.RepoName, manifest.Digest)
+		err = sd.DeleteManifest(account, manifest.RepoName, manifest.Digest)
+		if err != nil {
+			return fmt.Errorf("cannot purge manifest %s@%s: %w", manifest.RepoName, manifest.Digest, err)
+		}
+	}
+	return nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // ErrAuthDriverMismatch can be returned by StorageDriver and NameClaimDriver.
 var ErrAuthDriverMismatch = errors.New("given AuthDriver is not supported by this driver")
 
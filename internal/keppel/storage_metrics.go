@@ -0,0 +1,206 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storageOperationDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keppel_storage_operation_duration_seconds",
+			Help:    "Duration of calls into the storage driver. For ReadBlob and ReadBlobRange, this only covers the time until the blob contents start streaming.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation", "driver"},
+	)
+	storageOperationErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_storage_operation_errors",
+			Help: "Counts calls into the storage driver that returned an error.",
+		},
+		[]string{"operation", "driver"},
+	)
+	storageBlobBytesReadCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_storage_blob_bytes_read",
+			Help: "Counts blob content bytes that are read from the storage driver.",
+		},
+		[]string{"driver"},
+	)
+	storageBlobBytesWrittenCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_storage_blob_bytes_written",
+			Help: "Counts blob content bytes that are written into the storage driver.",
+		},
+		[]string{"driver"},
+	)
+	storageMetricsRegisterOnce sync.Once
+)
+
+// WithStorageMetrics wraps a StorageDriver such that the durations and errors
+// of its most important operations, as well as the amount of blob content
+// transferred, are reported as Prometheus metrics. The metrics are labeled
+// with the given driver name.
+func WithStorageMetrics(inner StorageDriver, driverName string) StorageDriver {
+	storageMetricsRegisterOnce.Do(func() {
+		prometheus.MustRegister(storageOperationDurationHistogram)
+		prometheus.MustRegister(storageOperationErrorCounter)
+		prometheus.MustRegister(storageBlobBytesReadCounter)
+		prometheus.MustRegister(storageBlobBytesWrittenCounter)
+	})
+	return &instrumentedStorageDriver{inner, driverName}
+}
+
+type instrumentedStorageDriver struct {
+	inner      StorageDriver
+	driverName string
+}
+
+// observe records the duration and outcome of an operation that started at
+// `startedAt`. It returns the given error unchanged for convenience.
+func (d *instrumentedStorageDriver) observe(operation string, startedAt time.Time, err error) error {
+	storageOperationDurationHistogram.WithLabelValues(operation, d.driverName).Observe(time.Since(startedAt).Seconds())
+	if err != nil {
+		storageOperationErrorCounter.WithLabelValues(operation, d.driverName).Inc()
+	}
+	return err
+}
+
+// AppendToBlob implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	startedAt := time.Now()
+	counter := storageBlobBytesWrittenCounter.WithLabelValues(d.driverName)
+	err := d.inner.AppendToBlob(account, storageID, chunkNumber, chunkLength, countingReader{chunk, counter})
+	return d.observe("AppendToBlob", startedAt, err)
+}
+
+// FinalizeBlob implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) FinalizeBlob(account Account, storageID string, chunkCount uint32) error {
+	startedAt := time.Now()
+	err := d.inner.FinalizeBlob(account, storageID, chunkCount)
+	return d.observe("FinalizeBlob", startedAt, err)
+}
+
+// AbortBlobUpload implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) AbortBlobUpload(account Account, storageID string, chunkCount uint32) error {
+	return d.inner.AbortBlobUpload(account, storageID, chunkCount)
+}
+
+// ReadBlob implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) ReadBlob(account Account, storageID string) (io.ReadCloser, uint64, error) {
+	startedAt := time.Now()
+	contents, sizeBytes, err := d.inner.ReadBlob(account, storageID)
+	err = d.observe("ReadBlob", startedAt, err)
+	if err != nil {
+		return contents, sizeBytes, err
+	}
+	counter := storageBlobBytesReadCounter.WithLabelValues(d.driverName)
+	return countingReadCloser{countingReader{contents, counter}, contents}, sizeBytes, nil
+}
+
+// ReadBlobRange implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) ReadBlobRange(account Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	startedAt := time.Now()
+	contents, err := d.inner.ReadBlobRange(account, storageID, offset, length)
+	err = d.observe("ReadBlobRange", startedAt, err)
+	if err != nil {
+		return contents, err
+	}
+	counter := storageBlobBytesReadCounter.WithLabelValues(d.driverName)
+	return countingReadCloser{countingReader{contents, counter}, contents}, nil
+}
+
+// URLForBlob implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) URLForBlob(account Account, storageID string) (string, error) {
+	return d.inner.URLForBlob(account, storageID)
+}
+
+// DeleteBlob implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) DeleteBlob(account Account, storageID string) error {
+	startedAt := time.Now()
+	err := d.inner.DeleteBlob(account, storageID)
+	return d.observe("DeleteBlob", startedAt, err)
+}
+
+// ReadManifest implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) ReadManifest(account Account, repoName, digest string) ([]byte, error) {
+	startedAt := time.Now()
+	contents, err := d.inner.ReadManifest(account, repoName, digest)
+	return contents, d.observe("ReadManifest", startedAt, err)
+}
+
+// WriteManifest implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) WriteManifest(account Account, repoName, digest string, contents []byte) error {
+	startedAt := time.Now()
+	err := d.inner.WriteManifest(account, repoName, digest, contents)
+	return d.observe("WriteManifest", startedAt, err)
+}
+
+// DeleteManifest implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) DeleteManifest(account Account, repoName, digest string) error {
+	return d.inner.DeleteManifest(account, repoName, digest)
+}
+
+// ListStorageContents implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) ListStorageContents(account Account) ([]StoredBlobInfo, []StoredManifestInfo, error) {
+	return d.inner.ListStorageContents(account)
+}
+
+// ListStorageContentsStream implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) ListStorageContentsStream(account Account, blobCallback func(StoredBlobInfo) error, manifestCallback func(StoredManifestInfo) error) error {
+	return d.inner.ListStorageContentsStream(account, blobCallback, manifestCallback)
+}
+
+// CleanupAccount implements the StorageDriver interface.
+func (d *instrumentedStorageDriver) CleanupAccount(account Account) error {
+	return d.inner.CleanupAccount(account)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helper types
+
+// countingReader is an io.Reader that adds the number of bytes read to a counter.
+type countingReader struct {
+	inner   io.Reader
+	counter prometheus.Counter
+}
+
+func (r countingReader) Read(buf []byte) (int, error) {
+	n, err := r.inner.Read(buf)
+	if n > 0 {
+		r.counter.Add(float64(n))
+	}
+	return n, err
+}
+
+type countingReadCloser struct {
+	countingReader
+	closer io.Closer
+}
+
+func (r countingReadCloser) Close() error {
+	return r.closer.Close()
+}
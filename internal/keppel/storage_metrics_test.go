@@ -0,0 +1,212 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// stubStorageDriver is a StorageDriver that stores at most one blob and one
+// manifest, and fails all operations while `Err` is set.
+type stubStorageDriver struct {
+	Blob     []byte
+	Manifest []byte
+	Err      error
+}
+
+func (d *stubStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	if d.Err != nil {
+		return d.Err
+	}
+	buf, err := io.ReadAll(chunk)
+	d.Blob = append(d.Blob, buf...)
+	return err
+}
+func (d *stubStorageDriver) FinalizeBlob(account Account, storageID string, chunkCount uint32) error {
+	return d.Err
+}
+func (d *stubStorageDriver) AbortBlobUpload(account Account, storageID string, chunkCount uint32) error {
+	return d.Err
+}
+func (d *stubStorageDriver) ReadBlob(account Account, storageID string) (io.ReadCloser, uint64, error) {
+	if d.Err != nil {
+		return nil, 0, d.Err
+	}
+	return io.NopCloser(bytes.NewReader(d.Blob)), uint64(len(d.Blob)), nil
+}
+func (d *stubStorageDriver) ReadBlobRange(account Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	return ReadBlobRangeBySkipping(d, account, storageID, offset, length)
+}
+func (d *stubStorageDriver) URLForBlob(account Account, storageID string) (string, error) {
+	return "", ErrCannotGenerateURL
+}
+func (d *stubStorageDriver) DeleteBlob(account Account, storageID string) error {
+	d.Blob = nil
+	return d.Err
+}
+func (d *stubStorageDriver) ReadManifest(account Account, repoName, digest string) ([]byte, error) {
+	return d.Manifest, d.Err
+}
+func (d *stubStorageDriver) WriteManifest(account Account, repoName, digest string, contents []byte) error {
+	d.Manifest = contents
+	return d.Err
+}
+func (d *stubStorageDriver) DeleteManifest(account Account, repoName, digest string) error {
+	return d.Err
+}
+func (d *stubStorageDriver) ListStorageContents(account Account) ([]StoredBlobInfo, []StoredManifestInfo, error) {
+	return nil, nil, d.Err
+}
+func (d *stubStorageDriver) ListStorageContentsStream(account Account, blobCallback func(StoredBlobInfo) error, manifestCallback func(StoredManifestInfo) error) error {
+	return d.Err
+}
+func (d *stubStorageDriver) CleanupAccount(account Account) error {
+	return d.Err
+}
+
+func TestStorageMetrics(t *testing.T) {
+	inner := &stubStorageDriver{}
+	sd := WithStorageMetrics(inner, "stub")
+	account := Account{Name: "test1"}
+
+	expectHistogramCount := func(operation string, expected int) {
+		t.Helper()
+		//testutil.ToFloat64() does not work for histograms, so we need to inspect the sample count ourselves
+		actual := histogramSampleCount(t, storageOperationDurationHistogram.WithLabelValues(operation, "stub"))
+		if actual != uint64(expected) {
+			t.Errorf("expected %d observations for %s, but got %d", expected, operation, actual)
+		}
+	}
+	expectCounter := func(c prometheus.Counter, expected float64) {
+		t.Helper()
+		actual := testutil.ToFloat64(c)
+		if actual != expected {
+			t.Errorf("expected counter value %g, but got %g", expected, actual)
+		}
+	}
+
+	//successful calls are forwarded and observed
+	err := sd.AppendToBlob(account, "foo", 1, nil, strings.NewReader("hello "))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = sd.AppendToBlob(account, "foo", 2, nil, strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = sd.FinalizeBlob(account, "foo", 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectHistogramCount("AppendToBlob", 2)
+	expectHistogramCount("FinalizeBlob", 1)
+	expectCounter(storageBlobBytesWrittenCounter.WithLabelValues("stub"), 11)
+
+	contents, sizeBytes, err := sd.ReadBlob(account, "foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf, err := io.ReadAll(contents)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = contents.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(buf) != "hello world" || sizeBytes != 11 {
+		t.Errorf("expected ReadBlob to return %q with size 11, but got %q with size %d", "hello world", string(buf), sizeBytes)
+	}
+	expectHistogramCount("ReadBlob", 1)
+	expectCounter(storageBlobBytesReadCounter.WithLabelValues("stub"), 11)
+
+	//the stub implements ReadBlobRange() with ReadBlobRangeBySkipping()
+	contents, err = sd.ReadBlobRange(account, "foo", 3, 5)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf, err = io.ReadAll(contents)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = contents.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(buf) != "lo wo" {
+		t.Errorf("expected ReadBlobRange to return %q, but got %q", "lo wo", string(buf))
+	}
+	expectHistogramCount("ReadBlobRange", 1)
+	expectCounter(storageBlobBytesReadCounter.WithLabelValues("stub"), 16)
+
+	err = sd.WriteManifest(account, "repo", "sha256:abc", []byte("{}"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	manifest, err := sd.ReadManifest(account, "repo", "sha256:abc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(manifest) != "{}" {
+		t.Errorf("expected ReadManifest to return %q, but got %q", "{}", string(manifest))
+	}
+	expectHistogramCount("WriteManifest", 1)
+	expectHistogramCount("ReadManifest", 1)
+
+	//errors are forwarded unchanged and counted
+	inner.Err = errors.New("storage is on fire")
+	_, _, err = sd.ReadBlob(account, "foo")
+	if err != inner.Err {
+		t.Errorf("expected ReadBlob to return %v, but got %v", inner.Err, err)
+	}
+	err = sd.DeleteBlob(account, "foo")
+	if err != inner.Err {
+		t.Errorf("expected DeleteBlob to return %v, but got %v", inner.Err, err)
+	}
+	expectHistogramCount("ReadBlob", 2)
+	expectHistogramCount("DeleteBlob", 1)
+	expectCounter(storageOperationErrorCounter.WithLabelValues("ReadBlob", "stub"), 1)
+	expectCounter(storageOperationErrorCounter.WithLabelValues("DeleteBlob", "stub"), 1)
+	expectCounter(storageOperationErrorCounter.WithLabelValues("AppendToBlob", "stub"), 0)
+
+	//uninstrumented operations are forwarded as well
+	_, err = sd.URLForBlob(account, "foo")
+	if err != ErrCannotGenerateURL {
+		t.Errorf("expected URLForBlob to return %v, but got %v", ErrCannotGenerateURL, err)
+	}
+}
+
+func histogramSampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	err := o.(prometheus.Metric).Write(&m) //nolint:errcheck
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return m.GetHistogram().GetSampleCount()
+}
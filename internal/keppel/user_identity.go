@@ -73,6 +73,14 @@ type UserIdentity interface {
 	SerializeToJSON() (typeName string, payload []byte, err error)
 }
 
+// GroupMembership is an optional interface for UserIdentity implementations
+// that know which groups the user belongs to (e.g. from the claims of an OIDC
+// token). RBAC policies with a "match_group" attribute only apply to user
+// identities implementing this interface.
+type GroupMembership interface {
+	GroupNames() []string
+}
+
 var authzDeserializers = make(map[string]func([]byte, AuthDriver) (UserIdentity, error))
 
 // RegisterUserIdentity registers a type implementing the UserIdentity
@@ -95,7 +103,8 @@ func DeserializeUserIdentity(typeName string, payload []byte, ad AuthDriver) (Us
 	if deserializer == nil {
 		return nil, fmt.Errorf("cannot unmarshal embedded authorization with unknown payload type %q", typeName)
 	}
-	return deserializer(payload, ad)
+	//deserializers may need to type-cast the AuthDriver into their concrete type
+	return deserializer(payload, UnwrapAuthDriver(ad))
 }
 
 type compressedPayload struct {
@@ -0,0 +1,68 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sapcc/keppel/internal/clair"
+)
+
+// VulnerabilityPolicy is a policy restricting which images can be pulled from
+// an account, based on their vulnerability status. It is stored in serialized
+// form in the VulnerabilityPolicyJSON field of type Account.
+type VulnerabilityPolicy struct {
+	//BlockPullsAtSeverity, if not empty, denies pulls of images whose
+	//vulnerability status is equal to or more severe than this.
+	BlockPullsAtSeverity clair.VulnerabilityStatus `json:"block_pulls_at_severity,omitempty"`
+	//BlockPullsWhilePending denies pulls of images that have not been scanned yet.
+	BlockPullsWhilePending bool `json:"block_pulls_while_pending,omitempty"`
+}
+
+// Validate returns an error if this policy is invalid.
+func (p VulnerabilityPolicy) Validate() error {
+	if p.BlockPullsAtSeverity != "" && !p.BlockPullsAtSeverity.IsAtLeast(clair.UnknownSeverity) {
+		return fmt.Errorf("%q is not a valid severity for a vulnerability policy", p.BlockPullsAtSeverity)
+	}
+	return nil
+}
+
+// CheckPull returns an error describing why an image with the given
+// vulnerability status may not be pulled, or nil if the pull is allowed.
+func (p VulnerabilityPolicy) CheckPull(status clair.VulnerabilityStatus) error {
+	if p.BlockPullsWhilePending && status == clair.PendingVulnerabilityStatus {
+		return fmt.Errorf("image has vulnerability status %s, and this account does not allow pulling images before their vulnerability scan has finished", status)
+	}
+	if p.BlockPullsAtSeverity != "" && status.IsAtLeast(p.BlockPullsAtSeverity) {
+		return fmt.Errorf("image has vulnerability status %s, and this account does not allow pulling images with vulnerabilities of severity %s or higher", status, p.BlockPullsAtSeverity)
+	}
+	return nil
+}
+
+// ParseVulnerabilityPolicy parses the vulnerability policy for the given
+// account. If the account does not have a vulnerability policy, nil is returned.
+func (a Account) ParseVulnerabilityPolicy() (*VulnerabilityPolicy, error) {
+	if a.VulnerabilityPolicyJSON == "" {
+		return nil, nil
+	}
+	var policy VulnerabilityPolicy
+	err := json.Unmarshal([]byte(a.VulnerabilityPolicyJSON), &policy)
+	return &policy, err
+}
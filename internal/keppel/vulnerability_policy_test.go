@@ -0,0 +1,71 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/keppel/internal/clair"
+)
+
+func TestVulnerabilityPolicy(t *testing.T) {
+	expect := func(policy VulnerabilityPolicy, status clair.VulnerabilityStatus, expectAllowed bool) {
+		t.Helper()
+		err := policy.CheckPull(status)
+		if expectAllowed && err != nil {
+			t.Errorf("expected pull of %s image to be allowed by %#v, but got: %s", status, policy, err.Error())
+		}
+		if !expectAllowed && err == nil {
+			t.Errorf("expected pull of %s image to be denied by %#v, but it was allowed", status, policy)
+		}
+	}
+
+	//threshold at Critical: only Critical and above are denied
+	criticalPolicy := VulnerabilityPolicy{BlockPullsAtSeverity: clair.CriticalSeverity}
+	expect(criticalPolicy, clair.CriticalSeverity, false)
+	expect(criticalPolicy, clair.Defcon1Severity, false)
+	expect(criticalPolicy, clair.HighSeverity, true)
+	expect(criticalPolicy, clair.MediumSeverity, true)
+	expect(criticalPolicy, clair.CleanSeverity, true)
+	//statuses without findings are not affected by the threshold
+	expect(criticalPolicy, clair.ErrorVulnerabilityStatus, true)
+	expect(criticalPolicy, clair.UnsupportedVulnerabilityStatus, true)
+	expect(criticalPolicy, clair.PendingVulnerabilityStatus, true)
+
+	//the stance on Pending images is configured separately
+	pendingPolicy := VulnerabilityPolicy{BlockPullsAtSeverity: clair.CriticalSeverity, BlockPullsWhilePending: true}
+	expect(pendingPolicy, clair.PendingVulnerabilityStatus, false)
+	expect(pendingPolicy, clair.MediumSeverity, true)
+	expect(pendingPolicy, clair.CriticalSeverity, false)
+	expect(VulnerabilityPolicy{BlockPullsWhilePending: true}, clair.CriticalSeverity, true)
+
+	//only actual severities can be used as threshold
+	for _, status := range []clair.VulnerabilityStatus{"", clair.UnknownSeverity, clair.LowSeverity, clair.Defcon1Severity} {
+		err := VulnerabilityPolicy{BlockPullsAtSeverity: status}.Validate()
+		if err != nil {
+			t.Errorf("expected threshold %q to be valid, but got: %s", status, err.Error())
+		}
+	}
+	for _, status := range []clair.VulnerabilityStatus{"Dangerous", clair.CleanSeverity, clair.PendingVulnerabilityStatus, clair.ErrorVulnerabilityStatus} {
+		err := VulnerabilityPolicy{BlockPullsAtSeverity: status}.Validate()
+		if err == nil {
+			t.Errorf("expected threshold %q to be rejected, but it was accepted", status)
+		}
+	}
+}
@@ -20,12 +20,14 @@
 package processor
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution"
@@ -47,7 +49,11 @@ func (p *Processor) ValidateExistingBlob(account keppel.Account, blob keppel.Blo
 		return fmt.Errorf("cannot parse blob digest: %s", err.Error())
 	}
 
-	readCloser, _, err := p.sd.ReadBlob(account, blob.StorageID)
+	storageAccount, err := keppel.FindBlobStorageAccount(p.db, blob, account)
+	if err != nil {
+		return err
+	}
+	readCloser, _, err := p.sd.ReadBlob(storageAccount, blob.StorageID)
 	if err != nil {
 		return err
 	}
@@ -123,6 +129,52 @@ var (
 	ErrConcurrentReplication = errors.New("currently replicating")
 )
 
+// Blob replications that are currently running in this process. When the
+// same blob is requested multiple times at once, only the first request
+// fetches it from upstream, and all others wait for that replication to
+// finish. (Replications in other processes are detected through the
+// `pending_blobs` table instead.)
+var (
+	replicationsInFlight      = make(map[string]*replicationInFlight) //key = account name + "/" + digest
+	replicationsInFlightMutex sync.Mutex
+)
+
+type replicationInFlight struct {
+	done chan struct{}
+	err  error //only valid after `done` was closed
+}
+
+// UpstreamFetchLimiter limits how many blobs can be fetched from upstream
+// registries concurrently (see keppel.Configuration.MaxConcurrentUpstreamFetches).
+// Since Processor instances are short-lived, the limiter is created once per
+// process and given to each Processor with WithUpstreamFetchLimiter().
+type UpstreamFetchLimiter struct {
+	sem chan struct{}
+}
+
+// NewUpstreamFetchLimiter creates a new UpstreamFetchLimiter. If the given
+// limit is not positive, nil is returned, which does not limit anything.
+func NewUpstreamFetchLimiter(limit int) *UpstreamFetchLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &UpstreamFetchLimiter{make(chan struct{}, limit)}
+}
+
+// Blocks until an upstream fetch may be started, or until the context expires.
+// On success, the returned function must be called when the upstream fetch is done.
+func (l *UpstreamFetchLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // ReplicateBlob replicates the given blob from its account's upstream registry.
 //
 // If a ResponseWriter is given, the response to the GET request to the upstream
@@ -130,7 +182,39 @@ var (
 // our local registry. The result value `responseWasWritten` indicates whether
 // this happened. It may be false if an error occurred before writing into the
 // ResponseWriter took place.
-func (p *Processor) ReplicateBlob(blob keppel.Blob, account keppel.Account, repo keppel.Repository, w http.ResponseWriter) (responseWasWritten bool, returnErr error) {
+//
+// If the same blob is already being replicated by a concurrent call in this
+// process, this call waits for that replication to finish instead of fetching
+// the blob again. In this case, `responseWasWritten` is always false, and a
+// nil error indicates that the blob can now be served from local storage.
+//
+// In read-only mode, replication is not possible and an error is returned.
+func (p *Processor) ReplicateBlob(ctx context.Context, blob keppel.Blob, account keppel.Account, repo keppel.Repository, w http.ResponseWriter) (responseWasWritten bool, returnErr error) {
+	if p.cfg.ReadOnly {
+		return false, keppel.ReadOnlyError()
+	}
+
+	key := account.Name + "/" + blob.Digest
+	replicationsInFlightMutex.Lock()
+	if call, exists := replicationsInFlight[key]; exists {
+		replicationsInFlightMutex.Unlock()
+		<-call.done
+		return false, call.err
+	}
+	call := &replicationInFlight{done: make(chan struct{})}
+	replicationsInFlight[key] = call
+	replicationsInFlightMutex.Unlock()
+
+	//NOTE: This deferred function runs after all others, so that waiting calls
+	//only wake up once the blob is fully stored and the `pending_blobs` entry is gone.
+	defer func() {
+		replicationsInFlightMutex.Lock()
+		delete(replicationsInFlight, key)
+		replicationsInFlightMutex.Unlock()
+		call.err = returnErr
+		close(call.done)
+	}()
+
 	//mark this blob as currently being replicated
 	pendingBlob := keppel.PendingBlob{
 		AccountName:  account.Name,
@@ -164,12 +248,19 @@ func (p *Processor) ReplicateBlob(blob keppel.Blob, account keppel.Account, repo
 		}
 	}()
 
+	//wait for a free slot if the number of concurrent upstream fetches is limited
+	releaseUpstreamFetchSlot, err := p.ufl.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer releaseUpstreamFetchSlot()
+
 	//query upstream for the blob
 	client, err := p.getRepoClientForUpstream(account, repo)
 	if err != nil {
 		return false, err
 	}
-	blobReadCloser, blobLengthBytes, err := client.DownloadBlob(digest.Digest(blob.Digest))
+	blobReadCloser, blobLengthBytes, err := client.DownloadBlob(digest.Digest(blob.Digest), nil)
 	if err != nil {
 		return false, err
 	}
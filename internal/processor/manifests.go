@@ -19,6 +19,7 @@
 package processor
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -62,6 +63,22 @@ var checkTagExistsAtSameDigestQuery = sqlext.SimplifyWhitespace(`
 // given reference. If the reference is a digest, it is validated. Otherwise, a
 // tag with that name is created that points to the new manifest.
 func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel.Repository, m IncomingManifest, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	maxSizeBytes := account.EffectiveMaxManifestSizeBytes()
+	if uint64(len(m.Contents)) > maxSizeBytes {
+		return nil, keppel.ErrManifestInvalid.With(
+			"manifest is too large: got %d bytes, but this account only allows up to %d bytes",
+			len(m.Contents), maxSizeBytes,
+		)
+	}
+
+	//nonstandard media types are only accepted if the account allows them (this
+	//is not checked in validateAndStoreManifestCommon() since manifests that
+	//were already accepted shall not be rejected during revalidation when the
+	//account configuration changes)
+	if m.MediaType != "" && !account.AcceptsManifestMediaType(m.MediaType) {
+		return nil, keppel.ErrManifestInvalid.With("unsupported manifest media type: " + m.MediaType)
+	}
+
 	//check if the objects we want to create already exist in the database; this
 	//check is not 100% reliable since it does not run in the same transaction as
 	//the actual upsert, so results should be taken with a grain of salt; but the
@@ -84,7 +101,7 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 	//the quota check can be skipped if we are sure that we won't need to insert
 	//a new row into the manifests table
 	if !manifestExistsAlready {
-		err = p.checkQuotaForManifestPush(account)
+		err = p.CheckQuotaForManifestPush(account)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +122,19 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 	err = p.validateAndStoreManifestCommon(account, repo, manifest, m.Contents,
 		func(tx *gorp.Transaction) error {
 			if m.Reference.IsTag() {
+				err = checkTagImmutability(tx, account, repo, m.Reference.Tag, manifest.Digest)
+				if err != nil {
+					return err
+				}
+				//signatures are pushed as separate manifests after the signed
+				//manifest, so they can only be checked when the manifest gets tagged
+				//(tags that were already accepted before are not checked again)
+				if !tagExistsAlready {
+					err = p.checkSignaturePolicy(tx, account, repo, manifest.Digest)
+					if err != nil {
+						return err
+					}
+				}
 				err = upsertTag(tx, keppel.Tag{
 					RepositoryID: repo.ID,
 					Name:         m.Reference.Tag,
@@ -178,6 +208,31 @@ func (p *Processor) ValidateExistingManifest(account keppel.Account, repo keppel
 	)
 }
 
+// RevalidateExistingManifest calls ValidateExistingManifest and records the
+// outcome in the `validated_at` and `validation_error_message` fields of the
+// manifest. The first return value is the validation error (if any). The
+// second return value is only set if the outcome could not be recorded.
+func (p *Processor) RevalidateExistingManifest(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, now time.Time) (validationErr, err error) {
+	validationErr = p.ValidateExistingManifest(account, repo, manifest, now)
+	if validationErr == nil {
+		//update `validated_at` and reset error message
+		_, err = p.db.Exec(`
+			UPDATE manifests SET validated_at = $1, validation_error_message = ''
+			 WHERE repo_id = $2 AND digest = $3`,
+			now, repo.ID, manifest.Digest,
+		)
+	} else {
+		//record the error message, and also update the `validated_at` timestamp
+		//to ensure that the janitor does not get stuck on this manifest
+		_, err = p.db.Exec(`
+			UPDATE manifests SET validated_at = $1, validation_error_message = $2
+			 WHERE repo_id = $3 AND digest = $4`,
+			now, validationErr.Error(), repo.ID, manifest.Digest,
+		)
+	}
+	return validationErr, err
+}
+
 func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, manifestBytes []byte, actionBeforeCommit func(*gorp.Transaction) error) error {
 	//parse manifest
 	manifestParsed, manifestDesc, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
@@ -201,6 +256,16 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		manifest.SizeBytes += uint64(desc.Size)
 	}
 
+	//remember the subject (if any) for the referrers API; the subject manifest
+	//does not need to exist, so it is not tracked as a manifest reference
+	if subject := manifestParsed.Subject(); subject != nil {
+		manifest.SubjectDigest = subject.Digest.String()
+		manifest.ArtifactType = manifestParsed.ArtifactType()
+	} else {
+		manifest.SubjectDigest = ""
+		manifest.ArtifactType = ""
+	}
+
 	return p.insideTransaction(func(tx *gorp.Transaction) error {
 		refsInfo, err := findManifestReferencedObjects(tx, account, repo, manifestParsed)
 		if err != nil {
@@ -213,29 +278,45 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 			return err
 		}
 
-		//enforce account-specific validation rules on manifest, but not list manifest
-		//and only when pushing (not when validating at a later point in time,
-		//the set of RequiredLabels could have been changed by then)
-		labelsRequired := manifest.PushedAt == manifest.ValidatedAt && account.RequiredLabels != "" &&
-			manifest.MediaType != manifestlist.MediaTypeManifestList && manifest.MediaType != imagespec.MediaTypeImageIndex
-		if labelsRequired {
+		//OCI manifests can carry annotations in addition to the labels in the
+		//image config; we treat both the same, but the config labels take
+		//precedence if both are present
+		labels := make(map[string]string, len(configInfo.Labels))
+		for key, value := range manifestParsed.Annotations() {
+			labels[key] = value
+		}
+		for key, value := range configInfo.Labels {
+			labels[key] = value
+		}
+
+		//enforce account-specific validation rules on manifest, but only when
+		//pushing (not when validating at a later point in time, the set of
+		//RequiredLabels could have been changed by then)
+		if manifest.PushedAt == manifest.ValidatedAt && account.RequiredLabels != "" {
 			requiredLabels := strings.Split(account.RequiredLabels, ",")
-			var missingLabels []string
-			for _, l := range requiredLabels {
-				if _, exists := configInfo.Labels[l]; !exists {
-					missingLabels = append(missingLabels, l)
+			if manifest.MediaType == manifestlist.MediaTypeManifestList || manifest.MediaType == imagespec.MediaTypeImageIndex {
+				//list manifests do not have labels of their own, so each of the
+				//constituent manifests must have the required labels instead
+				for _, childDigest := range refsInfo.ManifestDigests {
+					missingLabels := findMissingLabels(requiredLabels, refsInfo.ChildLabels[childDigest])
+					if len(missingLabels) > 0 {
+						msg := fmt.Sprintf("missing required labels on manifest %s: %s", childDigest, strings.Join(missingLabels, ", "))
+						return keppel.ErrManifestInvalid.With(msg)
+					}
+				}
+			} else {
+				missingLabels := findMissingLabels(requiredLabels, labels)
+				if len(missingLabels) > 0 {
+					msg := "missing required labels: " + strings.Join(missingLabels, ", ")
+					return keppel.ErrManifestInvalid.With(msg)
 				}
-			}
-			if len(missingLabels) > 0 {
-				msg := "missing required labels: " + strings.Join(missingLabels, ", ")
-				return keppel.ErrManifestInvalid.With(msg)
 			}
 		}
 
-		//for plain manifests, we report the labels from the manifest config; for
-		//list manifests (which do not have a config), we instead report all the
-		//labels that the constituent manifests agree on
-		reportedLabels := configInfo.Labels
+		//for plain manifests, we report the labels from the manifest config and
+		//annotations; for list manifests (which do not have a config), we
+		//instead report all the labels that the constituent manifests agree on
+		reportedLabels := labels
 		if manifest.MediaType == manifestlist.MediaTypeManifestList || manifest.MediaType == imagespec.MediaTypeImageIndex {
 			reportedLabels = refsInfo.CommonLabels
 		}
@@ -253,7 +334,14 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		manifest.MaxLayerCreatedAt = keppel.MaxMaybeTime(refsInfo.MaxCreationTime, configInfo.MaxCreationTime)
 
 		//create or update database entries
-		err = upsertManifest(tx, *manifest, manifestBytes)
+		contentBytes := manifestBytes
+		if p.cfg.CompressManifestContents {
+			contentBytes, err = keppel.CompressManifestContent(manifestBytes)
+			if err != nil {
+				return err
+			}
+		}
+		err = upsertManifest(tx, *manifest, contentBytes)
 		if err != nil {
 			return err
 		}
@@ -270,6 +358,15 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 	})
 }
 
+func findMissingLabels(requiredLabels []string, labels map[string]string) (missingLabels []string) {
+	for _, l := range requiredLabels {
+		if _, exists := labels[l]; !exists {
+			missingLabels = append(missingLabels, l)
+		}
+	}
+	return missingLabels
+}
+
 type blobRef struct {
 	ID        int64
 	MediaType string
@@ -280,6 +377,7 @@ type manifestRefsInfo struct {
 	BlobRefs        []blobRef
 	ManifestDigests []string
 	CommonLabels    map[string]string
+	ChildLabels     map[string]map[string]string //key = child manifest digest
 	MinCreationTime *time.Time
 	MaxCreationTime *time.Time
 	SumChildSizes   uint64
@@ -354,6 +452,10 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account keppel.Account,
 
 		//compute aggregate information for all child manifests
 		result.ManifestDigests = append(result.ManifestDigests, desc.Digest.String())
+		if result.ChildLabels == nil {
+			result.ChildLabels = make(map[string]map[string]string)
+		}
+		result.ChildLabels[desc.Digest.String()] = labels
 		result.MinCreationTime = keppel.MinMaybeTime(result.MinCreationTime, manifest.MinLayerCreatedAt)
 		result.MaxCreationTime = keppel.MaxMaybeTime(result.MaxCreationTime, manifest.MaxLayerCreatedAt)
 		result.SumChildSizes += manifest.SizeBytes
@@ -378,17 +480,18 @@ func parseManifestConfig(tx *gorp.Transaction, sd keppel.StorageDriver, account
 	}
 
 	//load the config blob
-	storageID, err := tx.SelectStr(
-		`SELECT storage_id FROM blobs WHERE account_name = $1 AND digest = $2`,
-		account.Name, configBlob.Digest.String(),
-	)
+	blob, err := keppel.FindBlobByAccountName(tx, configBlob.Digest, account)
 	if err != nil {
 		return manifestConfigInfo{}, err
 	}
-	if storageID == "" {
+	if blob.StorageID == "" {
 		return manifestConfigInfo{}, keppel.ErrManifestBlobUnknown.With("").WithDetail(configBlob.Digest.String())
 	}
-	blobReader, _, err := sd.ReadBlob(account, storageID)
+	storageAccount, err := keppel.FindBlobStorageAccount(tx, *blob, account)
+	if err != nil {
+		return manifestConfigInfo{}, err
+	}
+	blobReader, _, err := sd.ReadBlob(storageAccount, blob.StorageID)
 	if err != nil {
 		return manifestConfigInfo{}, err
 	}
@@ -434,11 +537,12 @@ func parseManifestConfig(tx *gorp.Transaction, sd keppel.StorageDriver, account
 }
 
 var upsertManifestQuery = sqlext.SimplifyWhitespace(`
-	INSERT INTO manifests (repo_id, digest, media_type, size_bytes, pushed_at, validated_at, labels_json, min_layer_created_at, max_layer_created_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	INSERT INTO manifests (repo_id, digest, media_type, size_bytes, pushed_at, validated_at, labels_json, min_layer_created_at, max_layer_created_at, subject_digest, artifact_type)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	ON CONFLICT (repo_id, digest) DO UPDATE
 		SET size_bytes = EXCLUDED.size_bytes, validated_at = EXCLUDED.validated_at, labels_json = EXCLUDED.labels_json,
-		min_layer_created_at = EXCLUDED.min_layer_created_at, max_layer_created_at = EXCLUDED.max_layer_created_at
+		min_layer_created_at = EXCLUDED.min_layer_created_at, max_layer_created_at = EXCLUDED.max_layer_created_at,
+		subject_digest = EXCLUDED.subject_digest, artifact_type = EXCLUDED.artifact_type
 `)
 
 var upsertManifestContentQuery = sqlext.SimplifyWhitespace(`
@@ -448,12 +552,14 @@ var upsertManifestContentQuery = sqlext.SimplifyWhitespace(`
 		SET content = EXCLUDED.content
 `)
 
-func upsertManifest(db gorp.SqlExecutor, m keppel.Manifest, manifestBytes []byte) error {
-	_, err := db.Exec(upsertManifestQuery, m.RepositoryID, m.Digest, m.MediaType, m.SizeBytes, m.PushedAt, m.ValidatedAt, m.LabelsJSON, m.MinLayerCreatedAt, m.MaxLayerCreatedAt)
+// NOTE: `contentBytes` is stored in manifest_contents as-is, so it needs to be
+// compressed beforehand if desired.
+func upsertManifest(db gorp.SqlExecutor, m keppel.Manifest, contentBytes []byte) error {
+	_, err := db.Exec(upsertManifestQuery, m.RepositoryID, m.Digest, m.MediaType, m.SizeBytes, m.PushedAt, m.ValidatedAt, m.LabelsJSON, m.MinLayerCreatedAt, m.MaxLayerCreatedAt, m.SubjectDigest, m.ArtifactType)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(upsertManifestContentQuery, m.RepositoryID, m.Digest, manifestBytes)
+	_, err = db.Exec(upsertManifestContentQuery, m.RepositoryID, m.Digest, contentBytes)
 	return err
 }
 
@@ -473,6 +579,28 @@ func upsertTag(db gorp.SqlExecutor, t keppel.Tag) error {
 	return err
 }
 
+// Returns an error if the given tag is immutable in this account and
+// currently points to a different manifest than `newDigest`.
+func checkTagImmutability(db gorp.SqlExecutor, account keppel.Account, repo keppel.Repository, tagName, newDigest string) error {
+	isImmutable, err := account.IsTagImmutable(tagName)
+	if err != nil || !isImmutable {
+		return err
+	}
+	existingDigest, err := db.SelectStr(
+		`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2 FOR UPDATE`,
+		repo.ID, tagName,
+	)
+	if err != nil {
+		return err
+	}
+	if existingDigest != "" && existingDigest != newDigest {
+		return keppel.ErrDenied.With(
+			"tag %q is immutable and already points to manifest %s", tagName, existingDigest,
+		).WithStatus(http.StatusConflict)
+	}
+	return nil
+}
+
 func maintainManifestBlobRefs(tx *gorp.Transaction, m keppel.Manifest, referencedBlobs []blobRef) error {
 	//maintain media type on blobs (we have no way of knowing the media type of a
 	//blob when it gets uploaded by itself, but manifests always include the
@@ -629,9 +757,27 @@ func (e UpstreamManifestMissingError) Error() string {
 }
 
 // ReplicateManifest replicates the manifest from its account's upstream registry.
-// On success, the manifest's metadata and contents are returned.
-func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Repository, reference keppel.ManifestReference, actx keppel.AuditContext) (*keppel.Manifest, []byte, error) {
-	manifestBytes, manifestMediaType, err := p.downloadManifestViaInboundCache(account, repo, reference)
+// On success, the manifest's metadata and contents are returned. In read-only
+// mode, replication is not possible and an error is returned.
+func (p *Processor) ReplicateManifest(ctx context.Context, account keppel.Account, repo keppel.Repository, reference keppel.ManifestReference, actx keppel.AuditContext) (*keppel.Manifest, []byte, error) {
+	if p.cfg.ReadOnly {
+		return nil, nil, keppel.ReadOnlyError()
+	}
+
+	isAllowed, err := account.IsRepoAllowedForReplication(repo.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isAllowed {
+		return nil, nil, keppel.ErrDenied.With("repository %s may not be replicated into this account", repo.FullName()).WithStatus(http.StatusForbidden)
+	}
+
+	//Negative cache entries are only honored for anonymous users. This avoids
+	//repeated upstream lookups for bogus tags by anonymous clients, while still
+	//allowing authenticated users to observe a manifest as soon as it appears
+	//upstream (which then also replaces the negative cache entry).
+	isAnonymous := actx.UserIdentity != nil && actx.UserIdentity.UserType() == keppel.AnonymousUser
+	manifestBytes, manifestMediaType, err := p.downloadManifestViaInboundCache(account, repo, reference, isAnonymous)
 	if err != nil {
 		if errorIsManifestNotFound(err) {
 			return nil, nil, UpstreamManifestMissingError{reference, err}
@@ -649,7 +795,7 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 	for _, desc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
 		_, err := keppel.FindManifest(p.db, repo, desc.Digest.String())
 		if err == sql.ErrNoRows {
-			_, _, err = p.ReplicateManifest(account, repo, keppel.ManifestReference{Digest: desc.Digest}, actx)
+			_, _, err = p.ReplicateManifest(ctx, account, repo, keppel.ManifestReference{Digest: desc.Digest}, actx)
 		}
 		if err != nil {
 			return nil, nil, err
@@ -682,7 +828,7 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 			return nil, nil, err
 		}
 		if configBlob.StorageID == "" {
-			_, err = p.ReplicateBlob(*configBlob, account, repo, nil)
+			_, err = p.ReplicateBlob(ctx, *configBlob, account, repo, nil)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -702,7 +848,7 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 // upstream registry. If not, false is returned, An error is returned only if
 // the account is not a replica, or if the upstream registry cannot be queried.
 func (p *Processor) CheckManifestOnPrimary(account keppel.Account, repo keppel.Repository, reference keppel.ManifestReference) (bool, error) {
-	_, _, err := p.downloadManifestViaInboundCache(account, repo, reference)
+	_, _, err := p.downloadManifestViaInboundCache(account, repo, reference, false)
 	if err != nil {
 		if errorIsManifestNotFound(err) {
 			return false, nil
@@ -731,7 +877,8 @@ func errorIsUpstreamRateLimit(err error) bool {
 
 // Downloads a manifest from an account's upstream using
 // RepoClient.DownloadManifest(), but also takes into account the inbound cache.
-func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo keppel.Repository, ref keppel.ManifestReference) (manifestBytes []byte, manifestMediaType string, err error) {
+// If `useNegativeCache` is false, negative cache entries are ignored.
+func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo keppel.Repository, ref keppel.ManifestReference, useNegativeCache bool) (manifestBytes []byte, manifestMediaType string, err error) {
 	c, err := p.getRepoClientForUpstream(account, repo)
 	if err != nil {
 		return nil, "", err
@@ -745,11 +892,16 @@ func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo
 	}
 	labels := prometheus.Labels{"external_hostname": c.Host}
 	manifestBytes, manifestMediaType, err = p.icd.LoadManifest(imageRef, p.timeNow())
-	if err == nil {
+	switch {
+	case err == nil:
 		InboundManifestCacheHitCounter.With(labels).Inc()
 		return manifestBytes, manifestMediaType, nil
-	}
-	if err != sql.ErrNoRows {
+	case err == keppel.ErrManifestNotFoundUpstream:
+		if useNegativeCache {
+			InboundManifestCacheHitCounter.With(labels).Inc()
+			return nil, "", keppel.ErrManifestUnknown.With(err.Error())
+		}
+	case err != sql.ErrNoRows:
 		return nil, "", err
 	}
 
@@ -768,6 +920,14 @@ func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo
 		}
 	}
 	if err != nil {
+		//remember nonexistent manifests for a short while to avoid hammering the
+		//upstream with repeated requests for bogus tags
+		if errorIsManifestNotFound(err) && p.cfg.InboundCacheNegativeTTL > 0 {
+			storeErr := p.icd.StoreManifestNotFound(imageRef, p.timeNow(), p.cfg.InboundCacheNegativeTTL)
+			if storeErr != nil {
+				logg.Error("while placing negative entry for %s in the inbound cache: %s", imageRef.String(), storeErr.Error())
+			}
+		}
 		return nil, "", err
 	}
 
@@ -787,7 +947,12 @@ func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo
 func (p *Processor) downloadManifestViaPullDelegation(imageRef keppel.ImageReference, userName, password string) (respBytes []byte, contentType string, success bool) {
 	//select a peer at random
 	var peer keppel.Peer
-	err := p.db.SelectOne(&peer, `SELECT * FROM peers WHERE our_password != '' ORDER BY RANDOM() LIMIT 1`)
+	query := `SELECT * FROM peers WHERE our_password != '' ORDER BY RANDOM() LIMIT 1`
+	if p.cfg.PeeringMode == keppel.PeeringModeMTLS {
+		//in mTLS mode, we do not need a password to talk to our peers
+		query = `SELECT * FROM peers ORDER BY RANDOM() LIMIT 1`
+	}
+	err := p.db.SelectOne(&peer, query)
 	if err == sql.ErrNoRows {
 		//no peers set up - just skip this step without logging anything
 		return nil, "", false
@@ -816,7 +981,7 @@ func (p *Processor) downloadManifestViaPullDelegation(imageRef keppel.ImageRefer
 	req.Header.Set("X-Keppel-Delegated-Pull-Username", userName)
 	req.Header.Set("X-Keppel-Delegated-Pull-Password", password)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.cfg.PeerHTTPClient().Do(req)
 	if err != nil {
 		logg.Error("during GET %s: %s", reqURL, err.Error())
 		return nil, "", false
@@ -836,16 +1001,109 @@ func (p *Processor) downloadManifestViaPullDelegation(imageRef keppel.ImageRefer
 	return respBytes, resp.Header.Get("Content-Type"), true
 }
 
+var insertManifestTranslationQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO manifest_translations (repo_id, source_digest, target_digest, media_type, content)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT DO NOTHING
+`)
+
+// ConvertManifestToOCI returns the OCI equivalent of the given Docker schema2
+// image manifest. The converted manifest is stored in the
+// `manifest_translations` table, so that it only needs to be computed once,
+// and so that clients can pull it by its own digest afterwards (see
+// FindManifestTranslation). In read-only mode, the converted manifest is
+// returned without being stored.
+func (p *Processor) ConvertManifestToOCI(repo keppel.Repository, manifest keppel.Manifest, manifestBytes []byte) (*keppel.ManifestTranslation, error) {
+	var mt keppel.ManifestTranslation
+	err := p.db.SelectOne(&mt,
+		`SELECT * FROM manifest_translations WHERE repo_id = $1 AND source_digest = $2 AND media_type = $3`,
+		repo.ID, manifest.Digest, imagespec.MediaTypeImageManifest,
+	)
+	if err == nil {
+		return &mt, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	converted, desc, err := keppel.ConvertManifestToOCI(manifest.MediaType, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	mt = keppel.ManifestTranslation{
+		RepositoryID: repo.ID,
+		SourceDigest: manifest.Digest,
+		TargetDigest: desc.Digest.String(),
+		MediaType:    desc.MediaType,
+		Content:      converted,
+	}
+	if p.cfg.ReadOnly {
+		return &mt, nil
+	}
+	_, err = p.db.Exec(insertManifestTranslationQuery, mt.RepositoryID, mt.SourceDigest, mt.TargetDigest, mt.MediaType, mt.Content)
+	if err != nil {
+		return nil, err
+	}
+	return &mt, nil
+}
+
+// FindManifestTranslation finds a manifest that was previously produced by
+// ConvertManifestToOCI, using the digest of the converted manifest. If there
+// is no such manifest, sql.ErrNoRows is returned.
+func (p *Processor) FindManifestTranslation(repo keppel.Repository, targetDigest digest.Digest) (*keppel.ManifestTranslation, error) {
+	var mt keppel.ManifestTranslation
+	err := p.db.SelectOne(&mt,
+		`SELECT * FROM manifest_translations WHERE repo_id = $1 AND target_digest = $2`,
+		repo.ID, targetDigest.String(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &mt, nil
+}
+
+var deleteTagsOfManifestQuery = sqlext.SimplifyWhitespace(`
+	WITH deleted AS (
+		DELETE FROM tags WHERE repo_id = $1 AND digest = $2 RETURNING name
+	)
+	SELECT name FROM deleted ORDER BY name
+`)
+
 // DeleteManifest deletes the given manifest from both the database and the
-// backing storage.
+// backing storage. All tags pointing to the manifest are deleted as well.
 //
 // If the manifest does not exist, sql.ErrNoRows is returned.
 func (p *Processor) DeleteManifest(account keppel.Account, repo keppel.Repository, digestStr string, actx keppel.AuditContext) error {
-	result, err := p.db.Exec(
-		//this also deletes tags referencing this manifest because of "ON DELETE CASCADE"
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	//if the account has a retention period for deleted manifests, keep a copy
+	//of the manifest around until then (if the DELETE below fails, this is
+	//rolled back along with it)
+	if account.ManifestRetentionSecs > 0 {
+		err = p.moveManifestToTrash(tx, account, repo, digestStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	//tags referencing this manifest would also be deleted by "ON DELETE CASCADE",
+	//but we delete them explicitly to be able to report them in the audit event
+	var deletedTagNames []string
+	_, err = tx.Select(&deletedTagNames, deleteTagsOfManifestQuery, repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
 		`DELETE FROM manifests WHERE repo_id = $1 AND digest = $2`,
 		repo.ID, digestStr)
 	if err != nil {
+		//the transaction is unusable after a failed statement, so look for the reason outside of it
+		sqlext.RollbackUnlessCommitted(tx)
 		otherDigest, err2 := p.db.SelectStr(
 			`SELECT parent_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND child_digest = $2`,
 			repo.ID, digestStr)
@@ -863,6 +1121,10 @@ func (p *Processor) DeleteManifest(account keppel.Account, repo keppel.Repositor
 	if rowsDeleted == 0 {
 		return sql.ErrNoRows
 	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
 
 	//We delete in the storage *after* the deletion is durable in the DB to be
 	//extra sure that we did not break any constraints (esp. manifest-manifest
@@ -890,9 +1152,10 @@ func (p *Processor) DeleteManifest(account keppel.Account, repo keppel.Repositor
 			ReasonCode: http.StatusOK,
 			Action:     cadf.DeleteAction,
 			Target: auditManifest{
-				Account:    account,
-				Repository: repo,
-				Digest:     digestStr,
+				Account:     account,
+				Repository:  repo,
+				Digest:      digestStr,
+				DeletedTags: deletedTagNames,
 			},
 		})
 	}
@@ -900,6 +1163,179 @@ func (p *Processor) DeleteManifest(account keppel.Account, repo keppel.Repositor
 	return nil
 }
 
+var moveManifestBlobRefsToTrashQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO deleted_manifest_blob_refs (repo_id, digest, blob_id)
+	SELECT repo_id, digest, blob_id FROM manifest_blob_refs WHERE repo_id = $1 AND digest = $2
+`)
+
+// Copies a manifest into the `deleted_manifests` table, together with its
+// blob references (so that the blobs are not garbage-collected while the
+// manifest can still be restored). If the manifest does not exist,
+// sql.ErrNoRows is returned.
+func (p *Processor) moveManifestToTrash(tx *gorp.Transaction, account keppel.Account, repo keppel.Repository, digestStr string) error {
+	manifest, err := keppel.FindManifest(tx, repo, digestStr)
+	if err != nil {
+		return err
+	}
+
+	//usually, the manifest contents are in the DB already, but they may not be
+	//for manifests that were pushed before the manifest_contents table existed
+	content, err := tx.SelectStr(
+		`SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`,
+		repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+	contentBytes, err := keppel.DecodeManifestContent([]byte(content))
+	if err != nil {
+		return err
+	}
+	if content == "" {
+		contentBytes, err = p.sd.ReadManifest(account, repo.Name, digestStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	//if the same manifest was deleted before, the newer deletion replaces the older one
+	_, err = tx.Exec(`DELETE FROM deleted_manifests WHERE repo_id = $1 AND digest = $2`, repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+	now := p.timeNow()
+	err = tx.Insert(&keppel.DeletedManifest{
+		RepositoryID: repo.ID,
+		Digest:       digestStr,
+		MediaType:    manifest.MediaType,
+		SizeBytes:    manifest.SizeBytes,
+		Content:      contentBytes,
+		DeletedAt:    now,
+		PurgeAfter:   now.Add(time.Duration(account.ManifestRetentionSecs) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(moveManifestBlobRefsToTrashQuery, repo.ID, digestStr)
+	return err
+}
+
+// RestoreManifest restores a manifest that was deleted while the account had
+// a retention period for deleted manifests. If the manifest is not in the
+// trash, or its retention period has expired, sql.ErrNoRows is returned.
+//
+// The manifest is validated and stored like a freshly pushed manifest, so this
+// fails if any blobs or child manifests referenced by it are not present in the
+// repository anymore. Tags that pointed to the manifest are not restored.
+func (p *Processor) RestoreManifest(account keppel.Account, repo keppel.Repository, digestStr string, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	var dm keppel.DeletedManifest
+	err := p.db.SelectOne(&dm,
+		`SELECT * FROM deleted_manifests WHERE repo_id = $1 AND digest = $2 AND purge_after > $3`,
+		repo.ID, digestStr, p.timeNow())
+	if err != nil {
+		return nil, err
+	}
+
+	manifestExists, err := p.db.SelectBool(checkManifestExistsQuery, repo.ID, digestStr)
+	if err != nil {
+		return nil, err
+	}
+	if manifestExists {
+		return nil, keppel.ErrManifestInvalid.With("manifest %s exists already in this repository", digestStr).WithStatus(http.StatusConflict)
+	}
+
+	manifest, err := p.ValidateAndStoreManifest(account, repo, IncomingManifest{
+		Reference: keppel.ManifestReference{Digest: digest.Digest(digestStr)},
+		MediaType: dm.MediaType,
+		Contents:  dm.Content,
+		PushedAt:  p.timeNow(),
+	}, actx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = p.db.Exec(`DELETE FROM deleted_manifests WHERE repo_id = $1 AND digest = $2`, repo.ID, digestStr)
+	return manifest, err
+}
+
+// RetagManifest points the tag `targetTagName` in the repo `targetRepoName`
+// to the manifest that the tag `sourceTagName` in `sourceRepo` currently
+// points to. The target repo is in the same account as the source repo, and is
+// created if necessary. If the source tag does not exist, sql.ErrNoRows is
+// returned.
+//
+// When the target repo is different from the source repo, the manifest (and
+// its child manifests, if any) are copied into the target repo, and the
+// referenced blobs are mounted into the target repo. Blob contents are never
+// copied in the storage.
+func (p *Processor) RetagManifest(account keppel.Account, sourceRepo keppel.Repository, sourceTagName, targetRepoName, targetTagName string, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	digestStr, err := p.db.SelectStr(
+		`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`,
+		sourceRepo.ID, sourceTagName)
+	if err != nil {
+		return nil, err
+	}
+	if digestStr == "" {
+		return nil, sql.ErrNoRows
+	}
+	targetRepo, err := keppel.FindRepository(p.db, targetRepoName, account)
+	if err == sql.ErrNoRows {
+		if rerr := p.cfg.CheckNewRepoName(targetRepoName); rerr != nil {
+			return nil, rerr
+		}
+		targetRepo, err = keppel.FindOrCreateRepository(p.db, targetRepoName, account)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p.copyManifest(account, sourceRepo, *targetRepo, digestStr,
+		keppel.ManifestReference{Tag: targetTagName}, actx)
+}
+
+func (p *Processor) copyManifest(account keppel.Account, sourceRepo, targetRepo keppel.Repository, digestStr string, targetRef keppel.ManifestReference, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	manifest, err := keppel.FindManifest(p.db, sourceRepo, digestStr)
+	if err != nil {
+		return nil, err
+	}
+	manifestBytes, err := p.sd.ReadManifest(account, sourceRepo.Name, digestStr)
+	if err != nil {
+		return nil, err
+	}
+
+	//when copying into a different repo, make sure that all referenced objects
+	//are available there before storing the manifest itself
+	if sourceRepo.ID != targetRepo.ID {
+		parsedManifest, _, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
+		if err != nil {
+			return nil, keppel.ErrManifestInvalid.With(err.Error())
+		}
+		for _, desc := range parsedManifest.BlobReferences() {
+			blob, err := keppel.FindBlobByRepository(p.db, desc.Digest, sourceRepo)
+			if err != nil {
+				return nil, fmt.Errorf("cannot find blob %s in repository %s: %w", desc.Digest, sourceRepo.FullName(), err)
+			}
+			err = keppel.MountBlobIntoRepo(p.db, *blob, targetRepo)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, desc := range parsedManifest.ManifestReferences(account.PlatformFilter) {
+			_, err := p.copyManifest(account, sourceRepo, targetRepo, desc.Digest.String(),
+				keppel.ManifestReference{Digest: desc.Digest}, actx)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p.ValidateAndStoreManifest(account, targetRepo, IncomingManifest{
+		Reference: targetRef,
+		MediaType: manifest.MediaType,
+		Contents:  manifestBytes,
+		PushedAt:  p.timeNow(),
+	}, actx)
+}
+
 // DeleteTag deletes the given tag from the database. The manifest is not deleted.
 // If the tag does not exist, sql.ErrNoRows is returned.
 func (p *Processor) DeleteTag(account keppel.Account, repo keppel.Repository, tagName string, actx keppel.AuditContext) error {
@@ -937,16 +1373,27 @@ type auditManifest struct {
 	Account    keppel.Account
 	Repository keppel.Repository
 	Digest     string
+	//DeletedTags is only filled when the manifest is deleted.
+	DeletedTags []string
 }
 
 // Render implements the audittools.TargetRenderer interface.
 func (a auditManifest) Render() cadf.Resource {
-	return cadf.Resource{
+	res := cadf.Resource{
 		TypeURI:   "docker-registry/account/repository/manifest",
 		Name:      fmt.Sprintf("%s@%s", a.Repository.FullName(), a.Digest),
 		ID:        a.Digest,
 		ProjectID: a.Account.AuthTenantID,
 	}
+	if len(a.DeletedTags) > 0 {
+		deletedTagsJSON, _ := json.Marshal(a.DeletedTags)
+		res.Attachments = []cadf.Attachment{{
+			Name:    "deleted-tags",
+			TypeURI: "mime:application/json",
+			Content: string(deletedTagsJSON),
+		}}
+	}
+	return res
 }
 
 // auditTag is an audittools.TargetRenderer.
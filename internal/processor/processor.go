@@ -20,11 +20,13 @@
 package processor
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/sapcc/go-bits/logg"
 	"gopkg.in/gorp.v2"
 
@@ -42,6 +44,7 @@ type Processor struct {
 	icd         keppel.InboundCacheDriver
 	auditor     keppel.Auditor
 	repoClients map[string]*client.RepoClient //key = account name
+	ufl         *UpstreamFetchLimiter         //may be nil
 
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
@@ -50,7 +53,15 @@ type Processor struct {
 
 // New creates a new Processor.
 func New(cfg keppel.Configuration, db *keppel.DB, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, auditor keppel.Auditor) *Processor {
-	return &Processor{cfg, db, sd, icd, auditor, make(map[string]*client.RepoClient), time.Now, keppel.GenerateStorageID}
+	return &Processor{cfg, db, sd, icd, auditor, make(map[string]*client.RepoClient), nil, time.Now, keppel.GenerateStorageID}
+}
+
+// WithUpstreamFetchLimiter sets the UpstreamFetchLimiter that is used when
+// replicating blobs. Without it, the number of concurrent upstream fetches is
+// not limited.
+func (p *Processor) WithUpstreamFetchLimiter(ufl *UpstreamFetchLimiter) *Processor {
+	p.ufl = ufl
+	return p
 }
 
 // OverrideTimeNow replaces time.Now with a test double.
@@ -112,8 +123,10 @@ func (p *Processor) insideTransaction(action func(*gorp.Transaction) error) erro
 ////////////////////////////////////////////////////////////////////////////////
 // helper functions used by multiple Processor methods
 
-// Returns nil if and only if the user can push another manifest.
-func (p *Processor) checkQuotaForManifestPush(account keppel.Account) error {
+// CheckQuotaForManifestPush returns nil if and only if the user can push
+// another manifest. Both the manifest quota of the account's auth tenant and
+// the account's own manifest limit (if any) are considered.
+func (p *Processor) CheckQuotaForManifestPush(account keppel.Account) error {
 	//check if user has enough quota to push a manifest
 	quotas, err := keppel.FindQuotas(p.db, account.AuthTenantID)
 	if err != nil {
@@ -132,6 +145,57 @@ func (p *Processor) checkQuotaForManifestPush(account keppel.Account) error {
 		)
 		return keppel.ErrDenied.With(msg).WithStatus(http.StatusConflict)
 	}
+
+	//check if the account's own limit allows another manifest
+	if account.ManifestLimit == 0 {
+		return nil
+	}
+	manifestUsage, err = account.GetManifestUsage(p.db)
+	if err != nil {
+		return err
+	}
+	if manifestUsage >= account.ManifestLimit {
+		msg := fmt.Sprintf("manifest limit for account exceeded (limit = %d, usage = %d)",
+			account.ManifestLimit, manifestUsage,
+		)
+		return keppel.ErrDenied.With(msg).WithStatus(http.StatusConflict)
+	}
+	return nil
+}
+
+// CheckQuotaForBlobPush returns nil if and only if the user can push another
+// blob with the given digest and size.
+func (p *Processor) CheckQuotaForBlobPush(account keppel.Account, blobDigest digest.Digest, sizeBytes uint64) error {
+	//pushing a blob that already exists in this account again does not consume
+	//any additional storage
+	_, err := keppel.FindBlobByAccountName(p.db, blobDigest, account)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	quotas, err := keppel.FindQuotas(p.db, account.AuthTenantID)
+	if err != nil {
+		return err
+	}
+	if quotas == nil {
+		quotas = keppel.DefaultQuotas(account.AuthTenantID)
+	}
+	if quotas.StorageBytes == nil {
+		return nil
+	}
+	storageUsage, err := quotas.GetStorageUsage(p.db)
+	if err != nil {
+		return err
+	}
+	if storageUsage+sizeBytes > *quotas.StorageBytes {
+		msg := fmt.Sprintf("storage quota exceeded (quota = %d bytes, usage = %d bytes, blob size = %d bytes)",
+			*quotas.StorageBytes, storageUsage, sizeBytes,
+		)
+		return keppel.ErrDenied.With(msg).WithStatus(http.StatusConflict)
+	}
 	return nil
 }
 
@@ -152,11 +216,15 @@ func (p *Processor) getRepoClientForUpstream(account keppel.Account, repo keppel
 		}
 
 		c := &client.RepoClient{
-			Scheme:   "https",
-			Host:     peer.HostName,
-			RepoName: repo.FullName(),
-			UserName: "replication@" + p.cfg.APIPublicHostname,
-			Password: peer.OurPassword,
+			Scheme:     "https",
+			Host:       peer.HostName,
+			RepoName:   repo.FullName(),
+			HTTPClient: p.cfg.PeerHTTPClient(),
+		}
+		if p.cfg.PeeringMode != keppel.PeeringModeMTLS {
+			//in mTLS mode, we are identified by our client certificate instead
+			c.UserName = "replication@" + p.cfg.APIPublicHostname
+			c.Password = peer.OurPassword
 		}
 		p.repoClients[repo.FullName()] = c
 		return c, nil
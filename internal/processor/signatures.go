@@ -0,0 +1,126 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+	"gopkg.in/gorp.v2"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// Signature payloads are tiny JSON documents. We refuse to load anything
+// larger than this to avoid reading arbitrary blobs into memory.
+const maxCosignPayloadSizeBytes = 1 << 20
+
+var findReferrersQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM manifests WHERE repo_id = $1 AND subject_digest = $2 ORDER BY digest
+`)
+
+// Returns an error if the account has a signature policy, and the manifest
+// with the given digest does not have a valid cosign signature in the given
+// repo.
+func (p *Processor) checkSignaturePolicy(tx *gorp.Transaction, account keppel.Account, repo keppel.Repository, manifestDigest string) error {
+	policy, err := account.ParseSignaturePolicy()
+	if err != nil {
+		return fmt.Errorf("malformed signature policy JSON: %q", account.SignaturePolicyJSON)
+	}
+	if policy == nil {
+		return nil
+	}
+
+	var referrers []keppel.Manifest
+	_, err = tx.Select(&referrers, findReferrersQuery, repo.ID, manifestDigest)
+	if err != nil {
+		return err
+	}
+	for _, referrer := range referrers {
+		ok, err := p.isValidCosignSignature(tx, account, repo, *policy, referrer, manifestDigest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return keppel.ErrDenied.With(
+		"manifest %s cannot be tagged because it does not have a valid signature, as required by this account's signature policy",
+		manifestDigest,
+	)
+}
+
+// Checks whether the given referrer manifest is a cosign signature manifest
+// containing at least one signature that satisfies the policy.
+func (p *Processor) isValidCosignSignature(tx *gorp.Transaction, account keppel.Account, repo keppel.Repository, policy keppel.SignaturePolicy, referrer keppel.Manifest, signedDigest string) (bool, error) {
+	manifestBytes, err := p.sd.ReadManifest(account, repo.Name, referrer.Digest)
+	if err != nil {
+		return false, err
+	}
+	parsedManifest, _, err := keppel.ParseManifest(referrer.MediaType, manifestBytes)
+	if err != nil {
+		return false, keppel.ErrManifestInvalid.With(err.Error())
+	}
+
+	for _, desc := range parsedManifest.BlobReferences() {
+		signature := desc.Annotations[keppel.CosignSignatureAnnotation]
+		if desc.MediaType != keppel.CosignSimpleSigningMediaType || signature == "" || desc.Size > maxCosignPayloadSizeBytes {
+			continue
+		}
+
+		blob, err := keppel.FindBlobByRepository(tx, desc.Digest, repo)
+		if err != nil {
+			return false, err
+		}
+		payload, err := p.readBlobContents(account, *blob)
+		if err != nil {
+			return false, err
+		}
+
+		err = policy.VerifyCosignSignature(payload, signature, signedDigest)
+		if err == nil {
+			return true, nil
+		}
+		//invalid signatures are not an error by themselves (there might be a valid one elsewhere)
+		logg.Debug("ignoring signature %s for manifest %s in repo %s: %s",
+			referrer.Digest, signedDigest, repo.FullName(), err.Error())
+	}
+	return false, nil
+}
+
+func (p *Processor) readBlobContents(account keppel.Account, blob keppel.Blob) ([]byte, error) {
+	storageAccount, err := keppel.FindBlobStorageAccount(p.db, blob, account)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := p.sd.ReadBlob(storageAccount, blob.StorageID)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return contents, reader.Close()
+}
@@ -0,0 +1,143 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var (
+	accountManifestCountDesc = prometheus.NewDesc(
+		"keppel_account_manifests",
+		"Number of manifests in the given account.",
+		[]string{"account", "auth_tenant_id"}, nil,
+	)
+	accountBlobCountDesc = prometheus.NewDesc(
+		"keppel_account_blobs",
+		"Number of blobs in the given account.",
+		[]string{"account", "auth_tenant_id"}, nil,
+	)
+	accountBlobSizeDesc = prometheus.NewDesc(
+		"keppel_account_blob_size_bytes",
+		"Total size of all blobs in the given account.",
+		[]string{"account", "auth_tenant_id"}, nil,
+	)
+)
+
+var accountMetricsQuery = sqlext.SimplifyWhitespace(`
+	SELECT a.name, a.auth_tenant_id, COALESCE(m.count, 0), COALESCE(b.count, 0), COALESCE(b.size_bytes, 0)
+	  FROM accounts a
+	  LEFT OUTER JOIN (
+	    SELECT r.account_name, COUNT(*) AS count FROM manifests m JOIN repos r ON m.repo_id = r.id GROUP BY r.account_name
+	  ) m ON m.account_name = a.name
+	  LEFT OUTER JOIN (
+	    SELECT account_name, COUNT(*) AS count, SUM(size_bytes) AS size_bytes FROM blobs GROUP BY account_name
+	  ) b ON b.account_name = a.name
+`)
+
+type accountMetrics struct {
+	AccountName   string
+	AuthTenantID  string
+	ManifestCount uint64
+	BlobCount     uint64
+	BlobSizeBytes uint64
+}
+
+// AccountMetricsCollector is a prometheus.Collector that reports the number of
+// manifests and blobs as well as the total blob size for each account. Since
+// the underlying queries touch large tables, their results are cached for the
+// given TTL instead of being recomputed on every scrape.
+type AccountMetricsCollector struct {
+	db  *keppel.DB
+	ttl time.Duration
+	//non-pure functions that can be replaced by deterministic doubles for unit tests
+	timeNow func() time.Time
+
+	mutex     sync.Mutex
+	cached    []accountMetrics
+	expiresAt time.Time
+}
+
+// NewAccountMetricsCollector creates a new AccountMetricsCollector.
+func NewAccountMetricsCollector(db *keppel.DB, ttl time.Duration) *AccountMetricsCollector {
+	return &AccountMetricsCollector{db: db, ttl: ttl, timeNow: time.Now}
+}
+
+// OverrideTimeNow replaces time.Now with a test double.
+func (c *AccountMetricsCollector) OverrideTimeNow(timeNow func() time.Time) *AccountMetricsCollector {
+	c.timeNow = timeNow
+	return c
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *AccountMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- accountManifestCountDesc
+	ch <- accountBlobCountDesc
+	ch <- accountBlobSizeDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *AccountMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.timeNow()
+	if c.cached == nil || !now.Before(c.expiresAt) {
+		var result []accountMetrics
+		err := sqlext.ForeachRow(c.db, accountMetricsQuery, nil, func(rows *sql.Rows) error {
+			var m accountMetrics
+			err := rows.Scan(&m.AccountName, &m.AuthTenantID, &m.ManifestCount, &m.BlobCount, &m.BlobSizeBytes)
+			result = append(result, m)
+			return err
+		})
+		if err != nil {
+			//keep reporting the previous values (if any) instead of dropping the metrics
+			logg.Error("cannot collect account metrics: " + err.Error())
+		} else {
+			c.cached = result
+			if c.cached == nil {
+				c.cached = []accountMetrics{}
+			}
+			c.expiresAt = now.Add(c.ttl)
+		}
+	}
+
+	for _, m := range c.cached {
+		ch <- prometheus.MustNewConstMetric(
+			accountManifestCountDesc, prometheus.GaugeValue,
+			float64(m.ManifestCount), m.AccountName, m.AuthTenantID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			accountBlobCountDesc, prometheus.GaugeValue,
+			float64(m.BlobCount), m.AccountName, m.AuthTenantID,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			accountBlobSizeDesc, prometheus.GaugeValue,
+			float64(m.BlobSizeBytes), m.AccountName, m.AuthTenantID,
+		)
+	}
+}
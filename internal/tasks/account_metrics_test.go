@@ -0,0 +1,81 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestAccountMetricsCollector(t *testing.T) {
+	_, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+	c := NewAccountMetricsCollector(s.DB, 5*time.Minute).OverrideTimeNow(s.Clock.Now)
+
+	//add an empty account in a different auth tenant
+	mustDo(t, s.DB.Insert(&keppel.Account{Name: "test2", AuthTenantID: "test2authtenant", GCPoliciesJSON: "[]"}))
+
+	expectMetrics := func(manifestCount, blobCount int, blobSizeBytes uint64) {
+		t.Helper()
+		expected := fmt.Sprintf(`
+			# HELP keppel_account_blob_size_bytes Total size of all blobs in the given account.
+			# TYPE keppel_account_blob_size_bytes gauge
+			keppel_account_blob_size_bytes{account="test1",auth_tenant_id="test1authtenant"} %[3]d
+			keppel_account_blob_size_bytes{account="test2",auth_tenant_id="test2authtenant"} 0
+			# HELP keppel_account_blobs Number of blobs in the given account.
+			# TYPE keppel_account_blobs gauge
+			keppel_account_blobs{account="test1",auth_tenant_id="test1authtenant"} %[2]d
+			keppel_account_blobs{account="test2",auth_tenant_id="test2authtenant"} 0
+			# HELP keppel_account_manifests Number of manifests in the given account.
+			# TYPE keppel_account_manifests gauge
+			keppel_account_manifests{account="test1",auth_tenant_id="test1authtenant"} %[1]d
+			keppel_account_manifests{account="test2",auth_tenant_id="test2authtenant"} 0
+		`, manifestCount, blobCount, blobSizeBytes)
+		err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}
+
+	//without any contents, all accounts report zero
+	expectMetrics(0, 0, 0)
+
+	//upload two images (each of which has a config blob and a layer blob)
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+		test.GenerateImage(test.GenerateExampleLayer(2)),
+	}
+	var blobSizeBytes uint64
+	for _, image := range images {
+		image.MustUpload(t, s, fooRepoRef, "")
+		blobSizeBytes += image.SizeBytes() - uint64(len(image.Manifest.Contents))
+	}
+
+	//the previous values are cached until the TTL expires
+	expectMetrics(0, 0, 0)
+	s.Clock.StepBy(5 * time.Minute)
+	expectMetrics(2, 4, blobSizeBytes)
+}
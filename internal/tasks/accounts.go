@@ -21,7 +21,6 @@ package tasks
 import (
 	"database/sql"
 	"fmt"
-	"time"
 
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
@@ -34,8 +33,8 @@ var accountAnnouncementSearchQuery = sqlext.SimplifyWhitespace(`
 		WHERE next_federation_announcement_at IS NULL OR next_federation_announcement_at < $1
 	-- accounts without any announcements first, then sorted by last announcement
 	ORDER BY next_federation_announcement_at IS NULL DESC, next_federation_announcement_at ASC
-	-- only one account at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextAccount)
+	LIMIT $2
 `)
 
 var accountAnnouncementDoneQuery = sqlext.SimplifyWhitespace(`
@@ -59,7 +58,7 @@ func (j *Janitor) AnnounceNextAccountToFederation() (returnErr error) {
 	}()
 
 	//find account to announce
-	err := j.db.SelectOne(&account, accountAnnouncementSearchQuery, j.timeNow())
+	release, err := j.lockNextAccount(&account, "federation-announcement", accountAnnouncementSearchQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to announce to federation - slowing down...")
@@ -67,6 +66,7 @@ func (j *Janitor) AnnounceNextAccountToFederation() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
 	err = j.fd.RecordExistingAccount(account, j.timeNow())
 	if err != nil {
@@ -75,6 +75,6 @@ func (j *Janitor) AnnounceNextAccountToFederation() (returnErr error) {
 		logg.Error("cannot announce account %q to federation: %s", account.Name, err.Error())
 	}
 
-	_, err = j.db.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(1*time.Hour))
+	_, err = j.db.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(j.intervals.FederationAnnouncement))
 	return err
 }
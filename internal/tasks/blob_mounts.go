@@ -21,7 +21,6 @@ package tasks
 import (
 	"database/sql"
 	"fmt"
-	"time"
 
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
@@ -39,14 +38,17 @@ var blobMountSweepSearchQuery = sqlext.SimplifyWhitespace(`
 		AND id NOT IN (SELECT repo_id FROM manifests WHERE validation_error_message != '')
 	-- repos without any sweeps first, then sorted by last sweep
 	ORDER BY next_blob_mount_sweep_at IS NULL DESC, next_blob_mount_sweep_at ASC
-	-- only one repo at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextRepo)
+	LIMIT $2
 `)
 
+// NOTE: Blobs referenced by deleted manifests that can still be restored are
+// considered to be in use.
 var blobMountMarkQuery = sqlext.SimplifyWhitespace(`
 	UPDATE blob_mounts SET can_be_deleted_at = $2
 	WHERE repo_id = $1 AND can_be_deleted_at IS NULL AND blob_id NOT IN (
 		SELECT blob_id FROM manifest_blob_refs WHERE repo_id = $1
+		UNION SELECT blob_id FROM deleted_manifest_blob_refs WHERE repo_id = $1
 	)
 `)
 
@@ -54,6 +56,7 @@ var blobMountUnmarkQuery = sqlext.SimplifyWhitespace(`
 	UPDATE blob_mounts SET can_be_deleted_at = NULL
 	WHERE repo_id = $1 AND blob_id IN (
 		SELECT blob_id FROM manifest_blob_refs WHERE repo_id = $1
+		UNION SELECT blob_id FROM deleted_manifest_blob_refs WHERE repo_id = $1
 	)
 `)
 
@@ -74,8 +77,9 @@ var blobMountSweepDoneQuery = sqlext.SimplifyWhitespace(`
 // This staged mark-and-sweep ensures that we don't remove fresh blob mounts
 // that were just created, but where the manifest has not yet been pushed.
 //
-// Blob mounts are sweeped in each repo at most once per hour. If no repos need
-// to be sweeped, sql.ErrNoRows is returned to instruct the caller to slow down.
+// Blob mounts are sweeped in each repo at most once per hour (or as configured
+// with SetTaskIntervals()). If no repos need to be sweeped, sql.ErrNoRows is
+// returned to instruct the caller to slow down.
 func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 	var repo keppel.Repository
 	defer func() {
@@ -89,7 +93,7 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 	}()
 
 	//find repo to sweep
-	err := j.db.SelectOne(&repo, blobMountSweepSearchQuery, j.timeNow())
+	release, err := j.lockNextRepo(&repo, "blob-mount-sweep", blobMountSweepSearchQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no blob mounts to sweep - slowing down...")
@@ -97,10 +101,12 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
-	//allow next pass in 1 hour to delete the newly marked blob mounts, but use a
-	//slighly earlier cut-off time to account for the marking taking some time
-	canBeDeletedAt := j.timeNow().Add(30 * time.Minute)
+	//allow next pass to delete the newly marked blob mounts (the grace period
+	//is shorter than the interval between passes to account for the marking
+	//taking some time)
+	canBeDeletedAt := j.timeNow().Add(j.intervals.BlobGracePeriod)
 
 	//NOTE: We don't need to pack the following steps in a single transaction, so
 	//we won't. The mark and unmark are obviously safe since they only update
@@ -128,6 +134,6 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 		logg.Info("%d blob mounts sweeped in repo %s", rowsDeleted, repo.FullName())
 	}
 
-	_, err = j.db.Exec(blobMountSweepDoneQuery, repo.ID, j.timeNow().Add(1*time.Hour))
+	_, err = j.db.Exec(blobMountSweepDoneQuery, repo.ID, j.timeNow().Add(j.intervals.BlobMountSweep))
 	return err
 }
@@ -78,3 +78,42 @@ func TestSweepBlobMounts(t *testing.T) {
 	expectError(t, sql.ErrNoRows.Error(), j.SweepBlobMountsInNextRepo())
 	easypg.AssertDBContent(t, s.DB.DbMap.Db, "fixtures/blob-mount-sweep-004.sql")
 }
+
+func TestSweepBlobMountsWithConfiguredGracePeriod(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	intervals := DefaultTaskIntervals()
+	intervals.BlobGracePeriod = 5 * time.Minute
+	intervals.BlobMountSweep = 10 * time.Minute
+	mustDo(t, intervals.Validate())
+	j.SetTaskIntervals(intervals)
+
+	//upload a blob that is not referenced by any manifest
+	dbBlob := test.GenerateExampleLayer(1).MustUpload(t, s, fooRepoRef)
+	expectMountCount := func(expected int64) {
+		t.Helper()
+		actual, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blob_mounts WHERE blob_id = $1`, dbBlob.ID)
+		mustDo(t, err)
+		if actual != expected {
+			t.Errorf("expected %d blob mounts, but got %d", expected, actual)
+		}
+	}
+
+	//the first sweep marks the blob mount for deletion after the grace period
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	var canBeDeletedAt time.Time
+	mustDo(t, s.DB.QueryRow(`SELECT can_be_deleted_at FROM blob_mounts WHERE blob_id = $1`, dbBlob.ID).Scan(&canBeDeletedAt))
+	if expected := s.Clock.Now().Add(5 * time.Minute); !canBeDeletedAt.Equal(expected) {
+		t.Errorf("expected blob mount to be deletable at %s, but got %s", expected, canBeDeletedAt)
+	}
+
+	//the next pass happens after the configured interval, which is longer than
+	//the grace period, so the blob mount is deleted then
+	s.Clock.StepBy(9 * time.Minute)
+	expectError(t, sql.ErrNoRows.Error(), j.SweepBlobMountsInNextRepo())
+	expectMountCount(1)
+	s.Clock.StepBy(1*time.Minute + 1*time.Second)
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	expectMountCount(0)
+}
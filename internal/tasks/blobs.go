@@ -34,8 +34,8 @@ var blobSweepSearchQuery = sqlext.SimplifyWhitespace(`
 		WHERE next_blob_sweep_at IS NULL OR next_blob_sweep_at < $1
 	-- accounts without any sweeps first, then sorted by last sweep
 	ORDER BY next_blob_sweep_at IS NULL DESC, next_blob_sweep_at ASC
-	-- only one account at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextAccount)
+	LIMIT $2
 `)
 
 var blobMarkQuery = sqlext.SimplifyWhitespace(`
@@ -70,8 +70,9 @@ var blobSweepDoneQuery = sqlext.SimplifyWhitespace(`
 // This staged mark-and-sweep ensures that we don't remove fresh blobs
 // that were just pushed and have not been mounted anywhere.
 //
-// Blobs are sweeped in each account at most once per hour. If no accounts need
-// to be sweeped, sql.ErrNoRows is returned to instruct the caller to slow down.
+// Blobs are sweeped in each account at most once per hour (or as configured
+// with SetTaskIntervals()). If no accounts need to be sweeped, sql.ErrNoRows is
+// returned to instruct the caller to slow down.
 func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 	var account keppel.Account
 	defer func() {
@@ -85,7 +86,7 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 	}()
 
 	//find account to sweep
-	err := j.db.SelectOne(&account, blobSweepSearchQuery, j.timeNow())
+	release, err := j.lockNextAccount(&account, "blob-sweep", blobSweepSearchQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no blobs to sweep - slowing down...")
@@ -93,10 +94,12 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
-	//allow next pass in 1 hour to delete the newly marked blob mounts, but use a
-	//slighly earlier cut-off time to account for the marking taking some time
-	canBeDeletedAt := j.timeNow().Add(30 * time.Minute)
+	//allow next pass to delete the newly marked blobs (the grace period is
+	//shorter than the interval between passes to account for the marking
+	//taking some time)
+	canBeDeletedAt := j.timeNow().Add(j.intervals.BlobGracePeriod)
 
 	//NOTE: We don't need to pack the following steps in a single transaction, so
 	//we won't. The mark and unmark are obviously safe since they only update
@@ -141,6 +144,16 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 			return err
 		}
 		if blob.StorageID != "" { //ignore unbacked blobs that were never replicated
+			//blob contents that are shared with other accounts because of
+			//cross-account deduplication need to stay; once the last blob referring
+			//to them is gone, they will be cleaned up by SweepStorageInNextAccount
+			isShared, err := keppel.IsBlobStorageShared(j.db, blob)
+			if err != nil {
+				return err
+			}
+			if isShared {
+				continue
+			}
 			err = j.sd.DeleteBlob(account, blob.StorageID)
 			if err != nil {
 				return err
@@ -148,7 +161,7 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		}
 	}
 
-	_, err = j.db.Exec(blobSweepDoneQuery, account.Name, j.timeNow().Add(1*time.Hour))
+	_, err = j.db.Exec(blobSweepDoneQuery, account.Name, j.timeNow().Add(j.intervals.BlobSweep))
 	return err
 }
 
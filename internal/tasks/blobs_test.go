@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -78,6 +79,73 @@ func TestSweepBlobs(t *testing.T) {
 	s.ExpectBlobsExistInStorage(t, dbBlobs[2:]...)
 }
 
+func TestSweepDeduplicatedBlobs(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithCrossAccountBlobDedup,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithAccount(keppel.Account{Name: "test2", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithRepo(keppel.Repository{AccountName: "test2", Name: "foo"}),
+		test.WithQuotas,
+	)
+	j := NewJanitor(s.Config, s.FD, s.SD, s.ICD, s.DB, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//upload the same blob into both accounts, so that the second blob refers to
+	//the storage contents of the first one
+	blob := test.GenerateExampleLayer(1)
+	dbBlob1 := blob.MustUpload(t, s, keppel.Repository{AccountName: "test1", Name: "foo"})
+	dbBlob2 := blob.MustUpload(t, s, keppel.Repository{AccountName: "test2", Name: "foo"})
+	assert.DeepEqual(t, "storage account name", dbBlob2.StorageAccountName, "test1")
+
+	sweepBlobsInAllAccounts := func() {
+		t.Helper()
+		s.Clock.StepBy(2 * time.Hour)
+		expectSuccess(t, j.SweepBlobsInNextAccount())
+		expectSuccess(t, j.SweepBlobsInNextAccount())
+		expectError(t, sql.ErrNoRows.Error(), j.SweepBlobsInNextAccount())
+	}
+	sweepStorageInAllAccounts := func() {
+		t.Helper()
+		s.Clock.StepBy(8 * time.Hour)
+		expectSuccess(t, j.SweepStorageInNextAccount())
+		expectSuccess(t, j.SweepStorageInNextAccount())
+		expectError(t, sql.ErrNoRows.Error(), j.SweepStorageInNextAccount())
+	}
+	countBlobsInDB := func() int64 {
+		t.Helper()
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blobs`)
+		mustDo(t, err)
+		return count
+	}
+
+	//when the blob owning the storage contents is deleted, the contents need to
+	//stay because the other blob still refers to them
+	mustExec(t, s.DB, `DELETE FROM blob_mounts WHERE blob_id = $1`, dbBlob1.ID)
+	sweepBlobsInAllAccounts() //marks dbBlob1 for deletion
+	sweepBlobsInAllAccounts() //deletes dbBlob1
+	assert.DeepEqual(t, "blob count in DB", countBlobsInDB(), int64(1))
+	s.ExpectBlobsExistInStorage(t, dbBlob2)
+
+	//the storage sweep does not consider these contents to be unknown
+	sweepStorageInAllAccounts()
+	sweepStorageInAllAccounts()
+	s.ExpectBlobsExistInStorage(t, dbBlob2)
+
+	//when the last blob referring to the storage contents is deleted, the blob
+	//sweep still does not touch them since they belong to a different account...
+	mustExec(t, s.DB, `DELETE FROM blob_mounts WHERE blob_id = $1`, dbBlob2.ID)
+	sweepBlobsInAllAccounts()
+	sweepBlobsInAllAccounts()
+	assert.DeepEqual(t, "blob count in DB", countBlobsInDB(), int64(0))
+	s.ExpectBlobsExistInStorage(t, dbBlob1)
+
+	//...but now the storage sweep of the owning account cleans them up
+	sweepStorageInAllAccounts() //marks the storage contents as unknown
+	sweepStorageInAllAccounts() //deletes them
+	s.ExpectBlobsMissingInStorage(t, dbBlob1)
+}
+
 func TestValidateBlobs(t *testing.T) {
 	j, s := setup(t)
 	s.Clock.StepBy(1 * time.Hour)
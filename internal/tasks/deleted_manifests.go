@@ -0,0 +1,60 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// PurgeExpiredDeletedManifests removes all deleted manifests whose retention
+// period has expired. Once they are gone, the blobs referenced by them are not
+// protected from garbage collection anymore, so they will be cleaned up by
+// SweepBlobMountsInNextRepo() and SweepBlobsInNextAccount() unless they are
+// still referenced elsewhere. If nothing needs to be purged, sql.ErrNoRows is
+// returned to instruct the caller to slow down.
+func (j *Janitor) PurgeExpiredDeletedManifests() (returnErr error) {
+	defer func() {
+		if returnErr == nil {
+			purgeDeletedManifestsSuccessCounter.Inc()
+		} else if returnErr != sql.ErrNoRows {
+			purgeDeletedManifestsFailedCounter.Inc()
+			returnErr = fmt.Errorf("while purging expired deleted manifests: %s", returnErr.Error())
+		}
+	}()
+
+	//NOTE: This also removes the respective deleted_manifest_blob_refs because of "ON DELETE CASCADE".
+	result, err := j.db.Exec(`DELETE FROM deleted_manifests WHERE purge_after <= $1`, j.timeNow())
+	if err != nil {
+		return err
+	}
+	rowsDeleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsDeleted == 0 {
+		logg.Debug("no deleted manifests to purge - slowing down...")
+		return sql.ErrNoRows
+	}
+	logg.Info("purged %d deleted manifests after their retention period expired", rowsDeleted)
+	return nil
+}
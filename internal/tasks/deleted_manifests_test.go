@@ -0,0 +1,81 @@
+/******************************************************************************
+*
+*  Copyright 2020 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestPurgeExpiredDeletedManifests(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//enable the trash for the test account
+	mustExec(t, s.DB, `UPDATE accounts SET manifest_retention_secs = $1 WHERE name = $2`, 86400, "test1")
+	account, err := keppel.FindAccount(s.DB, "test1")
+	mustDo(t, err)
+	repo, err := keppel.FindRepository(s.DB, "foo", *account)
+	mustDo(t, err)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "")
+
+	//nothing to purge yet
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeExpiredDeletedManifests())
+
+	//deleting the manifest moves it into the trash, and the blob refs along with it
+	mustDo(t, j.processor().DeleteManifest(*account, *repo, image.Manifest.Digest.String(), keppel.AuditContext{}))
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM manifests`, 0)
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM deleted_manifests`, 1)
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM deleted_manifest_blob_refs`, 2)
+
+	//the blob mount sweep must not touch blobs that are referenced by deleted manifests
+	s.Clock.StepBy(2 * time.Hour)
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM blob_mounts WHERE can_be_deleted_at IS NOT NULL`, 0)
+
+	//before the retention period expires, nothing is purged
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeExpiredDeletedManifests())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM deleted_manifests`, 1)
+
+	//afterwards, the deleted manifest and its blob refs are purged
+	s.Clock.StepBy(24 * time.Hour)
+	expectSuccess(t, j.PurgeExpiredDeletedManifests())
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeExpiredDeletedManifests())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM deleted_manifests`, 0)
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM deleted_manifest_blob_refs`, 0)
+
+	//now the blob mounts are up for deletion again
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM blob_mounts WHERE can_be_deleted_at IS NOT NULL`, 2)
+}
+
+func expectRowCount(t *testing.T, db *keppel.DB, query string, expected int64) {
+	t.Helper()
+	actual, err := db.SelectInt(query)
+	mustDo(t, err)
+	if actual != expected {
+		t.Errorf("expected %q to return %d, but got %d", query, expected, actual)
+	}
+}
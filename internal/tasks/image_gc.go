@@ -36,8 +36,8 @@ var imageGCRepoSelectQuery = sqlext.SimplifyWhitespace(`
 		WHERE (next_gc_at IS NULL OR next_gc_at < $1)
 	-- repos without any syncs first, then sorted by last sync
 	ORDER BY next_gc_at IS NULL DESC, next_gc_at ASC
-	-- only one repo at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextRepo)
+	LIMIT $2
 `)
 
 var imageGCResetStatusQuery = sqlext.SimplifyWhitespace(`
@@ -66,7 +66,7 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 	}()
 
 	//find repository to sync
-	err := j.db.SelectOne(&repo, imageGCRepoSelectQuery, j.timeNow())
+	release, err := j.lockNextRepo(&repo, "gc", imageGCRepoSelectQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to sync manifests in - slowing down...")
@@ -74,12 +74,44 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
+	err = j.garbageCollectManifestsInRepo(repo, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.db.Exec(imageGCRepoDoneQuery, repo.ID, j.timeNow().Add(j.intervals.GarbageCollection))
+	return err
+}
+
+// DryRunGarbageCollectManifestsInRepo evaluates the GC policies for the given
+// repository like GarbageCollectManifestsInNextRepo does, but does not delete
+// anything. Instead, the projected outcome is written into the GCStatusJSON
+// field of the repository's manifests. The next_gc_at timestamp of the repo is
+// not updated, so the next regular GC run will proceed as scheduled.
+func (j *Janitor) DryRunGarbageCollectManifestsInRepo(repo keppel.Repository) error {
+	err := j.garbageCollectManifestsInRepo(repo, true)
+	if err != nil {
+		return fmt.Errorf("while GCing manifests in the repo %s (dry run): %w", repo.FullName(), err)
+	}
+	return nil
+}
+
+func (j *Janitor) garbageCollectManifestsInRepo(repo keppel.Repository, dryRun bool) error {
 	//load GC policies for this repository
 	account, err := keppel.FindAccount(j.db, repo.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for repo %s: %w", repo.FullName(), err)
 	}
+
+	//do not delete anything while the account is in maintenance (the account
+	//might be in the middle of a migration, so deletions would be surprising);
+	//GC will be reattempted in the next run after maintenance ends
+	if account.InMaintenance && !dryRun {
+		return nil
+	}
+
 	policies, err := account.ParseGCPolicies()
 	if err != nil {
 		return fmt.Errorf("cannot load GC policies for account %s: %w", account.Name, err)
@@ -97,25 +129,17 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 
 	//execute GC policies
 	if len(policiesForRepo) > 0 {
-		err = j.executeGCPolicies(*account, repo, policiesForRepo)
-		if err != nil {
-			return err
-		}
-	} else {
-		//if there are no policies to apply, we can skip a whole bunch of work, but
-		//we still need to update the GCStatusJSON field on the repo's manifests to
-		//make sure those statuses don't refer to deleted GC policies
-		_, err = j.db.Exec(imageGCResetStatusQuery, repo.ID)
-		if err != nil {
-			return err
-		}
+		return j.executeGCPolicies(*account, repo, policiesForRepo, dryRun)
 	}
 
-	_, err = j.db.Exec(imageGCRepoDoneQuery, repo.ID, j.timeNow().Add(1*time.Hour))
+	//if there are no policies to apply, we can skip a whole bunch of work, but
+	//we still need to update the GCStatusJSON field on the repo's manifests to
+	//make sure those statuses don't refer to deleted GC policies
+	_, err = j.db.Exec(imageGCResetStatusQuery, repo.ID)
 	return err
 }
 
-func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Repository, policies []keppel.GCPolicy) error {
+func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Repository, policies []keppel.GCPolicy, dryRun bool) error {
 	//load manifests in repo
 	var dbManifests []keppel.Manifest
 	_, err := j.db.Select(&dbManifests, `SELECT * FROM manifests WHERE repo_id = $1`, repo.ID)
@@ -126,6 +150,7 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 	//setup a bit of structure to track state in during the policy evaluation
 	type manifestData struct {
 		Manifest      keppel.Manifest
+		Tags          []keppel.Tag
 		TagNames      []string
 		ParentDigests []string
 		GCStatus      keppel.GCStatus
@@ -142,31 +167,25 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 		})
 	}
 
-	//load tags (for matching policies on match_tag, except_tag and only_untagged)
-	query := `SELECT digest, name FROM tags WHERE repo_id = $1`
-	err = sqlext.ForeachRow(j.db, query, []interface{}{repo.ID}, func(rows *sql.Rows) error {
-		var (
-			digest  string
-			tagName string
-		)
-		err := rows.Scan(&digest, &tagName)
-		if err != nil {
-			return err
-		}
+	//load tags (for matching policies on match_tag, except_tag and only_untagged,
+	//and for evaluating policies with action "retain_tags")
+	var dbTags []keppel.Tag
+	_, err = j.db.Select(&dbTags, `SELECT * FROM tags WHERE repo_id = $1 ORDER BY name`, repo.ID)
+	if err != nil {
+		return err
+	}
+	for _, tag := range dbTags {
 		for _, m := range manifests {
-			if m.Manifest.Digest == digest {
-				m.TagNames = append(m.TagNames, tagName)
+			if m.Manifest.Digest == tag.Digest {
+				m.Tags = append(m.Tags, tag)
+				m.TagNames = append(m.TagNames, tag.Name)
 				break
 			}
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 
 	//check manifest-manifest relations to fill GCStatus.ProtectedByManifest
-	query = `SELECT parent_digest, child_digest FROM manifest_manifest_refs WHERE repo_id = $1`
+	query := `SELECT parent_digest, child_digest FROM manifest_manifest_refs WHERE repo_id = $1`
 	err = sqlext.ForeachRow(j.db, query, []interface{}{repo.ID}, func(rows *sql.Rows) error {
 		var (
 			parentDigest string
@@ -197,6 +216,113 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 	//evaulate policies in order
 	proc := j.processor()
 	for _, p := range policies {
+		//"retain_tags" policies operate on individual tags instead of on whole manifests
+		if p.Action == "retain_tags" {
+			//collect matching tags of manifests that have not been deleted yet
+			type tagData struct {
+				Tag      keppel.Tag
+				Manifest *manifestData
+			}
+			var candidates []tagData
+			for _, m := range manifests {
+				if m.IsDeleted {
+					continue
+				}
+				for _, tag := range m.Tags {
+					if p.MatchesTags([]string{tag.Name}) {
+						candidates = append(candidates, tagData{tag, m})
+					}
+				}
+			}
+
+			//the newest tags are retained (ties are broken by name for deterministic behavior)
+			sort.SliceStable(candidates, func(i, j int) bool {
+				lhs := candidates[i].Tag
+				rhs := candidates[j].Tag
+				if !lhs.PushedAt.Equal(rhs.PushedAt) {
+					return lhs.PushedAt.After(rhs.PushedAt)
+				}
+				return lhs.Name < rhs.Name
+			})
+
+			pCopied := p
+			actx := keppel.AuditContext{
+				UserIdentity: janitorUserIdentity{
+					TaskName: "policy-driven-gc",
+					GCPolicy: &pCopied,
+				},
+				Request: janitorDummyRequest,
+			}
+			isRelevantFor := make(map[*manifestData]bool)
+			isUntaggedNow := make(map[*manifestData]bool)
+			for idx, c := range candidates {
+				m := c.Manifest
+				tr := *p.TagRetention
+				switch {
+				case uint64(idx) < tr.NewestCount:
+					isRelevantFor[m] = true
+					continue
+				case tr.ProtectPulledWithin != 0 && c.Tag.LastPulledAt != nil && keppel.Duration(j.timeNow().Sub(*c.Tag.LastPulledAt)) <= tr.ProtectPulledWithin:
+					isRelevantFor[m] = true
+					continue
+				case m.GCStatus.ProtectedByRecentUpload || m.GCStatus.ProtectedByPolicy != nil:
+					continue
+				}
+
+				if dryRun {
+					m.GCStatus.WouldDeleteTags = append(m.GCStatus.WouldDeleteTags, c.Tag.Name)
+				} else {
+					err := proc.DeleteTag(account, repo, c.Tag.Name, actx)
+					if err != nil {
+						return err
+					}
+					policyJSON, _ := json.Marshal(p)
+					logg.Info("GC on repo %s: deleted tag %s because of policy %s", repo.FullName(), c.Tag.Name, string(policyJSON))
+				}
+
+				var remainingTags []keppel.Tag
+				var remainingTagNames []string
+				for _, tag := range m.Tags {
+					if tag.Name != c.Tag.Name {
+						remainingTags = append(remainingTags, tag)
+						remainingTagNames = append(remainingTagNames, tag.Name)
+					}
+				}
+				m.Tags = remainingTags
+				m.TagNames = remainingTagNames
+				if len(m.Tags) == 0 {
+					isUntaggedNow[m] = true
+				}
+			}
+
+			//manifests that became untagged are deleted, unless they are protected
+			//(most importantly, if they are referenced by another manifest)
+			for _, m := range manifests {
+				if !isUntaggedNow[m] || m.GCStatus.IsProtected() {
+					continue
+				}
+				if dryRun {
+					m.GCStatus.WouldBeDeletedByPolicy = &pCopied
+				} else {
+					err := proc.DeleteManifest(account, repo, m.Manifest.Digest, actx)
+					if err != nil {
+						return err
+					}
+					policyJSON, _ := json.Marshal(p)
+					logg.Info("GC on repo %s: deleted manifest %s because of policy %s", repo.FullName(), m.Manifest.Digest, string(policyJSON))
+				}
+				m.IsDeleted = true
+			}
+
+			//track matching "retain_tags" policies in GCStatus like for "delete" policies
+			for _, m := range manifests {
+				if isRelevantFor[m] && !m.IsDeleted && !m.GCStatus.IsProtected() {
+					m.GCStatus.RelevantPolicies = append(m.GCStatus.RelevantPolicies, p)
+				}
+			}
+			continue
+		}
+
 		//for some time constraint matches, we need to know which manifests are
 		//still alive
 		var aliveManifests []keppel.Manifest
@@ -234,6 +360,11 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 			case "protect":
 				m.GCStatus.ProtectedByPolicy = &pCopied
 			case "delete":
+				if dryRun {
+					m.GCStatus.WouldBeDeletedByPolicy = &pCopied
+					m.IsDeleted = true
+					continue
+				}
 				err := proc.DeleteManifest(account, repo, m.Manifest.Digest, keppel.AuditContext{
 					UserIdentity: janitorUserIdentity{
 						TaskName: "policy-driven-gc",
@@ -258,12 +389,14 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 	query = `UPDATE manifests SET gc_status_json = $1 WHERE repo_id = $2 AND digest = $3`
 	err = sqlext.WithPreparedStatement(j.db, query, func(stmt *sql.Stmt) error {
 		for _, m := range manifests {
-			if m.IsDeleted {
+			//in a dry run, manifests that would have been deleted still exist and
+			//shall show the projected outcome
+			if m.IsDeleted && m.GCStatus.WouldBeDeletedByPolicy == nil {
 				continue
 			}
 			//to simplify UI, show only EITHER protection status OR relevant deleting
 			//policies, not both
-			if m.GCStatus.IsProtected() {
+			if m.GCStatus.IsProtected() || m.GCStatus.WouldBeDeletedByPolicy != nil {
 				m.GCStatus.RelevantPolicies = nil
 			}
 			gcStatusJSON, err := json.Marshal(m.GCStatus)
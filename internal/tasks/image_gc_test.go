@@ -21,12 +21,14 @@ package tasks
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/easypg"
 
+	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/test"
 )
 
@@ -371,3 +373,260 @@ func TestGCProtectComesTooLate(t *testing.T) {
 		s.Clock.Now().Add(1*time.Hour).Unix(),
 	)
 }
+
+// TestGCRetainTags checks policies with action "retain_tags", which keep the
+// newest N matching tags and delete manifests that become untagged.
+func TestGCRetainTags(t *testing.T) {
+	j, s := setup(t)
+
+	//upload 20 images with one tag each, in chronological order
+	images := make([]test.Image, 20)
+	for idx := range images {
+		images[idx] = test.GenerateImage(test.GenerateExampleLayer(int64(idx)))
+		images[idx].MustUpload(t, s, fooRepoRef, fmt.Sprintf("v%02d", idx+1))
+		s.Clock.StepBy(1 * time.Minute)
+	}
+	//images[3] also has a tag that does not match the policy
+	images[3].MustUpload(t, s, fooRepoRef, "stable")
+	//images[0] and images[1] are referenced by an image list
+	imageList := test.GenerateImageList(images[0], images[1])
+	imageList.MustUpload(t, s, fooRepoRef, "multiarch")
+
+	//skip an hour to avoid protected_by_recent_upload
+	s.Clock.StepBy(1 * time.Hour)
+
+	//images[2] has been pulled recently through its tag
+	mustExec(t, s.DB,
+		`UPDATE tags SET last_pulled_at = $1 WHERE name = $2`,
+		s.Clock.Now().Add(-2*time.Hour), "v03",
+	)
+
+	retainingGCPolicyJSON := `{"match_repository":".*","match_tag":"v[0-9]+","tag_retention":{"newest":5,"protect_pulled_within":{"value":1,"unit":"d"}},"action":"retain_tags"}`
+	mustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1`,
+		fmt.Sprintf("[%s]", retainingGCPolicyJSON),
+	)
+
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.GarbageCollectManifestsInNextRepo())
+
+	//the newest 5 tags are retained, as well as the recently pulled tag and the
+	//tags that do not match the policy
+	var tags []keppel.Tag
+	_, err := s.DB.Select(&tags, `SELECT * FROM tags WHERE repo_id = 1 ORDER BY name`)
+	mustDo(t, err)
+	var tagNames []string
+	for _, tag := range tags {
+		tagNames = append(tagNames, tag.Name)
+	}
+	expectedTagNames := []string{"multiarch", "stable", "v03", "v16", "v17", "v18", "v19", "v20"}
+	if strings.Join(tagNames, ",") != strings.Join(expectedTagNames, ",") {
+		t.Errorf("expected tags %v, but got %v", expectedTagNames, tagNames)
+	}
+
+	//images[0] and images[1] lost their tags, but are protected by the image
+	//list; images[2] and images[3] are still tagged; images[4:15] are deleted
+	expectManifestExists := func(digest string, expected bool) {
+		t.Helper()
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE repo_id = 1 AND digest = $1`, digest)
+		mustDo(t, err)
+		if (count > 0) != expected {
+			t.Errorf("expected existence of manifest %s to be %t, but got %t", digest, expected, count > 0)
+		}
+	}
+	expectManifestExists(imageList.Manifest.Digest.String(), true)
+	for idx, image := range images {
+		expectManifestExists(image.Manifest.Digest.String(), idx < 4 || idx >= 15)
+	}
+
+	//GC status reflects the policy decisions
+	expectGCStatus := func(digest, expected string) {
+		t.Helper()
+		actual, err := s.DB.SelectStr(`SELECT gc_status_json FROM manifests WHERE repo_id = 1 AND digest = $1`, digest)
+		mustDo(t, err)
+		if actual != expected {
+			t.Errorf("expected GC status of manifest %s to be %s, but got %s", digest, expected, actual)
+		}
+	}
+	expectGCStatus(images[0].Manifest.Digest.String(),
+		fmt.Sprintf(`{"protected_by_parent":"%s"}`, imageList.Manifest.Digest.String()))
+	expectGCStatus(images[2].Manifest.Digest.String(),
+		fmt.Sprintf(`{"relevant_policies":[%s]}`, retainingGCPolicyJSON))
+	expectGCStatus(images[3].Manifest.Digest.String(), `{}`)
+	expectGCStatus(images[19].Manifest.Digest.String(),
+		fmt.Sprintf(`{"relevant_policies":[%s]}`, retainingGCPolicyJSON))
+
+	//running GC again does not delete anything else
+	s.Clock.StepBy(2 * time.Hour)
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	tr.DBChanges().AssertEqualf(`
+			UPDATE repos SET next_gc_at = %d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+		`,
+		s.Clock.Now().Add(1*time.Hour).Unix(),
+	)
+}
+
+// TestGCDeleteNotPulled checks the "last_pulled_or_pushed_at" time constraint
+// for deleting untagged images that have not been pulled in a while.
+func TestGCDeleteNotPulled(t *testing.T) {
+	j, s := setup(t)
+
+	images := make([]test.Image, 5)
+	for idx := range images {
+		images[idx] = test.GenerateImage(test.GenerateExampleLayer(int64(idx)))
+	}
+	images[0].MustUpload(t, s, fooRepoRef, "")
+	images[1].MustUpload(t, s, fooRepoRef, "")
+	images[2].MustUpload(t, s, fooRepoRef, "")
+	images[3].MustUpload(t, s, fooRepoRef, "latest")
+	//images[2] is referenced by an image list
+	imageList := test.GenerateImageList(images[2])
+	imageList.MustUpload(t, s, fooRepoRef, "list")
+
+	//images[4] is pushed much later than the others
+	s.Clock.StepBy(35 * 24 * time.Hour)
+	images[4].MustUpload(t, s, fooRepoRef, "")
+	s.Clock.StepBy(5 * 24 * time.Hour)
+
+	//only images[1] has been pulled (recently); all other images fall back to
+	//their pushed_at timestamp
+	mustExec(t, s.DB, `UPDATE manifests SET last_pulled_at = NULL`)
+	mustExec(t, s.DB,
+		`UPDATE manifests SET last_pulled_at = $1 WHERE digest = $2`,
+		s.Clock.Now().Add(-24*time.Hour), images[1].Manifest.Digest.String(),
+	)
+
+	deletingGCPolicyJSON := `{"match_repository":".*","only_untagged":true,"time_constraint":{"on":"last_pulled_or_pushed_at","older_than":{"value":30,"unit":"d"}},"action":"delete"}`
+	mustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1`,
+		fmt.Sprintf("[%s]", deletingGCPolicyJSON),
+	)
+
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.GarbageCollectManifestsInNextRepo())
+
+	//only images[0] was neither pulled nor pushed recently, and is neither
+	//tagged nor referenced by another manifest
+	expectGCStatus := func(digest string, expectedStatus string) {
+		t.Helper()
+		actual, err := s.DB.SelectStr(`SELECT gc_status_json FROM manifests WHERE repo_id = 1 AND digest = $1`, digest)
+		mustDo(t, err)
+		if actual != expectedStatus {
+			t.Errorf("expected GC status of manifest %s to be %q, but got %q", digest, expectedStatus, actual)
+		}
+	}
+	relevantStatus := fmt.Sprintf(`{"relevant_policies":[%s]}`, deletingGCPolicyJSON)
+	expectGCStatus(images[0].Manifest.Digest.String(), "") //deleted
+	expectGCStatus(images[1].Manifest.Digest.String(), relevantStatus)
+	expectGCStatus(images[2].Manifest.Digest.String(), fmt.Sprintf(`{"protected_by_parent":"%s"}`, imageList.Manifest.Digest.String()))
+	expectGCStatus(images[3].Manifest.Digest.String(), relevantStatus)
+	expectGCStatus(images[4].Manifest.Digest.String(), relevantStatus)
+	expectGCStatus(imageList.Manifest.Digest.String(), relevantStatus)
+}
+
+// TestGCDryRun checks that a dry run does not delete anything, but reports the
+// projected outcome in the GC status of the affected manifests.
+func TestGCDryRun(t *testing.T) {
+	j, s := setup(t)
+
+	//upload some test images: images[0] is tagged, images[1] is untagged, and
+	//images[2] is untagged but referenced by an untagged image list
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(0)),
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+		test.GenerateImage(test.GenerateExampleLayer(2)),
+	}
+	images[0].MustUpload(t, s, fooRepoRef, "latest")
+	images[1].MustUpload(t, s, fooRepoRef, "")
+	imageList := test.GenerateImageList(images[2])
+	imageList.MustUpload(t, s, fooRepoRef, "")
+
+	//skip an hour to avoid protected_by_recent_upload
+	s.Clock.StepBy(1 * time.Hour)
+
+	deletingGCPolicyJSON := `{"match_repository":".*","only_untagged":true,"action":"delete"}`
+	mustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1`,
+		fmt.Sprintf("[%s]", deletingGCPolicyJSON),
+	)
+
+	//the dry run must not delete anything and not touch next_gc_at...
+	repo, err := keppel.FindRepository(s.DB, "foo", keppel.Account{Name: "test1"})
+	mustDo(t, err)
+	expectSuccess(t, j.DryRunGarbageCollectManifestsInRepo(*repo))
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+	mustDo(t, err)
+	if count != 4 {
+		t.Errorf("expected 4 manifests after dry run, but got %d", count)
+	}
+	count, err = s.DB.SelectInt(`SELECT COUNT(*) FROM repos WHERE next_gc_at IS NOT NULL`)
+	mustDo(t, err)
+	if count != 0 {
+		t.Errorf("expected next_gc_at to not be set by dry run, but it was set on %d repos", count)
+	}
+
+	//...but the GC status must show that images[1] and the image list would be
+	//deleted, whereas images[2] is still protected by its parent
+	expectGCStatus := func(digest, expected string) {
+		t.Helper()
+		actual, err := s.DB.SelectStr(`SELECT gc_status_json FROM manifests WHERE repo_id = 1 AND digest = $1`, digest)
+		mustDo(t, err)
+		if actual != expected {
+			t.Errorf("expected GC status of manifest %s to be %s, but got %s", digest, expected, actual)
+		}
+	}
+	expectGCStatus(images[0].Manifest.Digest.String(),
+		fmt.Sprintf(`{"relevant_policies":[%s]}`, deletingGCPolicyJSON))
+	expectGCStatus(images[1].Manifest.Digest.String(),
+		fmt.Sprintf(`{"would_be_deleted_by_policy":%s}`, deletingGCPolicyJSON))
+	expectGCStatus(images[2].Manifest.Digest.String(),
+		fmt.Sprintf(`{"protected_by_parent":"%s"}`, imageList.Manifest.Digest.String()))
+	expectGCStatus(imageList.Manifest.Digest.String(),
+		fmt.Sprintf(`{"would_be_deleted_by_policy":%s}`, deletingGCPolicyJSON))
+
+	//the actual GC run deletes what the dry run announced (images[2] is still
+	//protected during this run since its parent is only deleted during this run)
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	for _, digest := range []string{images[1].Manifest.Digest.String(), imageList.Manifest.Digest.String()} {
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, digest)
+		mustDo(t, err)
+		if count != 0 {
+			t.Errorf("expected manifest %s to be deleted, but it still exists", digest)
+		}
+	}
+}
+
+func TestGCPausedDuringMaintenance(t *testing.T) {
+	j, s := setup(t)
+
+	//upload an untagged image that would be deleted by GC
+	image := test.GenerateImage(test.GenerateExampleLayer(0))
+	image.MustUpload(t, s, fooRepoRef, "")
+	s.Clock.StepBy(1 * time.Hour)
+	mustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1, in_maintenance = TRUE`,
+		`[{"match_repository":".*","only_untagged":true,"action":"delete"}]`,
+	)
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	tr.DBChanges().Ignore()
+
+	//while the account is in maintenance, GC only reschedules the repo
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.GarbageCollectManifestsInNextRepo())
+	tr.DBChanges().AssertEqualf(`
+			UPDATE repos SET next_gc_at = %d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+		`,
+		s.Clock.Now().Add(1*time.Hour).Unix(),
+	)
+
+	//after maintenance ends, GC resumes on the next run
+	mustExec(t, s.DB, `UPDATE accounts SET in_maintenance = FALSE`)
+	s.Clock.StepBy(2 * time.Hour)
+	expectSuccess(t, j.GarbageCollectManifestsInNextRepo())
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+	mustDo(t, err)
+	if count != 0 {
+		t.Errorf("expected manifest %s to be deleted after maintenance, but it still exists", image.Manifest.Digest.String())
+	}
+}
@@ -19,14 +19,18 @@
 package tasks
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
 	"time"
 
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/processor"
@@ -47,6 +51,14 @@ type Janitor struct {
 	icd     keppel.InboundCacheDriver
 	db      *keppel.DB
 	auditor keppel.Auditor
+	ufl     *processor.UpstreamFetchLimiter //may be nil
+
+	//see SetAbandonedUploadThreshold()
+	abandonedUploadThreshold time.Duration
+	//see SetTaskIntervals()
+	intervals TaskIntervals
+	//see SetWorkerCount()
+	workerCount int
 
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
@@ -55,11 +67,88 @@ type Janitor struct {
 
 // NewJanitor creates a new Janitor.
 func NewJanitor(cfg keppel.Configuration, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor) *Janitor {
-	j := &Janitor{cfg, fd, sd, icd, db, auditor, time.Now, keppel.GenerateStorageID}
+	ufl := processor.NewUpstreamFetchLimiter(cfg.MaxConcurrentUpstreamFetches)
+	j := &Janitor{cfg, fd, sd, icd, db, auditor, ufl, 24 * time.Hour, DefaultTaskIntervals(), 1, time.Now, keppel.GenerateStorageID}
 	j.initializeCounters()
 	return j
 }
 
+// SetAbandonedUploadThreshold configures how long an upload must not have been
+// updated before DeleteNextAbandonedUpload() considers it abandoned. The
+// default is 24 hours.
+func (j *Janitor) SetAbandonedUploadThreshold(threshold time.Duration) *Janitor {
+	j.abandonedUploadThreshold = threshold
+	return j
+}
+
+// TaskIntervals contains the rhythm in which the janitor revisits each repo or
+// account for those tasks that work on one repo or account at a time.
+type TaskIntervals struct {
+	FederationAnnouncement time.Duration //see AnnounceNextAccountToFederation()
+	BlobMountSweep         time.Duration //see SweepBlobMountsInNextRepo()
+	BlobSweep              time.Duration //see SweepBlobsInNextAccount()
+	GarbageCollection      time.Duration //see GarbageCollectManifestsInNextRepo()
+	ManifestSizeCheck      time.Duration //see CheckManifestSizesInNextRepo()
+	ManifestSync           time.Duration //see SyncManifestsInNextRepo()
+	StorageSweep           time.Duration //see SweepStorageInNextAccount()
+
+	//How long unused blobs and blob mounts stay marked before they are deleted
+	//by SweepBlobsInNextAccount() and SweepBlobMountsInNextRepo(). Must be
+	//shorter than the BlobSweep and BlobMountSweep intervals, otherwise the next
+	//pass would find the marked objects before they can be deleted.
+	BlobGracePeriod time.Duration
+}
+
+// DefaultTaskIntervals returns the TaskIntervals that a new Janitor uses
+// unless SetTaskIntervals() is called.
+func DefaultTaskIntervals() TaskIntervals {
+	return TaskIntervals{
+		FederationAnnouncement: 1 * time.Hour,
+		BlobMountSweep:         1 * time.Hour,
+		BlobSweep:              1 * time.Hour,
+		GarbageCollection:      1 * time.Hour,
+		ManifestSizeCheck:      24 * time.Hour,
+		ManifestSync:           1 * time.Hour,
+		StorageSweep:           6 * time.Hour,
+		BlobGracePeriod:        30 * time.Minute,
+	}
+}
+
+// Validate returns an error if the given intervals do not make sense.
+func (i TaskIntervals) Validate() error {
+	if i.BlobGracePeriod <= 0 {
+		return fmt.Errorf("blob grace period must be positive, but is %s", i.BlobGracePeriod)
+	}
+	if i.BlobMountSweep <= i.BlobGracePeriod {
+		return fmt.Errorf("blob mount sweep interval (%s) must be longer than the blob grace period (%s)", i.BlobMountSweep, i.BlobGracePeriod)
+	}
+	if i.BlobSweep <= i.BlobGracePeriod {
+		return fmt.Errorf("blob sweep interval (%s) must be longer than the blob grace period (%s)", i.BlobSweep, i.BlobGracePeriod)
+	}
+	return nil
+}
+
+// SetTaskIntervals configures how often each repo or account is visited by
+// the respective janitor task. The default is DefaultTaskIntervals().
+func (j *Janitor) SetTaskIntervals(intervals TaskIntervals) *Janitor {
+	j.intervals = intervals
+	return j
+}
+
+// SetWorkerCount configures how many workers the caller intends to run
+// concurrently for each of the tasks that work on one repo or account at a
+// time. Those tasks lock the repo or account that they are working on, so it
+// is safe to run them concurrently. The default is 1.
+func (j *Janitor) SetWorkerCount(count int) *Janitor {
+	j.workerCount = count
+	return j
+}
+
+// WorkerCount returns the value that was given to SetWorkerCount().
+func (j *Janitor) WorkerCount() int {
+	return j.workerCount
+}
+
 // OverrideTimeNow replaces time.Now with a test double.
 func (j *Janitor) OverrideTimeNow(timeNow func() time.Time) *Janitor {
 	j.timeNow = timeNow
@@ -73,7 +162,105 @@ func (j *Janitor) OverrideGenerateStorageID(generateStorageID func() string) *Ja
 }
 
 func (j *Janitor) processor() *processor.Processor {
-	return processor.New(j.cfg, j.db, j.sd, j.icd, j.auditor).OverrideTimeNow(j.timeNow).OverrideGenerateStorageID(j.generateStorageID)
+	return processor.New(j.cfg, j.db, j.sd, j.icd, j.auditor).WithUpstreamFetchLimiter(j.ufl).OverrideTimeNow(j.timeNow).OverrideGenerateStorageID(j.generateStorageID)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// locking of repos and accounts for concurrent workers
+
+// We use advisory locks instead of row locks (i.e. `SELECT ... FOR UPDATE SKIP
+// LOCKED`) since a task can take a long time, and a row lock would block API
+// requests (or other tasks) that need to update the same repo or account in
+// the meantime. The lock is held by a transaction that does nothing else, so
+// it is released when that transaction is rolled back, or when the connection
+// is lost.
+var tryAdvisoryLockQuery = `SELECT pg_try_advisory_xact_lock(hashtext($1))`
+
+// Tries to acquire the advisory lock with the given key. If the lock is held
+// by someone else, ok = false is returned. Otherwise, the caller must call
+// release() when done.
+func (j *Janitor) tryLock(key string) (release func(), ok bool, err error) {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	err = tx.QueryRow(tryAdvisoryLockQuery, key).Scan(&ok)
+	if err != nil || !ok {
+		sqlext.RollbackUnlessCommitted(tx)
+		return nil, false, err
+	}
+	return func() { sqlext.RollbackUnlessCommitted(tx) }, true, nil
+}
+
+// Finds the next repo for a task, using a search query that yields
+// candidates in order of priority. The search query must have a `LIMIT` of at
+// least j.workerCount, so that concurrent workers will find a candidate that is
+// not locked by anyone else.
+//
+// On success, the repo is written into the target, and the caller must call
+// release() when done with it. If no unlocked candidate is found,
+// sql.ErrNoRows is returned.
+func (j *Janitor) lockNextRepo(target *keppel.Repository, taskName, searchQuery string, args ...interface{}) (release func(), err error) {
+	var candidates []keppel.Repository
+	_, err = j.db.Select(&candidates, searchQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		release, ok, err := j.tryLock(fmt.Sprintf("%s:repo:%d", taskName, candidate.ID))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		//between our search query and us taking the lock, another worker might
+		//have finished working on this candidate -> only proceed if the repo is
+		//unchanged since the search query
+		var current keppel.Repository
+		err = j.db.SelectOne(&current, `SELECT * FROM repos WHERE id = $1`, candidate.ID)
+		if err == nil && reflect.DeepEqual(current, candidate) {
+			*target = current
+			return release, nil
+		}
+		release()
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Like lockNextRepo, but for accounts.
+func (j *Janitor) lockNextAccount(target *keppel.Account, taskName, searchQuery string, args ...interface{}) (release func(), err error) {
+	var candidates []keppel.Account
+	_, err = j.db.Select(&candidates, searchQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		release, ok, err := j.tryLock(fmt.Sprintf("%s:account:%s", taskName, candidate.Name))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		//see comment in lockNextRepo
+		var current keppel.Account
+		err = j.db.SelectOne(&current, `SELECT * FROM accounts WHERE name = $1`, candidate.Name)
+		if err == nil && reflect.DeepEqual(current, candidate) {
+			*target = current
+			return release, nil
+		}
+		release()
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return nil, sql.ErrNoRows
 }
 
 ////////////////////////////////////////////////////////////////////////////////
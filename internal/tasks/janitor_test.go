@@ -0,0 +1,166 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestConcurrentWorkersDoNotProcessSameRepo(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//create some more repos in addition to "test1/foo"
+	const repoCount = 20
+	for idx := 1; idx < repoCount; idx++ {
+		mustExec(t, s.DB, `INSERT INTO repos (account_name, name) VALUES ('test1', $1)`, fmt.Sprintf("bar%d", idx))
+	}
+
+	//sweep blob mounts with several workers until none of them finds any more
+	//repos to work on
+	const workerCount = 4
+	j.SetWorkerCount(workerCount)
+	var (
+		wg           sync.WaitGroup
+		mutex        sync.Mutex
+		successCount int
+	)
+	for idx := 0; idx < workerCount; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := j.SweepBlobMountsInNextRepo()
+				if err == sql.ErrNoRows {
+					return
+				}
+				if err != nil {
+					t.Error(err.Error())
+					return
+				}
+				mutex.Lock()
+				successCount++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	//a worker can give up early when all its candidates are locked by other
+	//workers, so make sure that nothing is left over
+	for j.SweepBlobMountsInNextRepo() == nil {
+		successCount++
+	}
+
+	//if workers had processed the same repo twice, we would see more successful
+	//sweeps than there are repos
+	if successCount != repoCount {
+		t.Errorf("expected %d successful blob mount sweeps, but got %d", repoCount, successCount)
+	}
+	unsweptCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM repos WHERE next_blob_mount_sweep_at IS NULL`)
+	mustDo(t, err)
+	if unsweptCount != 0 {
+		t.Errorf("expected all repos to be sweeped, but %d were not", unsweptCount)
+	}
+}
+
+func TestLockNextRepo(t *testing.T) {
+	j, s := setup(t)
+	mustExec(t, s.DB, `INSERT INTO repos (account_name, name) VALUES ('test1', 'bar')`)
+	j.SetWorkerCount(2)
+
+	//two workers that lock a repo at the same time get different repos
+	var repo1, repo2, repo3 keppel.Repository
+	release1, err := j.lockNextRepo(&repo1, "blob-mount-sweep", blobMountSweepSearchQuery, j.timeNow(), j.workerCount)
+	mustDo(t, err)
+	release2, err := j.lockNextRepo(&repo2, "blob-mount-sweep", blobMountSweepSearchQuery, j.timeNow(), j.workerCount)
+	mustDo(t, err)
+	if repo1.ID == repo2.ID {
+		t.Errorf("expected two workers to lock different repos, but both got repo %d", repo1.ID)
+	}
+
+	//while both repos are locked, a third worker does not find any repo
+	_, err = j.lockNextRepo(&repo3, "blob-mount-sweep", blobMountSweepSearchQuery, j.timeNow(), j.workerCount)
+	expectError(t, sql.ErrNoRows.Error(), err)
+
+	//locks are separate for each task
+	release3, err := j.lockNextRepo(&repo3, "gc", imageGCRepoSelectQuery, j.timeNow(), j.workerCount)
+	mustDo(t, err)
+	release3()
+
+	//once a worker releases its repo without finishing it, the repo can be locked again
+	release1()
+	release3, err = j.lockNextRepo(&repo3, "blob-mount-sweep", blobMountSweepSearchQuery, j.timeNow(), j.workerCount)
+	mustDo(t, err)
+	if repo3.ID != repo1.ID {
+		t.Errorf("expected to lock repo %d again, but got repo %d", repo1.ID, repo3.ID)
+	}
+	release2()
+	release3()
+}
+
+func TestConfiguredTaskIntervalIsHonored(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	intervals := DefaultTaskIntervals()
+	intervals.BlobMountSweep = 3 * time.Hour
+	j.SetTaskIntervals(intervals)
+
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.SweepBlobMountsInNextRepo())
+
+	var nextSweepAt time.Time
+	mustDo(t, s.DB.QueryRow(`SELECT next_blob_mount_sweep_at FROM repos WHERE id = 1`).Scan(&nextSweepAt))
+	if expected := s.Clock.Now().Add(3 * time.Hour); !nextSweepAt.Equal(expected) {
+		t.Errorf("expected next blob mount sweep at %s, but got %s", expected, nextSweepAt)
+	}
+
+	//the default interval of 1 hour does not apply anymore...
+	s.Clock.StepBy(2 * time.Hour)
+	expectError(t, sql.ErrNoRows.Error(), j.SweepBlobMountsInNextRepo())
+
+	//...but the repo gets sweeped again once the configured interval has passed
+	s.Clock.StepBy(1*time.Hour + 1*time.Second)
+	expectSuccess(t, j.SweepBlobMountsInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.SweepBlobMountsInNextRepo())
+}
+
+func TestValidateTaskIntervals(t *testing.T) {
+	mustDo(t, DefaultTaskIntervals().Validate())
+
+	intervals := DefaultTaskIntervals()
+	intervals.BlobGracePeriod = 1 * time.Hour
+	expectError(t, "blob mount sweep interval (1h0m0s) must be longer than the blob grace period (1h0m0s)", intervals.Validate())
+
+	intervals.BlobMountSweep = 2 * time.Hour
+	expectError(t, "blob sweep interval (1h0m0s) must be longer than the blob grace period (1h0m0s)", intervals.Validate())
+
+	intervals.BlobSweep = 2 * time.Hour
+	mustDo(t, intervals.Validate())
+
+	intervals.BlobGracePeriod = 0
+	expectError(t, "blob grace period must be positive, but is 0s", intervals.Validate())
+}
@@ -0,0 +1,173 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var manifestSizeCheckSearchQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM repos
+		WHERE next_size_check_at IS NULL OR next_size_check_at < $1
+	-- repos without any checks first, then sorted by last check
+	ORDER BY next_size_check_at IS NULL DESC, next_size_check_at ASC
+	-- one candidate per worker (see lockNextRepo)
+	LIMIT $2
+`)
+
+var manifestSizeCheckFlagQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET validation_error_message = $3 WHERE repo_id = $1 AND digest = $2
+`)
+
+var manifestSizeCheckDoneQuery = sqlext.SimplifyWhitespace(`
+	UPDATE repos SET next_size_check_at = $2 WHERE id = $1
+`)
+
+// CheckManifestSizesInNextRepo finds the next repo where the recorded sizes
+// of manifests have not been checked for more than a day, and checks them.
+// For each manifest, the size is recomputed from the stored manifest contents
+// and the recorded sizes of the referenced blobs and child manifests. Blobs
+// whose recorded size differs from what the manifest says are detected, too.
+//
+// Mismatches are only recorded in the manifest's validation_error_message.
+// Nothing is deleted or corrected automatically. If no repos need to be
+// checked, sql.ErrNoRows is returned to instruct the caller to slow down.
+func (j *Janitor) CheckManifestSizesInNextRepo() (returnErr error) {
+	var repo keppel.Repository
+	defer func() {
+		if returnErr == nil {
+			checkManifestSizesSuccessCounter.Inc()
+		} else if returnErr != sql.ErrNoRows {
+			checkManifestSizesFailedCounter.Inc()
+			returnErr = fmt.Errorf("while checking manifest sizes in repo %q: %s",
+				repo.FullName(), returnErr.Error())
+		}
+	}()
+
+	//find repo to check
+	release, err := j.lockNextRepo(&repo, "manifest-size-check", manifestSizeCheckSearchQuery, j.timeNow(), j.workerCount)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			logg.Debug("no manifest sizes to check - slowing down...")
+			return sql.ErrNoRows
+		}
+		return err
+	}
+	defer release()
+
+	account, err := keppel.FindAccount(j.db, repo.AccountName)
+	if err != nil {
+		return err
+	}
+	var manifests []keppel.Manifest
+	_, err = j.db.Select(&manifests, `SELECT * FROM manifests WHERE repo_id = $1`, repo.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range manifests {
+		msg, err := j.checkManifestSize(*account, repo, m)
+		if err != nil {
+			return fmt.Errorf("cannot check size of manifest %s: %w", m.Digest, err)
+		}
+		if msg == "" {
+			continue
+		}
+		logg.Info("size mismatch detected for manifest %s in repo %s: %s", m.Digest, repo.FullName(), msg)
+		manifestSizeMismatchCounter.Inc()
+		_, err = j.db.Exec(manifestSizeCheckFlagQuery, repo.ID, m.Digest, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = j.db.Exec(manifestSizeCheckDoneQuery, repo.ID, j.timeNow().Add(j.intervals.ManifestSizeCheck))
+	return err
+}
+
+// Returns a non-empty message if a size mismatch was found.
+func (j *Janitor) checkManifestSize(account keppel.Account, repo keppel.Repository, manifest keppel.Manifest) (string, error) {
+	var content keppel.ManifestContent
+	err := j.db.SelectOne(&content, `SELECT * FROM manifest_contents WHERE repo_id = $1 AND digest = $2`, repo.ID, manifest.Digest)
+	if err == sql.ErrNoRows {
+		//nothing to check against
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	contentBytes, err := keppel.DecodeManifestContent(content.Content)
+	if err != nil {
+		return "", err
+	}
+	parsed, desc, err := keppel.ParseManifest(manifest.MediaType, contentBytes)
+	if err != nil {
+		return "", err
+	}
+
+	//NOTE: This computation mirrors what processor.validateAndStoreManifestCommon() does.
+	expectedSize := uint64(desc.Size)
+	for _, ref := range parsed.BlobReferences() {
+		expectedSize += uint64(ref.Size)
+
+		blob, err := keppel.FindBlobByRepository(j.db, ref.Digest, repo)
+		if err == sql.ErrNoRows {
+			//missing blobs are reported by ValidateNextManifest()
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if blob.SizeBytes != uint64(ref.Size) {
+			return fmt.Sprintf(
+				"size mismatch: manifest references blob %s with %d bytes, but blob is recorded with %d bytes",
+				ref.Digest.String(), ref.Size, blob.SizeBytes), nil
+		}
+	}
+
+	wasHandled := make(map[string]bool)
+	for _, ref := range parsed.ManifestReferences(account.PlatformFilter) {
+		if wasHandled[ref.Digest.String()] {
+			continue
+		}
+		wasHandled[ref.Digest.String()] = true
+		child, err := keppel.FindManifest(j.db, repo, ref.Digest.String())
+		if err == sql.ErrNoRows {
+			//missing child manifests are reported by ValidateNextManifest()
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		expectedSize += child.SizeBytes
+	}
+
+	if manifest.SizeBytes != expectedSize {
+		return fmt.Sprintf("size mismatch: manifest is recorded with %d bytes, but should have %d bytes",
+			manifest.SizeBytes, expectedSize), nil
+	}
+	return "", nil
+}
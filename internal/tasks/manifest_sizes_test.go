@@ -0,0 +1,91 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestCheckManifestSizesInNextRepo(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//setup three images with some layers
+	images := make([]test.Image, 3)
+	for idx := range images {
+		images[idx] = test.GenerateImage(
+			test.GenerateExampleLayer(int64(10*idx+1)),
+			test.GenerateExampleLayer(int64(10*idx+2)),
+		)
+		images[idx].MustUpload(t, s, fooRepoRef, "")
+	}
+
+	expectValidationErrors := func(expected ...string) {
+		t.Helper()
+		for idx, image := range images {
+			msg, err := s.DB.SelectStr(`SELECT validation_error_message FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			assert.DeepEqual(t, fmt.Sprintf("validation_error_message of image %d", idx), msg, expected[idx])
+		}
+	}
+
+	//when sizes are intact, nothing is flagged
+	expectSuccess(t, j.CheckManifestSizesInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.CheckManifestSizesInNextRepo())
+	expectValidationErrors("", "", "")
+
+	//disturb the recorded size of the first manifest and of one blob in the second manifest
+	mustExec(t, s.DB, `UPDATE manifests SET size_bytes = 1337 WHERE digest = $1`, images[0].Manifest.Digest.String())
+	mustExec(t, s.DB, `UPDATE blobs SET size_bytes = 42 WHERE digest = $1`, images[1].Layers[0].Digest.String())
+
+	//the repo is not checked again until a day has passed
+	s.Clock.StepBy(12 * time.Hour)
+	expectError(t, sql.ErrNoRows.Error(), j.CheckManifestSizesInNextRepo())
+	s.Clock.StepBy(13 * time.Hour)
+	expectSuccess(t, j.CheckManifestSizesInNextRepo())
+	expectError(t, sql.ErrNoRows.Error(), j.CheckManifestSizesInNextRepo())
+
+	//both disturbances are flagged, but nothing gets corrected or deleted
+	expectValidationErrors(
+		fmt.Sprintf("size mismatch: manifest is recorded with 1337 bytes, but should have %d bytes", images[0].SizeBytes()),
+		fmt.Sprintf("size mismatch: manifest references blob %s with %d bytes, but blob is recorded with 42 bytes",
+			images[1].Layers[0].Digest.String(), len(images[1].Layers[0].Contents)),
+		"",
+	)
+	sizeBytes, err := s.DB.SelectInt(`SELECT size_bytes FROM manifests WHERE digest = $1`, images[0].Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "size_bytes of first manifest", sizeBytes, int64(1337))
+	manifestCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest count", manifestCount, int64(len(images)))
+}
@@ -21,8 +21,10 @@ package tasks
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -100,33 +102,14 @@ func (j *Janitor) ValidateNextManifest() (returnErr error) {
 	}
 
 	//perform validation
-	err = j.processor().ValidateExistingManifest(*account, repo, &manifest, j.timeNow())
-	if err == nil {
-		//update `validated_at` and reset error message
-		_, err := j.db.Exec(`
-			UPDATE manifests SET validated_at = $1, validation_error_message = ''
-			 WHERE repo_id = $2 AND digest = $3`,
-			j.timeNow(), repo.ID, manifest.Digest,
-		)
-		if err != nil {
-			return err
-		}
-	} else {
-		//attempt to log the error message, and also update the `validated_at`
-		//timestamp to ensure that the ValidateNextManifest() loop does not get
-		//stuck on this one
-		_, updateErr := j.db.Exec(`
-			UPDATE manifests SET validated_at = $1, validation_error_message = $2
-			 WHERE repo_id = $3 AND digest = $4`,
-			j.timeNow(), err.Error(), repo.ID, manifest.Digest,
-		)
-		if updateErr != nil {
-			err = fmt.Errorf("%s (additional error encountered while recording validation error: %s)", err.Error(), updateErr.Error())
+	validationErr, err := j.processor().RevalidateExistingManifest(*account, repo, &manifest, j.timeNow())
+	if err != nil {
+		if validationErr != nil {
+			return fmt.Errorf("%s (additional error encountered while recording validation error: %s)", validationErr.Error(), err.Error())
 		}
 		return err
 	}
-
-	return nil
+	return validationErr
 }
 
 var syncManifestRepoSelectQuery = sqlext.SimplifyWhitespace(`
@@ -137,8 +120,8 @@ var syncManifestRepoSelectQuery = sqlext.SimplifyWhitespace(`
 		AND (a.upstream_peer_hostname != '' OR a.external_peer_url != '')
 	-- repos without any syncs first, then sorted by last sync
 	ORDER BY r.next_manifest_sync_at IS NULL DESC, r.next_manifest_sync_at ASC
-	-- only one repo at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextRepo)
+	LIMIT $2
 `)
 
 var syncManifestEnumerateRefsQuery = sqlext.SimplifyWhitespace(`
@@ -176,7 +159,7 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 	}()
 
 	//find repository to sync
-	err := j.db.SelectOne(&repo, syncManifestRepoSelectQuery, j.timeNow())
+	release, err := j.lockNextRepo(&repo, "manifest-sync", syncManifestRepoSelectQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to sync manifests in - slowing down...")
@@ -184,6 +167,7 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
 	//find corresponding account
 	account, err := keppel.FindAccount(j.db, repo.AccountName)
@@ -207,7 +191,7 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 		}
 	}
 
-	_, err = j.db.Exec(syncManifestDoneQuery, repo.ID, j.timeNow().Add(1*time.Hour))
+	_, err = j.db.Exec(syncManifestDoneQuery, repo.ID, j.timeNow().Add(j.intervals.ManifestSync))
 	if err != nil {
 		return err
 	}
@@ -297,7 +281,7 @@ func (j *Janitor) getReplicaSyncPayload(account keppel.Account, repo keppel.Repo
 	req.Header.Set("Authorization", "Bearer "+peerToken)
 
 	//execute request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := j.cfg.PeerHTTPClient().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("during POST %s: %w", reqURL, err)
 	}
@@ -361,7 +345,7 @@ TAG:
 		//different manifest, replicate that manifest; all of that boils down to
 		//just a ReplicateManifest() call
 		ref := keppel.ManifestReference{Tag: tag.Name}
-		_, _, err := p.ReplicateManifest(account, repo, ref, keppel.AuditContext{
+		_, _, err := p.ReplicateManifest(context.Background(), account, repo, ref, keppel.AuditContext{
 			UserIdentity: janitorUserIdentity{TaskName: "tag-sync"},
 			Request:      janitorDummyRequest,
 		})
@@ -551,12 +535,18 @@ func (j *Janitor) CheckVulnerabilitiesForNextManifest() (returnErr error) {
 		return fmt.Errorf("cannot find account for repo %s: %s", repo.FullName(), err.Error())
 	}
 
-	err = j.doVulnerabilityCheck(*account, *repo, &manifest)
+	//NOTE: If Clair is unavailable, doVulnerabilityCheck() records the error on
+	//the manifest and reschedules it, so we need to store the manifest anyway.
+	checkErr := j.doVulnerabilityCheck(*account, *repo, &manifest)
+	var uerr clair.UnavailableError
+	if checkErr != nil && !errors.As(checkErr, &uerr) {
+		return checkErr
+	}
+	_, err = j.db.Update(&manifest)
 	if err != nil {
 		return err
 	}
-	_, err = j.db.Update(&manifest)
-	return err
+	return checkErr
 }
 
 var (
@@ -581,6 +571,16 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 		return err
 	}
 
+	//skip Helm charts (Clair only understands container image layers)
+	for _, blob := range blobs {
+		if blob.MediaType == keppel.HelmChartConfigMediaType {
+			manifest.VulnerabilityStatus = clair.UnsupportedVulnerabilityStatus
+			manifest.VulnerabilityScanErrorMessage = "vulnerability scanning is not supported for Helm charts"
+			manifest.NextVulnerabilityCheckAt = p2time(j.timeNow().Add(24 * time.Hour))
+			return nil
+		}
+	}
+
 	//skip when blobs add up to more than 5 GiB
 	if manifest.SizeBytes >= uint64(1<<30*manifestSizeTooBigGiB) {
 		manifest.VulnerabilityStatus = clair.UnsupportedVulnerabilityStatus
@@ -599,7 +599,7 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 				return nil
 			}
 			//otherwise we do the replication ourselves
-			_, err := j.processor().ReplicateBlob(blob, account, repo, nil)
+			_, err := j.processor().ReplicateBlob(context.Background(), blob, account, repo, nil)
 			if err != nil {
 				return err
 			}
@@ -609,7 +609,11 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 
 		if blob.BlocksVulnScanning == nil && strings.HasSuffix(blob.MediaType, "gzip") {
 			//uncompress the blob to check if it's too large for Clair to handle
-			reader, _, err := j.sd.ReadBlob(account, blob.StorageID)
+			storageAccount, err := keppel.FindBlobStorageAccount(j.db, blob, account)
+			if err != nil {
+				return err
+			}
+			reader, _, err := j.sd.ReadBlob(storageAccount, blob.StorageID)
 			if err != nil {
 				return err
 			}
@@ -664,7 +668,7 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 			return j.buildClairManifest(account, repo, *manifest, blobs)
 		})
 		if err != nil {
-			return err
+			return j.handleClairUnavailable(manifest, err)
 		}
 		if clairState.IsErrored {
 			vulnStatuses = append(vulnStatuses, clair.ErrorVulnerabilityStatus)
@@ -672,7 +676,7 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 		} else if clairState.IsIndexed {
 			clairReport, err := j.cfg.ClairClient.GetVulnerabilityReport(manifest.Digest)
 			if err != nil {
-				return err
+				return j.handleClairUnavailable(manifest, err)
 			}
 			if clairReport == nil {
 				//nolint:stylecheck // Clair is a proper name
@@ -697,6 +701,18 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 	return nil
 }
 
+// If Clair is unavailable, we record the error on the manifest (without
+// changing its vulnerability status) and try again later, instead of
+// immediately trying again and hammering Clair while it recovers.
+func (j *Janitor) handleClairUnavailable(manifest *keppel.Manifest, err error) error {
+	var uerr clair.UnavailableError
+	if errors.As(err, &uerr) {
+		manifest.VulnerabilityScanErrorMessage = uerr.Message
+		manifest.NextVulnerabilityCheckAt = p2time(j.timeNow().Add(10 * time.Minute))
+	}
+	return err
+}
+
 func (j *Janitor) buildClairManifest(account keppel.Account, repo keppel.Repository, manifest keppel.Manifest, blobs []keppel.Blob) (clair.Manifest, error) {
 	result := clair.Manifest{
 		Digest: manifest.Digest,
@@ -723,7 +739,11 @@ func (j *Janitor) buildClairManifest(account keppel.Account, repo keppel.Reposit
 		if !isLayer[blob.Digest] {
 			continue
 		}
-		blobURL, err := j.sd.URLForBlob(account, blob.StorageID)
+		storageAccount, err := keppel.FindBlobStorageAccount(j.db, blob, account)
+		if err != nil {
+			return clair.Manifest{}, err
+		}
+		blobURL, err := j.sd.URLForBlob(storageAccount, blob.StorageID)
 		//TODO handle ErrCannotGenerateURL (currently not a problem because all storage drivers can make URLs)
 		if err != nil {
 			return clair.Manifest{}, err
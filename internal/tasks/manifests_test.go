@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -644,3 +645,106 @@ func TestCheckVulnerabilitiesForNextManifest(t *testing.T) {
 		UPDATE manifests SET next_vuln_check_at = 9600, vuln_status = 'Clean' WHERE repo_id = 1 AND digest = '%s';
 	`, images[0].Manifest.Digest, images[2].Manifest.Digest, images[1].Manifest.Digest)
 }
+
+func TestCheckVulnerabilitiesForHelmChart(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//Helm charts are accepted like any other OCI manifest (including the check
+	//that all referenced blobs exist)...
+	chart := test.GenerateHelmChart(1)
+	chart.MustUpload(t, s, fooRepoRef, "0.1.1")
+	blobRefCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifest_blob_refs WHERE digest = $1`, chart.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if blobRefCount != 2 {
+		t.Errorf("expected 2 manifest-blob refs, but got %d", blobRefCount)
+	}
+
+	//...and can be pulled again
+	token := s.GetToken(t, "repository:test1/foo:pull")
+	assert.HTTPRequest{
+		Method: "GET",
+		Path:   "/v2/test1/foo/manifests/0.1.1",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Accept":        chart.Manifest.MediaType,
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{
+			"Content-Type":          chart.Manifest.MediaType,
+			"Docker-Content-Digest": chart.Manifest.Digest.String(),
+		},
+		ExpectBody: assert.ByteData(chart.Manifest.Contents),
+	}.Check(t, s.Handler)
+
+	//Clair cannot scan Helm charts, so we do not even ask it
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	s.Clock.StepBy(30 * time.Minute)
+	expectSuccess(t, j.CheckVulnerabilitiesForNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.CheckVulnerabilitiesForNextManifest())
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET next_vuln_check_at = 91800, vuln_status = 'Unsupported', vuln_scan_error = 'vulnerability scanning is not supported for Helm charts' WHERE repo_id = 1 AND digest = '%s';
+		`,
+		chart.Manifest.Digest,
+	)
+}
+
+func TestCheckVulnerabilitiesWhileClairIsUnavailable(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "")
+
+	//setup a Clair that is down for maintenance
+	clairAvailable := false
+	claird := test.NewClairDouble()
+	claird.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-002.json"
+	clairHandler := httpapi.Compose(claird)
+	http.DefaultTransport = &test.RoundTripper{
+		Handlers: map[string]http.Handler{
+			"registry.example.org": s.Handler,
+			"clair.example.org": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if clairAvailable {
+					clairHandler.ServeHTTP(w, r)
+				} else {
+					http.Error(w, "Clair is down", http.StatusServiceUnavailable)
+				}
+			}),
+		},
+	}
+	clairBaseURL := must.Return(url.Parse("https://clair.example.org/"))
+	j.cfg.ClairClient = &clair.Client{
+		BaseURL:      *clairBaseURL,
+		PresharedKey: []byte("doesnotmatter"), //since the ClairDouble does not check the Authorization header
+	}
+	s.SD.AllowDummyURLs = true
+
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+
+	//when Clair is unavailable, the error is recorded on the manifest, and the
+	//manifest is not checked again for a while (instead of retrying immediately)
+	s.Clock.StepBy(30 * time.Minute)
+	expectedMessage := fmt.Sprintf(`cannot GET https://clair.example.org/indexer/api/v1/index_report/%s: got 503 response: "Clair is down\n"`, image.Manifest.Digest)
+	expectError(t, "while updating vulnerability status for a manifest: "+expectedMessage, j.CheckVulnerabilitiesForNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.CheckVulnerabilitiesForNextManifest())
+	tr.DBChanges().AssertEqualf(`
+			UPDATE blobs SET blocks_vuln_scanning = FALSE WHERE id = 1 AND account_name = 'test1' AND digest = '%[1]s';
+			UPDATE manifests SET next_vuln_check_at = 6000, vuln_scan_error = '%[3]s' WHERE repo_id = 1 AND digest = '%[2]s';
+		`,
+		image.Layers[0].Digest, image.Manifest.Digest, strings.ReplaceAll(expectedMessage, "'", "''"),
+	)
+
+	//when Clair comes back, the check proceeds as usual and the error is cleared
+	clairAvailable = true
+	s.Clock.StepBy(10 * time.Minute)
+	expectSuccess(t, j.CheckVulnerabilitiesForNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.CheckVulnerabilitiesForNextManifest())
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET next_vuln_check_at = 6120, vuln_scan_error = '' WHERE repo_id = 1 AND digest = '%[1]s';
+		`,
+		image.Manifest.Digest,
+	)
+}
@@ -37,6 +37,18 @@ var (
 		Name: "keppel_failed_vulnerability_checks",
 		Help: "Counter for failed updates of the vulnerability status of a manifest.",
 	})
+	checkManifestSizesSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_successful_manifest_size_checks",
+		Help: "Counter for successful checks of recorded manifest sizes in a repo.",
+	})
+	checkManifestSizesFailedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_failed_manifest_size_checks",
+		Help: "Counter for failed checks of recorded manifest sizes in a repo.",
+	})
+	manifestSizeMismatchCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_manifest_size_mismatches",
+		Help: "Counter for manifests whose recorded size was found to not match their contents.",
+	})
 	cleanupAbandonedUploadSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "keppel_successful_abandoned_upload_cleanups",
 		Help: "Counter for successful cleanup of abandoned uploads.",
@@ -53,6 +65,22 @@ var (
 		Name: "keppel_failed_image_garbage_collections",
 		Help: "Counter for failed garbage collection runs in repos.",
 	})
+	purgeDeletedManifestsSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_successful_deleted_manifest_purges",
+		Help: "Counter for successful purges of deleted manifests whose retention period has expired.",
+	})
+	purgeDeletedManifestsFailedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_failed_deleted_manifest_purges",
+		Help: "Counter for failed purges of deleted manifests whose retention period has expired.",
+	})
+	purgeManifestPullStatsSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_successful_manifest_pull_stats_purges",
+		Help: "Counter for successful purges of manifest pull stats whose retention period has expired.",
+	})
+	purgeManifestPullStatsFailedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_failed_manifest_pull_stats_purges",
+		Help: "Counter for failed purges of manifest pull stats whose retention period has expired.",
+	})
 	sweepBlobMountsSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "keppel_successful_blob_mount_sweeps",
 		Help: "Counter for successful garbage collections on blob mounts in a repo.",
@@ -112,10 +140,17 @@ func (j *Janitor) initializeCounters() {
 		prometheus.MustRegister(announceAccountToFederationFailedCounter)
 		prometheus.MustRegister(checkVulnerabilitySuccessCounter)
 		prometheus.MustRegister(checkVulnerabilityFailedCounter)
+		prometheus.MustRegister(checkManifestSizesSuccessCounter)
+		prometheus.MustRegister(checkManifestSizesFailedCounter)
+		prometheus.MustRegister(manifestSizeMismatchCounter)
 		prometheus.MustRegister(cleanupAbandonedUploadSuccessCounter)
 		prometheus.MustRegister(cleanupAbandonedUploadFailedCounter)
 		prometheus.MustRegister(imageGCSuccessCounter)
 		prometheus.MustRegister(imageGCFailedCounter)
+		prometheus.MustRegister(purgeDeletedManifestsSuccessCounter)
+		prometheus.MustRegister(purgeDeletedManifestsFailedCounter)
+		prometheus.MustRegister(purgeManifestPullStatsSuccessCounter)
+		prometheus.MustRegister(purgeManifestPullStatsFailedCounter)
 		prometheus.MustRegister(sweepBlobMountsSuccessCounter)
 		prometheus.MustRegister(sweepBlobMountsFailedCounter)
 		prometheus.MustRegister(sweepBlobsSuccessCounter)
@@ -135,10 +170,17 @@ func (j *Janitor) initializeCounters() {
 	announceAccountToFederationFailedCounter.Add(0)
 	checkVulnerabilitySuccessCounter.Add(0)
 	checkVulnerabilityFailedCounter.Add(0)
+	checkManifestSizesSuccessCounter.Add(0)
+	checkManifestSizesFailedCounter.Add(0)
+	manifestSizeMismatchCounter.Add(0)
 	cleanupAbandonedUploadSuccessCounter.Add(0)
 	cleanupAbandonedUploadFailedCounter.Add(0)
 	imageGCSuccessCounter.Add(0)
 	imageGCFailedCounter.Add(0)
+	purgeDeletedManifestsSuccessCounter.Add(0)
+	purgeDeletedManifestsFailedCounter.Add(0)
+	purgeManifestPullStatsSuccessCounter.Add(0)
+	purgeManifestPullStatsFailedCounter.Add(0)
 	sweepBlobMountsSuccessCounter.Add(0)
 	sweepBlobMountsFailedCounter.Add(0)
 	sweepBlobsSuccessCounter.Add(0)
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/sapcc/go-bits/logg"
 	"golang.org/x/crypto/bcrypt"
@@ -36,8 +37,31 @@ import (
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
+const (
+	peeringBackoffInitial = 30 * time.Second
+	peeringBackoffMax     = 30 * time.Minute
+)
+
+// PeeringBackoff returns how long to wait before the next attempt at issuing a
+// password to a peer after the given number of consecutive failures. The delay
+// doubles with each failure, up to a maximum of 30 minutes.
+func PeeringBackoff(consecutiveFailures int) time.Duration {
+	backoff := peeringBackoffInitial
+	for idx := 1; idx < consecutiveFailures; idx++ {
+		backoff *= 2
+		if backoff >= peeringBackoffMax {
+			return peeringBackoffMax
+		}
+	}
+	return backoff
+}
+
 // IssueNewPasswordForPeer issues a new replication password for the given peer.
 //
+// If the issuance fails, the peer's failure counter is incremented and
+// `next_peering_at` is set according to PeeringBackoff(). On success, both are
+// reset.
+//
 // The `tx` argument can be given if the caller already has a transaction open
 // for this operation. This is useful because it is the caller's responsibility
 // to lock the database row for the peer to prevent concurrent issuances for the
@@ -61,7 +85,9 @@ func IssueNewPasswordForPeer(cfg keppel.Configuration, db *keppel.DB, tx *gorp.T
 		UPDATE peers SET
 			their_current_password_hash = $1,
 			their_previous_password_hash = their_current_password_hash,
-			last_peered_at = NOW()
+			last_peered_at = NOW(),
+			consecutive_peering_failures = 0,
+			next_peering_at = NULL
 		WHERE hostname = $2
 	`, newPasswordHashed, peer.HostName)
 	if err == nil {
@@ -79,19 +105,24 @@ func IssueNewPasswordForPeer(cfg keppel.Configuration, db *keppel.DB, tx *gorp.T
 	//the problem is that, if we later find that the peer has not successfully
 	//stored the password on their side, we need to revert these changes,
 	//otherwise the actual credentials used by the peer rotate out of our DB
+	//(we also use this opportunity to delay the next attempt for this peer, so
+	//that an unreachable peer does not cause a tight loop of failed attempts)
 	resultErr = errors.New("interrupted")
 	defer func() {
 		if resultErr == nil {
 			return
 		}
+		failures := peer.ConsecutivePeeringFailures + 1
 		_, err := db.Exec(`
 			UPDATE peers SET
 				their_current_password_hash = $1,
 				their_previous_password_hash = $2,
-				last_peered_at = $3
-			WHERE hostname = $4
+				last_peered_at = $3,
+				consecutive_peering_failures = $4,
+				next_peering_at = $5
+			WHERE hostname = $6
 		`, peer.TheirCurrentPasswordHash, peer.TheirPreviousPasswordHash,
-			peer.LastPeeredAt, peer.HostName)
+			peer.LastPeeredAt, failures, time.Now().Add(PeeringBackoff(failures)), peer.HostName)
 		if err != nil {
 			resultErr = fmt.Errorf("%s (additional error encountered while attempting to rollback the new peer password in our DB: %s)", resultErr.Error(), err.Error())
 		}
@@ -94,23 +94,75 @@ func TestIssueNewPasswordForPeer(t *testing.T) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		})
 		peerBeforeFailedIssue := getPeerFromDB(t, s.DB)
+		for _, expectedFailures := range []int{1, 2, 3} {
+			timeBeforeIssue := time.Now()
+			tx, err := s.DB.Begin()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			err = IssueNewPasswordForPeer(s.Config, s.DB, tx, getPeerFromDB(t, s.DB))
+			if err == nil {
+				t.Error("expected IssueNewPasswordForPeer to fail, but got err = nil")
+			}
+
+			//a failing issuance should only touch the backoff state, and the delay
+			//until the next attempt should grow with each failure
+			peerState := getPeerFromDB(t, s.DB)
+			assert.DeepEqual(t, "consecutive_peering_failures after failed IssueNewPasswordForPeer",
+				peerState.ConsecutivePeeringFailures, expectedFailures)
+			if peerState.NextPeeringAt == nil {
+				t.Error("expected peer to have next_peering_at, but got nil")
+			} else {
+				backoff := PeeringBackoff(expectedFailures)
+				if peerState.NextPeeringAt.Before(timeBeforeIssue.Add(backoff)) || peerState.NextPeeringAt.After(time.Now().Add(backoff)) {
+					t.Errorf("expected next_peering_at to be %s after the failed attempt, but got %s",
+						backoff, peerState.NextPeeringAt.Sub(timeBeforeIssue))
+				}
+			}
+			peerState.ConsecutivePeeringFailures = 0
+			peerState.NextPeeringAt = nil
+			assert.DeepEqual(t, "peer state after failed IssueNewPasswordForPeer",
+				peerState,
+				peerBeforeFailedIssue,
+			)
+		}
+
+		//a successful issuance resets the backoff
+		tt.Handlers["peer.example.org"] = httpapi.Compose(&mockPeer)
 		tx, err := s.DB.Begin()
 		if err != nil {
 			t.Fatal(err.Error())
 		}
 		err = IssueNewPasswordForPeer(s.Config, s.DB, tx, getPeerFromDB(t, s.DB))
-		if err == nil {
-			t.Error("expected IssueNewPasswordForPeer to fail, but got err = nil")
+		if err != nil {
+			t.Error(err.Error())
+		}
+		peerState := getPeerFromDB(t, s.DB)
+		assert.DeepEqual(t, "consecutive_peering_failures after successful IssueNewPasswordForPeer",
+			peerState.ConsecutivePeeringFailures, 0)
+		if peerState.NextPeeringAt != nil {
+			t.Errorf("expected next_peering_at to be reset, but got %s", peerState.NextPeeringAt.String())
 		}
-
-		//a failing issuance should not touch the DB
-		assert.DeepEqual(t, "peer state after failed IssueNewPasswordForPeer",
-			getPeerFromDB(t, s.DB),
-			peerBeforeFailedIssue,
-		)
 	})
 }
 
+func TestPeeringBackoff(t *testing.T) {
+	expected := []time.Duration{
+		30 * time.Second, //after 1 failure
+		1 * time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		30 * time.Minute, //capped
+		30 * time.Minute,
+	}
+	for idx, backoff := range expected {
+		assert.DeepEqual(t, "PeeringBackoff", PeeringBackoff(idx+1), backoff)
+	}
+	assert.DeepEqual(t, "PeeringBackoff", PeeringBackoff(1000), peeringBackoffMax)
+}
+
 func getPeerFromDB(t *testing.T, db *keppel.DB) keppel.Peer {
 	t.Helper()
 	var peer keppel.Peer
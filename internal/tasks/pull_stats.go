@@ -0,0 +1,61 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// PurgeOldManifestPullStats removes all per-day pull counts that are older
+// than keppel.ManifestPullStatsRetention. If nothing needs to be purged,
+// sql.ErrNoRows is returned to instruct the caller to slow down.
+func (j *Janitor) PurgeOldManifestPullStats() (returnErr error) {
+	defer func() {
+		if returnErr == nil {
+			purgeManifestPullStatsSuccessCounter.Inc()
+		} else if returnErr != sql.ErrNoRows {
+			purgeManifestPullStatsFailedCounter.Inc()
+			returnErr = fmt.Errorf("while purging old manifest pull stats: %s", returnErr.Error())
+		}
+	}()
+
+	//pull stats are kept for whole days, so the cutoff is aligned to the start of a day
+	y, m, d := j.timeNow().UTC().Date()
+	cutoff := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Add(-keppel.ManifestPullStatsRetention)
+	result, err := j.db.Exec(`DELETE FROM manifest_pull_stats WHERE day < $1`, cutoff.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	rowsDeleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsDeleted == 0 {
+		logg.Debug("no manifest pull stats to purge - slowing down...")
+		return sql.ErrNoRows
+	}
+	logg.Info("purged %d manifest pull stats after their retention period expired", rowsDeleted)
+	return nil
+}
@@ -0,0 +1,70 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestPurgeOldManifestPullStats(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	account, err := keppel.FindAccount(s.DB, "test1")
+	mustDo(t, err)
+	repo, err := keppel.FindRepository(s.DB, "foo", *account)
+	mustDo(t, err)
+
+	//nothing to purge yet
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeOldManifestPullStats())
+
+	//record pulls on two different days; repeated pulls on the same day are
+	//aggregated into one row, also across multiple flushes
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	s.PullCounter.Record(repo.ID, digest, s.Clock.Now())
+	s.PullCounter.Record(repo.ID, digest, s.Clock.Now())
+	mustDo(t, s.PullCounter.Flush())
+	s.PullCounter.Record(repo.ID, digest, s.Clock.Now())
+	mustDo(t, s.PullCounter.Flush())
+	s.Clock.StepBy(24 * time.Hour)
+	s.PullCounter.Record(repo.ID, digest, s.Clock.Now())
+	mustDo(t, s.PullCounter.Flush())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM manifest_pull_stats`, 2)
+	expectRowCount(t, s.DB, `SELECT SUM(count) FROM manifest_pull_stats`, 4)
+	expectRowCount(t, s.DB, `SELECT count FROM manifest_pull_stats WHERE day = '1970-01-01'`, 3)
+
+	//before the retention period expires, nothing is purged
+	s.Clock.StepBy(keppel.ManifestPullStatsRetention - 24*time.Hour)
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeOldManifestPullStats())
+
+	//afterwards, the stats are purged day by day
+	s.Clock.StepBy(24 * time.Hour)
+	expectSuccess(t, j.PurgeOldManifestPullStats())
+	expectError(t, sql.ErrNoRows.Error(), j.PurgeOldManifestPullStats())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM manifest_pull_stats WHERE day = '1970-01-01'`, 0)
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM manifest_pull_stats`, 1)
+
+	s.Clock.StepBy(24 * time.Hour)
+	expectSuccess(t, j.PurgeOldManifestPullStats())
+	expectRowCount(t, s.DB, `SELECT COUNT(*) FROM manifest_pull_stats`, 0)
+}
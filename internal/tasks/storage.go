@@ -34,8 +34,8 @@ var storageSweepSearchQuery = sqlext.SimplifyWhitespace(`
 		WHERE next_storage_sweep_at IS NULL OR next_storage_sweep_at < $1
 	-- accounts without any sweeps first, then sorted by last sweep
 	ORDER BY next_storage_sweep_at IS NULL DESC, next_storage_sweep_at ASC
-	-- only one account at a time
-	LIMIT 1
+	-- one candidate per worker (see lockNextAccount)
+	LIMIT $2
 `)
 
 var storageSweepDoneQuery = sqlext.SimplifyWhitespace(`
@@ -52,9 +52,9 @@ var storageSweepDoneQuery = sqlext.SimplifyWhitespace(`
 // manifests that were just pushed, but where the entry in the database is still
 // being created.
 //
-// The storage of each account is sweeped at most once every 6 hours. If no
-// accounts need to be sweeped, sql.ErrNoRows is returned to instruct the caller
-// to slow down.
+// The storage of each account is sweeped at most once every 6 hours (or as
+// configured with SetTaskIntervals()). If no accounts need to be sweeped,
+// sql.ErrNoRows is returned to instruct the caller to slow down.
 func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 	var account keppel.Account
 	defer func() {
@@ -68,7 +68,7 @@ func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 	}()
 
 	//find account to sweep
-	err := j.db.SelectOne(&account, storageSweepSearchQuery, j.timeNow())
+	release, err := j.lockNextAccount(&account, "storage-sweep", storageSweepSearchQuery, j.timeNow(), j.workerCount)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no storages to sweep - slowing down...")
@@ -76,50 +76,84 @@ func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 		}
 		return err
 	}
+	defer release()
 
-	//enumerate blobs and manifests in the backing storage
-	actualBlobs, actualManifests, err := j.sd.ListStorageContents(account)
+	//when creating new entries in `unknown_blobs` and `unknown_manifests`, set
+	//the `can_be_deleted_at` timestamp such that the next pass will sweep them
+	//(we don't use the full interval to account for the marking taking some time)
+	canBeDeletedAt := j.timeNow().Add(j.intervals.StorageSweep * 2 / 3)
+
+	//load the DB state for blobs and manifests before enumerating the backing
+	//storage, so that the storage contents can be processed in a streaming
+	//fashion without holding the entire listing in memory
+	blobSweep, err := j.prepareBlobSweep(account, canBeDeletedAt)
+	if err != nil {
+		return err
+	}
+	manifestSweep, err := j.prepareManifestSweep(account, canBeDeletedAt)
 	if err != nil {
 		return err
 	}
 
-	//when creating new entries in `unknown_blobs` and `unknown_manifests`, set
-	//the `can_be_deleted_at` timestamp such that the next pass 6 hours from now
-	//will sweep them (we don't use .Add(6 * time.Hour) to account for the
-	//marking taking some time)
-	canBeDeletedAt := j.timeNow().Add(4 * time.Hour)
+	//enumerate blobs and manifests in the backing storage (this also performs
+	//the mark phase for newly discovered unknown blobs and manifests)
+	err = j.sd.ListStorageContentsStream(account, blobSweep.Observe, manifestSweep.Observe)
+	if err != nil {
+		return err
+	}
 
-	//handle blobs and manifests separately
-	err = j.sweepBlobStorage(account, actualBlobs, canBeDeletedAt)
+	//unmark/sweep phase for blobs and manifests that were marked in a previous pass
+	err = blobSweep.Finish()
 	if err != nil {
 		return err
 	}
-	err = j.sweepManifestStorage(account, actualManifests, canBeDeletedAt)
+	err = manifestSweep.Finish()
 	if err != nil {
 		return err
 	}
 
-	_, err = j.db.Exec(storageSweepDoneQuery, account.Name, j.timeNow().Add(6*time.Hour))
+	_, err = j.db.Exec(storageSweepDoneQuery, account.Name, j.timeNow().Add(j.intervals.StorageSweep))
 	return err
 }
 
-func (j *Janitor) sweepBlobStorage(account keppel.Account, actualBlobs []keppel.StoredBlobInfo, canBeDeletedAt time.Time) error {
-	actualBlobsByStorageID := make(map[string]keppel.StoredBlobInfo, len(actualBlobs))
-	for _, blobInfo := range actualBlobs {
-		actualBlobsByStorageID[blobInfo.StorageID] = blobInfo
+// blobSweep contains the state of the blob storage sweep for a single account.
+type blobSweep struct {
+	j              *Janitor
+	account        keppel.Account
+	canBeDeletedAt time.Time
+	//storage IDs of blobs and uploads known to the DB
+	isKnownStorageID map[string]bool
+	//blobs that were marked in a previous pass (key = storage ID)
+	markedBlobs map[string]keppel.UnknownBlob
+	//chunk counts for marked blobs that were observed in the backing storage
+	//during this pass (only marked blobs are tracked to keep memory usage low)
+	observedChunkCounts map[string]uint32
+	//storage IDs of blobs that were marked during this pass
+	isNewlyMarked map[string]bool
+}
+
+func (j *Janitor) prepareBlobSweep(account keppel.Account, canBeDeletedAt time.Time) (*blobSweep, error) {
+	s := &blobSweep{
+		j:                   j,
+		account:             account,
+		canBeDeletedAt:      canBeDeletedAt,
+		isKnownStorageID:    make(map[string]bool),
+		markedBlobs:         make(map[string]keppel.UnknownBlob),
+		observedChunkCounts: make(map[string]uint32),
+		isNewlyMarked:       make(map[string]bool),
 	}
 
-	//enumerate blobs known to the DB
-	isKnownStorageID := make(map[string]bool)
-	query := `SELECT storage_id FROM blobs WHERE account_name = $1`
+	//enumerate blobs known to the DB (including those in other accounts that
+	//refer to this account's storage because of cross-account deduplication)
+	query := `SELECT storage_id FROM blobs WHERE account_name = $1 OR storage_account_name = $1`
 	err := sqlext.ForeachRow(j.db, query, []interface{}{account.Name}, func(rows *sql.Rows) error {
 		var storageID string
 		err := rows.Scan(&storageID)
-		isKnownStorageID[storageID] = true
+		s.isKnownStorageID[storageID] = true
 		return err
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//blobs in the backing storage may also correspond to uploads in progress
@@ -127,24 +161,60 @@ func (j *Janitor) sweepBlobStorage(account keppel.Account, actualBlobs []keppel.
 	err = sqlext.ForeachRow(j.db, query, []interface{}{account.Name}, func(rows *sql.Rows) error {
 		var storageID string
 		err := rows.Scan(&storageID)
-		isKnownStorageID[storageID] = true
+		s.isKnownStorageID[storageID] = true
 		return err
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	//unmark/sweep phase: enumerate all unknown blobs
+	//enumerate blobs that were marked in a previous pass
 	var unknownBlobs []keppel.UnknownBlob
 	_, err = j.db.Select(&unknownBlobs, `SELECT * FROM unknown_blobs WHERE account_name = $1`, account.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	isMarkedStorageID := make(map[string]bool)
 	for _, unknownBlob := range unknownBlobs {
+		s.markedBlobs[unknownBlob.StorageID] = unknownBlob
+	}
+
+	return s, nil
+}
+
+// Observe is called for each blob that is found in the backing storage.
+func (s *blobSweep) Observe(blobInfo keppel.StoredBlobInfo) error {
+	storageID := blobInfo.StorageID
+	if s.isKnownStorageID[storageID] || s.isNewlyMarked[storageID] {
+		return nil
+	}
+
+	//remember blobs that were marked previously for the sweep phase
+	if _, isMarked := s.markedBlobs[storageID]; isMarked {
+		if prevCount, exists := s.observedChunkCounts[storageID]; exists {
+			s.observedChunkCounts[storageID] = keppel.MergeChunkCounts(prevCount, blobInfo.ChunkCount)
+		} else {
+			s.observedChunkCounts[storageID] = blobInfo.ChunkCount
+		}
+		return nil
+	}
+
+	//mark phase: record newly discovered unknown blobs in the DB
+	s.isNewlyMarked[storageID] = true
+	return s.j.db.Insert(&keppel.UnknownBlob{
+		AccountName:    s.account.Name,
+		StorageID:      storageID,
+		CanBeDeletedAt: s.canBeDeletedAt,
+	})
+}
+
+// Finish performs the unmark/sweep phase after all blobs in the backing
+// storage have been observed.
+func (s *blobSweep) Finish() error {
+	j := s.j
+	for _, unknownBlob := range s.markedBlobs {
 		//unmark blobs that have been recorded in the database in the meantime
-		if isKnownStorageID[unknownBlob.StorageID] {
-			_, err = j.db.Delete(&unknownBlob) //nolint:gosec // Delete is not holding onto the pointer after it returns
+		if s.isKnownStorageID[unknownBlob.StorageID] {
+			_, err := j.db.Delete(&unknownBlob) //nolint:gosec // Delete is not holding onto the pointer after it returns
 			if err != nil {
 				return err
 			}
@@ -152,89 +222,124 @@ func (j *Janitor) sweepBlobStorage(account keppel.Account, actualBlobs []keppel.
 		}
 
 		//sweep blobs that have been marked long enough
-		isMarkedStorageID[unknownBlob.StorageID] = true
 		if unknownBlob.CanBeDeletedAt.Before(j.timeNow()) {
 			//only call DeleteBlob if we can still see the blob in the backing
 			//storage (this protects against unexpected errors e.g. because an
 			//operator deleted the blob between the mark and sweep phases, or if we
 			//deleted the blob from the backing storage in a previous sweep, but
 			//could not remove the unknown_blobs entry from the DB)
-			if blobInfo, exists := actualBlobsByStorageID[unknownBlob.StorageID]; exists {
+			if chunkCount, exists := s.observedChunkCounts[unknownBlob.StorageID]; exists {
 				//need to use different cleanup strategies depending on whether the
 				//blob upload was finalized or not
-				if blobInfo.ChunkCount > 0 {
+				var err error
+				if chunkCount > 0 {
 					logg.Info("storage sweep in account %s: removing unfinalized blob stored at %s with %d chunks",
-						account.Name, unknownBlob.StorageID, blobInfo.ChunkCount)
-					err = j.sd.AbortBlobUpload(account, unknownBlob.StorageID, blobInfo.ChunkCount)
+						s.account.Name, unknownBlob.StorageID, chunkCount)
+					err = j.sd.AbortBlobUpload(s.account, unknownBlob.StorageID, chunkCount)
 				} else {
 					logg.Info("storage sweep in account %s: removing finalized blob stored at %s",
-						account.Name, unknownBlob.StorageID)
-					err = j.sd.DeleteBlob(account, unknownBlob.StorageID)
+						s.account.Name, unknownBlob.StorageID)
+					err = j.sd.DeleteBlob(s.account, unknownBlob.StorageID)
 				}
 				if err != nil {
 					return err
 				}
 			}
-			_, err = j.db.Delete(&unknownBlob) //nolint:gosec // Delete is not holding onto the pointer after it returns
+			_, err := j.db.Delete(&unknownBlob) //nolint:gosec // Delete is not holding onto the pointer after it returns
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	//mark phase: record newly discovered unknown blobs in the DB
-	for storageID := range actualBlobsByStorageID {
-		if isKnownStorageID[storageID] || isMarkedStorageID[storageID] {
-			continue
-		}
-		err := j.db.Insert(&keppel.UnknownBlob{
-			AccountName:    account.Name,
-			StorageID:      storageID,
-			CanBeDeletedAt: canBeDeletedAt,
-		})
-		if err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
-func (j *Janitor) sweepManifestStorage(account keppel.Account, actualManifests []keppel.StoredManifestInfo, canBeDeletedAt time.Time) error {
-	isActualManifest := make(map[keppel.StoredManifestInfo]bool, len(actualManifests))
-	for _, m := range actualManifests {
-		isActualManifest[m] = true
+// manifestSweep contains the state of the manifest storage sweep for a single account.
+type manifestSweep struct {
+	j              *Janitor
+	account        keppel.Account
+	canBeDeletedAt time.Time
+	//manifests known to the DB
+	isKnownManifest map[keppel.StoredManifestInfo]bool
+	//manifests that were marked in a previous pass
+	markedManifests map[keppel.StoredManifestInfo]keppel.UnknownManifest
+	//marked manifests that were observed in the backing storage during this pass
+	isObservedMarkedManifest map[keppel.StoredManifestInfo]bool
+	//manifests that were marked during this pass
+	isNewlyMarked map[keppel.StoredManifestInfo]bool
+}
+
+func (j *Janitor) prepareManifestSweep(account keppel.Account, canBeDeletedAt time.Time) (*manifestSweep, error) {
+	s := &manifestSweep{
+		j:                        j,
+		account:                  account,
+		canBeDeletedAt:           canBeDeletedAt,
+		isKnownManifest:          make(map[keppel.StoredManifestInfo]bool),
+		markedManifests:          make(map[keppel.StoredManifestInfo]keppel.UnknownManifest),
+		isObservedMarkedManifest: make(map[keppel.StoredManifestInfo]bool),
+		isNewlyMarked:            make(map[keppel.StoredManifestInfo]bool),
 	}
 
 	//enumerate manifests known to the DB
-	isKnownManifest := make(map[keppel.StoredManifestInfo]bool)
 	query := `SELECT r.name, m.digest FROM repos r JOIN manifests m ON m.repo_id = r.id WHERE r.account_name = $1`
 	err := sqlext.ForeachRow(j.db, query, []interface{}{account.Name}, func(rows *sql.Rows) error {
 		var m keppel.StoredManifestInfo
 		err := rows.Scan(&m.RepoName, &m.Digest)
-		isKnownManifest[m] = true
+		s.isKnownManifest[m] = true
 		return err
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	//unmark/sweep phase: enumerate all unknown manifests
+	//enumerate manifests that were marked in a previous pass
 	var unknownManifests []keppel.UnknownManifest
 	_, err = j.db.Select(&unknownManifests, `SELECT * FROM unknown_manifests WHERE account_name = $1`, account.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	isMarkedManifest := make(map[keppel.StoredManifestInfo]bool)
 	for _, unknownManifest := range unknownManifests {
-		unknownManifestInfo := keppel.StoredManifestInfo{
+		info := keppel.StoredManifestInfo{
 			RepoName: unknownManifest.RepositoryName,
 			Digest:   unknownManifest.Digest,
 		}
+		s.markedManifests[info] = unknownManifest
+	}
 
+	return s, nil
+}
+
+// Observe is called for each manifest that is found in the backing storage.
+func (s *manifestSweep) Observe(manifest keppel.StoredManifestInfo) error {
+	if s.isKnownManifest[manifest] || s.isNewlyMarked[manifest] {
+		return nil
+	}
+
+	//remember manifests that were marked previously for the sweep phase
+	if _, isMarked := s.markedManifests[manifest]; isMarked {
+		s.isObservedMarkedManifest[manifest] = true
+		return nil
+	}
+
+	//mark phase: record newly discovered unknown manifests in the DB
+	s.isNewlyMarked[manifest] = true
+	return s.j.db.Insert(&keppel.UnknownManifest{
+		AccountName:    s.account.Name,
+		RepositoryName: manifest.RepoName,
+		Digest:         manifest.Digest,
+		CanBeDeletedAt: s.canBeDeletedAt,
+	})
+}
+
+// Finish performs the unmark/sweep phase after all manifests in the backing
+// storage have been observed.
+func (s *manifestSweep) Finish() error {
+	j := s.j
+	for unknownManifestInfo, unknownManifest := range s.markedManifests {
 		//unmark manifests that have been recorded in the database in the meantime
-		if isKnownManifest[unknownManifestInfo] {
-			_, err = j.db.Delete(&unknownManifest) //nolint:gosec // Delete is not holding onto the pointer after it returns
+		if s.isKnownManifest[unknownManifestInfo] {
+			_, err := j.db.Delete(&unknownManifest) //nolint:gosec // Delete is not holding onto the pointer after it returns
 			if err != nil {
 				return err
 			}
@@ -242,43 +347,26 @@ func (j *Janitor) sweepManifestStorage(account keppel.Account, actualManifests [
 		}
 
 		//sweep manifests that have been marked long enough
-		isMarkedManifest[unknownManifestInfo] = true
 		if unknownManifest.CanBeDeletedAt.Before(j.timeNow()) {
 			//only call DeleteManifest if we can still see the manifest in the
 			//backing storage (this protects against unexpected errors e.g. because
 			//an operator deleted the manifest between the mark and sweep phases, or
 			//if we deleted the manifest from the backing storage in a previous
 			//sweep, but could not remove the unknown_manifests entry from the DB)
-			if isActualManifest[unknownManifestInfo] {
+			if s.isObservedMarkedManifest[unknownManifestInfo] {
 				logg.Info("storage sweep in account %s: removing manifest %s/%s",
-					account.Name, unknownManifest.RepositoryName, unknownManifest.Digest)
-				err := j.sd.DeleteManifest(account, unknownManifest.RepositoryName, unknownManifest.Digest)
+					s.account.Name, unknownManifest.RepositoryName, unknownManifest.Digest)
+				err := j.sd.DeleteManifest(s.account, unknownManifest.RepositoryName, unknownManifest.Digest)
 				if err != nil {
 					return err
 				}
 			}
-			_, err = j.db.Delete(&unknownManifest) //nolint:gosec // Delete is not holding onto the pointer after it returns
+			_, err := j.db.Delete(&unknownManifest) //nolint:gosec // Delete is not holding onto the pointer after it returns
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	//mark phase: record newly discovered unknown manifests in the DB
-	for manifest := range isActualManifest {
-		if isKnownManifest[manifest] || isMarkedManifest[manifest] {
-			continue
-		}
-		err := j.db.Insert(&keppel.UnknownManifest{
-			AccountName:    account.Name,
-			RepositoryName: manifest.RepoName,
-			Digest:         manifest.Digest,
-			CanBeDeletedAt: canBeDeletedAt,
-		})
-		if err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
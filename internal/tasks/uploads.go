@@ -21,7 +21,6 @@ package tasks
 import (
 	"database/sql"
 	"fmt"
-	"time"
 
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
@@ -45,8 +44,9 @@ var findAccountForRepoQuery = sqlext.SimplifyWhitespace(`
 `)
 
 // DeleteNextAbandonedUpload cleans up uploads that have not been updated for more
-// than a day. At most one upload is cleaned up per call. If no upload needs to
-// be cleaned up, sql.ErrNoRows is returned.
+// than a day (or the threshold given to SetAbandonedUploadThreshold()). At most
+// one upload is cleaned up per call. If no upload needs to be cleaned up,
+// sql.ErrNoRows is returned.
 func (j *Janitor) DeleteNextAbandonedUpload() (returnErr error) {
 	defer func() {
 		if returnErr == nil {
@@ -66,7 +66,7 @@ func (j *Janitor) DeleteNextAbandonedUpload() (returnErr error) {
 
 	//find upload
 	var upload keppel.Upload
-	maxUpdatedAt := j.timeNow().Add(-24 * time.Hour)
+	maxUpdatedAt := j.timeNow().Add(-j.abandonedUploadThreshold)
 	err = tx.SelectOne(&upload, abandonedUploadSearchQuery, maxUpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -22,14 +22,19 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
 )
 
 var (
@@ -120,6 +125,139 @@ func testDeleteUpload(t *testing.T, setupUploadObject func(keppel.StorageDriver,
 	expectNoRows(t, j.DeleteNextAbandonedUpload())
 }
 
+func TestDeleteAbandonedUploadWithCustomThreshold(t *testing.T) {
+	j, s := setup(t)
+	j.SetAbandonedUploadThreshold(1 * time.Hour)
+
+	//create one stale and one fresh upload
+	s.Clock.StepBy(48 * time.Hour)
+	staleUpload := keppel.Upload{
+		RepositoryID: 1,
+		UUID:         uuid.Must(uuid.NewV4()).String(),
+		StorageID:    keppel.GenerateStorageID(),
+		UpdatedAt:    s.Clock.Now().Add(-90 * time.Minute),
+	}
+	freshUpload := keppel.Upload{
+		RepositoryID: 1,
+		UUID:         uuid.Must(uuid.NewV4()).String(),
+		StorageID:    keppel.GenerateStorageID(),
+		UpdatedAt:    s.Clock.Now().Add(-30 * time.Minute),
+	}
+	for _, upload := range []*keppel.Upload{&staleUpload, &freshUpload} {
+		err := s.DB.Insert(upload)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//only the stale upload shall be cleaned up
+	err := j.DeleteNextAbandonedUpload()
+	if err != nil {
+		t.Errorf("expected no error, but got: %s", err.Error())
+	}
+	expectNoRows(t, j.DeleteNextAbandonedUpload())
+	var remainingUUIDs []string
+	_, err = s.DB.Select(&remainingUUIDs, `SELECT uuid FROM uploads`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "remaining uploads", remainingUUIDs, []string{freshUpload.UUID})
+
+	//once the fresh upload also becomes stale, it gets cleaned up as well
+	s.Clock.StepBy(time.Hour)
+	err = j.DeleteNextAbandonedUpload()
+	if err != nil {
+		t.Errorf("expected no error, but got: %s", err.Error())
+	}
+	expectNoRows(t, j.DeleteNextAbandonedUpload())
+}
+
+func TestHeartbeatPreventsUploadCleanup(t *testing.T) {
+	j, s := setup(t)
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+	blob := test.NewBytes([]byte("just some test data"))
+	chunk1, chunk2 := blob.Contents[0:10], blob.Contents[10:]
+
+	//start an upload and push the first chunk
+	s.Clock.StepBy(48 * time.Hour)
+	resp, _ := assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/v2/test1/foo/blobs/uploads/",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, s.Handler)
+	resp, _ = assert.HTTPRequest{
+		Method:       "PATCH",
+		Path:         resp.Header.Get("Location"),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		Body:         assert.ByteData(chunk1),
+		ExpectStatus: http.StatusAccepted,
+		ExpectHeader: map[string]string{"Range": fmt.Sprintf("0-%d", len(chunk1)-1)},
+	}.Check(t, s.Handler)
+	uploadURL := resp.Header.Get("Location")
+
+	//while the client is busy, it keeps the upload alive with empty PATCH
+	//requests, which do not change the upload state
+	for i := 0; i < 3; i++ {
+		s.Clock.StepBy(20 * time.Hour)
+		resp, _ = assert.HTTPRequest{
+			Method:       "PATCH",
+			Path:         uploadURL,
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusAccepted,
+			ExpectHeader: map[string]string{"Range": fmt.Sprintf("0-%d", len(chunk1)-1)},
+		}.Check(t, s.Handler)
+		assert.DeepEqual(t, "upload URL after heartbeat", resp.Header.Get("Location"), uploadURL)
+	}
+
+	//since the last heartbeat is recent, the upload does not get cleaned up
+	//(even though the last chunk was pushed more than two days ago)
+	s.Clock.StepBy(3 * time.Hour)
+	expectNoRows(t, j.DeleteNextAbandonedUpload())
+	var numChunks uint32
+	err := s.DB.SelectOne(&numChunks, `SELECT num_chunks FROM uploads`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of chunks", numChunks, uint32(1))
+
+	//the upload can be finished normally after the heartbeats
+	resp, _ = assert.HTTPRequest{
+		Method:       "PATCH",
+		Path:         uploadURL,
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		Body:         assert.ByteData(chunk2),
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, s.Handler)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         keppel.AppendQuery(resp.Header.Get("Location"), url.Values{"digest": {blob.Digest.String()}}),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, s.Handler)
+
+	//without heartbeats, an upload gets cleaned up as usual
+	resp, _ = assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/v2/test1/foo/blobs/uploads/",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, s.Handler)
+	assert.HTTPRequest{
+		Method:       "PATCH",
+		Path:         resp.Header.Get("Location"),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		Body:         assert.ByteData(chunk1),
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, s.Handler)
+	s.Clock.StepBy(25 * time.Hour)
+	err = j.DeleteNextAbandonedUpload()
+	if err != nil {
+		t.Errorf("expected no error, but got: %s", err.Error())
+	}
+	expectNoRows(t, j.DeleteNextAbandonedUpload())
+}
+
 func expectNoRows(t *testing.T, err error) {
 	t.Helper()
 	switch err {
@@ -22,6 +22,10 @@ package test
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ecdsa"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -31,6 +35,7 @@ import (
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sapcc/go-bits/assert"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -216,6 +221,63 @@ func GenerateImageWithCustomConfig(change func(map[string]interface{}), layers .
 	}
 }
 
+// WithOCIAnnotations converts this image's manifest into the OCI format and
+// adds the given annotations to it.
+func (i Image) WithOCIAnnotations(annotations map[string]string) Image {
+	converted, _, err := keppel.ConvertManifestToOCI(i.Manifest.MediaType, i.Manifest.Contents)
+	if err != nil {
+		panic(err.Error())
+	}
+	var manifestData map[string]interface{}
+	err = json.Unmarshal(converted, &manifestData)
+	if err != nil {
+		panic(err.Error())
+	}
+	manifestData["annotations"] = annotations
+	manifestBytes, err := json.Marshal(manifestData)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	i.Manifest = newBytesWithMediaType(manifestBytes, imagespec.MediaTypeImageManifest)
+	return i
+}
+
+// WithOCISubject converts this image's manifest into the OCI format and makes
+// it refer to the given manifest through its "subject" field, as used by
+// signatures and other artifacts. If artifactType is not empty, it is written
+// into the "artifactType" field.
+func (i Image) WithOCISubject(subject Bytes, artifactType string) Image {
+	manifestBytes := i.Manifest.Contents
+	if i.Manifest.MediaType != imagespec.MediaTypeImageManifest {
+		var err error
+		manifestBytes, _, err = keppel.ConvertManifestToOCI(i.Manifest.MediaType, i.Manifest.Contents)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	var manifestData map[string]interface{}
+	err := json.Unmarshal(manifestBytes, &manifestData)
+	if err != nil {
+		panic(err.Error())
+	}
+	manifestData["subject"] = map[string]interface{}{
+		"mediaType": subject.MediaType,
+		"size":      len(subject.Contents),
+		"digest":    subject.Digest.String(),
+	}
+	if artifactType != "" {
+		manifestData["artifactType"] = artifactType
+	}
+	manifestBytes, err = json.Marshal(manifestData)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	i.Manifest = newBytesWithMediaType(manifestBytes, imagespec.MediaTypeImageManifest)
+	return i
+}
+
 // SizeBytes returns the value that we expect in the DB column
 // `manifests.size_bytes` for this image.
 func (i Image) SizeBytes() uint64 {
@@ -293,3 +355,104 @@ func (l ImageList) DigestRef() keppel.ManifestReference {
 func makeTimestamp(seconds int) string {
 	return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339Nano)
 }
+
+// GenerateCosignSignature makes an Image that looks like a cosign signature
+// for the given subject manifest, signed with the given key. The result
+// refers to the subject through its "subject" field, so it will be found by
+// the referrers API.
+func GenerateCosignSignature(subject Bytes, key *ecdsa.PrivateKey) Image {
+	payloadBytes, err := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]interface{}{"docker-reference": "registry.example.org/test1/foo"},
+			"image":    map[string]interface{}{"docker-manifest-digest": subject.Digest.String()},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	payload := newBytesWithMediaType(payloadBytes, keppel.CosignSimpleSigningMediaType)
+
+	hash := sha256.Sum256(payloadBytes)
+	signature, err := ecdsa.SignASN1(crand.Reader, key, hash[:])
+	if err != nil {
+		panic(err.Error())
+	}
+
+	config := newBytesWithMediaType([]byte("{}"), imagespec.MediaTypeImageConfig)
+	manifestBytes, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imagespec.MediaTypeImageManifest,
+		"artifactType":  "application/vnd.dev.cosign.artifact.sig.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": config.MediaType,
+			"size":      len(config.Contents),
+			"digest":    config.Digest.String(),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": payload.MediaType,
+			"size":      len(payload.Contents),
+			"digest":    payload.Digest.String(),
+			"annotations": map[string]string{
+				keppel.CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+			},
+		}},
+		"subject": map[string]interface{}{
+			"mediaType": subject.MediaType,
+			"size":      len(subject.Contents),
+			"digest":    subject.Digest.String(),
+		},
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return Image{
+		Layers:   []Bytes{payload},
+		Config:   config,
+		Manifest: newBytesWithMediaType(manifestBytes, imagespec.MediaTypeImageManifest),
+	}
+}
+
+// GenerateHelmChart makes an Image that looks like a Helm chart pushed as an
+// OCI artifact. The chart content is generated from the given seed like in
+// GenerateExampleLayer().
+func GenerateHelmChart(seed int64) Image {
+	chart := GenerateExampleLayer(seed)
+	chart = newBytesWithMediaType(chart.Contents, keppel.HelmChartContentLayerMediaType)
+
+	configBytes, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v2",
+		"name":       "example",
+		"version":    fmt.Sprintf("0.1.%d", seed),
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	config := newBytesWithMediaType(configBytes, keppel.HelmChartConfigMediaType)
+
+	manifestBytes, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imagespec.MediaTypeImageManifest,
+		"config": map[string]interface{}{
+			"mediaType": config.MediaType,
+			"size":      len(config.Contents),
+			"digest":    config.Digest.String(),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": chart.MediaType,
+			"size":      len(chart.Contents),
+			"digest":    chart.Digest.String(),
+		}},
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return Image{
+		Layers:   []Bytes{chart},
+		Config:   config,
+		Manifest: newBytesWithMediaType(manifestBytes, imagespec.MediaTypeImageManifest),
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/go-redis/redis/v8"
+
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
@@ -39,10 +41,12 @@ type inboundCacheEntry struct {
 	Contents   []byte
 	MediaType  string
 	InsertedAt time.Time
+	//only set for negative entries
+	NotFoundUntil *time.Time
 }
 
 func init() {
-	keppel.RegisterInboundCacheDriver("unittest", func(_ keppel.Configuration) (keppel.InboundCacheDriver, error) {
+	keppel.RegisterInboundCacheDriver("unittest", func(_ keppel.Configuration, _ *redis.Client) (keppel.InboundCacheDriver, error) {
 		defaultMaxAge := 6 * time.Hour
 		return &InboundCacheDriver{defaultMaxAge, make(map[keppel.ImageReference]inboundCacheEntry)}, nil
 	})
@@ -52,6 +56,12 @@ func init() {
 func (d *InboundCacheDriver) LoadManifest(location keppel.ImageReference, now time.Time) (contents []byte, mediaType string, err error) {
 	maxInsertedAt := now.Add(-d.MaxAge)
 	entry, ok := d.Entries[location]
+	if ok && entry.NotFoundUntil != nil {
+		if entry.NotFoundUntil.After(now) {
+			return nil, "", keppel.ErrManifestNotFoundUpstream
+		}
+		return nil, "", sql.ErrNoRows
+	}
 	if ok && entry.InsertedAt.After(maxInsertedAt) {
 		return entry.Contents, entry.MediaType, nil
 	}
@@ -60,6 +70,13 @@ func (d *InboundCacheDriver) LoadManifest(location keppel.ImageReference, now ti
 
 // StoreManifest implements the keppel.InboundCacheDriver interface.
 func (d *InboundCacheDriver) StoreManifest(location keppel.ImageReference, contents []byte, mediaType string, now time.Time) error {
-	d.Entries[location] = inboundCacheEntry{contents, mediaType, now}
+	d.Entries[location] = inboundCacheEntry{contents, mediaType, now, nil}
+	return nil
+}
+
+// StoreManifestNotFound implements the keppel.InboundCacheDriver interface.
+func (d *InboundCacheDriver) StoreManifestNotFound(location keppel.ImageReference, now time.Time, ttl time.Duration) error {
+	notFoundUntil := now.Add(ttl)
+	d.Entries[location] = inboundCacheEntry{nil, "", now, &notFoundUntil}
 	return nil
 }
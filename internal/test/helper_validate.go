@@ -32,6 +32,9 @@ func (s Setup) ExpectBlobsExistInStorage(t *testing.T, blobs ...keppel.Blob) {
 	t.Helper()
 	for _, blob := range blobs {
 		account := keppel.Account{Name: blob.AccountName}
+		if blob.StorageAccountName != "" {
+			account.Name = blob.StorageAccountName
+		}
 		readCloser, sizeBytes, err := s.SD.ReadBlob(account, blob.StorageID)
 		if err != nil {
 			t.Errorf("expected blob %s to exist in the storage, but got: %s", blob.Digest, err.Error())
@@ -71,6 +74,9 @@ func (s Setup) ExpectBlobsMissingInStorage(t *testing.T, blobs ...keppel.Blob) {
 	t.Helper()
 	for _, blob := range blobs {
 		account := keppel.Account{Name: blob.AccountName}
+		if blob.StorageAccountName != "" {
+			account.Name = blob.StorageAccountName
+		}
 		_, _, err := s.SD.ReadBlob(account, blob.StorageID)
 		if err == nil {
 			t.Errorf("expected blob %s to be missing in the storage, but could read it", blob.Digest)
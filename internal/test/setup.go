@@ -23,7 +23,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/easypg"
 	"github.com/sapcc/go-bits/httpapi"
@@ -38,22 +40,33 @@ import (
 	"github.com/sapcc/keppel/internal/clair"
 	"github.com/sapcc/keppel/internal/drivers/trivial"
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 type setupParams struct {
 	//all false/empty by default
-	IsSecondary             bool
-	WithAnycast             bool
-	WithKeppelAPI           bool
-	WithPeerAPI             bool
-	WithClairDouble         bool
-	WithQuotas              bool
-	WithPreviousIssuerKey   bool
-	WithoutCurrentIssuerKey bool
-	RateLimitEngine         *keppel.RateLimitEngine
-	SetupOfPrimary          *Setup
-	Accounts                []*keppel.Account
-	Repos                   []*keppel.Repository
+	IsSecondary                 bool
+	WithAnycast                 bool
+	WithKeppelAPI               bool
+	WithPeerAPI                 bool
+	WithClairDouble             bool
+	WithQuotas                  bool
+	WithPreviousIssuerKey       bool
+	WithoutCurrentIssuerKey     bool
+	RateLimitEngine             *keppel.RateLimitEngine
+	InboundCacheNegativeTTL     time.Duration
+	PeeringMode                 keppel.PeeringMode
+	DisableAnonymousAccess      bool
+	ForbiddenRepoNamePatterns   []string
+	DefaultGCPolicies           []keppel.GCPolicy
+	EnableCrossAccountBlobDedup bool
+	LastPulledDebounceInterval  time.Duration
+	CompressManifestContents    bool
+	MaxManifestBodySizeBytes    uint64
+	MaxBlobBodySizeBytes        uint64
+	SetupOfPrimary              *Setup
+	Accounts                    []*keppel.Account
+	Repos                       []*keppel.Repository
 }
 
 // SetupOption is an option that can be given to NewSetup().
@@ -104,6 +117,82 @@ func WithRateLimitEngine(rle *keppel.RateLimitEngine) SetupOption {
 	}
 }
 
+// WithInboundCacheNegativeTTL is a SetupOption that enables negative entries
+// in the inbound cache with the given TTL.
+func WithInboundCacheNegativeTTL(ttl time.Duration) SetupOption {
+	return func(params *setupParams) {
+		params.InboundCacheNegativeTTL = ttl
+	}
+}
+
+// WithPeeringMode is a SetupOption that overrides the default peering mode
+// (keppel.PeeringModePassword).
+func WithPeeringMode(mode keppel.PeeringMode) SetupOption {
+	return func(params *setupParams) {
+		params.PeeringMode = mode
+	}
+}
+
+// WithoutAnonymousAccess is a SetupOption that sets
+// keppel.Configuration.DisableAnonymousAccess.
+func WithoutAnonymousAccess(params *setupParams) {
+	params.DisableAnonymousAccess = true
+}
+
+// WithCrossAccountBlobDedup is a SetupOption that sets
+// keppel.Configuration.EnableCrossAccountBlobDedup.
+func WithCrossAccountBlobDedup(params *setupParams) {
+	params.EnableCrossAccountBlobDedup = true
+}
+
+// WithManifestContentCompression is a SetupOption that sets
+// keppel.Configuration.CompressManifestContents.
+func WithManifestContentCompression(params *setupParams) {
+	params.CompressManifestContents = true
+}
+
+// WithMaxManifestBodySize is a SetupOption that sets
+// keppel.Configuration.MaxManifestBodySizeBytes.
+func WithMaxManifestBodySize(limit uint64) SetupOption {
+	return func(params *setupParams) {
+		params.MaxManifestBodySizeBytes = limit
+	}
+}
+
+// WithMaxBlobBodySize is a SetupOption that sets
+// keppel.Configuration.MaxBlobBodySizeBytes.
+func WithMaxBlobBodySize(limit uint64) SetupOption {
+	return func(params *setupParams) {
+		params.MaxBlobBodySizeBytes = limit
+	}
+}
+
+// WithLastPulledDebounceInterval is a SetupOption that sets
+// keppel.Configuration.LastPulledDebounceInterval. Since there is no
+// background goroutine in tests, the test needs to call
+// Setup.LPD.Flush() explicitly.
+func WithLastPulledDebounceInterval(interval time.Duration) SetupOption {
+	return func(params *setupParams) {
+		params.LastPulledDebounceInterval = interval
+	}
+}
+
+// WithForbiddenRepoNamePatterns is a SetupOption that fills
+// keppel.Configuration.ForbiddenRepoNamePatterns.
+func WithForbiddenRepoNamePatterns(patterns ...string) SetupOption {
+	return func(params *setupParams) {
+		params.ForbiddenRepoNamePatterns = append(params.ForbiddenRepoNamePatterns, patterns...)
+	}
+}
+
+// WithDefaultGCPolicies is a SetupOption that fills
+// keppel.Configuration.DefaultGCPolicies.
+func WithDefaultGCPolicies(policies ...keppel.GCPolicy) SetupOption {
+	return func(params *setupParams) {
+		params.DefaultGCPolicies = append(params.DefaultGCPolicies, policies...)
+	}
+}
+
 // WithAccount is a SetupOption that adds the given keppel.Account to the DB during NewSetup().
 func WithAccount(account keppel.Account) SetupOption {
 	return func(params *setupParams) {
@@ -144,6 +233,8 @@ type Setup struct {
 	FD           *FederationDriver
 	SD           *trivial.StorageDriver
 	ICD          *InboundCacheDriver
+	PullCounter  *keppel.PullCounter
+	LPD          *keppel.LastPulledDebouncer
 	Handler      http.Handler
 	//fields that are only set if the respective With... setup option is included
 	ClairDouble *ClairDouble
@@ -178,7 +269,7 @@ func GetReplicationPassword() string {
 func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	t.Helper()
 	logg.ShowDebug = osext.GetenvBool("KEPPEL_DEBUG")
-	var params setupParams
+	params := setupParams{PeeringMode: keppel.PeeringModePassword}
 	for _, option := range opts {
 		option(&params)
 	}
@@ -204,11 +295,22 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	mustDo(t, err)
 	s := Setup{
 		Config: keppel.Configuration{
-			APIPublicHostname: apiPublicHostname,
-			DatabaseURL:       dbURL,
+			APIPublicHostname:           apiPublicHostname,
+			DatabaseURL:                 dbURL,
+			InboundCacheNegativeTTL:     params.InboundCacheNegativeTTL,
+			PeeringMode:                 params.PeeringMode,
+			DisableAnonymousAccess:      params.DisableAnonymousAccess,
+			DefaultGCPolicies:           params.DefaultGCPolicies,
+			EnableCrossAccountBlobDedup: params.EnableCrossAccountBlobDedup,
+			LastPulledDebounceInterval:  params.LastPulledDebounceInterval,
+			CompressManifestContents:    params.CompressManifestContents,
+			MaxManifestBodySizeBytes:    params.MaxManifestBodySizeBytes,
+			MaxBlobBodySizeBytes:        params.MaxBlobBodySizeBytes,
 		},
 		tokenCache: make(map[string]string),
 	}
+	s.Config.ForbiddenRepoNamePatterns, err = keppel.ParseRepoNamePatterns(strings.Join(params.ForbiddenRepoNamePatterns, " "))
+	mustDo(t, err)
 
 	//select issuer keys
 	if params.WithoutCurrentIssuerKey && !params.WithPreviousIssuerKey {
@@ -303,24 +405,28 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	sd, err := keppel.NewStorageDriver("in-memory-for-testing", ad, s.Config)
 	mustDo(t, err)
 	s.SD = sd.(*trivial.StorageDriver) //nolint:errcheck
-	icd, err := keppel.NewInboundCacheDriver("unittest", s.Config)
+	icd, err := keppel.NewInboundCacheDriver("unittest", s.Config, nil)
 	mustDo(t, err)
 	s.ICD = icd.(*InboundCacheDriver) //nolint:errcheck
 
 	//setup APIs
+	s.PullCounter = keppel.NewPullCounter(s.DB)
+	s.LPD = keppel.NewLastPulledDebouncer(s.DB)
+	ufl := processor.NewUpstreamFetchLimiter(s.Config.MaxConcurrentUpstreamFetches)
 	apis := []httpapi.API{
 		httpapi.WithoutLogging(),
 		//Registry API (and thus Auth API) are nearly always needed for
 		//Bytes.Upload, Image.Upload and ImageList.Upload
-		registryv2.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor, params.RateLimitEngine).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next),
+		registryv2.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor, params.RateLimitEngine, s.PullCounter, s.LPD, ufl).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next),
 		authapi.NewAPI(s.Config, ad, fd, s.DB),
 	}
 	if params.WithKeppelAPI {
-		apis = append(apis, keppelv1.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor))
+		apis = append(apis, keppelv1.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor, ufl).OverrideTimeNow(s.Clock.Now))
 	}
 	if params.WithPeerAPI {
 		apis = append(apis, peerv1.NewAPI(s.Config, ad, s.DB))
 	}
+	apis = append(apis, httpapi.WithGlobalMiddleware(keppel.RequestIDMiddleware))
 	s.Handler = httpapi.Compose(apis...)
 	if tt, ok := http.DefaultTransport.(*RoundTripper); ok {
 		//make our own API reachable to other peers
@@ -369,6 +475,21 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	return s
 }
 
+// ReadOnlyRegistryHandler returns a handler for the Registry API that behaves
+// like keppel-api with KEPPEL_READONLY set, but otherwise shares everything
+// with this Setup. (Setup.Handler stays writable since tests need it to put
+// images in place.)
+func (s Setup) ReadOnlyRegistryHandler() http.Handler {
+	cfg := s.Config
+	cfg.ReadOnly = true
+	return httpapi.Compose(
+		httpapi.WithoutLogging(),
+		registryv2.NewAPI(cfg, s.AD, s.FD, s.SD, s.ICD, s.DB, s.Auditor, nil, s.PullCounter, s.LPD, nil).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next),
+		httpapi.WithGlobalMiddleware(keppel.ReadOnlyMiddleware),
+		httpapi.WithGlobalMiddleware(keppel.RequestIDMiddleware),
+	)
+}
+
 func mustDo(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
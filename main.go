@@ -29,11 +29,16 @@ import (
 	apicmd "github.com/sapcc/keppel/cmd/api"
 	healthmonitorcmd "github.com/sapcc/keppel/cmd/healthmonitor"
 	janitorcmd "github.com/sapcc/keppel/cmd/janitor"
+	migratestoragecmd "github.com/sapcc/keppel/cmd/migratestorage"
 	validatecmd "github.com/sapcc/keppel/cmd/validate"
 
 	//include all known driver implementations
+	_ "github.com/sapcc/keppel/internal/drivers/azure"
 	_ "github.com/sapcc/keppel/internal/drivers/basic"
+	_ "github.com/sapcc/keppel/internal/drivers/gcs"
+	_ "github.com/sapcc/keppel/internal/drivers/ldap"
 	_ "github.com/sapcc/keppel/internal/drivers/multi"
+	_ "github.com/sapcc/keppel/internal/drivers/oidc"
 	_ "github.com/sapcc/keppel/internal/drivers/openstack"
 	_ "github.com/sapcc/keppel/internal/drivers/redis"
 	_ "github.com/sapcc/keppel/internal/drivers/trivial"
@@ -68,6 +73,7 @@ func main() {
 	apicmd.AddCommandTo(serverCmd)
 	healthmonitorcmd.AddCommandTo(serverCmd)
 	janitorcmd.AddCommandTo(serverCmd)
+	migratestoragecmd.AddCommandTo(serverCmd)
 	rootCmd.AddCommand(serverCmd)
 
 	must.Succeed(rootCmd.Execute())